@@ -0,0 +1,373 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/cache"
+)
+
+const (
+	cookieAccount = cookiePrefix + "account"
+
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt ignores the rest
+	maxAccounts       = 10000
+	maxLoginFailures  = 5 // failed logins in a row locking an address out
+	loginLockout      = 15 * time.Minute
+)
+
+// loginRateLimit bounds the logins of each client IP, whatever the
+// addresses tried: ten at once, then one every ten seconds.
+var loginRateLimit = rateLimit{rate: 0.1, burst: 10}
+
+var (
+	errAccountExists        = errors.New("an account with this e-mail address already exists")
+	errTooManyAccounts      = errors.New("no more accounts can be created")
+	errBadCredentials       = errors.New("wrong e-mail address or password")
+	errLoginLocked          = errors.New("too many failed logins")
+	errLoginRateLimited     = errors.New("too many logins from the client")
+	errInvalidAccountCookie = errors.New("invalid account cookie")
+)
+
+// accountCartPrefix starts the cart IDs of accounts, so that they are never
+// taken for a session ID, which is a bare UUID.
+const accountCartPrefix = "account-"
+
+type ctxKeyAccount struct{}
+
+// account is a shopper who signed up. Its cart is kept by the cart service
+// under CartID, drawn at random on signup, so it stays the same for the
+// life of the account, is not lost by logging out, and cannot be guessed
+// from the e-mail address.
+type account struct {
+	Email  string
+	CartID string
+	hash   []byte
+}
+
+// loginFailures counts the failed logins of an address since its last
+// successful one.
+type loginFailures struct {
+	count int
+}
+
+// accountStore keeps the accounts in memory, like the other state of the
+// frontend: they are lost on restart and not shared between replicas. A
+// nil *accountStore disables accounts.
+type accountStore struct {
+	key  []byte // signs account cookies
+	cost int    // of the bcrypt password hashes
+
+	mu       sync.Mutex
+	byEmail  map[string]*account
+	byCartID map[string]*account
+
+	failures *cache.Cache // by e-mail address, forgotten after loginLockout
+	dummy    []byte       // compared with for unknown addresses
+
+	logins *rateLimiter // by client IP
+}
+
+func newAccountStore(key []byte, cost int) *accountStore {
+	// A password is compared with this hash when the address is unknown,
+	// so that a login takes as long whether the account exists or not.
+	dummy, _ := bcrypt.GenerateFromPassword([]byte("not a password"), cost)
+	return &accountStore{
+		key:      key,
+		cost:     cost,
+		byEmail:  make(map[string]*account),
+		byCartID: make(map[string]*account),
+		failures: cache.New(maxAccounts),
+		dummy:    dummy,
+		logins:   newRateLimiter(loginRateLimit, nil, false),
+	}
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// signup creates an account.
+func (s *accountStore) signup(email, password string) (*account, error) {
+	email = normalizeEmail(email)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), s.cost)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to hash the password")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byEmail[email]; ok {
+		return nil, errAccountExists
+	}
+	if len(s.byEmail) >= maxAccounts {
+		return nil, errTooManyAccounts
+	}
+	a := &account{
+		Email:  email,
+		CartID: accountCartPrefix + uuid.New().String(),
+		hash:   hash,
+	}
+	s.byEmail[email] = a
+	s.byCartID[a.CartID] = a
+	return a, nil
+}
+
+// login returns the account of the address if the password is right, for
+// a login from the client at ip. After maxLoginFailures wrong passwords in
+// a row, the address is locked out for loginLockout, whatever the
+// password; a client over loginRateLimit is turned away before any
+// password is checked.
+func (s *accountStore) login(ip, email, password string) (*account, error) {
+	if _, ok, _ := s.logins.allow("", "ip:"+ip); !ok {
+		return nil, errLoginRateLimited
+	}
+	email = normalizeEmail(email)
+	s.mu.Lock()
+	if v, ok := s.failures.Get(email); ok && v.(*loginFailures).count >= maxLoginFailures {
+		s.mu.Unlock()
+		return nil, errLoginLocked
+	}
+	a := s.byEmail[email]
+	s.mu.Unlock()
+
+	hash := s.dummy
+	if a != nil {
+		hash = a.hash
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || a == nil {
+		// Counted under the lock, for concurrent failures to add up.
+		s.mu.Lock()
+		failures := &loginFailures{}
+		if v, ok := s.failures.Get(email); ok {
+			failures = v.(*loginFailures)
+		}
+		failures.count++
+		s.failures.Set(email, failures, loginLockout)
+		s.mu.Unlock()
+		return nil, errBadCredentials
+	}
+	s.mu.Lock()
+	s.failures.Take(email)
+	s.mu.Unlock()
+	return a, nil
+}
+
+// sign returns the account cookie value, "<cart ID>.<expiry>.<signature>".
+func (s *accountStore) sign(a *account, expires time.Time) string {
+	payload := a.CartID + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.mac(payload))
+}
+
+// verify returns the account of a cookie value made by sign, if it has not
+// expired.
+func (s *accountStore) verify(value string, now time.Time) (*account, error) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return nil, errInvalidAccountCookie
+	}
+	payload := value[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil || !hmac.Equal(sig, s.mac(payload)) {
+		return nil, errInvalidAccountCookie
+	}
+	parts := strings.SplitN(payload, ".", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidAccountCookie
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.After(time.Unix(expires, 0)) {
+		return nil, errInvalidAccountCookie
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.byCartID[parts[0]]
+	if !ok {
+		return nil, errInvalidAccountCookie // created before a restart
+	}
+	return a, nil
+}
+
+func (s *accountStore) mac(payload string) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// identifyAccount puts the account of a valid account cookie in the
+// request context.
+func (fe *frontendServer) identifyAccount(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(cookieAccount); err == nil {
+			if a, err := fe.accounts.verify(c.Value, fe.clock.Now()); err == nil {
+				r = r.WithContext(context.WithValue(r.Context(), ctxKeyAccount{}, a))
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// accountFrom returns the signed-in account of the request, or nil.
+func accountFrom(r *http.Request) *account {
+	a, _ := r.Context().Value(ctxKeyAccount{}).(*account)
+	return a
+}
+
+// cartID is the user ID the cart of the request is kept under by the cart
+// service: the account's when signed in, the session's otherwise.
+func cartID(r *http.Request) string {
+	if a := accountFrom(r); a != nil {
+		return a.CartID
+	}
+	return sessionID(r)
+}
+
+func (fe *frontendServer) signupFormHandler(w http.ResponseWriter, r *http.Request) {
+	fe.renderAccountForm(w, r, formSignup)
+}
+
+func (fe *frontendServer) loginFormHandler(w http.ResponseWriter, r *http.Request) {
+	fe.renderAccountForm(w, r, formLogin)
+}
+
+func (fe *frontendServer) renderAccountForm(w http.ResponseWriter, r *http.Request, form string) {
+	fe.render(w, r, http.StatusOK, "account", fe.injectCommonTemplateData(r, map[string]interface{}{
+		"account_form": form,
+	}))
+}
+
+// validateAccountForm checks the fields of the signup and login forms. Only
+// the address is kept to fill the form again.
+func validateAccountForm(r *http.Request, form string) *formState {
+	f := newFormState(form)
+	f.Values["email"] = r.FormValue("email")
+	if strings.TrimSpace(r.FormValue("email")) == "" {
+		f.add("email", "Enter an e-mail address")
+	} else if _, err := mail.ParseAddress(r.FormValue("email")); err != nil {
+		f.add("email", "Enter an e-mail address like name@example.com")
+	}
+	password := r.FormValue("password")
+	switch {
+	case password == "":
+		f.add("password", "Enter a password")
+	case form == formSignup && len(password) < minPasswordLength:
+		f.add("password", "Choose a password of at least "+strconv.Itoa(minPasswordLength)+" characters")
+	case form == formSignup && len(password) > maxPasswordLength:
+		f.add("password", "Choose a password of at most "+strconv.Itoa(maxPasswordLength)+" bytes")
+	}
+	if len(f.Errors) == 0 {
+		return nil
+	}
+	return f
+}
+
+func (fe *frontendServer) signupHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	if f := validateAccountForm(r, formSignup); f != nil {
+		fe.rejectForm(w, r, f, "/signup")
+		return
+	}
+	a, err := fe.accounts.signup(r.FormValue("email"), r.FormValue("password"))
+	switch err {
+	case nil:
+	case errAccountExists, errTooManyAccounts:
+		f := newFormState(formSignup)
+		f.Values["email"] = r.FormValue("email")
+		if err == errAccountExists {
+			f.add("email", "An account with this e-mail address already exists, log in instead")
+		} else {
+			f.add("email", "No more accounts can be created at the moment")
+		}
+		fe.rejectForm(w, r, f, "/signup")
+		return
+	default:
+		fe.renderHTTPError(log, r, w, err, http.StatusInternalServerError)
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"event":   "account_created",
+		"account": hashSessionID(a.CartID),
+	}).Info("account created")
+	fe.signIn(w, r, log, a)
+}
+
+func (fe *frontendServer) loginHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	if f := validateAccountForm(r, formLogin); f != nil {
+		fe.rejectForm(w, r, f, "/login")
+		return
+	}
+	a, err := fe.accounts.login(fe.clientIP(r), r.FormValue("email"), r.FormValue("password"))
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":        "login_failed",
+			"locked":       err == errLoginLocked,
+			"rate_limited": err == errLoginRateLimited,
+		}).Warn("failed login")
+		f := newFormState(formLogin)
+		f.Values["email"] = r.FormValue("email")
+		switch err {
+		case errLoginLocked:
+			f.add("email", "Too many failed attempts, try again in "+strconv.Itoa(int(loginLockout/time.Minute))+" minutes")
+		case errLoginRateLimited:
+			f.add("email", "Too many attempts from your network, try again in a few seconds")
+		default:
+			f.add("password", "Wrong e-mail address or password")
+		}
+		fe.rejectForm(w, r, f, "/login")
+		return
+	}
+	fe.signIn(w, r, log, a)
+}
+
+// signIn sets the account cookie and merges the anonymous cart of the
+// session into the account's. Signing in again while signed in to another
+// account leaves both carts as they are.
+func (fe *frontendServer) signIn(w http.ResponseWriter, r *http.Request, log logrus.FieldLogger, a *account) {
+	if accountFrom(r) == nil {
+		moved, dropped, err := fe.mergeCart(r.Context(), sessionID(r), a.CartID)
+		if err != nil {
+			log.WithField("error", err).Warn("failed to merge the anonymous cart into the account's")
+		}
+		log.WithFields(logrus.Fields{
+			"event":   "account_login",
+			"account": hashSessionID(a.CartID),
+			"moved":   moved,
+			"dropped": dropped,
+		}).Info("signed in")
+	}
+	c := fe.sessions.newCookie(cookieAccount, "")
+	c.Value = fe.accounts.sign(a, fe.clock.Now().Add(time.Duration(c.MaxAge)*time.Second))
+	c.HttpOnly = true
+	http.SetCookie(w, c)
+	// The remembered count is that of the anonymous cart.
+	http.SetCookie(w, &http.Cookie{Name: cookieCartCount, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
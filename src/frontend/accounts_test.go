@@ -0,0 +1,282 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func withAccounts(fe *frontendServer) {
+	fe.accounts = newAccountStore([]byte("test account key"), bcrypt.MinCost)
+}
+
+var shopper = url.Values{"email": {"Shopper@example.com"}, "password": {"correct horse"}}
+
+// userCart returns the quantity of each product in the cart of a user ID.
+func userCart(h *testHarness, userID string) map[string]int32 {
+	h.cart.mu.Lock()
+	defer h.cart.mu.Unlock()
+	out := make(map[string]int32)
+	for _, it := range h.cart.carts[userID] {
+		out[it.GetProductId()] = it.GetQuantity()
+	}
+	return out
+}
+
+func TestAccountsDisabledByDefault(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	if resp := h.get("/login"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /login = %d, want 404 without ACCOUNTS_ENABLED", resp.StatusCode)
+	}
+	if resp := h.get("/"); strings.Contains(resp.body, `id="account_nav"`) {
+		t.Error("account links shown with accounts disabled")
+	}
+}
+
+func TestLoginMergesCart(t *testing.T) {
+	h := newTestHarness(t, withAccounts)
+	defer h.close()
+	resp := h.post("/signup", shopper)
+	if !strings.Contains(resp.body, "Signed in as shopper@example.com") {
+		t.Fatal("not signed in after signing up")
+	}
+	a := h.fe.accounts.byEmail["shopper@example.com"]
+
+	// Logging out keeps the account's cart, the anonymous one is empty.
+	h.post("/cart", url.Values{"product_id": {"66VCHSJNUP"}, "quantity": {"2"}})
+	h.post("/logout", nil)
+	if resp := h.get("/cart"); !strings.Contains(resp.body, "View Cart (0)") || !strings.Contains(resp.body, `href="/login"`) {
+		t.Error("still signed in after logging out")
+	}
+	if q := userCart(h, a.CartID); q["66VCHSJNUP"] != 2 {
+		t.Fatalf("account cart after logout = %v, want 2 lenses", q)
+	}
+
+	// Meanwhile the account's lenses reached the limit in another session.
+	h.cart.mu.Lock()
+	max := int32(h.fe.cartMaxQuantity)
+	h.cart.carts[a.CartID] = []*pb.CartItem{{ProductId: "66VCHSJNUP", Quantity: max - 1}}
+	h.cart.mu.Unlock()
+
+	h.post("/cart", url.Values{"product_id": {"66VCHSJNUP"}, "quantity": {"3"}})
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	anonymous := h.cookie(cookieSessionID)
+	resp = h.post("/login", shopper)
+	if resp.Request.URL.Path != "/" || !strings.Contains(resp.body, "Signed in as shopper@example.com") {
+		t.Fatalf("login ended on %s without signing in", resp.Request.URL.Path)
+	}
+	q := userCart(h, a.CartID)
+	if q["66VCHSJNUP"] != max || q["OLJCESPC7Z"] != 1 {
+		t.Errorf("merged cart = %v, want %d lenses and 1 typewriter", q, max)
+	}
+	if q := userCart(h, anonymous); len(q) != 0 {
+		t.Errorf("anonymous cart not emptied by the merge: %v", q)
+	}
+	if !strings.Contains(resp.body, fmt.Sprintf("View Cart (%d)", max+1)) {
+		t.Error("cart badge does not count the merged cart")
+	}
+	if entries := h.logs.find("account_login"); len(entries) != 2 || entries[1].Data["moved"] != 2 {
+		t.Errorf("logins not logged with the merge: %v", entries)
+	}
+}
+
+func TestSignupRejected(t *testing.T) {
+	h := newTestHarness(t, withAccounts)
+	defer h.close()
+	resp := h.post("/signup", url.Values{"email": {"shopper"}, "password": {"short"}})
+	if ids := assertErrorAssociations(t, resp.body); strings.Join(ids, " ") != "email_error password_error" {
+		t.Errorf("error messages %v, want the address and the password", ids)
+	}
+	if u := resp.Request.URL; u.Path != "/signup" || u.Fragment != "signup_errors" {
+		t.Errorf("rejected signup redirected to %v, want /signup#signup_errors", u)
+	}
+
+	h.post("/signup", shopper)
+	h.post("/logout", nil)
+	resp = h.post("/signup", url.Values{"email": {"shopper@EXAMPLE.com"}, "password": {"another password"}})
+	if !strings.Contains(resp.body, "already exists") || strings.Contains(resp.body, "Signed in as") {
+		t.Error("second account created for the same address")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	clock := newFakeClock()
+	h := newTestHarness(t, withAccounts, withFakeClock(clock))
+	defer h.close()
+	h.post("/signup", shopper)
+	h.post("/logout", nil)
+
+	wrong := url.Values{"email": {"shopper@example.com"}, "password": {"wrong horse"}}
+	for i := 0; i < maxLoginFailures; i++ {
+		if resp := h.post("/login", wrong); !strings.Contains(resp.body, "Wrong e-mail address or password") {
+			t.Fatalf("wrong password %d not rejected", i+1)
+		}
+	}
+	resp := h.post("/login", shopper)
+	if !strings.Contains(resp.body, "Too many failed attempts") || strings.Contains(resp.body, "Signed in as") {
+		t.Fatal("locked out address signed in with the right password")
+	}
+	if entries := h.logs.find("login_failed"); len(entries) != maxLoginFailures+1 || entries[maxLoginFailures].Data["locked"] != true {
+		t.Errorf("failed logins not logged: %v", entries)
+	}
+
+	clock.Advance(loginLockout)
+	if resp := h.post("/login", shopper); !strings.Contains(resp.body, "Signed in as shopper@example.com") {
+		t.Error("still locked out after the lockout")
+	}
+}
+
+func TestLoginRateLimited(t *testing.T) {
+	clock := newFakeClock()
+	h := newTestHarness(t, withAccounts, withFakeClock(clock))
+	defer h.close()
+	h.post("/signup", shopper)
+	h.post("/logout", nil)
+
+	// Each address tried once, none locked out.
+	for i := 0; i < loginRateLimit.burst; i++ {
+		wrong := url.Values{"email": {fmt.Sprintf("shopper%d@example.com", i)}, "password": {"wrong horse"}}
+		if resp := h.post("/login", wrong); !strings.Contains(resp.body, "Wrong e-mail address or password") {
+			t.Fatalf("login %d not checked", i+1)
+		}
+	}
+	resp := h.post("/login", shopper)
+	if !strings.Contains(resp.body, "Too many attempts from your network") || strings.Contains(resp.body, "Signed in as") {
+		t.Fatal("client over the login limit signed in")
+	}
+	if entries := h.logs.find("login_failed"); len(entries) != loginRateLimit.burst+1 || entries[loginRateLimit.burst].Data["rate_limited"] != true {
+		t.Errorf("rate limited login not logged: %v", entries)
+	}
+	if _, err := h.fe.accounts.login("192.0.2.1", shopper.Get("email"), shopper.Get("password")); err != nil {
+		t.Errorf("login from another client: %v", err)
+	}
+
+	clock.Advance(loginRateLimit.refill())
+	if resp := h.post("/login", shopper); !strings.Contains(resp.body, "Signed in as shopper@example.com") {
+		t.Error("client still limited once its bucket refilled")
+	}
+}
+
+func TestLoginFailuresConcurrent(t *testing.T) {
+	s := newAccountStore([]byte("key"), bcrypt.MinCost)
+	if _, err := s.signup("shopper@example.com", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < maxLoginFailures; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.login(fmt.Sprintf("192.0.2.%d", i), "shopper@example.com", "wrong horse")
+		}(i)
+	}
+	wg.Wait()
+	if _, err := s.login("192.0.2.100", "shopper@example.com", "correct horse"); err != errLoginLocked {
+		t.Errorf("after %d concurrent failures: %v, want the address locked out", maxLoginFailures, err)
+	}
+}
+
+func TestLoginUnknownAddress(t *testing.T) {
+	h := newTestHarness(t, withAccounts)
+	defer h.close()
+	resp := h.post("/login", shopper)
+	if !strings.Contains(resp.body, "Wrong e-mail address or password") {
+		t.Error("unknown address not rejected like a wrong password")
+	}
+}
+
+func TestAccountCookie(t *testing.T) {
+	s := newAccountStore([]byte("key"), bcrypt.MinCost)
+	a, err := s.signup("shopper@example.com", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	value := s.sign(a, now.Add(time.Hour))
+	if got, err := s.verify(value, now); err != nil || got != a {
+		t.Fatalf("verify(sign(a)) = %v, %v", got, err)
+	}
+
+	other, _ := s.signup("other@example.com", "correct horse")
+	forged := other.CartID + value[strings.IndexByte(value, '.'):]
+	for name, v := range map[string]string{
+		"expired":   s.sign(a, now.Add(-time.Second)),
+		"forged":    forged,
+		"other key": newAccountStore([]byte("other key"), bcrypt.MinCost).sign(a, now.Add(time.Hour)),
+		"malformed": "shopper@example.com",
+	} {
+		if got, err := s.verify(v, now); err == nil {
+			t.Errorf("%s cookie verified as %s", name, got.Email)
+		}
+	}
+}
+
+func TestAccountCookieAttributes(t *testing.T) {
+	h := newTestHarness(t, withAccounts, func(fe *frontendServer) {
+		fe.sessions = &sessionManager{maxAge: time.Hour, secure: true, sameSite: http.SameSiteStrictMode}
+	})
+	defer h.close()
+
+	// Sent by hand: the client's jar keeps secure cookies off plain HTTP.
+	id := uuid.New().String()
+	form := url.Values{"email": shopper["email"], "password": shopper["password"], csrfField: {h.fe.csrfToken(id)}}
+	req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/signup", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", h.srv.URL+"/")
+	req.AddCookie(h.fe.sessions.cookie(id))
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	var c *http.Cookie
+	for _, rc := range res.Cookies() {
+		if rc.Name == cookieAccount {
+			c = rc
+		}
+	}
+	if c == nil {
+		t.Fatalf("no account cookie set, status %d", res.StatusCode)
+	}
+	if c.MaxAge != 3600 || !c.Secure || c.SameSite != http.SameSiteStrictMode || !c.HttpOnly || c.Path != "/" {
+		t.Errorf("account cookie = %+v, want one hour, secure, SameSite=Strict and HttpOnly", c)
+	}
+	if a, err := h.fe.accounts.verify(c.Value, h.fe.clock.Now().Add(59*time.Minute)); err != nil || a.Email != "shopper@example.com" {
+		t.Errorf("account cookie verified as %v, %v", a, err)
+	}
+}
+
+func TestAccountCartIDUnguessable(t *testing.T) {
+	a, _ := newAccountStore([]byte("key"), bcrypt.MinCost).signup("shopper@example.com", "correct horse")
+	b, _ := newAccountStore([]byte("key"), bcrypt.MinCost).signup("shopper@example.com", "correct horse")
+	if a.CartID == b.CartID {
+		t.Errorf("cart ID %s derived from the e-mail address", a.CartID)
+	}
+	if _, err := uuid.Parse(a.CartID); err == nil {
+		t.Errorf("cart ID %s can be taken for a session ID", a.CartID)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package adclient wraps the ad service client with the policies the
+// frontend needs for a decorative, non-essential backend: a short deadline,
+// validation of the returned ads, a short-lived cache of the last good ads
+// and a static fallback ("house ad").
+package adclient
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// Defaults used for the zero values of Config.
+const (
+	DefaultTimeout       = 100 * time.Millisecond
+	DefaultCacheTTL      = 5 * time.Second
+	DefaultMaxTextLength = 100
+)
+
+// ErrNoAds is returned when no valid ad is available and no fallback is
+// configured.
+var ErrNoAds = errors.New("no ads available")
+
+// Config configures a Client. Zero values select the defaults.
+type Config struct {
+	// Timeout bounds each call to the ad service.
+	Timeout time.Duration
+	// CacheTTL is how long the last good ads for a set of context keys are
+	// served when the ad service fails or returns nothing.
+	CacheTTL time.Duration
+	// MaxTextLength is the maximum length of an ad text, in characters.
+	MaxTextLength int
+	// Fallback is the ad returned when neither the service nor the cache
+	// has an ad. A nil Fallback disables it.
+	Fallback *pb.Ad
+	// Observe, if set, is called with the outcome of every call to the ad
+	// service.
+	Observe func(error)
+}
+
+type cacheEntry struct {
+	ads     []*pb.Ad
+	expires time.Time
+}
+
+// Client is an ad service client enforcing the Config policies. It is safe
+// for concurrent use.
+type Client struct {
+	client pb.AdServiceClient
+	cfg    Config
+	now    func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+// New returns a Client wrapping the given ad service client.
+func New(client pb.AdServiceClient, cfg Config) *Client {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = DefaultCacheTTL
+	}
+	if cfg.MaxTextLength <= 0 {
+		cfg.MaxTextLength = DefaultMaxTextLength
+	}
+	return &Client{
+		client: client,
+		cfg:    cfg,
+		now:    time.Now,
+		cache:  make(map[string]cacheEntry),
+	}
+}
+
+// GetAds returns the valid ads for the given context keys. When the ad
+// service fails or returns no valid ad, the last good ads for the same keys
+// (if recent enough) or the fallback ad are returned instead. The error of
+// the ad service call is only returned when there is nothing to show.
+func (c *Client) GetAds(ctx context.Context, contextKeys []string) ([]*pb.Ad, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+
+	resp, err := c.client.GetAds(ctx, &pb.AdRequest{ContextKeys: contextKeys})
+	if c.cfg.Observe != nil {
+		c.cfg.Observe(err)
+	}
+	key := cacheKey(contextKeys)
+	if err == nil {
+		if ads := c.sanitize(resp.GetAds()); len(ads) > 0 {
+			c.mu.Lock()
+			c.cache[key] = cacheEntry{ads: ads, expires: c.now().Add(c.cfg.CacheTTL)}
+			c.mu.Unlock()
+			return ads, nil
+		}
+	}
+
+	c.mu.Lock()
+	entry, ok := c.cache[key]
+	if ok && c.now().After(entry.expires) {
+		delete(c.cache, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if ok {
+		return entry.ads, nil
+	}
+	if c.cfg.Fallback != nil {
+		return []*pb.Ad{c.cfg.Fallback}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, ErrNoAds
+}
+
+// sanitize drops the ads with invalid redirect URLs and truncates the text
+// of the remaining ones.
+func (c *Client) sanitize(ads []*pb.Ad) []*pb.Ad {
+	var out []*pb.Ad
+	for _, ad := range ads {
+		if !ValidRedirectURL(ad.GetRedirectUrl()) || strings.TrimSpace(ad.GetText()) == "" {
+			continue
+		}
+		out = append(out, &pb.Ad{
+			RedirectUrl: ad.GetRedirectUrl(),
+			Text:        Truncate(ad.GetText(), c.cfg.MaxTextLength),
+		})
+	}
+	return out
+}
+
+// ValidRedirectURL reports whether u is an absolute http(s) URL or a path on
+// this site.
+func ValidRedirectURL(u string) bool {
+	if u == "" {
+		return false
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	if parsed.Scheme == "" {
+		// Site-relative paths only; "//host/path" would leave the site.
+		return parsed.Host == "" && strings.HasPrefix(u, "/") && !strings.HasPrefix(u, "//")
+	}
+	return (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// Truncate shortens s to at most max characters, ending it with an
+// ellipsis when it was cut. It never splits a multi-byte character.
+func Truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	runes := []rune(s)
+	return strings.TrimSpace(string(runes[:max-1])) + "…"
+}
+
+func cacheKey(contextKeys []string) string {
+	keys := append([]string(nil), contextKeys...)
+	sort.Strings(keys)
+	return strings.Join(keys, "\x00")
+}
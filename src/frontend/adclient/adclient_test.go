@@ -0,0 +1,174 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adclient
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+type fakeAdService struct {
+	ads   []*pb.Ad
+	err   error
+	calls int
+}
+
+func (f *fakeAdService) GetAds(ctx context.Context, in *pb.AdRequest, opts ...grpc.CallOption) (*pb.AdResponse, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &pb.AdResponse{Ads: f.ads}, nil
+}
+
+var houseAd = &pb.Ad{RedirectUrl: "/", Text: "House ad"}
+
+func TestValidRedirectURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"", false},
+		{"/product/OLJCESPC7Z", true},
+		{"https://example.com/sale", true},
+		{"http://example.com", true},
+		{"javascript:alert(1)", false},
+		{"data:text/html,hi", false},
+		{"ftp://example.com/file", false},
+		{"//evil.example.com/path", false},
+		{"https://", false},
+		{"product/relative", false},
+		{"http://[::1", false},
+	}
+	for _, tt := range tests {
+		if got := ValidRedirectURL(tt.in); got != tt.want {
+			t.Errorf("ValidRedirectURL(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"this is too long", 10, "this is t…"},
+		{"trailing space here", 9, "trailing…"},
+		{"ÄÖÜäöüßÄÖÜ and more", 5, "ÄÖÜä…"},
+	}
+	for _, tt := range tests {
+		if got := Truncate(tt.in, tt.max); got != tt.want {
+			t.Errorf("Truncate(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestGetAdsDropsMalformedAds(t *testing.T) {
+	svc := &fakeAdService{ads: []*pb.Ad{
+		{RedirectUrl: "javascript:alert(1)", Text: "bad"},
+		{RedirectUrl: "", Text: "no url"},
+		{RedirectUrl: "/product/1", Text: strings.Repeat("x", 200)},
+	}}
+	c := New(svc, Config{MaxTextLength: 20})
+	ads, err := c.GetAds(context.Background(), []string{"vintage"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ads) != 1 || ads[0].GetRedirectUrl() != "/product/1" {
+		t.Fatalf("got ads %v, want only the valid one", ads)
+	}
+	if n := len([]rune(ads[0].GetText())); n != 20 {
+		t.Errorf("ad text has %d characters, want 20", n)
+	}
+}
+
+func TestGetAdsFallback(t *testing.T) {
+	for _, svc := range []*fakeAdService{
+		{},                               // empty response
+		{err: errors.New("unavailable")}, // error
+		{ads: []*pb.Ad{{RedirectUrl: "javascript:void(0)", Text: "x"}}}, // nothing valid
+	} {
+		c := New(svc, Config{Fallback: houseAd})
+		ads, err := c.GetAds(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ads) != 1 || ads[0] != houseAd {
+			t.Errorf("got %v, want the house ad", ads)
+		}
+	}
+
+	c := New(&fakeAdService{err: errors.New("unavailable")}, Config{})
+	if _, err := c.GetAds(context.Background(), nil); err == nil {
+		t.Error("expected an error without a fallback")
+	}
+	c = New(&fakeAdService{}, Config{})
+	if _, err := c.GetAds(context.Background(), nil); err != ErrNoAds {
+		t.Errorf("got error %v, want %v", err, ErrNoAds)
+	}
+}
+
+func TestGetAdsCache(t *testing.T) {
+	now := time.Now()
+	good := []*pb.Ad{{RedirectUrl: "/product/1", Text: "Camera sale"}}
+	svc := &fakeAdService{ads: good}
+	var observed []error
+	c := New(svc, Config{
+		CacheTTL: 5 * time.Second,
+		Fallback: houseAd,
+		Observe:  func(err error) { observed = append(observed, err) },
+	})
+	c.now = func() time.Time { return now }
+
+	if _, err := c.GetAds(context.Background(), []string{"b", "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The service flaps: the last good ads are served for the same keys,
+	// regardless of their order.
+	svc.err = errors.New("unavailable")
+	now = now.Add(4 * time.Second)
+	ads, _ := c.GetAds(context.Background(), []string{"a", "b"})
+	if len(ads) != 1 || ads[0].GetText() != "Camera sale" {
+		t.Errorf("got %v, want the cached ad", ads)
+	}
+
+	// Other keys have no cached ads.
+	ads, _ = c.GetAds(context.Background(), []string{"c"})
+	if len(ads) != 1 || ads[0] != houseAd {
+		t.Errorf("got %v, want the house ad for uncached keys", ads)
+	}
+
+	// Once expired, the fallback is used.
+	now = now.Add(2 * time.Second)
+	ads, _ = c.GetAds(context.Background(), []string{"a", "b"})
+	if len(ads) != 1 || ads[0] != houseAd {
+		t.Errorf("got %v, want the house ad after the cache expired", ads)
+	}
+
+	if len(observed) != svc.calls || observed[0] != nil || observed[1] == nil {
+		t.Errorf("observed outcomes %v for %d calls", observed, svc.calls)
+	}
+}
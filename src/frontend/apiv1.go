@@ -0,0 +1,455 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// maxAPIBodyBytes bounds the request bodies of the JSON API.
+const maxAPIBodyBytes = 64 << 10
+
+var apiCurrencyParam = apiParam{
+	Name:        "currency",
+	Description: "ISO 4217 code of the currency of the prices, by default that of the session",
+}
+
+// apiPrice is an amount of money, along with its display form.
+type apiPrice struct {
+	CurrencyCode string `json:"currency_code"`
+	Units        int64  `json:"units"`
+	Nanos        int32  `json:"nanos"`
+	Formatted    string `json:"formatted"` // as shown on the pages
+}
+
+func newAPIPrice(m pb.Money) apiPrice {
+	return apiPrice{CurrencyCode: m.GetCurrencyCode(), Units: m.GetUnits(), Nanos: m.GetNanos(), Formatted: renderMoney(m)}
+}
+
+type apiProduct struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Picture     string   `json:"picture"`
+	Categories  []string `json:"categories"`
+	Price       apiPrice `json:"price"`
+}
+
+func newAPIProduct(p *pb.Product, price pb.Money) apiProduct {
+	return apiProduct{
+		ID:          p.GetId(),
+		Name:        p.GetName(),
+		Description: p.GetDescription(),
+		Picture:     p.GetPicture(),
+		Categories:  p.GetCategories(),
+		Price:       newAPIPrice(price),
+	}
+}
+
+type apiProducts struct {
+	Products []apiProduct `json:"products"`
+}
+
+type apiCartItem struct {
+	Product  apiProduct `json:"product"`
+	Quantity int32      `json:"quantity"`
+	Cost     apiPrice   `json:"cost"` // price × quantity
+}
+
+type apiCart struct {
+	Items     []apiCartItem `json:"items"`
+	MoreItems int           `json:"more_items"` // lines beyond items, left out as on the cart page
+	Size      int           `json:"size"`       // number of items
+	Shipping  apiPrice      `json:"shipping"`
+	Total     apiPrice      `json:"total"`
+}
+
+// apiCartAddition is the body of POST /api/v1/cart.
+type apiCartAddition struct {
+	ProductID string `json:"product_id"`
+	Quantity  int32  `json:"quantity"`
+}
+
+// field returns the value of the add to cart form field of the given name.
+func (a apiCartAddition) field(name string) string {
+	switch name {
+	case "product_id":
+		return a.ProductID
+	case "quantity":
+		return strconv.Itoa(int(a.Quantity))
+	}
+	return ""
+}
+
+// apiCheckout is the body of POST /api/v1/checkout, with the fields of the
+// checkout form.
+type apiCheckout struct {
+	Email                     string `json:"email"`
+	StreetAddress             string `json:"street_address"`
+	ZipCode                   string `json:"zip_code"`
+	City                      string `json:"city"`
+	State                     string `json:"state"`
+	Country                   string `json:"country"`
+	CreditCardNumber          string `json:"credit_card_number"`
+	CreditCardExpirationMonth int    `json:"credit_card_expiration_month"`
+	CreditCardExpirationYear  int    `json:"credit_card_expiration_year"`
+	CreditCardCVV             string `json:"credit_card_cvv"`
+}
+
+// field returns the value of the checkout form field of the given name.
+func (c apiCheckout) field(name string) string {
+	switch name {
+	case "email":
+		return c.Email
+	case "street_address":
+		return c.StreetAddress
+	case "zip_code":
+		return c.ZipCode
+	case "city":
+		return c.City
+	case "state":
+		return c.State
+	case "country":
+		return c.Country
+	case "credit_card_number":
+		return c.CreditCardNumber
+	case "credit_card_expiration_month":
+		return strconv.Itoa(c.CreditCardExpirationMonth)
+	case "credit_card_expiration_year":
+		return strconv.Itoa(c.CreditCardExpirationYear)
+	case "credit_card_cvv":
+		return c.CreditCardCVV
+	}
+	return ""
+}
+
+type apiOrderItem struct {
+	ProductID string   `json:"product_id"`
+	Quantity  int32    `json:"quantity"`
+	Cost      apiPrice `json:"cost"`
+}
+
+type apiOrder struct {
+	OrderID            string         `json:"order_id"`
+	ShippingTrackingID string         `json:"shipping_tracking_id"`
+	ShippingCost       apiPrice       `json:"shipping_cost"`
+	Items              []apiOrderItem `json:"items"`
+	Total              apiPrice       `json:"total"`
+	// TotalMismatch is set when the total charged differs from the cart's.
+	TotalMismatch bool `json:"total_mismatch"`
+}
+
+// apiCurrency returns the currency asked for by the currency parameter, or
+// else that of the session.
+func (fe *frontendServer) apiCurrency(r *http.Request) (string, error) {
+	c := r.URL.Query().Get("currency")
+	if c == "" {
+		return currentCurrency(r), nil
+	}
+	if c = strings.ToUpper(c); !fe.currencies.allowed(c) {
+		return "", fmt.Errorf("unsupported currency %q", c)
+	}
+	return c, nil
+}
+
+// decodeAPIBody decodes the JSON body of r into v, answering 400 if it
+// cannot.
+func decodeAPIBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)).Decode(v); err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// writeBackendProblem answers an API request a backend call failed: 404
+// for what does not exist, 504 when the backend did not answer in time and
+// 502 otherwise.
+func writeBackendProblem(w http.ResponseWriter, log logrus.FieldLogger, err error, what string) {
+	log.WithField("error", err).Warn(what)
+	switch {
+	case status.Code(errors.Cause(err)) == codes.NotFound:
+		writeProblem(w, http.StatusNotFound, what)
+	case totalOverflowed(err):
+		writeProblem(w, http.StatusUnprocessableEntity, what+": the total is too large")
+	case rpcTimedOut(err):
+		writeProblem(w, http.StatusGatewayTimeout, what)
+	default:
+		writeProblem(w, http.StatusBadGateway, what)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (fe *frontendServer) apiProductsHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	currency, err := fe.apiCurrency(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	products, err := fe.getProducts(r.Context())
+	if err != nil {
+		writeBackendProblem(w, log, err, "could not retrieve products")
+		return
+	}
+	amounts := make([]*pb.Money, len(products))
+	for i, p := range products {
+		amounts[i] = p.GetPriceUsd()
+	}
+	resp := apiProducts{Products: make([]apiProduct, len(products))}
+	for i, res := range fe.convertAll(withRateSnapshot(r.Context(), fe.rates.snapshot()), amounts, currency) {
+		if res.Err != nil {
+			writeBackendProblem(w, log, res.Err, "failed to do currency conversion")
+			return
+		}
+		resp.Products[i] = newAPIProduct(products[i], *res.Money)
+	}
+	writeJSON(w, resp)
+}
+
+func (fe *frontendServer) apiProductHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	currency, err := fe.apiCurrency(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p, err := fe.getProduct(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeBackendProblem(w, log, err, "could not retrieve product")
+		return
+	}
+	price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currency)
+	if err != nil {
+		writeBackendProblem(w, log, err, "failed to convert currency")
+		return
+	}
+	writeJSON(w, newAPIProduct(p, *price))
+}
+
+func (fe *frontendServer) apiCartHandler(w http.ResponseWriter, r *http.Request) {
+	fe.writeAPICart(w, r)
+}
+
+// writeAPICart answers with the cart of the session priced in the
+// requested currency, as on the cart page.
+func (fe *frontendServer) writeAPICart(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	currency, err := fe.apiCurrency(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cart, err := fe.getCart(r.Context(), cartID(r))
+	if err != nil {
+		writeBackendProblem(w, log, err, "could not retrieve cart")
+		return
+	}
+	q, err := fe.quoteCart(withRateSnapshot(r.Context(), fe.rates.snapshot()), cart, nil, currency)
+	if err != nil {
+		writeBackendProblem(w, log, err, "could not price the cart")
+		return
+	}
+	resp := apiCart{
+		Items:     []apiCartItem{},
+		MoreItems: q.MoreItems,
+		Size:      cartQuantity(cart),
+		Shipping:  newAPIPrice(q.Shipping),
+		Total:     newAPIPrice(q.Total),
+	}
+	for _, it := range q.Items {
+		resp.Items = append(resp.Items, apiCartItem{
+			Product:  newAPIProduct(it.Item, it.UnitPrice),
+			Quantity: it.Quantity,
+			Cost:     newAPIPrice(*it.Price),
+		})
+	}
+	fe.setCartCount(w, resp.Size)
+	writeJSON(w, resp)
+}
+
+func (fe *frontendServer) apiAddToCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	var add apiCartAddition
+	if !decodeAPIBody(w, r, &add) {
+		return
+	}
+	if add.ProductID == "" {
+		writeProblem(w, http.StatusBadRequest, "product_id is required")
+		return
+	}
+	if f := validateAddToCart(add.field, fe.cartMaxQuantity); f != nil {
+		writeInvalidParams(w, r, f)
+		return
+	}
+	p, err := fe.getProduct(r.Context(), add.ProductID)
+	if err != nil {
+		writeBackendProblem(w, log, err, "could not retrieve product")
+		return
+	}
+	if err := fe.insertCart(r.Context(), cartID(r), p.GetId(), add.Quantity); err != nil {
+		writeBackendProblem(w, log, err, "failed to add to cart")
+		return
+	}
+	fe.metrics.cartAdd()
+	fe.writeAPICart(w, r)
+}
+
+func (fe *frontendServer) apiEmptyCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	if err := fe.emptyCart(r.Context(), cartID(r)); err != nil {
+		writeBackendProblem(w, log, err, "failed to empty cart")
+		return
+	}
+	fe.writeAPICart(w, r)
+}
+
+// apiCheckoutHandler places the order of the cart, the way the checkout
+// form does.
+func (fe *frontendServer) apiCheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	if fe.oidc != nil && fe.oidc.requireCheckout && fe.identity(r) == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeProblem(w, http.StatusUnauthorized, "sign in to check out")
+		return
+	}
+	currency, err := fe.apiCurrency(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var c apiCheckout
+	if !decodeAPIBody(w, r, &c) {
+		return
+	}
+	if f := validateCheckoutFields(c.field, fe.clock.Now()); f != nil {
+		writeInvalidParams(w, r, f)
+		return
+	}
+
+	// The cart is priced as the cart page would, to check the total
+	// charged against it.
+	req := checkoutRequest(c.field, cartID(r), currency)
+	ctx := withRateSnapshot(r.Context(), fe.rates.snapshot())
+	var displayed *cartQuote
+	cart, err := fe.getCart(ctx, cartID(r))
+	if n := cartQuantity(cart); fe.checkoutMaxItems > 0 && n > fe.checkoutMaxItems {
+		writeProblem(w, http.StatusConflict, fmt.Sprintf("carts of more than %d items cannot be checked out", fe.checkoutMaxItems))
+		return
+	}
+	if err == nil {
+		var q cartQuote
+		if q, err = fe.quoteCart(ctx, cart, req.GetAddress(), currency); err == nil {
+			displayed = &q
+		}
+	}
+	if totalOverflowed(err) {
+		log.WithField("error", err).Warn("refusing to check out a cart whose total overflows")
+		writeProblem(w, http.StatusUnprocessableEntity, "the cart total is too large to check out")
+		return
+	}
+	if err != nil {
+		log.WithField("error", err).Warn("could not price the cart, the order total will not be verified")
+	}
+
+	order, discrepancy, err := fe.placeOrder(log, r, req, displayed)
+	if err != nil {
+		writeBackendProblem(w, log, err, "failed to complete the order")
+		return
+	}
+	fe.setCartCount(w, 0) // the checkout service empties the cart
+	resp := apiOrder{
+		OrderID:            order.GetOrderId(),
+		ShippingTrackingID: order.GetShippingTrackingId(),
+		ShippingCost:       newAPIPrice(*order.GetShippingCost()),
+		Items:              []apiOrderItem{},
+		Total:              newAPIPrice(orderTotal(order)),
+		TotalMismatch:      discrepancy != nil,
+	}
+	for _, it := range order.GetItems() {
+		resp.Items = append(resp.Items, apiOrderItem{
+			ProductID: it.GetItem().GetProductId(),
+			Quantity:  it.GetItem().GetQuantity(),
+			Cost:      newAPIPrice(*it.GetCost()),
+		})
+	}
+	writeJSON(w, resp)
+}
+
+// apiV1Routes registers and documents the routes of version 1 of the JSON
+// API, the operations of the shop's pages for clients other than browsers.
+func (fe *frontendServer) apiV1Routes(t *routeTable) {
+	backendErrors := []int{http.StatusBadGateway, http.StatusGatewayTimeout}
+	t.handleFunc("/api/v1/products", fe.apiProductsHandler, http.MethodGet)
+	t.document("/api/v1/products", http.MethodGet, apiOperation{
+		Summary:  "Products of the catalog, priced in the requested currency",
+		Params:   []apiParam{apiCurrencyParam},
+		Response: apiProducts{},
+		Errors:   append([]int{http.StatusBadRequest}, backendErrors...),
+	})
+	t.handleFunc("/api/v1/products/{id}", fe.apiProductHandler, http.MethodGet)
+	t.document("/api/v1/products/{id}", http.MethodGet, apiOperation{
+		Summary:  "A product, priced in the requested currency",
+		Params:   []apiParam{apiCurrencyParam},
+		Response: apiProduct{},
+		Errors:   append([]int{http.StatusBadRequest, http.StatusNotFound}, backendErrors...),
+	})
+	t.handleFunc("/api/v1/cart", fe.apiCartHandler, http.MethodGet)
+	t.document("/api/v1/cart", http.MethodGet, apiOperation{
+		Summary:  "The session's cart, priced in the requested currency",
+		Params:   []apiParam{apiCurrencyParam},
+		Response: apiCart{},
+		Errors:   append([]int{http.StatusBadRequest}, backendErrors...),
+	})
+	t.handleFunc("/api/v1/cart", fe.apiAddToCartHandler, http.MethodPost)
+	t.document("/api/v1/cart", http.MethodPost, apiOperation{
+		Summary:  "Add a product to the session's cart, returning the cart",
+		Params:   []apiParam{apiCurrencyParam},
+		Request:  apiCartAddition{},
+		Response: apiCart{},
+		Errors:   append([]int{http.StatusBadRequest, http.StatusNotFound}, backendErrors...),
+	})
+	t.handleFunc("/api/v1/cart/empty", fe.apiEmptyCartHandler, http.MethodPost)
+	t.document("/api/v1/cart/empty", http.MethodPost, apiOperation{
+		Summary:  "Empty the session's cart, returning the cart",
+		Params:   []apiParam{apiCurrencyParam},
+		Response: apiCart{},
+		Errors:   append([]int{http.StatusBadRequest}, backendErrors...),
+	})
+	t.handleFunc("/api/v1/checkout", fe.apiCheckoutHandler, http.MethodPost)
+	t.document("/api/v1/checkout", http.MethodPost, apiOperation{
+		Summary:  "Place the order of the session's cart, charged in the requested currency",
+		Params:   []apiParam{apiCurrencyParam},
+		Request:  apiCheckout{},
+		Response: apiOrder{},
+		Errors:   append([]int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusConflict}, backendErrors...),
+	})
+}
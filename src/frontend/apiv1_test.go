@@ -0,0 +1,167 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var apiCheckoutBody = `{
+	"email": "someone@example.com",
+	"street_address": "1600 Amphitheatre Parkway",
+	"zip_code": "94043",
+	"city": "Mountain View",
+	"state": "CA",
+	"country": "United States",
+	"credit_card_number": "4432-8015-6152-0454",
+	"credit_card_expiration_month": 1,
+	"credit_card_expiration_year": 2039,
+	"credit_card_cvv": "672"
+}`
+
+// postJSON posts body to path as JSON.
+func (h *testHarness) postJSON(path, body string) *response {
+	h.t.Helper()
+	req, err := http.NewRequest(http.MethodPost, h.srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	return h.do(req)
+}
+
+func decodeAPI(t *testing.T, resp *response, want int, v interface{}) {
+	t.Helper()
+	if resp.StatusCode != want {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, want, resp.body)
+	}
+	if err := json.Unmarshal([]byte(resp.body), v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIProducts(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	var products apiProducts
+	decodeAPI(t, h.get("/api/v1/products?currency=eur"), http.StatusOK, &products)
+	if len(products.Products) != len(fakeProducts) {
+		t.Fatalf("%d products, want %d", len(products.Products), len(fakeProducts))
+	}
+	if p := products.Products[0]; p.ID != "OLJCESPC7Z" || p.Price.CurrencyCode != "EUR" || p.Price.Formatted != "EUR 61.19" {
+		t.Errorf("first product = %+v, want the typewriter priced in EUR", p)
+	}
+
+	var p apiProduct
+	decodeAPI(t, h.get("/api/v1/products/66VCHSJNUP"), http.StatusOK, &p)
+	if p.Name != "Vintage Camera Lens" || p.Price.CurrencyCode != defaultCurrency {
+		t.Errorf("product = %+v, want the lens priced in %s", p, defaultCurrency)
+	}
+
+	for path, want := range map[string]int{
+		"/api/v1/products?currency=XXX": http.StatusBadRequest,
+		"/api/v1/products/NOSUCHITEM":   http.StatusNotFound,
+	} {
+		var pb problem
+		decodeAPI(t, h.get(path), want, &pb)
+		if pb.Status != want {
+			t.Errorf("%s: problem status = %d, want %d", path, pb.Status, want)
+		}
+	}
+}
+
+func TestAPICart(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	var cart apiCart
+	decodeAPI(t, h.postJSON("/api/v1/cart", `{"product_id": "OLJCESPC7Z", "quantity": 2}`), http.StatusOK, &cart)
+	if cart.Size != 2 || len(cart.Items) != 1 || cart.Items[0].Product.ID != "OLJCESPC7Z" {
+		t.Fatalf("cart after adding = %+v, want two typewriters", cart)
+	}
+	if h.cookie(cookieSessionID) == "" {
+		t.Error("no session cookie set by the API")
+	}
+
+	decodeAPI(t, h.get("/api/v1/cart?currency=JPY"), http.StatusOK, &cart)
+	if cart.Total.CurrencyCode != "JPY" || cart.Items[0].Cost.CurrencyCode != "JPY" {
+		t.Errorf("cart = %+v, want it priced in JPY", cart)
+	}
+
+	for body, want := range map[string]int{
+		`{"product_id": "OLJCESPC7Z", "quantity": 0}`:  http.StatusBadRequest,
+		`{"product_id": "OLJCESPC7Z", "quantity": 11}`: http.StatusBadRequest,
+		`{"product_id": "OLJCESPC7Z"`:                  http.StatusBadRequest,
+		`{"product_id": "NOSUCHITEM", "quantity": 1}`:  http.StatusNotFound,
+	} {
+		if resp := h.postJSON("/api/v1/cart", body); resp.StatusCode != want {
+			t.Errorf("adding %s: status = %d, want %d", body, resp.StatusCode, want)
+		}
+	}
+
+	decodeAPI(t, h.postJSON("/api/v1/cart/empty", ""), http.StatusOK, &cart)
+	if cart.Size != 0 || len(cart.Items) != 0 {
+		t.Errorf("cart after emptying = %+v, want it empty", cart)
+	}
+}
+
+func TestAPICheckout(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.postJSON("/api/v1/cart", `{"product_id": "OLJCESPC7Z", "quantity": 1}`)
+
+	var p problem
+	decodeAPI(t, h.postJSON("/api/v1/checkout", `{"email": "nobody"}`), http.StatusBadRequest, &p)
+	if len(p.InvalidParams) == 0 || p.InvalidParams[0].Name != "email" {
+		t.Errorf("invalid params = %+v, want the e-mail address first", p.InvalidParams)
+	}
+
+	var order apiOrder
+	decodeAPI(t, h.postJSON("/api/v1/checkout?currency=EUR", apiCheckoutBody), http.StatusOK, &order)
+	if order.OrderID == "" || len(order.Items) != 1 || order.Total.CurrencyCode != "EUR" {
+		t.Errorf("order = %+v, want one typewriter charged in EUR", order)
+	}
+	if order.TotalMismatch {
+		t.Error("the charged total differs from the cart's")
+	}
+	if orders := h.fe.orders.snapshot(); len(orders) != 1 || orders[0].OrderID != order.OrderID {
+		t.Errorf("order history = %+v, want the order placed", orders)
+	}
+	var cart apiCart
+	decodeAPI(t, h.get("/api/v1/cart"), http.StatusOK, &cart)
+	if cart.Size != 0 {
+		t.Errorf("cart after checkout has %d items, want 0", cart.Size)
+	}
+}
+
+func TestAPIBackendFailure(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.fail("/hipstershop.ProductCatalogService/ListProducts", status.Error(codes.Internal, "injected failure"))
+
+	var p problem
+	decodeAPI(t, h.get("/api/v1/products"), http.StatusBadGateway, &p)
+	if p.Detail != "could not retrieve products" {
+		t.Errorf("detail = %q", p.Detail)
+	}
+}
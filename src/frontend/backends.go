@@ -0,0 +1,199 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// dialGRPC connects to a backend without waiting for it: the connection is
+// established in the background and reestablished whenever it is lost, so
+// the frontend starts serving while backends are still coming up. Only an
+// invalid address fails.
+func dialGRPC(ctx context.Context, conn **grpc.ClientConn, addr string, opts ...grpc.DialOption) error {
+	var err error
+	*conn, err = grpc.DialContext(ctx, addr, append([]grpc.DialOption{grpc.WithInsecure()}, opts...)...)
+	return errors.Wrapf(err, "grpc: failed to dial %s", addr)
+}
+
+// maxBackendEvents is how many changes of state of the backend
+// connections are kept for /debug/backends/events.
+const maxBackendEvents = 100
+
+// defaultBackendReconnectAfter is how long a backend connection may fail
+// before it is made to reconnect at once, rather than after its backoff.
+const defaultBackendReconnectAfter = 10 * time.Second
+
+// backendEvent is a change of state of a backend connection, or a
+// reconnection forced by the watcher.
+type backendEvent struct {
+	Time    time.Time `json:"time"`
+	Backend string    `json:"backend"`
+	Addr    string    `json:"addr"`
+	From    string    `json:"from"`
+	State   string    `json:"state"`
+	// Duration is the time spent in the state the connection left, or
+	// failing, for a reconnection.
+	Duration string `json:"duration"`
+	Action   string `json:"action,omitempty"` // "reconnect" when forced
+}
+
+// backendWatcher follows the connections to the backends: it logs their
+// changes of state, keeps the last ones, and makes those failing for
+// longer than reconnectAfter reconnect at once, which resolves their
+// address again. A nil watcher does nothing.
+type backendWatcher struct {
+	reconnectAfter time.Duration
+	now            func() time.Time
+
+	mu     sync.Mutex
+	events []backendEvent // ring of the last maxBackendEvents
+	next   int            // index of the oldest event once the ring is full
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newBackendWatcher(reconnectAfter time.Duration) *backendWatcher {
+	return &backendWatcher{reconnectAfter: reconnectAfter, now: time.Now, cancel: func() {}}
+}
+
+// watchBackends watches the connections to the backends until they are
+// closed, ctx is done, or the watcher is stopped.
+func (fe *frontendServer) watchBackends(ctx context.Context, log logrus.FieldLogger) {
+	fe.watcher.start(ctx, log, fe.backends())
+}
+
+// start watches each of the connections of backends in a goroutine of its
+// own.
+func (bw *backendWatcher) start(ctx context.Context, log logrus.FieldLogger, backends []backendInfo) {
+	if bw == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	bw.mu.Lock()
+	prev := bw.cancel
+	bw.cancel = func() { prev(); cancel() }
+	bw.mu.Unlock()
+	for _, b := range backends {
+		if b.conn == nil {
+			continue
+		}
+		bw.wg.Add(1)
+		go bw.watch(ctx, log, b)
+	}
+}
+
+// stop ends the watching, and returns once every goroutine returned.
+func (bw *backendWatcher) stop() {
+	if bw == nil {
+		return
+	}
+	bw.mu.Lock()
+	cancel := bw.cancel
+	bw.mu.Unlock()
+	cancel()
+	bw.wg.Wait()
+}
+
+func (bw *backendWatcher) watch(ctx context.Context, log logrus.FieldLogger, b backendInfo) {
+	defer bw.wg.Done()
+	state, since := b.conn.GetState(), bw.now()
+	for state != connectivity.Shutdown {
+		wait, cancel := ctx, context.CancelFunc(func() {})
+		if state == connectivity.TransientFailure && bw.reconnectAfter > 0 {
+			wait, cancel = context.WithTimeout(ctx, bw.reconnectAfter)
+		}
+		changed := b.conn.WaitForStateChange(wait, state)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		now := bw.now()
+		if !changed {
+			// Still failing after reconnectAfter: the backoff is cut short.
+			b.conn.ResetConnectBackoff()
+			bw.record(log, backendEvent{Time: now, Backend: b.Name, Addr: b.Addr, From: state.String(), State: state.String(),
+				Duration: now.Sub(since).String(), Action: "reconnect"})
+			continue
+		}
+		next := b.conn.GetState()
+		bw.record(log, backendEvent{Time: now, Backend: b.Name, Addr: b.Addr, From: state.String(), State: next.String(),
+			Duration: now.Sub(since).String()})
+		state, since = next, now
+	}
+}
+
+// record logs an event and keeps it.
+func (bw *backendWatcher) record(log logrus.FieldLogger, e backendEvent) {
+	entry := log.WithFields(logrus.Fields{
+		"event":    "backend_state",
+		"backend":  e.Backend,
+		"addr":     e.Addr,
+		"from":     e.From,
+		"state":    e.State,
+		"duration": e.Duration,
+	})
+	switch {
+	case e.Action != "":
+		entry.WithField("event", "backend_reconnect").Warn("backend connection still failing, reconnecting")
+	case e.State == connectivity.TransientFailure.String():
+		entry.Warn("backend connection failing")
+	default:
+		entry.Info("backend connection changed state")
+	}
+
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if len(bw.events) < maxBackendEvents {
+		bw.events = append(bw.events, e)
+		return
+	}
+	bw.events[bw.next] = e
+	bw.next = (bw.next + 1) % maxBackendEvents
+}
+
+// recent returns the events kept, oldest first.
+func (bw *backendWatcher) recent() []backendEvent {
+	if bw == nil {
+		return []backendEvent{}
+	}
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	return append(append([]backendEvent{}, bw.events[bw.next:]...), bw.events[:bw.next]...)
+}
+
+// debugBackendEventsHandler serves the last changes of state of the backend
+// connections as JSON, for demo presenters and when debugging is enabled
+// only.
+func (fe *frontendServer) debugBackendEventsHandler(w http.ResponseWriter, r *http.Request) {
+	fe.serveDebugJSON(w, r, fe.watcher.recent())
+}
+
+// backendUnavailable reports whether err comes from a backend that could
+// not be reached, rather than from one that failed the call.
+func backendUnavailable(err error) bool {
+	return status.Code(errors.Cause(err)) == codes.Unavailable
+}
@@ -0,0 +1,269 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// unreachableAddr returns the address of a port nothing listens on.
+func unreachableAddr(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	return addr
+}
+
+// withUnreachable connects one of the backends to an address nothing
+// listens on, as during a cold start.
+func withUnreachable(t *testing.T, conn func(*frontendServer) **grpc.ClientConn) func(*frontendServer) {
+	return func(fe *frontendServer) {
+		if err := dialGRPC(context.Background(), conn(fe), unreachableAddr(t)); err != nil {
+			t.Fatalf("dialing a backend that is down: %v", err)
+		}
+	}
+}
+
+func catalogConn(fe *frontendServer) **grpc.ClientConn { return &fe.productCatalogSvcConn }
+func adConn(fe *frontendServer) **grpc.ClientConn      { return &fe.adSvcConn }
+
+func TestBackendDown(t *testing.T) {
+	h := newTestHarness(t, withUnreachable(t, catalogConn))
+	defer h.close()
+	defer h.fe.productCatalogSvcConn.Close()
+
+	resp := h.get("/")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("home with the catalog down = %d, want 503", resp.StatusCode)
+	}
+	if !strings.Contains(resp.body, "Service temporarily unavailable") {
+		t.Error("error page does not say the service is unavailable")
+	}
+	if strings.Contains(resp.body, "could not retrieve products") {
+		t.Error("error page shows the details of the failure")
+	}
+
+	h = newTestHarness(t, withUnreachable(t, adConn))
+	defer h.close()
+	defer h.fe.adSvcConn.Close()
+	if resp := h.get("/"); resp.StatusCode != http.StatusOK || !strings.Contains(resp.body, "/product/OLJCESPC7Z") {
+		t.Errorf("home with the ad service down = %d, want the page without the ad", resp.StatusCode)
+	}
+}
+
+func TestBackendsEndpoint(t *testing.T) {
+	h := newTestHarness(t, withUnreachable(t, catalogConn))
+	defer h.close()
+	defer h.fe.productCatalogSvcConn.Close()
+	if resp := h.get("/debug/backends"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /debug/backends without debugging = %d, want 404", resp.StatusCode)
+	}
+
+	h.fe.demoMode = true
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.AddHook(h.logs)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h.fe.watchBackends(ctx, log)
+	h.get("/") // makes the catalog connection try
+
+	var states map[string]string
+	var failing bool
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && !failing; time.Sleep(20 * time.Millisecond) {
+		var backends []backendInfo
+		if err := json.Unmarshal([]byte(h.get("/debug/backends").body), &backends); err != nil {
+			t.Fatal(err)
+		}
+		states = make(map[string]string)
+		for _, b := range backends {
+			states[b.Name] = b.State
+		}
+		for _, e := range h.logs.find("backend_state") {
+			failing = failing || (e.Data["backend"] == "productcatalog" && e.Data["state"] == "TRANSIENT_FAILURE")
+		}
+	}
+	// Between attempts, the catalog connection is failing or connecting again.
+	if states["productcatalog"] == "READY" || states["cart"] != "READY" || len(states) != 7 {
+		t.Errorf("backend states = %v, want the catalog down", states)
+	}
+	if !failing {
+		t.Error("failing catalog connection not logged")
+	}
+
+	var events []backendEvent
+	if err := json.Unmarshal([]byte(h.get("/debug/backends/events").body), &events); err != nil {
+		t.Fatal(err)
+	}
+	failing = false
+	for _, e := range events {
+		failing = failing || (e.Backend == "productcatalog" && e.State == "TRANSIENT_FAILURE" && e.Duration != "")
+	}
+	if !failing {
+		t.Errorf("backend events = %+v, want the catalog failing", events)
+	}
+}
+
+// movingBackend is a catalog backend that can be stopped and started again
+// on another port, the connections to it dialing its current address.
+type movingBackend struct {
+	t    *testing.T
+	addr atomic.Value
+	srv  *grpc.Server
+}
+
+func (m *movingBackend) start() {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	m.srv = grpc.NewServer()
+	pb.RegisterProductCatalogServiceServer(m.srv, &fakeCatalog{products: fakeProducts})
+	go m.srv.Serve(lis)
+	m.addr.Store(lis.Addr().String())
+}
+
+func (m *movingBackend) dial() *grpc.ClientConn {
+	var conn *grpc.ClientConn
+	err := dialGRPC(context.Background(), &conn, "productcatalog", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", m.addr.Load().(string))
+	}))
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return conn
+}
+
+// awaitEvent waits for the watcher to record an event matching match.
+func awaitEvent(t *testing.T, bw *backendWatcher, match func(backendEvent) bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		for _, e := range bw.recent() {
+			if match(e) {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no such backend event in %+v", bw.recent())
+		}
+	}
+}
+
+func TestBackendWatcherReconnects(t *testing.T) {
+	backend := &movingBackend{t: t}
+	backend.start()
+	conn := backend.dial()
+	defer conn.Close()
+	bw := newBackendWatcher(50 * time.Millisecond)
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	bw.start(context.Background(), log, []backendInfo{{Name: "productcatalog", Addr: "productcatalog", conn: conn}})
+	defer bw.stop()
+
+	catalog := pb.NewProductCatalogServiceClient(conn)
+	if _, err := catalog.ListProducts(context.Background(), &pb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	// The backend goes away and comes back on another port, after the
+	// connection failed.
+	backend.srv.Stop()
+	awaitEvent(t, bw, func(e backendEvent) bool { return e.State == "TRANSIENT_FAILURE" })
+	backend.start()
+	defer backend.srv.Stop()
+
+	// Left to its backoff, the connection would try again after a second.
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := catalog.ListProducts(ctx, &pb.Empty{}, grpc.WaitForReady(true)); err != nil {
+		t.Fatalf("backend not reached once back: %v", err)
+	}
+	if d := time.Since(start); d > 700*time.Millisecond {
+		t.Errorf("reconnected after %v, want it forced sooner", d)
+	}
+	awaitEvent(t, bw, func(e backendEvent) bool { return e.Action == "reconnect" })
+	awaitEvent(t, bw, func(e backendEvent) bool { return e.State == "READY" && e.From != "IDLE" })
+}
+
+func TestBackendWatcherStops(t *testing.T) {
+	backend := &movingBackend{t: t}
+	backend.start()
+	defer backend.srv.Stop()
+	bw := newBackendWatcher(time.Second)
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	returned := func() bool {
+		done := make(chan struct{})
+		go func() {
+			bw.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return true
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+
+	// Closing the connection ends its watch.
+	conn := backend.dial()
+	bw.start(context.Background(), log, []backendInfo{{Name: "productcatalog", conn: conn}})
+	conn.Close()
+	if !returned() {
+		t.Fatal("watch of a closed connection still running")
+	}
+
+	// So does stopping the watcher, the connection still open.
+	conn = backend.dial()
+	defer conn.Close()
+	bw.start(context.Background(), log, []backendInfo{{Name: "productcatalog", conn: conn}})
+	bw.stop()
+	if !returned() {
+		t.Fatal("watch still running once stopped")
+	}
+}
+
+func TestBackendEventsRing(t *testing.T) {
+	bw := newBackendWatcher(time.Second)
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	for i := 0; i < maxBackendEvents+5; i++ {
+		bw.record(log, backendEvent{Backend: strconv.Itoa(i)})
+	}
+	events := bw.recent()
+	if len(events) != maxBackendEvents || events[0].Backend != "5" || events[len(events)-1].Backend != strconv.Itoa(maxBackendEvents+4) {
+		t.Errorf("kept %d events from %s, want the last %d", len(events), events[0].Backend, maxBackendEvents)
+	}
+}
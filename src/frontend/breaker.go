@@ -0,0 +1,160 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+// errCircuitOpen is returned instead of calling a backend whose circuit is
+// open.
+var errCircuitOpen = errors.New("circuit open")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breakerSettings are shared by the circuit breakers of the backends.
+type breakerSettings struct {
+	failures int           // consecutive failures opening the circuit, 0 disables the breakers
+	window   time.Duration // within which the failures must happen
+	cooldown time.Duration // the circuit stays open before a probe
+}
+
+var defaultBreakerSettings = breakerSettings{failures: 5, window: 10 * time.Second, cooldown: 30 * time.Second}
+
+// circuitBreaker skips the calls to a non-essential backend that keeps
+// failing, so that pages stop waiting for its timeouts. After failures
+// consecutive failures within window the circuit opens: calls fail with
+// errCircuitOpen for cooldown. Then a single call is let through as a
+// probe, the circuit being half-open; it closes the circuit if it succeeds
+// and opens it again if it fails. Its methods accept a nil
+// *circuitBreaker, which lets every call through.
+type circuitBreaker struct {
+	backend  string
+	settings breakerSettings
+	log      logrus.FieldLogger
+	now      func() time.Time
+
+	mu           sync.Mutex
+	state        circuitState
+	failures     int
+	firstFailure time.Time // of the current streak
+	openedAt     time.Time
+}
+
+func newCircuitBreaker(log logrus.FieldLogger, backend string, settings breakerSettings) *circuitBreaker {
+	return &circuitBreaker{backend: backend, settings: settings, log: log, now: time.Now}
+}
+
+// allow returns errCircuitOpen if a call to the backend must be skipped.
+// Otherwise the outcome of the call must be passed to record.
+func (b *circuitBreaker) allow(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) >= b.settings.cooldown {
+			b.transition(circuitHalfOpen)
+			trace.FromContext(ctx).AddAttributes(trace.StringAttribute("circuit", circuitHalfOpen.String()))
+			return nil
+		}
+	case circuitHalfOpen: // a probe is in flight
+	default:
+		return nil
+	}
+	trace.FromContext(ctx).AddAttributes(trace.StringAttribute("circuit", circuitOpen.String()))
+	return errCircuitOpen
+}
+
+// record counts the outcome of a call let through by allow.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.state == circuitHalfOpen && err != nil:
+		b.open()
+	case b.state == circuitHalfOpen:
+		b.failures = 0
+		b.transition(circuitClosed)
+	case b.state == circuitOpen: // a call started before the circuit opened
+	case err == nil:
+		b.failures = 0
+	default:
+		now := b.now()
+		if b.failures == 0 || now.Sub(b.firstFailure) > b.settings.window {
+			b.failures, b.firstFailure = 0, now
+		}
+		if b.failures++; b.failures >= b.settings.failures {
+			b.open()
+		}
+	}
+}
+
+// current returns the state of the circuit.
+func (b *circuitBreaker) current() circuitState {
+	if b == nil {
+		return circuitClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) open() {
+	b.openedAt = b.now()
+	b.transition(circuitOpen)
+}
+
+func (b *circuitBreaker) transition(to circuitState) {
+	log := b.log.WithFields(logrus.Fields{
+		"event":   "circuit_state",
+		"backend": b.backend,
+		"from":    b.state.String(),
+		"to":      to.String(),
+	})
+	b.state = to
+	if to == circuitOpen {
+		log.Warnf("circuit of %s opened", b.backend)
+	} else {
+		log.Infof("circuit of %s %s", b.backend, to)
+	}
+}
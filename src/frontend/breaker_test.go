@@ -0,0 +1,132 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testBreakerSettings = breakerSettings{failures: 3, window: time.Minute, cooldown: 30 * time.Second}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	for _, tc := range []struct {
+		method  string
+		breaker func(fe *frontendServer) **circuitBreaker
+	}{
+		{"/hipstershop.RecommendationService/ListRecommendations", func(fe *frontendServer) **circuitBreaker { return &fe.recommendationBreaker }},
+		{"/hipstershop.AdService/GetAds", func(fe *frontendServer) **circuitBreaker { return &fe.adBreaker }},
+	} {
+		t.Run(tc.method, func(t *testing.T) {
+			h := newTestHarness(t)
+			defer h.close()
+			log := logrus.New()
+			log.Out = ioutil.Discard
+			log.AddHook(h.logs)
+			b := newCircuitBreaker(log, "test", testBreakerSettings)
+			b.now = h.fe.clock.Now
+			*tc.breaker(h.fe) = b
+
+			page := func() {
+				t.Helper()
+				if resp := h.get("/product/OLJCESPC7Z"); resp.StatusCode != http.StatusOK {
+					t.Fatalf("status = %d, want the page rendered without the widget", resp.StatusCode)
+				}
+			}
+			h.fail(tc.method, status.Error(codes.Internal, "injected failure"))
+			for i := 0; i < testBreakerSettings.failures; i++ {
+				page()
+			}
+			if s := b.current(); s != circuitOpen {
+				t.Fatalf("state after %d failures = %v, want open", testBreakerSettings.failures, s)
+			}
+			page()
+			if n := h.faults.calls(tc.method); n != testBreakerSettings.failures {
+				t.Errorf("%d calls, want none while the circuit is open", n-testBreakerSettings.failures)
+			}
+
+			h.fail(tc.method, nil)
+			h.fe.clock.setOffset(testBreakerSettings.cooldown)
+			page()
+			if n := h.faults.calls(tc.method); n != testBreakerSettings.failures+1 {
+				t.Errorf("%d calls after the cooldown, want one probe", n-testBreakerSettings.failures)
+			}
+			if s := b.current(); s != circuitClosed {
+				t.Errorf("state after a successful probe = %v, want closed", s)
+			}
+			var transitions []string
+			for _, e := range h.logs.find("circuit_state") {
+				transitions = append(transitions, e.Data["to"].(string))
+			}
+			if len(transitions) != 3 || transitions[0] != "open" || transitions[1] != "half-open" || transitions[2] != "closed" {
+				t.Errorf("transitions = %v, want open, half-open, closed", transitions)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerProbe(t *testing.T) {
+	now := time.Unix(0, 0)
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	b := newCircuitBreaker(log, "test", testBreakerSettings)
+	b.now = func() time.Time { return now }
+	fail := errors.New("unavailable")
+	ctx := context.Background()
+
+	b.record(fail)
+	b.record(fail)
+	now = now.Add(2 * time.Minute) // the streak is outside the window
+	b.record(fail)
+	b.record(nil) // a success ends the streak
+	b.record(fail)
+	b.record(fail)
+	if s := b.current(); s != circuitClosed {
+		t.Fatalf("state = %v, want closed without %d failures in a row within the window", s, testBreakerSettings.failures)
+	}
+	b.record(fail)
+	if err := b.allow(ctx); err != errCircuitOpen {
+		t.Fatalf("allow = %v, want %v", err, errCircuitOpen)
+	}
+
+	now = now.Add(testBreakerSettings.cooldown)
+	if err := b.allow(ctx); err != nil {
+		t.Fatalf("allow after the cooldown = %v, want a probe", err)
+	}
+	if err := b.allow(ctx); err != errCircuitOpen {
+		t.Errorf("allow during the probe = %v, want %v", err, errCircuitOpen)
+	}
+	b.record(fail)
+	if s := b.current(); s != circuitOpen {
+		t.Errorf("state after a failed probe = %v, want open", s)
+	}
+	if err := b.allow(ctx); err != errCircuitOpen {
+		t.Errorf("allow after a failed probe = %v, want a new cooldown", err)
+	}
+
+	var disabled *circuitBreaker
+	if err := disabled.allow(ctx); err != nil {
+		t.Errorf("nil breaker: allow = %v", err)
+	}
+	disabled.record(fail)
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache is an in-memory cache of a bounded number of entries, each
+// expiring after its own time to live. It is safe for concurrent use.
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache maps string keys to values until they expire.
+type Cache struct {
+	max int
+
+	// Now is the clock entries expire by, time.Now unless replaced.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+type entry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// New returns a cache of at most max entries.
+func New(max int) *Cache {
+	return &Cache{max: max, Now: time.Now, entries: make(map[string]entry)}
+}
+
+// Get returns the value of key, if it is cached and has not expired.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.Now().Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+// Set caches value under key for ttl. When the cache is full, expired
+// entries are dropped first, then arbitrary ones.
+func (c *Cache) Set(key string, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.Now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.max {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.max {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	if c.max > 0 {
+		c.entries[key] = entry{value: value, expires: now.Add(ttl)}
+	}
+}
+
+// Take removes key and returns its value, if it was cached and had not
+// expired. Of concurrent calls for the same key, only one gets the value.
+func (c *Cache) Take(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	delete(c.entries, key)
+	if !c.Now().Before(e.expires) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// Purge drops every entry.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]entry)
+}
+
+// Len returns the number of entries, expired ones included.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
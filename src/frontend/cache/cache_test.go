@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := New(10)
+	c.Now = func() time.Time { return now }
+
+	c.Set("a", 1, time.Minute)
+	c.Set("b", 2, time.Hour)
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Errorf("Get(a) = %v, %v; want 1, true", v, ok)
+	}
+	now = now.Add(time.Minute)
+	if _, ok := c.Get("a"); ok {
+		t.Error("expired entry returned")
+	}
+	if v, ok := c.Get("b"); !ok || v != 2 {
+		t.Errorf("Get(b) = %v, %v; want 2, true", v, ok)
+	}
+
+	c.Set("a", 1, time.Minute)
+	if v, ok := c.Take("a"); !ok || v != 1 {
+		t.Errorf("Take(a) = %v, %v; want 1, true", v, ok)
+	}
+	if _, ok := c.Take("a"); ok {
+		t.Error("entry taken twice")
+	}
+
+	c.Purge()
+	if _, ok := c.Get("b"); ok || c.Len() != 0 {
+		t.Error("entries left after Purge")
+	}
+}
+
+func TestBound(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := New(3)
+	c.Now = func() time.Time { return now }
+
+	c.Set("short", 0, time.Second)
+	c.Set("a", 1, time.Hour)
+	c.Set("b", 2, time.Hour)
+	now = now.Add(time.Second)
+	// The expired entry makes room.
+	c.Set("c", 3, time.Hour)
+	for _, k := range []string{"a", "b", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("%s evicted while an expired entry was cached", k)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		c.Set(fmt.Sprint(i), i, time.Hour)
+	}
+	if c.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", c.Len())
+	}
+	if v, ok := c.Get("9"); !ok || v != 9 {
+		t.Errorf("last entry set not cached")
+	}
+	// Replacing an entry never evicts another.
+	c.Set("9", 90, time.Hour)
+	if c.Len() != 3 {
+		t.Errorf("Len() = %d after replacing an entry, want 3", c.Len())
+	}
+}
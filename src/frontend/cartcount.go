@@ -0,0 +1,99 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// cartCountFreshness is how long the number of items in the cart, as last
+// known by the frontend, is trusted for the cart badge.
+const cartCountFreshness = 5 * time.Second
+
+// cartQuantity is the number of items in a cart, as shown in the badge.
+func cartQuantity(cart []*pb.CartItem) int {
+	var n int
+	for _, it := range cart {
+		n += int(it.GetQuantity())
+	}
+	return n
+}
+
+// setCartCount remembers the number of items in the cart for the next
+// pages, typically the one a cart mutation redirects to.
+func (fe *frontendServer) setCartCount(w http.ResponseWriter, n int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   cookieCartCount,
+		Value:  strconv.Itoa(n) + "." + strconv.FormatInt(fe.clock.Now().Unix(), 10),
+		Path:   "/",
+		MaxAge: int(cartCountFreshness / time.Second),
+	})
+}
+
+// cartCount returns the number of items in the cart remembered by
+// setCartCount, if it is still fresh.
+func (fe *frontendServer) cartCount(r *http.Request) (int, bool) {
+	c, err := r.Cookie(cookieCartCount)
+	if err != nil {
+		return 0, false
+	}
+	parts := strings.SplitN(c.Value, ".", 2)
+	if len(parts) != 2 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if age := fe.clock.Now().Sub(time.Unix(ts, 0)); age < 0 || age > cartCountFreshness {
+		return 0, false
+	}
+	return n, true
+}
+
+// cartSize returns the number of items in the cart for the badge of pages
+// that do not show the cart itself, from a fresh remembered count when
+// there is one, from the cart service otherwise.
+func (fe *frontendServer) cartSize(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	n, fetched, err := fe.countCartItems(ctx, r)
+	if fetched {
+		fe.setCartCount(w, n)
+	}
+	return n, err
+}
+
+// countCartItems is cartSize leaving the response alone, for the calls
+// made alongside others: fetched says whether the count came from the cart
+// service, and is worth remembering once the calls are done.
+func (fe *frontendServer) countCartItems(ctx context.Context, r *http.Request) (n int, fetched bool, err error) {
+	if n, ok := fe.cartCount(r); ok {
+		return n, false, nil
+	}
+	cart, err := fe.getCart(ctx, cartID(r))
+	if err != nil {
+		return 0, false, err
+	}
+	return cartQuantity(cart), true, nil
+}
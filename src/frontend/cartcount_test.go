@@ -0,0 +1,69 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCartCountAfterRedirects(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	// Browse, add twice, empty the cart and browse again. Every page used
+	// to read the cart for its badge: 6 GetCart calls. With the count
+	// carried through the redirects only the cart pages read it.
+	h.get("/product/OLJCESPC7Z")
+	resp := h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"2"}})
+	if !strings.Contains(resp.body, "View Cart (2)") {
+		t.Error("cart badge after adding 2 items is not 2")
+	}
+	resp = h.post("/cart", url.Values{"product_id": {"66VCHSJNUP"}, "quantity": {"3"}})
+	if !strings.Contains(resp.body, "View Cart (5)") {
+		t.Error("cart badge after adding 3 more items is not 5")
+	}
+	resp = h.post("/cart/empty", nil)
+	if !strings.Contains(resp.body, "View Cart (0)") {
+		t.Error("cart badge after emptying the cart is not 0")
+	}
+	h.get("/product/66VCHSJNUP")
+
+	if got := h.faults.calls(getCartMethod); got != 4 {
+		t.Errorf("made %d GetCart calls, want 4 (1 for the first page, 2 for the cart pages, 1 to keep the emptied cart for undo)", got)
+	}
+}
+
+func TestCartCountStale(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+
+	// A count older than cartCountFreshness is not trusted.
+	stale := time.Now().Add(-2 * cartCountFreshness).Unix()
+	u, _ := url.Parse(h.srv.URL)
+	h.client.Jar.SetCookies(u, []*http.Cookie{{Name: cookieCartCount, Value: "7." + strconv.FormatInt(stale, 10), Path: "/"}})
+	calls := h.faults.calls(getCartMethod)
+	if resp := h.get("/"); !strings.Contains(resp.body, "View Cart (1)") {
+		t.Error("cart badge shows a stale count")
+	}
+	if got := h.faults.calls(getCartMethod) - calls; got != 1 {
+		t.Errorf("made %d GetCart calls with a stale count, want 1", got)
+	}
+}
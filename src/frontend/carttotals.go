@@ -0,0 +1,119 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+// maxTotalsCurrencies is how many currencies the cart totals can be asked
+// in at once.
+const maxTotalsCurrencies = 5
+
+// currencyTotals is the cost of the cart in one currency, formatted as on
+// the cart page, or the reason it could not be computed.
+type currencyTotals struct {
+	Currency string `json:"currency"`
+	Subtotal string `json:"subtotal,omitempty"`
+	Shipping string `json:"shipping,omitempty"`
+	Total    string `json:"total,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type cartTotals struct {
+	RatesAsOf time.Time        `json:"rates_as_of"`
+	Totals    []currencyTotals `json:"totals"`
+}
+
+// cartTotalsHandler serves the cost of the cart in each of the currencies
+// listed in the currencies parameter. The cart is read once and priced with
+// a single rate snapshot, the same way as on the cart page.
+func (fe *frontendServer) cartTotalsHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	currencies, err := parseTotalsCurrencies(r.FormValue("currencies"), fe.currencies.allowed)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cart, err := fe.getCart(r.Context(), cartID(r))
+	if err != nil {
+		log.WithField("error", err).Warn("could not retrieve cart")
+		writeProblem(w, http.StatusInternalServerError, "could not retrieve cart")
+		return
+	}
+	in, err := fe.cartPricing(r.Context(), cart, fe.addresses.get(sessionID(r)).proto())
+	if err == nil {
+		err = in.shippingErr
+	}
+	if err != nil {
+		log.WithField("error", err).Warn("could not price the cart")
+		writeProblem(w, http.StatusInternalServerError, "could not price the cart")
+		return
+	}
+
+	rates := fe.rates.snapshot()
+	ctx := withRateSnapshot(r.Context(), rates)
+	resp := cartTotals{RatesAsOf: rates.created.UTC()}
+	for _, c := range currencies {
+		q, err := fe.priceCart(ctx, in, c)
+		if err != nil {
+			log.WithField("currency", c).WithField("error", err).Warn("could not price the cart")
+			resp.Totals = append(resp.Totals, currencyTotals{Currency: c, Error: "conversion failed"})
+			continue
+		}
+		subtotal := money.Must(money.Sum(q.Total, money.Negate(q.Shipping)))
+		resp.Totals = append(resp.Totals, currencyTotals{
+			Currency: c,
+			Subtotal: renderMoney(subtotal),
+			Shipping: renderMoney(q.Shipping),
+			Total:    renderMoney(q.Total),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseTotalsCurrencies parses a comma-separated list of supported currency
+// codes, dropping duplicates.
+func parseTotalsCurrencies(s string, allowed func(code string) bool) ([]string, error) {
+	if s == "" {
+		return nil, fmt.Errorf("no currencies requested")
+	}
+	var out []string
+	seen := make(map[string]bool)
+	for _, c := range strings.Split(s, ",") {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if !allowed(c) {
+			return nil, fmt.Errorf("unsupported currency %q", c)
+		}
+		if !seen[c] {
+			seen[c] = true
+			out = append(out, c)
+		}
+	}
+	if len(out) > maxTotalsCurrencies {
+		return nil, fmt.Errorf("at most %d currencies can be requested", maxTotalsCurrencies)
+	}
+	return out, nil
+}
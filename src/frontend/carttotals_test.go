@@ -0,0 +1,99 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func (h *testHarness) cartTotals(currencies string) (*response, cartTotals) {
+	h.t.Helper()
+	resp := h.get("/api/cart/totals?currencies=" + url.QueryEscape(currencies))
+	var totals cartTotals
+	if resp.StatusCode == http.StatusOK {
+		if err := json.Unmarshal([]byte(resp.body), &totals); err != nil {
+			h.t.Fatalf("invalid cart totals: %v", err)
+		}
+	}
+	return resp, totals
+}
+
+func TestCartTotalsMatchCartPage(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	h.post("/cart", url.Values{"product_id": {"66VCHSJNUP"}, "quantity": {"3"}})
+
+	calls := h.faults.calls(getCartMethod)
+	resp, totals := h.cartTotals("USD,EUR,JPY,eur")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /api/cart/totals = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := h.faults.calls(getCartMethod) - calls; got != 1 {
+		t.Errorf("read the cart %d times, want once", got)
+	}
+	if totals.RatesAsOf.IsZero() {
+		t.Error("no rate snapshot timestamp")
+	}
+	if len(totals.Totals) != 3 {
+		t.Fatalf("got totals %+v, want USD, EUR and JPY", totals.Totals)
+	}
+
+	for _, tt := range totals.Totals {
+		h.post("/setCurrency", url.Values{"currency_code": {tt.Currency}})
+		cart := h.get("/cart")
+		if tt.Error != "" {
+			t.Errorf("%s: %s", tt.Currency, tt.Error)
+			continue
+		}
+		if !strings.Contains(cart.body, "Total Cost: <strong>"+tt.Total+"</strong>") {
+			t.Errorf("%s total %q differs from the cart page", tt.Currency, tt.Total)
+		}
+		if !strings.Contains(cart.body, tt.Shipping) {
+			t.Errorf("%s shipping %q differs from the cart page", tt.Currency, tt.Shipping)
+		}
+	}
+}
+
+func TestCartTotalsConversionError(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	h.rates.mu.Lock()
+	delete(h.rates.rates, "GBP")
+	h.rates.mu.Unlock()
+
+	_, totals := h.cartTotals("EUR,GBP")
+	if len(totals.Totals) != 2 || totals.Totals[0].Total == "" || totals.Totals[1].Error == "" {
+		t.Errorf("got totals %+v, want EUR and an error for GBP", totals.Totals)
+	}
+}
+
+func TestCartTotalsInvalidCurrencies(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	for _, currencies := range []string{"", "USD,XXX", "USD,EUR,CAD,JPY,GBP,TRY"} {
+		if resp, _ := h.cartTotals(currencies); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("currencies=%q: status = %d, want %d", currencies, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+	if got := h.faults.calls(getCartMethod); got != 0 {
+		t.Errorf("read the cart %d times for invalid requests", got)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/cache"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	defaultCartUndoWindow = time.Minute
+	maxUndoSessions       = 1000 // sessions with an emptied cart remembered
+)
+
+// cartSnapshot is the content of an emptied cart, kept so that it can be
+// restored. Token identifies it in the undo form: an undo must carry the
+// token of the snapshot it restores, which a forged form cannot.
+type cartSnapshot struct {
+	Token string
+	Items []*pb.CartItem
+	Until time.Time
+}
+
+// Quantity is the number of items in the snapshot, for the undo notice.
+func (s *cartSnapshot) Quantity() int { return cartQuantity(s.Items) }
+
+// cartUndo remembers the last emptied cart of each session for the undo
+// window. A nil *cartUndo remembers nothing.
+type cartUndo struct {
+	window    time.Duration
+	snapshots *cache.Cache // by session ID
+}
+
+func newCartUndo(window time.Duration) *cartUndo {
+	return &cartUndo{window: window, snapshots: cache.New(maxUndoSessions)}
+}
+
+// save remembers the items of the session's cart, replacing an earlier
+// snapshot.
+func (u *cartUndo) save(sessionID string, items []*pb.CartItem) {
+	if u == nil || len(items) == 0 {
+		return
+	}
+	u.snapshots.Set(sessionID, &cartSnapshot{
+		Token: uuid.New().String(),
+		Items: items,
+		Until: u.snapshots.Now().Add(u.window),
+	}, u.window)
+}
+
+// pending returns the snapshot the session can still restore, or nil.
+func (u *cartUndo) pending(sessionID string) *cartSnapshot {
+	if u == nil {
+		return nil
+	}
+	if v, ok := u.snapshots.Get(sessionID); ok {
+		return v.(*cartSnapshot)
+	}
+	return nil
+}
+
+// take removes and returns the session's snapshot if token identifies it.
+// A snapshot can only be taken once, so resubmitting the undo form restores
+// nothing.
+func (u *cartUndo) take(sessionID, token string) *cartSnapshot {
+	s := u.pending(sessionID)
+	if s == nil || subtle.ConstantTimeCompare([]byte(s.Token), []byte(token)) != 1 {
+		return nil
+	}
+	v, ok := u.snapshots.Take(sessionID)
+	if !ok {
+		return nil
+	}
+	if taken := v.(*cartSnapshot); taken != s {
+		// The cart was emptied again meanwhile: keep the newer snapshot.
+		u.putBack(sessionID, taken)
+		return nil
+	}
+	return s
+}
+
+// putBack returns a taken snapshot for the rest of its window, so that a
+// failed undo can be retried.
+func (u *cartUndo) putBack(sessionID string, s *cartSnapshot) {
+	if ttl := s.Until.Sub(u.snapshots.Now()); ttl > 0 {
+		u.snapshots.Set(sessionID, s, ttl)
+	}
+}
+
+// undoEmptyCartHandler adds the items of the session's last emptied cart
+// back to it. Products added since the cart was emptied are left as they
+// are rather than overwritten with their quantity in the snapshot, which
+// also makes retrying a partly failed undo safe.
+func (fe *frontendServer) undoEmptyCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	snapshot := fe.undo.take(sessionID(r), r.FormValue("undo_token"))
+	if snapshot == nil {
+		log.WithField("event", "cart_undo").Info("nothing to undo: the snapshot expired or was already restored")
+		w.Header().Set("location", "/cart")
+		w.WriteHeader(http.StatusSeeOther)
+		return
+	}
+
+	cart, err := fe.getCart(r.Context(), cartID(r))
+	if err != nil {
+		fe.undo.putBack(sessionID(r), snapshot)
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
+		return
+	}
+	present := make(map[string]bool, len(cart))
+	for _, it := range cart {
+		present[it.GetProductId()] = true
+	}
+	restored, skipped := 0, 0
+	for _, it := range snapshot.Items {
+		if present[it.GetProductId()] {
+			skipped++
+			continue
+		}
+		if err := fe.insertCart(r.Context(), cartID(r), it.GetProductId(), it.GetQuantity()); err != nil {
+			fe.undo.putBack(sessionID(r), snapshot)
+			fe.renderHTTPError(log, r, w, errors.Wrap(err, "failed to restore the cart"), http.StatusInternalServerError)
+			return
+		}
+		cart = append(cart, it)
+		restored++
+	}
+	log.WithFields(logrus.Fields{
+		"event":    "cart_undo",
+		"restored": restored,
+		"skipped":  skipped,
+	}).Info("emptied cart restored")
+	fe.setCartCount(w, cartQuantity(cart))
+	w.Header().Set("location", "/cart")
+	w.WriteHeader(http.StatusSeeOther)
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+var undoTokenValue = regexp.MustCompile(`name="undo_token" value="([^"]*)"`)
+
+// emptyCartForUndo fills the cart with 2 typewriters and 3 lenses, empties
+// it and returns the undo token offered on the resulting page.
+func emptyCartForUndo(t *testing.T, h *testHarness) string {
+	t.Helper()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"2"}})
+	h.post("/cart", url.Values{"product_id": {"66VCHSJNUP"}, "quantity": {"3"}})
+	resp := h.post("/cart/empty", nil)
+	if !strings.Contains(resp.body, "Your cart was emptied (5 items).") {
+		t.Fatal("no undo notice after emptying the cart")
+	}
+	m := undoTokenValue.FindStringSubmatch(resp.body)
+	if m == nil {
+		t.Fatal("undo notice has no undo token")
+	}
+	return m[1]
+}
+
+// cartQuantities returns the quantity of each product in the harness
+// session's cart.
+func cartQuantities(h *testHarness) map[string]int32 {
+	h.cart.mu.Lock()
+	defer h.cart.mu.Unlock()
+	out := make(map[string]int32)
+	for _, it := range h.cart.carts[h.cookie(cookieSessionID)] {
+		out[it.GetProductId()] = it.GetQuantity()
+	}
+	return out
+}
+
+func TestUndoEmptyCart(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	token := emptyCartForUndo(t, h)
+
+	// A form without the token, as a cross-site one would be, restores
+	// nothing and leaves the undo available.
+	h.post("/cart/undo", url.Values{"undo_token": {"forged"}})
+	if q := cartQuantities(h); len(q) != 0 {
+		t.Fatalf("cart restored with a wrong token: %v", q)
+	}
+
+	resp := h.post("/cart/undo", url.Values{"undo_token": {token}})
+	if resp.Request.URL.Path != "/cart" || !strings.Contains(resp.body, "View Cart (5)") {
+		t.Errorf("undo ended on %s without the restored count", resp.Request.URL.Path)
+	}
+	if strings.Contains(resp.body, `id="cart_undo"`) {
+		t.Error("undo notice still shown after the undo")
+	}
+	if q := cartQuantities(h); q["OLJCESPC7Z"] != 2 || q["66VCHSJNUP"] != 3 {
+		t.Errorf("restored cart = %v, want 2 typewriters and 3 lenses", q)
+	}
+
+	// Submitting the form again, e.g. with a double click, adds nothing.
+	h.post("/cart/undo", url.Values{"undo_token": {token}})
+	if q := cartQuantities(h); q["OLJCESPC7Z"] != 2 || q["66VCHSJNUP"] != 3 {
+		t.Errorf("cart after a repeated undo = %v, want it unchanged", q)
+	}
+	if entries := h.logs.find("cart_undo"); len(entries) != 3 || entries[1].Data["restored"] != 2 {
+		t.Errorf("undos not logged: %v", entries)
+	}
+}
+
+func TestUndoEmptyCartExpired(t *testing.T) {
+	clock := newFakeClock()
+	h := newTestHarness(t, withFakeClock(clock))
+	defer h.close()
+	token := emptyCartForUndo(t, h)
+
+	clock.Advance(defaultCartUndoWindow)
+	if resp := h.get("/"); strings.Contains(resp.body, `id="cart_undo"`) {
+		t.Error("undo notice shown after the undo window")
+	}
+	h.post("/cart/undo", url.Values{"undo_token": {token}})
+	if q := cartQuantities(h); len(q) != 0 {
+		t.Errorf("cart restored after the undo window: %v", q)
+	}
+}
+
+func TestUndoEmptyCartMerges(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	token := emptyCartForUndo(t, h)
+
+	// A lens added between emptying and undoing is kept as it is, the
+	// typewriters come back.
+	h.post("/cart", url.Values{"product_id": {"66VCHSJNUP"}, "quantity": {"1"}})
+	h.post("/cart", url.Values{"product_id": {"1YMWWN1N4O"}, "quantity": {"1"}})
+	resp := h.post("/cart/undo", url.Values{"undo_token": {token}})
+	want := map[string]int32{"OLJCESPC7Z": 2, "66VCHSJNUP": 1, "1YMWWN1N4O": 1}
+	q := cartQuantities(h)
+	for id, n := range want {
+		if q[id] != n {
+			t.Errorf("cart after undo = %v, want %v", q, want)
+			break
+		}
+	}
+	if !strings.Contains(resp.body, "View Cart (4)") {
+		t.Error("cart badge after the merge is not 4")
+	}
+}
+
+func TestCartUndoNewerSnapshot(t *testing.T) {
+	clock := newFakeClock()
+	u := newCartUndo(time.Minute)
+	u.snapshots.Now = clock.Now
+	u.save("s1", []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}})
+	first := u.pending("s1")
+	clock.Advance(30 * time.Second)
+	u.save("s1", []*pb.CartItem{{ProductId: "66VCHSJNUP", Quantity: 1}})
+
+	if s := u.take("s1", first.Token); s != nil {
+		t.Error("snapshot replaced by a later empty restored")
+	}
+	second := u.pending("s1")
+	if second == nil || second.Items[0].GetProductId() != "66VCHSJNUP" {
+		t.Fatal("latest snapshot lost")
+	}
+	if s := u.take("s1", second.Token); s != second {
+		t.Error("latest snapshot not restorable")
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	// cartRebuildAttempts is how many times a cart is rebuilt with the
+	// updated items before its original items are put back.
+	cartRebuildAttempts = 2
+	// maxCartAdditions is how many products one request may add at once.
+	maxCartAdditions = 50
+)
+
+// uncanceled is a context with the values of its parent, such as the trace
+// span and the log fields, but not its cancellation: a cart being rebuilt
+// must not be left empty because the client went away.
+type uncanceled struct{ context.Context }
+
+func (uncanceled) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (uncanceled) Done() <-chan struct{}       { return nil }
+func (uncanceled) Err() error                  { return nil }
+
+// updateCartHandler sets the quantity of a product in the cart, removing it
+// with a quantity of 0.
+func (fe *frontendServer) updateCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	productID := r.FormValue("product_id")
+	quantity, err := strconv.Atoi(r.FormValue("quantity"))
+	if productID == "" || err != nil || quantity < 0 || quantity > fe.cartMaxQuantity {
+		fe.renderHTTPError(log, r, w, errors.New("invalid form input"), http.StatusBadRequest)
+		return
+	}
+	cart, err := fe.getCart(r.Context(), cartID(r))
+	if err != nil {
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
+		return
+	}
+	current := 0
+	for _, it := range cart {
+		if it.GetProductId() == productID {
+			current += int(it.GetQuantity())
+		}
+	}
+	log = log.WithFields(logrus.Fields{"product": productID, "quantity": quantity, "previous": current})
+	switch {
+	case current == 0 && quantity > 0:
+		fe.renderHTTPError(log, r, w, errors.Errorf("product #%s is not in the cart", productID), http.StatusUnprocessableEntity)
+		return
+	case quantity == current:
+	case quantity > current:
+		// Adding to a line needs no rebuild.
+		if err := fe.insertCart(r.Context(), cartID(r), productID, int32(quantity-current)); err != nil {
+			fe.renderHTTPError(log, r, w, errors.Wrap(err, "failed to update the cart"), http.StatusInternalServerError)
+			return
+		}
+	default:
+		// The lines keep their order, so the cart page does not reshuffle.
+		var updated []*pb.CartItem
+		placed := quantity == 0
+		for _, it := range cart {
+			if it.GetProductId() != productID {
+				updated = append(updated, it)
+			} else if !placed {
+				updated = append(updated, &pb.CartItem{ProductId: productID, Quantity: int32(quantity)})
+				placed = true
+			}
+		}
+		if err := fe.rebuildCart(uncanceled{r.Context()}, log, sessionID(r), cartID(r), cart, updated); err != nil {
+			fe.renderHTTPError(log, r, w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	log.WithField("event", "cart_updated").Debug("cart quantity updated")
+	fe.setCartCount(w, cartQuantity(cart)-current+quantity)
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// rebuildCart replaces the items of the cart, as the cart service can only
+// add items or empty a cart. The rebuild is retried once; when it still
+// fails, the original items are put back. If even that fails, they are kept
+// for the session to restore with the undo of an emptied cart.
+func (fe *frontendServer) rebuildCart(ctx context.Context, log logrus.FieldLogger, sessionID, userID string, original, updated []*pb.CartItem) error {
+	var err error
+	for attempt := 1; attempt <= cartRebuildAttempts; attempt++ {
+		if err = fe.replaceCart(ctx, userID, updated); err == nil {
+			return nil
+		}
+		log.WithFields(logrus.Fields{"event": "cart_rebuild_failed", "attempt": attempt, "error": err}).
+			Warn("could not rebuild the cart")
+	}
+	if rerr := fe.replaceCart(ctx, userID, original); rerr != nil {
+		fe.undo.save(sessionID, original)
+		log.WithFields(logrus.Fields{"event": "cart_restore_failed", "items": cartQuantity(original), "error": rerr}).
+			Error("could not put the original cart items back")
+		return errors.Wrap(err, "failed to update the cart, and to restore it")
+	}
+	return errors.Wrap(err, "failed to update the cart, which was left unchanged")
+}
+
+// replaceCart empties the cart and adds the items to it.
+func (fe *frontendServer) replaceCart(ctx context.Context, userID string, items []*pb.CartItem) error {
+	if err := fe.emptyCart(ctx, userID); err != nil {
+		return errors.Wrap(err, "failed to empty the cart")
+	}
+	for _, it := range items {
+		if err := fe.insertCart(ctx, userID, it.GetProductId(), it.GetQuantity()); err != nil {
+			return errors.Wrapf(err, "failed to add product #%s", it.GetProductId())
+		}
+	}
+	return nil
+}
+
+// cartAdditions is the JSON body of a POST /cart adding several products.
+type cartAdditions struct {
+	Items []apiCartAddition `json:"items"`
+}
+
+// isJSON reports whether the body of r is JSON.
+func isJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+}
+
+// addItemsToCartHandler adds the products of a JSON body to the cart and
+// answers with the cart, the way /api/v1/cart does. Every entry is checked
+// before any is added; products added before a failure stay in the cart.
+func (fe *frontendServer) addItemsToCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	var add cartAdditions
+	if !decodeAPIBody(w, r, &add) {
+		return
+	}
+	if len(add.Items) == 0 || len(add.Items) > maxCartAdditions {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("from 1 to %d items can be added at once", maxCartAdditions))
+		return
+	}
+	f := newFormState(formAddToCart)
+	for i, it := range add.Items {
+		if it.ProductID == "" {
+			f.add(fmt.Sprintf("items[%d].product_id", i), "product_id is required")
+		}
+		if g := validateAddToCart(it.field, fe.cartMaxQuantity); g != nil {
+			for _, e := range g.Errors {
+				f.add(fmt.Sprintf("items[%d].%s", i, e.Field), e.Message)
+			}
+		}
+	}
+	if len(f.Errors) > 0 {
+		writeInvalidParams(w, r, f)
+		return
+	}
+	for _, it := range add.Items {
+		if _, err := fe.getProduct(r.Context(), it.ProductID); err != nil {
+			writeBackendProblem(w, log, err, "could not retrieve product #"+it.ProductID)
+			return
+		}
+	}
+	added := 0
+	for _, it := range add.Items {
+		if err := fe.insertCart(r.Context(), cartID(r), it.ProductID, it.Quantity); err != nil {
+			writeBackendProblem(w, log, err, "failed to add to cart")
+			return
+		}
+		fe.metrics.cartAdd()
+		added += int(it.Quantity)
+	}
+	log.WithFields(logrus.Fields{"products": len(add.Items), "quantity": added}).Debug("added to cart")
+	if n, ok := fe.cartCount(r); ok {
+		fe.setCartCount(w, n+added)
+	}
+	fe.writeAPICart(w, r)
+}
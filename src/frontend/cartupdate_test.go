@@ -0,0 +1,194 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const emptyCartMethod = "/hipstershop.CartService/EmptyCart"
+
+// fillCartForUpdate adds 3 typewriters, 1 lens and 2 of the third product
+// to the cart, in that order.
+func fillCartForUpdate(h *testHarness) {
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"3"}})
+	h.post("/cart", url.Values{"product_id": {"66VCHSJNUP"}, "quantity": {"1"}})
+	h.post("/cart", url.Values{"product_id": {"1YMWWN1N4O"}, "quantity": {"2"}})
+}
+
+// cartLines returns the lines of the harness session's cart, in order, as
+// "product×quantity".
+func cartLines(h *testHarness) string {
+	h.cart.mu.Lock()
+	defer h.cart.mu.Unlock()
+	var lines []string
+	for _, it := range h.cart.carts[h.cookie(cookieSessionID)] {
+		lines = append(lines, fmt.Sprintf("%s×%d", it.GetProductId(), it.GetQuantity()))
+	}
+	return strings.Join(lines, " ")
+}
+
+func updateCart(h *testHarness, productID, quantity string) *response {
+	return h.post("/cart/update", url.Values{"product_id": {productID}, "quantity": {quantity}})
+}
+
+func TestUpdateCart(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	fillCartForUpdate(h)
+
+	resp := updateCart(h, "OLJCESPC7Z", "1")
+	if resp.Request.URL.Path != "/cart" || !strings.Contains(resp.body, "View Cart (4)") {
+		t.Errorf("update ended on %s without the updated count", resp.Request.URL.Path)
+	}
+	if got, want := cartLines(h), "OLJCESPC7Z×1 66VCHSJNUP×1 1YMWWN1N4O×2"; got != want {
+		t.Errorf("cart = %s, want %s", got, want)
+	}
+	if n := h.faults.calls(emptyCartMethod); n != 1 {
+		t.Errorf("%d EmptyCart calls to lower a quantity, want 1", n)
+	}
+
+	// Raising a quantity adds the difference, without a rebuild.
+	updateCart(h, "66VCHSJNUP", "4")
+	if got, want := cartLines(h), "OLJCESPC7Z×1 66VCHSJNUP×4 1YMWWN1N4O×2"; got != want {
+		t.Errorf("cart = %s, want %s", got, want)
+	}
+	if n := h.faults.calls(emptyCartMethod); n != 1 {
+		t.Errorf("cart rebuilt to raise a quantity")
+	}
+
+	updateCart(h, "OLJCESPC7Z", "0")
+	if got, want := cartLines(h), "66VCHSJNUP×4 1YMWWN1N4O×2"; got != want {
+		t.Errorf("cart = %s, want %s", got, want)
+	}
+}
+
+func TestUpdateCartInvalid(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"3"}})
+
+	for _, tc := range []struct {
+		productID, quantity string
+		want                int
+	}{
+		{"OLJCESPC7Z", "-1", http.StatusBadRequest},
+		{"OLJCESPC7Z", "many", http.StatusBadRequest},
+		{"OLJCESPC7Z", "11", http.StatusBadRequest},
+		{"", "1", http.StatusBadRequest},
+		{"66VCHSJNUP", "2", http.StatusUnprocessableEntity},
+	} {
+		if resp := updateCart(h, tc.productID, tc.quantity); resp.StatusCode != tc.want {
+			t.Errorf("%s×%s: %d, want %d", tc.productID, tc.quantity, resp.StatusCode, tc.want)
+		}
+	}
+	if got := cartLines(h); got != "OLJCESPC7Z×3" {
+		t.Errorf("cart = %s after invalid updates", got)
+	}
+}
+
+func TestUpdateCartRebuildRetried(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	fillCartForUpdate(h)
+
+	// The first rebuild fails after the lens was added back.
+	h.cart.failAdding("1YMWWN1N4O", 1)
+	if resp := updateCart(h, "OLJCESPC7Z", "2"); resp.Request.URL.Path != "/cart" {
+		t.Errorf("update ended on %s (%d)", resp.Request.URL.Path, resp.StatusCode)
+	}
+	if got, want := cartLines(h), "OLJCESPC7Z×2 66VCHSJNUP×1 1YMWWN1N4O×2"; got != want {
+		t.Errorf("cart = %s, want %s", got, want)
+	}
+	if entries := h.logs.find("cart_rebuild_failed"); len(entries) != 1 {
+		t.Errorf("%d failed rebuilds logged, want 1", len(entries))
+	}
+}
+
+func TestUpdateCartRebuildFails(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	fillCartForUpdate(h)
+
+	// Both rebuilds fail; the original items are put back.
+	h.cart.failAdding("1YMWWN1N4O", cartRebuildAttempts)
+	if resp := updateCart(h, "OLJCESPC7Z", "0"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("failed update: %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if got, want := cartLines(h), "OLJCESPC7Z×3 66VCHSJNUP×1 1YMWWN1N4O×2"; got != want {
+		t.Errorf("cart = %s, want it unchanged: %s", got, want)
+	}
+	if entries := h.logs.find("cart_restore_failed"); len(entries) != 0 {
+		t.Error("restore failure logged")
+	}
+}
+
+func TestUpdateCartRestoreFails(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	fillCartForUpdate(h)
+
+	// Putting the original items back fails too: they can be restored with
+	// the undo of an emptied cart.
+	h.cart.failAdding("1YMWWN1N4O", cartRebuildAttempts+1)
+	if resp := updateCart(h, "OLJCESPC7Z", "0"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("failed update: %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if entries := h.logs.find("cart_restore_failed"); len(entries) != 1 {
+		t.Fatal("restore failure not logged")
+	}
+	resp := h.get("/cart")
+	m := undoTokenValue.FindStringSubmatch(resp.body)
+	if m == nil {
+		t.Fatal("no undo offered after losing the cart")
+	}
+	h.post("/cart/undo", url.Values{"undo_token": {m[1]}})
+	if q := cartQuantities(h); q["OLJCESPC7Z"] != 3 || q["66VCHSJNUP"] != 1 || q["1YMWWN1N4O"] != 2 {
+		t.Errorf("restored cart = %v", q)
+	}
+}
+
+func TestAddItemsToCart(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.get("/")
+
+	var cart apiCart
+	decodeAPI(t, h.postJSON("/cart", `{"items": [
+		{"product_id": "OLJCESPC7Z", "quantity": 2},
+		{"product_id": "66VCHSJNUP", "quantity": 1}]}`), http.StatusOK, &cart)
+	if cart.Size != 3 || len(cart.Items) != 2 {
+		t.Errorf("cart = %+v, want 3 items on 2 lines", cart)
+	}
+
+	var p problem
+	decodeAPI(t, h.postJSON("/cart", `{"items": [
+		{"product_id": "1YMWWN1N4O", "quantity": 1},
+		{"product_id": "OLJCESPC7Z", "quantity": 0}]}`), http.StatusBadRequest, &p)
+	if len(p.InvalidParams) != 1 || p.InvalidParams[0].Name != "items[1].quantity" {
+		t.Errorf("invalid params = %+v, want items[1].quantity", p.InvalidParams)
+	}
+	decodeAPI(t, h.postJSON("/cart", `{"items": [
+		{"product_id": "1YMWWN1N4O", "quantity": 1},
+		{"product_id": "NOSUCHPRODUCT", "quantity": 1}]}`), http.StatusNotFound, &p)
+	decodeAPI(t, h.postJSON("/cart", `{"items": []}`), http.StatusBadRequest, &p)
+	if q := cartQuantities(h); len(q) != 2 {
+		t.Errorf("cart = %v after rejected additions, want them all refused", q)
+	}
+}
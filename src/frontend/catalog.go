@@ -0,0 +1,155 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+var (
+	deadLinkSourceKey, _ = tag.NewKey("source")
+
+	deadLinks = stats.Int64("frontend/dead_product_links",
+		"Recommendations and ads dropped for linking to products missing from the catalog", stats.UnitDimensionless)
+
+	deadLinksView = &view.View{
+		Name:        "frontend/dead_product_links",
+		Measure:     deadLinks,
+		Description: deadLinks.Description(),
+		TagKeys:     []tag.Key{deadLinkSourceKey},
+		Aggregation: view.Count(),
+	}
+)
+
+// catalogIDs is the set of product IDs last listed by the catalog service.
+// It lets pages check links to products without calling the catalog.
+type catalogIDs struct {
+	mu  sync.RWMutex
+	ids map[string]bool
+
+	// generation changes whenever a listing differs from the previous one
+	// in its products or any of their details.
+	generation  uint64
+	fingerprint string
+	details     map[string]string // by product ID
+	purge       []string          // surrogate keys of the pages the last change affected
+}
+
+func (c *catalogIDs) update(products []*pb.Product) {
+	ids := make(map[string]bool, len(products))
+	details := make(map[string]string, len(products))
+	var fp strings.Builder
+	for _, p := range products {
+		ids[p.GetId()] = true
+		details[p.GetId()] = p.String()
+		fmt.Fprintf(&fp, "%s;", details[p.GetId()])
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids = ids
+	if fp.String() == c.fingerprint {
+		return
+	}
+	c.fingerprint = fp.String()
+	c.generation++
+	// Listings change with any product; a product page only with its
+	// product. The first listing has nothing to purge.
+	c.purge = nil
+	for id, d := range details {
+		if prev, ok := c.details[id]; c.details != nil && (!ok || prev != d) {
+			c.purge = append(c.purge, productSurrogateKey(id))
+		}
+	}
+	for id := range c.details {
+		if !ids[id] {
+			c.purge = append(c.purge, productSurrogateKey(id))
+		}
+	}
+	if c.details != nil {
+		sort.Strings(c.purge)
+		c.purge = append([]string{surrogateKeyCatalog}, c.purge...)
+	}
+	c.details = details
+}
+
+// purgeKeys returns the surrogate keys of the cached pages that the last
+// catalog change made stale.
+func (c *catalogIDs) purgeKeys() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.purge
+}
+
+// gen returns the generation of the last listing.
+func (c *catalogIDs) gen() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.generation
+}
+
+// dead reports whether the product is known not to be in the catalog. Until
+// the catalog has been listed once, no product is known to be dead.
+func (c *catalogIDs) dead(id string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ids != nil && !c.ids[id]
+}
+
+// recordDeadLink counts a link to a dead product from the given source.
+func recordDeadLink(ctx context.Context, source string) {
+	if ctx, err := tag.New(ctx, tag.Upsert(deadLinkSourceKey, source)); err == nil {
+		stats.Record(ctx, deadLinks.M(1))
+	}
+}
+
+// liveRecommendations drops the recommended products known to be dead and
+// keeps at most n of the others.
+func (fe *frontendServer) liveRecommendations(ctx context.Context, ids []string, n int) []string {
+	out := make([]string, 0, n)
+	for _, id := range ids {
+		if len(out) == n {
+			break
+		}
+		if fe.catalog.dead(id) {
+			recordDeadLink(ctx, "recommendation")
+			continue
+		}
+		out = append(out, id)
+	}
+	return out
+}
+
+// liveAds drops the ads linking to a product known to be dead.
+func (fe *frontendServer) liveAds(ctx context.Context, ads []*pb.Ad) []*pb.Ad {
+	var out []*pb.Ad
+	for _, ad := range ads {
+		if id := strings.TrimPrefix(ad.GetRedirectUrl(), "/product/"); id != ad.GetRedirectUrl() && fe.catalog.dead(id) {
+			recordDeadLink(ctx, "ad")
+			continue
+		}
+		out = append(out, ad)
+	}
+	return out
+}
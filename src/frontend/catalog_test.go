@@ -0,0 +1,102 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.opencensus.io/stats/view"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const listProductsMethod = "/hipstershop.ProductCatalogService/ListProducts"
+
+// deadLinkCounts returns the dead links counted so far, by source.
+func deadLinkCounts(t *testing.T) map[string]int64 {
+	t.Helper()
+	rows, err := view.RetrieveData(deadLinksView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]int64)
+	for _, row := range rows {
+		out[row.Tags[0].Value] = row.Data.(*view.CountData).Value
+	}
+	return out
+}
+
+func TestDeadRecommendations(t *testing.T) {
+	if err := view.Register(deadLinksView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(deadLinksView)
+	h := newTestHarness(t)
+	defer h.close()
+	h.recs.stale = []string{"DISCONT001", "DISCONT002", "DISCONT003", "DISCONT004", "DISCONT005"}
+
+	h.get("/") // lists the catalog
+	listed := h.faults.calls(listProductsMethod)
+	resp := h.get("/product/OLJCESPC7Z")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /product/OLJCESPC7Z = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if strings.Contains(resp.body, "DISCONT") {
+		t.Error("product page links to products missing from the catalog")
+	}
+	// The live recommendations fill in for the dead ones.
+	for _, id := range []string{"66VCHSJNUP", "1YMWWN1N4O"} {
+		if !strings.Contains(resp.body, `href="/product/`+id+`"`) {
+			t.Errorf("live recommendation %s missing", id)
+		}
+	}
+	if got := h.faults.calls(listProductsMethod); got != listed {
+		t.Errorf("checking the recommendations listed the catalog %d more times", got-listed)
+	}
+	if got := deadLinkCounts(t)["recommendation"]; got != 5 {
+		t.Errorf("counted %d dead recommendations, want 5", got)
+	}
+}
+
+func TestDeadAds(t *testing.T) {
+	if err := view.Register(deadLinksView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(deadLinksView)
+	h := newTestHarness(t, func(fe *frontendServer) {
+		fe.houseAd = &pb.Ad{RedirectUrl: "/", Text: "Discover this season's hipster essentials."}
+	})
+	defer h.close()
+	h.ads.ads = []*pb.Ad{{RedirectUrl: "/product/DISCONT001", Text: "Gone but not forgotten."}}
+
+	resp := h.get("/")
+	if strings.Contains(resp.body, "DISCONT001") {
+		t.Error("home page shows an ad linking to a product missing from the catalog")
+	}
+	if !strings.Contains(resp.body, "hipster essentials") {
+		t.Error("dead ad not replaced by the house ad")
+	}
+	if got := deadLinkCounts(t)["ad"]; got != 1 {
+		t.Errorf("counted %d dead ads, want 1", got)
+	}
+
+	// Ads linking to live products or elsewhere are kept.
+	h.ads.ads = []*pb.Ad{{RedirectUrl: "/product/66VCHSJNUP", Text: "Camera lens, 20% off."}}
+	if resp := h.get("/"); !strings.Contains(resp.body, "Camera lens, 20% off.") {
+		t.Error("live ad replaced")
+	}
+}
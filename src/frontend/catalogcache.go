@@ -0,0 +1,158 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/cache"
+)
+
+const (
+	defaultCatalogCacheTTL = 30 * time.Second
+	// maxCatalogCacheEntries bounds the cache, mostly products by ID.
+	maxCatalogCacheEntries = 1000
+)
+
+// catalogCache keeps the answers of the catalog and currency services that
+// change rarely: the product listing, the products by ID and the supported
+// currencies. Conversions are left to the rate snapshots. Concurrent misses
+// of the same key make a single backend call, whose result they share. A
+// nil cache, or one with no ttl, calls the backend every time.
+type catalogCache struct {
+	ttl   time.Duration
+	cache *cache.Cache
+	stats *rollingStats // nil counts lookups in hits and misses only
+
+	mu    sync.Mutex
+	gen   uint64 // bumped by flush, so that calls in flight do not refill the cache
+	calls map[string]*catalogCall
+
+	hits, misses int64 // atomic
+}
+
+// catalogCall is a backend call in flight for a key.
+type catalogCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+func newCatalogCache(ttl time.Duration) *catalogCache {
+	return &catalogCache{
+		ttl:   ttl,
+		cache: cache.New(maxCatalogCacheEntries),
+		calls: make(map[string]*catalogCall),
+	}
+}
+
+// get returns the value cached for key, or the value fetch returns, caching
+// it unless it failed. A caller waiting on another's call gives up when its
+// ctx is done.
+func (c *catalogCache) get(ctx context.Context, key string, fetch func(context.Context) (interface{}, error)) (interface{}, error) {
+	if c == nil || c.ttl <= 0 {
+		return fetch(ctx)
+	}
+	if v, ok := c.cache.Get(key); ok {
+		c.lookup(true)
+		return v, nil
+	}
+	c.lookup(false)
+
+	c.mu.Lock()
+	call, ok := c.calls[key]
+	if !ok {
+		call = &catalogCall{done: make(chan struct{})}
+		c.calls[key] = call
+		gen := c.gen
+		c.mu.Unlock()
+		call.value, call.err = fetch(ctx)
+		c.mu.Lock()
+		delete(c.calls, key)
+		if call.err == nil && gen == c.gen {
+			c.cache.Set(key, call.value, c.ttl)
+		}
+		c.mu.Unlock()
+		close(call.done)
+		return call.value, call.err
+	}
+	c.mu.Unlock()
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// timeToLive returns the ttl of the cached values, 0 when disabled.
+func (c *catalogCache) timeToLive() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return c.ttl
+}
+
+func (c *catalogCache) lookup(hit bool) {
+	if hit {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+	c.stats.cacheLookup(statsCacheCatalog, hit)
+}
+
+// lookups returns the number of hits and misses since the start.
+func (c *catalogCache) lookups() (hits, misses int64) {
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
+
+// flush drops the cached values and returns how many there were.
+func (c *catalogCache) flush() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	n := c.cache.Len()
+	c.cache.Purge()
+	return n
+}
+
+// catalogCacheFlushHandler empties the catalog cache, for demos of changes
+// made to the catalog.
+func (fe *frontendServer) catalogCacheFlushHandler(w http.ResponseWriter, r *http.Request) {
+	if !fe.demoMode && !fe.debugEnabled(r) {
+		http.NotFound(w, r)
+		return
+	}
+	n := fe.catalogCache.flush()
+	hits, misses := fe.catalogCache.lookups()
+	r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger).WithFields(logrus.Fields{
+		"event":   "catalog_cache_flushed",
+		"entries": n,
+	}).Info("flushed the catalog cache")
+	fe.serveDebugJSON(w, r, map[string]interface{}{"flushed": n, "hits": hits, "misses": misses})
+}
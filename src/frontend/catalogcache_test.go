@@ -0,0 +1,118 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCatalogCacheConcurrentMisses(t *testing.T) {
+	c := newCatalogCache(time.Minute)
+	var calls int32
+	release := make(chan struct{})
+	fetch := func(context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "product", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.get(context.Background(), "product/1", fetch); err != nil || v != "product" {
+				t.Errorf("get = %v, %v; want product", v, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // lets every get miss
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("%d backend calls for concurrent misses, want 1", n)
+	}
+	if hits, misses := c.lookups(); hits+misses != 10 {
+		t.Errorf("%d hits and %d misses counted, want 10 lookups", hits, misses)
+	}
+}
+
+func TestCatalogCache(t *testing.T) {
+	var calls int
+	fetch := func(context.Context) (interface{}, error) {
+		if calls++; calls == 1 {
+			return nil, errors.New("unavailable")
+		}
+		return calls, nil
+	}
+
+	c := newCatalogCache(time.Minute)
+	if _, err := c.get(context.Background(), "k", fetch); err == nil {
+		t.Fatal("failed fetch returned no error")
+	}
+	if v, _ := c.get(context.Background(), "k", fetch); v != 2 {
+		t.Errorf("get after a failure = %v, want a new fetch", v)
+	}
+	if v, _ := c.get(context.Background(), "k", fetch); v != 2 {
+		t.Errorf("get = %v, want the cached 2", v)
+	}
+	if n := c.flush(); n != 1 {
+		t.Errorf("flush dropped %d entries, want 1", n)
+	}
+	if v, _ := c.get(context.Background(), "k", fetch); v != 3 {
+		t.Errorf("get after flush = %v, want a new fetch", v)
+	}
+
+	disabled := newCatalogCache(0)
+	disabled.get(context.Background(), "k", fetch)
+	if v, _ := disabled.get(context.Background(), "k", fetch); v != 5 {
+		t.Errorf("get with no ttl = %v, want a new fetch", v)
+	}
+}
+
+func TestCatalogCacheFlushEndpoint(t *testing.T) {
+	const method = "/hipstershop.CurrencyService/GetSupportedCurrencies"
+	h := newTestHarness(t, func(fe *frontendServer) {
+		fe.catalogCache = newCatalogCache(time.Minute)
+	})
+	defer h.close()
+
+	h.get("/")
+	h.get("/")
+	if n := h.faults.calls(method); n != 1 {
+		t.Fatalf("%d calls for two pages, want 1", n)
+	}
+	if resp := h.post("/debug/cache/flush", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("flush without debug endpoints: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	h.fe.demoMode = true
+	if resp := h.post("/debug/cache/flush", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("flush: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if len(h.logs.find("catalog_cache_flushed")) != 1 {
+		t.Error("no catalog_cache_flushed event logged")
+	}
+	h.get("/")
+	if n := h.faults.calls(method); n != 2 {
+		t.Errorf("%d calls after the flush, want 2", n)
+	}
+}
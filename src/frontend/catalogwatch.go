@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCatalogPollInterval = 15 * time.Second
+	maxCatalogPollBackoff      = 2 * time.Minute
+	catalogPollTimeout         = 5 * time.Second
+)
+
+// Ways of noticing catalog changes, for CATALOG_REFRESH_MODE.
+const (
+	catalogRefreshPoll = "poll"
+	catalogRefreshOff  = "off"
+	// catalogRefreshWatch would stream changes from the catalog service,
+	// which has no such RPC yet; it falls back to polling.
+	catalogRefreshWatch = "watch"
+)
+
+// watchCatalog lists the products every interval until ctx is done. A
+// listing that differs from the previous one bumps the catalog generation,
+// which drops the cached products, fragments and facets, so replicas pick up a
+// reloaded catalog within an interval even on pages that do not list it.
+// The catalog_changed event lists the surrogate keys of the pages to purge
+// from a CDN.
+// Failed listings are retried with an exponential backoff.
+func (fe *frontendServer) watchCatalog(ctx context.Context, log logrus.FieldLogger, interval time.Duration) {
+	delay := interval
+	for {
+		t := fe.clock.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C():
+		}
+
+		before := fe.catalog.gen()
+		pollCtx, cancel := context.WithTimeout(ctx, catalogPollTimeout)
+		_, err := fe.listProducts(pollCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if delay *= 2; delay > maxCatalogPollBackoff {
+				delay = maxCatalogPollBackoff
+			}
+			log.WithFields(logrus.Fields{
+				"event": "catalog_poll_failed",
+				"error": err,
+				"retry": delay.String(),
+			}).Warn("failed to poll the catalog")
+			continue
+		}
+		delay = interval
+		if gen := fe.catalog.gen(); gen != before {
+			fe.catalogCache.flush()
+			log.WithFields(logrus.Fields{
+				"event":      "catalog_changed",
+				"generation": gen,
+				"purge_keys": strings.Join(fe.catalog.purgeKeys(), " "),
+			}).Info("catalog changed, cached products, fragments and facets dropped")
+		}
+	}
+}
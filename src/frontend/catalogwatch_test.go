@@ -0,0 +1,120 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// startCatalogWatch runs the catalog watcher of the harness and returns a
+// function stopping it, which fails the test if the watcher does not return.
+func startCatalogWatch(t *testing.T, h *testHarness) (stop func()) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.AddHook(h.logs)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.fe.watchCatalog(ctx, log, defaultCatalogPollInterval)
+		close(done)
+	}()
+	return func() {
+		t.Helper()
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("catalog watcher still running after its context was canceled")
+		}
+	}
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestCatalogWatchInvalidates(t *testing.T) {
+	clock := newFakeClock()
+	h := newTestHarness(t, withFakeClock(clock))
+	defer h.close()
+	if home := h.get("/"); !strings.Contains(home.body, "Vintage Camera Lens") {
+		t.Fatal("home page does not show the lens")
+	}
+	stop := startCatalogWatch(t, h)
+	defer stop()
+	waitFor(t, "the first poll to be scheduled", func() bool { return len(clock.timersStarted()) == 1 })
+
+	// The catalog service reloads a catalog with the lens renamed.
+	gen := h.fe.catalog.gen()
+	lens := proto.Clone(h.catalog.products[1]).(*pb.Product)
+	lens.Name = "Vintage Camera Lens (Refurbished)"
+	h.catalog.mu.Lock()
+	h.catalog.products = []*pb.Product{h.catalog.products[0], lens, h.catalog.products[2]}
+	h.catalog.mu.Unlock()
+
+	clock.Advance(defaultCatalogPollInterval)
+	waitFor(t, "the catalog generation to change", func() bool { return h.fe.catalog.gen() != gen })
+	if entries := h.logs.find("catalog_changed"); len(entries) != 1 {
+		t.Errorf("catalog change logged %d times, want once", len(entries))
+	}
+	if home := h.get("/"); !strings.Contains(home.body, "Vintage Camera Lens (Refurbished)") {
+		t.Error("home page still shows the product card of the old catalog")
+	}
+}
+
+func TestCatalogWatchBackoff(t *testing.T) {
+	clock := newFakeClock()
+	clock.autoAdvance = true
+	h := newTestHarness(t, withFakeClock(clock))
+	defer h.close()
+	h.fail(listProductsMethod, status.Error(codes.Unavailable, "catalog down"))
+	stop := startCatalogWatch(t, h)
+	defer stop()
+
+	waitFor(t, "the backoff to reach its maximum", func() bool { return len(clock.timersStarted()) >= 7 })
+	want := []time.Duration{15 * time.Second, 30 * time.Second, time.Minute, 2 * time.Minute, 2 * time.Minute}
+	for i, d := range clock.timersStarted()[:len(want)] {
+		if d != want[i] {
+			t.Errorf("poll %d after %v, want %v", i, d, want[i])
+		}
+	}
+	if len(h.logs.find("catalog_poll_failed")) == 0 {
+		t.Error("failed polls not logged")
+	}
+
+	// Once the catalog is back, polls are on the interval again.
+	h.fail(listProductsMethod, nil)
+	waitFor(t, "polls on the interval", func() bool {
+		started := clock.timersStarted()
+		return started[len(started)-1] == defaultCatalogPollInterval
+	})
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/curation"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// defaultCurationRefresh is how often the curated content is reloaded and
+// validated again against the catalog.
+const defaultCurationRefresh = time.Minute
+
+// curationStore holds the curated content of the category pages, loaded
+// from a file. It is reloaded lazily, with the catalog listed by the page
+// being rendered, once the refresh interval has passed.
+type curationStore struct {
+	path    string
+	refresh time.Duration
+	now     func() time.Time
+
+	mu     sync.Mutex
+	cfg    *curation.Config
+	loaded time.Time
+}
+
+func newCurationStore(path string, refresh time.Duration) *curationStore {
+	return &curationStore{path: path, refresh: refresh, now: time.Now}
+}
+
+// get returns the current content, reloading it first when it is stale. On
+// reload errors the previous content is kept.
+func (s *curationStore) get(log logrus.FieldLogger, products []*pb.Product) *curation.Config {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loaded.IsZero() && s.now().Sub(s.loaded) < s.refresh {
+		return s.cfg
+	}
+	s.loaded = s.now()
+
+	cfg, err := curation.Load(s.path)
+	if err != nil {
+		log.WithField("error", err).Warn("failed to load the category curation, keeping the previous one")
+		return s.cfg
+	}
+	known := make(map[string]bool, len(products))
+	for _, p := range products {
+		known[p.GetId()] = true
+	}
+	for _, w := range cfg.Validate(known, staticFileExists) {
+		log.Warn("category curation: " + w)
+	}
+	s.cfg = cfg
+	return cfg
+}
+
+// staticFileExists reports whether a URL path refers to a file served from
+// ./static. Other URLs are assumed to exist.
+func staticFileExists(path string) bool {
+	if !strings.HasPrefix(path, "/static/") {
+		return true
+	}
+	fi, err := os.Stat(filepath.Join(".", filepath.FromSlash(path)))
+	return err == nil && !fi.IsDir()
+}
+
+func (fe *frontendServer) categoryHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	name := mux.Vars(r)["name"]
+	log.WithField("category", name).WithField("currency", currentCurrency(r)).Debug("serving category page")
+
+	currencies, err := fe.getCurrencies(r.Context())
+	if err != nil {
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+		return
+	}
+	all, err := fe.getProducts(r.Context())
+	if err != nil {
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve products"), http.StatusInternalServerError)
+		return
+	}
+	cartSize, err := fe.cartSize(r.Context(), w, r)
+	if err != nil {
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
+		return
+	}
+
+	var products []*pb.Product
+	for _, p := range all {
+		for _, c := range p.GetCategories() {
+			if strings.EqualFold(c, name) {
+				products = append(products, p)
+				break
+			}
+		}
+	}
+	if len(products) == 0 {
+		fe.renderHTTPError(log, r, w, errors.Errorf("no products in category %q", name), http.StatusNotFound)
+		return
+	}
+
+	// Featured products come first, in their curated order; without
+	// curation this is the plain filtered grid.
+	curated := fe.curation.get(log, all).Category(name)
+	sort.SliceStable(products, func(i, j int) bool {
+		ri, fi := curated.Rank(products[i].GetId())
+		rj, fj := curated.Rank(products[j].GetId())
+		if fi != fj {
+			return fi
+		}
+		return fi && ri < rj
+	})
+
+	prices := make([]*pb.Money, len(products))
+	for i, p := range products {
+		prices[i] = p.GetPriceUsd()
+	}
+	ps := make([]productView, len(products))
+	for i, res := range fe.convertAll(r.Context(), prices, currentCurrency(r)) {
+		if res.Err != nil {
+			log.WithField("product", products[i].GetId()).WithField("error", res.Err).Warn("failed to do currency conversion")
+		}
+		_, featured := curated.Rank(products[i].GetId())
+		ps[i] = productView{Item: products[i], Price: res.Money, Featured: featured, Locale: requestLocale(r)}
+	}
+
+	filter := parsePriceFilter(r, currentCurrency(r))
+	converted := make([]*pb.Money, len(ps))
+	for i := range ps {
+		converted[i] = ps[i].Price
+	}
+	facets := fe.priceFacetLinks(r.Context(), r, "category "+strings.ToLower(name), converted, filter)
+	shown := ps[:0]
+	for _, p := range ps {
+		if filter.match(p.Price) {
+			shown = append(shown, p)
+		}
+	}
+
+	if !fe.delayRendering(log, r) {
+		return
+	}
+	addSurrogateKeys(r.Context(), true, products...)
+
+	fe.render(w, r, http.StatusOK, "category", fe.injectCommonTemplateData(r, map[string]interface{}{
+		"user_currency": currentCurrency(r),
+		"currencies":    currencies,
+		"category":      strings.ToLower(name),
+		"curated":       curated,
+		"products":      shown,
+		"price_facets":  facets,
+		"cart_size":     cartSize,
+	}))
+}
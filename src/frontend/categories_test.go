@@ -0,0 +1,167 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withCuration serves the category pages with the given curated content.
+func withCuration(t *testing.T, content string) (func(*frontendServer), string) {
+	dir, err := ioutil.TempDir("", "curation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "curation.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return func(fe *frontendServer) { fe.curation = newCurationStore(path, defaultCurationRefresh) }, dir
+}
+
+// productOrder returns the product IDs in the order they appear in a page.
+func productOrder(body string, ids ...string) []string {
+	pos := make(map[string]int)
+	for _, id := range ids {
+		pos[id] = strings.Index(body, "/product/"+id)
+	}
+	var out []string
+	for len(pos) > 0 {
+		first := ""
+		for id, p := range pos {
+			if first == "" || p < pos[first] {
+				first = id
+			}
+		}
+		if pos[first] >= 0 {
+			out = append(out, first)
+		}
+		delete(pos, first)
+	}
+	return out
+}
+
+func TestCategoryPlainGrid(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	resp := h.get("/category/vintage")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /category/vintage = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := productOrder(resp.body, "OLJCESPC7Z", "66VCHSJNUP", "1YMWWN1N4O"); len(got) != 2 || got[0] != "OLJCESPC7Z" {
+		t.Errorf("products = %v, want the vintage products in catalog order", got)
+	}
+	if strings.Contains(resp.body, "Featured") {
+		t.Error("uncurated page shows featured products")
+	}
+	if resp := h.get("/category/furniture"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /category/furniture = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestCategoryCurated(t *testing.T) {
+	opt, dir := withCuration(t, `{"categories": {"vintage": {
+		"hero_image": "/static/img/products/typewriter.jpg",
+		"tagline": "Old is the new new.",
+		"featured": ["66VCHSJNUP", "DISCONTINUED"]}}}`)
+	defer os.RemoveAll(dir)
+	h := newTestHarness(t, opt)
+	defer h.close()
+
+	resp := h.get("/category/vintage")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /category/vintage = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := productOrder(resp.body, "OLJCESPC7Z", "66VCHSJNUP"); len(got) != 2 || got[0] != "66VCHSJNUP" {
+		t.Errorf("products = %v, want the featured product first", got)
+	}
+	for _, want := range []string{"Old is the new new.", "background-image: url('/static/img/products/typewriter.jpg')"} {
+		if !strings.Contains(resp.body, want) {
+			t.Errorf("page does not contain %q", want)
+		}
+	}
+	var warned bool
+	for _, e := range h.logs.entries {
+		warned = warned || strings.Contains(e.Message, `"DISCONTINUED" is not in the catalog`)
+	}
+	if !warned {
+		t.Error("no warning for the featured product missing from the catalog")
+	}
+
+	// Other categories keep the plain grid.
+	if resp := h.get("/category/cookware"); resp.StatusCode != http.StatusOK || strings.Contains(resp.body, "Old is the new new.") {
+		t.Errorf("GET /category/cookware = %d with curated content", resp.StatusCode)
+	}
+}
+
+func TestCategoryMissingHeroImage(t *testing.T) {
+	opt, dir := withCuration(t, `{"categories": {"vintage": {
+		"hero_image": "/static/img/hero/missing.jpg", "tagline": "Old is the new new."}}}`)
+	defer os.RemoveAll(dir)
+	h := newTestHarness(t, opt)
+	defer h.close()
+
+	resp := h.get("/category/vintage")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /category/vintage = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if strings.Contains(resp.body, "missing.jpg") {
+		t.Error("page refers to the missing hero image")
+	}
+	if !strings.Contains(resp.body, "Old is the new new.") {
+		t.Error("page lost the tagline with the hero image")
+	}
+}
+
+func TestCategoryCurationReload(t *testing.T) {
+	opt, dir := withCuration(t, `{"categories": {"vintage": {"tagline": "First edition."}}}`)
+	defer os.RemoveAll(dir)
+	h := newTestHarness(t, opt)
+	defer h.close()
+	now := time.Now()
+	h.fe.curation.now = func() time.Time { return now }
+
+	if resp := h.get("/category/vintage"); !strings.Contains(resp.body, "First edition.") {
+		t.Fatal("curated tagline missing")
+	}
+	path := filepath.Join(dir, "curation.json")
+	if err := ioutil.WriteFile(path, []byte(`{"categories": {"vintage": {"tagline": "Second edition."}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if resp := h.get("/category/vintage"); !strings.Contains(resp.body, "First edition.") {
+		t.Error("curation reloaded before the refresh interval")
+	}
+
+	now = now.Add(defaultCurationRefresh)
+	if resp := h.get("/category/vintage"); !strings.Contains(resp.body, "Second edition.") {
+		t.Error("curation not reloaded after the refresh interval")
+	}
+
+	// A broken file keeps the last good content.
+	if err := ioutil.WriteFile(path, []byte(`{"categories": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(defaultCurationRefresh)
+	if resp := h.get("/category/vintage"); !strings.Contains(resp.body, "Second edition.") {
+		t.Error("broken curation replaced the last good one")
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/cache"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	checkoutPreviewTTL  = 5 * time.Minute // how long an order review can be confirmed
+	maxCheckoutPreviews = 1000            // order reviews whose card is kept
+)
+
+// previewTokenPrefix tells preview tokens from checkout states, which are
+// signed with the same key.
+const previewTokenPrefix = "preview:"
+
+// checkoutFields are the fields of the checkout form, carried from the
+// order review to the order it confirms.
+var checkoutFields = []string{
+	"email", "street_address", "zip_code", "city", "state", "country",
+	"checkout_state",
+}
+
+// cardFields are the card fields of the checkout form. They are kept on
+// the server while the order is reviewed, rather than in the review page.
+var cardFields = []string{
+	"credit_card_number", "credit_card_expiration_month", "credit_card_expiration_year", "credit_card_cvv",
+}
+
+var errPreviewExpired = errors.New("order review expired")
+
+// previewField is a field of the checkout form, as a hidden field of the
+// order review.
+type previewField struct {
+	Name, Value string
+}
+
+// previewCards keeps the card of each order review until the order is
+// confirmed. A card is kept past the expiry of its review, for an expired
+// review to be shown again without the card entered again.
+type previewCards struct {
+	cards *cache.Cache // by preview token: map[string]string of the card fields
+}
+
+func newPreviewCards() *previewCards {
+	return &previewCards{cards: cache.New(maxCheckoutPreviews)}
+}
+
+func (p *previewCards) save(token string, r *http.Request) {
+	card := make(map[string]string, len(cardFields))
+	for _, name := range cardFields {
+		card[name] = r.FormValue(name)
+	}
+	p.cards.Set(token, card, 2*checkoutPreviewTTL)
+}
+
+// take returns the card of the review of token, once.
+func (p *previewCards) take(token string) (map[string]string, bool) {
+	v, ok := p.cards.Take(token)
+	if !ok {
+		return nil, false
+	}
+	return v.(map[string]string), true
+}
+
+// lastDigits returns the last four digits of a card number.
+func lastDigits(number string) string {
+	digits := strings.NewReplacer("-", "", " ", "").Replace(number)
+	if len(digits) > 4 {
+		digits = digits[len(digits)-4:]
+	}
+	return digits
+}
+
+// orderDigest hashes what the total of an order depends on: the cart
+// lines, whatever their order, the currency and the shipping address.
+func orderDigest(cart []*pb.CartItem, currency string, addr *pb.Address) string {
+	lines := make([]string, len(cart))
+	for i, item := range cart {
+		lines[i] = item.GetProductId() + "\x00" + strconv.Itoa(int(item.GetQuantity()))
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, l := range lines {
+		fmt.Fprintf(h, "%s\x00", l)
+	}
+	fmt.Fprintf(h, "\x00%s\x00%s\x00%s\x00%s\x00%d\x00%s", currency,
+		addr.GetStreetAddress(), addr.GetCity(), addr.GetState(), addr.GetZipCode(), addr.GetCountry())
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// signPreview returns the token of an order review: the digest of the
+// order reviewed and the time it expires, bound to the session and signed
+// so neither can be altered by the client.
+func (fe *frontendServer) signPreview(sessionID, digest string, expires time.Time) string {
+	payload := previewTokenPrefix + strconv.FormatInt(expires.Unix(), 10) + ":" + digest
+	return payload + "." + base64.RawURLEncoding.EncodeToString(fe.checkoutStateMAC(sessionID, payload))
+}
+
+// verifyPreview returns the order digest of a token made by signPreview for
+// the same session, or errPreviewExpired if it expired before now.
+func (fe *frontendServer) verifyPreview(sessionID, token string, now time.Time) (string, error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return "", errInvalidCheckoutState
+	}
+	payload, sig := token[:i], token[i+1:]
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, fe.checkoutStateMAC(sessionID, payload)) || !strings.HasPrefix(payload, previewTokenPrefix) {
+		return "", errInvalidCheckoutState
+	}
+	parts := strings.SplitN(strings.TrimPrefix(payload, previewTokenPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errInvalidCheckoutState
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", errInvalidCheckoutState
+	}
+	if now.After(time.Unix(expires, 0)) {
+		return "", errPreviewExpired
+	}
+	return parts[1], nil
+}
+
+// checkoutPreviewHandler shows the order the checkout form would place,
+// priced the way it would be charged, without placing it. The review is
+// confirmed by posting the form to the checkout with its token.
+func (fe *frontendServer) checkoutPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log.Debug("reviewing order")
+	co, ok := fe.prepareCheckout(w, r, log)
+	if !ok {
+		return
+	}
+	fe.renderPreview(w, r, log, co, "")
+}
+
+// restorePreviewCard puts the card kept for the review of token back in
+// the checkout form. A review already confirmed, or kept too long, has no
+// card left: the cart is shown again for it to be entered. It returns
+// false once it has responded, the order not to be placed.
+func (fe *frontendServer) restorePreviewCard(w http.ResponseWriter, r *http.Request, log logrus.FieldLogger, token string) bool {
+	card, ok := fe.previews.take(token)
+	if !ok {
+		if _, err := fe.verifyPreview(sessionID(r), token, fe.clock.Now()); err == errInvalidCheckoutState {
+			fe.renderHTTPError(log, r, w, errors.Wrap(err, "could not confirm the order"), http.StatusBadRequest)
+			return false
+		}
+		log.Info("order review already confirmed or forgotten, showing the cart again")
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return false
+	}
+	for name, v := range card {
+		r.Form.Set(name, v)
+	}
+	return true
+}
+
+// checkPreview checks the token of the review an order is confirmed from.
+// A token altered or made for another session fails the request; an
+// expired one, or one for an order that changed since, gets the review
+// shown again with a notice. It returns false once it has responded, the
+// order not to be placed.
+func (fe *frontendServer) checkPreview(w http.ResponseWriter, r *http.Request, log logrus.FieldLogger, co pendingCheckout, token string) bool {
+	digest, err := fe.verifyPreview(sessionID(r), token, fe.clock.Now())
+	switch {
+	case err == errPreviewExpired:
+		log.Info("order review expired, showing it again")
+		fe.renderPreview(w, r, log, co, "expired")
+		return false
+	case err != nil:
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "could not confirm the order"), http.StatusBadRequest)
+		return false
+	case digest != orderDigest(co.cart, currentCurrency(r), co.req.GetAddress()):
+		log.Info("order changed since its review, showing it again")
+		fe.renderPreview(w, r, log, co, "changed")
+		return false
+	}
+	return true
+}
+
+// renderPreview renders the review of a checkout, with a notice saying why
+// it is shown again, if it is.
+func (fe *frontendServer) renderPreview(w http.ResponseWriter, r *http.Request, log logrus.FieldLogger, co pendingCheckout, notice string) {
+	if co.err != nil {
+		fe.renderHTTPError(log, r, w, errors.Wrap(co.err, "could not price the order"), http.StatusInternalServerError)
+		return
+	}
+	if len(co.cart) == 0 {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+	fields := make([]previewField, len(checkoutFields))
+	for i, name := range checkoutFields {
+		fields[i] = previewField{Name: name, Value: r.FormValue(name)}
+	}
+	expires := fe.clock.Now().Add(checkoutPreviewTTL)
+	token := fe.signPreview(sessionID(r), orderDigest(co.cart, currentCurrency(r), co.req.GetAddress()), expires)
+	fe.previews.save(token, r)
+	fe.render(w, r, http.StatusOK, "checkout_preview", fe.injectCommonTemplateData(r, map[string]interface{}{
+		"user_currency": currentCurrency(r),
+		"quote":         co.displayed,
+		"address":       co.req.GetAddress(),
+		"email":         co.req.GetEmail(),
+		"card_digits":   lastDigits(r.FormValue("credit_card_number")),
+		"fields":        fields,
+		"preview_token": token,
+		"expires":       expires,
+		"notice":        notice,
+	}))
+}
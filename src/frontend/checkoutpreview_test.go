@@ -0,0 +1,191 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var (
+	hiddenField = regexp.MustCompile(`<input type="hidden" name="([^"]+)" value="([^"]*)">`)
+	reviewTotal = regexp.MustCompile(`id="review_total">([^<]*)<`)
+)
+
+// reviewForm returns the hidden fields of an order review, the form
+// confirming it.
+func reviewForm(t *testing.T, resp *response) url.Values {
+	t.Helper()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.body, "Review your order") {
+		t.Fatalf("status %d at %s, want the order review", resp.StatusCode, resp.Request.URL)
+	}
+	form := url.Values{}
+	for _, m := range hiddenField.FindAllStringSubmatch(resp.body, -1) {
+		form.Set(m[1], html.UnescapeString(m[2]))
+	}
+	if form.Get("preview_token") == "" {
+		t.Fatal("order review without a token")
+	}
+	return form
+}
+
+func TestCheckoutPreview(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"2"}})
+
+	review := h.post("/cart/checkout/preview", checkoutForm)
+	form := reviewForm(t, review)
+	if n := h.faults.calls(placeOrderMethod); n != 0 {
+		t.Fatalf("reviewing placed %d orders", n)
+	}
+	if !strings.Contains(review.body, "Vintage Typewriter") || !strings.Contains(review.body, "1600 Amphitheatre Parkway, 94043 Mountain View") {
+		t.Error("review does not show the items and address")
+	}
+	total := reviewTotal.FindStringSubmatch(review.body)
+	if total == nil {
+		t.Fatal("review shows no total")
+	}
+	// The card stays on the server, only its last digits are shown.
+	for field, want := range checkoutForm {
+		if strings.HasPrefix(field, "credit_card_") {
+			if _, ok := form[field]; ok {
+				t.Errorf("review carries %s", field)
+			}
+		} else if got := form.Get(field); got != want[0] {
+			t.Errorf("review carries %s = %q, want %q", field, got, want[0])
+		}
+	}
+	if strings.Contains(review.body, "4432-8015-6152") {
+		t.Error("review shows the card number")
+	}
+	if !strings.Contains(review.body, `id="review_card">0454<`) {
+		t.Error("review does not show the last digits of the card")
+	}
+
+	order := h.post("/cart/checkout", form)
+	if !strings.HasPrefix(order.Request.URL.Path, "/order/") {
+		t.Fatalf("confirming the review led to %s, want the order", order.Request.URL)
+	}
+	if n := h.faults.calls(placeOrderMethod); n != 1 {
+		t.Errorf("placed %d orders, want 1", n)
+	}
+	if !strings.Contains(order.body, "Total Paid: <strong>"+total[1]+"</strong>") {
+		t.Errorf("order does not show the reviewed total %s as paid", total[1])
+	}
+
+	// The card is forgotten once the order is placed.
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	if again := h.post("/cart/checkout", form); again.Request.URL.Path != "/cart" {
+		t.Errorf("confirming the review again led to %s, want the cart", again.Request.URL)
+	}
+	if n := h.faults.calls(placeOrderMethod); n != 1 {
+		t.Errorf("placed %d orders, want 1", n)
+	}
+	if n := h.fe.previews.cards.Len(); n != 0 {
+		t.Errorf("%d cards kept after the order", n)
+	}
+}
+
+func TestCheckoutPreviewTampered(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	form := reviewForm(t, h.post("/cart/checkout/preview", checkoutForm))
+	token := form.Get("preview_token")
+
+	for name, tampered := range map[string]string{
+		"digest":         strings.Replace(token, ":", ":A", 1),
+		"expiry":         strings.Replace(token, "preview:", "preview:9", 1),
+		"signature":      token[:len(token)-2] + "AA",
+		"checkout state": h.fe.signCheckoutState(h.cookie(cookieSessionID), 1),
+		"other session":  h.fe.signPreview("other-session", "digest", h.fe.clock.Now().Add(checkoutPreviewTTL)),
+	} {
+		f := url.Values{}
+		for k, v := range form {
+			f[k] = v
+		}
+		f.Set("preview_token", tampered)
+		if resp := h.post("/cart/checkout", f); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s altered: status %d, want 400", name, resp.StatusCode)
+		}
+	}
+	if n := h.faults.calls(placeOrderMethod); n != 0 {
+		t.Errorf("placed %d orders from altered reviews", n)
+	}
+}
+
+func TestCheckoutPreviewExpired(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	form := reviewForm(t, h.post("/cart/checkout/preview", checkoutForm))
+
+	h.fe.clock.setOffset(checkoutPreviewTTL + 1)
+	again := h.post("/cart/checkout", form)
+	if !strings.Contains(again.body, `id="preview_notice"`) || !strings.Contains(again.body, "expired") {
+		t.Fatal("expired review not shown again with a notice")
+	}
+	if n := h.faults.calls(placeOrderMethod); n != 0 {
+		t.Fatalf("placed %d orders from an expired review", n)
+	}
+	if order := h.post("/cart/checkout", reviewForm(t, again)); !strings.HasPrefix(order.Request.URL.Path, "/order/") {
+		t.Errorf("confirming the new review led to %s, want the order", order.Request.URL)
+	}
+}
+
+func TestCheckoutPreviewOrderChanged(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	form := reviewForm(t, h.post("/cart/checkout/preview", checkoutForm))
+	first := reviewTotal.FindStringSubmatch(h.post("/cart/checkout/preview", checkoutForm).body)
+
+	// A field of the review altered to ship elsewhere.
+	abroad := url.Values{}
+	for k, v := range form {
+		abroad[k] = v
+	}
+	abroad.Set("country", "Germany")
+	resp := h.post("/cart/checkout", abroad)
+	if !strings.Contains(resp.body, `id="preview_notice"`) {
+		t.Fatal("review confirmed with another address")
+	}
+	form = reviewForm(t, resp)
+	form.Set("country", checkoutForm.Get("country"))
+
+	h.post("/cart", url.Values{"product_id": {"66VCHSJNUP"}, "quantity": {"1"}})
+	again := h.post("/cart/checkout", form)
+	if !strings.Contains(again.body, `id="preview_notice"`) || !strings.Contains(again.body, "changed") {
+		t.Fatal("review of a changed cart not shown again with a notice")
+	}
+	if n := h.faults.calls(placeOrderMethod); n != 0 {
+		t.Fatalf("placed %d orders from outdated reviews", n)
+	}
+	second := reviewTotal.FindStringSubmatch(again.body)
+	if second == nil || second[1] == first[1] {
+		t.Errorf("review total %v after adding to the cart, want other than %s", second, first[1])
+	}
+	if !strings.Contains(again.body, "Vintage Camera Lens") {
+		t.Error("review of the changed cart misses the product added")
+	}
+	if order := h.post("/cart/checkout", reviewForm(t, again)); !strings.HasPrefix(order.Request.URL.Path, "/order/") {
+		t.Errorf("confirming the new review led to %s, want the order", order.Request.URL)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+)
+
+var (
+	checkoutRerenders = stats.Int64("frontend/checkout_rerenders",
+		"Checkouts sent back to the cart because their rate snapshot expired", stats.UnitDimensionless)
+
+	checkoutRerendersView = &view.View{
+		Name:        "frontend/checkout_rerenders",
+		Measure:     checkoutRerenders,
+		Description: checkoutRerenders.Description(),
+		Aggregation: view.Count(),
+	}
+)
+
+var errInvalidCheckoutState = errors.New("invalid checkout state")
+
+// signCheckoutState returns the checkout state embedded in the checkout
+// form: the rate generation the cart was priced with, bound to the session
+// and signed so it cannot be altered by the client.
+func (fe *frontendServer) signCheckoutState(sessionID string, generation uint64) string {
+	payload := strconv.FormatUint(generation, 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(fe.checkoutStateMAC(sessionID, payload))
+}
+
+// verifyCheckoutState returns the rate generation of a checkout state made
+// by signCheckoutState for the same session.
+func (fe *frontendServer) verifyCheckoutState(sessionID, state string) (uint64, error) {
+	i := strings.LastIndexByte(state, '.')
+	if i < 0 {
+		return 0, errInvalidCheckoutState
+	}
+	payload, sig := state[:i], state[i+1:]
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, fe.checkoutStateMAC(sessionID, payload)) {
+		return 0, errInvalidCheckoutState
+	}
+	generation, err := strconv.ParseUint(payload, 10, 64)
+	if err != nil {
+		return 0, errInvalidCheckoutState
+	}
+	return generation, nil
+}
+
+func (fe *frontendServer) checkoutStateMAC(sessionID, payload string) []byte {
+	h := hmac.New(sha256.New, fe.checkoutKey)
+	h.Write([]byte(sessionID))
+	h.Write([]byte{0})
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
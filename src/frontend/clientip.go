@@ -0,0 +1,104 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// trustedProxies are the load balancers and proxies whose X-Forwarded-For
+// entries are believed.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses TRUSTED_PROXIES: comma-separated CIDR ranges
+// or single addresses.
+func parseTrustedProxies(v string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("invalid address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Errorf("invalid range %q", s)
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+func (p trustedProxies) contains(ip net.IP) bool {
+	for _, n := range p {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of a request received from
+// remoteAddr with the given X-Forwarded-For values. Each proxy appends the
+// address it received the request from, so the entries are read from the
+// right, through the trusted proxies, up to the first address that is not
+// one: everything left of it may have been written by the client. When an
+// entry is not an address, the last hop known is returned.
+func clientIP(remoteAddr string, xff []string, trusted trustedProxies) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trusted.contains(ip) {
+		return host
+	}
+	var hops []string
+	for _, v := range xff {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !trusted.contains(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// clientIP returns the address of the client of r. Without trusted proxies,
+// X-Forwarded-For is ignored: it is the address the request came from.
+func (fe *frontendServer) clientIP(r *http.Request) string {
+	return clientIP(r.RemoteAddr, r.Header["X-Forwarded-For"], fe.trustedProxies)
+}
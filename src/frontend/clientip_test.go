@@ -0,0 +1,68 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 35.191.0.0/16, 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct", "203.0.113.7:5123", nil, "203.0.113.7"},
+		{"spoofed by a direct client", "203.0.113.7:5123", []string{"1.2.3.4"}, "203.0.113.7"},
+		{"through the load balancer", "10.1.2.3:80", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"spoofed through the load balancer", "10.1.2.3:80", []string{"1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{"multi-hop", "10.1.2.3:80", []string{"203.0.113.7, 35.191.4.5, 10.9.9.9"}, "203.0.113.7"},
+		{"multi-hop in several headers", "10.1.2.3:80", []string{"1.2.3.4, 203.0.113.7", "35.191.4.5"}, "203.0.113.7"},
+		{"untrusted hop", "10.1.2.3:80", []string{"203.0.113.7, 198.51.100.2, 10.9.9.9"}, "198.51.100.2"},
+		{"all trusted", "10.1.2.3:80", []string{"10.4.4.4, 10.9.9.9"}, "10.4.4.4"},
+		{"garbage hop", "10.1.2.3:80", []string{"203.0.113.7, <script>, 35.191.4.5"}, "35.191.4.5"},
+		{"no header from the load balancer", "10.1.2.3:80", nil, "10.1.2.3"},
+		{"IPv6 proxy", "[2001:db8::1]:443", []string{"2001:db8::42"}, "2001:db8::42"},
+		{"IPv4 client of an IPv6 proxy", "[2001:db8::1]:443", []string{" 203.0.113.7 "}, "203.0.113.7"},
+	} {
+		if got := clientIP(tc.remote, tc.xff, trusted); got != tc.want {
+			t.Errorf("%s: clientIP(%q, %q) = %q, want %q", tc.name, tc.remote, tc.xff, got, tc.want)
+		}
+	}
+}
+
+func TestClientIPWithoutTrustedProxies(t *testing.T) {
+	if got := clientIP("10.1.2.3:80", []string{"203.0.113.7"}, nil); got != "10.1.2.3" {
+		t.Errorf("clientIP = %q, want the remote address", got)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.1, ,192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proxies) != 2 || proxies[0].String() != "10.0.0.1/32" || proxies[1].String() != "192.168.0.0/16" {
+		t.Errorf("proxies = %v", proxies)
+	}
+	for _, bad := range []string{"10.0.0", "10.0.0.0/33", "proxy.internal"} {
+		if _, err := parseTrustedProxies(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxClockOffset bounds how far the demo clock can be moved.
+const maxClockOffset = 366 * 24 * time.Hour
+
+// clock is the source of time of the time-dependent features, so tests can
+// control it.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) timer
+	After(d time.Duration) <-chan time.Time
+}
+
+// timer is the part of *time.Timer used by the frontend.
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) NewTimer(d time.Duration) timer         { return realTimer{time.NewTimer(d)} }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop() bool          { return t.t.Stop() }
+
+// offsetClock is a clock running ahead of, or behind, another by an offset
+// that can be changed at any time. The offset only moves the time read;
+// timers and delays last as long as on the underlying clock.
+type offsetClock struct {
+	base   clock
+	offset int64 // atomic, a time.Duration
+}
+
+func newOffsetClock(base clock) *offsetClock { return &offsetClock{base: base} }
+
+func (c *offsetClock) Now() time.Time                         { return c.base.Now().Add(c.Offset()) }
+func (c *offsetClock) NewTimer(d time.Duration) timer         { return c.base.NewTimer(d) }
+func (c *offsetClock) After(d time.Duration) <-chan time.Time { return c.base.After(d) }
+
+func (c *offsetClock) Offset() time.Duration { return time.Duration(atomic.LoadInt64(&c.offset)) }
+
+func (c *offsetClock) setOffset(d time.Duration) { atomic.StoreInt64(&c.offset, int64(d)) }
+
+// clockOffsetHandler moves the clock of the frontend by the offset
+// parameter, e.g. "48h" or "-30m", so that time-dependent flows can be
+// demonstrated without waiting; "0" resets it. It is only registered in demo
+// mode and requires the admin token.
+func (fe *frontendServer) clockOffsetHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	if !fe.demoMode {
+		http.NotFound(w, r)
+		return
+	}
+	if !fe.isAdmin(r) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	offset, err := time.ParseDuration(r.FormValue("offset"))
+	if err != nil || offset > maxClockOffset || offset < -maxClockOffset {
+		http.Error(w, fmt.Sprintf("offset must be a duration within %v", maxClockOffset), http.StatusBadRequest)
+		return
+	}
+
+	previous := fe.clock.Offset()
+	fe.clock.setOffset(offset)
+	log.WithFields(logrus.Fields{
+		"event":    "clock_offset",
+		"offset":   offset.String(),
+		"previous": previous.String(),
+		"now":      fe.clock.Now().Format(time.RFC3339),
+	}).Warn("DEMO CLOCK MOVED: the frontend no longer runs on the real time")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Offset string    `json:"offset"`
+		Now    time.Time `json:"now"`
+	}{offset.String(), fe.clock.Now()})
+}
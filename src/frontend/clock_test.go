@@ -0,0 +1,208 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock moved by the test. Its timers fire when Advance
+// passes their deadline, or right away with autoAdvance, which moves the
+// clock to their deadline instead of waiting.
+type fakeClock struct {
+	mu          sync.Mutex
+	now         time.Time
+	autoAdvance bool
+	timers      []*fakeTimer
+	started     []time.Duration // durations of every timer started
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	c       chan time.Time
+	at      time.Time
+	stopped bool
+	fired   bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := !t.stopped && !t.fired
+	t.stopped = true
+	return active
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.started = append(c.started, d)
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), at: c.now.Add(d)}
+	if c.autoAdvance {
+		c.now = t.at
+	}
+	c.timers = append(c.timers, t)
+	c.fireLocked()
+	return t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time { return c.NewTimer(d).C() }
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.fireLocked()
+}
+
+func (c *fakeClock) fireLocked() {
+	for _, t := range c.timers {
+		if !t.fired && !t.stopped && !t.at.After(c.now) {
+			t.fired = true
+			t.c <- t.at
+		}
+	}
+}
+
+// timersStarted returns the durations of the timers started so far.
+func (c *fakeClock) timersStarted() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.started...)
+}
+
+// withFakeClock runs the frontend on a fake clock.
+func withFakeClock(c *fakeClock) func(*frontendServer) {
+	return func(fe *frontendServer) { fe.clock = newOffsetClock(c) }
+}
+
+func TestOffsetClock(t *testing.T) {
+	base := newFakeClock()
+	c := newOffsetClock(base)
+	start := base.Now()
+
+	c.setOffset(48 * time.Hour)
+	if got := c.Now().Sub(start); got != 48*time.Hour {
+		t.Errorf("Now() is %v ahead, want 48h", got)
+	}
+	timer := c.NewTimer(time.Minute)
+	base.Advance(59 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired early: the offset must not shorten delays")
+	default:
+	}
+	base.Advance(time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Error("timer did not fire")
+	}
+}
+
+func (h *testHarness) setClockOffset(offset, token string) *response {
+	h.t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/admin/clock/offset",
+		strings.NewReader(url.Values{"offset": {offset}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return h.do(req)
+}
+
+func TestClockOffset(t *testing.T) {
+	clock := newFakeClock()
+	h := newTestHarness(t, withAdminToken, withFakeClock(clock), func(fe *frontendServer) { fe.demoMode = true })
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	generation := h.fe.rates.snapshot().generation
+
+	for _, tc := range []struct {
+		offset, token string
+		want          int
+	}{
+		{"48h", "", http.StatusUnauthorized},
+		{"48h", "guess", http.StatusUnauthorized},
+		{"two days", "s3cret", http.StatusBadRequest},
+		{"9000h", "s3cret", http.StatusBadRequest},
+	} {
+		if resp := h.setClockOffset(tc.offset, tc.token); resp.StatusCode != tc.want {
+			t.Errorf("offset %q with token %q: status %d, want %d", tc.offset, tc.token, resp.StatusCode, tc.want)
+		}
+	}
+	if off := h.fe.clock.Offset(); off != 0 {
+		t.Fatalf("clock moved by %v by rejected requests", off)
+	}
+
+	const offset = 366 * 24 * time.Hour
+	if resp := h.setClockOffset("8784h", "s3cret"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /admin/clock/offset = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if entries := h.logs.find("clock_offset"); len(entries) != 1 || entries[0].Data["offset"] != offset.String() {
+		t.Errorf("clock offset not logged: %v", entries)
+	}
+
+	// Rendered dates, request logs and rate staleness all follow the clock.
+	cart := h.get("/cart")
+	year := clock.Now().Add(offset).Year()
+	if !strings.Contains(cart.body, fmt.Sprintf(`<option value="%d"`, year)) || strings.Contains(cart.body, fmt.Sprintf(`<option value="%d"`, year-1)) {
+		t.Errorf("card expiration years do not start in %d", year)
+	}
+	h.get("/")
+	var logged bool
+	for _, e := range h.logs.entries {
+		logged = logged || e.Data["clock_offset"] == offset.String()
+	}
+	if !logged {
+		t.Error("requests served with a moved clock are not logged with the offset")
+	}
+	if got := h.fe.rates.snapshot().generation; got == generation {
+		t.Error("rates not refreshed after moving the clock past their refresh interval")
+	}
+
+	if resp := h.setClockOffset("0", "s3cret"); resp.StatusCode != http.StatusOK || h.fe.clock.Offset() != 0 {
+		t.Error("clock offset not reset")
+	}
+}
+
+func TestClockOffsetOutsideDemoMode(t *testing.T) {
+	h := newTestHarness(t, withAdminToken)
+	defer h.close()
+	if resp := h.setClockOffset("48h", "s3cret"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("POST /admin/clock/offset = %d outside demo mode, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if off := h.fe.clock.Offset(); off != 0 {
+		t.Errorf("clock moved by %v outside demo mode", off)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	defaultConfirmationTTL  = time.Hour
+	confirmationSweepPeriod = time.Minute
+	maxSessionConfirmations = 5     // orders listed on /orders
+	maxConfirmations        = 10000 // across sessions
+)
+
+// confirmation is an order placed by a session, as its confirmation page
+// shows it.
+type confirmation struct {
+	Order       *pb.OrderResult
+	TotalPaid   *pb.Money
+	Discrepancy *totalDiscrepancy
+	Quote       *cartQuote // the cart as displayed, nil if it could not be priced
+	Placed      time.Time
+
+	session string
+	expires time.Time
+	dropped bool
+}
+
+// confirmations keeps the orders each session placed recently, so that the
+// confirmation page can be served after the checkout form redirects to it.
+// Entries expire after ttl; the oldest are dropped beyond
+// maxSessionConfirmations for a session and maxConfirmations in all.
+type confirmations struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	bySession map[string][]*confirmation // oldest first
+	queue     []*confirmation            // oldest first, dropped ones included
+	size      int
+}
+
+func newConfirmations(ttl time.Duration) *confirmations {
+	return &confirmations{ttl: ttl, now: time.Now, bySession: make(map[string][]*confirmation)}
+}
+
+// add records an order placed by the session.
+func (c *confirmations) add(sessionID string, o *confirmation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	o.session, o.expires = sessionID, c.now().Add(c.ttl)
+	list := append(c.bySession[sessionID], o)
+	if len(list) > maxSessionConfirmations {
+		list[0].dropped = true
+		list = list[1:]
+		c.size--
+	}
+	c.bySession[sessionID] = list
+	c.queue = append(c.queue, o)
+	c.size++
+	for c.size > maxConfirmations {
+		c.drop(c.queue[0])
+		c.queue = c.queue[1:]
+	}
+}
+
+// drop removes o from its session's list. The caller removes it from the
+// queue.
+func (c *confirmations) drop(o *confirmation) {
+	if o.dropped {
+		return
+	}
+	o.dropped = true
+	c.size--
+	list := c.bySession[o.session]
+	for i, e := range list {
+		if e == o {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(c.bySession, o.session)
+	} else {
+		c.bySession[o.session] = list
+	}
+}
+
+// get returns the order with the given ID if the session placed it and it
+// has not expired.
+func (c *confirmations) get(sessionID, orderID string) (*confirmation, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for _, o := range c.bySession[sessionID] {
+		if o.Order.GetOrderId() == orderID && now.Before(o.expires) {
+			return o, true
+		}
+	}
+	return nil, false
+}
+
+// list returns the unexpired orders of the session, newest first.
+func (c *confirmations) list(sessionID string) []*confirmation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	var out []*confirmation
+	list := c.bySession[sessionID]
+	for i := len(list) - 1; i >= 0; i-- {
+		if now.Before(list[i].expires) {
+			out = append(out, list[i])
+		}
+	}
+	return out
+}
+
+// sweep drops the expired orders and returns how many it dropped. As all
+// orders live for the same ttl, they expire in the order of the queue.
+func (c *confirmations) sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now, n := c.now(), 0
+	for len(c.queue) > 0 && (c.queue[0].dropped || !now.Before(c.queue[0].expires)) {
+		if !c.queue[0].dropped {
+			c.drop(c.queue[0])
+			n++
+		}
+		c.queue = c.queue[1:]
+	}
+	return n
+}
+
+// len returns the number of orders kept.
+func (c *confirmations) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// sweepConfirmations drops expired orders every interval until ctx is done.
+func (fe *frontendServer) sweepConfirmations(ctx context.Context, log logrus.FieldLogger, interval time.Duration) {
+	for {
+		t := fe.clock.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C():
+		}
+		if n := fe.confirmed.sweep(); n > 0 {
+			log.WithField("dropped", n).Debug("dropped expired order confirmations")
+		}
+	}
+}
+
+// orderHandler shows the confirmation of an order placed by the session.
+// Orders of other sessions are not found.
+func (fe *frontendServer) orderHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	o, ok := fe.confirmed.get(sessionID(r), mux.Vars(r)["order_id"])
+	if !ok {
+		fe.renderHTTPError(log, r, w, errors.New("order not found"), http.StatusNotFound)
+		return
+	}
+
+	recommendations, err := fe.getRecommendations(r.Context(), sessionID(r), nil)
+	if err != nil {
+		degradeOptional(r.Context(), log, "ListRecommendations", err)
+	}
+	if !fe.delayRendering(log, r) {
+		return
+	}
+	fe.render(w, r, http.StatusOK, "order", fe.injectCommonTemplateData(r, map[string]interface{}{
+		"user_currency":   currentCurrency(r),
+		"order":           o.Order,
+		"total_paid":      o.TotalPaid,
+		"discrepancy":     o.Discrepancy,
+		"cart_quote":      o.Quote,
+		"recommendations": recommendations,
+	}))
+}
+
+// ordersHandler lists the orders the session placed recently.
+func (fe *frontendServer) ordersHandler(w http.ResponseWriter, r *http.Request) {
+	fe.render(w, r, http.StatusOK, "orders", fe.injectCommonTemplateData(r, map[string]interface{}{
+		"user_currency": currentCurrency(r),
+		"orders":        fe.confirmed.list(sessionID(r)),
+	}))
+}
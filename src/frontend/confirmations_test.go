@@ -0,0 +1,148 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// placeTestOrder places an order for a typewriter and returns the response to the
+// checkout form, redirects followed.
+func (h *testHarness) placeTestOrder() *response {
+	h.t.Helper()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	resp := h.post("/cart/checkout", checkoutForm)
+	if resp.StatusCode != http.StatusOK {
+		h.t.Fatalf("POST /cart/checkout = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	return resp
+}
+
+func TestOrderConfirmationRedirect(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	resp := h.placeTestOrder()
+	if len(resp.redirects) != 1 || !strings.HasPrefix(resp.redirects[0], "/order/") {
+		t.Fatalf("checkout redirects = %v, want the order page", resp.redirects)
+	}
+	orderID := strings.TrimPrefix(resp.redirects[0], "/order/")
+	if !strings.Contains(resp.body, orderID) {
+		t.Error("confirmation page lacks the order ID")
+	}
+
+	reloaded := h.get(resp.redirects[0])
+	if reloaded.StatusCode != http.StatusOK || !strings.Contains(reloaded.body, orderID) {
+		t.Errorf("reloading the confirmation: status = %d", reloaded.StatusCode)
+	}
+	if n := h.faults.calls(placeOrderMethod); n != 1 {
+		t.Errorf("%d orders placed, want 1", n)
+	}
+
+	h.placeTestOrder()
+	list := h.get("/orders")
+	if list.StatusCode != http.StatusOK || !strings.Contains(list.body, `href="/order/`+orderID+`"`) {
+		t.Errorf("/orders does not link to order %s", orderID)
+	}
+	if n := strings.Count(list.body, `href="/order/`); n != 2 {
+		t.Errorf("/orders lists %d orders, want 2", n)
+	}
+}
+
+func TestOrderConfirmationOtherSession(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	page := h.placeTestOrder().redirects[0]
+
+	jar, _ := cookiejar.New(nil)
+	h.client.Jar = jar
+	if resp := h.get(page); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("order of another session: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if resp := h.get("/orders"); strings.Contains(resp.body, page) {
+		t.Error("/orders lists an order of another session")
+	}
+	if resp := h.get("/order/NOSUCHORDER"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown order: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestOrderConfirmationExpiry(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	page := h.placeTestOrder().redirects[0]
+
+	h.fe.clock.setOffset(defaultConfirmationTTL)
+	if resp := h.get(page); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expired order: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestConfirmationsEviction(t *testing.T) {
+	now := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := newConfirmations(time.Hour)
+	c.now = func() time.Time { return now }
+	order := func(id string) *confirmation {
+		return &confirmation{Order: &pb.OrderResult{OrderId: id}}
+	}
+
+	for i := 0; i < maxSessionConfirmations+2; i++ {
+		c.add("a", order(strconv.Itoa(i)))
+	}
+	if n := len(c.list("a")); n != maxSessionConfirmations {
+		t.Errorf("session keeps %d orders, want %d", n, maxSessionConfirmations)
+	}
+	if _, ok := c.get("a", "0"); ok {
+		t.Error("oldest order of the session not dropped")
+	}
+	if l := c.list("a"); l[0].Order.GetOrderId() != strconv.Itoa(maxSessionConfirmations+1) {
+		t.Errorf("list starts with %s, want the newest order", l[0].Order.GetOrderId())
+	}
+	if _, ok := c.get("b", "1"); ok {
+		t.Error("order found for another session")
+	}
+
+	now = now.Add(30 * time.Minute)
+	for i := 0; i < maxConfirmations; i++ {
+		c.add("s"+strconv.Itoa(i), order("x"))
+	}
+	if n := c.len(); n != maxConfirmations {
+		t.Errorf("%d orders kept, want %d", n, maxConfirmations)
+	}
+	if len(c.list("a")) != 0 {
+		t.Error("oldest orders not dropped when full")
+	}
+
+	now = now.Add(40 * time.Minute)
+	c.add("a", order("late"))
+	now = now.Add(30 * time.Minute)
+	if n := c.sweep(); n != maxConfirmations-1 {
+		t.Errorf("sweep dropped %d orders, want %d", n, maxConfirmations-1)
+	}
+	if _, ok := c.get("a", "late"); !ok || c.len() != 1 {
+		t.Errorf("after the sweep: %d orders kept, want the late one", c.len())
+	}
+	if len(c.bySession) != 1 {
+		t.Errorf("%d sessions kept, want 1", len(c.bySession))
+	}
+}
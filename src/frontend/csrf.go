@@ -0,0 +1,147 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+const (
+	// csrfField is the hidden field of the forms carrying the token.
+	csrfField = "csrf_token"
+	// csrfHeader carries the token for the clients posting with scripts.
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfExemptPaths are the operator endpoints that require the admin or
+// the debug token, which browsers do not send on their own. The other debug
+// endpoints, such as /debug/cache/flush, are open in demo mode and checked
+// like any form.
+var csrfExemptPaths = []string{"/admin/", "/debug/flags", "/debug/loadgen"}
+
+// csrfToken returns the token of the forms of a session. It is a MAC of
+// the session ID, so it changes along with the session, as on logout, and
+// is worthless in any other session.
+func (fe *frontendServer) csrfToken(sessionID string) string {
+	h := hmac.New(sha256.New, fe.csrfKey)
+	h.Write([]byte("csrf\x00"))
+	h.Write([]byte(sessionID))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// validCSRFToken reports whether token is that of the session, in constant
+// time.
+func (fe *frontendServer) validCSRFToken(sessionID, token string) bool {
+	return token != "" && hmac.Equal([]byte(token), []byte(fe.csrfToken(sessionID)))
+}
+
+// verifyCSRF rejects the state-changing requests that could have been
+// forged by another site. A form post must carry the session's token, in
+// its csrf_token field or the X-CSRF-Token header. A request to the JSON
+// API must carry the token in the header, X-Requested-With, or an
+// Authorization header, none of which a cross-site form can set.
+//
+// Pages cached at the edge cannot carry a per-session token: with edge
+// caching on, a form post without one is taken when its Origin, or
+// Referer, is this host.
+func (fe *frontendServer) verifyCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, p := range csrfExemptPaths {
+			if strings.HasPrefix(r.URL.Path, p) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		reason := fe.csrfRejection(r)
+		if reason == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+		log.WithFields(logrus.Fields{
+			"event":  "csrf_rejected",
+			"reason": reason,
+			"origin": r.Header.Get("Origin"),
+		}).Warn("request without a valid CSRF token")
+		trace.FromContext(r.Context()).AddAttributes(trace.StringAttribute("csrf.rejected", reason))
+
+		if csrfHeaderRoute(r) {
+			writeProblem(w, http.StatusForbidden, "send the X-Requested-With header, or the session's token in "+csrfHeader)
+			return
+		}
+		fe.render(w, r, http.StatusForbidden, "error", fe.injectCommonTemplateData(r, map[string]interface{}{
+			"status_code": http.StatusForbidden,
+			"status":      http.StatusText(http.StatusForbidden),
+			"csrf":        true,
+		}))
+	})
+}
+
+// csrfRejection returns why a state-changing request is rejected, or ""
+// if it is not.
+func (fe *frontendServer) csrfRejection(r *http.Request) string {
+	if token := r.Header.Get(csrfHeader); token != "" {
+		if fe.validCSRFToken(sessionID(r), token) {
+			return ""
+		}
+		return "invalid token"
+	}
+	if csrfHeaderRoute(r) {
+		if r.Header.Get("X-Requested-With") != "" || r.Header.Get("Authorization") != "" {
+			return ""
+		}
+		return "missing header"
+	}
+	token := r.PostFormValue(csrfField)
+	switch {
+	case token == "" && fe.edgeCache != nil && sameOrigin(r):
+		return ""
+	case token == "":
+		return "missing token"
+	case !fe.validCSRFToken(sessionID(r), token):
+		return "invalid token"
+	}
+	return ""
+}
+
+// csrfHeaderRoute reports whether a request is one of a programmatic
+// client, to be checked for a header rather than a form field.
+func csrfHeaderRoute(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") || isJSON(r)
+}
+
+// sameOrigin reports whether a request comes from a page of this host,
+// according to its Origin header, or its Referer without one.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	u, err := url.Parse(origin)
+	return err == nil && origin != "" && u.Host == r.Host
+}
@@ -0,0 +1,190 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// postRaw posts a form with none of the headers or fields h.post adds,
+// the way another site's page would.
+func (h *testHarness) postRaw(path string, form url.Values, header http.Header) *response {
+	h.t.Helper()
+	req, err := http.NewRequest(http.MethodPost, h.srv.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	return h.do(req)
+}
+
+func TestCSRFMissingToken(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.get("/")
+
+	for _, path := range []string{"/cart", "/cart/empty", "/cart/update", "/setCurrency", "/logout", "/cart/checkout"} {
+		resp := h.postRaw(path, url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}, "currency_code": {"EUR"}}, nil)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("POST %s without a token = %d, want 403", path, resp.StatusCode)
+		}
+		if !strings.Contains(resp.body, "This form has expired") {
+			t.Errorf("POST %s without a token: rejection not explained", path)
+		}
+	}
+	if n := h.faults.calls(addItemMethod); n != 0 {
+		t.Errorf("AddItem called %d times, want none", n)
+	}
+	if n := h.faults.calls(placeOrderMethod); n != 0 {
+		t.Errorf("PlaceOrder called %d times, want none", n)
+	}
+	if h.cookie(cookieCurrency) != "" {
+		t.Error("currency changed by a forged form")
+	}
+	if entries := h.logs.find("csrf_rejected"); len(entries) != 6 || entries[0].Data["reason"] != "missing token" {
+		t.Errorf("logged %d rejections, want 6 for a missing token", len(entries))
+	}
+
+	token := h.fe.csrfToken(h.session())
+	if resp := h.postRaw("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}, csrfField: {token}}, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /cart with the token = %d, want 200", resp.StatusCode)
+	}
+	header := http.Header{csrfHeader: {token}}
+	if resp := h.postRaw("/cart/empty", nil, header); resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /cart/empty with the token in %s = %d, want 200", csrfHeader, resp.StatusCode)
+	}
+}
+
+func TestCSRFDebugEndpointsOpenInDemoMode(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) { fe.demoMode = true })
+	defer h.close()
+	h.get("/")
+
+	if resp := h.postRaw("/debug/cache/flush", nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("forged cache flush = %d, want 403", resp.StatusCode)
+	}
+	if len(h.logs.find("catalog_cache_flushed")) != 0 {
+		t.Error("catalog cache flushed by a forged form")
+	}
+	if resp := h.post("/debug/cache/flush", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("cache flush with the token = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestCSRFTokenRotatesOnLogout(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.get("/")
+	stale := h.fe.csrfToken(h.session())
+
+	if resp := h.post("/logout", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /logout = %d, want 200", resp.StatusCode)
+	}
+	if fresh := h.fe.csrfToken(h.session()); fresh == stale {
+		t.Fatal("token unchanged by logging out")
+	}
+	resp := h.postRaw("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}, csrfField: {stale}}, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST /cart with the token of the logged out session = %d, want 403", resp.StatusCode)
+	}
+	if entries := h.logs.find("csrf_rejected"); len(entries) != 1 || entries[0].Data["reason"] != "invalid token" {
+		t.Errorf("logged %d rejections, want one for an invalid token", len(entries))
+	}
+}
+
+func TestCSRFTokenOfAnotherSession(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.get("/")
+	victim := h.session()
+
+	// The attacker's own session gets the attacker a valid token, for that
+	// session only.
+	attacker := h.fe.csrfToken("attacker-session")
+	form := url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}, csrfField: {attacker}}
+	if resp := h.postRaw("/cart", form, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST /cart with another session's token = %d, want 403", resp.StatusCode)
+	}
+	if resp := h.postRaw("/cart/empty", nil, http.Header{csrfHeader: {attacker}}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST /cart/empty with another session's token in %s = %d, want 403", csrfHeader, resp.StatusCode)
+	}
+	if h.session() != victim {
+		t.Error("session changed by a rejected form")
+	}
+	if n := h.faults.calls(addItemMethod); n != 0 {
+		t.Errorf("AddItem called %d times, want none", n)
+	}
+}
+
+func TestCSRFJSONAPI(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.get("/")
+
+	post := func(header http.Header) *response {
+		req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/api/v1/cart", strings.NewReader(`{"product_id": "OLJCESPC7Z", "quantity": 1}`))
+		req.Header.Set("Content-Type", "application/json")
+		for k, vs := range header {
+			req.Header[k] = vs
+		}
+		return h.do(req)
+	}
+	var p problem
+	decodeAPI(t, post(nil), http.StatusForbidden, &p)
+	if !strings.Contains(p.Detail, "X-Requested-With") {
+		t.Errorf("problem detail = %q, want it to name the header", p.Detail)
+	}
+	for _, header := range []http.Header{
+		{"X-Requested-With": {"XMLHttpRequest"}},
+		{csrfHeader: {h.fe.csrfToken(h.session())}},
+	} {
+		if resp := post(header); resp.StatusCode != http.StatusOK {
+			t.Errorf("POST /api/v1/cart with %v = %d, want 200", header, resp.StatusCode)
+		}
+	}
+	if resp := post(http.Header{csrfHeader: {h.fe.csrfToken("another")}}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST /api/v1/cart with another session's token = %d, want 403", resp.StatusCode)
+	}
+	// A form posted to a JSON route is refused too, whatever its fields.
+	if resp := h.postRaw("/cart", nil, http.Header{"Content-Type": {"application/json"}}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("JSON POST /cart without the header = %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestCSRFEdgeCachedForms(t *testing.T) {
+	h := newTestHarness(t, withEdgeCache)
+	defer h.close()
+	h.get("/")
+
+	form := url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}}
+	if resp := h.postRaw("/cart", form, http.Header{"Origin": {h.srv.URL}}); resp.StatusCode != http.StatusOK {
+		t.Errorf("tokenless POST /cart from this host = %d, want 200", resp.StatusCode)
+	}
+	if resp := h.postRaw("/cart", form, http.Header{"Referer": {h.srv.URL + "/product/OLJCESPC7Z"}}); resp.StatusCode != http.StatusOK {
+		t.Errorf("tokenless POST /cart referred by this host = %d, want 200", resp.StatusCode)
+	}
+	if resp := h.postRaw("/cart", form, http.Header{"Origin": {"https://evil.example"}}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("tokenless POST /cart from another site = %d, want 403", resp.StatusCode)
+	}
+	if resp := h.postRaw("/cart", form, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("tokenless POST /cart of unknown origin = %d, want 403", resp.StatusCode)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package curation loads the curated content of category landing pages: a
+// hero image, a tagline and products featured before the others. The
+// content is a JSON file of the form
+//
+//	{
+//	  "categories": {
+//	    "vintage": {
+//	      "hero_image": "/static/img/hero/vintage.jpg",
+//	      "tagline": "Old is the new new.",
+//	      "featured": ["OLJCESPC7Z"]
+//	    }
+//	  }
+//	}
+package curation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Config is the curated content of every curated category.
+type Config struct {
+	Categories map[string]*Category `json:"categories"`
+}
+
+// Category is the curated content of one category page.
+type Category struct {
+	HeroImage string   `json:"hero_image"`
+	Tagline   string   `json:"tagline"`
+	Featured  []string `json:"featured"` // product IDs, rendered first
+}
+
+// Parse reads a config. Unknown fields are rejected so that typos do not go
+// unnoticed.
+func Parse(r io.Reader) (*Config, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("invalid curation config: %v", err)
+	}
+	for name, cat := range c.Categories {
+		if cat == nil {
+			return nil, fmt.Errorf("invalid curation config: category %q is null", name)
+		}
+	}
+	return &c, nil
+}
+
+// Load reads the config in the given file.
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Validate checks the config against the catalog. Featured products that
+// are not in the catalog, or featured twice, are dropped, and hero images
+// that do not exist are cleared so the page is rendered without them. It
+// returns a warning for each change. A nil imageExists accepts every image.
+func (c *Config) Validate(products map[string]bool, imageExists func(path string) bool) []string {
+	var warnings []string
+	for name, cat := range c.Categories {
+		seen := make(map[string]bool, len(cat.Featured))
+		featured := cat.Featured[:0]
+		for _, id := range cat.Featured {
+			switch {
+			case !products[id]:
+				warnings = append(warnings, fmt.Sprintf("category %q: featured product %q is not in the catalog", name, id))
+			case seen[id]:
+				warnings = append(warnings, fmt.Sprintf("category %q: product %q is featured twice", name, id))
+			default:
+				seen[id] = true
+				featured = append(featured, id)
+			}
+		}
+		cat.Featured = featured
+
+		if cat.HeroImage != "" && imageExists != nil && !imageExists(cat.HeroImage) {
+			warnings = append(warnings, fmt.Sprintf("category %q: hero image %q does not exist", name, cat.HeroImage))
+			cat.HeroImage = ""
+		}
+	}
+	return warnings
+}
+
+// Category returns the curated content of a category, or nil when it is not
+// curated. Category names are case-insensitive.
+func (c *Config) Category(name string) *Category {
+	if c == nil {
+		return nil
+	}
+	for n, cat := range c.Categories {
+		if strings.EqualFold(n, name) {
+			return cat
+		}
+	}
+	return nil
+}
+
+// Rank returns the position of a featured product, and false for products
+// that are not featured.
+func (c *Category) Rank(id string) (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+	for i, f := range c.Featured {
+		if f == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package curation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const sample = `{
+  "categories": {
+    "vintage": {
+      "hero_image": "/static/img/hero/vintage.jpg",
+      "tagline": "Old is the new new.",
+      "featured": ["OLJCESPC7Z", "MISSING", "66VCHSJNUP", "OLJCESPC7Z"]
+    },
+    "cookware": {"tagline": "Brew like a barista."}
+  }
+}`
+
+func TestParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := c.Category("Vintage")
+	if v == nil || v.Tagline != "Old is the new new." || len(v.Featured) != 4 {
+		t.Errorf("Category(Vintage) = %+v", v)
+	}
+	if c.Category("photography") != nil {
+		t.Error("uncurated category has content")
+	}
+	var nilConfig *Config
+	if nilConfig.Category("vintage") != nil {
+		t.Error("nil config has content")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, in := range []string{
+		`{"categories": {"vintage": {"tagline": "x", "featured": "OLJCESPC7Z"}}}`,
+		`{"categories": {"vintage": {"headline": "x"}}}`,
+		`{"categories": {"vintage": null}}`,
+		`{"categories": `,
+	} {
+		if _, err := Parse(strings.NewReader(in)); err == nil {
+			t.Errorf("Parse(%s) succeeded", in)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c, err := Parse(strings.NewReader(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	products := map[string]bool{"OLJCESPC7Z": true, "66VCHSJNUP": true}
+	warnings := c.Validate(products, func(string) bool { return false })
+	if len(warnings) != 3 {
+		t.Errorf("got warnings %q, want 3", warnings)
+	}
+	v := c.Category("vintage")
+	if want := []string{"OLJCESPC7Z", "66VCHSJNUP"}; !reflect.DeepEqual(v.Featured, want) {
+		t.Errorf("featured = %v, want %v", v.Featured, want)
+	}
+	if v.HeroImage != "" {
+		t.Error("missing hero image kept")
+	}
+	if r, ok := v.Rank("66VCHSJNUP"); !ok || r != 1 {
+		t.Errorf("Rank(66VCHSJNUP) = %d, %v", r, ok)
+	}
+	if _, ok := v.Rank("1YMWWN1N4O"); ok {
+		t.Error("unfeatured product ranked")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "curation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "curation.json")
+	if err := ioutil.WriteFile(path, []byte(sample), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Categories) != 2 {
+		t.Errorf("loaded %d categories, want 2", len(c.Categories))
+	}
+	if _, err := Load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("loading a missing file succeeded")
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const defaultCurrencyRefresh = 5 * time.Minute
+
+var currencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// parseCurrencies parses WHITELISTED_CURRENCIES, a comma-separated list of
+// currency codes. An empty list is the default whitelist.
+func parseCurrencies(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return sortedCurrencies(whitelistedCurrencies), nil
+	}
+	set := make(map[string]bool)
+	for _, c := range strings.Split(s, ",") {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if !currencyCodePattern.MatchString(c) {
+			return nil, fmt.Errorf("invalid currency code %q", c)
+		}
+		set[c] = true
+	}
+	return sortedCurrencies(set), nil
+}
+
+func sortedCurrencies(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for c := range set {
+		out = append(out, c)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// currencySet is the currencies shoppers can choose: those of the whitelist
+// the currency service supports. Until the service answers, the whole
+// whitelist is offered. Its methods accept a nil *currencySet, which offers
+// the default whitelist.
+type currencySet struct {
+	whitelist []string // sorted
+
+	mu        sync.RWMutex
+	effective map[string]bool
+}
+
+func newCurrencySet(whitelist []string) *currencySet {
+	s := &currencySet{whitelist: whitelist, effective: make(map[string]bool)}
+	for _, c := range whitelist {
+		s.effective[c] = true
+	}
+	return s
+}
+
+// allowed reports whether code can be chosen.
+func (s *currencySet) allowed(code string) bool {
+	if s == nil {
+		return whitelistedCurrencies[code]
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.effective[code]
+}
+
+// configured returns the whitelist, sorted.
+func (s *currencySet) configured() []string {
+	if s == nil {
+		return sortedCurrencies(whitelistedCurrencies)
+	}
+	return s.whitelist
+}
+
+// snapshot returns the currencies offered.
+func (s *currencySet) snapshot() map[string]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]bool, len(s.effective))
+	for c := range s.effective {
+		out[c] = true
+	}
+	return out
+}
+
+// update intersects the whitelist with the currencies supported by the
+// currency service. It returns the whitelisted currencies left out, and
+// whether the currencies offered changed.
+func (s *currencySet) update(supported []string) (unsupported []string, changed bool) {
+	backend := make(map[string]bool, len(supported))
+	for _, c := range supported {
+		backend[c] = true
+	}
+	effective := make(map[string]bool)
+	for _, c := range s.whitelist {
+		if backend[c] {
+			effective[c] = true
+		} else {
+			unsupported = append(unsupported, c)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed = len(effective) != len(s.effective)
+	for c := range effective {
+		changed = changed || !s.effective[c]
+	}
+	s.effective = effective
+	return unsupported, changed
+}
+
+// refreshCurrencies asks the currency service which currencies it supports
+// and updates the currencies offered.
+func (fe *frontendServer) refreshCurrencies(ctx context.Context, log logrus.FieldLogger) error {
+	ctx, cancel := fe.withRPCTimeout(ctx, "currency")
+	defer cancel()
+	resp, err := pb.NewCurrencyServiceClient(fe.currencySvcConn).GetSupportedCurrencies(ctx, &pb.Empty{})
+	if err != nil {
+		return err
+	}
+	if unsupported, changed := fe.currencies.update(resp.GetCurrencyCodes()); changed {
+		fe.catalogCache.flush() // holds the list of currencies
+		log.WithFields(logrus.Fields{
+			"event":       "currencies_updated",
+			"currencies":  strings.Join(sortedCurrencies(fe.currencies.snapshot()), ","),
+			"unsupported": strings.Join(unsupported, ","),
+		}).Info("currencies offered updated")
+	}
+	return nil
+}
+
+// watchCurrencies refreshes the currencies offered at once, then every
+// interval, until ctx is done. A failed refresh keeps the currencies
+// offered so far.
+func (fe *frontendServer) watchCurrencies(ctx context.Context, log logrus.FieldLogger, interval time.Duration) {
+	for delay := time.Duration(0); ; delay = interval {
+		t := fe.clock.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C():
+		}
+		if err := fe.refreshCurrencies(ctx, log); err != nil && ctx.Err() == nil {
+			log.WithFields(logrus.Fields{
+				"event": "currency_refresh_failed",
+				"error": err,
+			}).Warn("failed to list the supported currencies")
+		}
+	}
+}
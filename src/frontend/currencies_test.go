@@ -0,0 +1,112 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseCurrencies(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string // want "" for an error
+	}{
+		{"", "CAD EUR GBP JPY TRY USD"},
+		{"  ", "CAD EUR GBP JPY TRY USD"},
+		{" chf, usd ,CHF", "CHF USD"},
+		{"USD,,EUR", ""},
+		{"USD,US", ""},
+		{"USD,EURO", ""},
+	} {
+		got, err := parseCurrencies(tc.in)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("parseCurrencies(%q) = %v, want an error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || strings.Join(got, " ") != tc.want {
+			t.Errorf("parseCurrencies(%q) = %v, %v; want %s", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestCurrencyWhitelist(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) {
+		// The fake currency service supports CHF, not AUD.
+		fe.currencies = newCurrencySet([]string{"AUD", "CHF", "EUR", "USD"})
+	})
+	defer h.close()
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.AddHook(h.logs)
+
+	if err := h.fe.refreshCurrencies(context.Background(), log); err != nil {
+		t.Fatal(err)
+	}
+	if e := h.logs.find("currencies_updated"); len(e) != 1 || e[0].Data["unsupported"] != "AUD" {
+		t.Errorf("currencies_updated events = %v, want AUD unsupported", e)
+	}
+
+	home := h.get("/")
+	for code, offered := range map[string]bool{"AUD": false, "CHF": true, "EUR": true, "USD": true, "JPY": false} {
+		if got := strings.Contains(home.body, `<option value="`+code+`"`); got != offered {
+			t.Errorf("%s offered = %v, want %v", code, got, offered)
+		}
+	}
+
+	h.post("/setCurrency", url.Values{"currency_code": {"CHF"}})
+	if got := h.cookie(cookieCurrency); got != "CHF" {
+		t.Errorf("currency cookie = %q, want CHF", got)
+	}
+	for _, code := range []string{"AUD", "JPY", "XYZ", ""} {
+		resp := h.post("/setCurrency", url.Values{"currency_code": {code}})
+		if got := h.cookie(cookieCurrency); got != "CHF" {
+			t.Errorf("%q: currency cookie = %q, want CHF kept", code, got)
+		}
+		if resp.Request.URL.Fragment != "currency_errors" {
+			t.Errorf("%q: not rejected", code)
+		}
+	}
+	if resp := h.get("/api/v1/products?currency=AUD"); resp.StatusCode != 400 {
+		t.Errorf("API price in AUD: status = %d, want 400", resp.StatusCode)
+	}
+
+	if err := h.fe.refreshCurrencies(context.Background(), log); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.logs.find("currencies_updated")); n != 1 {
+		t.Errorf("%d currencies_updated events, want none for an unchanged list", n-1)
+	}
+}
+
+func TestCurrencyWhitelistDefaults(t *testing.T) {
+	whitelist, _ := parseCurrencies("")
+	s := newCurrencySet(whitelist)
+	for code, allowed := range map[string]bool{"USD": true, "TRY": true, "CHF": false} {
+		if s.allowed(code) != allowed {
+			t.Errorf("default whitelist: %s allowed = %v, want %v", code, !allowed, allowed)
+		}
+	}
+	var unset *currencySet
+	if !unset.allowed("EUR") || unset.allowed("CHF") {
+		t.Error("nil set does not offer the default whitelist")
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+const (
+	debugDelayHeader = "X-Debug-Delay" // milliseconds
+	maxDebugDelay    = 10 * time.Second
+)
+
+// debugEnabled reports whether debugging aids may be used for a request:
+// when DEBUG_ENDPOINTS_ENABLED is set, or for admins.
+func (fe *frontendServer) debugEnabled(r *http.Request) bool {
+	return fe.debugEndpoints || fe.isAdmin(r)
+}
+
+// delayRendering slows down a page after its backend calls, before it is
+// rendered, by FRONTEND_EXTRA_LATENCY plus the X-Debug-Delay requested by
+// the client, if allowed. It returns false when the client went away while
+// waiting, in which case the page must not be rendered.
+func (fe *frontendServer) delayRendering(log logrus.FieldLogger, r *http.Request) bool {
+	d := fe.extraLatency
+	if v := r.Header.Get(debugDelayHeader); v != "" && fe.debugEnabled(r) {
+		ms, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			log.WithField("value", v).Debug("ignoring an invalid " + debugDelayHeader)
+		} else {
+			requested := time.Duration(ms) * time.Millisecond
+			if requested > maxDebugDelay {
+				requested = maxDebugDelay
+			}
+			d += requested
+		}
+	}
+	if d <= 0 {
+		return true
+	}
+	trace.FromContext(r.Context()).AddAttributes(trace.Int64Attribute("debug.delay_ms", int64(d/time.Millisecond)))
+
+	t := fe.clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return true
+	case <-r.Context().Done():
+		log.WithField("delay", d).Debug("client went away during the injected delay")
+		return false
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestDebugDelayHeader(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	for _, tc := range []struct {
+		name      string
+		debug     bool
+		token     string
+		wantDelay bool
+	}{
+		{name: "default"},
+		{name: "debug endpoints", debug: true, wantDelay: true},
+		{name: "admin token", token: "s3cret", wantDelay: true},
+		{name: "wrong admin token", token: "guess"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := newFakeClock()
+			clock.autoAdvance = true
+			h := newTestHarness(t, withFakeClock(clock), func(fe *frontendServer) {
+				fe.debugEndpoints = tc.debug
+				fe.adminToken = "s3cret"
+			})
+			defer h.close()
+
+			req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/", nil)
+			req.Header.Set(debugDelayHeader, "300")
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			if resp := h.do(req); resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET / = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			started := clock.timersStarted()
+			if got := len(started) == 1 && started[0] == delay; got != tc.wantDelay {
+				t.Errorf("delayed = %v (timers %v), want %v", got, started, tc.wantDelay)
+			}
+		})
+	}
+}
+
+func TestExtraLatency(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	clock := newFakeClock()
+	clock.autoAdvance = true
+	h := newTestHarness(t, withFakeClock(clock), func(fe *frontendServer) { fe.extraLatency = delay })
+	defer h.close()
+
+	for _, path := range []string{"/", "/product/OLJCESPC7Z", "/cart"} {
+		before := clock.Now()
+		h.get(path)
+		if took := clock.Now().Sub(before); took < delay {
+			t.Errorf("GET %s took %v, want at least %v", path, took, delay)
+		}
+	}
+	// Non-page handlers are not slowed down.
+	n := len(clock.timersStarted())
+	h.get("/_healthz")
+	if len(clock.timersStarted()) != n {
+		t.Error("GET /_healthz delayed")
+	}
+}
+
+func TestDebugDelayCancellation(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) { fe.debugEndpoints = true })
+	defer h.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/", nil)
+	req.Header.Set(debugDelayHeader, "60000") // capped to maxDebugDelay
+	req = req.WithContext(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if h.fe.delayRendering(logrus.New(), req) {
+		t.Error("rendering not abandoned after the client went away")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("kept waiting %v after the client went away", took)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// echoedHeader is a request header as listed on /debug/headers.
+type echoedHeader struct {
+	Name   string
+	Values []string
+}
+
+// requireDebugToken reports whether r carries the debug or the admin token,
+// and rejects the request otherwise.
+func (fe *frontendServer) requireDebugToken(w http.ResponseWriter, r *http.Request) bool {
+	if hasBearerToken(r, fe.debugToken) || fe.isAdmin(r) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "debug token required", http.StatusUnauthorized)
+	return false
+}
+
+// debugHeadersHandler renders the request as the frontend received it, to
+// troubleshoot the proxies in front of it. The Authorization header, which
+// carries the token, is not echoed. It requires the debug or the admin
+// token.
+func (fe *frontendServer) debugHeadersHandler(w http.ResponseWriter, r *http.Request) {
+	if !fe.requireDebugToken(w, r) {
+		return
+	}
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	var headers []echoedHeader
+	for name, values := range r.Header {
+		if name == "Authorization" {
+			continue
+		}
+		headers = append(headers, echoedHeader{Name: name, Values: values})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.WithError(err).Warn("could not get the hostname")
+	}
+	fe.render(w, r, http.StatusOK, "debug_headers", fe.injectCommonTemplateData(r, map[string]interface{}{
+		"headers":     headers,
+		"host":        r.Host,
+		"remote_addr": r.RemoteAddr,
+		"client_ip":   fe.clientIP(r),
+		"session_id":  sessionID(r),
+		"hostname":    hostname,
+	}))
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDebugHeaders(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) {
+		fe.debugToken = "debug-token"
+		fe.trustedProxies, _ = parseTrustedProxies("127.0.0.1")
+	})
+	h.get("/")
+
+	if res := h.get("/debug/headers"); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without the token: %d, want %d", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/debug/headers", nil)
+	req.Header.Set("Authorization", "Bearer debug-token")
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7")
+	req.Header.Set("X-Demo", "echoed")
+	res := h.do(req)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("with the token: %d", res.StatusCode)
+	}
+	for _, want := range []string{
+		`<code id="client_ip">203.0.113.7</code>`,
+		`<code id="session_id">` + h.cookie(cookieSessionID),
+		"X-Demo", "echoed",
+	} {
+		if !strings.Contains(res.body, want) {
+			t.Errorf("page lacks %q", want)
+		}
+	}
+	if strings.Contains(res.body, "debug-token") {
+		t.Error("the token is echoed")
+	}
+}
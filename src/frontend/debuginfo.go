@@ -0,0 +1,171 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// Build information, set with -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "1.0.0"
+	commit  = "unknown"
+)
+
+// backendInfo describes the connection to one backend service.
+type backendInfo struct {
+	Name  string `json:"name"`
+	Addr  string `json:"addr"`
+	State string `json:"state"`
+
+	conn *grpc.ClientConn // nil when not connected
+}
+
+// runtimeConfig is the effective configuration of the running frontend.
+type runtimeConfig struct {
+	Version  string            `json:"version"`
+	Commit   string            `json:"commit"`
+	Listen   string            `json:"listen"`
+	Tracing  string            `json:"tracing"`
+	Platform string            `json:"platform,omitempty"`
+	Features map[string]bool   `json:"features"`
+	Timeouts map[string]string `json:"timeouts"`
+}
+
+// backends lists the backend services with their address and current
+// connection state. It is the single source for /debug/deps, the startup
+// summary, and the watching and closing of the connections.
+func (fe *frontendServer) backends() []backendInfo {
+	backend := func(name, addr string, conn *grpc.ClientConn) backendInfo {
+		if conn == nil {
+			return backendInfo{Name: name, Addr: addr, State: "NOT_CONNECTED"}
+		}
+		return backendInfo{Name: name, Addr: addr, State: conn.GetState().String(), conn: conn}
+	}
+	return []backendInfo{
+		backend("productcatalog", fe.productCatalogSvcAddr, fe.productCatalogSvcConn),
+		backend("currency", fe.currencySvcAddr, fe.currencySvcConn),
+		backend("cart", fe.cartSvcAddr, fe.cartSvcConn),
+		backend("recommendation", fe.recommendationSvcAddr, fe.recommendationSvcConn),
+		backend("shipping", fe.shippingSvcAddr, fe.shippingSvcConn),
+		backend("checkout", fe.checkoutSvcAddr, fe.checkoutSvcConn),
+		backend("ad", fe.adSvcAddr, fe.adSvcConn),
+	}
+}
+
+// runtimeConfig returns the effective configuration. It is the single
+// source for /debug/config and the startup summary.
+func (fe *frontendServer) runtimeConfig() runtimeConfig {
+	var platform string
+	if p := fe.platform.get(); p != nil {
+		platform = p.ID
+	}
+	return runtimeConfig{
+		Version:  version,
+		Commit:   commit,
+		Listen:   fe.listenAddr,
+		Tracing:  fe.tracing,
+		Platform: platform,
+		Features: map[string]bool{
+			"ads":              fe.adSvcAddr != "",
+			"recommendations":  fe.recommendationSvcAddr != "",
+			"demo_mode":        fe.demoMode,
+			"admin_token":      fe.adminToken != "",
+			"trace_links":      fe.traceURLTemplate != "",
+			"accounts":         fe.accounts != nil,
+			"oidc_login":       fe.oidc != nil,
+			"metrics":          fe.metrics != nil,
+			"circuit_breakers": fe.adBreaker != nil,
+			"fault_flags":      fe.flags != nil,
+			"cart_reaper":      fe.reaper != nil,
+		},
+		Timeouts: map[string]string{
+			"ads":                   fe.rpcTimeouts.of("ad").String(),
+			"rpc_default":           fe.rpcTimeouts.of(rpcTimeoutDefault).String(),
+			"rpc_checkout":          fe.rpcTimeouts.of("checkout").String(),
+			"rpc_recommendation":    fe.rpcTimeouts.of("recommendation").String(),
+			"essential_calls":       callClassTimeouts[essential].String(),
+			"decorative_calls":      callClassTimeouts[decorative].String(),
+			"rate_refresh":          fe.rates.refresh.String(),
+			"checkout_pin_window":   fe.rates.pinWindow.String(),
+			"degradation_cache_ttl": degradationCacheTTL.String(),
+			"catalog_cache_ttl":     fe.catalogCache.timeToLive().String(),
+		},
+	}
+}
+
+// logStartupSummary logs one entry describing the build, its configuration
+// and its backends. With text logs, a multi-line variant easier to read is
+// logged as well.
+func (fe *frontendServer) logStartupSummary(log logrus.FieldLogger, text bool) {
+	cfg, backends := fe.runtimeConfig(), fe.backends()
+	log.WithFields(logrus.Fields{
+		"event":    "startup_summary",
+		"config":   cfg,
+		"backends": backends,
+	}).Info("startup complete")
+	if !text {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "frontend %s (%s) listening on %s, tracing: %s\n", cfg.Version, cfg.Commit, cfg.Listen, cfg.Tracing)
+	b.WriteString("backends:\n")
+	for _, be := range backends {
+		fmt.Fprintf(&b, "  %-15s %-40s %s\n", be.Name, be.Addr, be.State)
+	}
+	var lines []string
+	for k, v := range cfg.Features {
+		lines = append(lines, fmt.Sprintf("  %-22s %v", k, v))
+	}
+	sort.Strings(lines)
+	b.WriteString("features:\n" + strings.Join(lines, "\n") + "\n")
+	lines = lines[:0]
+	for k, v := range cfg.Timeouts {
+		lines = append(lines, fmt.Sprintf("  %-22s %s", k, v))
+	}
+	sort.Strings(lines)
+	b.WriteString("timeouts:\n" + strings.Join(lines, "\n"))
+	log.Info(b.String())
+}
+
+// debugDepsHandler serves the backends as JSON, for demo presenters and
+// when debugging is enabled only. The state is that of the connection:
+// IDLE, CONNECTING, READY, TRANSIENT_FAILURE or SHUTDOWN.
+func (fe *frontendServer) debugDepsHandler(w http.ResponseWriter, r *http.Request) {
+	fe.serveDebugJSON(w, r, fe.backends())
+}
+
+// debugConfigHandler serves the effective configuration as JSON, for demo
+// presenters and when debugging is enabled only.
+func (fe *frontendServer) debugConfigHandler(w http.ResponseWriter, r *http.Request) {
+	fe.serveDebugJSON(w, r, fe.runtimeConfig())
+}
+
+func (fe *frontendServer) serveDebugJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if !fe.demoMode && !fe.debugEnabled(r) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
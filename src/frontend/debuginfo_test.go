@@ -0,0 +1,105 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func withBackendAddrs(fe *frontendServer) {
+	fe.productCatalogSvcAddr = "productcatalogservice:3550"
+	fe.currencySvcAddr = "currencyservice:7000"
+	fe.cartSvcAddr = "cartservice:7070"
+	fe.recommendationSvcAddr = "recommendationservice:8080"
+	fe.shippingSvcAddr = "shippingservice:50051"
+	fe.checkoutSvcAddr = "checkoutservice:5050"
+	fe.adSvcAddr = "adservice:9555"
+}
+
+func TestStartupSummary(t *testing.T) {
+	h := newTestHarness(t, withBackendAddrs)
+	defer h.close()
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	logs := &logCapture{}
+	log.AddHook(logs)
+	h.fe.logStartupSummary(log, true)
+
+	entries := logs.find("startup_summary")
+	if len(entries) != 1 {
+		t.Fatalf("got %d startup summary entries, want 1", len(entries))
+	}
+	backends, _ := entries[0].Data["backends"].([]backendInfo)
+	got := make(map[string]string)
+	for _, be := range backends {
+		got[be.Addr] = be.Name
+		if be.State == "" {
+			t.Errorf("backend %s has no connection state", be.Name)
+		}
+	}
+	for _, addr := range []string{h.fe.productCatalogSvcAddr, h.fe.currencySvcAddr, h.fe.cartSvcAddr,
+		h.fe.recommendationSvcAddr, h.fe.shippingSvcAddr, h.fe.checkoutSvcAddr, h.fe.adSvcAddr} {
+		if _, ok := got[addr]; !ok {
+			t.Errorf("backend %s missing from the startup summary", addr)
+		}
+	}
+	if cfg, ok := entries[0].Data["config"].(runtimeConfig); !ok || cfg.Version != version {
+		t.Errorf("startup summary config = %+v, want the build version", entries[0].Data["config"])
+	}
+
+	// The text variant is logged separately.
+	if len(logs.entries) != 2 || !strings.Contains(logs.entries[1].Message, "adservice:9555") {
+		t.Error("no multi-line startup summary logged for text logs")
+	}
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	t.Run("hidden by default", func(t *testing.T) {
+		h := newTestHarness(t, withBackendAddrs)
+		defer h.close()
+		for _, path := range []string{"/debug/deps", "/debug/config"} {
+			if resp := h.get(path); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("GET %s = %d, want %d", path, resp.StatusCode, http.StatusNotFound)
+			}
+		}
+	})
+
+	t.Run("demo mode", func(t *testing.T) {
+		h := newTestHarness(t, withBackendAddrs, func(fe *frontendServer) { fe.demoMode = true })
+		defer h.close()
+		resp := h.get("/debug/deps")
+		var backends []backendInfo
+		if err := json.Unmarshal([]byte(resp.body), &backends); err != nil {
+			t.Fatalf("GET /debug/deps: %v", err)
+		}
+		if len(backends) != 7 || backends[0].Addr != "productcatalogservice:3550" {
+			t.Errorf("GET /debug/deps = %+v", backends)
+		}
+		var cfg runtimeConfig
+		if err := json.Unmarshal([]byte(h.get("/debug/config").body), &cfg); err != nil {
+			t.Fatalf("GET /debug/config: %v", err)
+		}
+		if !cfg.Features["demo_mode"] {
+			t.Errorf("GET /debug/config = %+v, want demo_mode enabled", cfg)
+		}
+	})
+}
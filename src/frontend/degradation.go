@@ -0,0 +1,167 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// degradationCacheTTL is how long a computed degradation status is reused
+	// before the registry is scanned again.
+	degradationCacheTTL = 2 * time.Second
+
+	// degradedFailureWindow is how long a failed call keeps a dependency in
+	// degraded mode when no better signal (e.g. a breaker) is registered.
+	degradedFailureWindow = 30 * time.Second
+
+	degradationMessage = "Some features are temporarily unavailable"
+)
+
+// Names of the non-essential dependencies tracked by the degradation
+// registry.
+const (
+	depAds             = "ads"
+	depRecommendations = "recommendations"
+)
+
+// degradationSignal reports whether a dependency is currently running in
+// degraded mode.
+type degradationSignal interface {
+	degraded() bool
+}
+
+// failureTracker is the default degradationSignal: a dependency is degraded
+// while its most recent call failed within degradedFailureWindow.
+type failureTracker struct {
+	mu          sync.Mutex
+	lastFailure time.Time
+	failing     bool
+}
+
+func (f *failureTracker) observe(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing = err != nil
+	if err != nil {
+		f.lastFailure = time.Now()
+	}
+}
+
+func (f *failureTracker) degraded() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failing && time.Since(f.lastFailure) < degradedFailureWindow
+}
+
+type degradableDependency struct {
+	widget    string // user-facing name of the feature backed by the dependency
+	essential bool
+	signal    degradationSignal
+}
+
+// degradationRegistry tracks the health signals of the backends the pages
+// depend on and computes the site-wide degradation status from them.
+type degradationRegistry struct {
+	mu   sync.Mutex
+	deps map[string]*degradableDependency
+
+	cached   degradationStatus
+	cachedAt time.Time
+}
+
+// degradationStatus is the site-wide degradation state as shown in the
+// banner and returned by /api/status.
+type degradationStatus struct {
+	Degraded bool     `json:"degraded"`
+	Message  string   `json:"message,omitempty"`
+	Features []string `json:"features,omitempty"`
+}
+
+// newDegradationRegistry returns a registry tracking the non-essential
+// dependencies with the default failureTracker signal.
+func newDegradationRegistry() *degradationRegistry {
+	d := &degradationRegistry{deps: make(map[string]*degradableDependency)}
+	d.register(depAds, "Advertisements", false, new(failureTracker))
+	d.register(depRecommendations, "Recommendations", false, new(failureTracker))
+	return d
+}
+
+// register adds (or replaces) the signal for the named dependency.
+// Essential dependencies never contribute to the banner: when they fail the
+// page fails with an error instead of rendering degraded.
+func (d *degradationRegistry) register(name, widget string, essential bool, signal degradationSignal) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deps[name] = &degradableDependency{widget: widget, essential: essential, signal: signal}
+	d.cachedAt = time.Time{}
+}
+
+// observe records the outcome of a call to the named dependency if it is
+// tracked with the default failureTracker signal.
+func (d *degradationRegistry) observe(name string, err error) {
+	d.mu.Lock()
+	dep, ok := d.deps[name]
+	d.mu.Unlock()
+	if !ok {
+		return
+	}
+	if t, ok := dep.signal.(*failureTracker); ok {
+		t.observe(err)
+	}
+}
+
+// status returns the current degradation status, scanning the registry at
+// most once per degradationCacheTTL.
+func (d *degradationRegistry) status() degradationStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.cachedAt.IsZero() && time.Since(d.cachedAt) < degradationCacheTTL {
+		return d.cached
+	}
+	var st degradationStatus
+	for _, dep := range d.deps {
+		if dep.essential || !dep.signal.degraded() {
+			continue
+		}
+		st.Degraded = true
+		st.Features = append(st.Features, dep.widget)
+	}
+	if st.Degraded {
+		st.Message = degradationMessage
+		sort.Strings(st.Features)
+	}
+	d.cached, d.cachedAt = st, time.Now()
+	return st
+}
+
+// bannerStatus returns the degradation status as shown to the user. The
+// affected features are only listed in demo mode.
+func (fe *frontendServer) bannerStatus() degradationStatus {
+	st := fe.degradation.status()
+	if !fe.demoMode {
+		st.Features = nil
+	}
+	return st
+}
+
+func (fe *frontendServer) statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fe.bannerStatus())
+}
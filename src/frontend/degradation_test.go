@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type staticSignal bool
+
+func (s staticSignal) degraded() bool { return bool(s) }
+
+func renderBanner(t *testing.T, fe *frontendServer) string {
+	t.Helper()
+	var buf bytes.Buffer
+	r := httptest.NewRequest("GET", "/", nil)
+	if err := testRenderer.set.execute(&buf, "header", fe.injectCommonTemplateData(r, nil)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestDegradationBanner(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		adOpen     bool
+		catalogBad bool
+		demoMode   bool
+		wantBanner bool
+		wantDetail bool
+	}{
+		{name: "healthy"},
+		{name: "ad breaker open", adOpen: true, wantBanner: true},
+		{name: "ad breaker open in demo mode", adOpen: true, demoMode: true, wantBanner: true, wantDetail: true},
+		{name: "catalog degraded", catalogBad: true, demoMode: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := newDegradationRegistry()
+			reg.register(depAds, "Advertisements", false, staticSignal(tc.adOpen))
+			reg.register(depRecommendations, "Recommendations", false, staticSignal(false))
+			reg.register("catalog", "Product catalog", true, staticSignal(tc.catalogBad))
+			fe := &frontendServer{degradation: reg, demoMode: tc.demoMode}
+
+			st := fe.bannerStatus()
+			if st.Degraded != tc.wantBanner {
+				t.Errorf("Degraded = %v, want %v", st.Degraded, tc.wantBanner)
+			}
+			out := renderBanner(t, fe)
+			if got := strings.Contains(out, degradationMessage); got != tc.wantBanner {
+				t.Errorf("banner rendered = %v, want %v", got, tc.wantBanner)
+			}
+			if got := strings.Contains(out, "Advertisements"); got != tc.wantDetail {
+				t.Errorf("banner detail rendered = %v, want %v", got, tc.wantDetail)
+			}
+		})
+	}
+}
+
+func TestFailureTracker(t *testing.T) {
+	reg := newDegradationRegistry()
+	reg.register(depAds, "Advertisements", false, new(failureTracker))
+
+	reg.observe(depAds, errors.New("unavailable"))
+	if !reg.status().Degraded {
+		t.Fatal("expected degraded status after a failed call")
+	}
+
+	// Cached status is reused until the TTL expires.
+	reg.observe(depAds, nil)
+	if !reg.status().Degraded {
+		t.Fatal("expected cached degraded status")
+	}
+	reg.cachedAt = reg.cachedAt.Add(-degradationCacheTTL)
+	if reg.status().Degraded {
+		t.Fatal("expected healthy status after a successful call")
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// deprecationLogInterval is how often the use of each deprecated route is
+// logged at most.
+const deprecationLogInterval = time.Minute
+
+var (
+	deprecatedRouteKey, _ = tag.NewKey("route")
+
+	deprecatedRequests = stats.Int64("frontend/deprecated_route_requests",
+		"Requests served by deprecated routes", stats.UnitDimensionless)
+
+	deprecatedRequestsView = &view.View{
+		Name:        "frontend/deprecated_route_requests",
+		Measure:     deprecatedRequests,
+		Description: deprecatedRequests.Description(),
+		TagKeys:     []tag.Key{deprecatedRouteKey},
+		Aggregation: view.Count(),
+	}
+)
+
+// deprecation describes when a route was deprecated and what replaces it.
+type deprecation struct {
+	since     time.Time
+	sunset    time.Time // zero until a removal date is set
+	successor string    // URL of the replacement, if there is one
+}
+
+// deprecatedHandler serves a deprecated route with its usual handler,
+// adding the deprecation headers and recording the use of the route.
+type deprecatedHandler struct {
+	next  http.Handler
+	route string // "<methods> <route template>", as in metrics and logs
+	deprecation
+
+	mu         sync.Mutex
+	lastLog    time.Time
+	suppressed int
+}
+
+// deprecate marks a registered route as deprecated. Its responses are
+// unchanged but for Deprecation and Sunset headers and a Link to the
+// successor; each use is counted per route and logged, at most once per
+// deprecationLogInterval, with the caller's user agent.
+func deprecate(route *mux.Route, d deprecation) *mux.Route {
+	tmpl, _ := route.GetPathTemplate()
+	methods, _ := route.GetMethods()
+	name := tmpl
+	if len(methods) > 0 {
+		name = strings.Join(methods, ",") + " " + tmpl
+	}
+	return route.Handler(&deprecatedHandler{next: route.GetHandler(), route: name, deprecation: d})
+}
+
+func (h *deprecatedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Deprecation", h.since.UTC().Format(http.TimeFormat))
+	if !h.sunset.IsZero() {
+		w.Header().Set("Sunset", h.sunset.UTC().Format(http.TimeFormat))
+	}
+	if h.successor != "" {
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", h.successor))
+	}
+
+	if ctx, err := tag.New(r.Context(), tag.Upsert(deprecatedRouteKey, h.route)); err == nil {
+		stats.Record(ctx, deprecatedRequests.M(1))
+	}
+	if log, ok := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+		h.logUse(log, r)
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// logUse logs the use of the route unless it was logged recently, in which
+// case it is only counted towards the next notice.
+func (h *deprecatedHandler) logUse(log logrus.FieldLogger, r *http.Request) {
+	h.mu.Lock()
+	now := time.Now()
+	if now.Sub(h.lastLog) < deprecationLogInterval {
+		h.suppressed++
+		h.mu.Unlock()
+		return
+	}
+	suppressed := h.suppressed
+	h.lastLog, h.suppressed = now, 0
+	h.mu.Unlock()
+
+	log.WithFields(logrus.Fields{
+		"event":      "deprecated_route",
+		"route":      h.route,
+		"successor":  h.successor,
+		"user_agent": r.UserAgent(),
+		"suppressed": suppressed,
+	}).Warn("deprecated route used")
+}
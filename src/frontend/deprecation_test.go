@@ -0,0 +1,108 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats/view"
+)
+
+func TestDeprecatedRoutes(t *testing.T) {
+	if err := view.Register(deprecatedRequestsView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(deprecatedRequestsView)
+
+	logs := &logCapture{}
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.AddHook(logs)
+
+	r := mux.NewRouter()
+	deprecate(r.HandleFunc("/cart", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/cart", http.StatusFound)
+	}).Methods(http.MethodPost), deprecation{
+		since:     time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC),
+		sunset:    time.Date(2019, 12, 1, 0, 0, 0, 0, time.UTC),
+		successor: "/api/cart",
+	})
+	r.HandleFunc("/cart", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "cart") }).Methods(http.MethodGet)
+	serve := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/cart", nil)
+		req.Header.Set("User-Agent", "locust/0.9")
+		req = req.WithContext(context.WithValue(req.Context(), ctxKeyLog{}, logrus.FieldLogger(log)))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := serve(http.MethodPost)
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/cart" {
+			t.Errorf("deprecated route answered %d to %q, want its usual redirect", rec.Code, rec.Header().Get("Location"))
+		}
+		for k, want := range map[string]string{
+			"Deprecation": "Sat, 01 Jun 2019 00:00:00 GMT",
+			"Sunset":      "Sun, 01 Dec 2019 00:00:00 GMT",
+			"Link":        `</api/cart>; rel="successor-version"`,
+		} {
+			if got := rec.Header().Get(k); got != want {
+				t.Errorf("%s header = %q, want %q", k, got, want)
+			}
+		}
+	}
+	entries := logs.find("deprecated_route")
+	if len(entries) != 1 {
+		t.Fatalf("got %d deprecation notices, want 1 per interval", len(entries))
+	}
+	if e := entries[0]; e.Data["route"] != "POST /cart" || e.Data["user_agent"] != "locust/0.9" {
+		t.Errorf("deprecation notice %v does not name the route and the caller", e.Data)
+	}
+
+	rows, err := view.RetrieveData(deprecatedRequestsView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Tags[0].Value != "POST /cart" || rows[0].Data.(*view.CountData).Value != 3 {
+		t.Errorf("deprecated route usage = %v, want 3 uses of POST /cart", rows)
+	}
+
+	// Other routes, even on the same path, are left alone.
+	rec := serve(http.MethodGet)
+	for _, k := range []string{"Deprecation", "Sunset", "Link"} {
+		if v := rec.Header().Get(k); v != "" {
+			t.Errorf("route not deprecated has a %s header %q", k, v)
+		}
+	}
+}
+
+func TestNoDeprecatedRoutes(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	for _, path := range []string{"/", "/cart", "/product/OLJCESPC7Z", "/api/status"} {
+		if v := h.get(path).Header.Get("Deprecation"); v != "" {
+			t.Errorf("GET %s has a Deprecation header %q", path, v)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	cacheControlPrivate = "private, no-store"
+
+	// surrogateKeyCatalog tags the pages listing the catalog, which change
+	// whenever a product is added or removed.
+	surrogateKeyCatalog = "catalog"
+)
+
+type ctxKeyPageCache struct{}
+
+// edgeCachePolicy is how long a CDN in front of the frontend may cache the
+// public pages. Browsers always revalidate them, for the cart badge to be
+// current once the shopper adds something.
+type edgeCachePolicy struct {
+	maxAge               time.Duration // s-maxage
+	staleWhileRevalidate time.Duration // none if zero
+}
+
+func (p *edgeCachePolicy) cacheControl() string {
+	v := fmt.Sprintf("public, max-age=0, s-maxage=%d", int(p.maxAge/time.Second))
+	if p.staleWhileRevalidate > 0 {
+		v += fmt.Sprintf(", stale-while-revalidate=%d", int(p.staleWhileRevalidate/time.Second))
+	}
+	return v
+}
+
+// pageCache is what the rendering of a public page tells about its
+// cacheability.
+type pageCache struct {
+	personalized bool     // the markup depends on the session
+	keys         []string // Surrogate-Key values
+}
+
+func pageCacheFrom(ctx context.Context) *pageCache {
+	p, _ := ctx.Value(ctxKeyPageCache{}).(*pageCache)
+	return p
+}
+
+// productSurrogateKey tags the pages showing a product, to purge them from
+// the CDN when it changes.
+func productSurrogateKey(id string) string { return "product-" + id }
+
+// addSurrogateKeys tags the page with the keys of the products it shows,
+// and with the catalog key if it lists the catalog. It does nothing for
+// pages that are never cached.
+func addSurrogateKeys(ctx context.Context, listing bool, products ...*pb.Product) {
+	p := pageCacheFrom(ctx)
+	if p == nil {
+		return
+	}
+	if listing {
+		p.keys = append(p.keys, surrogateKeyCatalog)
+	}
+	for _, pr := range products {
+		p.keys = append(p.keys, productSurrogateKey(pr.GetId()))
+	}
+}
+
+// markPersonalized checks the data of a page about to be rendered for
+// anything specific to the session, after which the page must not be
+// cached. On a page that stays cacheable, the session hash and request ID
+// of the footer are left out: the CDN would show them to everyone.
+func markPersonalized(r *http.Request, data map[string]interface{}) {
+	p := pageCacheFrom(r.Context())
+	if p == nil {
+		return
+	}
+	if n, _ := data["cart_size"].(int); n > 0 {
+		p.personalized = true
+	}
+	if c, _ := data["user_currency"].(string); c != "" && c != defaultCurrency {
+		p.personalized = true
+	}
+	if u, _ := data["cart_undo"].(*cartSnapshot); u != nil {
+		p.personalized = true
+	}
+	if f, _ := data["forms"].(map[string]*formState); len(f) > 0 {
+		p.personalized = true
+	}
+	if a, _ := data["account"].(*account); a != nil {
+		p.personalized = true
+	}
+	if id, _ := data["identity"].(*identity); id != nil {
+		p.personalized = true
+	}
+	if c, _ := data["resume"].(*resumeCard); c != nil {
+		p.personalized = true
+	}
+	if _, err := r.Cookie(cookieLocale); err == nil {
+		p.personalized = true
+	}
+	if !p.personalized {
+		delete(data, "session_hash")
+		delete(data, "csrf_token")
+		delete(data, "request_id")
+	}
+}
+
+// edgeCaching is a router middleware setting Cache-Control on the public
+// routes: the policy's directives when the page came out the same for
+// everyone, "private, no-store" when its rendering was personalized, when
+// it sets a cookie or when it is not a 200. Other routes are left alone.
+func edgeCaching(policy *edgeCachePolicy, public map[string]bool) mux.MiddlewareFunc {
+	cacheControl := policy.cacheControl()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var route string
+			if cur := mux.CurrentRoute(r); cur != nil {
+				route, _ = cur.GetPathTemplate()
+			}
+			if !public[route] || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			p := &pageCache{}
+			r = r.WithContext(context.WithValue(r.Context(), ctxKeyPageCache{}, p))
+			next.ServeHTTP(&edgeCacheWriter{ResponseWriter: w, page: p, cacheControl: cacheControl}, r)
+		})
+	}
+}
+
+// edgeCacheWriter sets the caching headers once the page is rendered far
+// enough to know them, that is when its header is written.
+type edgeCacheWriter struct {
+	http.ResponseWriter
+	page         *pageCache
+	cacheControl string
+	wroteHeader  bool
+}
+
+func (w *edgeCacheWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		if len(w.page.keys) > 0 {
+			h.Set("Surrogate-Key", strings.Join(w.page.keys, " "))
+		}
+		if code == http.StatusOK && !w.page.personalized && len(h["Set-Cookie"]) == 0 {
+			h.Set("Cache-Control", w.cacheControl)
+			h.Add("Vary", "Accept-Language") // for the locale of the prices
+		} else {
+			h.Set("Cache-Control", cacheControlPrivate)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *edgeCacheWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sets the caching headers before the first flush sends them.
+func (w *edgeCacheWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
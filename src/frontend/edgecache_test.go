@@ -0,0 +1,142 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const publicCacheControl = "public, max-age=0, s-maxage=60, stale-while-revalidate=30"
+
+func withEdgeCache(fe *frontendServer) {
+	fe.edgeCache = &edgeCachePolicy{maxAge: time.Minute, staleWhileRevalidate: 30 * time.Second}
+}
+
+func TestEdgeCachingDowngrade(t *testing.T) {
+	h := newTestHarness(t, withEdgeCache)
+	defer h.close()
+
+	if got := h.get("/").Header.Get("Cache-Control"); got != cacheControlPrivate {
+		t.Errorf("page starting a session: Cache-Control = %q, want %q", got, cacheControlPrivate)
+	}
+	resp := h.get("/")
+	if got := resp.Header.Get("Cache-Control"); got != publicCacheControl {
+		t.Errorf("page of a returning session: Cache-Control = %q, want %q", got, publicCacheControl)
+	}
+	if strings.Contains(resp.body, "session: ") || strings.Contains(resp.body, "request-id: ") {
+		t.Error("public page shows the session hash or request ID")
+	}
+	if got := h.get("/category/vintage").Header.Get("Cache-Control"); got != publicCacheControl {
+		t.Errorf("category page: Cache-Control = %q, want %q", got, publicCacheControl)
+	}
+	if got := h.get("/cart").Header.Get("Cache-Control"); got != "" {
+		t.Errorf("cart page: Cache-Control = %q, want none", got)
+	}
+	if got := h.get("/product/NOSUCHPRODUCT").Header.Get("Cache-Control"); got != cacheControlPrivate {
+		t.Errorf("error page: Cache-Control = %q, want %q", got, cacheControlPrivate)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		setup func()
+	}{
+		{"non-empty cart", func() {
+			h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+		}},
+		{"undo notice", func() { h.post("/cart/empty", nil) }},
+		{"currency", func() { h.post("/setCurrency", url.Values{"currency_code": {"EUR"}}) }},
+	} {
+		tc.setup()
+		h.get("/") // lets the cookies set by the change settle
+		resp := h.get("/")
+		if got := resp.Header.Get("Cache-Control"); got != cacheControlPrivate {
+			t.Errorf("%s: Cache-Control = %q, want %q", tc.name, got, cacheControlPrivate)
+		}
+		if !strings.Contains(resp.body, "session: ") {
+			t.Errorf("%s: personalized page lost the session hash", tc.name)
+		}
+	}
+}
+
+func TestEdgeCachingSurrogateKeys(t *testing.T) {
+	h := newTestHarness(t, withEdgeCache)
+	defer h.close()
+	h.get("/")
+
+	if got := h.get("/product/OLJCESPC7Z").Header.Get("Cache-Control"); got != cacheControlPrivate {
+		t.Errorf("first view: Cache-Control = %q, want %q for the last viewed cookie", got, cacheControlPrivate)
+	}
+	resp := h.get("/product/OLJCESPC7Z")
+	if got := resp.Header.Get("Cache-Control"); got != publicCacheControl {
+		t.Errorf("second view: Cache-Control = %q, want %q", got, publicCacheControl)
+	}
+	keys := strings.Fields(resp.Header.Get("Surrogate-Key"))
+	if len(keys) == 0 || keys[0] != "product-OLJCESPC7Z" {
+		t.Fatalf("Surrogate-Key = %v, want the product first", keys)
+	}
+	for _, k := range keys {
+		if k == surrogateKeyCatalog {
+			t.Error("product page tagged as a catalog listing")
+		}
+	}
+	// Recommendations are tagged too.
+	for _, p := range fakeProducts[1:] {
+		if !strings.Contains(resp.body, "/product/"+p.GetId()) {
+			continue
+		}
+		if !strings.Contains(resp.Header.Get("Surrogate-Key"), productSurrogateKey(p.GetId())) {
+			t.Errorf("recommended product %s not in Surrogate-Key", p.GetId())
+		}
+	}
+
+	home := h.get("/").Header.Get("Surrogate-Key")
+	if want := "catalog product-OLJCESPC7Z product-66VCHSJNUP product-1YMWWN1N4O"; home != want {
+		t.Errorf("home Surrogate-Key = %q, want %q", home, want)
+	}
+}
+
+func TestEdgeCachingDisabled(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.get("/")
+	resp := h.get("/product/OLJCESPC7Z")
+	if resp.Header.Get("Cache-Control") != "" || resp.Header.Get("Surrogate-Key") != "" {
+		t.Errorf("caching headers sent without a policy: %v", resp.Header)
+	}
+}
+
+func TestCatalogPurgeKeys(t *testing.T) {
+	var c catalogIDs
+	c.update(fakeProducts)
+	if keys := c.purgeKeys(); len(keys) != 0 {
+		t.Errorf("first listing purges %v", keys)
+	}
+	c.update(fakeProducts)
+	lens := proto.Clone(fakeProducts[1]).(*pb.Product)
+	lens.Name = "Camera Lens"
+	c.update([]*pb.Product{lens, fakeProducts[2]})
+	want := []string{"catalog", "product-66VCHSJNUP", "product-OLJCESPC7Z"}
+	if got := c.purgeKeys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("purge keys = %v, want %v", got, want)
+	}
+}
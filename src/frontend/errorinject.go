@@ -0,0 +1,173 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+// headerInjectedError marks the responses of injected errors, for the load
+// generator and the rolling stats to tell them from real ones.
+const headerInjectedError = "X-Injected-Error"
+
+// injectionRule makes a share of the synthetic requests to a route fail.
+type injectionRule struct {
+	Route  string  `json:"route"` // path template, "*" for every route
+	Rate   float64 `json:"rate"`  // in [0, 1]
+	Status int     `json:"status"`
+}
+
+// parseInjectionRules parses rules like
+// "route=/product/{id},rate=0.02,status=500", separated by semicolons. The
+// route defaults to every route and the status to 500.
+func parseInjectionRules(s string) ([]injectionRule, error) {
+	var rules []injectionRule
+	for _, spec := range strings.Split(s, ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		rule := injectionRule{Route: "*", Rate: -1, Status: http.StatusInternalServerError}
+		for _, field := range strings.Split(spec, ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("error injection rule %q: %q is not key=value", spec, field)
+			}
+			var err error
+			switch kv[0] {
+			case "route":
+				rule.Route = kv[1]
+			case "rate":
+				rule.Rate, err = strconv.ParseFloat(kv[1], 64)
+			case "status":
+				rule.Status, err = strconv.Atoi(kv[1])
+			default:
+				err = fmt.Errorf("unknown key %q", kv[0])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("error injection rule %q: %v", spec, err)
+			}
+		}
+		switch {
+		case rule.Rate < 0 || rule.Rate > 1:
+			return nil, fmt.Errorf("error injection rule %q: rate must be in [0, 1]", spec)
+		case rule.Status < 400 || rule.Status > 599:
+			return nil, fmt.Errorf("error injection rule %q: status must be an error status", spec)
+		case rule.Route != "*" && !strings.HasPrefix(rule.Route, "/"):
+			return nil, fmt.Errorf("error injection rule %q: route must be a path template or *", spec)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// errorInjector fails a share of the synthetic requests on purpose, so that
+// alerting on frontend errors can be demonstrated. Requests from real users
+// are never failed, and failed requests never reach their handler, so no
+// backend is called for them.
+type errorInjector struct {
+	sample func() float64 // in [0, 1)
+
+	mu    sync.RWMutex
+	rules []injectionRule
+}
+
+func newErrorInjector(rules []injectionRule) *errorInjector {
+	return &errorInjector{rules: rules, sample: rand.Float64}
+}
+
+func (e *errorInjector) set(rules []injectionRule) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = rules
+}
+
+func (e *errorInjector) get() []injectionRule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return append(make([]injectionRule, 0, len(e.rules)), e.rules...)
+}
+
+// match returns the first rule applying to the route, if any.
+func (e *errorInjector) match(route string) (injectionRule, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, rule := range e.rules {
+		if rule.Route == "*" || rule.Route == route {
+			return rule, true
+		}
+	}
+	return injectionRule{}, false
+}
+
+// middleware is a router middleware injecting the errors.
+func (e *errorInjector) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isSynthetic(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var route string
+		if cur := mux.CurrentRoute(r); cur != nil {
+			route, _ = cur.GetPathTemplate()
+		}
+		rule, ok := e.match(route)
+		if !ok || e.sample() >= rule.Rate {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if log, ok := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+			log.WithFields(logrus.Fields{
+				"event":  "error_injected",
+				"route":  route,
+				"status": rule.Status,
+			}).Info("injected an error")
+		}
+		trace.FromContext(r.Context()).AddAttributes(trace.BoolAttribute("error.injected", true))
+		w.Header().Set(headerInjectedError, "true")
+		http.Error(w, "injected error", rule.Status)
+	})
+}
+
+// errorInjectionHandler shows the error injection rules on GET, and
+// replaces them with the rules form value on POST.
+func (fe *frontendServer) errorInjectionHandler(w http.ResponseWriter, r *http.Request) {
+	if !fe.isAdmin(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodPost {
+		rules, err := parseInjectionRules(r.FormValue("rules"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fe.injector.set(rules)
+		r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger).
+			WithField("event", "error_injection_changed").WithField("rules", len(rules)).Info("error injection rules changed")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"rules": fe.injector.get()})
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+const syntheticUA = "python-requests/2.21.0"
+
+func withErrorInjection(rules string) func(*frontendServer) {
+	return func(fe *frontendServer) {
+		r, err := parseInjectionRules(rules)
+		if err != nil {
+			panic(err)
+		}
+		fe.injector = newErrorInjector(r)
+	}
+}
+
+// getAs gets a page with the given user agent.
+func (h *testHarness) getAs(userAgent, path string) *response {
+	h.t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+path, nil)
+	req.Header.Set("User-Agent", userAgent)
+	return h.do(req)
+}
+
+func TestParseInjectionRules(t *testing.T) {
+	got, err := parseInjectionRules("route=/product/{id},rate=0.02,status=503; rate=0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []injectionRule{{"/product/{id}", 0.02, 503}, {"*", 0.5, 500}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rules = %+v, want %+v", got, want)
+	}
+	for _, bad := range []string{"route=/", "rate=2", "rate=0.1,status=200", "rate=0.1,route=product", "rate=0.1,color=red", "rate"} {
+		if _, err := parseInjectionRules(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestErrorInjection(t *testing.T) {
+	h := newTestHarness(t, withErrorInjection("route=/product/{id},rate=1,status=503"))
+	defer h.close()
+
+	resp := h.getAs(syntheticUA, "/product/OLJCESPC7Z")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get(headerInjectedError) != "true" {
+		t.Errorf("synthetic request = %d, want an injected 503", resp.StatusCode)
+	}
+	if got := h.faults.calls(getProductMethod); got != 0 {
+		t.Errorf("injected request made %d GetProduct calls", got)
+	}
+	if entries := h.logs.find("error_injected"); len(entries) != 1 || entries[0].Data["route"] != "/product/{id}" {
+		t.Errorf("injection logged as %v", entries)
+	}
+	if resp := h.getAs(syntheticUA, "/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("synthetic request to another route = %d, want 200", resp.StatusCode)
+	}
+	for i := 0; i < 20; i++ {
+		if resp := h.get("/product/OLJCESPC7Z"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("real request = %d, want 200", resp.StatusCode)
+		}
+	}
+
+	// Injected errors are left out of the rolling stats.
+	var found bool
+	for _, r := range h.fe.stats.report().Windows[0].Routes {
+		if strings.HasSuffix(r.Route, "/product/{id}") {
+			found = true
+			if r.Errors != 0 || r.Requests != 20 {
+				t.Errorf("stats of the product page = %+v, want 20 requests without errors", r)
+			}
+		}
+	}
+	if !found {
+		t.Error("product page missing from the stats")
+	}
+}
+
+func TestErrorInjectionRate(t *testing.T) {
+	e := newErrorInjector([]injectionRule{{Route: "/product/{id}", Rate: 0.2, Status: 500}})
+	r := mux.NewRouter()
+	r.HandleFunc("/product/{id}", func(http.ResponseWriter, *http.Request) {})
+	r.Use(e.middleware)
+
+	const n = 5000
+	var injected, real int
+	for i := 0; i < n; i++ {
+		for _, ua := range []string{syntheticUA, "Mozilla/5.0"} {
+			req := httptest.NewRequest(http.MethodGet, "/product/OLJCESPC7Z", nil)
+			req.Header.Set("User-Agent", ua)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			switch {
+			case w.Code != http.StatusInternalServerError:
+			case ua == syntheticUA:
+				injected++
+			default:
+				real++
+			}
+		}
+	}
+	if real != 0 {
+		t.Errorf("%d real requests injected", real)
+	}
+	if rate := float64(injected) / n; rate < 0.17 || rate > 0.23 {
+		t.Errorf("injected %.3f of the synthetic requests, want about 0.2", rate)
+	}
+}
+
+func TestErrorInjectionAdmin(t *testing.T) {
+	h := newTestHarness(t, withAdminToken, withErrorInjection(""))
+	defer h.close()
+	post := func(rules string, admin bool) *response {
+		req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/admin/error-injection",
+			strings.NewReader(url.Values{"rules": {rules}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if admin {
+			req.Header.Set("Authorization", "Bearer s3cret")
+		}
+		return h.do(req)
+	}
+
+	if resp := post("rate=1", false); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("change without the admin token = %d, want 401", resp.StatusCode)
+	}
+	if resp := post("rate=7", true); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid rules = %d, want 400", resp.StatusCode)
+	}
+	if resp := h.getAs(syntheticUA, "/"); resp.StatusCode != http.StatusOK {
+		t.Fatal("error injected without rules")
+	}
+	if resp := post("route=/,rate=1,status=502", true); !strings.Contains(resp.body, `"route":"/"`) {
+		t.Errorf("rules after a change = %s", resp.body)
+	}
+	if resp := h.getAs(syntheticUA, "/"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("synthetic request after a change = %d, want 502", resp.StatusCode)
+	}
+	post("", true)
+	if resp := h.getAs(syntheticUA, "/"); resp.StatusCode != http.StatusOK {
+		t.Error("error injected after clearing the rules")
+	}
+}
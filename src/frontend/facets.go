@@ -0,0 +1,241 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+// priceFacetBands is the most price ranges a page offers.
+const priceFacetBands = 4
+
+// priceFacet is a range of prices, from Min included to Max excluded, and
+// how many products are in it. A nil bound is an open end.
+type priceFacet struct {
+	Min, Max *pb.Money
+	Count    int
+}
+
+// priceFacets splits prices, all in one currency, into at most n ranges at
+// their quantiles. Boundaries are rounded down to two significant digits of
+// whole units so they read well; an outlier only widens the top range.
+// Prices that cannot be told apart this way give no facets.
+func priceFacets(prices []pb.Money, n int) []priceFacet {
+	if len(prices) == 0 || n < 2 {
+		return nil
+	}
+	sorted := append([]pb.Money(nil), prices...)
+	sort.Slice(sorted, func(i, j int) bool { return moneyLess(sorted[i], sorted[j]) })
+	currency := sorted[0].GetCurrencyCode()
+
+	var bounds []int64
+	for k := 1; k < n; k++ {
+		b := niceFloor(sorted[k*len(sorted)/n].GetUnits())
+		// Every range must hold a product: the first one those below b,
+		// the others at least the product b was taken from.
+		if !moneyLess(sorted[0], pb.Money{CurrencyCode: currency, Units: b}) {
+			continue
+		}
+		if len(bounds) > 0 && b <= bounds[len(bounds)-1] {
+			continue
+		}
+		bounds = append(bounds, b)
+	}
+	if len(bounds) == 0 {
+		return nil
+	}
+
+	facets := make([]priceFacet, len(bounds)+1)
+	for i, b := range bounds {
+		m := &pb.Money{CurrencyCode: currency, Units: b}
+		facets[i].Max, facets[i+1].Min = m, m
+	}
+	for _, p := range sorted {
+		units := p.GetUnits()
+		facets[sort.Search(len(bounds), func(i int) bool { return bounds[i] > units })].Count++
+	}
+	return facets
+}
+
+// niceFloor rounds units down to two significant digits.
+func niceFloor(units int64) int64 {
+	step := int64(1)
+	for units/step >= 100 {
+		step *= 10
+	}
+	return units / step * step
+}
+
+// moneyLess compares two non-negative amounts of the same currency.
+func moneyLess(a, b pb.Money) bool {
+	if a.GetUnits() != b.GetUnits() {
+		return a.GetUnits() < b.GetUnits()
+	}
+	return a.GetNanos() < b.GetNanos()
+}
+
+// priceFilter is the price range requested with the price_min and
+// price_max parameters, in the session currency. Invalid bounds are
+// ignored.
+type priceFilter struct {
+	min, max *pb.Money
+}
+
+func parsePriceFilter(r *http.Request, currency string) priceFilter {
+	var f priceFilter
+	for _, b := range []struct {
+		param  string
+		target **pb.Money
+	}{{"price_min", &f.min}, {"price_max", &f.max}} {
+		v := r.FormValue(b.param)
+		if v == "" {
+			continue
+		}
+		if m, err := money.ParseAmount(v); err == nil && !money.IsNegative(m) {
+			m.CurrencyCode = currency
+			*b.target = &m
+		}
+	}
+	return f
+}
+
+func (f priceFilter) active() bool { return f.min != nil || f.max != nil }
+
+// match reports whether a price is in the range; unknown prices are only
+// matched without a filter.
+func (f priceFilter) match(m *pb.Money) bool {
+	if !f.active() {
+		return true
+	}
+	if m == nil {
+		return false
+	}
+	return (f.min == nil || !moneyLess(*m, *f.min)) && (f.max == nil || moneyLess(*m, *f.max))
+}
+
+// facetCache keeps the price facets of each page and currency until the
+// catalog listing or the exchange rates change.
+type facetCache struct {
+	mu      sync.Mutex
+	entries map[string]facetEntry
+}
+
+type facetEntry struct {
+	catalogGen, rateGen uint64
+	facets              []priceFacet
+}
+
+// get returns the cached facets for key, or those computed by compute.
+// They are only cached if compute says they are complete.
+func (c *facetCache) get(key string, catalogGen, rateGen uint64, compute func() ([]priceFacet, bool)) []priceFacet {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && e.catalogGen == catalogGen && e.rateGen == rateGen {
+		return e.facets
+	}
+	facets, complete := compute()
+	if complete {
+		c.mu.Lock()
+		if c.entries == nil {
+			c.entries = make(map[string]facetEntry)
+		}
+		c.entries[key] = facetEntry{catalogGen, rateGen, facets}
+		c.mu.Unlock()
+	}
+	return facets
+}
+
+// facetLink is a price facet as rendered on a page.
+type facetLink struct {
+	Label  string
+	URL    string
+	Count  int
+	Active bool
+}
+
+// priceFacetLinks returns the price facets of the page scope, computed from
+// the prices of its products in the session currency. The links keep the
+// other query parameters of the page. A link clearing the filter follows
+// the facets while one is applied.
+func (fe *frontendServer) priceFacetLinks(ctx context.Context, r *http.Request, scope string, prices []*pb.Money, filter priceFilter) []facetLink {
+	currency := currentCurrency(r)
+	hit := true
+	facets := fe.facets.get(currency+" "+scope, fe.catalog.gen(), fe.rateSnapshot(ctx).generation, func() ([]priceFacet, bool) {
+		hit = false
+		known := make([]pb.Money, 0, len(prices))
+		for _, p := range prices {
+			if p != nil {
+				known = append(known, *p)
+			}
+		}
+		return priceFacets(known, priceFacetBands), len(known) == len(prices)
+	})
+	fe.stats.cacheLookup(statsCacheFacets, hit)
+
+	loc := requestLocale(r)
+	var links []facetLink
+	for _, f := range facets {
+		var label string
+		switch {
+		case f.Min == nil:
+			label = "Under " + loc.formatMoney(*f.Max)
+		case f.Max == nil:
+			label = loc.formatMoney(*f.Min) + " and over"
+		default:
+			label = loc.formatMoney(*f.Min) + " to " + loc.formatMoney(*f.Max)
+		}
+		links = append(links, facetLink{
+			Label:  label,
+			URL:    facetURL(r.URL, f.Min, f.Max),
+			Count:  f.Count,
+			Active: sameBound(f.Min, filter.min) && sameBound(f.Max, filter.max),
+		})
+	}
+	if len(links) > 0 && filter.active() {
+		links = append(links, facetLink{Label: "Any price", URL: facetURL(r.URL, nil, nil)})
+	}
+	return links
+}
+
+// facetURL is u with its price range parameters replaced.
+func facetURL(u *url.URL, min, max *pb.Money) string {
+	q := u.Query()
+	q.Del("price_min")
+	q.Del("price_max")
+	if min != nil {
+		q.Set("price_min", strconv.FormatInt(min.GetUnits(), 10))
+	}
+	if max != nil {
+		q.Set("price_max", strconv.FormatInt(max.GetUnits(), 10))
+	}
+	return (&url.URL{Path: u.Path, RawQuery: q.Encode()}).String()
+}
+
+func sameBound(a, b *pb.Money) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return strings.EqualFold(a.GetCurrencyCode(), b.GetCurrencyCode()) && !moneyLess(*a, *b) && !moneyLess(*b, *a)
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+func usd(amounts ...string) []pb.Money {
+	out := make([]pb.Money, len(amounts))
+	for i, a := range amounts {
+		out[i] = money.Must(money.ParseAmount(a))
+		out[i].CurrencyCode = "USD"
+	}
+	return out
+}
+
+// facetString describes facets as "[lo,hi)=count" ranges.
+func facetString(facets []priceFacet) string {
+	var parts []string
+	for _, f := range facets {
+		lo, hi := "", ""
+		if f.Min != nil {
+			lo = fmt.Sprint(f.Min.GetUnits())
+		}
+		if f.Max != nil {
+			hi = fmt.Sprint(f.Max.GetUnits())
+		}
+		parts = append(parts, fmt.Sprintf("[%s,%s)=%d", lo, hi, f.Count))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestPriceFacets(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		prices []pb.Money
+		want   string
+	}{
+		{"no products", nil, ""},
+		{"one product", usd("19.99"), ""},
+		{"identical prices", usd("5", "5", "5", "5", "5"), ""},
+		{"same whole units", usd("5.10", "5.20", "5.90"), ""},
+		{"two products", usd("5", "40"), "[,40)=1 [40,)=1"},
+		{"quartiles", usd("3", "8", "12", "19", "25", "31", "42", "60"), "[,12)=2 [12,25)=2 [25,42)=2 [42,)=2"},
+		{"rounded bounds", usd("10", "1234", "5678", "9999"), "[,1200)=1 [1200,5600)=1 [5600,9900)=1 [9900,)=1"},
+		{"extreme outlier", usd("10", "11", "12", "13", "14", "15", "16", "1000000"), "[,12)=2 [12,14)=2 [14,16)=2 [16,)=2"},
+		{"mostly identical", usd("5", "5", "5", "5", "5", "5", "5", "90"), ""},
+		{"unsorted", usd("60", "3", "25", "8"), "[,8)=1 [8,25)=1 [25,60)=1 [60,)=1"},
+	} {
+		got := priceFacets(tc.prices, priceFacetBands)
+		if s := facetString(got); s != tc.want {
+			t.Errorf("%s: facets = %q, want %q", tc.name, s, tc.want)
+		}
+		var n int
+		for _, f := range got {
+			if f.Count == 0 {
+				t.Errorf("%s: empty range %s", tc.name, facetString([]priceFacet{f}))
+			}
+			n += f.Count
+		}
+		if got != nil && n != len(tc.prices) {
+			t.Errorf("%s: ranges hold %d products, want %d", tc.name, n, len(tc.prices))
+		}
+	}
+}
+
+func TestPriceFacetLinks(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	home := h.get("/")
+	for _, want := range []string{
+		`href="/?price_max=67">Under USD 67.00 (1)`,
+		`href="/?price_max=120&amp;price_min=67">USD 67.00 to USD 120.00 (1)`,
+		`href="/?price_min=120">USD 120.00 and over (1)`,
+	} {
+		if !strings.Contains(home.body, want) {
+			t.Errorf("home page does not link %s", want)
+		}
+	}
+
+	// A facet click keeps the other parameters and only shows the products
+	// in its range.
+	resp := h.get("/category/vintage?sort=name&price_min=60")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /category/vintage = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := productOrder(resp.body, "OLJCESPC7Z", "66VCHSJNUP"); len(got) != 1 || got[0] != "OLJCESPC7Z" {
+		t.Errorf("products = %v, want only the typewriter", got)
+	}
+	if !strings.Contains(resp.body, `href="/category/vintage?price_min=67&amp;sort=name"`) ||
+		!strings.Contains(resp.body, `href="/category/vintage?sort=name">Any price`) {
+		t.Error("category facets do not keep the sort parameter or offer to clear the filter")
+	}
+	if resp := h.get("/category/vintage?price_max=1"); !strings.Contains(resp.body, `id="no_products"`) {
+		t.Error("empty price range not explained")
+	}
+	if resp := h.get("/?price_min=abc"); len(productOrder(resp.body, "OLJCESPC7Z", "66VCHSJNUP", "1YMWWN1N4O")) != 3 {
+		t.Error("invalid price filter not ignored")
+	}
+}
+
+func TestPriceFacetsRefresh(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.post("/setCurrency", url.Values{"currency_code": {"EUR"}})
+	if resp := h.get("/"); !strings.Contains(resp.body, `href="/?price_min=110">EUR 110.00 and over`) {
+		t.Fatal("home page has no EUR facets")
+	}
+
+	// Cached until the rates change.
+	h.rates.set("EUR", 2)
+	if resp := h.get("/"); !strings.Contains(resp.body, "EUR 110.00 and over") {
+		t.Error("facets recomputed before the rate table was refreshed")
+	}
+	h.fe.rates.rotate()
+	if resp := h.get("/"); !strings.Contains(resp.body, `href="/?price_min=240">EUR 240.00 and over`) {
+		t.Error("facets not recomputed with the new rates")
+	}
+
+	// And until the catalog prices change.
+	h.catalog.mu.Lock()
+	p := proto.Clone(h.catalog.products[2]).(*pb.Product)
+	p.PriceUsd = &pb.Money{CurrencyCode: "USD", Units: 500}
+	h.catalog.products = append([]*pb.Product{h.catalog.products[0], h.catalog.products[1]}, p)
+	h.catalog.mu.Unlock()
+	if resp := h.get("/"); !strings.Contains(resp.body, `href="/?price_min=1000">EUR 1000.00 and over`) {
+		t.Error("facets not recomputed after a catalog price change")
+	}
+}
@@ -0,0 +1,434 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+// In-memory fakes of the backend services. They are served over bufconn by
+// the test harness so the frontend talks to them through real gRPC clients.
+
+var fakeProducts = []*pb.Product{
+	{Id: "OLJCESPC7Z", Name: "Vintage Typewriter", Description: "This typewriter looks good in your living room.",
+		Picture: "/static/img/products/typewriter.jpg", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 67, Nanos: 990000000},
+		Categories: []string{"vintage"}},
+	{Id: "66VCHSJNUP", Name: "Vintage Camera Lens", Description: "You won't have a camera to use it and it probably doesn't work anyway.",
+		Picture: "/static/img/products/camera-lens.jpg", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 12, Nanos: 490000000},
+		Categories: []string{"photography", "vintage"}},
+	{Id: "1YMWWN1N4O", Name: "Home Barista Kit", Description: "Always wanted to brew coffee with Chemex and Aeropress at home?",
+		Picture: "/static/img/products/barista-kit.jpg", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 124},
+		Categories: []string{"cookware"}},
+}
+
+// fakeRates maps currency codes to their value of one USD.
+var fakeRates = map[string]float64{
+	"USD": 1,
+	"EUR": 0.9,
+	"CAD": 1.3,
+	"JPY": 110,
+	"GBP": 0.8,
+	"TRY": 5.8,
+}
+
+// fakeRateTable holds the exchange rates shared by the currency and
+// checkout fakes, starting from fakeRates. Tests may change them.
+type fakeRateTable struct {
+	mu    sync.Mutex
+	rates map[string]float64
+}
+
+func newFakeRateTable() *fakeRateTable {
+	t := &fakeRateTable{rates: make(map[string]float64)}
+	for k, v := range fakeRates {
+		t.rates[k] = v
+	}
+	return t
+}
+
+func (t *fakeRateTable) get(code string) (float64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.rates[code]
+	return v, ok
+}
+
+func (t *fakeRateTable) set(code string, rate float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rates[code] = rate
+}
+
+// faultInjector is a unary server interceptor returning configured errors
+// (and adding configured latency) for specific full method names such as
+// "/hipstershop.AdService/GetAds".
+type faultInjector struct {
+	mu      sync.Mutex
+	errs    map[string]error
+	delays  map[string]time.Duration
+	counter map[string]int
+	// remaining counts the calls left to fail, for the errors that stop
+	// after a number of calls.
+	remaining map[string]int
+	// delaysLeft counts the calls left to delay, for the delays that stop
+	// after a number of calls.
+	delaysLeft map[string]int
+	// inFlight and peak count the calls being handled, and the most of
+	// them at once.
+	inFlight map[string]int
+	peak     map[string]int
+	// cancelled counts the delayed calls whose context ended first.
+	cancelled map[string]int
+	// received is the metadata of the last call to each method.
+	received map[string]metadata.MD
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{
+		errs:       make(map[string]error),
+		delays:     make(map[string]time.Duration),
+		counter:    make(map[string]int),
+		remaining:  make(map[string]int),
+		delaysLeft: make(map[string]int),
+		inFlight:   make(map[string]int),
+		peak:       make(map[string]int),
+		cancelled:  make(map[string]int),
+		received:   make(map[string]metadata.MD),
+	}
+}
+
+func (f *faultInjector) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	f.mu.Lock()
+	f.counter[info.FullMethod]++
+	f.received[info.FullMethod], _ = metadata.FromIncomingContext(ctx)
+	if f.inFlight[info.FullMethod]++; f.inFlight[info.FullMethod] > f.peak[info.FullMethod] {
+		f.peak[info.FullMethod] = f.inFlight[info.FullMethod]
+	}
+	defer func() {
+		f.mu.Lock()
+		f.inFlight[info.FullMethod]--
+		f.mu.Unlock()
+	}()
+	err, delay := f.errs[info.FullMethod], f.delays[info.FullMethod]
+	if n, ok := f.delaysLeft[info.FullMethod]; ok && delay > 0 {
+		if f.delaysLeft[info.FullMethod] = n - 1; n <= 1 {
+			delete(f.delays, info.FullMethod)
+			delete(f.delaysLeft, info.FullMethod)
+		}
+	}
+	if n, ok := f.remaining[info.FullMethod]; ok && err != nil {
+		if f.remaining[info.FullMethod] = n - 1; n <= 1 {
+			delete(f.errs, info.FullMethod)
+			delete(f.remaining, info.FullMethod)
+		}
+	}
+	f.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			f.mu.Lock()
+			f.cancelled[info.FullMethod]++
+			f.mu.Unlock()
+			return nil, status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (f *faultInjector) calls(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counter[method]
+}
+
+// metadata returns the metadata of the last call to method.
+func (f *faultInjector) metadata(method string) metadata.MD {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.received[method]
+}
+
+// cancellations returns the number of delayed calls to method whose
+// context ended before the delay did.
+func (f *faultInjector) cancellations(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cancelled[method]
+}
+
+// concurrency returns the most calls to method handled at once.
+func (f *faultInjector) concurrency(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.peak[method]
+}
+
+type fakeCatalog struct {
+	mu       sync.Mutex
+	products []*pb.Product
+}
+
+func (c *fakeCatalog) ListProducts(context.Context, *pb.Empty) (*pb.ListProductsResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &pb.ListProductsResponse{Products: c.products}, nil
+}
+
+func (c *fakeCatalog) GetProduct(_ context.Context, req *pb.GetProductRequest) (*pb.Product, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.products {
+		if p.GetId() == req.GetId() {
+			return p, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "no product with ID %s", req.GetId())
+}
+
+func (c *fakeCatalog) SearchProducts(_ context.Context, req *pb.SearchProductsRequest) (*pb.SearchProductsResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []*pb.Product
+	q := strings.ToLower(req.GetQuery())
+	for _, p := range c.products {
+		if strings.Contains(strings.ToLower(p.GetName()), q) ||
+			strings.Contains(strings.ToLower(p.GetDescription()), q) {
+			out = append(out, p)
+		}
+	}
+	return &pb.SearchProductsResponse{Results: out}, nil
+}
+
+func (c *fakeCatalog) lookup(id string) *pb.Product {
+	p, _ := c.GetProduct(context.Background(), &pb.GetProductRequest{Id: id})
+	return p
+}
+
+type fakeCurrency struct {
+	rates *fakeRateTable
+}
+
+func (fakeCurrency) GetSupportedCurrencies(context.Context, *pb.Empty) (*pb.GetSupportedCurrenciesResponse, error) {
+	// CHF is deliberately supported by the backend but not whitelisted.
+	return &pb.GetSupportedCurrenciesResponse{CurrencyCodes: []string{"CAD", "CHF", "EUR", "GBP", "JPY", "TRY", "USD"}}, nil
+}
+
+func (c fakeCurrency) Convert(_ context.Context, req *pb.CurrencyConversionRequest) (*pb.Money, error) {
+	from, ok := c.rates.get(req.GetFrom().GetCurrencyCode())
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported currency %q", req.GetFrom().GetCurrencyCode())
+	}
+	to, ok := c.rates.get(req.GetToCode())
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported currency %q", req.GetToCode())
+	}
+	return convertMoney(req.GetFrom(), req.GetToCode(), to/from), nil
+}
+
+func convertMoney(m *pb.Money, code string, rate float64) *pb.Money {
+	nanos := math.Round((float64(m.GetUnits())*1e9 + float64(m.GetNanos())) * rate)
+	units := math.Trunc(nanos / 1e9)
+	return &pb.Money{CurrencyCode: code, Units: int64(units), Nanos: int32(nanos - units*1e9)}
+}
+
+type fakeCart struct {
+	mu    sync.Mutex
+	carts map[string][]*pb.CartItem
+	// failAdds counts the calls left to fail adding each product, to fail
+	// the middle of a series of calls.
+	failAdds map[string]int
+}
+
+// failAdding makes the next n calls adding the product fail.
+func (c *fakeCart) failAdding(productID string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failAdds == nil {
+		c.failAdds = make(map[string]int)
+	}
+	c.failAdds[productID] = n
+}
+
+func (c *fakeCart) AddItem(_ context.Context, req *pb.AddItemRequest) (*pb.Empty, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failAdds[req.GetItem().GetProductId()] > 0 {
+		c.failAdds[req.GetItem().GetProductId()]--
+		return nil, status.Error(codes.Unavailable, "injected AddItem failure")
+	}
+	items := c.carts[req.GetUserId()]
+	for _, it := range items {
+		if it.GetProductId() == req.GetItem().GetProductId() {
+			it.Quantity += req.GetItem().GetQuantity()
+			return &pb.Empty{}, nil
+		}
+	}
+	c.carts[req.GetUserId()] = append(items, &pb.CartItem{
+		ProductId: req.GetItem().GetProductId(),
+		Quantity:  req.GetItem().GetQuantity()})
+	return &pb.Empty{}, nil
+}
+
+func (c *fakeCart) GetCart(_ context.Context, req *pb.GetCartRequest) (*pb.Cart, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var items []*pb.CartItem
+	for _, it := range c.carts[req.GetUserId()] {
+		items = append(items, &pb.CartItem{ProductId: it.GetProductId(), Quantity: it.GetQuantity()})
+	}
+	return &pb.Cart{UserId: req.GetUserId(), Items: items}, nil
+}
+
+func (c *fakeCart) EmptyCart(_ context.Context, req *pb.EmptyCartRequest) (*pb.Empty, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.carts, req.GetUserId())
+	return &pb.Empty{}, nil
+}
+
+type fakeRecommendations struct {
+	catalog *fakeCatalog
+	stale   []string // recommended before the catalog products
+}
+
+func (r *fakeRecommendations) ListRecommendations(_ context.Context, req *pb.ListRecommendationsRequest) (*pb.ListRecommendationsResponse, error) {
+	exclude := make(map[string]bool)
+	for _, id := range req.GetProductIds() {
+		exclude[id] = true
+	}
+	resp, _ := r.catalog.ListProducts(context.Background(), &pb.Empty{})
+	out := append([]string(nil), r.stale...)
+	for _, p := range resp.GetProducts() {
+		if !exclude[p.GetId()] {
+			out = append(out, p.GetId())
+		}
+	}
+	return &pb.ListRecommendationsResponse{ProductIds: out}, nil
+}
+
+var (
+	fakeShippingCostUSD = &pb.Money{CurrencyCode: "USD", Units: 8, Nanos: 990000000}
+	fakeAbroadCostUSD   = &pb.Money{CurrencyCode: "USD", Units: 24, Nanos: 500000000}
+)
+
+// fakeShipping quotes fakeShippingCostUSD, or fakeAbroadCostUSD to an
+// address outside the United States, and records the quotes asked for.
+type fakeShipping struct {
+	mu     sync.Mutex
+	quotes []*pb.GetQuoteRequest
+}
+
+func (s *fakeShipping) GetQuote(_ context.Context, req *pb.GetQuoteRequest) (*pb.GetQuoteResponse, error) {
+	s.mu.Lock()
+	s.quotes = append(s.quotes, req)
+	s.mu.Unlock()
+	if c := req.GetAddress().GetCountry(); c != "" && c != "United States" {
+		return &pb.GetQuoteResponse{CostUsd: fakeAbroadCostUSD}, nil
+	}
+	return &pb.GetQuoteResponse{CostUsd: fakeShippingCostUSD}, nil
+}
+
+// lastQuote returns the last quote asked for, or nil.
+func (s *fakeShipping) lastQuote() *pb.GetQuoteRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.quotes) == 0 {
+		return nil
+	}
+	return s.quotes[len(s.quotes)-1]
+}
+
+func (s *fakeShipping) ShipOrder(context.Context, *pb.ShipOrderRequest) (*pb.ShipOrderResponse, error) {
+	return &pb.ShipOrderResponse{TrackingId: "TRACKING-1"}, nil
+}
+
+// fakeCheckout places orders the way checkoutservice does: it prices the
+// user's cart in the user currency, adds shipping and empties the cart.
+type fakeCheckout struct {
+	catalog *fakeCatalog
+	cart    *fakeCart
+	rates   *fakeRateTable
+
+	mu     sync.Mutex
+	orders int
+	drift  int32 // nanos added to every line cost, simulating rate drift
+}
+
+func (c *fakeCheckout) PlaceOrder(ctx context.Context, req *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
+	cart, _ := c.cart.GetCart(ctx, &pb.GetCartRequest{UserId: req.GetUserId()})
+	if len(cart.GetItems()) == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "cart is empty")
+	}
+	rate, ok := c.rates.get(req.GetUserCurrency())
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported currency %q", req.GetUserCurrency())
+	}
+	var items []*pb.OrderItem
+	for _, it := range cart.GetItems() {
+		p := c.catalog.lookup(it.GetProductId())
+		if p == nil {
+			return nil, status.Errorf(codes.NotFound, "no product with ID %s", it.GetProductId())
+		}
+		price := convertMoney(p.GetPriceUsd(), req.GetUserCurrency(), rate)
+		cost := money.MultiplySlow(*price, uint32(it.GetQuantity()))
+		items = append(items, &pb.OrderItem{Item: it, Cost: &cost})
+	}
+	c.cart.EmptyCart(ctx, &pb.EmptyCartRequest{UserId: req.GetUserId()})
+
+	c.mu.Lock()
+	for _, it := range items {
+		*it.Cost = money.Must(money.Sum(*it.Cost, pb.Money{CurrencyCode: it.Cost.GetCurrencyCode(), Nanos: c.drift}))
+	}
+	c.orders++
+	id := fmt.Sprintf("order-%d", c.orders)
+	c.mu.Unlock()
+	return &pb.PlaceOrderResponse{Order: &pb.OrderResult{
+		OrderId:            id,
+		ShippingTrackingId: "TRACKING-1",
+		ShippingCost:       convertMoney(fakeShippingCostUSD, req.GetUserCurrency(), rate),
+		ShippingAddress:    req.GetAddress(),
+		Items:              items,
+	}}, nil
+}
+
+type fakeAds struct {
+	ads []*pb.Ad // replacing the default ad
+}
+
+func (a *fakeAds) GetAds(context.Context, *pb.AdRequest) (*pb.AdResponse, error) {
+	if a.ads != nil {
+		return &pb.AdResponse{Ads: a.ads}, nil
+	}
+	return &pb.AdResponse{Ads: []*pb.Ad{{
+		RedirectUrl: "/product/66VCHSJNUP",
+		Text:        "Vintage camera lens for sale. 20% off."}}}, nil
+}
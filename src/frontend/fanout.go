@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultMaxOutboundConcurrency is the most backend calls in flight at
+// once from an instance.
+const defaultMaxOutboundConcurrency = 256
+
+// outboundLimit caps the backend calls in flight from this instance, so
+// that pages fanning out their calls cannot, together, make more of them
+// than the backends are sized for. Calls over the limit wait for a slot,
+// for as long as their context allows. A nil limit lets every call
+// through.
+type outboundLimit struct {
+	waiting int64 // calls waiting for a slot, updated atomically
+	slots   *semaphore.Weighted
+}
+
+// newOutboundLimit returns a limit of n calls at once, or nil for zero.
+func newOutboundLimit(n int) *outboundLimit {
+	if n <= 0 {
+		return nil
+	}
+	return &outboundLimit{slots: semaphore.NewWeighted(int64(n))}
+}
+
+// intercept is a unary client interceptor applying the limit. It comes
+// after the retries and hedges, so that each attempt takes a slot and none
+// is held during a backoff. A call whose context ends while it waits fails
+// with Canceled or DeadlineExceeded without reaching the backend.
+func (l *outboundLimit) intercept(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if l == nil {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	atomic.AddInt64(&l.waiting, 1)
+	err := l.slots.Acquire(ctx, 1)
+	atomic.AddInt64(&l.waiting, -1)
+	if err != nil {
+		code := codes.Canceled
+		if err == context.DeadlineExceeded {
+			code = codes.DeadlineExceeded
+		}
+		return status.Error(code, "waiting for an outbound call slot: "+err.Error())
+	}
+	defer l.slots.Release(1)
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// queued returns the number of calls waiting for a slot.
+func (l *outboundLimit) queued() int {
+	if l == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&l.waiting))
+}
@@ -0,0 +1,206 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	getCurrenciesMethod       = "/hipstershop.CurrencyService/GetSupportedCurrencies"
+	listRecommendationsMethod = "/hipstershop.RecommendationService/ListRecommendations"
+)
+
+func withOutboundLimit(n int) func(*frontendServer) {
+	return func(fe *frontendServer) { fe.outbound = newOutboundLimit(n) }
+}
+
+// awaitCancellations waits for the delayed calls to each method to be
+// cancelled.
+func awaitCancellations(t *testing.T, h *testHarness, methods ...string) {
+	t.Helper()
+	for _, m := range methods {
+		for deadline := time.Now().Add(time.Second); h.faults.cancellations(m) == 0; time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s was not cancelled", m)
+			}
+		}
+	}
+}
+
+func TestHomeCallsCancelledOnDisconnect(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.delay(getCurrenciesMethod, 5*time.Second)
+	h.delay(listProductsMethod, 5*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/", nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.client.Do(req.WithContext(ctx))
+		done <- err
+	}()
+	// Both calls are made at once, then the client goes away.
+	for deadline := time.Now().Add(time.Second); h.faults.calls(getCurrenciesMethod) == 0 || h.faults.calls(listProductsMethod) == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the home page calls were not made at once")
+		}
+	}
+	cancel()
+	if err := <-done; err == nil {
+		t.Fatal("request completed despite the cancellation")
+	}
+	awaitCancellations(t, h, getCurrenciesMethod, listProductsMethod)
+}
+
+func TestHomeCallsCancelledOnFailure(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.fail(getCurrenciesMethod, status.Error(codes.Internal, "injected failure"))
+	h.delay(listProductsMethod, 5*time.Second)
+
+	start := time.Now()
+	if resp := h.get("/"); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", resp.StatusCode)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("error page took %v, want it as soon as the currencies failed", d)
+	}
+	awaitCancellations(t, h, listProductsMethod)
+}
+
+func TestProductDecorativeCallsInParallel(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	for _, m := range []string{getProductMethod, getCurrenciesMethod, getCartMethod, listRecommendationsMethod} {
+		h.delay(m, 200*time.Millisecond)
+	}
+
+	start := time.Now()
+	if resp := h.get("/product/OLJCESPC7Z"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	// GetProduct and the ad after it are the longest chain.
+	if d := time.Since(start); d > 600*time.Millisecond {
+		t.Errorf("product page took %v, want its calls made at once", d)
+	}
+}
+
+func TestOutboundLimit(t *testing.T) {
+	l := newOutboundLimit(2)
+	var inFlight, peak int32
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for p := atomic.LoadInt32(&peak); n > p && !atomic.CompareAndSwapInt32(&peak, p, n); p = atomic.LoadInt32(&peak) {
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.intercept(context.Background(), listProductsMethod, nil, nil, nil, invoker); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if peak != 2 {
+		t.Errorf("at most %d calls at once, want 2", peak)
+	}
+}
+
+func TestOutboundLimitWaitCancelled(t *testing.T) {
+	l := newOutboundLimit(1)
+	release := make(chan struct{})
+	go l.intercept(context.Background(), listProductsMethod, nil, nil, nil, func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		<-release
+		return nil
+	})
+	defer close(release)
+	for deadline := time.Now().Add(time.Second); l.slots.TryAcquire(1); time.Sleep(time.Millisecond) {
+		l.slots.Release(1)
+		if time.Now().After(deadline) {
+			t.Fatal("the first call did not take the slot")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	invoked := false
+	err := l.intercept(ctx, getProductMethod, nil, nil, nil, func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		invoked = true
+		return nil
+	})
+	if status.Code(err) != codes.DeadlineExceeded || invoked {
+		t.Errorf("call over the limit: err %v, invoked %v, want DeadlineExceeded while waiting", err, invoked)
+	}
+	if n := l.queued(); n != 0 {
+		t.Errorf("%d calls still queued", n)
+	}
+}
+
+func TestOutboundLimitAcrossPage(t *testing.T) {
+	h := newTestHarness(t, withOutboundLimit(1))
+	defer h.close()
+	h.delay(convertMethod, 5*time.Millisecond)
+	h.post("/setCurrency", map[string][]string{"currency_code": {"EUR"}})
+
+	if resp := h.get("/"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := h.faults.concurrency(convertMethod); got != 1 {
+		t.Errorf("at most %d Convert calls at once, want 1", got)
+	}
+}
+
+// BenchmarkHomeFanOut loads the home page with backends taking 2ms a call,
+// with the calls made one at a time and at once.
+func BenchmarkHomeFanOut(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		limit int
+	}{
+		{"sequential", 1},
+		{"fanned_out", 0},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			h := newTestHarness(b, withOutboundLimit(bc.limit))
+			defer h.close()
+			for _, m := range []string{getCurrenciesMethod, listProductsMethod, getCartMethod, getAdsMethod} {
+				h.delay(m, 2*time.Millisecond)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if resp := h.get("/"); resp.StatusCode != http.StatusOK {
+					b.Fatalf("status = %d", resp.StatusCode)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+const maxFlagLatency = 30 * time.Second
+
+// faultFlag slows down a route, and fails a share of its requests, for
+// observability demos.
+type faultFlag struct {
+	Route          string  `json:"route"`      // path template, "*" for every route
+	ErrorRate      float64 `json:"error_rate"` // in [0, 1]
+	AddedLatencyMS int     `json:"added_latency_ms"`
+	Enabled        bool    `json:"enabled"`
+}
+
+func (f faultFlag) validate() error {
+	switch {
+	case f.Route != "*" && !strings.HasPrefix(f.Route, "/"):
+		return fmt.Errorf("flag %q: route must be a path template or *", f.Route)
+	case f.ErrorRate < 0 || f.ErrorRate > 1:
+		return fmt.Errorf("flag %q: error_rate must be in [0, 1]", f.Route)
+	case f.AddedLatencyMS < 0 || time.Duration(f.AddedLatencyMS)*time.Millisecond > maxFlagLatency:
+		return fmt.Errorf("flag %q: added_latency_ms must be in [0, %d]", f.Route, maxFlagLatency/time.Millisecond)
+	}
+	return nil
+}
+
+// parseFaultFlags parses the JSON array of flags of FAULT_FLAGS.
+func parseFaultFlags(s string) ([]faultFlag, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var flags []faultFlag
+	if err := json.Unmarshal([]byte(s), &flags); err != nil {
+		return nil, errors.Wrap(err, "flags must be a JSON array")
+	}
+	for _, f := range flags {
+		if err := f.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return flags, nil
+}
+
+// exemptFromFlags tells the routes flags never apply to, so that a flag
+// for every route cannot lock out the flags themselves or fail the probes.
+func exemptFromFlags(route string) bool {
+	return strings.HasPrefix(route, "/debug/") || strings.HasPrefix(route, "/admin/") ||
+		strings.HasPrefix(route, "/_")
+}
+
+// featureFlags holds the fault flags, by route. Unlike the error injector,
+// they apply to every request, synthetic or not.
+type featureFlags struct {
+	sample func() float64 // in [0, 1)
+
+	mu    sync.RWMutex
+	flags map[string]faultFlag
+}
+
+func newFeatureFlags(flags []faultFlag) *featureFlags {
+	ff := &featureFlags{sample: rand.Float64, flags: make(map[string]faultFlag)}
+	for _, f := range flags {
+		ff.flags[f.Route] = f
+	}
+	return ff
+}
+
+// set adds the flag, or replaces the flag of its route.
+func (ff *featureFlags) set(f faultFlag) {
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+	ff.flags[f.Route] = f
+}
+
+// list returns the flags, sorted by route.
+func (ff *featureFlags) list() []faultFlag {
+	ff.mu.RLock()
+	defer ff.mu.RUnlock()
+	out := make([]faultFlag, 0, len(ff.flags))
+	for _, f := range ff.flags {
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Route < out[j].Route })
+	return out
+}
+
+// match returns the enabled flag of the route, or else the enabled flag of
+// every route.
+func (ff *featureFlags) match(route string) (faultFlag, bool) {
+	ff.mu.RLock()
+	defer ff.mu.RUnlock()
+	if f, ok := ff.flags[route]; ok && f.Enabled {
+		return f, true
+	}
+	f, ok := ff.flags["*"]
+	return f, ok && f.Enabled
+}
+
+// faultFlags is a router middleware applying the flag of the route: it
+// waits for the added latency, then fails the request with the error rate.
+// Injected faults are tagged on the span as fault.injected.
+func (fe *frontendServer) faultFlags(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var route string
+		if cur := mux.CurrentRoute(r); cur != nil {
+			route, _ = cur.GetPathTemplate()
+		}
+		f, ok := fe.flags.match(route)
+		if !ok || exemptFromFlags(route) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		span := trace.FromContext(r.Context())
+		log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+		if d := time.Duration(f.AddedLatencyMS) * time.Millisecond; d > 0 {
+			span.AddAttributes(trace.BoolAttribute("fault.injected", true),
+				trace.Int64Attribute("fault.latency_ms", int64(f.AddedLatencyMS)))
+			t := fe.clock.NewTimer(d)
+			select {
+			case <-t.C():
+			case <-r.Context().Done():
+				t.Stop()
+				return
+			}
+		}
+		if fe.flags.sample() >= f.ErrorRate {
+			next.ServeHTTP(w, r)
+			return
+		}
+		span.AddAttributes(trace.BoolAttribute("fault.injected", true))
+		log.WithFields(logrus.Fields{
+			"event": "fault_injected",
+			"route": route,
+		}).Info("injected a fault")
+		w.Header().Set(headerInjectedError, "true")
+		fe.renderHTTPError(log, r, w, errors.New("injected fault"), http.StatusInternalServerError)
+	})
+}
+
+// flagsHandler lists the fault flags on GET, and sets the flag of a route
+// from a JSON body on POST. It requires the debug or the admin token.
+func (fe *frontendServer) flagsHandler(w http.ResponseWriter, r *http.Request) {
+	if !fe.requireDebugToken(w, r) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		var f faultFlag
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			http.Error(w, "invalid flag: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := f.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fe.flags.set(f)
+		r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger).WithFields(logrus.Fields{
+			"event":            "fault_flag_changed",
+			"route":            f.Route,
+			"error_rate":       f.ErrorRate,
+			"added_latency_ms": f.AddedLatencyMS,
+			"enabled":          f.Enabled,
+		}).Info("fault flag changed")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"flags": fe.flags.list()})
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+func withFaultFlags(flags ...faultFlag) func(*frontendServer) {
+	return func(fe *frontendServer) {
+		fe.flags = newFeatureFlags(flags)
+		fe.debugToken = "debug-token"
+	}
+}
+
+// postFlag posts a flag to /debug/flags with the given bearer token.
+func (h *testHarness) postFlag(body, token string) *response {
+	h.t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/debug/flags", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return h.do(req)
+}
+
+func TestParseFaultFlags(t *testing.T) {
+	flags, err := parseFaultFlags(`[{"route": "/product/{id}", "error_rate": 0.1, "added_latency_ms": 200, "enabled": true}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (faultFlag{"/product/{id}", 0.1, 200, true}); len(flags) != 1 || flags[0] != want {
+		t.Errorf("flags = %+v, want %+v", flags, want)
+	}
+	if flags, err := parseFaultFlags(""); err != nil || flags != nil {
+		t.Errorf("empty FAULT_FLAGS = %v, %v; want no flags", flags, err)
+	}
+	for _, bad := range []string{
+		`{"route": "*"}`,
+		`[{"route": "product"}]`,
+		`[{"route": "*", "error_rate": 1.01}]`,
+		`[{"route": "*", "error_rate": -0.1}]`,
+		`[{"route": "*", "added_latency_ms": -1}]`,
+		`[{"route": "*", "added_latency_ms": 30001}]`,
+	} {
+		if _, err := parseFaultFlags(bad); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestFaultFlagErrorRate(t *testing.T) {
+	for _, tc := range []struct {
+		rate   float64
+		sample float64
+		fail   bool
+	}{
+		{0, 0, false},
+		{1, math.Nextafter(1, 0), true},
+		{0.3, 0.29, true},
+		{0.3, 0.3, false},
+	} {
+		h := newTestHarness(t, withFaultFlags(faultFlag{Route: "/product/{id}", ErrorRate: tc.rate, Enabled: true}))
+		h.fe.flags.sample = func() float64 { return tc.sample }
+		resp := h.get("/product/OLJCESPC7Z")
+		if failed := resp.StatusCode == http.StatusInternalServerError; failed != tc.fail {
+			t.Errorf("rate %v, sample %v: status = %d, want failed = %v", tc.rate, tc.sample, resp.StatusCode, tc.fail)
+		}
+		if tc.fail && (resp.Header.Get(headerInjectedError) != "true" || len(h.logs.find("fault_injected")) != 1) {
+			t.Errorf("rate %v: injected fault not marked", tc.rate)
+		}
+		if tc.fail && h.faults.calls(getProductMethod) != 0 {
+			t.Errorf("rate %v: injected fault called the backend", tc.rate)
+		}
+		h.close()
+	}
+}
+
+func TestFaultFlagRouting(t *testing.T) {
+	h := newTestHarness(t, withFaultFlags(
+		faultFlag{Route: "*", ErrorRate: 1, Enabled: true},
+		faultFlag{Route: "/cart", ErrorRate: 1},
+	))
+	defer h.close()
+
+	if resp := h.get("/"); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("GET / = %d, want the fault of every route", resp.StatusCode)
+	}
+	if resp := h.get("/_healthz"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /_healthz = %d, want health checks exempt", resp.StatusCode)
+	}
+	// A disabled flag falls back to the flag of every route.
+	if resp := h.get("/cart"); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("GET /cart = %d, want the fault of every route", resp.StatusCode)
+	}
+	if resp := h.postFlag(`{"route": "*", "error_rate": 1, "enabled": false}`, "debug-token"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("disabling the flag of every route = %d", resp.StatusCode)
+	}
+	if resp := h.get("/cart"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /cart = %d with every flag disabled", resp.StatusCode)
+	}
+}
+
+func TestFaultFlagLatency(t *testing.T) {
+	rec := &spanRecorder{kind: trace.SpanKindServer}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+	h := newTestHarness(t, withFaultFlags(faultFlag{Route: "/robots.txt", AddedLatencyMS: 100, Enabled: true}))
+	defer h.close()
+
+	traceID := strings.Repeat("0", 30) + "f1"
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/robots.txt", nil)
+	req.Header.Set("X-B3-TraceId", traceID)
+	req.Header.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+	req.Header.Set("X-B3-Sampled", "1")
+	start := time.Now()
+	if resp := h.do(req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("request took %v, want at least the added 100ms", d)
+	}
+	span := rec.wait(t, traceID)
+	if span.Attributes["fault.injected"] != true || span.Attributes["fault.latency_ms"] != int64(100) {
+		t.Errorf("span attributes = %v, want the injected latency", span.Attributes)
+	}
+}
+
+func TestFlagsHandler(t *testing.T) {
+	h := newTestHarness(t, withAdminToken, withFaultFlags())
+	defer h.close()
+
+	if resp := h.postFlag(`{"route": "/", "error_rate": 1, "enabled": true}`, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("change without a token = %d, want 401", resp.StatusCode)
+	}
+	if resp := h.postFlag(`{"route": "/", "error_rate": 2}`, "debug-token"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid flag = %d, want 400", resp.StatusCode)
+	}
+	if resp := h.postFlag(`{"route": "/", "error_rate": 1, "enabled": true}`, "s3cret"); resp.StatusCode != http.StatusOK {
+		t.Errorf("change with the admin token = %d, want 200", resp.StatusCode)
+	}
+	if entries := h.logs.find("fault_flag_changed"); len(entries) != 1 || entries[0].Data["route"] != "/" {
+		t.Errorf("change logged as %v", entries)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/debug/flags", nil)
+	req.Header.Set("Authorization", "Bearer debug-token")
+	var list struct{ Flags []faultFlag }
+	decodeAPI(t, h.do(req), http.StatusOK, &list)
+	if want := (faultFlag{"/", 1, 0, true}); len(list.Flags) != 1 || list.Flags[0] != want {
+		t.Errorf("flags = %+v, want %+v", list.Flags, want)
+	}
+	if resp := h.get("/debug/flags"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("listing without a token = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestFeatureFlagsConcurrent(t *testing.T) {
+	ff := newFeatureFlags(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ff.set(faultFlag{Route: "/", ErrorRate: float64(i) / 8, Enabled: j%2 == 0})
+				ff.match("/")
+				ff.list()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := len(ff.list()); n != 1 {
+		t.Errorf("%d flags, want the one of /", n)
+	}
+}
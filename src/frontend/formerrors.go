@@ -0,0 +1,288 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.opencensus.io/trace"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/cache"
+)
+
+const (
+	formStateTTL  = 5 * time.Minute
+	maxFormStates = 1000 // sessions with a rejected form remembered
+)
+
+// Forms validated by the frontend, by name. The name prefixes the ID of
+// the error summary of the form, which the redirect after a rejected
+// submission targets so that the summary gets the focus.
+const (
+	formCheckout  = "checkout"
+	formAddToCart = "add_to_cart"
+	formCurrency  = "currency"
+	formLocale    = "locale"
+	formShipping  = "shipping"
+	formSignup    = "signup"
+	formLogin     = "login"
+)
+
+// fieldError is a rejected form field. The field's element has the name of
+// the field as its ID, so that the error summary can link to it; ID is that
+// of the message, which the element references with aria-describedby.
+type fieldError struct {
+	Field   string
+	ID      string
+	Message string
+}
+
+// formState is a rejected submission of a form: its errors, in the order of
+// the fields, and the values to fill the form with again. Its methods accept
+// a nil *formState, the state of a form that was not rejected.
+type formState struct {
+	Form   string
+	Errors []fieldError
+	Values map[string]string
+}
+
+func newFormState(form string) *formState {
+	return &formState{Form: form, Values: make(map[string]string)}
+}
+
+func (f *formState) add(field, message string) {
+	f.Errors = append(f.Errors, fieldError{Field: field, ID: field + "_error", Message: message})
+}
+
+// SummaryID is the ID of the error summary of the form.
+func (f *formState) SummaryID() string { return f.Form + "_errors" }
+
+// Error returns the error on field, or nil.
+func (f *formState) Error(field string) *fieldError {
+	if f == nil {
+		return nil
+	}
+	for i := range f.Errors {
+		if f.Errors[i].Field == field {
+			return &f.Errors[i]
+		}
+	}
+	return nil
+}
+
+// Value returns the submitted value of field, or def if the form was not
+// rejected.
+func (f *formState) Value(field, def string) string {
+	if f == nil {
+		return def
+	}
+	if v, ok := f.Values[field]; ok {
+		return v
+	}
+	return def
+}
+
+// formStates keeps rejected forms across the redirect that follows them,
+// for the next page of the same session to render.
+type formStates struct {
+	states *cache.Cache // by session ID: map[string]*formState by form
+}
+
+func newFormStates() *formStates {
+	return &formStates{states: cache.New(maxFormStates)}
+}
+
+func (s *formStates) save(sessionID string, f *formState) {
+	if s == nil {
+		return
+	}
+	forms := map[string]*formState{f.Form: f}
+	if v, ok := s.states.Get(sessionID); ok {
+		for k, prev := range v.(map[string]*formState) {
+			if k != f.Form {
+				forms[k] = prev
+			}
+		}
+	}
+	s.states.Set(sessionID, forms, formStateTTL)
+}
+
+// take returns the rejected forms of the session, by form name, and
+// forgets them: they are shown once.
+func (s *formStates) take(sessionID string) map[string]*formState {
+	if s == nil {
+		return nil
+	}
+	if v, ok := s.states.Take(sessionID); ok {
+		return v.(map[string]*formState)
+	}
+	return nil
+}
+
+// annotate records the names of the rejected fields on the span of ctx.
+func (f *formState) annotate(ctx context.Context) {
+	fields := make([]string, 0, len(f.Errors))
+	for _, e := range f.Errors {
+		fields = append(fields, e.Field)
+	}
+	trace.FromContext(ctx).AddAttributes(
+		trace.StringAttribute("form", f.Form),
+		trace.StringAttribute("form.invalid_fields", strings.Join(fields, ",")))
+}
+
+// rejectForm remembers the rejected form for the session and redirects to
+// the page showing it, with the error summary as the fragment.
+func (fe *frontendServer) rejectForm(w http.ResponseWriter, r *http.Request, f *formState, page string) {
+	f.annotate(r.Context())
+	fe.forms.save(sessionID(r), f)
+	u, err := url.Parse(page)
+	if err != nil {
+		u = &url.URL{Path: "/"}
+	}
+	u.Fragment = f.SummaryID()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+var (
+	zipCodePattern = regexp.MustCompile(`^\d{4,5}$`)
+	cvvPattern     = regexp.MustCompile(`^\d{3,4}$`)
+
+	// checkoutMaxLengths caps the text fields of the checkout form, in
+	// characters.
+	checkoutMaxLengths = map[string]int{
+		"email":          254,
+		"street_address": 100,
+		"city":           60,
+		"state":          60,
+		"country":        60,
+	}
+)
+
+// validateAddToCart checks the quantity of the form adding a product to
+// the cart; the product is checked against the catalog by the handler.
+func validateAddToCart(value func(field string) string, maxQuantity int) *formState {
+	f := newFormState(formAddToCart)
+	f.Values["quantity"] = value("quantity")
+	if n, err := strconv.Atoi(value("quantity")); err != nil || n < 1 || n > maxQuantity {
+		f.add("quantity", fmt.Sprintf("Choose a quantity from 1 to %d", maxQuantity))
+		return f
+	}
+	return nil
+}
+
+// quantityChoices are the quantities offered by the product page, up to
+// max.
+func quantityChoices(max int) []int {
+	var out []int
+	for _, n := range []int{1, 2, 3, 4, 5, 10} {
+		if n <= max {
+			out = append(out, n)
+		}
+	}
+	if out[len(out)-1] != max {
+		out = append(out, max)
+	}
+	return out
+}
+
+// luhnValid reports whether the digits pass the Luhn check of card numbers.
+func luhnValid(digits string) bool {
+	sum := 0
+	for i := range digits {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// validateCheckout checks the checkout form. Only the address fields are
+// kept to fill the form again, never the card details.
+func validateCheckout(r *http.Request, now time.Time) *formState {
+	return validateCheckoutFields(r.FormValue, now)
+}
+
+// validateCheckoutFields checks the fields of the checkout form as returned
+// by value.
+func validateCheckoutFields(value func(field string) string, now time.Time) *formState {
+	f := newFormState(formCheckout)
+	for _, field := range []string{"email", "street_address", "zip_code", "city", "state", "country"} {
+		f.Values[field] = value(field)
+	}
+	required := func(field, message string) bool {
+		v := strings.TrimSpace(value(field))
+		if v == "" {
+			f.add(field, message)
+			return false
+		}
+		if max, ok := checkoutMaxLengths[field]; ok && utf8.RuneCountInString(v) > max {
+			f.add(field, fmt.Sprintf("Enter at most %d characters", max))
+			return false
+		}
+		return true
+	}
+
+	if required("email", "Enter an e-mail address") {
+		if _, err := mail.ParseAddress(value("email")); err != nil {
+			f.add("email", "Enter an e-mail address like name@example.com")
+		}
+	}
+	required("street_address", "Enter a street address")
+	if required("zip_code", "Enter a zip code") && !zipCodePattern.MatchString(value("zip_code")) {
+		f.add("zip_code", "Enter a zip code of 4 or 5 digits")
+	}
+	required("city", "Enter a city")
+	required("state", "Enter a state")
+	required("country", "Enter a country")
+
+	if required("credit_card_number", "Enter a credit card number") {
+		digits := strings.NewReplacer("-", "", " ", "").Replace(value("credit_card_number"))
+		if _, err := strconv.ParseUint(digits, 10, 64); err != nil || len(digits) < 13 || len(digits) > 19 {
+			f.add("credit_card_number", "Enter a credit card number of 13 to 19 digits")
+		} else if !luhnValid(digits) {
+			f.add("credit_card_number", "Check the credit card number, it is not valid")
+		}
+	}
+	month, errMonth := strconv.Atoi(value("credit_card_expiration_month"))
+	year, errYear := strconv.Atoi(value("credit_card_expiration_year"))
+	switch {
+	case errMonth != nil || month < 1 || month > 12:
+		f.add("credit_card_expiration_month", "Choose the expiration month")
+	case errYear != nil:
+		f.add("credit_card_expiration_year", "Choose the expiration year")
+	case year < now.Year() || year == now.Year() && month < int(now.Month()):
+		f.add("credit_card_expiration_year", "The card has expired")
+	}
+	if !cvvPattern.MatchString(value("credit_card_cvv")) {
+		f.add("credit_card_cvv", "Enter the 3 or 4 digit security code")
+	}
+	if len(f.Errors) == 0 {
+		return nil
+	}
+	return f
+}
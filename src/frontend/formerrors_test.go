@@ -0,0 +1,285 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+const placeOrderMethod = "/hipstershop.CheckoutService/PlaceOrder"
+
+var (
+	describedByPattern  = regexp.MustCompile(`aria-describedby="([^"]+)"`)
+	errorIDPattern      = regexp.MustCompile(`id="([^"]+_error)"`)
+	summaryLinkPattern  = regexp.MustCompile(`<a href="#([^"]+)" class="alert-link">`)
+	invalidCheckoutForm = url.Values{
+		"email":                        {"someone at example.com"},
+		"street_address":               {"1600 Amphitheatre Parkway"},
+		"zip_code":                     {"940"},
+		"city":                         {""},
+		"state":                        {"CA"},
+		"country":                      {"United States"},
+		"credit_card_number":           {"4432-8015"},
+		"credit_card_expiration_month": {"1"},
+		"credit_card_expiration_year":  {"2039"},
+		"credit_card_cvv":              {"67"},
+	}
+)
+
+// assertErrorAssociations checks that every error message on the page is
+// referenced by exactly one aria-describedby, and the reverse, and that the
+// error summary links to existing elements. It returns the IDs of the
+// messages, sorted.
+func assertErrorAssociations(t *testing.T, body string) []string {
+	t.Helper()
+	var ids []string
+	for _, m := range errorIDPattern.FindAllStringSubmatch(body, -1) {
+		ids = append(ids, m[1])
+	}
+	var described []string
+	for _, m := range describedByPattern.FindAllStringSubmatch(body, -1) {
+		described = append(described, m[1])
+	}
+	sort.Strings(ids)
+	sort.Strings(described)
+	if strings.Join(ids, " ") != strings.Join(described, " ") {
+		t.Errorf("error messages %v and aria-describedby references %v do not pair up", ids, described)
+	}
+	for _, m := range summaryLinkPattern.FindAllStringSubmatch(body, -1) {
+		if strings.Count(body, `id="`+m[1]+`"`) != 1 {
+			t.Errorf("error summary links to #%s, which is not a single element", m[1])
+		}
+	}
+	return ids
+}
+
+func TestCheckoutFormErrors(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+
+	resp := h.post("/cart/checkout", invalidCheckoutForm)
+	if got := h.faults.calls(placeOrderMethod); got != 0 {
+		t.Fatalf("invalid checkout form sent to the checkout service %d times", got)
+	}
+	if u := resp.Request.URL; u.Path != "/cart" || u.Fragment != "checkout_errors" {
+		t.Errorf("rejected checkout redirected to %v, want /cart#checkout_errors", u)
+	}
+	if !strings.Contains(resp.body, `id="checkout_errors" tabindex="-1"`) {
+		t.Error("no focusable error summary")
+	}
+	ids := assertErrorAssociations(t, resp.body)
+	want := []string{"city_error", "credit_card_cvv_error", "credit_card_number_error", "email_error", "zip_code_error"}
+	if strings.Join(ids, " ") != strings.Join(want, " ") {
+		t.Errorf("error messages %v, want %v", ids, want)
+	}
+	if got := len(summaryLinkPattern.FindAllString(resp.body, -1)); got != len(want) {
+		t.Errorf("error summary lists %d errors, want %d", got, len(want))
+	}
+
+	// The address is filled in again as entered, the card details are not.
+	if !strings.Contains(resp.body, `value="someone at example.com"`) || !strings.Contains(resp.body, `value="940"`) {
+		t.Error("submitted address not filled in again")
+	}
+	if strings.Contains(resp.body, `value="4432-8015"`) {
+		t.Error("rejected card number echoed back")
+	}
+
+	// The errors are shown once.
+	if again := h.get("/cart"); strings.Contains(again.body, "checkout_errors") || len(assertErrorAssociations(t, again.body)) != 0 {
+		t.Error("errors shown again on the next page")
+	}
+}
+
+func TestCheckoutFormExpiredCard(t *testing.T) {
+	clock := newFakeClock() // March 2019
+	h := newTestHarness(t, withFakeClock(clock))
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+
+	form := url.Values{}
+	for k, v := range checkoutForm {
+		form[k] = v
+	}
+	form.Set("credit_card_expiration_year", "2019")
+	form.Set("credit_card_expiration_month", "2")
+	resp := h.post("/cart/checkout", form)
+	if ids := assertErrorAssociations(t, resp.body); len(ids) != 1 || ids[0] != "credit_card_expiration_year_error" {
+		t.Errorf("error messages %v, want the expiration year only", ids)
+	}
+	if !strings.Contains(resp.body, "The card has expired") {
+		t.Error("expired card not reported")
+	}
+
+	form.Set("credit_card_expiration_month", "3")
+	if resp := h.post("/cart/checkout", form); !strings.Contains(resp.body, "Your order is complete!") {
+		t.Error("card expiring this month rejected")
+	}
+}
+
+func TestCurrencyFormErrors(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.get("/")
+
+	resp := h.post("/setCurrency", url.Values{"currency_code": {"XYZ"}})
+	if got := h.cookie(cookieCurrency); got != "" {
+		t.Errorf("currency cookie set to %q by an unknown currency", got)
+	}
+	if u := resp.Request.URL; u.Path != "/" || u.Fragment != "currency_errors" {
+		t.Errorf("rejected currency redirected to %v, want /#currency_errors", u)
+	}
+	if ids := assertErrorAssociations(t, resp.body); len(ids) != 1 || ids[0] != "currency_code_error" {
+		t.Errorf("error messages %v, want the currency only", ids)
+	}
+	if !strings.Contains(resp.body, `id="currency_errors"`) {
+		t.Error("no currency error summary")
+	}
+}
+
+func TestValidateCheckoutFields(t *testing.T) {
+	now := time.Date(2019, time.March, 14, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name, field, value string
+		want               string // field rejected, "" if none
+	}{
+		{"valid", "", "", ""},
+		{"no email", "email", " ", "email"},
+		{"unparsable email", "email", "someone at example.com", "email"},
+		{"email too long", "email", strings.Repeat("a", 250) + "@example.com", "email"},
+		{"no street", "street_address", "", "street_address"},
+		{"street too long", "street_address", strings.Repeat("x", 101), "street_address"},
+		{"street at the cap", "street_address", strings.Repeat("é", 100), ""},
+		{"short zip", "zip_code", "940", "zip_code"},
+		{"no city", "city", "", "city"},
+		{"city too long", "city", strings.Repeat("x", 61), "city"},
+		{"state too long", "state", strings.Repeat("x", 61), "state"},
+		{"country too long", "country", strings.Repeat("x", 61), "country"},
+		{"short card number", "credit_card_number", "4432-8015", "credit_card_number"},
+		{"card number with letters", "credit_card_number", "4432-8015-6152-04a4", "credit_card_number"},
+		{"card number failing the luhn check", "credit_card_number", "4432-8015-6152-0455", "credit_card_number"},
+		{"month 13", "credit_card_expiration_month", "13", "credit_card_expiration_month"},
+		{"month 0", "credit_card_expiration_month", "0", "credit_card_expiration_month"},
+		{"expired last year", "credit_card_expiration_year", "2018", "credit_card_expiration_year"},
+		{"expiring this month", "credit_card_expiration_month", "3", ""},
+		{"short cvv", "credit_card_cvv", "67", "credit_card_cvv"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			form := url.Values{}
+			for k, v := range checkoutForm {
+				form[k] = v
+			}
+			form.Set("credit_card_expiration_year", "2019")
+			form.Set("credit_card_expiration_month", "6")
+			if tc.field != "" {
+				form.Set(tc.field, tc.value)
+			}
+			f := validateCheckoutFields(form.Get, now)
+			if tc.want == "" {
+				if f != nil {
+					t.Errorf("errors %+v, want none", f.Errors)
+				}
+				return
+			}
+			if f == nil || len(f.Errors) != 1 || f.Errors[0].Field != tc.want {
+				t.Errorf("errors %+v, want one on %s", f, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateAddToCart(t *testing.T) {
+	for _, tc := range []struct {
+		quantity string
+		valid    bool
+	}{
+		{"1", true},
+		{"10", true},
+		{"0", false},
+		{"-1", false},
+		{"11", false},
+		{"4294967297", false},
+		{"two", false},
+		{"", false},
+	} {
+		f := validateAddToCart(url.Values{"quantity": {tc.quantity}}.Get, defaultCartMaxQuantity)
+		if valid := f == nil; valid != tc.valid {
+			t.Errorf("quantity %q: valid = %v, want %v", tc.quantity, valid, tc.valid)
+		}
+	}
+}
+
+func TestQuantityChoices(t *testing.T) {
+	for max, want := range map[int]string{1: "[1]", 4: "[1 2 3 4]", 7: "[1 2 3 4 5 7]", 10: "[1 2 3 4 5 10]", 20: "[1 2 3 4 5 10 20]"} {
+		if got := fmt.Sprint(quantityChoices(max)); got != want {
+			t.Errorf("quantityChoices(%d) = %s, want %s", max, got, want)
+		}
+	}
+}
+
+func TestAddToCartFormErrors(t *testing.T) {
+	rec := &spanRecorder{kind: trace.SpanKindServer}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+	h := newTestHarness(t)
+	defer h.close()
+	h.get("/")
+
+	traceID := strings.Repeat("0", 30) + "c1"
+	req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/cart", strings.NewReader("product_id=OLJCESPC7Z&quantity=11"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-B3-TraceId", traceID)
+	req.Header.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+	req.Header.Set("X-B3-Sampled", "1")
+	req.Header.Set(csrfHeader, h.fe.csrfToken(h.session()))
+	for _, c := range h.client.Jar.Cookies(req.URL) {
+		req.AddCookie(c)
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if loc := resp.Header.Get("Location"); resp.StatusCode != http.StatusSeeOther || loc != "/product/OLJCESPC7Z#add_to_cart_errors" {
+		t.Errorf("rejected quantity: %d to %q, want a redirect to the product page", resp.StatusCode, loc)
+	}
+	if got := rec.wait(t, traceID).Attributes["form.invalid_fields"]; got != "quantity" {
+		t.Errorf("invalid fields on the span = %v, want quantity", got)
+	}
+
+	page := h.get("/product/OLJCESPC7Z")
+	if ids := assertErrorAssociations(t, page.body); len(ids) != 1 || ids[0] != "quantity_error" {
+		t.Errorf("error messages %v, want the quantity only", ids)
+	}
+	if !strings.Contains(page.body, "Choose a quantity from 1 to 10") {
+		t.Error("quantity error not shown")
+	}
+	if n := h.faults.calls("/hipstershop.CartService/AddItem"); n != 0 {
+		t.Errorf("invalid quantity sent to the cart service %d times", n)
+	}
+
+	if resp := h.post("/cart", url.Values{"product_id": {"NOSUCHITEM"}, "quantity": {"1"}}); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("unknown product: status = %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+	}
+}
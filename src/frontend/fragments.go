@@ -0,0 +1,181 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"sync"
+	"sync/atomic"
+	"text/template/parse"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/cache"
+)
+
+// maxFragments bounds the rendered fragments kept in memory.
+const maxFragments = 5000
+
+// fragmentKeyer is implemented by the data of cacheable partials: the key
+// must tell apart every rendering of the partial, such as a product and its
+// price in the session currency.
+type fragmentKeyer interface {
+	fragmentKey() string
+}
+
+// fragmentCache keeps partials rendered by cacheFragment. Its entries are
+// dropped whenever the catalog listing or the exchange rates change.
+type fragmentCache struct {
+	cache *cache.Cache
+
+	mu                  sync.Mutex
+	catalogGen, rateGen uint64
+
+	hits, misses int64         // atomic
+	stats        *rollingStats // nil counts lookups in hits and misses only
+}
+
+func newFragmentCache() *fragmentCache {
+	return &fragmentCache{cache: cache.New(maxFragments)}
+}
+
+// sync drops the fragments rendered before the given generations. Pages
+// rendered with older rates, such as a pinned checkout, leave them alone.
+func (c *fragmentCache) sync(catalogGen, rateGen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if catalogGen > c.catalogGen || rateGen > c.rateGen {
+		c.cache.Purge()
+		if catalogGen > c.catalogGen {
+			c.catalogGen = catalogGen
+		}
+		if rateGen > c.rateGen {
+			c.rateGen = rateGen
+		}
+	}
+}
+
+// fragmentsFor returns the fragment cache to render a page with the rates
+// of ctx, or nil if fragments are not cached.
+func (fe *frontendServer) fragmentsFor(ctx context.Context) *fragmentCache {
+	if fe.fragments == nil {
+		return nil
+	}
+	fe.fragments.sync(fe.catalog.gen(), fe.rateSnapshot(ctx).generation)
+	return fe.fragments
+}
+
+// cacheFragment renders the partial with data, reusing what it rendered for
+// the same key within ttl. A nil cache, a partial in nonCacheable or
+// reloaded templates render every time.
+func (ts *templateSet) cacheFragment(c *fragmentCache, partial, ttl string, data fragmentKeyer) (template.HTML, error) {
+	if c == nil || ts.uncached || ts.nonCacheable[partial] {
+		return ts.renderFragment(partial, data)
+	}
+	key := partial + "|" + data.fragmentKey()
+	if v, ok := c.cache.Get(key); ok {
+		atomic.AddInt64(&c.hits, 1)
+		c.stats.cacheLookup(statsCacheFragments, true)
+		return v.(template.HTML), nil
+	}
+	atomic.AddInt64(&c.misses, 1)
+	c.stats.cacheLookup(statsCacheFragments, false)
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return "", fmt.Errorf("cacheFragment %s: invalid ttl %q", partial, ttl)
+	}
+	html, err := ts.renderFragment(partial, data)
+	if err == nil {
+		c.cache.Set(key, html, d)
+	}
+	return html, err
+}
+
+func (ts *templateSet) renderFragment(partial string, data interface{}) (template.HTML, error) {
+	var buf bytes.Buffer
+	if err := ts.shared.ExecuteTemplate(&buf, partial, data); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// findNonCacheable returns the partials of t that must be rendered on every
+// use: those marked with {{ noCache }}, for showing per-session data, and
+// those including them.
+func findNonCacheable(t *template.Template) map[string]bool {
+	marked := make(map[string]bool)
+	includes := make(map[string][]string)
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree == nil {
+			continue
+		}
+		var walk func(parse.Node)
+		walk = func(n parse.Node) {
+			switch n := n.(type) {
+			case *parse.ListNode:
+				if n == nil {
+					return
+				}
+				for _, c := range n.Nodes {
+					walk(c)
+				}
+			case *parse.ActionNode:
+				walk(n.Pipe)
+			case *parse.PipeNode:
+				if n == nil {
+					return
+				}
+				for _, cmd := range n.Cmds {
+					for _, arg := range cmd.Args {
+						walk(arg)
+					}
+				}
+			case *parse.IdentifierNode:
+				if n.Ident == "noCache" {
+					marked[tmpl.Name()] = true
+				}
+			case *parse.IfNode:
+				walk(n.Pipe)
+				walk(n.List)
+				walk(n.ElseList)
+			case *parse.RangeNode:
+				walk(n.Pipe)
+				walk(n.List)
+				walk(n.ElseList)
+			case *parse.WithNode:
+				walk(n.Pipe)
+				walk(n.List)
+				walk(n.ElseList)
+			case *parse.TemplateNode:
+				includes[tmpl.Name()] = append(includes[tmpl.Name()], n.Name)
+				walk(n.Pipe)
+			}
+		}
+		walk(tmpl.Tree.Root)
+	}
+	for changed := true; changed; {
+		changed = false
+		for name, incl := range includes {
+			for _, other := range incl {
+				if marked[other] && !marked[name] {
+					marked[name], changed = true, true
+				}
+			}
+		}
+	}
+	return marked
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func (c *fragmentCache) counts() (hits, misses int64) {
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
+
+func TestProductCardFragments(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	c := h.fe.fragments
+
+	h.get("/")
+	if hits, misses := c.counts(); hits != 0 || misses != 3 {
+		t.Fatalf("first page: %d hits, %d misses; want 0, 3", hits, misses)
+	}
+	first := h.get("/")
+	if hits, misses := c.counts(); hits != 3 || misses != 3 {
+		t.Errorf("second page: %d hits, %d misses; want 3, 3", hits, misses)
+	}
+	if !strings.Contains(first.body, "USD 12.49") {
+		t.Error("cached page does not show the lens price")
+	}
+
+	// Another currency renders its own cards.
+	h.post("/setCurrency", url.Values{"currency_code": {"EUR"}})
+	if resp := h.get("/"); !strings.Contains(resp.body, "EUR 11.24") {
+		t.Error("EUR page shows the cards cached in USD")
+	}
+	h.post("/setCurrency", url.Values{"currency_code": {"USD"}})
+
+	// A price change in the catalog invalidates the cards.
+	h.catalog.mu.Lock()
+	lens := proto.Clone(h.catalog.products[1]).(*pb.Product)
+	lens.PriceUsd = &pb.Money{CurrencyCode: "USD", Units: 15}
+	h.catalog.products = []*pb.Product{h.catalog.products[0], lens, h.catalog.products[2]}
+	h.catalog.mu.Unlock()
+	_, before := c.counts()
+	resp := h.get("/")
+	if !strings.Contains(resp.body, "USD 15.00") || strings.Contains(resp.body, "USD 12.49") {
+		t.Error("home page shows the old lens price")
+	}
+	if _, after := c.counts(); after-before != 3 {
+		t.Errorf("%d cards rendered after the catalog changed, want 3", after-before)
+	}
+
+	// So does a rate update.
+	h.post("/setCurrency", url.Values{"currency_code": {"EUR"}})
+	h.get("/")
+	h.rates.set("EUR", 2)
+	h.fe.rates.rotate()
+	if resp := h.get("/"); !strings.Contains(resp.body, "EUR 30.00") {
+		t.Error("EUR page shows the lens price at the old rate")
+	}
+}
+
+// sessionData is the data of a page, for rendering whole page templates as
+// fragments.
+type sessionData map[string]interface{}
+
+func (sessionData) fragmentKey() string { return "page" }
+
+func TestNonCacheableFragments(t *testing.T) {
+	for name, want := range map[string]bool{
+		"header":       true, // marked
+		"home":         true, // includes the header
+		"product_card": false,
+		"footer":       false,
+	} {
+		if got := testRenderer.set.nonCacheable[name]; got != want {
+			t.Errorf("%s non-cacheable = %v, want %v", name, got, want)
+		}
+	}
+
+	c := newFragmentCache()
+	for _, size := range []int{1, 2} {
+		html, err := testRenderer.set.cacheFragment(c, "header", "1m", sessionData{"currencies": []string{"USD"}, "user_currency": "USD", "cart_size": size})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("View Cart (%d)", size); !strings.Contains(string(html), want) {
+			t.Errorf("header does not show %q", want)
+		}
+	}
+	if c.cache.Len() != 0 {
+		t.Errorf("%d non-cacheable fragments cached", c.cache.Len())
+	}
+}
+
+// BenchmarkHomeRender renders the home page template with 120 products,
+// with and without the product cards cached.
+func BenchmarkHomeRender(b *testing.B) {
+	products := make([]productView, 120)
+	for i := range products {
+		p := proto.Clone(fakeProducts[i%len(fakeProducts)]).(*pb.Product)
+		p.Id = fmt.Sprintf("%s%03d", p.Id, i)
+		products[i] = productView{Item: p, Price: p.PriceUsd}
+	}
+	for _, bc := range []struct {
+		name      string
+		fragments *fragmentCache
+	}{
+		{"uncached", nil},
+		{"cached", newFragmentCache()},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			data := map[string]interface{}{
+				"session_id":    oldSession,
+				"user_currency": "USD",
+				"currencies":    []string{"USD", "EUR"},
+				"products":      products,
+				"fragments":     bc.fragments,
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := testRenderer.set.execute(ioutil.Discard, "home", data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -17,112 +17,253 @@ package main
 import (
 	"context"
 	"fmt"
-	"html/template"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
 	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
 )
 
-var (
-	templates = template.Must(template.New("").
-		Funcs(template.FuncMap{
-			"renderMoney": renderMoney,
-		}).ParseGlob("templates/*.html"))
-)
+// productView is a product as shown in the product grids, priced in the
+// session currency.
+type productView struct {
+	Item     *pb.Product
+	Price    *pb.Money // nil if it could not be converted
+	Featured bool
+	Locale   *locale
+}
+
+func (p productView) fragmentKey() string {
+	price := "unavailable"
+	if p.Price != nil {
+		price = p.Price.GetCurrencyCode() + " " + formatDecimal(*p.Price)
+	}
+	return fmt.Sprintf("%s|%s|%v|%s", p.Item.GetId(), price, p.Featured, p.Locale.tag())
+}
+
+// moneyRounding is the rounding mode applied when displaying prices.
+var moneyRounding = money.RoundHalfUp
 
+// homeHandler streams the home page: the top of the page and the product
+// grid are flushed as soon as the essential calls are done, and the ad,
+// fetched meanwhile, is waited for within the composition budget only.
 func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.WithField("currency", currentCurrency(r)).Info("home")
-	currencies, err := fe.getCurrencies(r.Context())
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
-		return
+	r = r.WithContext(withPageConversions(r.Context()))
+
+	// The ad is not critical, the page is rendered without it on errors or
+	// when it comes too late. It is checked against the catalog once listed.
+	// It is asked for with the request context: the failure of the other
+	// calls does not cut it short, the client going away does.
+	var ads []*pb.Ad
+	adDone := make(chan struct{})
+	go func() {
+		defer close(adDone)
+		var err error
+		if ads, err = fe.getAd(r.Context(), []string{}); err != nil {
+			degradeOptional(r.Context(), log, "GetAds", err)
+		}
+	}()
+	var budget <-chan time.Time
+	if fe.composeBudget > 0 {
+		t := fe.clock.NewTimer(fe.composeBudget)
+		defer t.Stop()
+		budget = t.C()
 	}
-	products, err := fe.getProducts(r.Context())
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve products"), http.StatusInternalServerError)
+
+	// The calls the page needs are made at once, and all cancelled as soon
+	// as one of them fails. The response is left alone until they are done.
+	listing := parseListingQuery(r)
+	var (
+		currencies []string
+		products   []*pb.Product
+		resume     *resumeCard
+		cartSize   int
+		countCart  bool // the cart size is to be remembered
+	)
+	g, ctx := errgroup.WithContext(r.Context())
+	g.Go(func() (err error) {
+		currencies, err = fe.getCurrencies(ctx)
+		return errors.Wrap(err, "could not retrieve currencies")
+	})
+	g.Go(func() (err error) {
+		if listing.search != "" {
+			products, err = fe.searchProducts(ctx, listing.search)
+			return errors.Wrap(err, "could not search products")
+		}
+		products, err = fe.getProducts(ctx)
+		return errors.Wrap(err, "could not retrieve products")
+	})
+	g.Go(func() (err error) {
+		var cart []*pb.CartItem
+		if resume, cart, countCart = fe.resumeCard(ctx, log, r); countCart {
+			cartSize = cartQuantity(cart)
+			return nil
+		}
+		cartSize, countCart, err = fe.countCartItems(ctx, r)
+		return errors.Wrap(err, "could not retrieve cart")
+	})
+	if err := g.Wait(); err != nil {
+		fe.renderHTTPError(log, r, w, err, http.StatusInternalServerError)
 		return
 	}
-	cart, err := fe.getCart(r.Context(), sessionID(r))
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
-		return
+	if countCart {
+		fe.setCartCount(w, cartSize)
 	}
 
-	type productView struct {
-		Item  *pb.Product
-		Price *pb.Money
+	prices := make([]*pb.Money, len(products))
+	for i, p := range products {
+		prices[i] = p.GetPriceUsd()
 	}
+	// A product whose price cannot be converted is shown without it; when
+	// none can be, the prices are shown in USD.
 	ps := make([]productView, len(products))
-	for i, p := range products {
-		price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
-		if err != nil {
-			renderHTTPError(log, r, w, errors.Wrapf(err, "failed to do currency conversion for product %s", p.GetId()), http.StatusInternalServerError)
-			return
+	for i, res := range fe.convertAll(r.Context(), prices, currentCurrency(r)) {
+		if res.Err != nil {
+			log.WithField("product", products[i].GetId()).WithField("error", res.Err).Warn("failed to do currency conversion")
+		}
+		ps[i] = productView{Item: products[i], Price: res.Money, Locale: requestLocale(r)}
+	}
+	usd := pageConversionsFrom(r.Context()).usdFallback()
+
+	// The price facets are those of the whole catalog; search results,
+	// being for any query, are not worth caching facets for. Prices shown
+	// in USD instead of the shopper's currency are not filtered.
+	var filter priceFilter
+	if !usd {
+		filter = parsePriceFilter(r, currentCurrency(r))
+	}
+	var facets []facetLink
+	if listing.search == "" && !usd {
+		converted := make([]*pb.Money, len(ps))
+		for i := range ps {
+			converted[i] = ps[i].Price
 		}
-		ps[i] = productView{p, price}
+		facets = fe.priceFacetLinks(r.Context(), r, "home", converted, filter)
 	}
+	shown := ps[:0]
+	for _, p := range ps {
+		if filter.match(p.Price) {
+			shown = append(shown, p)
+		}
+	}
+	sortProducts(shown, listing.sort)
+	shown, pages := paginate(r.URL, shown, listing)
 
-	if err := templates.ExecuteTemplate(w, "home", map[string]interface{}{
-		"session_id":    sessionID(r),
-		"request_id":    r.Context().Value(ctxKeyRequestID{}),
+	if !fe.delayRendering(log, r) {
+		return
+	}
+
+	addSurrogateKeys(r.Context(), true, products...)
+	data := fe.injectCommonTemplateData(r, map[string]interface{}{
 		"user_currency": currentCurrency(r),
 		"currencies":    currencies,
-		"products":      ps,
-		"cart_size":     len(cart),
+		"products":      shown,
+		"listing":       pages,
+		"search_query":  listing.search,
+		"price_facets":  facets,
+		"cart_size":     cartSize,
 		"banner_color":  os.Getenv("BANNER_COLOR"), // illustrates canary deployments
-		"ad":            fe.chooseAd(r.Context(), []string{}, log),
-	}); err != nil {
-		log.Error(err)
-	}
+		"resume":        resume,
+	})
+	page := fe.newPageStream(w, r, start)
+	page.section("home_top", data)
+	page.section("home_grid", data)
+	if awaitDecorative(r.Context(), log, "home_ad", adDone, budget) && ads != nil {
+		data["ad"] = fe.pickAd(r.Context(), ads)
+	}
+	page.section("home_ad", data)
+	page.section("home_bottom", data)
 }
 
 func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	id := mux.Vars(r)["id"]
 	if id == "" {
-		renderHTTPError(log, r, w, errors.New("product id not specified"), http.StatusBadRequest)
+		fe.renderHTTPError(log, r, w, errors.New("product id not specified"), http.StatusBadRequest)
 		return
 	}
 	log.WithField("id", id).WithField("currency", currentCurrency(r)).
 		Debug("serving product page")
+	r = r.WithContext(withPageConversions(r.Context()))
 
-	p, err := fe.getProduct(r.Context(), id)
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusInternalServerError)
+	var (
+		ctx             = r.Context()
+		p               *pb.Product
+		currencies      []string
+		cartSize        int
+		countCart       bool // the cart size is to be remembered
+		price           *pb.Money
+		recommendations []*pb.Product
+		ad              *pb.Ad
+	)
+	// The decorative calls are made with the request context, alongside the
+	// essential ones: the failure of an essential call, which cancels the
+	// others, does not cut them short, the client going away does. They
+	// never fail the page, and leave the response alone until they are done.
+	var decorative sync.WaitGroup
+	decorate := func(call string, fn func(ctx context.Context) error) {
+		decorative.Add(1)
+		go func() {
+			defer decorative.Done()
+			pageCall(ctx, log, "product", call, fn)
+		}()
+	}
+	decorate("GetCart", func(ctx context.Context) (err error) {
+		cartSize, countCart, err = fe.countCartItems(ctx, r)
 		return
-	}
-	currencies, err := fe.getCurrencies(r.Context())
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+	})
+	decorate("ListRecommendations", func(ctx context.Context) (err error) {
+		recommendations, err = fe.getRecommendations(ctx, sessionID(r), []string{id})
 		return
-	}
+	})
 
-	cart, err := fe.getCart(r.Context(), sessionID(r))
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		if err := pageCall(gctx, log, "product", "GetProduct", func(ctx context.Context) (err error) {
+			p, err = fe.getProduct(ctx, id)
+			return
+		}); err != nil {
+			return errors.Wrap(err, "could not retrieve product")
+		}
+		decorate("GetAds", func(ctx context.Context) (err error) {
+			ad, err = fe.chooseAd(ctx, p.Categories)
+			return
+		})
+		return errors.Wrap(pageCall(gctx, log, "product", "Convert", func(ctx context.Context) error {
+			res := fe.convertAll(ctx, []*pb.Money{p.GetPriceUsd()}, currentCurrency(r))[0]
+			price = res.Money
+			return res.Err
+		}), "failed to convert currency")
+	})
+	g.Go(func() error {
+		return errors.Wrap(pageCall(gctx, log, "product", "GetSupportedCurrencies", func(ctx context.Context) (err error) {
+			currencies, err = fe.getCurrencies(ctx)
+			return
+		}), "could not retrieve currencies")
+	})
+	if err := g.Wait(); err != nil {
+		fe.renderHTTPError(log, r, w, err, http.StatusInternalServerError)
 		return
 	}
-
-	price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to convert currency"), http.StatusInternalServerError)
-		return
-	}
-
-	recommendations, err := fe.getRecommendations(r.Context(), sessionID(r), []string{id})
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to get product recommendations"), http.StatusInternalServerError)
-		return
+	decorative.Wait()
+	if countCart {
+		fe.setCartCount(w, cartSize)
 	}
 
 	product := struct {
@@ -130,40 +271,59 @@ func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request)
 		Price *pb.Money
 	}{p, price}
 
-	if err := templates.ExecuteTemplate(w, "product", map[string]interface{}{
-		"session_id":      sessionID(r),
-		"request_id":      r.Context().Value(ctxKeyRequestID{}),
-		"ad":              fe.chooseAd(r.Context(), p.Categories, log),
+	if !fe.delayRendering(log, r) {
+		return
+	}
+	rememberViewed(w, r, p.GetId())
+	addSurrogateKeys(ctx, false, append([]*pb.Product{p}, recommendations...)...)
+
+	fe.render(w, r, http.StatusOK, "product", fe.injectCommonTemplateData(r, map[string]interface{}{
+		"ad":              ad,
 		"user_currency":   currentCurrency(r),
 		"currencies":      currencies,
 		"product":         product,
+		"quantities":      quantityChoices(fe.cartMaxQuantity),
 		"recommendations": recommendations,
-		"cart_size":       len(cart),
-	}); err != nil {
-		log.Println(err)
-	}
+		"cart_size":       cartSize,
+	}))
 }
 
 func (fe *frontendServer) addToCartHandler(w http.ResponseWriter, r *http.Request) {
+	if isJSON(r) {
+		fe.addItemsToCartHandler(w, r)
+		return
+	}
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
-	quantity, _ := strconv.ParseUint(r.FormValue("quantity"), 10, 32)
 	productID := r.FormValue("product_id")
-	if productID == "" || quantity == 0 {
-		renderHTTPError(log, r, w, errors.New("invalid form input"), http.StatusBadRequest)
+	if productID == "" {
+		fe.renderHTTPError(log, r, w, errors.New("invalid form input"), http.StatusBadRequest)
 		return
 	}
-	log.WithField("product", productID).WithField("quantity", quantity).Debug("adding to cart")
-
 	p, err := fe.getProduct(r.Context(), productID)
+	if status.Code(errors.Cause(err)) == codes.NotFound {
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "no such product"), http.StatusUnprocessableEntity)
+		return
+	}
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusInternalServerError)
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusInternalServerError)
 		return
 	}
+	if f := validateAddToCart(r.FormValue, fe.cartMaxQuantity); f != nil {
+		log.WithField("quantity", r.FormValue("quantity")).Info("add to cart form rejected")
+		fe.rejectForm(w, r, f, "/product/"+p.GetId())
+		return
+	}
+	quantity, _ := strconv.ParseUint(r.FormValue("quantity"), 10, 32)
+	log.WithField("product", productID).WithField("quantity", quantity).Debug("adding to cart")
 
-	if err := fe.insertCart(r.Context(), sessionID(r), p.GetId(), int32(quantity)); err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to add to cart"), http.StatusInternalServerError)
+	if err := fe.insertCart(r.Context(), cartID(r), p.GetId(), int32(quantity)); err != nil {
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "failed to add to cart"), http.StatusInternalServerError)
 		return
 	}
+	fe.metrics.cartAdd()
+	if n, ok := fe.cartCount(r); ok {
+		fe.setCartCount(w, n+int(quantity))
+	}
 	w.Header().Set("location", "/cart")
 	w.WriteHeader(http.StatusFound)
 }
@@ -172,10 +332,18 @@ func (fe *frontendServer) emptyCartHandler(w http.ResponseWriter, r *http.Reques
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Debug("emptying cart")
 
-	if err := fe.emptyCart(r.Context(), sessionID(r)); err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to empty cart"), http.StatusInternalServerError)
+	// Keep the items so that a cart emptied by mistake can be restored; without
+	// them, emptying goes ahead with no undo.
+	items, err := fe.getCart(r.Context(), cartID(r))
+	if err != nil {
+		log.WithField("error", err).Warn("could not snapshot the cart, emptying it with no undo")
+	}
+	if err := fe.emptyCart(r.Context(), cartID(r)); err != nil {
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "failed to empty cart"), http.StatusInternalServerError)
 		return
 	}
+	fe.undo.save(sessionID(r), items)
+	fe.setCartCount(w, 0)
 	w.Header().Set("location", "/")
 	w.WriteHeader(http.StatusFound)
 }
@@ -183,137 +351,233 @@ func (fe *frontendServer) emptyCartHandler(w http.ResponseWriter, r *http.Reques
 func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Debug("view user cart")
+	r = r.WithContext(withPageConversions(r.Context()))
 	currencies, err := fe.getCurrencies(r.Context())
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
 		return
 	}
-	cart, err := fe.getCart(r.Context(), sessionID(r))
+	cart, err := fe.getCart(r.Context(), cartID(r))
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
 		return
 	}
 
-	recommendations, err := fe.getRecommendations(r.Context(), sessionID(r), cartIDs(cart))
+	ids := cartIDs(cart)
+	if len(ids) > maxRecommendationInputs {
+		ids = ids[:maxRecommendationInputs]
+	}
+	recommendations, err := fe.getRecommendations(r.Context(), sessionID(r), ids)
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to get product recommendations"), http.StatusInternalServerError)
+		degradeOptional(r.Context(), log, "ListRecommendations", err)
+	}
+
+	// The whole cart is priced with one rate snapshot, pinned in the
+	// checkout form so the order is checked against the same prices.
+	// Shipping is estimated to the address last entered, if any; without
+	// an estimate the cart is shown with a warning, and shipping is added
+	// at checkout.
+	rates := fe.rates.snapshot()
+	address := fe.addresses.get(sessionID(r))
+	in, err := fe.cartPricing(r.Context(), cart, address.proto())
+	if err == nil && in.shippingErr != nil {
+		degradeOptional(r.Context(), log, "GetQuote", in.shippingErr)
+	}
+	var quote cartQuote
+	if err == nil {
+		quote, err = fe.priceCart(withRateSnapshot(r.Context(), rates), in, currentCurrency(r))
+	}
+	if totalOverflowed(err) {
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "the cart total is too large"), http.StatusUnprocessableEntity)
 		return
 	}
-
-	shippingCost, err := fe.getShippingQuote(r.Context(), cart, currentCurrency(r))
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to get shipping quote"), http.StatusInternalServerError)
+		fe.renderHTTPError(log, r, w, err, http.StatusInternalServerError)
 		return
 	}
 
-	type cartItemView struct {
-		Item     *pb.Product
-		Quantity int32
-		Price    *pb.Money
-	}
-	items := make([]cartItemView, len(cart))
-	totalPrice := pb.Money{CurrencyCode: currentCurrency(r)}
-	for i, item := range cart {
-		p, err := fe.getProduct(r.Context(), item.GetProductId())
-		if err != nil {
-			renderHTTPError(log, r, w, errors.Wrapf(err, "could not retrieve product #%s", item.GetProductId()), http.StatusInternalServerError)
-			return
-		}
-		price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
-		if err != nil {
-			renderHTTPError(log, r, w, errors.Wrapf(err, "could not convert currency for product #%s", item.GetProductId()), http.StatusInternalServerError)
-			return
-		}
-
-		multPrice := money.MultiplySlow(*price, uint32(item.GetQuantity()))
-		items[i] = cartItemView{
-			Item:     p,
-			Quantity: item.GetQuantity(),
-			Price:    &multPrice}
-		totalPrice = money.Must(money.Sum(totalPrice, multPrice))
+	if !fe.delayRendering(log, r) {
+		return
 	}
-	totalPrice = money.Must(money.Sum(totalPrice, *shippingCost))
-
-	year := time.Now().Year()
-	if err := templates.ExecuteTemplate(w, "cart", map[string]interface{}{
-		"session_id":       sessionID(r),
-		"request_id":       r.Context().Value(ctxKeyRequestID{}),
+	fe.setCartCount(w, cartQuantity(cart))
+	year := fe.clock.Now().Year()
+	fe.render(w, r, http.StatusOK, "cart", fe.injectCommonTemplateData(r, map[string]interface{}{
 		"user_currency":    currentCurrency(r),
 		"currencies":       currencies,
 		"recommendations":  recommendations,
-		"cart_size":        len(cart),
-		"shipping_cost":    shippingCost,
-		"total_cost":       totalPrice,
-		"items":            items,
+		"cart_size":        cartQuantity(cart),
+		"shipping_cost":    quote.Shipping,
+		"shipping_missing": in.shippingErr != nil,
+		"address":          address.orDefault(),
+		"estimated_to":     address,
+		"estimate_empty":   r.URL.Query().Get("estimate") == "empty",
+		"total_cost":       quote.Total,
+		"items":            quote.Items,
+		"more_items":       quote.MoreItems,
+		"cart_lines":       len(cart),
+		"too_large":        fe.checkoutMaxItems > 0 && cartQuantity(cart) > fe.checkoutMaxItems,
+		"max_items":        fe.checkoutMaxItems,
+		"max_quantity":     fe.cartMaxQuantity,
+		"checkout_state":   fe.signCheckoutState(sessionID(r), rates.generation),
+		"repriced":         r.URL.Query().Get("repriced") == "1",
+		"reorder":          fe.reorders.outcome(sessionID(r), r.URL.Query().Get("reordered")),
 		"expiration_years": []int{year, year + 1, year + 2, year + 3, year + 4},
-	}); err != nil {
-		log.Println(err)
-	}
+	}))
 }
 
 func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Debug("placing order")
 
-	var (
-		email         = r.FormValue("email")
-		streetAddress = r.FormValue("street_address")
-		zipCode, _    = strconv.ParseInt(r.FormValue("zip_code"), 10, 32)
-		city          = r.FormValue("city")
-		state         = r.FormValue("state")
-		country       = r.FormValue("country")
-		ccNumber      = r.FormValue("credit_card_number")
-		ccMonth, _    = strconv.ParseInt(r.FormValue("credit_card_expiration_month"), 10, 32)
-		ccYear, _     = strconv.ParseInt(r.FormValue("credit_card_expiration_year"), 10, 32)
-		ccCVV, _      = strconv.ParseInt(r.FormValue("credit_card_cvv"), 10, 32)
-	)
+	// A review confirmed carries no card: it was kept on the server.
+	token := r.FormValue("preview_token")
+	if token != "" && !fe.restorePreviewCard(w, r, log, token) {
+		return
+	}
+	co, ok := fe.prepareCheckout(w, r, log)
+	if !ok {
+		return
+	}
+	if token != "" && !fe.checkPreview(w, r, log, co, token) {
+		return
+	}
+	if co.err != nil {
+		log.WithField("error", co.err).Warn("could not price the cart, the order total will not be verified")
+	}
 
-	order, err := pb.NewCheckoutServiceClient(fe.checkoutSvcConn).
-		PlaceOrder(r.Context(), &pb.PlaceOrderRequest{
-			Email: email,
-			CreditCard: &pb.CreditCardInfo{
-				CreditCardNumber:          ccNumber,
-				CreditCardExpirationMonth: int32(ccMonth),
-				CreditCardExpirationYear:  int32(ccYear),
-				CreditCardCvv:             int32(ccCVV)},
-			UserId:       sessionID(r),
-			UserCurrency: currentCurrency(r),
-			Address: &pb.Address{
-				StreetAddress: streetAddress,
-				City:          city,
-				State:         state,
-				ZipCode:       int32(zipCode),
-				Country:       country},
-		})
+	order, _, err := fe.placeOrder(log, r, co.req, co.displayed)
 	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to complete the order"), http.StatusInternalServerError)
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "failed to complete the order"), http.StatusInternalServerError)
 		return
 	}
-	log.WithField("order", order.GetOrder().GetOrderId()).Info("order placed")
 
-	order.GetOrder().GetItems()
-	recommendations, _ := fe.getRecommendations(r.Context(), sessionID(r), nil)
+	fe.setCartCount(w, 0) // the checkout service empties the cart
+	// The confirmation is served by orderHandler, so that reloading it does
+	// not post the checkout form again.
+	http.Redirect(w, r, "/order/"+url.PathEscape(order.GetOrderId()), http.StatusSeeOther)
+}
+
+// pendingCheckout is the order of the checkout form, about to be placed or
+// reviewed.
+type pendingCheckout struct {
+	req       *pb.PlaceOrderRequest
+	cart      []*pb.CartItem
+	displayed *cartQuote // the cart as priced for the user; nil on err
+	err       error      // why the cart could not be priced
+}
+
+// prepareCheckout does what comes before placing the order of the checkout
+// form: it checks the form and prices the cart. It returns false once it
+// has responded, the order not to be placed.
+func (fe *frontendServer) prepareCheckout(w http.ResponseWriter, r *http.Request, log logrus.FieldLogger) (pendingCheckout, bool) {
+	if fe.requireIdentity(w, r, "/cart") {
+		return pendingCheckout{}, false
+	}
+	if f := validateCheckout(r, fe.clock.Now()); f != nil {
+		log.WithField("errors", len(f.Errors)).Info("checkout form rejected")
+		fe.rejectForm(w, r, f, "/cart")
+		return pendingCheckout{}, false
+	}
+	// The cart is priced again the way the cart page displayed it, with the
+	// rate snapshot pinned in the checkout form, to check the total charged
+	// by the checkout service against it. If that snapshot is gone, the
+	// cart page is shown again with fresh prices rather than charging an
+	// amount the user has not seen.
+	ctx := r.Context()
+	if state := r.FormValue("checkout_state"); state != "" {
+		generation, err := fe.verifyCheckoutState(sessionID(r), state)
+		rates, ok := fe.rates.pinned(generation)
+		if err != nil || !ok {
+			log.WithField("error", err).Info("checkout rate snapshot expired, showing the cart again")
+			stats.Record(ctx, checkoutRerenders.M(1))
+			http.Redirect(w, r, "/cart?repriced=1", http.StatusSeeOther)
+			return pendingCheckout{}, false
+		}
+		ctx = withRateSnapshot(ctx, rates)
+	}
+	co := pendingCheckout{req: checkoutRequest(r.FormValue, cartID(r), currentCurrency(r))}
+	co.cart, co.err = fe.getCart(ctx, cartID(r))
+	if n := cartQuantity(co.cart); fe.checkoutMaxItems > 0 && n > fe.checkoutMaxItems {
+		log.WithField("items", n).Warn("refusing to check out a cart over the size limit")
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return pendingCheckout{}, false
+	}
+	if co.err == nil {
+		var q cartQuote
+		if q, co.err = fe.quoteCart(ctx, co.cart, co.req.GetAddress(), currentCurrency(r)); co.err == nil {
+			co.displayed = &q
+		}
+	}
+	if totalOverflowed(co.err) {
+		fe.renderHTTPError(log, r, w, errors.Wrap(co.err, "the cart total is too large to check out"), http.StatusUnprocessableEntity)
+		return pendingCheckout{}, false
+	}
+	return co, true
+}
+
+// checkoutRequest is the order of the cart of userID, from the fields of
+// the checkout form as returned by value.
+func checkoutRequest(value func(field string) string, userID, currency string) *pb.PlaceOrderRequest {
+	zipCode, _ := strconv.ParseInt(value("zip_code"), 10, 32)
+	ccMonth, _ := strconv.ParseInt(value("credit_card_expiration_month"), 10, 32)
+	ccYear, _ := strconv.ParseInt(value("credit_card_expiration_year"), 10, 32)
+	ccCVV, _ := strconv.ParseInt(value("credit_card_cvv"), 10, 32)
+	return &pb.PlaceOrderRequest{
+		Email: value("email"),
+		CreditCard: &pb.CreditCardInfo{
+			CreditCardNumber:          value("credit_card_number"),
+			CreditCardExpirationMonth: int32(ccMonth),
+			CreditCardExpirationYear:  int32(ccYear),
+			CreditCardCvv:             int32(ccCVV)},
+		UserId:       userID,
+		UserCurrency: currency,
+		Address: &pb.Address{
+			StreetAddress: value("street_address"),
+			City:          value("city"),
+			State:         value("state"),
+			ZipCode:       int32(zipCode),
+			Country:       value("country")},
+	}
+}
 
-	totalPaid := *order.GetOrder().GetShippingCost()
-	for _, v := range order.GetOrder().GetItems() {
-		totalPaid = money.Must(money.Sum(totalPaid, *v.GetCost()))
+// placeOrder places the order with the checkout service and records it, in
+// the order history and for the session's confirmation page.
+// The total charged is checked against displayed, the cart as priced for
+// the user, if known; the discrepancy found, if any, is returned.
+func (fe *frontendServer) placeOrder(log logrus.FieldLogger, r *http.Request, req *pb.PlaceOrderRequest, displayed *cartQuote) (*pb.OrderResult, *totalDiscrepancy, error) {
+	ctx, cancel := fe.withRPCTimeout(r.Context(), "checkout")
+	defer cancel()
+	resp, err := pb.NewCheckoutServiceClient(fe.checkoutSvcConn).PlaceOrder(ctx, req)
+	fe.metrics.checkout(err)
+	if err != nil {
+		return nil, nil, err
 	}
+	order := resp.GetOrder()
+	log.WithField("order", order.GetOrderId()).Info("order placed")
+	fe.orders.add(newOrderRecord(r, fe.clock.Now(), order, displayed))
+	fe.stats.order(orderTotal(order))
 
-	if err := templates.ExecuteTemplate(w, "order", map[string]interface{}{
-		"session_id":      sessionID(r),
-		"request_id":      r.Context().Value(ctxKeyRequestID{}),
-		"user_currency":   currentCurrency(r),
-		"order":           order.GetOrder(),
-		"total_paid":      &totalPaid,
-		"recommendations": recommendations,
-	}); err != nil {
-		log.Println(err)
+	var discrepancy *totalDiscrepancy
+	if displayed != nil {
+		if discrepancy = compareTotals(*displayed, order, fe.totalTolerance); discrepancy != nil {
+			reportDiscrepancy(r.Context(), log, discrepancy)
+		}
 	}
+	totalPaid := orderTotal(order)
+	fe.confirmed.add(sessionID(r), &confirmation{
+		Order:       order,
+		TotalPaid:   &totalPaid,
+		Discrepancy: discrepancy,
+		Quote:       displayed,
+		Placed:      fe.clock.Now(),
+	})
+	return order, discrepancy, nil
 }
 
 func (fe *frontendServer) logoutHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Debug("logging out")
+	fe.sessions.revoke(sessionID(r))
 	for _, c := range r.Cookies() {
 		c.Expires = time.Now().Add(-time.Hour * 24 * 365)
 		c.MaxAge = -1
@@ -329,43 +593,102 @@ func (fe *frontendServer) setCurrencyHandler(w http.ResponseWriter, r *http.Requ
 	log.WithField("curr.new", cur).WithField("curr.old", currentCurrency(r)).
 		Debug("setting currency")
 
-	if cur != "" {
-		http.SetCookie(w, &http.Cookie{
-			Name:   cookieCurrency,
-			Value:  cur,
-			MaxAge: cookieMaxAge,
-		})
-	}
 	referer := r.Header.Get("referer")
 	if referer == "" {
 		referer = "/"
 	}
+	if !fe.currencies.allowed(cur) {
+		f := newFormState(formCurrency)
+		f.add("currency_code", "Choose one of the currencies listed")
+		fe.rejectForm(w, r, f, referer)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   cookieCurrency,
+		Value:  cur,
+		Path:   "/",
+		MaxAge: cookieMaxAge,
+	})
 	w.Header().Set("Location", referer)
 	w.WriteHeader(http.StatusFound)
 }
 
-// chooseAd queries for advertisements available and randomly chooses one, if
-// available. It ignores the error retrieving the ad since it is not critical.
-func (fe *frontendServer) chooseAd(ctx context.Context, ctxKeys []string, log logrus.FieldLogger) *pb.Ad {
+// chooseAd queries for advertisements available and randomly chooses one.
+func (fe *frontendServer) chooseAd(ctx context.Context, ctxKeys []string) (*pb.Ad, error) {
 	ads, err := fe.getAd(ctx, ctxKeys)
 	if err != nil {
-		log.WithField("error", err).Warn("failed to retrieve ads")
-		return nil
+		return nil, err
+	}
+	return fe.pickAd(ctx, ads), nil
+}
+
+// pickAd randomly chooses one of the ads not linking to a product gone from
+// the catalog, or the house ad when there is none.
+func (fe *frontendServer) pickAd(ctx context.Context, ads []*pb.Ad) *pb.Ad {
+	if ads = fe.liveAds(ctx, ads); len(ads) == 0 {
+		return fe.houseAd
 	}
 	return ads[rand.Intn(len(ads))]
 }
 
-func renderHTTPError(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, err error, code int) {
+func (fe *frontendServer) renderHTTPError(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, err error, code int) {
 	log.WithField("error", err).Error("request error")
-	errMsg := fmt.Sprintf("%+v", err)
+	// A backend that cannot be reached is most likely coming up or
+	// restarting: the page says so rather than showing what failed.
+	unavailable := code == http.StatusInternalServerError && backendUnavailable(err)
+	if unavailable {
+		code = http.StatusServiceUnavailable
+	}
+	// One that did not answer within the call timeout is reported the same
+	// way, as a gateway timeout.
+	if code == http.StatusInternalServerError && rpcTimedOut(err) {
+		code, unavailable = http.StatusGatewayTimeout, true
+	}
 
-	w.WriteHeader(code)
-	templates.ExecuteTemplate(w, "error", map[string]interface{}{
-		"session_id":  sessionID(r),
-		"request_id":  r.Context().Value(ctxKeyRequestID{}),
-		"error":       errMsg,
+	data := map[string]interface{}{
 		"status_code": code,
-		"status":      http.StatusText(code)})
+		"status":      http.StatusText(code),
+		"unavailable": unavailable,
+	}
+	// Trace details are for demo presenters and admins only, as are the
+	// details of an unavailable backend.
+	if fe.demoMode || fe.isAdmin(r) {
+		data["trace_id"] = traceIDFromContext(r.Context())
+		data["trace_url"] = fe.traceURL(r.Context())
+	}
+	if !unavailable || fe.demoMode || fe.isAdmin(r) {
+		data["error"] = fmt.Sprintf("%+v", err)
+	}
+	fe.render(w, r, code, "error", fe.injectCommonTemplateData(r, data))
+}
+
+// injectCommonTemplateData adds the values every page template expects
+// (session, request ID, degradation banner) to the page-specific payload.
+func (fe *frontendServer) injectCommonTemplateData(r *http.Request, payload map[string]interface{}) map[string]interface{} {
+	data := map[string]interface{}{
+		"session_hash":  hashSessionID(sessionID(r)),
+		"csrf_token":    fe.csrfToken(sessionID(r)),
+		"request_id":    r.Context().Value(ctxKeyRequestID{}),
+		"degradation":   fe.bannerStatus(),
+		"usd_fallback":  currentCurrency(r) != defaultCurrency && pageConversionsFrom(r.Context()).usdFallback(),
+		"demo_mode":     fe.demoMode,
+		"fragments":     fe.fragmentsFor(r.Context()),
+		"cart_undo":     fe.undo.pending(sessionID(r)),
+		"forms":         fe.forms.take(sessionID(r)),
+		"accounts":      fe.accounts != nil,
+		"account":       accountFrom(r),
+		"oidc":          fe.oidc != nil,
+		"identity":      fe.identity(r),
+		"platform":      fe.platform.get(),
+		"locale":        requestLocale(r),
+		"chosen_locale": chosenLocale(r).tag(),
+		"locales":       locales,
+	}
+	for k, v := range payload {
+		data[k] = v
+	}
+	markPersonalized(r, data)
+	return data
 }
 
 func currentCurrency(r *http.Request) string {
@@ -384,6 +707,10 @@ func sessionID(r *http.Request) string {
 	return ""
 }
 
+// maxRecommendationInputs is how many cart products recommendations are
+// based on.
+const maxRecommendationInputs = 20
+
 func cartIDs(c []*pb.CartItem) []string {
 	out := make([]string, len(c))
 	for i, v := range c {
@@ -392,6 +719,21 @@ func cartIDs(c []*pb.CartItem) []string {
 	return out
 }
 
-func renderMoney(money pb.Money) string {
-	return fmt.Sprintf("%s %d.%02d", money.GetCurrencyCode(), money.GetUnits(), money.GetNanos()/10000000)
+// renderMoney formats a value for display. This is the display boundary:
+// the value is rounded here, once, using the configured rounding mode.
+func renderMoney(m pb.Money) string {
+	m = money.Round(m, moneyRounding)
+	units, nanos, sign := m.GetUnits(), m.GetNanos(), ""
+	if units < 0 || nanos < 0 {
+		units, nanos, sign = -units, -nanos, "-"
+	}
+	digits := money.MinorUnitDigits(m.GetCurrencyCode())
+	if digits == 0 {
+		return fmt.Sprintf("%s %s%d", m.GetCurrencyCode(), sign, units)
+	}
+	minor := nanos
+	for i := digits; i < 9; i++ {
+		minor /= 10
+	}
+	return fmt.Sprintf("%s %s%d.%0*d", m.GetCurrencyCode(), sign, units, digits, minor)
 }
@@ -0,0 +1,40 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestRenderMoney(t *testing.T) {
+	tests := []struct {
+		in   pb.Money
+		want string
+	}{
+		{pb.Money{CurrencyCode: "USD", Units: 12, Nanos: 490000000}, "USD 12.49"},
+		{pb.Money{CurrencyCode: "USD", Units: 12, Nanos: 495000000}, "USD 12.50"},
+		{pb.Money{CurrencyCode: "USD", Units: 0, Nanos: 50000000}, "USD 0.05"},
+		{pb.Money{CurrencyCode: "EUR", Units: -3, Nanos: -10000000}, "EUR -3.01"},
+		{pb.Money{CurrencyCode: "JPY", Units: 1373, Nanos: 500000000}, "JPY 1374"},
+		{pb.Money{CurrencyCode: "KWD", Units: 1, Nanos: 5000000}, "KWD 1.005"},
+	}
+	for _, tt := range tests {
+		if got := renderMoney(tt.in); got != tt.want {
+			t.Errorf("renderMoney(%v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden page snapshots in testdata/")
+
+// testRenderer has the templates of the tests, parsed once.
+var testRenderer *renderer
+
+func TestMain(m *testing.M) {
+	rd, err := newRenderer(templateDir, false)
+	if err != nil {
+		panic(err)
+	}
+	testRenderer = rd
+	os.Exit(m.Run())
+}
+
+// testHarness runs the real frontend router against in-process fake
+// backends served over bufconn.
+type testHarness struct {
+	t      testing.TB
+	fe     *frontendServer
+	srv    *httptest.Server
+	client *http.Client
+	faults *faultInjector
+	logs   *logCapture
+
+	catalog  *fakeCatalog
+	cart     *fakeCart
+	checkout *fakeCheckout
+	rates    *fakeRateTable
+	recs     *fakeRecommendations
+	ads      *fakeAds
+	shipping *fakeShipping
+
+	grpcSrv *grpc.Server
+	conn    *grpc.ClientConn
+}
+
+// logCapture is a logrus hook keeping every log entry of the frontend.
+type logCapture struct {
+	mu      sync.Mutex
+	entries []*logrus.Entry
+}
+
+func (c *logCapture) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (c *logCapture) Fire(e *logrus.Entry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = append(c.entries, e)
+	return nil
+}
+
+// find returns the entries having the given value for the "event" field.
+func (c *logCapture) find(event string) []*logrus.Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []*logrus.Entry
+	for _, e := range c.entries {
+		if e.Data["event"] == event {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// response is a fully read HTTP response along with the redirect chain
+// that led to it.
+type response struct {
+	*http.Response
+	body      string
+	redirects []string
+}
+
+// newTestHarness starts the frontend against fresh fakes. The options are
+// applied to the frontendServer before its handler is built.
+func newTestHarness(t testing.TB, opts ...func(*frontendServer)) *testHarness {
+	t.Helper()
+	h := &testHarness{t: t, faults: newFaultInjector(), logs: &logCapture{}}
+	h.catalog = &fakeCatalog{products: fakeProducts}
+	h.cart = &fakeCart{carts: make(map[string][]*pb.CartItem)}
+	h.rates = newFakeRateTable()
+	h.checkout = &fakeCheckout{catalog: h.catalog, cart: h.cart, rates: h.rates}
+	h.recs = &fakeRecommendations{catalog: h.catalog}
+	h.ads = &fakeAds{}
+	h.shipping = &fakeShipping{}
+
+	lis := bufconn.Listen(1 << 20)
+	h.grpcSrv = grpc.NewServer(grpc.UnaryInterceptor(h.faults.intercept))
+	pb.RegisterProductCatalogServiceServer(h.grpcSrv, h.catalog)
+	pb.RegisterCurrencyServiceServer(h.grpcSrv, fakeCurrency{h.rates})
+	pb.RegisterCartServiceServer(h.grpcSrv, h.cart)
+	pb.RegisterRecommendationServiceServer(h.grpcSrv, h.recs)
+	pb.RegisterShippingServiceServer(h.grpcSrv, h.shipping)
+	pb.RegisterCheckoutServiceServer(h.grpcSrv, h.checkout)
+	pb.RegisterAdServiceServer(h.grpcSrv, h.ads)
+	go h.grpcSrv.Serve(lis)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithChainUnaryInterceptor(
+			requestIDInterceptor,
+			func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+				return h.fe.metrics.intercept(ctx, method, req, reply, cc, invoker, opts...)
+			},
+			func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+				return h.fe.hedges.intercept(ctx, method, req, reply, cc, invoker, opts...)
+			},
+			func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+				return h.fe.retries.intercept(ctx, method, req, reply, cc, invoker, opts...)
+			},
+			func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+				return h.fe.outbound.intercept(ctx, method, req, reply, cc, invoker, opts...)
+			}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.conn = conn
+
+	h.fe = &frontendServer{
+		productCatalogSvcConn: conn,
+		currencySvcConn:       conn,
+		cartSvcConn:           conn,
+		recommendationSvcConn: conn,
+		checkoutSvcConn:       conn,
+		shippingSvcConn:       conn,
+		adSvcConn:             conn,
+		degradation:           newDegradationRegistry(),
+		activity:              newSessionActivity(),
+		orders:                newOrderHistory(),
+		confirmed:             newConfirmations(defaultConfirmationTTL),
+		clock:                 newOffsetClock(realClock{}),
+		httpClient:            newOutboundClient(defaultOutboundTimeout),
+		renderer:              testRenderer,
+		fragments:             newFragmentCache(),
+		stats:                 newRollingStats(),
+		undo:                  newCartUndo(defaultCartUndoWindow),
+		reorders:              newReorders(),
+		forms:                 newFormStates(),
+		previews:              newPreviewCards(),
+		addresses:             newAddressBook(),
+		ready:                 newReadinessGate(),
+		watcher:               newBackendWatcher(defaultBackendReconnectAfter),
+		rates:                 newRateCache(defaultRateRefresh, defaultRatePinWindow),
+		checkoutKey:           []byte("test checkout key"),
+		csrfKey:               []byte("test csrf key"),
+		cartMaxRows:           defaultCartMaxRows,
+		checkoutMaxItems:      defaultCheckoutMaxItems,
+		cartMaxQuantity:       defaultCartMaxQuantity,
+		logSampleRate:         1,
+	}
+
+	for _, opt := range opts {
+		opt(h.fe)
+	}
+	h.fe.rates.now = h.fe.clock.Now
+	h.fe.undo.snapshots.Now = h.fe.clock.Now
+	h.fe.reorders.outcomes.Now = h.fe.clock.Now
+	h.fe.confirmed.now = h.fe.clock.Now
+	h.fe.forms.states.Now = h.fe.clock.Now
+	h.fe.previews.cards.Now = h.fe.clock.Now
+	h.fe.stats.now = h.fe.clock.Now
+	h.fe.watcher.now = h.fe.clock.Now
+	h.fe.fragments.stats = h.fe.stats
+	if h.fe.accounts != nil {
+		h.fe.accounts.failures.Now = h.fe.clock.Now
+		h.fe.accounts.logins.now = h.fe.clock.Now
+		h.fe.accounts.logins.buckets.Now = h.fe.clock.Now
+	}
+	if h.fe.limiter != nil {
+		h.fe.limiter.now = h.fe.clock.Now
+		h.fe.limiter.buckets.Now = h.fe.clock.Now
+	}
+	if h.fe.oidc != nil {
+		h.fe.oidc.now = h.fe.clock.Now
+		h.fe.oidc.pending.Now = h.fe.clock.Now
+	}
+	h.fe.initClients()
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.AddHook(h.logs)
+	router, err := h.fe.router()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.srv = httptest.NewServer(h.fe.handler(log, router))
+
+	jar, _ := cookiejar.New(nil)
+	h.client = &http.Client{Jar: jar, Timeout: 10 * time.Second}
+	return h
+}
+
+func (h *testHarness) close() {
+	h.fe.loadgen.stop()
+	h.srv.Close()
+	h.fe.watcher.stop()
+	h.conn.Close()
+	h.grpcSrv.Stop()
+}
+
+// fail makes every call to the given full gRPC method name (e.g.
+// "/hipstershop.AdService/GetAds") return err. A nil err clears the fault.
+func (h *testHarness) fail(method string, err error) {
+	h.faults.mu.Lock()
+	defer h.faults.mu.Unlock()
+	delete(h.faults.remaining, method)
+	if err == nil {
+		delete(h.faults.errs, method)
+		return
+	}
+	h.faults.errs[method] = err
+}
+
+// failTimes makes the next n calls to the given full gRPC method name
+// return err, and the later ones succeed.
+func (h *testHarness) failTimes(method string, err error, n int) {
+	h.faults.mu.Lock()
+	defer h.faults.mu.Unlock()
+	h.faults.errs[method] = err
+	h.faults.remaining[method] = n
+}
+
+// delay makes every call to the given full gRPC method name take at least d.
+func (h *testHarness) delay(method string, d time.Duration) {
+	h.faults.mu.Lock()
+	defer h.faults.mu.Unlock()
+	delete(h.faults.delaysLeft, method)
+	h.faults.delays[method] = d
+}
+
+// delayTimes makes the next n calls to the given full gRPC method name take
+// at least d.
+func (h *testHarness) delayTimes(method string, d time.Duration, n int) {
+	h.faults.mu.Lock()
+	defer h.faults.mu.Unlock()
+	h.faults.delays[method] = d
+	h.faults.delaysLeft[method] = n
+}
+
+func (h *testHarness) do(req *http.Request) *response {
+	h.t.Helper()
+	resp := &response{}
+	h.client.CheckRedirect = func(r *http.Request, _ []*http.Request) error {
+		resp.redirects = append(resp.redirects, r.URL.Path)
+		return nil
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	resp.Response, resp.body = res, string(b)
+	return resp
+}
+
+func (h *testHarness) get(path string) *response {
+	h.t.Helper()
+	req, err := http.NewRequest(http.MethodGet, h.srv.URL+path, nil)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return h.do(req)
+}
+
+// post sends a form the way the pages do, with the CSRF token of the
+// client's session, starting one if it has none yet.
+func (h *testHarness) post(path string, form url.Values) *response {
+	h.t.Helper()
+	if form.Get(csrfField) == "" {
+		v := url.Values{}
+		for k, vs := range form {
+			v[k] = vs
+		}
+		v.Set(csrfField, h.fe.csrfToken(h.session()))
+		form = v
+	}
+	req, err := http.NewRequest(http.MethodPost, h.srv.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", h.srv.URL+"/")
+	return h.do(req)
+}
+
+// session returns the ID of the client's session, and sets a cookie for a
+// new one if it has none.
+func (h *testHarness) session() string {
+	v := h.cookie(cookieSessionID)
+	if v == "" {
+		id := uuid.New().String()
+		u, _ := url.Parse(h.srv.URL)
+		h.client.Jar.SetCookies(u, []*http.Cookie{h.fe.sessions.cookie(id)})
+		return id
+	}
+	if i := strings.IndexByte(v, '.'); i >= 0 {
+		v = v[:i]
+	}
+	return v
+}
+
+// cookie returns the value of the named cookie held by the client.
+func (h *testHarness) cookie(name string) string {
+	u, _ := url.Parse(h.srv.URL)
+	for _, c := range h.client.Jar.Cookies(u) {
+		if c.Name == name {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+var (
+	uuidPattern = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+	yearPattern = regexp.MustCompile(`\b20[0-9]{2}\b`)
+	// The checkout state is signed with the session ID.
+	checkoutStatePattern = regexp.MustCompile(`name="checkout_state" value="[^"]*"`)
+	sessionHashPattern   = regexp.MustCompile(`session: [0-9a-f]{12}`)
+	// So is the CSRF token.
+	csrfTokenPattern = regexp.MustCompile(`name="csrf_token" value="[^"]*"`)
+)
+
+// normalizePage replaces the parts of a rendered page that change between
+// runs (session hash, request IDs, the current year) with fixed placeholders.
+func normalizePage(s string) string {
+	s = uuidPattern.ReplaceAllString(s, "<uuid>")
+	s = yearPattern.ReplaceAllString(s, "<year>")
+	s = checkoutStatePattern.ReplaceAllString(s, `name="checkout_state" value="<checkout-state>"`)
+	s = sessionHashPattern.ReplaceAllString(s, "session: <hash>")
+	s = csrfTokenPattern.ReplaceAllString(s, `name="csrf_token" value="<csrf-token>"`)
+	return s
+}
+
+// assertGolden compares the normalized page body against
+// testdata/<name>.golden.html. Run the tests with -update to rewrite the
+// snapshots after an intended change to the templates.
+func assertGolden(t *testing.T, name, body string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden.html")
+	got := normalizePage(body)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file (run with -update to create it): %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("page %q does not match %s (run with -update to accept changes):\n%s", name, path, got)
+	}
+}
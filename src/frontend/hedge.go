@@ -0,0 +1,121 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+)
+
+// hedgedMethods are the catalog reads worth a second attempt when the
+// first is slow. Only reads are hedged: both attempts may go through.
+var hedgedMethods = map[string]bool{
+	"/hipstershop.ProductCatalogService/GetProduct":     true,
+	"/hipstershop.ProductCatalogService/ListProducts":   true,
+	"/hipstershop.ProductCatalogService/SearchProducts": true,
+}
+
+// hedgePolicy makes a second attempt of the hedged calls still running
+// after delay, on the same connection, and takes the first answer. A nil
+// policy never hedges.
+type hedgePolicy struct {
+	delay time.Duration
+}
+
+// attempt is the outcome of one attempt of a hedged call.
+type attempt struct {
+	reply  interface{}
+	err    error
+	hedged bool
+}
+
+// intercept is a unary client interceptor applying the policy. Each
+// attempt decodes into a reply of its own, the winner's is merged into
+// reply, and the other attempt is cancelled. There is at most one hedge
+// per call; when an attempt fails, the other is waited for.
+func (p *hedgePolicy) intercept(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	msg, ok := reply.(proto.Message)
+	if p == nil || !hedgedMethods[method] || !ok {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // the loser
+	results := make(chan attempt, 2)
+	start := func(hedged bool) {
+		r := reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+		go func() {
+			err := invoker(ctx, method, req, r, cc, opts...)
+			results <- attempt{reply: r, err: err, hedged: hedged}
+		}()
+	}
+	start(false)
+
+	t := time.NewTimer(p.delay)
+	defer t.Stop()
+	var first attempt
+	select {
+	case first = <-results:
+		return first.finish(msg)
+	case <-t.C:
+		start(true)
+	}
+
+	first = <-results
+	if first.err != nil {
+		if second := <-results; second.err == nil {
+			first = second
+		}
+	}
+	hedgeAnnotate(ctx, method, first.hedged && first.err == nil, first.err)
+	return first.finish(msg)
+}
+
+// finish gives reply the content of the attempt's, if it succeeded.
+func (a attempt) finish(reply proto.Message) error {
+	if a.err != nil {
+		return a.err
+	}
+	reply.Reset()
+	proto.Merge(reply, a.reply.(proto.Message))
+	return nil
+}
+
+// hedgeAnnotate records a hedged call on the span of the request and in its
+// log.
+func hedgeAnnotate(ctx context.Context, method string, hedgeWon bool, err error) {
+	span := trace.FromContext(ctx)
+	span.AddAttributes(trace.BoolAttribute("rpc.hedged", true), trace.BoolAttribute("rpc.hedge_won", hedgeWon))
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute("method", method),
+		trace.BoolAttribute("hedge_won", hedgeWon),
+	}, "hedged call")
+	if log, ok := ctx.Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+		entry := log.WithFields(logrus.Fields{
+			"event":     "rpc_hedged",
+			"method":    method,
+			"hedge_won": hedgeWon,
+		})
+		if err != nil {
+			entry = entry.WithField("error", err)
+		}
+		entry.Info("hedged call")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+const addItemMethod = "/hipstershop.CartService/AddItem"
+
+func withHedging(delay time.Duration) func(*frontendServer) {
+	return func(fe *frontendServer) { fe.hedges = &hedgePolicy{delay: delay} }
+}
+
+// tracedCall runs fn under a sampled span, and returns the span once
+// exported.
+func tracedCall(t *testing.T, fn func(ctx context.Context)) *trace.SpanData {
+	t.Helper()
+	rec := &spanRecorder{kind: trace.SpanKindUnspecified}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+	ctx, span := trace.StartSpan(context.Background(), "test", trace.WithSampler(trace.AlwaysSample()))
+	fn(ctx)
+	span.End()
+	return rec.wait(t, span.SpanContext().TraceID.String())
+}
+
+func TestHedgeWins(t *testing.T) {
+	h := newTestHarness(t, withHedging(20*time.Millisecond))
+	defer h.close()
+	h.delayTimes(getProductMethod, 2*time.Second, 1) // only the first attempt is slow
+
+	start := time.Now()
+	sd := tracedCall(t, func(ctx context.Context) {
+		p, err := h.fe.getProduct(ctx, "OLJCESPC7Z")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.GetName() != "Vintage Typewriter" {
+			t.Errorf("product = %q, want the typewriter", p.GetName())
+		}
+	})
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("hedged call took %v, want the hedge's answer", d)
+	}
+	if n := h.faults.calls(getProductMethod); n != 2 {
+		t.Errorf("made %d GetProduct calls, want 2", n)
+	}
+	if sd.Attributes["rpc.hedged"] != true || sd.Attributes["rpc.hedge_won"] != true {
+		t.Errorf("span attributes = %v, want the hedge winning", sd.Attributes)
+	}
+
+	// The slow attempt was cancelled rather than left running.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		h.faults.mu.Lock()
+		n := h.faults.inFlight[getProductMethod]
+		h.faults.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the losing attempt is still running")
+		}
+	}
+}
+
+func TestHedgeOriginalWins(t *testing.T) {
+	h := newTestHarness(t, withHedging(20*time.Millisecond))
+	defer h.close()
+	// Both attempts take as long, so the one started first answers first.
+	h.delayTimes(listProductsMethod, 100*time.Millisecond, 2)
+
+	sd := tracedCall(t, func(ctx context.Context) {
+		ps, err := h.fe.listProducts(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ps) != len(fakeProducts) {
+			t.Errorf("got %d products, want %d", len(ps), len(fakeProducts))
+		}
+	})
+	if n := h.faults.calls(listProductsMethod); n != 2 {
+		t.Errorf("made %d ListProducts calls, want 2", n)
+	}
+	if sd.Attributes["rpc.hedged"] != true || sd.Attributes["rpc.hedge_won"] != false {
+		t.Errorf("span attributes = %v, want the first attempt winning", sd.Attributes)
+	}
+}
+
+func TestHedgeNotNeeded(t *testing.T) {
+	h := newTestHarness(t, withHedging(200*time.Millisecond))
+	defer h.close()
+
+	sd := tracedCall(t, func(ctx context.Context) {
+		if _, err := h.fe.getProduct(ctx, "OLJCESPC7Z"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if n := h.faults.calls(getProductMethod); n != 1 {
+		t.Errorf("made %d GetProduct calls, want 1", n)
+	}
+	if _, ok := sd.Attributes["rpc.hedged"]; ok {
+		t.Errorf("span attributes = %v, want no hedge", sd.Attributes)
+	}
+}
+
+func TestNoHedgeForMutations(t *testing.T) {
+	h := newTestHarness(t, withHedging(10*time.Millisecond))
+	defer h.close()
+	h.delay(addItemMethod, 100*time.Millisecond)
+	h.delay(placeOrderMethod, 100*time.Millisecond)
+
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	if resp := h.post("/cart/checkout", checkoutForm); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /cart/checkout = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	for _, method := range []string{addItemMethod, placeOrderMethod} {
+		if n := h.faults.calls(method); n != 1 {
+			t.Errorf("made %d calls to %s, want 1", n, method)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var checkoutForm = url.Values{
+	"email":                        {"someone@example.com"},
+	"street_address":               {"1600 Amphitheatre Parkway"},
+	"zip_code":                     {"94043"},
+	"city":                         {"Mountain View"},
+	"state":                        {"CA"},
+	"country":                      {"United States"},
+	"credit_card_number":           {"4432-8015-6152-0454"},
+	"credit_card_expiration_month": {"1"},
+	"credit_card_expiration_year":  {"2039"},
+	"credit_card_cvv":              {"672"},
+}
+
+func TestUserFlows(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	home := h.get("/")
+	if home.StatusCode != http.StatusOK {
+		t.Fatalf("GET / = %d, want %d", home.StatusCode, http.StatusOK)
+	}
+	if h.cookie(cookieSessionID) == "" {
+		t.Fatal("no session cookie set on first visit")
+	}
+	assertGolden(t, "home", home.body)
+
+	product := h.get("/product/OLJCESPC7Z")
+	if product.StatusCode != http.StatusOK {
+		t.Fatalf("GET /product = %d, want %d", product.StatusCode, http.StatusOK)
+	}
+	assertGolden(t, "product", product.body)
+
+	added := h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"2"}})
+	if added.StatusCode != http.StatusOK {
+		t.Fatalf("POST /cart = %d, want %d", added.StatusCode, http.StatusOK)
+	}
+	if want := []string{"/cart"}; !reflect.DeepEqual(added.redirects, want) {
+		t.Errorf("POST /cart redirects = %v, want %v", added.redirects, want)
+	}
+	assertGolden(t, "cart", added.body)
+
+	changed := h.post("/setCurrency", url.Values{"currency_code": {"EUR"}})
+	if want := []string{"/"}; !reflect.DeepEqual(changed.redirects, want) {
+		t.Errorf("POST /setCurrency redirects = %v, want %v", changed.redirects, want)
+	}
+	if got := h.cookie(cookieCurrency); got != "EUR" {
+		t.Errorf("currency cookie = %q, want %q", got, "EUR")
+	}
+	assertGolden(t, "home_eur", changed.body)
+
+	order := h.post("/cart/checkout", checkoutForm)
+	if order.StatusCode != http.StatusOK {
+		t.Fatalf("POST /cart/checkout = %d, want %d", order.StatusCode, http.StatusOK)
+	}
+	assertGolden(t, "order", order.body)
+
+	empty := h.get("/cart")
+	if !strings.Contains(empty.body, "Your shopping cart is empty!") {
+		t.Error("cart not emptied after checkout")
+	}
+}
+
+func TestBackendFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{"catalog down on home", "/hipstershop.ProductCatalogService/ListProducts", "/", http.StatusServiceUnavailable},
+		{"currency down on product", "/hipstershop.CurrencyService/Convert", "/product/OLJCESPC7Z", http.StatusOK}, // shown in USD
+		{"ads down on home", "/hipstershop.AdService/GetAds", "/", http.StatusOK},
+		{"recommendations down on product", "/hipstershop.RecommendationService/ListRecommendations", "/product/OLJCESPC7Z", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHarness(t)
+			defer h.close()
+			h.fail(tc.method, status.Error(codes.Unavailable, "injected failure"))
+
+			resp := h.get(tc.path)
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("GET %s = %d, want %d", tc.path, resp.StatusCode, tc.wantStatus)
+			}
+			if h.faults.calls(tc.method) == 0 {
+				t.Errorf("%s was never called", tc.method)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// fillCart puts n lines of one item each in the cart of the harness
+// session, cycling through the catalog.
+func fillCart(h *testHarness, n int) {
+	h.get("/")
+	id := h.cookie(cookieSessionID)
+	items := make([]*pb.CartItem, n)
+	for i := range items {
+		items[i] = &pb.CartItem{ProductId: fakeProducts[i%len(fakeProducts)].GetId(), Quantity: 1}
+	}
+	h.cart.mu.Lock()
+	h.cart.carts[id] = items
+	h.cart.mu.Unlock()
+}
+
+func TestLargeCartPage(t *testing.T) {
+	const lines = 10000
+	h := newTestHarness(t)
+	defer h.close()
+	fillCart(h, lines)
+
+	const getProduct = "/hipstershop.ProductCatalogService/GetProduct"
+	products := h.faults.calls(getProduct)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	resp := h.get("/cart")
+	runtime.ReadMemStats(&after)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /cart = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// The allocations include the fake cart service and both ends of the
+	// gRPC call, which grow with the cart; the rendering must not.
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 16<<20 {
+		t.Errorf("rendering a %d line cart allocated %d MiB", lines, alloc>>20)
+	}
+	if got := strings.Count(resp.body, "SKU: #"); got != defaultCartMaxRows {
+		t.Errorf("rendered %d cart rows, want %d", got, defaultCartMaxRows)
+	}
+	if want := fmt.Sprintf("and %d more items", lines-defaultCartMaxRows); !strings.Contains(resp.body, want) {
+		t.Errorf("cart page does not say %q", want)
+	}
+	if got := h.faults.calls(getProduct) - products; got > len(fakeProducts) {
+		t.Errorf("fetched products %d times for %d distinct products", got, len(fakeProducts))
+	}
+	// 3334 typewriters, 3333 lenses and 3333 kits, plus shipping.
+	if want := "USD 681608.82"; !strings.Contains(resp.body, "Total Cost: <strong>"+want) {
+		t.Errorf("total of the whole cart %s not shown", want)
+	}
+}
+
+func TestLargeCartCheckout(t *testing.T) {
+	const placeOrder = "/hipstershop.CheckoutService/PlaceOrder"
+	h := newTestHarness(t)
+	defer h.close()
+	fillCart(h, defaultCheckoutMaxItems+1)
+
+	cart := h.get("/cart")
+	if !strings.Contains(cart.body, `id="cart_too_large"`) {
+		t.Error("cart page does not say the cart is too large to check out")
+	}
+	if strings.Contains(cart.body, `action="/cart/checkout"`) {
+		t.Error("cart page offers to check out a cart over the limit")
+	}
+
+	resp := h.post("/cart/checkout", checkoutForm)
+	if got := h.faults.calls(placeOrder); got != 0 {
+		t.Errorf("placed %d orders for a cart over the limit", got)
+	}
+	if !strings.Contains(resp.body, `action="/cart/empty"`) || !strings.Contains(resp.body, `id="cart_too_large"`) {
+		t.Error("refused checkout does not offer to empty the cart")
+	}
+
+	h.post("/cart/empty", nil)
+	fillCart(h, defaultCheckoutMaxItems)
+	if resp := h.post("/cart/checkout", checkoutForm); resp.StatusCode != http.StatusOK || h.faults.calls(placeOrder) != 1 {
+		t.Errorf("cart at the limit not checked out: status %d", resp.StatusCode)
+	}
+}
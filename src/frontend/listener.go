@@ -0,0 +1,178 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Default limits of the HTTP server, so that a client sending its request
+// slowly, or keeping an idle connection open, cannot hold a connection
+// forever. The write timeout leaves room for the streamed pages and the
+// debug delays.
+const (
+	defaultReadTimeout       = 30 * time.Second
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultWriteTimeout      = 60 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	defaultMaxHeaderBytes    = 1 << 20
+
+	defaultHTTPSRedirectPort = "8081"
+)
+
+// serverConfig is how the frontend listens: the limits of its HTTP server,
+// and whether it speaks HTTP/2 in cleartext or serves TLS itself.
+type serverConfig struct {
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+
+	h2c bool // HTTP/2 without TLS, for an L4 load balancer speaking it
+
+	// With a certificate and its key, the frontend serves HTTPS, and
+	// redirects plain HTTP on redirectPort to it.
+	tlsCert, tlsKey string
+	redirectPort    string
+}
+
+func defaultServerConfig() serverConfig {
+	return serverConfig{
+		readTimeout:       defaultReadTimeout,
+		readHeaderTimeout: defaultReadHeaderTimeout,
+		writeTimeout:      defaultWriteTimeout,
+		idleTimeout:       defaultIdleTimeout,
+		maxHeaderBytes:    defaultMaxHeaderBytes,
+		redirectPort:      defaultHTTPSRedirectPort,
+	}
+}
+
+// serverConfigFromEnv is the default configuration with the overrides of
+// the environment.
+func serverConfigFromEnv(log logrus.FieldLogger) serverConfig {
+	c := defaultServerConfig()
+	mapDurationEnv(log, &c.readTimeout, "HTTP_READ_TIMEOUT")
+	mapDurationEnv(log, &c.readHeaderTimeout, "HTTP_READ_HEADER_TIMEOUT")
+	mapDurationEnv(log, &c.writeTimeout, "HTTP_WRITE_TIMEOUT")
+	mapDurationEnv(log, &c.idleTimeout, "HTTP_IDLE_TIMEOUT")
+	mapIntEnv(log, &c.maxHeaderBytes, "HTTP_MAX_HEADER_BYTES")
+	c.h2c = os.Getenv("ENABLE_H2C") == "true"
+	c.tlsCert, c.tlsKey = os.Getenv("FRONTEND_TLS_CERT"), os.Getenv("FRONTEND_TLS_KEY")
+	if (c.tlsCert == "") != (c.tlsKey == "") {
+		log.Warn("FRONTEND_TLS_CERT and FRONTEND_TLS_KEY go together, serving plain HTTP")
+		c.tlsCert, c.tlsKey = "", ""
+	}
+	if v, ok := os.LookupEnv("HTTPS_REDIRECT_PORT"); ok {
+		c.redirectPort = v
+	}
+	if c.h2c && c.tls() {
+		log.Warn("ENABLE_H2C is ignored when serving TLS, which negotiates HTTP/2")
+		c.h2c = false
+	}
+	return c
+}
+
+func (c serverConfig) tls() bool { return c.tlsCert != "" }
+
+// server returns the HTTP server of handler. With h2c, connections starting
+// with the HTTP/2 preface, or asking to upgrade to it, are served by an
+// HTTP/2 server; the others go to handler as usual.
+func (c serverConfig) server(handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       c.readTimeout,
+		ReadHeaderTimeout: c.readHeaderTimeout,
+		WriteTimeout:      c.writeTimeout,
+		IdleTimeout:       c.idleTimeout,
+		MaxHeaderBytes:    c.maxHeaderBytes,
+	}
+	if c.h2c {
+		h2s := &http2.Server{IdleTimeout: c.idleTimeout}
+		// Registers the HTTP/2 connections for srv.Shutdown to send them
+		// a GOAWAY.
+		http2.ConfigureServer(srv, h2s)
+		srv.Handler = h2c.NewHandler(handler, h2s)
+	}
+	return srv
+}
+
+// listen returns the listener of the frontend on addr, terminating TLS if
+// configured.
+func (c serverConfig) listen(addr string) (net.Listener, error) {
+	var cfg *tls.Config
+	if c.tls() {
+		cert, err := tls.LoadX509KeyPair(c.tlsCert, c.tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil || cfg == nil {
+		return lis, err
+	}
+	return tls.NewListener(lis, cfg), nil
+}
+
+// redirectServer returns the server redirecting plain HTTP requests to
+// HTTPS on httpsPort.
+func (c serverConfig) redirectServer(httpsPort string) *http.Server {
+	return &http.Server{
+		Handler:           httpsRedirect(httpsPort),
+		ReadTimeout:       c.readTimeout,
+		ReadHeaderTimeout: c.readHeaderTimeout,
+		WriteTimeout:      c.writeTimeout,
+		IdleTimeout:       c.idleTimeout,
+		MaxHeaderBytes:    c.maxHeaderBytes,
+	}
+}
+
+// httpsRedirect permanently redirects requests to the same URL over HTTPS
+// on port, keeping their method.
+func httpsRedirect(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		u := *r.URL
+		u.Scheme, u.Host = "https", host
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// protocol describes what the listener speaks, for the logs.
+func (c serverConfig) protocol() string {
+	switch {
+	case c.tls():
+		return "https (h2, http/1.1)"
+	case c.h2c:
+		return "http (h2c, http/1.1)"
+	default:
+		return "http (http/1.1)"
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// h2cClient speaks HTTP/2 in cleartext, with prior knowledge.
+var h2cClient = &http.Client{
+	Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	},
+	Timeout: 5 * time.Second,
+}
+
+// serveH2C serves the harness frontend with h2c, as main would, until the
+// returned signal channel gets a signal.
+func serveH2C(t *testing.T, h *testHarness) (base string, sigs chan os.Signal, served chan error) {
+	t.Helper()
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.AddHook(h.logs)
+	router, err := h.fe.router()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := defaultServerConfig()
+	c.h2c = true
+	srv := c.server(h.fe.handler(log, router))
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigs = make(chan os.Signal, 1)
+	served = make(chan error, 1)
+	go func() { served <- h.fe.serve(log, srv, lis, sigs, 5*time.Second, func() {}) }()
+	return "http://" + lis.Addr().String(), sigs, served
+}
+
+func TestH2C(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	base, sigs, served := serveH2C(t, h)
+	defer func() { sigs <- syscall.SIGTERM; <-served }()
+
+	resp, err := h2cClient.Get(base + "/product/OLJCESPC7Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("GET over h2c = %d %s, want 200 over HTTP/2", resp.StatusCode, resp.Proto)
+	}
+	if !strings.Contains(string(body), "Vintage Typewriter") {
+		t.Error("product page over h2c does not show the product")
+	}
+	// The middleware chain ran: the session cookie was set and the request
+	// logged.
+	if len(resp.Cookies()) == 0 {
+		t.Error("no cookies set over h2c")
+	}
+	var logged bool
+	for _, e := range h.logs.find("request") {
+		logged = logged || e.Data["path"] == "/product/OLJCESPC7Z"
+	}
+	if !logged {
+		t.Error("request over h2c not logged")
+	}
+
+	// HTTP/1.1 clients are still served.
+	resp, err = http.Get(base + "/_healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 1 {
+		t.Errorf("GET over HTTP/1.1 = %d %s, want 200 over HTTP/1.1", resp.StatusCode, resp.Proto)
+	}
+}
+
+func TestH2CGracefulShutdown(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) { fe.extraLatency = 300 * time.Millisecond })
+	defer h.close()
+	base, sigs, served := serveH2C(t, h)
+
+	slow := make(chan int, 1)
+	go func() {
+		resp, err := h2cClient.Get(base + "/")
+		if err != nil {
+			t.Error(err)
+			slow <- 0
+			return
+		}
+		resp.Body.Close()
+		slow <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond) // the slow request is in flight
+	sigs <- syscall.SIGTERM
+
+	select {
+	case <-served:
+		t.Fatal("serve returned with an h2c request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if code := <-slow; code != http.StatusOK {
+		t.Errorf("h2c request in flight at the signal = %d, want 200", code)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve = %v, want nil after a signal", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("serve did not return after the h2c request finished")
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	c := defaultServerConfig()
+	c.readHeaderTimeout = 100 * time.Millisecond
+	srv := c.server(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(lis)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A client that never finishes its headers.
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("connection still open after the header timeout: %v", err)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	for _, tc := range []struct {
+		port, target, want string
+	}{
+		{"8443", "http://shop.example.com:8081/cart?currency=EUR", "https://shop.example.com:8443/cart?currency=EUR"},
+		{"443", "http://shop.example.com/product/OLJCESPC7Z", "https://shop.example.com/product/OLJCESPC7Z"},
+	} {
+		rec := httptest.NewRecorder()
+		httpsRedirect(tc.port).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tc.target, nil))
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != tc.want {
+			t.Errorf("%s redirected %d to %q, want %d to %q", tc.target, rec.Code, rec.Header().Get("Location"), http.StatusPermanentRedirect, tc.want)
+		}
+	}
+}
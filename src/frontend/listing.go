@@ -0,0 +1,155 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 24
+	maxPageSize     = 100
+	maxSearchLength = 100 // characters of a search query
+)
+
+// Orders of a product listing, the values of the sort parameter. Without
+// one, products are listed in the catalog's order.
+const (
+	sortPriceAsc  = "price_asc"
+	sortPriceDesc = "price_desc"
+	sortName      = "name"
+)
+
+var sortOrders = []struct{ value, label string }{
+	{"", "Featured"},
+	{sortPriceAsc, "Price: low to high"},
+	{sortPriceDesc, "Price: high to low"},
+	{sortName, "Name"},
+}
+
+// listingQuery is how a product listing is requested: the page, page_size,
+// sort and q parameters. Invalid values fall back to the defaults rather
+// than failing the page.
+type listingQuery struct {
+	page     int // from 1
+	pageSize int
+	sort     string
+	search   string
+}
+
+func parseListingQuery(r *http.Request) listingQuery {
+	q := listingQuery{page: 1, pageSize: defaultPageSize}
+	if n, err := strconv.Atoi(r.FormValue("page")); err == nil && n > 1 {
+		q.page = n
+	}
+	if n, err := strconv.Atoi(r.FormValue("page_size")); err == nil && n >= 1 && n <= maxPageSize {
+		q.pageSize = n
+	}
+	for _, o := range sortOrders {
+		if r.FormValue("sort") == o.value {
+			q.sort = o.value
+		}
+	}
+	q.search = strings.TrimSpace(r.FormValue("q"))
+	if s := []rune(q.search); len(s) > maxSearchLength {
+		q.search = string(s[:maxSearchLength])
+	}
+	return q
+}
+
+// sortProducts orders products as requested, keeping the catalog's order
+// between equals. Prices are compared in the session currency; products
+// without a price come last either way.
+func sortProducts(ps []productView, order string) {
+	var less func(a, b productView) bool
+	switch order {
+	case sortPriceAsc, sortPriceDesc:
+		less = func(a, b productView) bool {
+			if a.Price == nil || b.Price == nil {
+				return b.Price == nil && a.Price != nil
+			}
+			if order == sortPriceDesc {
+				return moneyLess(*b.Price, *a.Price)
+			}
+			return moneyLess(*a.Price, *b.Price)
+		}
+	case sortName:
+		less = func(a, b productView) bool {
+			return strings.ToLower(a.Item.GetName()) < strings.ToLower(b.Item.GetName())
+		}
+	default:
+		return
+	}
+	sort.SliceStable(ps, func(i, j int) bool { return less(ps[i], ps[j]) })
+}
+
+// sortOption is an order of the sort menu.
+type sortOption struct {
+	Value, Label string
+	Selected     bool
+}
+
+// listingPage describes the page of a listing shown, for the sort menu and
+// the pagination links.
+type listingPage struct {
+	Total      int // products on every page
+	Page       int // from 1
+	Pages      int
+	Prev, Next string // URLs, empty on the first and last pages
+	Sorts      []sortOption
+}
+
+// paginate returns the products of the requested page. A page past the
+// last one is clamped to it. The links of u keep its other parameters, the
+// currency among them when it is one.
+func paginate(u *url.URL, ps []productView, q listingQuery) ([]productView, listingPage) {
+	p := listingPage{Total: len(ps), Page: q.page}
+	p.Pages = (len(ps) + q.pageSize - 1) / q.pageSize
+	if p.Pages == 0 {
+		p.Pages = 1
+	}
+	if p.Page > p.Pages {
+		p.Page = p.Pages
+	}
+	if p.Page > 1 {
+		p.Prev = pageURL(u, p.Page-1)
+	}
+	if p.Page < p.Pages {
+		p.Next = pageURL(u, p.Page+1)
+	}
+	for _, o := range sortOrders {
+		p.Sorts = append(p.Sorts, sortOption{Value: o.value, Label: o.label, Selected: o.value == q.sort})
+	}
+	start := (p.Page - 1) * q.pageSize
+	end := start + q.pageSize
+	if end > len(ps) {
+		end = len(ps)
+	}
+	return ps[start:end], p
+}
+
+// pageURL is u with its page parameter replaced.
+func pageURL(u *url.URL, page int) string {
+	q := u.Query()
+	q.Del("page")
+	if page > 1 {
+		q.Set("page", strconv.Itoa(page))
+	}
+	return (&url.URL{Path: u.Path, RawQuery: q.Encode()}).String()
+}
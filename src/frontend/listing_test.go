@@ -0,0 +1,160 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+var productCardPattern = regexp.MustCompile(`<a href="/product/([0-9A-Z]+)">\s*<img class="card-img-top"`)
+
+// gridProducts returns the IDs of the product cards of a page, in order.
+func gridProducts(body string) []string {
+	var ids []string
+	for _, m := range productCardPattern.FindAllStringSubmatch(body, -1) {
+		ids = append(ids, m[1])
+	}
+	return ids
+}
+
+func TestParseListingQuery(t *testing.T) {
+	for query, want := range map[string]listingQuery{
+		"":                                  {page: 1, pageSize: defaultPageSize},
+		"page=3&page_size=10&sort=name&q=a": {page: 3, pageSize: 10, sort: sortName, search: "a"},
+		"page=-1&page_size=0&sort=random":   {page: 1, pageSize: defaultPageSize},
+		"page=x&page_size=1000&q=+lens+":    {page: 1, pageSize: defaultPageSize, search: "lens"},
+		"sort=price_desc&page_size=100":     {page: 1, pageSize: 100, sort: sortPriceDesc},
+		"q=" + strings.Repeat("é", 150):     {page: 1, pageSize: defaultPageSize, search: strings.Repeat("é", maxSearchLength)},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/?"+strings.Replace(query, "é", "%C3%A9", -1), nil)
+		if got := parseListingQuery(r); got != want {
+			t.Errorf("parseListingQuery(%q) = %+v, want %+v", query, got, want)
+		}
+	}
+}
+
+func TestSortProducts(t *testing.T) {
+	price := func(units int64) *pb.Money { return &pb.Money{CurrencyCode: "EUR", Units: units} }
+	view := func(id, name string, converted *pb.Money) productView {
+		// The USD prices are in the opposite order, to tell which is sorted on.
+		usd := int64(100)
+		if converted != nil {
+			usd -= converted.GetUnits()
+		}
+		return productView{Item: &pb.Product{Id: id, Name: name, PriceUsd: &pb.Money{CurrencyCode: "USD", Units: usd}}, Price: converted}
+	}
+	products := []productView{
+		view("A", "lamp", price(20)),
+		view("B", "Bike", nil),
+		view("C", "mug", price(10)),
+		view("D", "Chair", price(20)),
+		view("E", "apron", price(5)),
+	}
+	for order, want := range map[string]string{
+		"":            "ABCDE",
+		sortPriceAsc:  "ECADB",
+		sortPriceDesc: "ADCEB",
+		sortName:      "EBDAC",
+	} {
+		ps := append([]productView(nil), products...)
+		sortProducts(ps, order)
+		var got string
+		for _, p := range ps {
+			got += p.Item.GetId()
+		}
+		if got != want {
+			t.Errorf("sort %q = %s, want %s", order, got, want)
+		}
+	}
+}
+
+func TestHomeListing(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	for path, want := range map[string][]string{
+		"/?sort=price_asc":              {"66VCHSJNUP", "OLJCESPC7Z", "1YMWWN1N4O"},
+		"/?sort=price_desc":             {"1YMWWN1N4O", "OLJCESPC7Z", "66VCHSJNUP"},
+		"/?sort=name":                   {"1YMWWN1N4O", "66VCHSJNUP", "OLJCESPC7Z"},
+		"/?page_size=2":                 {"OLJCESPC7Z", "66VCHSJNUP"},
+		"/?page_size=2&page=2":          {"1YMWWN1N4O"},
+		"/?page_size=2&page=99":         {"1YMWWN1N4O"},
+		"/?page_size=2&page=zero":       {"OLJCESPC7Z", "66VCHSJNUP"},
+		"/?sort=price_desc&page_size=1": {"1YMWWN1N4O"},
+	} {
+		resp := h.get(path)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s = %d, want %d", path, resp.StatusCode, http.StatusOK)
+		}
+		if got := gridProducts(resp.body); !reflect.DeepEqual(got, want) {
+			t.Errorf("GET %s lists %v, want %v", path, got, want)
+		}
+	}
+
+	h.post("/setCurrency", url.Values{"currency_code": {"JPY"}})
+	last := h.get("/?page_size=2&page=2&sort=name").body
+	if !strings.Contains(last, `href="/?page_size=2&amp;sort=name" rel="prev"`) || !strings.Contains(last, `href="#" rel="next"`) {
+		t.Error("last page does not link back to the first with the same parameters")
+	}
+	if !strings.Contains(last, "Page 2 of 2") || !strings.Contains(last, "JPY") {
+		t.Error("last page lacks its position or the chosen currency")
+	}
+	if first := h.get("/?page_size=2"); !strings.Contains(first.body, `href="/?page=2&amp;page_size=2" rel="next"`) {
+		t.Error("first page does not link to the next")
+	}
+	if one := h.get("/"); strings.Contains(one.body, `id="pagination"`) {
+		t.Error("pagination shown for a single page")
+	}
+}
+
+func TestHomeSearch(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	resp := h.get("/?q=vintage&sort=price_asc")
+	if got, want := gridProducts(resp.body), []string{"66VCHSJNUP", "OLJCESPC7Z"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search lists %v, want %v", got, want)
+	}
+	if n := h.faults.calls(searchProductsMethod); n != 1 {
+		t.Errorf("%d SearchProducts calls, want 1", n)
+	}
+	if strings.Contains(resp.body, `id="price_facets"`) {
+		t.Error("price facets shown for search results")
+	}
+	if !strings.Contains(resp.body, `value="vintage"`) {
+		t.Error("search box does not keep the query")
+	}
+
+	none := h.get("/?q=spaceship")
+	if len(gridProducts(none.body)) != 0 || !strings.Contains(none.body, "No products match your search.") {
+		t.Error("search without results not reported")
+	}
+
+	h.fail(searchProductsMethod, status.Error(codes.Unavailable, "injected failure"))
+	if resp := h.get("/?q=vintage"); resp.StatusCode < 500 {
+		t.Errorf("failed search = %d, want an error page", resp.StatusCode)
+	}
+}
@@ -0,0 +1,536 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSyntheticRPS   = 2
+	defaultSyntheticUsers = 4
+	maxSyntheticRPS       = 1000
+	maxSyntheticBody      = 1 << 20 // read from synthetic responses, then dropped
+	syntheticTimeout      = 30 * time.Second
+	// headerSynthetic marks the requests of the traffic generator.
+	headerSynthetic    = "X-Synthetic"
+	syntheticUserAgent = "frontend-loadgen/1.0"
+	// syntheticBase is the URL the synthetic users browse. Their requests
+	// never leave the process; https keeps secure session cookies in their
+	// jars.
+	syntheticBase = "https://frontend.synthetic"
+)
+
+// syntheticScenarios are the things a synthetic user does, in the order
+// they are listed. The default weights are those of the load generator.
+var (
+	syntheticScenarios      = []string{"home", "browse", "currency", "add_to_cart", "view_cart", "checkout"}
+	defaultSyntheticWeights = map[string]int{
+		"home": 1, "browse": 10, "currency": 2, "add_to_cart": 2, "view_cart": 3, "checkout": 1,
+	}
+	syntheticCurrencies = []string{"EUR", "USD", "JPY", "CAD"}
+	syntheticQuantities = []int{1, 2, 3, 4, 5, 10}
+	syntheticCheckout   = url.Values{
+		"email":                        {"someone@example.com"},
+		"street_address":               {"1600 Amphitheatre Parkway"},
+		"zip_code":                     {"94043"},
+		"city":                         {"Mountain View"},
+		"state":                        {"CA"},
+		"country":                      {"United States"},
+		"credit_card_number":           {"4432-8015-6152-0454"},
+		"credit_card_expiration_month": {"1"},
+		"credit_card_expiration_year":  {"2039"},
+		"credit_card_cvv":              {"672"},
+	}
+
+	syntheticProductLink = regexp.MustCompile(`href="/product/([A-Za-z0-9]+)"`)
+	syntheticCSRFToken   = regexp.MustCompile(`name="csrf_token" value="([^"]*)"`)
+)
+
+// parseSyntheticWeights parses the weights of SYNTHETIC_TRAFFIC_WEIGHTS,
+// e.g. "browse=10,checkout=1", over the default weights.
+func parseSyntheticWeights(s string) (map[string]int, error) {
+	weights := make(map[string]int, len(defaultSyntheticWeights))
+	for k, v := range defaultSyntheticWeights {
+		weights[k] = v
+	}
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("weight %q: want scenario=weight", kv)
+		}
+		w, err := strconv.Atoi(strings.TrimSpace(kv[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("weight %q: %v", kv, err)
+		}
+		weights[strings.TrimSpace(kv[:i])] = w
+	}
+	if err := validateSyntheticWeights(weights); err != nil {
+		return nil, err
+	}
+	return weights, nil
+}
+
+func validateSyntheticWeights(weights map[string]int) error {
+	total := 0
+	for name, w := range weights {
+		if _, ok := defaultSyntheticWeights[name]; !ok {
+			return fmt.Errorf("unknown scenario %q, want one of %s", name, strings.Join(syntheticScenarios, ", "))
+		}
+		if w < 0 {
+			return fmt.Errorf("scenario %q: weight must not be negative", name)
+		}
+		total += w
+	}
+	if total == 0 {
+		return fmt.Errorf("at least one scenario must have a weight")
+	}
+	return nil
+}
+
+// loadGenerator drives the frontend with synthetic shoppers, for
+// observability demos without the load generator. Its users send their
+// requests through the frontend's own handler, in process, each with a
+// session of its own. Requests are marked with the X-Synthetic header, and
+// paced so that all users together stay under the target rate.
+type loadGenerator struct {
+	users int
+	clock clock // the pace follows real time, not the demo clock
+	log   logrus.FieldLogger
+
+	requests int64 // atomic
+	failures int64 // atomic, transport errors and server errors
+
+	mu      sync.Mutex
+	enabled bool
+	rps     float64
+	weights map[string]int
+	runs    map[string]int64 // scenarios run, by name
+	next    time.Time        // when the next request may be sent
+	handler http.Handler     // nil until run
+	closed  bool
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func newLoadGenerator(enabled bool, rps float64, users int, weights map[string]int) *loadGenerator {
+	return &loadGenerator{
+		users:   users,
+		clock:   realClock{},
+		log:     logrus.New(),
+		enabled: enabled,
+		rps:     rps,
+		weights: weights,
+		runs:    make(map[string]int64),
+	}
+}
+
+// run starts the users, if the generator is enabled, sending their
+// requests to h. Later changes to the settings start and stop them.
+func (g *loadGenerator) run(log logrus.FieldLogger, h http.Handler) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.log, g.handler = log, h
+	if g.enabled {
+		g.startLocked()
+	}
+}
+
+// stop stops the users for good, waiting for their requests in flight.
+func (g *loadGenerator) stop() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+	g.pause()
+}
+
+func (g *loadGenerator) startLocked() {
+	if g.cancel != nil || g.closed || g.handler == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	g.cancel = cancel
+	for i := 0; i < g.users; i++ {
+		g.wg.Add(1)
+		go g.user(ctx)
+	}
+	g.log.WithFields(logrus.Fields{
+		"event": "loadgen_started",
+		"users": g.users,
+		"rps":   g.rps,
+	}).Info("started generating synthetic traffic")
+}
+
+// pause stops the users, waiting for their requests in flight.
+func (g *loadGenerator) pause() {
+	g.mu.Lock()
+	cancel := g.cancel
+	g.cancel = nil
+	g.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	g.wg.Wait()
+	g.log.WithField("event", "loadgen_stopped").Info("stopped generating synthetic traffic")
+}
+
+// update changes the settings that are set, starting or stopping the users.
+func (g *loadGenerator) update(u loadgenUpdate) error {
+	switch {
+	case u.RPS != nil && (*u.RPS <= 0 || *u.RPS > maxSyntheticRPS):
+		return fmt.Errorf("rps must be in (0, %d]", maxSyntheticRPS)
+	case u.Weights != nil:
+		if err := validateSyntheticWeights(u.Weights); err != nil {
+			return err
+		}
+	}
+	g.mu.Lock()
+	if u.RPS != nil {
+		g.rps = *u.RPS
+	}
+	if u.Weights != nil {
+		g.weights = u.Weights
+	}
+	if u.Enabled != nil {
+		g.enabled = *u.Enabled
+	}
+	if g.enabled {
+		g.startLocked()
+	}
+	enabled := g.enabled
+	g.mu.Unlock()
+	if !enabled {
+		g.pause()
+	}
+	return nil
+}
+
+// wait waits for the next request slot, and reports whether it got one
+// before ctx was done. Slots are 1/rps apart whichever user takes them, so
+// there is no burst over the rate.
+func (g *loadGenerator) wait(ctx context.Context) bool {
+	g.mu.Lock()
+	now := g.clock.Now()
+	if g.next.Before(now) {
+		g.next = now
+	}
+	at := g.next
+	g.next = g.next.Add(time.Duration(float64(time.Second) / g.rps))
+	g.mu.Unlock()
+
+	t := g.clock.NewTimer(at.Sub(now))
+	select {
+	case <-t.C():
+		return true
+	case <-ctx.Done():
+		t.Stop()
+		return false
+	}
+}
+
+// pick returns a scenario at random, by weight.
+func (g *loadGenerator) pick() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	total := 0
+	for _, w := range g.weights {
+		total += w
+	}
+	n := rand.Intn(total)
+	for _, name := range syntheticScenarios {
+		if n -= g.weights[name]; n < 0 {
+			return name
+		}
+	}
+	return syntheticScenarios[0]
+}
+
+// user runs scenarios until ctx is done.
+func (g *loadGenerator) user(ctx context.Context) {
+	defer g.wg.Done()
+	u := &syntheticUser{g: g}
+	u.reset()
+	for ctx.Err() == nil {
+		name := g.pick()
+		u.scenario(ctx, name)
+		g.mu.Lock()
+		g.runs[name]++
+		g.mu.Unlock()
+	}
+}
+
+// loadgenUpdate is the body of POST /debug/loadgen. Settings left out are
+// unchanged.
+type loadgenUpdate struct {
+	Enabled *bool          `json:"enabled"`
+	RPS     *float64       `json:"rps"`
+	Weights map[string]int `json:"weights"`
+}
+
+// loadgenStatus is the answer of /debug/loadgen.
+type loadgenStatus struct {
+	Enabled  bool             `json:"enabled"`
+	RPS      float64          `json:"rps"`
+	Users    int              `json:"users"`
+	Weights  map[string]int   `json:"weights"`
+	Requests int64            `json:"requests"`
+	Failures int64            `json:"failures"`
+	Runs     map[string]int64 `json:"runs"`
+}
+
+func (g *loadGenerator) status() loadgenStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := loadgenStatus{
+		Enabled:  g.enabled && !g.closed,
+		RPS:      g.rps,
+		Users:    g.users,
+		Weights:  make(map[string]int, len(g.weights)),
+		Requests: atomic.LoadInt64(&g.requests),
+		Failures: atomic.LoadInt64(&g.failures),
+		Runs:     make(map[string]int64, len(g.runs)),
+	}
+	for k, v := range g.weights {
+		s.Weights[k] = v
+	}
+	for k, v := range g.runs {
+		s.Runs[k] = v
+	}
+	return s
+}
+
+// syntheticUser is a shopper of the generator, with its own session. It
+// follows the links and forms of the pages it gets, as a browser would.
+type syntheticUser struct {
+	g        *loadGenerator
+	client   *http.Client
+	products []string // product IDs linked from the home page
+	token    string   // CSRF token of the last page
+	page     string   // path of the last page, sent as the Referer
+}
+
+// reset starts a new session, as a new shopper would.
+func (u *syntheticUser) reset() {
+	jar, _ := cookiejar.New(nil)
+	u.client = &http.Client{
+		Transport: handlerTransport{u.g.handler},
+		Jar:       jar,
+		Timeout:   syntheticTimeout,
+		// Redirects are not followed: each request must take a slot.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	u.token, u.page = "", "/"
+}
+
+func (u *syntheticUser) scenario(ctx context.Context, name string) {
+	if len(u.products) == 0 && name != "home" && name != "currency" {
+		u.get(ctx, "/")
+		if len(u.products) == 0 {
+			return
+		}
+	}
+	switch name {
+	case "home":
+		u.get(ctx, "/")
+	case "browse":
+		u.get(ctx, "/product/"+u.product())
+	case "currency":
+		u.post(ctx, "/setCurrency", url.Values{
+			"currency_code": {syntheticCurrencies[rand.Intn(len(syntheticCurrencies))]},
+		})
+	case "add_to_cart":
+		u.addToCart(ctx)
+	case "view_cart":
+		u.get(ctx, "/cart")
+	case "checkout":
+		if u.addToCart(ctx) && u.post(ctx, "/cart/checkout", syntheticCheckout) {
+			u.reset()
+		}
+	}
+}
+
+func (u *syntheticUser) product() string {
+	return u.products[rand.Intn(len(u.products))]
+}
+
+func (u *syntheticUser) addToCart(ctx context.Context) bool {
+	id := u.product()
+	return u.get(ctx, "/product/"+id) && u.post(ctx, "/cart", url.Values{
+		"product_id": {id},
+		"quantity":   {strconv.Itoa(syntheticQuantities[rand.Intn(len(syntheticQuantities))])},
+	})
+}
+
+func (u *syntheticUser) get(ctx context.Context, path string) bool {
+	body, ok := u.do(ctx, http.MethodGet, path, nil)
+	if !ok {
+		return false
+	}
+	u.page = path
+	if m := syntheticCSRFToken.FindStringSubmatch(body); m != nil {
+		u.token = m[1]
+	}
+	if path == "/" {
+		u.products = u.products[:0]
+		for _, m := range syntheticProductLink.FindAllStringSubmatch(body, -1) {
+			u.products = append(u.products, m[1])
+		}
+	}
+	return true
+}
+
+// post sends a form with the CSRF token of the last page. Pages cached at
+// the edge carry none; the Referer vouches for those.
+func (u *syntheticUser) post(ctx context.Context, path string, form url.Values) bool {
+	f := url.Values{}
+	for k, vs := range form {
+		f[k] = vs
+	}
+	if u.token != "" {
+		f.Set(csrfField, u.token)
+	}
+	_, ok := u.do(ctx, http.MethodPost, path, strings.NewReader(f.Encode()))
+	return ok
+}
+
+// do waits for a slot and sends a request, returning the body of the
+// response and whether it succeeded.
+func (u *syntheticUser) do(ctx context.Context, method, path string, body io.Reader) (string, bool) {
+	if !u.g.wait(ctx) {
+		return "", false
+	}
+	req, err := http.NewRequest(method, syntheticBase+path, body)
+	if err != nil {
+		return "", false
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(headerSynthetic, "true")
+	req.Header.Set("User-Agent", syntheticUserAgent)
+	req.Header.Set("Referer", syntheticBase+u.page)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	atomic.AddInt64(&u.g.requests, 1)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		u.fail(ctx)
+		return "", false
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxSyntheticBody))
+	if resp.StatusCode >= 500 {
+		u.fail(ctx)
+	}
+	return string(b), resp.StatusCode < 400
+}
+
+// fail counts a failed request, unless it was cancelled by stopping the
+// users.
+func (u *syntheticUser) fail(ctx context.Context) {
+	if ctx.Err() == nil {
+		atomic.AddInt64(&u.g.failures, 1)
+	}
+}
+
+// handlerTransport serves requests with a handler in process, the way
+// selfCheck does.
+type handlerTransport struct {
+	h http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.WithContext(req.Context())
+	r.Host = req.URL.Host
+	r.RequestURI = req.URL.RequestURI()
+	r.RemoteAddr = "127.0.0.1:0"
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+	w := httptest.NewRecorder()
+	t.h.ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+// loadgenHandler shows the settings and counters of the traffic generator
+// on GET, and changes its settings from a JSON body on POST. It requires
+// the debug or the admin token.
+func (fe *frontendServer) loadgenHandler(w http.ResponseWriter, r *http.Request) {
+	if !fe.requireDebugToken(w, r) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		var u loadgenUpdate
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			http.Error(w, "invalid settings: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := fe.loadgen.update(u); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s := fe.loadgen.status()
+		r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger).WithFields(logrus.Fields{
+			"event":   "loadgen_changed",
+			"enabled": s.Enabled,
+			"rps":     s.RPS,
+			"weights": formatSyntheticWeights(s.Weights),
+		}).Info("synthetic traffic settings changed")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fe.loadgen.status())
+}
+
+// formatSyntheticWeights formats weights the way SYNTHETIC_TRAFFIC_WEIGHTS
+// takes them.
+func formatSyntheticWeights(weights map[string]int) string {
+	names := make([]string, 0, len(weights))
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=" + strconv.Itoa(weights[name])
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,209 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func withLoadGenerator(rps float64, users int) func(*frontendServer) {
+	return func(fe *frontendServer) {
+		fe.loadgen = newLoadGenerator(true, rps, users, defaultSyntheticWeights)
+		fe.debugToken = "debug-token"
+	}
+}
+
+// syntheticRecorder records the requests the generator sends.
+type syntheticRecorder struct {
+	mu       sync.Mutex
+	n        int
+	real     int // requests not marked synthetic
+	sessions map[string]bool
+}
+
+func (rec *syntheticRecorder) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.mu.Lock()
+		rec.n++
+		if r.Header.Get(headerSynthetic) != "true" {
+			rec.real++
+		}
+		if c, err := r.Cookie(cookieSessionID); err == nil {
+			rec.sessions[c.Value] = true
+		}
+		rec.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rec *syntheticRecorder) count() int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.n
+}
+
+// runLoadGenerator starts the generator of h, recording its requests.
+func runLoadGenerator(h *testHarness) *syntheticRecorder {
+	rec := &syntheticRecorder{sessions: make(map[string]bool)}
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	h.fe.loadgen.run(log, rec.wrap(h.srv.Config.Handler))
+	return rec
+}
+
+// postLoadgen posts settings to /debug/loadgen with the given bearer token.
+func (h *testHarness) postLoadgen(body, token string) *response {
+	h.t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/debug/loadgen", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return h.do(req)
+}
+
+func TestParseSyntheticWeights(t *testing.T) {
+	weights, err := parseSyntheticWeights(" browse=3, checkout=0 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weights["browse"] != 3 || weights["checkout"] != 0 || weights["view_cart"] != defaultSyntheticWeights["view_cart"] {
+		t.Errorf("weights = %v, want browse and checkout over the defaults", weights)
+	}
+	for _, s := range []string{"browse", "browse=x", "fly=1", "browse=-1",
+		"home=0,browse=0,currency=0,add_to_cart=0,view_cart=0,checkout=0"} {
+		if _, err := parseSyntheticWeights(s); err == nil {
+			t.Errorf("parseSyntheticWeights(%q) accepted", s)
+		}
+	}
+}
+
+func TestLoadGeneratorRate(t *testing.T) {
+	const rps = 40
+	h := newTestHarness(t, withLoadGenerator(rps, 8))
+	defer h.close()
+	h.get("/")
+
+	start := time.Now()
+	rec := runLoadGenerator(h)
+	time.Sleep(500 * time.Millisecond)
+	h.fe.loadgen.stop()
+	elapsed := time.Since(start)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if max := int(rps*elapsed.Seconds()) + 1; rec.n > max {
+		t.Errorf("%d requests in %v, want at most %d at %d rps", rec.n, elapsed, max, rps)
+	}
+	if min := int(rps * elapsed.Seconds() / 2); rec.n < min {
+		t.Errorf("%d requests in %v, want at least %d at %d rps", rec.n, elapsed, min, rps)
+	}
+	if rec.real != 0 {
+		t.Errorf("%d requests not marked synthetic", rec.real)
+	}
+	if rec.sessions[h.cookie(cookieSessionID)] {
+		t.Error("synthetic users share the session of a shopper")
+	}
+	if len(rec.sessions) < 2 {
+		t.Errorf("synthetic users sent %d sessions, want one each", len(rec.sessions))
+	}
+	if s := h.fe.loadgen.status(); s.Enabled || s.Requests != int64(rec.n) || s.Failures != 0 {
+		t.Errorf("status after stop = %+v, want disabled with %d requests and no failures", s, rec.n)
+	}
+}
+
+func TestLoadGeneratorRuntimeSettings(t *testing.T) {
+	h := newTestHarness(t, withLoadGenerator(100, 4))
+	defer h.close()
+	rec := runLoadGenerator(h)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rec.count() < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec.count() < 5 {
+		t.Fatalf("%d requests sent once started, want some", rec.count())
+	}
+
+	if resp := h.postLoadgen(`{"enabled": false}`, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("settings without the debug token = %d, want 401", resp.StatusCode)
+	}
+	for _, body := range []string{`{"rps": 0}`, `{"rps": 1e6}`, `{"weights": {"fly": 1}}`, `[]`} {
+		if resp := h.postLoadgen(body, "debug-token"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("settings %s = %d, want 400", body, resp.StatusCode)
+		}
+	}
+
+	resp := h.postLoadgen(`{"enabled": false}`, "debug-token")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.body, `"enabled":false`) {
+		t.Fatalf("disabling = %d %s", resp.StatusCode, resp.body)
+	}
+	stopped := rec.count()
+	time.Sleep(100 * time.Millisecond)
+	if n := rec.count(); n != stopped {
+		t.Errorf("%d requests sent once disabled", n-stopped)
+	}
+	if entries := h.logs.find("loadgen_changed"); len(entries) != 1 || entries[0].Data["enabled"] != false {
+		t.Errorf("logged %d changes, want the disabling", len(entries))
+	}
+
+	resp = h.postLoadgen(`{"enabled": true, "rps": 200, "weights": {"browse": 1, "home": 0}}`, "debug-token")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("enabling = %d %s", resp.StatusCode, resp.body)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for rec.count() == stopped && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec.count() == stopped {
+		t.Error("no request sent once enabled again")
+	}
+	if s := h.fe.loadgen.status(); !s.Enabled || s.RPS != 200 || s.Weights["home"] != 0 {
+		t.Errorf("status = %+v, want the new settings", s)
+	}
+}
+
+func TestLoadGeneratorCheckout(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) {
+		fe.loadgen = newLoadGenerator(true, 200, 2, map[string]int{"checkout": 1})
+	})
+	defer h.close()
+	runLoadGenerator(h)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.faults.calls(placeOrderMethod) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.fe.loadgen.stop()
+	if n := h.faults.calls(placeOrderMethod); n < 2 {
+		t.Fatalf("%d orders placed, want the synthetic users to check out", n)
+	}
+	if entries := h.logs.find("csrf_rejected"); len(entries) != 0 {
+		t.Errorf("%d synthetic forms rejected for their CSRF token", len(entries))
+	}
+	orders, _ := h.fe.orders.page(0, time.Time{}, maxOrderHistory)
+	for _, o := range orders {
+		if !o.Synthetic {
+			t.Errorf("order %s not marked synthetic", o.OrderID)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+// locale is how prices and dates are written for the shopper. A nil locale
+// is the neutral format, the currency code then the amount ("USD 1234.50"),
+// used when the shopper has no language the shop knows.
+type locale struct {
+	Tag         string // BCP 47 language, e.g. "de"
+	Name        string // in the language itself, for the selector
+	decimal     string
+	group       string // between groups of three digits of the units
+	symbolAfter bool   // "1.234,50 €" rather than "€1,234.50"
+	symbolSpace bool   // a space between the amount and the symbol
+	timeLayout  string
+}
+
+// nbsp keeps an amount and its currency on one line; nnbsp is the narrow
+// one French groups digits with.
+const (
+	nbsp  = "\u00a0"
+	nnbsp = "\u202f"
+)
+
+// locales are those the shop knows, in the order of the selector.
+var locales = []*locale{
+	{Tag: "en", Name: "English", decimal: ".", group: ",", timeLayout: "Jan 2, 15:04 MST"},
+	{Tag: "de", Name: "Deutsch", decimal: ",", group: ".", symbolAfter: true, symbolSpace: true, timeLayout: "02.01., 15:04 MST"},
+	{Tag: "es", Name: "Español", decimal: ",", group: ".", symbolAfter: true, symbolSpace: true, timeLayout: "02/01, 15:04 MST"},
+	{Tag: "fr", Name: "Français", decimal: ",", group: nnbsp, symbolAfter: true, symbolSpace: true, timeLayout: "02/01 15:04 MST"},
+	{Tag: "it", Name: "Italiano", decimal: ",", group: ".", symbolAfter: true, symbolSpace: true, timeLayout: "02/01, 15:04 MST"},
+	{Tag: "ja", Name: "日本語", decimal: ".", group: ",", timeLayout: "01/02 15:04 MST"},
+	{Tag: "pt", Name: "Português", decimal: ",", group: ".", symbolSpace: true, timeLayout: "02/01 15:04 MST"},
+}
+
+// currencySymbols has the symbols of the currencies written with one; the
+// others are written with their code.
+var currencySymbols = map[string]string{
+	"AUD": "A$", "BRL": "R$", "CAD": "CA$", "CNY": "CN¥", "EUR": "€",
+	"GBP": "£", "HKD": "HK$", "ILS": "₪", "INR": "₹", "JPY": "¥",
+	"KRW": "₩", "MXN": "MX$", "NZD": "NZ$", "TRY": "₺", "USD": "$",
+}
+
+func findLocale(tag string) *locale {
+	for _, l := range locales {
+		if strings.EqualFold(l.Tag, tag) {
+			return l
+		}
+	}
+	return nil
+}
+
+// requestLocale returns the locale of the request: the one chosen with
+// /setLocale, or else the first of Accept-Language the shop knows, or nil.
+func requestLocale(r *http.Request) *locale {
+	if l := chosenLocale(r); l != nil {
+		return l
+	}
+	return acceptedLocale(r.Header.Get("Accept-Language"))
+}
+
+// chosenLocale returns the locale chosen with /setLocale, if any.
+func chosenLocale(r *http.Request) *locale {
+	c, err := r.Cookie(cookieLocale)
+	if err != nil {
+		return nil
+	}
+	return findLocale(c.Value)
+}
+
+// acceptedLocale returns the preferred locale of an Accept-Language header,
+// matching its ranges by language only: "de-CH" gets "de".
+func acceptedLocale(header string) *locale {
+	type choice struct {
+		tag string
+		q   float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		c := choice{tag: strings.TrimSpace(fields[0]), q: 1}
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, err := strconv.ParseFloat(p[2:], 64)
+				if err != nil {
+					q = 0
+				}
+				c.q = q
+			}
+		}
+		if c.tag != "" && c.q > 0 {
+			choices = append(choices, c)
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	for _, c := range choices {
+		lang := c.tag
+		if i := strings.IndexAny(lang, "-_"); i >= 0 {
+			lang = lang[:i]
+		}
+		if l := findLocale(lang); l != nil {
+			return l
+		}
+	}
+	return nil
+}
+
+// formatMoney formats a value for display, rounded once to the minor unit
+// of its currency. The amount has the digits of that minor unit (none for
+// JPY), the separators of the locale, and the currency symbol where the
+// locale puts it; a currency without a known symbol is prefixed with its
+// code.
+func (l *locale) formatMoney(m pb.Money) string {
+	if l == nil {
+		return renderMoney(m)
+	}
+	m = money.Round(m, moneyRounding)
+	units, nanos, sign := m.GetUnits(), m.GetNanos(), ""
+	if units < 0 || nanos < 0 {
+		units, nanos, sign = -units, -nanos, "-"
+	}
+	amount := groupDigits(strconv.FormatInt(units, 10), l.group)
+	if digits := money.MinorUnitDigits(m.GetCurrencyCode()); digits > 0 {
+		minor := nanos
+		for i := digits; i < 9; i++ {
+			minor /= 10
+		}
+		amount += fmt.Sprintf("%s%0*d", l.decimal, digits, minor)
+	}
+	symbol, ok := currencySymbols[m.GetCurrencyCode()]
+	if !ok {
+		return sign + m.GetCurrencyCode() + nbsp + amount
+	}
+	space := ""
+	if l.symbolSpace {
+		space = nbsp
+	}
+	if l.symbolAfter {
+		return sign + amount + space + symbol
+	}
+	return sign + symbol + space + amount
+}
+
+// groupDigits separates the digits in groups of three from the right.
+func groupDigits(digits, sep string) string {
+	if len(digits) <= 3 {
+		return digits
+	}
+	var b strings.Builder
+	head := len(digits) % 3
+	if head > 0 {
+		b.WriteString(digits[:head])
+	}
+	for i := head; i < len(digits); i += 3 {
+		if b.Len() > 0 {
+			b.WriteString(sep)
+		}
+		b.WriteString(digits[i : i+3])
+	}
+	return b.String()
+}
+
+const neutralTimeLayout = "Jan 2, 15:04 MST"
+
+// formatTime formats a time for display, in the neutral format when the
+// locale is nil.
+func (l *locale) formatTime(t time.Time) string {
+	if l == nil {
+		return t.Format(neutralTimeLayout)
+	}
+	return t.Format(l.timeLayout)
+}
+
+// tag is the tag of the locale, or "" for the neutral format.
+func (l *locale) tag() string {
+	if l == nil {
+		return ""
+	}
+	return l.Tag
+}
+
+// setLocaleHandler sets the locale of the session, or forgets it for an
+// empty one, going back to that of Accept-Language.
+func (fe *frontendServer) setLocaleHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	tag := r.FormValue("locale")
+	log.WithField("locale.new", tag).WithField("locale.old", requestLocale(r).tag()).
+		Debug("setting locale")
+
+	referer := r.Header.Get("referer")
+	if referer == "" {
+		referer = "/"
+	}
+	c := &http.Cookie{Name: cookieLocale, Path: "/", MaxAge: -1}
+	if tag != "" {
+		l := findLocale(tag)
+		if l == nil {
+			f := newFormState(formLocale)
+			f.add("locale", "Choose one of the languages listed")
+			fe.rejectForm(w, r, f, referer)
+			return
+		}
+		c.Value, c.MaxAge = l.Tag, cookieMaxAge
+	}
+	http.SetCookie(w, c)
+	w.Header().Set("Location", referer)
+	w.WriteHeader(http.StatusFound)
+}
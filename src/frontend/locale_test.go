@@ -0,0 +1,147 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestFormatMoney(t *testing.T) {
+	for _, tt := range []struct {
+		locale string // "" for the neutral format
+		in     pb.Money
+		want   string
+	}{
+		{"en", pb.Money{CurrencyCode: "USD", Units: 1234, Nanos: 500000000}, "$1,234.50"},
+		{"en", pb.Money{CurrencyCode: "USD", Units: -1234, Nanos: -500000000}, "-$1,234.50"},
+		{"en", pb.Money{CurrencyCode: "JPY", Units: 1234}, "¥1,234"},
+		{"en", pb.Money{CurrencyCode: "KWD", Units: 1, Nanos: 5000000}, "KWD\u00a01.005"},
+		{"en", pb.Money{CurrencyCode: "XYZ", Units: 1234, Nanos: 500000000}, "XYZ\u00a01,234.50"},
+		{"de", pb.Money{CurrencyCode: "EUR", Units: 1234, Nanos: 500000000}, "1.234,50\u00a0€"},
+		{"de", pb.Money{CurrencyCode: "EUR", Nanos: -500000000}, "-0,50\u00a0€"},
+		{"de", pb.Money{CurrencyCode: "JPY", Units: 1000000}, "1.000.000\u00a0¥"},
+		{"de", pb.Money{CurrencyCode: "XYZ", Units: 1234, Nanos: 500000000}, "XYZ\u00a01.234,50"},
+		{"fr", pb.Money{CurrencyCode: "EUR", Units: 1234567, Nanos: 891000000}, "1\u202f234\u202f567,89\u00a0€"},
+		{"es", pb.Money{CurrencyCode: "EUR", Nanos: 5000000}, "0,01\u00a0€"},
+		{"it", pb.Money{CurrencyCode: "GBP", Units: 12, Nanos: 345000000}, "12,35\u00a0£"},
+		{"ja", pb.Money{CurrencyCode: "JPY", Units: 1373, Nanos: 500000000}, "¥1,374"},
+		{"ja", pb.Money{CurrencyCode: "USD", Units: 999, Nanos: 990000000}, "$999.99"},
+		{"pt", pb.Money{CurrencyCode: "BRL", Units: 99, Nanos: 990000000}, "R$\u00a099,99"},
+		{"", pb.Money{CurrencyCode: "USD", Units: 1234, Nanos: 500000000}, "USD 1234.50"},
+		{"", pb.Money{CurrencyCode: "XYZ", Units: -3, Nanos: -10000000}, "XYZ -3.01"},
+	} {
+		l := findLocale(tt.locale)
+		if got := l.formatMoney(tt.in); got != tt.want {
+			t.Errorf("%q: formatMoney(%v) = %q, want %q", tt.locale, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	at := time.Date(2019, 3, 7, 14, 5, 0, 0, time.UTC)
+	for tag, want := range map[string]string{
+		"":   "Mar 7, 14:05 UTC",
+		"en": "Mar 7, 14:05 UTC",
+		"de": "07.03., 14:05 UTC",
+		"ja": "03/07 14:05 UTC",
+	} {
+		if got := findLocale(tag).formatTime(at); got != want {
+			t.Errorf("%q: formatTime = %q, want %q", tag, got, want)
+		}
+	}
+}
+
+func TestAcceptedLocale(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                                 "",
+		"de-CH, de;q=0.9, en;q=0.8":        "de",
+		"en-GB,en;q=0.9":                   "en",
+		"nl-NL, nl;q=0.9, fr;q=0.5":        "fr",
+		"en;q=0.5, ja;q=0.8":               "ja",
+		"pt-BR;q=0, es":                    "es",
+		"sv, *;q=0.1":                      "",
+		"fr_FR":                            "fr",
+		"it;q=bogus, de;q=0.3":             "de",
+		"  , ;q=1, en ; q=1.0 ":            "en",
+		"zh-Hant-TW, ja-JP;q=0.7, en;q=.5": "ja",
+	} {
+		if got := acceptedLocale(header).tag(); got != want {
+			t.Errorf("acceptedLocale(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestSetLocale(t *testing.T) {
+	h := newTestHarness(t, withEdgeCache)
+	defer h.close()
+	getIn := func(language string) *response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, h.srv.URL+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Language", language)
+		return h.do(req)
+	}
+	getIn("de") // lets the session cookie settle
+
+	resp := getIn("de-DE,de;q=0.9,en;q=0.8")
+	if !strings.Contains(resp.body, "67,99\u00a0$") {
+		t.Error("home page prices not formatted for Accept-Language")
+	}
+	if got := resp.Header.Get("Cache-Control"); got != publicCacheControl {
+		t.Errorf("Cache-Control = %q, want %q", got, publicCacheControl)
+	}
+	if got := resp.Header.Get("Vary"); !strings.Contains(got, "Accept-Language") {
+		t.Errorf("Vary = %q, want Accept-Language", got)
+	}
+
+	h.post("/setLocale", url.Values{"locale": {"en"}})
+	if got := h.cookie(cookieLocale); got != "en" {
+		t.Errorf("locale cookie = %q, want en", got)
+	}
+	resp = getIn("de")
+	if !strings.Contains(resp.body, "$67.99") {
+		t.Error("chosen locale does not override Accept-Language")
+	}
+	if !strings.Contains(resp.body, `<option value="en" selected="selected">`) {
+		t.Error("chosen locale not selected")
+	}
+	if got := resp.Header.Get("Cache-Control"); got != cacheControlPrivate {
+		t.Errorf("with a chosen locale: Cache-Control = %q, want %q", got, cacheControlPrivate)
+	}
+
+	resp = h.post("/setLocale", url.Values{"locale": {"xx"}})
+	if resp.Request.URL.Fragment != "locale_errors" {
+		t.Error("unknown locale not rejected")
+	}
+	if got := h.cookie(cookieLocale); got != "en" {
+		t.Errorf("locale cookie = %q, want en kept", got)
+	}
+
+	h.post("/setLocale", url.Values{"locale": {""}})
+	if got := h.cookie(cookieLocale); got != "" {
+		t.Errorf("locale cookie = %q, want it cleared", got)
+	}
+	if resp := getIn("de"); !strings.Contains(resp.body, "67,99\u00a0$") {
+		t.Error("Accept-Language not used again after clearing the locale")
+	}
+}
@@ -16,23 +16,35 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"flag"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/profiler"
 	"contrib.go.opencensus.io/exporter/jaeger"
 	"contrib.go.opencensus.io/exporter/stackdriver"
 	"github.com/gorilla/mux"
-	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"go.opencensus.io/plugin/ocgrpc"
 	"go.opencensus.io/plugin/ochttp"
-	"go.opencensus.io/plugin/ochttp/propagation/b3"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
+	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/adclient"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/cache"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
 )
 
 const (
@@ -43,9 +55,20 @@ const (
 	cookiePrefix    = "shop_"
 	cookieSessionID = cookiePrefix + "session-id"
 	cookieCurrency  = cookiePrefix + "currency"
+	cookieLocale    = cookiePrefix + "locale"
+	cookieCartCount = cookiePrefix + "cart-count"
+
+	defaultHouseAdURL  = "/"
+	defaultHouseAdText = "Discover this season's hipster essentials."
+
+	defaultCartMaxRows      = 100  // cart lines rendered on the cart page
+	defaultCartMaxQuantity  = 10   // items of a product added to the cart at once
+	defaultCheckoutMaxItems = 1000 // items in a cart that can be checked out
 )
 
 var (
+	// whitelistedCurrencies are the currencies offered unless
+	// WHITELISTED_CURRENCIES lists others.
 	whitelistedCurrencies = map[string]bool{
 		"USD": true,
 		"EUR": true,
@@ -78,9 +101,115 @@ type frontendServer struct {
 
 	adSvcAddr string
 	adSvcConn *grpc.ClientConn
+
+	// httpClient is shared by the calls to services not reached over gRPC.
+	httpClient *http.Client
+
+	demoMode    bool
+	clock       *offsetClock // moved only in demo mode
+	degradation *degradationRegistry
+	activity    *sessionActivity
+	orders      *orderHistory
+	confirmed   *confirmations // each session's recent orders, for /order/{order_id}
+	reorders    *reorders
+	edgeCache   *edgeCachePolicy // nil leaves caching headers out of pages
+	houseAd     *pb.Ad
+	ads         *adclient.Client
+	ready       *readinessGate
+	rates       *rateCache
+	checkoutKey []byte
+	csrfKey     []byte
+	catalog     catalogIDs // product IDs last listed, to check links to products
+	facets      facetCache
+	renderer    *renderer
+	fragments   *fragmentCache // nil renders every partial
+	undo        *cartUndo      // nil disables undoing an emptied cart
+	forms       *formStates    // rejected forms, shown after the redirect
+	previews    *previewCards  // cards of the orders under review
+	addresses   *addressBook   // nil estimates shipping to anywhere
+	accounts    *accountStore  // nil disables signing up and logging in
+	oidc        *oidcProvider  // nil disables logging in with an identity provider
+	mirror      *shadowMirror  // nil disables mirroring requests to a shadow
+	monitor     *runtimeMonitor
+	stats       *rollingStats // nil counts nothing
+	metrics     *metrics      // nil disables /metrics
+	currencies  *currencySet  // nil offers the default whitelist
+
+	adBreaker             *circuitBreaker // nil always calls the ad service
+	recommendationBreaker *circuitBreaker // nil always calls the recommendation service
+	static                *staticAssets   // nil serves the static files from disk
+	injector              *errorInjector  // nil never injects errors
+	flags                 *featureFlags   // nil never injects faults
+	loadgen               *loadGenerator  // nil sends no synthetic traffic
+	reaper                *cartReaper     // nil keeps the carts of idle sessions
+	limiter               *rateLimiter    // nil never rate limits
+
+	shuttingDown int32         // set atomically once shutdown began
+	active       inFlight      // requests being served, waited for on shutdown
+	backendCheck *backendCheck // nil leaves the backends out of readiness
+	// watcher follows the backend connections; nil does not.
+	watcher *backendWatcher
+
+	// sessions issues session cookies; nil leaves them unsigned.
+	sessions      *sessionManager
+	cartMigration *cartMigrations // nil disables cart migration
+
+	curation *curationStore // nil without curated category content
+
+	// composeBudget bounds the wait for the decorative sections of streamed
+	// pages, from the start of the request; zero waits for them.
+	composeBudget time.Duration
+	// rpcTimeouts bounds the calls to each backend; nil uses the defaults.
+	rpcTimeouts rpcTimeouts
+	retries     *retryPolicy // of the idempotent calls; nil never retries
+	hedges      *hedgePolicy // of the catalog reads; nil never hedges
+	// outbound caps the backend calls in flight; nil does not.
+	outbound *outboundLimit
+	// catalogCache keeps the products and currencies; nil disables it.
+	catalogCache *catalogCache
+
+	// snapshotPath is the file the in-memory state is saved to and
+	// restored from; empty disables snapshots.
+	snapshotPath string
+
+	adminToken       string
+	debugToken       string // also grants access to /debug/flags and /debug/headers
+	traceURLTemplate string
+	debugEndpoints   bool          // debugging aids enabled for everyone
+	extraLatency     time.Duration // added to every page, like EXTRA_LATENCY in the backends
+	logSampleRate    float64       // share of the successful requests logged
+	// trustedProxies are believed in X-Forwarded-For; without any, the
+	// header is ignored.
+	trustedProxies trustedProxies
+	// platform is shown in a banner on every page; nil shows none.
+	platform *platformBanner
+
+	listenAddr string
+	tracing    string // tracing backends, for the startup summary
+	// tracingBackend is the TRACING_BACKEND; empty is the default.
+	tracingBackend string
+
+	// Limits keeping very large carts from exhausting the frontend; zero
+	// means no limit.
+	cartMaxRows      int
+	checkoutMaxItems int
+	cartMaxQuantity  int // at least 1
+
+	// totalTolerance is how much the charged order total may differ from
+	// the displayed cart total before it is reported.
+	totalTolerance pb.Money
+
+	// conversionConcurrency bounds the Convert calls of convertAll in
+	// flight; zero means defaultConversionConcurrency.
+	conversionConcurrency int
 }
 
 func main() {
+	preflight := flag.Bool("preflight", false, "check the catalog and currencies against the backends, print a JSON report and exit with status 1 if a check failed")
+	preflightSkip := flag.String("preflight-skip", "", "comma-separated preflight checks to skip: "+strings.Join(preflightChecks, ", "))
+	preflightTimeout := flag.Duration("preflight-timeout", defaultPreflightTimeout, "time allowed for all the preflight checks")
+	flag.Parse()
+
 	ctx := context.Background()
 	log := logrus.New()
 	log.Level = logrus.DebugLevel
@@ -93,17 +222,27 @@ func main() {
 		TimestampFormat: time.RFC3339Nano,
 	}
 	log.Out = os.Stdout
+	if *preflight {
+		log.Out = os.Stderr // keep stdout for the report
+	}
+	textLogs := os.Getenv("LOG_FORMAT") == "text"
+	if textLogs {
+		log.Formatter = &logrus.TextFormatter{FullTimestamp: true, TimestampFormat: time.RFC3339Nano}
+	}
 
-	if os.Getenv("DISABLE_TRACING") == "" {
-		log.Info("Tracing enabled.")
-		go initTracing(log)
+	tracingBackend := tracingBackendFromEnv(log)
+	stopTracing := func() {}
+	if tracingBackend != tracingNone && !*preflight {
+		log.WithField("backend", tracingBackend).Info("Tracing enabled.")
+		stopTracing = setupTracing(ctx, log, tracingBackend)
 	} else {
 		log.Info("Tracing disabled.")
+		setupTracing(ctx, log, tracingNone)
 	}
 
-	if os.Getenv("DISABLE_PROFILER") == "" {
+	if os.Getenv("DISABLE_PROFILER") == "" && !*preflight {
 		log.Info("Profiling enabled.")
-		go initProfiling(log, "frontend", "1.0.0")
+		go initProfiling(log, "frontend", version)
 	} else {
 		log.Info("Profiling disabled.")
 	}
@@ -114,44 +253,684 @@ func main() {
 	}
 	addr := os.Getenv("LISTEN_ADDR")
 	svc := new(frontendServer)
-	mustMapEnv(&svc.productCatalogSvcAddr, "PRODUCT_CATALOG_SERVICE_ADDR")
-	mustMapEnv(&svc.currencySvcAddr, "CURRENCY_SERVICE_ADDR")
-	mustMapEnv(&svc.cartSvcAddr, "CART_SERVICE_ADDR")
-	mustMapEnv(&svc.recommendationSvcAddr, "RECOMMENDATION_SERVICE_ADDR")
-	mustMapEnv(&svc.checkoutSvcAddr, "CHECKOUT_SERVICE_ADDR")
-	mustMapEnv(&svc.shippingSvcAddr, "SHIPPING_SERVICE_ADDR")
-	mustMapEnv(&svc.adSvcAddr, "AD_SERVICE_ADDR")
-
-	mustConnGRPC(ctx, &svc.currencySvcConn, svc.currencySvcAddr)
-	mustConnGRPC(ctx, &svc.productCatalogSvcConn, svc.productCatalogSvcAddr)
-	mustConnGRPC(ctx, &svc.cartSvcConn, svc.cartSvcAddr)
-	mustConnGRPC(ctx, &svc.recommendationSvcConn, svc.recommendationSvcAddr)
-	mustConnGRPC(ctx, &svc.shippingSvcConn, svc.shippingSvcAddr)
-	mustConnGRPC(ctx, &svc.checkoutSvcConn, svc.checkoutSvcAddr)
-	mustConnGRPC(ctx, &svc.adSvcConn, svc.adSvcAddr)
+	svc.ready = newReadinessGate()
+	svc.clock = newOffsetClock(realClock{})
+	svc.httpClient = newOutboundClient(defaultOutboundTimeout)
+	svc.listenAddr = addr + ":" + srvPort
+	svc.tracingBackend = tracingBackend
+	svc.tracing = tracingSummary(tracingBackend)
+
+	if err := view.Register(startupPhaseView); err != nil {
+		log.Warn("Error registering startup phase view")
+	}
+	var budget time.Duration
+	if v := os.Getenv("STARTUP_BUDGET_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			log.Warnf("invalid STARTUP_BUDGET_MS %q, ignoring", v)
+		} else {
+			budget = time.Duration(ms) * time.Millisecond
+		}
+	}
+	var requiredSteps []string
+	if v, ok := os.LookupEnv("STARTUP_REQUIRED_STEPS"); ok {
+		requiredSteps = []string{}
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				requiredSteps = append(requiredSteps, name)
+			}
+		}
+	}
+	st := newStartup(log, svc.ready, budget)
+	catalogRefresh, catalogPollInterval := catalogRefreshPoll, defaultCatalogPollInterval
+	runtimeSampleInterval := defaultRuntimeSampleInterval
+	currencyRefresh := defaultCurrencyRefresh
+	shutdownGrace := defaultShutdownGracePeriod
+	var srvConfig serverConfig
+
+	st.phase("config", func() {
+		mustMapEnv(&svc.productCatalogSvcAddr, "PRODUCT_CATALOG_SERVICE_ADDR")
+		mustMapEnv(&svc.currencySvcAddr, "CURRENCY_SERVICE_ADDR")
+		mustMapEnv(&svc.cartSvcAddr, "CART_SERVICE_ADDR")
+		mustMapEnv(&svc.recommendationSvcAddr, "RECOMMENDATION_SERVICE_ADDR")
+		mustMapEnv(&svc.checkoutSvcAddr, "CHECKOUT_SERVICE_ADDR")
+		mustMapEnv(&svc.shippingSvcAddr, "SHIPPING_SERVICE_ADDR")
+		mustMapEnv(&svc.adSvcAddr, "AD_SERVICE_ADDR")
+		svc.demoMode = os.Getenv("DEMO_MODE") == "true"
+		limits := runtimeLimits{Goroutines: defaultMaxGoroutines, QueueDepth: defaultMaxQueueDepth}
+		heapMB := defaultMaxHeapInUseMB
+		mapIntEnv(log, &limits.Goroutines, "RUNTIME_MAX_GOROUTINES")
+		mapIntEnv(log, &heapMB, "RUNTIME_MAX_HEAP_MB")
+		mapIntEnv(log, &limits.QueueDepth, "RUNTIME_MAX_QUEUE_DEPTH")
+		mapDurationEnv(log, &runtimeSampleInterval, "RUNTIME_SAMPLE_INTERVAL")
+		mapDurationEnv(log, &shutdownGrace, "SHUTDOWN_GRACE_PERIOD")
+		srvConfig = serverConfigFromEnv(log)
+		readinessTTL := defaultReadinessCacheTTL
+		mapDurationEnv(log, &readinessTTL, "READINESS_CACHE_TTL")
+		svc.backendCheck = newBackendCheck(readinessTTL)
+		limits.HeapInUse = uint64(heapMB) << 20
+		svc.monitor = newRuntimeMonitor(limits)
+		svc.adminToken = os.Getenv("ADMIN_TOKEN")
+		svc.debugEndpoints = os.Getenv("DEBUG_ENDPOINTS_ENABLED") == "true"
+		svc.debugToken = os.Getenv("DEBUG_API_TOKEN")
+		if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+			proxies, err := parseTrustedProxies(v)
+			if err != nil {
+				log.Warnf("invalid TRUSTED_PROXIES %q, ignoring X-Forwarded-For: %v", v, err)
+			} else {
+				svc.trustedProxies = proxies
+			}
+		}
+		svc.platform = newPlatformBanner()
+		if v := os.Getenv("ENV_PLATFORM"); v != "" {
+			if p, ok := parsePlatform(v); ok {
+				svc.platform.set(p)
+			} else {
+				log.Warnf("invalid ENV_PLATFORM %q, detecting the platform; want one of %s", v, strings.Join(platformIDs(), ", "))
+			}
+		}
+		mapDurationEnv(log, &svc.extraLatency, "FRONTEND_EXTRA_LATENCY")
+		svc.logSampleRate = 1
+		if v := os.Getenv("LOG_SAMPLING_RATE"); v != "" {
+			if p, err := strconv.ParseFloat(v, 64); err != nil || p < 0 || p > 1 {
+				log.Warnf("invalid LOG_SAMPLING_RATE %q, logging every request", v)
+			} else {
+				svc.logSampleRate = p
+			}
+		}
+		svc.composeBudget = defaultComposeBudget
+		mapDurationEnv(log, &svc.composeBudget, "HOME_COMPOSITION_BUDGET")
+		svc.rpcTimeouts = loadRPCTimeouts(log, svc.backends())
+		retries, retryDelay := defaultRPCRetries, defaultRPCRetryDelay
+		mapIntEnv(log, &retries, "RPC_RETRIES")
+		mapDurationEnv(log, &retryDelay, "RPC_RETRY_DELAY")
+		svc.retries = newRetryPolicy(retries, retryDelay)
+		var hedgeMS int
+		mapIntEnv(log, &hedgeMS, "HEDGE_DELAY_MS")
+		if hedgeMS > 0 {
+			svc.hedges = &hedgePolicy{delay: time.Duration(hedgeMS) * time.Millisecond}
+		}
+		maxOutbound := defaultMaxOutboundConcurrency
+		mapIntEnv(log, &maxOutbound, "MAX_OUTBOUND_CONCURRENCY")
+		svc.outbound = newOutboundLimit(maxOutbound)
+		svc.monitor.register("outbound_calls", svc.outbound.queued)
+		catalogTTL := defaultCatalogCacheTTL
+		if d, err := time.ParseDuration(os.Getenv("CATALOG_CACHE_TTL")); err == nil && d == 0 {
+			catalogTTL = 0 // disables the cache
+		} else {
+			mapDurationEnv(log, &catalogTTL, "CATALOG_CACHE_TTL")
+		}
+		svc.catalogCache = newCatalogCache(catalogTTL)
+		if svc.extraLatency > 0 {
+			log.Infof("extra latency enabled (duration: %v)", svc.extraLatency)
+		}
+		if v := os.Getenv("INSTANA_TRACE_URL_TEMPLATE"); v != "" {
+			if validTraceURLTemplate(v) {
+				svc.traceURLTemplate = v
+			} else {
+				log.Warnf("invalid INSTANA_TRACE_URL_TEMPLATE %q, it must be an http(s) URL containing %s", v, traceURLPlaceholder)
+			}
+		}
+		if mode, err := money.ParseRoundingMode(os.Getenv("MONEY_ROUNDING_MODE")); err != nil {
+			log.Warnf("%v, using %v", err, moneyRounding)
+		} else {
+			moneyRounding = mode
+		}
+		if v := os.Getenv("CHECKOUT_TOTAL_TOLERANCE"); v != "" {
+			tolerance, err := money.ParseAmount(v)
+			if err != nil || money.IsNegative(tolerance) {
+				log.Warnf("invalid CHECKOUT_TOTAL_TOLERANCE %q, using 0", v)
+			} else {
+				svc.totalTolerance = tolerance
+			}
+		}
+
+		svc.houseAd = &pb.Ad{RedirectUrl: defaultHouseAdURL, Text: defaultHouseAdText}
+		if v := os.Getenv("HOUSE_AD_TEXT"); v != "" {
+			svc.houseAd.Text = v
+		}
+		if v := os.Getenv("HOUSE_AD_URL"); v != "" {
+			svc.houseAd.RedirectUrl = v
+		}
+		if !adclient.ValidRedirectURL(svc.houseAd.RedirectUrl) {
+			log.Warnf("invalid HOUSE_AD_URL %q, using %q", svc.houseAd.RedirectUrl, defaultHouseAdURL)
+			svc.houseAd.RedirectUrl = defaultHouseAdURL
+		}
+
+		refresh, pinWindow := defaultRateRefresh, defaultRatePinWindow
+		mapDurationEnv(log, &refresh, "RATE_REFRESH_INTERVAL")
+		mapDurationEnv(log, &pinWindow, "CHECKOUT_PIN_WINDOW")
+		svc.cartMaxRows, svc.checkoutMaxItems = defaultCartMaxRows, defaultCheckoutMaxItems
+		mapIntEnv(log, &svc.cartMaxRows, "CART_MAX_ROWS")
+		mapIntEnv(log, &svc.checkoutMaxItems, "CHECKOUT_MAX_ITEMS")
+		svc.cartMaxQuantity = defaultCartMaxQuantity
+		mapIntEnv(log, &svc.cartMaxQuantity, "CART_MAX_QUANTITY")
+		if svc.cartMaxQuantity < 1 {
+			log.Warnf("invalid CART_MAX_QUANTITY %d, using %d", svc.cartMaxQuantity, defaultCartMaxQuantity)
+			svc.cartMaxQuantity = defaultCartMaxQuantity
+		}
+		svc.rates = newRateCache(refresh, pinWindow)
+		svc.rates.now = svc.clock.Now
+		svc.conversionConcurrency = defaultConversionConcurrency
+		mapIntEnv(log, &svc.conversionConcurrency, "CONVERSION_CONCURRENCY")
+		if svc.conversionConcurrency < 1 {
+			log.Warnf("invalid CONVERSION_CONCURRENCY %d, using %d", svc.conversionConcurrency, defaultConversionConcurrency)
+			svc.conversionConcurrency = defaultConversionConcurrency
+		}
+		if v := os.Getenv("CHECKOUT_STATE_SECRET"); v != "" {
+			svc.checkoutKey = []byte(v)
+		} else {
+			// Checkout forms rendered by other replicas cannot be verified
+			// with a random key; set CHECKOUT_STATE_SECRET when scaling out.
+			svc.checkoutKey = make([]byte, 32)
+			if _, err := rand.Read(svc.checkoutKey); err != nil {
+				log.Fatalf("failed to generate the checkout state key: %+v", err)
+			}
+		}
+		if v := os.Getenv("CSRF_SECRET"); v != "" {
+			svc.csrfKey = []byte(v)
+		} else {
+			// Forms rendered by other replicas cannot be verified with a
+			// random key; set CSRF_SECRET when scaling out.
+			svc.csrfKey = make([]byte, 32)
+			if _, err := rand.Read(svc.csrfKey); err != nil {
+				log.Fatalf("failed to generate the CSRF key: %+v", err)
+			}
+		}
+
+		svc.sessions = &sessionManager{maxAge: cookieMaxAge * time.Second}
+		if v := os.Getenv("SESSION_SIGNING_KEY"); v != "" {
+			svc.sessions.keys = &sessionKeys{current: []byte(v)}
+			if prev := os.Getenv("SESSION_SIGNING_KEY_PREVIOUS"); prev != "" {
+				svc.sessions.keys.previous = []byte(prev)
+			}
+		}
+		sessionHashKey = []byte(os.Getenv("SESSION_HASH_KEY"))
+		if os.Getenv("CART_MIGRATION") == "true" {
+			if svc.sessions.keys == nil {
+				log.Warn("CART_MIGRATION has no effect without SESSION_SIGNING_KEY")
+			}
+			svc.cartMigration = newCartMigrations()
+			svc.cartMigration.done.Now = svc.clock.Now
+			svc.monitor.register("migrated_sessions", svc.cartMigration.done.Len)
+		}
+		svc.sessions.acceptUnsigned = os.Getenv("SESSION_ACCEPT_UNSIGNED") == "true"
+		if svc.sessions.acceptUnsigned && svc.sessions.keys == nil {
+			log.Warn("SESSION_ACCEPT_UNSIGNED has no effect without SESSION_SIGNING_KEY")
+		}
+		mapDurationEnv(log, &svc.sessions.maxAge, "SESSION_COOKIE_MAX_AGE")
+		svc.sessions.secure = os.Getenv("SESSION_COOKIE_SECURE") == "true"
+		if v := os.Getenv("SESSION_COOKIE_SAMESITE"); v != "" {
+			mode, ok := parseSameSite(v)
+			if !ok {
+				log.Warnf("invalid SESSION_COOKIE_SAMESITE %q, leaving the attribute out", v)
+			}
+			svc.sessions.sameSite = mode
+		}
+		if os.Getenv("SESSION_REVOKE_ON_LOGOUT") == "true" {
+			svc.sessions.revoked = cache.New(maxRevokedSessions)
+		}
+		// CART_TTL=0 keeps the carts of idle sessions, and tracks none.
+		cartTTL := defaultCartTTL
+		if v := os.Getenv("CART_TTL"); v == "0" || v == "0s" {
+			cartTTL = 0
+		} else {
+			mapDurationEnv(log, &cartTTL, "CART_TTL")
+		}
+		if cartTTL > 0 {
+			svc.sessions.seen = newSessionsSeen(maxTrackedSessions)
+			svc.reaper = newCartReaper(cartTTL)
+			svc.monitor.register("tracked_sessions", svc.sessions.tracked)
+		}
+		if os.Getenv("ACCOUNTS_ENABLED") == "true" {
+			key := []byte(os.Getenv("ACCOUNT_SIGNING_KEY"))
+			if len(key) == 0 {
+				// Like the checkout state key: set ACCOUNT_SIGNING_KEY when
+				// scaling out, or shoppers are signed out by other replicas.
+				key = make([]byte, 32)
+				if _, err := rand.Read(key); err != nil {
+					log.Fatalf("failed to generate the account signing key: %+v", err)
+				}
+			}
+			svc.accounts = newAccountStore(key, bcrypt.DefaultCost)
+			svc.accounts.failures.Now = svc.clock.Now
+			svc.accounts.logins.now = svc.clock.Now
+			svc.accounts.logins.buckets.Now = svc.clock.Now
+		}
+		if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+			if clientID := os.Getenv("OIDC_CLIENT_ID"); clientID == "" {
+				log.Warn("OIDC_ISSUER has no effect without OIDC_CLIENT_ID")
+			} else {
+				svc.oidc = newOIDCProvider(issuer, clientID, os.Getenv("OIDC_CLIENT_SECRET"), svc.httpClient)
+				svc.oidc.redirectURL = os.Getenv("OIDC_REDIRECT_URL")
+				svc.oidc.requireCheckout = os.Getenv("OIDC_REQUIRE_CHECKOUT") == "true"
+				svc.oidc.now = svc.clock.Now
+				svc.oidc.pending.Now = svc.clock.Now
+				svc.monitor.register("oidc_pending", svc.oidc.pending.Len)
+			}
+		}
+
+		if v := os.Getenv("CATEGORY_CURATION_FILE"); v != "" {
+			refresh := defaultCurationRefresh
+			mapDurationEnv(log, &refresh, "CATEGORY_CURATION_REFRESH")
+			svc.curation = newCurationStore(v, refresh)
+			svc.curation.now = svc.clock.Now
+		}
+
+		svc.degradation = newDegradationRegistry()
+		svc.activity = newSessionActivity()
+		svc.orders = newOrderHistory()
+		confirmationTTL := defaultConfirmationTTL
+		mapDurationEnv(log, &confirmationTTL, "ORDER_CONFIRMATION_TTL")
+		svc.confirmed = newConfirmations(confirmationTTL)
+		svc.confirmed.now = svc.clock.Now
+		svc.monitor.register("order_confirmations", svc.confirmed.len)
+		svc.snapshotPath = os.Getenv("SESSION_SNAPSHOT")
+		svc.restoreSessionSnapshot(log)
+		svc.stats = newRollingStats()
+		svc.stats.now = svc.clock.Now
+		svc.stats.countInjected = os.Getenv("ERROR_INJECT_IN_STATS") == "true"
+		if os.Getenv("ENABLE_METRICS") != "false" {
+			svc.metrics = newMetrics()
+		}
+		breakers := defaultBreakerSettings
+		mapIntEnv(log, &breakers.failures, "CIRCUIT_BREAKER_FAILURES")
+		mapDurationEnv(log, &breakers.window, "CIRCUIT_BREAKER_WINDOW")
+		mapDurationEnv(log, &breakers.cooldown, "CIRCUIT_BREAKER_COOLDOWN")
+		if breakers.failures > 0 {
+			svc.adBreaker = newCircuitBreaker(log, "ad", breakers)
+			svc.adBreaker.now = svc.clock.Now
+			svc.recommendationBreaker = newCircuitBreaker(log, "recommendation", breakers)
+			svc.recommendationBreaker.now = svc.clock.Now
+		}
+		rules, err := parseInjectionRules(os.Getenv("ERROR_INJECT"))
+		if err != nil {
+			log.Warnf("invalid ERROR_INJECT, not injecting errors: %v", err)
+		}
+		svc.injector = newErrorInjector(rules)
+		flags, err := parseFaultFlags(os.Getenv("FAULT_FLAGS"))
+		if err != nil {
+			log.Warnf("invalid FAULT_FLAGS, not injecting faults: %v", err)
+		}
+		svc.flags = newFeatureFlags(flags)
+		if os.Getenv("ENABLE_SYNTHETIC_TRAFFIC") == "true" {
+			rps, users := float64(defaultSyntheticRPS), defaultSyntheticUsers
+			mapFloatEnv(log, &rps, "SYNTHETIC_TRAFFIC_RPS")
+			if rps <= 0 || rps > maxSyntheticRPS {
+				log.Warnf("invalid SYNTHETIC_TRAFFIC_RPS %v, using %v", rps, defaultSyntheticRPS)
+				rps = defaultSyntheticRPS
+			}
+			mapIntEnv(log, &users, "SYNTHETIC_TRAFFIC_USERS")
+			if users < 1 {
+				log.Warnf("invalid SYNTHETIC_TRAFFIC_USERS %d, using %d", users, defaultSyntheticUsers)
+				users = defaultSyntheticUsers
+			}
+			weights, err := parseSyntheticWeights(os.Getenv("SYNTHETIC_TRAFFIC_WEIGHTS"))
+			if err != nil {
+				log.Warnf("invalid SYNTHETIC_TRAFFIC_WEIGHTS, using the default weights: %v", err)
+				weights, _ = parseSyntheticWeights("")
+			}
+			svc.loadgen = newLoadGenerator(true, rps, users, weights)
+		}
+		var rps float64
+		mapFloatEnv(log, &rps, "RATE_LIMIT_RPS")
+		if rps > 0 {
+			svc.limiter = newRateLimiter(
+				rateLimitFromEnv(log, rateLimit{rate: rps, burst: int(math.Ceil(2 * rps))}, "RATE_LIMIT_RPS", "RATE_LIMIT_BURST"),
+				map[string]rateLimit{
+					http.MethodPost + " /cart/checkout": rateLimitFromEnv(log, defaultCheckoutRateLimit, "RATE_LIMIT_CHECKOUT_RPS", "RATE_LIMIT_CHECKOUT_BURST"),
+					http.MethodPost + " /cart":          rateLimitFromEnv(log, defaultCartRateLimit, "RATE_LIMIT_CART_RPS", "RATE_LIMIT_CART_BURST"),
+				},
+				os.Getenv("RATE_LIMIT_KEY") == "session")
+			svc.limiter.now = svc.clock.Now
+			svc.limiter.buckets.Now = svc.clock.Now
+			svc.monitor.register("rate_limit_keys", svc.limiter.len)
+		}
+		svc.fragments = newFragmentCache()
+		svc.fragments.stats = svc.stats
+		svc.catalogCache.stats = svc.stats
+
+		undoWindow := defaultCartUndoWindow
+		mapDurationEnv(log, &undoWindow, "CART_UNDO_WINDOW")
+		svc.undo = newCartUndo(undoWindow)
+		svc.undo.snapshots.Now = svc.clock.Now
+		svc.monitor.register("cart_undo", svc.undo.snapshots.Len)
+		svc.reorders = newReorders()
+		var edge edgeCachePolicy
+		mapDurationEnv(log, &edge.maxAge, "EDGE_CACHE_MAX_AGE")
+		mapDurationEnv(log, &edge.staleWhileRevalidate, "EDGE_CACHE_STALE_WHILE_REVALIDATE")
+		if edge.maxAge > 0 {
+			svc.edgeCache = &edge
+		}
+		svc.reorders.outcomes.Now = svc.clock.Now
+		svc.monitor.register("reorders", svc.reorders.outcomes.Len)
+		svc.previews = newPreviewCards()
+		svc.previews.cards.Now = svc.clock.Now
+		svc.monitor.register("preview_cards", svc.previews.cards.Len)
+		svc.forms = newFormStates()
+		svc.forms.states.Now = svc.clock.Now
+		svc.monitor.register("form_states", svc.forms.states.Len)
+		svc.addresses = newAddressBook()
+		svc.addresses.addresses.Now = svc.clock.Now
+		svc.monitor.register("shipping_addresses", svc.addresses.addresses.Len)
+
+		if v := os.Getenv("CATALOG_REFRESH_MODE"); v != "" {
+			switch v {
+			case catalogRefreshPoll, catalogRefreshWatch, catalogRefreshOff:
+				catalogRefresh = v
+			default:
+				log.Warnf("invalid CATALOG_REFRESH_MODE %q, using %q", v, catalogRefresh)
+			}
+		}
+		mapDurationEnv(log, &catalogPollInterval, "CATALOG_POLL_INTERVAL")
+		currencies, err := parseCurrencies(os.Getenv("WHITELISTED_CURRENCIES"))
+		if err != nil {
+			log.Warnf("invalid WHITELISTED_CURRENCIES, using the defaults: %v", err)
+			currencies, _ = parseCurrencies("")
+		}
+		svc.currencies = newCurrencySet(currencies)
+		mapDurationEnv(log, &currencyRefresh, "CURRENCY_REFRESH_INTERVAL")
+
+		if v := os.Getenv("SHADOW_BASE_URL"); v != "" {
+			base, err := url.Parse(v)
+			if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+				log.Warnf("invalid SHADOW_BASE_URL %q, not mirroring requests", v)
+			} else {
+				percent, workers := float64(defaultShadowPercent), defaultShadowConcurrency
+				if v := os.Getenv("SHADOW_PERCENT"); v != "" {
+					if p, err := strconv.ParseFloat(v, 64); err != nil || p < 0 || p > 100 {
+						log.Warnf("invalid SHADOW_PERCENT %q, using %v", v, percent)
+					} else {
+						percent = p
+					}
+				}
+				mapIntEnv(log, &workers, "SHADOW_MAX_CONCURRENCY")
+				svc.mirror = newShadowMirror(base, percent, workers, svc.httpClient, log)
+				svc.monitor.register("shadow_queue", svc.mirror.queued)
+				log.Infof("mirroring %v%% of GET requests to %s", percent, base)
+			}
+		}
+	})
+	st.phase("templates", func() {
+		reload := os.Getenv("TEMPLATE_RELOAD") == "true"
+		rd, err := newRenderer(templateDir, reload)
+		if err != nil {
+			log.Fatalf("failed to parse templates: %+v", err)
+		}
+		svc.renderer = rd
+		if reload {
+			log.Warn("reloading the templates for every page")
+		}
+	})
+	st.phase("static", func() {
+		dir := findStaticDir("./static")
+		static, err := loadStaticAssets(dir)
+		if err != nil {
+			log.Fatalf("failed to load static files: %+v", err)
+		}
+		static.notFound = svc.staticNotFoundHandler
+		svc.static = static
+		versionedAssets = static
+		log.WithField("dir", dir).Debugf("loaded %d static files", len(static.files))
+	})
+	st.phase("dial", func() {
+		for _, d := range []struct {
+			conn **grpc.ClientConn
+			addr string
+		}{
+			{&svc.currencySvcConn, svc.currencySvcAddr},
+			{&svc.productCatalogSvcConn, svc.productCatalogSvcAddr},
+			{&svc.cartSvcConn, svc.cartSvcAddr},
+			{&svc.recommendationSvcConn, svc.recommendationSvcAddr},
+			{&svc.shippingSvcConn, svc.shippingSvcAddr},
+			{&svc.checkoutSvcConn, svc.checkoutSvcAddr},
+			{&svc.adSvcConn, svc.adSvcAddr},
+		} {
+			if err := dialGRPC(ctx, d.conn, d.addr, svc.dialOptions()...); err != nil {
+				log.Fatal(err)
+			}
+		}
+		svc.initClients()
+		reconnectAfter := defaultBackendReconnectAfter
+		mapDurationEnv(log, &reconnectAfter, "BACKEND_RECONNECT_AFTER")
+		svc.watcher = newBackendWatcher(reconnectAfter)
+		svc.watcher.now = svc.clock.Now
+		svc.watchBackends(ctx, log)
+	})
+	if *preflight {
+		skip, err := parsePreflightSkip(*preflightSkip)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(svc.preflight(ctx, log, os.Stdout, skip, *preflightTimeout))
+	}
+	// The background loops stop on shutdown, before the connections they
+	// use are closed.
+	ctx, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+	switch catalogRefresh {
+	case catalogRefreshOff:
+	case catalogRefreshWatch:
+		log.Warn("the catalog service cannot stream catalog changes yet, polling it instead")
+		fallthrough
+	default:
+		go svc.watchCatalog(ctx, log, catalogPollInterval)
+	}
+	go svc.watchCurrencies(ctx, log, currencyRefresh)
+	go svc.sweepConfirmations(ctx, log, confirmationSweepPeriod)
+	if svc.reaper != nil {
+		reapInterval := defaultCartReapInterval
+		mapDurationEnv(log, &reapInterval, "CART_REAP_INTERVAL")
+		go svc.reapCarts(ctx, log, reapInterval)
+	}
+	go svc.monitor.run(ctx, log, svc.clock, runtimeSampleInterval)
+	for _, step := range svc.startupSteps(requiredSteps) {
+		st.background(step)
+	}
+	go func() {
+		st.wait()
+		svc.logStartupSummary(log, textLogs)
+	}()
+
+	var handler http.Handler
+	st.phase("routes", func() {
+		router, err := svc.router()
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = svc.handler(log, router)
+		if os.Getenv("ROUTE_SELF_CHECK") == "true" {
+			if err := selfCheck(handler, selfCheckPaths(router)); err != nil {
+				log.Fatal(err)
+			}
+		}
+	})
 
+	lis, err := srvConfig.listen(svc.listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := srvConfig.server(handler)
+	if srvConfig.tls() && srvConfig.redirectPort != "" {
+		redirect := srvConfig.redirectServer(srvPort)
+		redirect.Addr = addr + ":" + srvConfig.redirectPort
+		srv.RegisterOnShutdown(func() { redirect.Close() })
+		go func() {
+			if err := redirect.ListenAndServe(); err != http.ErrServerClosed {
+				log.WithField("error", err).Error("HTTPS redirect server stopped")
+			}
+		}()
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	log.Infof("starting server on %s, %s", svc.listenAddr, srvConfig.protocol())
+	svc.loadgen.run(log, handler)
+	if err := svc.serve(log, srv, lis, sigs, shutdownGrace, stopBackground); err != nil {
+		log.Fatal(err)
+	}
+	stopTracing()
+}
+
+// initClients creates the backend client wrappers once the connections are
+// established.
+func (fe *frontendServer) initClients() {
+	fe.ads = adclient.New(pb.NewAdServiceClient(fe.adSvcConn), adclient.Config{
+		Timeout:  fe.rpcTimeouts.of("ad"),
+		Fallback: fe.houseAd,
+		Observe: func(err error) {
+			fe.degradation.observe(depAds, err)
+			fe.adBreaker.record(err)
+		},
+	})
+}
+
+// router builds the router with all the routes of the enabled features. It
+// fails if routes conflict or cannot be served, see routeTable.
+func (fe *frontendServer) router() (*mux.Router, error) {
 	r := mux.NewRouter()
-	r.HandleFunc("/", svc.homeHandler).Methods(http.MethodGet, http.MethodHead)
-	r.HandleFunc("/product/{id}", svc.productHandler).Methods(http.MethodGet, http.MethodHead)
-	r.HandleFunc("/cart", svc.viewCartHandler).Methods(http.MethodGet, http.MethodHead)
-	r.HandleFunc("/cart", svc.addToCartHandler).Methods(http.MethodPost)
-	r.HandleFunc("/cart/empty", svc.emptyCartHandler).Methods(http.MethodPost)
-	r.HandleFunc("/setCurrency", svc.setCurrencyHandler).Methods(http.MethodPost)
-	r.HandleFunc("/logout", svc.logoutHandler).Methods(http.MethodGet)
-	r.HandleFunc("/cart/checkout", svc.placeOrderHandler).Methods(http.MethodPost)
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
-	r.HandleFunc("/robots.txt", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "User-agent: *\nDisallow: /") })
-	r.HandleFunc("/_healthz", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") })
+	t := newRouteTable(r)
+	t.handleFunc("/", fe.homeHandler, http.MethodGet, http.MethodHead)
+	t.handleFunc("/product/{id}", fe.productHandler, http.MethodGet, http.MethodHead)
+	t.handleFunc("/category/{name}", fe.categoryHandler, http.MethodGet, http.MethodHead)
+	t.handleFunc("/cart", fe.viewCartHandler, http.MethodGet, http.MethodHead)
+	t.handleFunc("/cart", fe.addToCartHandler, http.MethodPost)
+	t.handleFunc("/cart/update", fe.updateCartHandler, http.MethodPost)
+	t.handleFunc("/cart/shipping-estimate", fe.shippingEstimateHandler, http.MethodPost)
+	t.handleFunc("/cart/empty", fe.emptyCartHandler, http.MethodPost)
+	t.handleFunc("/cart/undo", fe.undoEmptyCartHandler, http.MethodPost)
+	t.handleFunc("/cart/reorder", fe.reorderHandler, http.MethodPost)
+	t.handleFunc("/setCurrency", fe.setCurrencyHandler, http.MethodPost)
+	t.handleFunc("/setLocale", fe.setLocaleHandler, http.MethodPost)
+	t.handleFunc("/logout", fe.logoutHandler, http.MethodPost)
+	t.handleFunc("/resume/dismiss", fe.dismissResumeHandler, http.MethodPost)
+	if fe.accounts != nil {
+		t.handleFunc("/signup", fe.signupFormHandler, http.MethodGet, http.MethodHead)
+		t.handleFunc("/signup", fe.signupHandler, http.MethodPost)
+		t.handleFunc("/login", fe.loginFormHandler, http.MethodGet, http.MethodHead)
+		t.handleFunc("/login", fe.loginHandler, http.MethodPost)
+	}
+	if fe.oidc != nil {
+		t.handleFunc("/auth/login", fe.oidcLoginHandler, http.MethodGet)
+		t.handleFunc("/auth/callback", fe.oidcCallbackHandler, http.MethodGet)
+		t.handleFunc("/auth/logout", fe.oidcLogoutHandler, http.MethodGet)
+	}
+	t.handleFunc("/cart/checkout", fe.placeOrderHandler, http.MethodPost)
+	t.handleFunc("/cart/checkout/preview", fe.checkoutPreviewHandler, http.MethodPost)
+	t.handleFunc("/order/{order_id}", fe.orderHandler, http.MethodGet, http.MethodHead)
+	t.handleFunc("/orders", fe.ordersHandler, http.MethodGet, http.MethodHead)
+	t.handleFunc("/api/status", fe.statusHandler, http.MethodGet)
+	t.document("/api/status", http.MethodGet, apiOperation{
+		Summary:  "Degraded backends and features, as shown in the banner",
+		Response: degradationStatus{},
+	})
+	t.handleFunc("/api/cart/totals", fe.cartTotalsHandler, http.MethodGet)
+	t.document("/api/cart/totals", http.MethodGet, apiOperation{
+		Summary:  "Cost of the session's cart in each of the given currencies",
+		Params:   []apiParam{apiCurrenciesParam},
+		Response: cartTotals{},
+		Errors:   []int{http.StatusBadRequest, http.StatusInternalServerError},
+	})
+	fe.apiV1Routes(t)
+	t.handleFunc("/api/openapi.json", t.openAPIHandler, http.MethodGet)
+	t.document("/api/openapi.json", http.MethodGet, apiOperation{
+		Summary:  "This OpenAPI description",
+		Response: map[string]interface{}{},
+	})
+	if fe.demoMode {
+		t.handleFunc("/whoami", fe.whoamiHandler, http.MethodGet, http.MethodHead)
+		t.handleFunc("/admin/clock/offset", fe.clockOffsetHandler, http.MethodPost)
+	}
+	static := http.Handler(http.FileServer(http.Dir("./static/")))
+	if fe.static != nil {
+		static = fe.static
+	}
+	t.handlePrefix("/static/", http.StripPrefix("/static/", static))
+	t.handleFunc("/robots.txt", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "User-agent: *\nDisallow: /") })
+	t.handleFunc("/_healthz", fe.healthHandler)
+	t.handleFunc("/_readyz", fe.readyHandler)
+	if fe.metrics != nil {
+		t.handleFunc("/metrics", fe.metricsHandler, http.MethodGet)
+	}
+	t.handleFunc("/debug/deps", fe.debugDepsHandler, http.MethodGet)
+	t.handleFunc("/debug/config", fe.debugConfigHandler, http.MethodGet)
+	t.handleFunc("/debug/goroutines", fe.goroutinesHandler, http.MethodGet)
+	t.handleFunc("/debug/cache/flush", fe.catalogCacheFlushHandler, http.MethodPost)
+	t.handleFunc("/debug/backends", fe.debugDepsHandler, http.MethodGet)
+	t.handleFunc("/debug/backends/events", fe.debugBackendEventsHandler, http.MethodGet)
+	if fe.reaper != nil {
+		t.handleFunc("/debug/reaper", fe.debugReaperHandler, http.MethodGet)
+	}
+	t.handleFunc("/admin/orders/export", fe.exportOrdersHandler, http.MethodGet)
+	t.handleFunc("/admin/session/snapshot", fe.sessionSnapshotHandler, http.MethodPost)
+	t.handleFunc("/admin/preflight", fe.preflightHandler, http.MethodGet)
+	t.handleFunc("/api/stats", fe.statsHandler, http.MethodGet)
+	t.document("/api/stats", http.MethodGet, apiOperation{
+		Summary:  "Rolling request, order and cache statistics",
+		Debug:    true,
+		Response: statsReport{},
+	})
+	t.handleFunc("/debug/openapi", fe.openAPIPageHandler, http.MethodGet)
+	t.handleFunc("/debug/headers", fe.debugHeadersHandler, http.MethodGet)
+	t.handleFunc("/admin/dashboard", fe.dashboardHandler, http.MethodGet)
+	t.handleFunc("/admin/stats/reset", fe.resetStatsHandler, http.MethodPost)
+	t.handleFunc("/admin/sessions/match", fe.matchSessionHashHandler, http.MethodPost)
+	if fe.injector != nil {
+		t.handleFunc("/admin/error-injection", fe.errorInjectionHandler, http.MethodGet, http.MethodPost)
+	}
+	if fe.flags != nil {
+		t.handleFunc("/debug/flags", fe.flagsHandler, http.MethodGet, http.MethodPost)
+	}
+	if fe.loadgen != nil {
+		t.handleFunc("/debug/loadgen", fe.loadgenHandler, http.MethodGet, http.MethodPost)
+	}
+	t.public("/", "/product/{id}", "/category/{name}")
+	if err := t.err(); err != nil {
+		return nil, err
+	}
+	r.Use(tagRoute)
+	if fe.edgeCache != nil {
+		r.Use(edgeCaching(fe.edgeCache, t.publicPages))
+	}
+	if fe.injector != nil {
+		r.Use(fe.injector.middleware)
+	}
+	if fe.flags != nil {
+		r.Use(fe.faultFlags)
+	}
+	return r, nil
+}
 
+// handler wraps the router in the middleware chain shared by every request.
+func (fe *frontendServer) handler(log *logrus.Logger, r *mux.Router) http.Handler {
 	var handler http.Handler = r
-	handler = &logHandler{log: log, next: handler} // add logging
-	handler = ensureSessionID(handler)             // add session ID
-	handler = &ochttp.Handler{                     // add opencensus instrumentation
-		Handler:     handler,
-		Propagation: &b3.HTTPFormat{}}
-
-	log.Infof("starting server on " + addr + ":" + srvPort)
-	log.Fatal(http.ListenAndServe(addr+":"+srvPort, handler))
+	if fe.demoMode {
+		handler = fe.recordActivity(handler) // remember requests for /whoami
+	}
+	if fe.accounts != nil {
+		handler = fe.identifyAccount(handler) // add the signed-in account
+	}
+	if fe.mirror != nil {
+		handler = fe.mirror.wrap(handler) // replay a sample against the shadow
+	}
+	if fe.stats != nil {
+		handler = fe.stats.wrap(r, handler) // count requests for /api/stats
+	}
+	if fe.metrics != nil {
+		handler = fe.metrics.wrap(r, handler) // count requests for /metrics
+	}
+	handler = fe.verifyCSRF(handler)                                                                                          // reject forged form posts
+	handler = fe.rateLimit(handler)                                                                                           // shed load over the rate limits
+	handler = &logHandler{log: log, clock: fe.clock, trusted: fe.trustedProxies, sampleRate: fe.logSampleRate, next: handler} // add logging
+	handler = withRequestID(handler)                                                                                          // add request ID
+	handler = fe.ensureSessionID(log, handler)                                                                                // add session ID
+	handler = fe.active.track(handler)                                                                                        // count the requests in flight
+	if fe.tracingBackend != tracingNone {
+		handler = &ochttp.Handler{ // add opencensus instrumentation
+			Handler:        handler,
+			Propagation:    fe.httpPropagation(),
+			FormatSpanName: routeSpanName(r)}
+	}
+	return handler
 }
 
 func initJaegerTracing(log logrus.FieldLogger) {
@@ -190,6 +969,18 @@ func initStats(log logrus.FieldLogger, exporter *stackdriver.Exporter) {
 	} else {
 		log.Info("Registered grpc default client views")
 	}
+	if err := view.Register(append(ochttp.DefaultClientViews, redisLatencyView, redisCommandsView)...); err != nil {
+		log.Warn("Error registering outbound client views")
+	}
+	if err := view.Register(totalDiscrepanciesView, checkoutRerendersView, deadLinksView, deprecatedRequestsView); err != nil {
+		log.Warn("Error registering checkout views")
+	}
+	if err := view.Register(shadowRequestsView, shadowLatencyView, shadowDivergencesView, shadowDroppedView); err != nil {
+		log.Warn("Error registering shadow views")
+	}
+	if err := view.Register(goroutineCountView, heapInUseView, queueDepthView); err != nil {
+		log.Warn("Error registering runtime views")
+	}
 }
 
 func initStackdriverTracing(log logrus.FieldLogger) {
@@ -261,13 +1052,48 @@ func mustMapEnv(target *string, envKey string) {
 	*target = v
 }
 
-func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
-	var err error
-	*conn, err = grpc.DialContext(ctx, addr,
-		grpc.WithInsecure(),
-		grpc.WithTimeout(time.Second*3),
-		grpc.WithStatsHandler(&ocgrpc.ClientHandler{}))
-	if err != nil {
-		panic(errors.Wrapf(err, "grpc: failed to connect %s", addr))
+// mapIntEnv sets target from an optional non-negative integer environment
+// variable, keeping its value when the variable is unset or invalid.
+func mapIntEnv(log logrus.FieldLogger, target *int, envKey string) {
+	v := os.Getenv(envKey)
+	if v == "" {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Warnf("invalid %s %q, using %d", envKey, v, *target)
+		return
+	}
+	*target = n
+}
+
+// mapFloatEnv sets target from an optional non-negative, finite number
+// environment variable, keeping its value when the variable is unset or
+// invalid.
+func mapFloatEnv(log logrus.FieldLogger, target *float64, envKey string) {
+	v := os.Getenv(envKey)
+	if v == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		log.Warnf("invalid %s %q, using %v", envKey, v, *target)
+		return
+	}
+	*target = f
+}
+
+// mapDurationEnv sets target from an optional positive duration environment
+// variable, keeping its value when the variable is unset or invalid.
+func mapDurationEnv(log logrus.FieldLogger, target *time.Duration, envKey string) {
+	v := os.Getenv(envKey)
+	if v == "" {
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Warnf("invalid %s %q, using %v", envKey, v, *target)
+		return
 	}
+	*target = d
 }
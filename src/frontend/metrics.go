@@ -0,0 +1,258 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+)
+
+// metricsContentType is the Prometheus text exposition format, version
+// 0.0.4.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metricsLatencyBounds are the upper bounds, in seconds, of the latency
+// histograms.
+var metricsLatencyBounds = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics are the series scraped by Prometheus at /metrics. They are
+// written in the text exposition format by hand, like /api/stats needs no
+// client library; the OpenCensus views exported to Stackdriver are left as
+// they are. Its methods accept a nil *metrics, which counts nothing.
+type metrics struct {
+	requests  *metricVec // by route and status code
+	rpcs      *metricVec // by backend service and method
+	cartAdds  *metricVec
+	checkouts *metricVec // by result
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: newHistogramVec("frontend_http_request_duration_seconds",
+			"Latency of the requests served, by route and status code.", "route", "code"),
+		rpcs: newHistogramVec("frontend_grpc_client_duration_seconds",
+			"Latency of the calls to the backends, retries included, by service and method.", "service", "method"),
+		cartAdds: newCounterVec("frontend_cart_adds_total",
+			"Products added to a cart by the shoppers."),
+		checkouts: newCounterVec("frontend_checkouts_total",
+			"Orders placed, or failed, by result.", "result"),
+	}
+}
+
+// metricVec is a counter, or a histogram if it has bounds, for each
+// combination of values of its labels.
+type metricVec struct {
+	name, help string
+	labels     []string
+	bounds     []float64 // nil for a counter
+
+	mu     sync.Mutex
+	series map[string]*metricSeries // by label values joined with \x00
+}
+
+type metricSeries struct {
+	values  []string
+	buckets []uint64 // counts by bound, not cumulative; then above them
+	sum     float64
+	count   uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, labels: labels, series: make(map[string]*metricSeries)}
+}
+
+func newHistogramVec(name, help string, labels ...string) *metricVec {
+	v := newCounterVec(name, help, labels...)
+	v.bounds = metricsLatencyBounds
+	return v
+}
+
+// observe adds x to the series of the label values.
+func (v *metricVec) observe(x float64, values ...string) {
+	key := strings.Join(values, "\x00")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &metricSeries{values: values, buckets: make([]uint64, len(v.bounds)+1)}
+		v.series[key] = s
+	}
+	s.buckets[sort.SearchFloat64s(v.bounds, x)]++
+	s.sum += x
+	s.count++
+}
+
+// write writes the series of v, sorted by label values.
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	typ := "counter"
+	if v.bounds != nil {
+		typ = "histogram"
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, typ)
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		labels := formatLabels(v.labels, s.values)
+		if v.bounds == nil {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, labels, formatFloat(s.sum))
+			continue
+		}
+		names := append(v.labels[:len(v.labels):len(v.labels)], "le")
+		var n uint64
+		for i, c := range s.buckets {
+			n += c
+			le := "+Inf"
+			if i < len(v.bounds) {
+				le = formatFloat(v.bounds[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(names, append(s.values[:len(s.values):len(s.values)], le)), n)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, labels, s.count)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns {name="value",...}, or nothing without labels.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", n, labelValueEscaper.Replace(values[i]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(x float64) string { return strconv.FormatFloat(x, 'g', -1, 64) }
+
+// wrap counts the requests served by the handler of router.
+func (m *metrics) wrap(router *mux.Router, next http.Handler) http.Handler {
+	name := routeSpanName(router)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rr := &responseRecorder{w: w}
+		next.ServeHTTP(rr, r)
+		code := rr.status
+		if code == 0 {
+			code = http.StatusOK
+		}
+		m.requests.observe(time.Since(start).Seconds(), name(r), strconv.Itoa(code))
+	})
+}
+
+// intercept is a gRPC client interceptor timing the calls to the backends.
+func (m *metrics) intercept(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if m == nil {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	service, name := splitMethodName(method)
+	m.rpcs.observe(time.Since(start).Seconds(), service, name)
+	return err
+}
+
+// splitMethodName splits "/package.Service/Method" in its service and
+// method.
+func splitMethodName(fullMethod string) (service, method string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", fullMethod
+}
+
+// cartAdd counts a product added to a cart.
+func (m *metrics) cartAdd() {
+	if m == nil {
+		return
+	}
+	m.cartAdds.observe(1)
+}
+
+// checkout counts an order placed, or failed with err.
+func (m *metrics) checkout(err error) {
+	if m == nil {
+		return
+	}
+	result := "placed"
+	if err != nil {
+		result = "failed"
+	}
+	m.checkouts.observe(1, result)
+}
+
+// writeRuntime writes the state of the Go runtime.
+func writeRuntime(w io.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	for _, g := range []struct {
+		name, help string
+		value      float64
+	}{
+		{"go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine())},
+		{"go_threads", "Number of OS threads created.", float64(pprof.Lookup("threadcreate").Count())},
+		{"go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(ms.Alloc)},
+		{"go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(ms.HeapInuse)},
+		{"go_memstats_heap_objects", "Number of allocated objects.", float64(ms.HeapObjects)},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from system.", float64(ms.Sys)},
+		{"go_memstats_last_gc_time_seconds", "Number of seconds since 1970 of last garbage collection.", float64(ms.LastGC) / 1e9},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.value))
+	}
+	fmt.Fprintf(w, "# HELP go_gc_duration_seconds A summary of the pause duration of garbage collection cycles.\n"+
+		"# TYPE go_gc_duration_seconds summary\ngo_gc_duration_seconds_sum %s\ngo_gc_duration_seconds_count %d\n",
+		formatFloat(float64(ms.PauseTotalNs)/1e9), ms.NumGC)
+	fmt.Fprintf(w, "# HELP go_info Information about the Go environment.\n# TYPE go_info gauge\ngo_info%s 1\n",
+		formatLabels([]string{"version"}, []string{runtime.Version()}))
+}
+
+// metricsHandler serves the metrics to Prometheus.
+func (fe *frontendServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	bw := bufio.NewWriter(w)
+	for _, v := range []*metricVec{fe.metrics.requests, fe.metrics.rpcs, fe.metrics.cartAdds, fe.metrics.checkouts} {
+		v.write(bw)
+	}
+	writeRuntime(bw)
+	bw.Flush()
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) { fe.metrics = newMetrics() })
+	defer h.close()
+
+	h.get("/")
+	h.get("/product/NOSUCHITEM")
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	h.fail("/hipstershop.CheckoutService/PlaceOrder", status.Error(codes.Internal, "injected failure"))
+	h.postJSON("/api/v1/checkout", apiCheckoutBody)
+
+	resp := h.get("/metrics")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != metricsContentType {
+		t.Errorf("content type = %q, want %q", ct, metricsContentType)
+	}
+	for _, series := range []string{
+		`frontend_http_request_duration_seconds_count{route="GET /",code="200"} 1`,
+		`frontend_http_request_duration_seconds_bucket{route="GET /product/{id}",code="500",le="+Inf"} 1`,
+		`frontend_http_request_duration_seconds_count{route="POST /cart",code="302"} 1`,
+		`frontend_grpc_client_duration_seconds_count{service="hipstershop.CartService",method="AddItem"} 1`,
+		`frontend_grpc_client_duration_seconds_sum{service="hipstershop.ProductCatalogService",method="ListProducts"}`,
+		`frontend_cart_adds_total 1`,
+		`frontend_checkouts_total{result="failed"} 1`,
+		`# TYPE go_goroutines gauge`,
+		`go_memstats_heap_inuse_bytes `,
+		`go_gc_duration_seconds_count `,
+	} {
+		if !strings.Contains(resp.body, series) {
+			t.Errorf("no %s in:\n%s", series, resp.body)
+		}
+	}
+	for _, e := range h.logs.find("request") {
+		if e.Data["path"] == "/metrics" {
+			t.Error("scrape logged as a request")
+		}
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	if resp := h.get("/metrics"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestMetricVecLabels(t *testing.T) {
+	v := newCounterVec("c_total", "A counter.", "name")
+	v.observe(1, "quote\" and \\ and\nnewline")
+	var b strings.Builder
+	v.write(&b)
+	if want := `c_total{name="quote\" and \\ and\nnewline"} 1`; !strings.Contains(b.String(), want) {
+		t.Errorf("got %s, want %s", b.String(), want)
+	}
+}
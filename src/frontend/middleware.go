@@ -16,7 +16,9 @@ package main
 
 import (
 	"context"
+	"math/rand"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -25,12 +27,24 @@ import (
 
 type ctxKeyLog struct{}
 type ctxKeyRequestID struct{}
+type ctxKeyNewSession struct{}
 
+// logHandler gives each request a logger and logs one "request" entry per
+// request once it is served. Successful requests are logged at sampleRate,
+// errors always; probes and static files are never logged.
 type logHandler struct {
-	log  *logrus.Logger
-	next http.Handler
+	log        *logrus.Logger
+	clock      *offsetClock
+	trusted    trustedProxies // proxies believed in X-Forwarded-For
+	sampleRate float64        // in [0, 1]
+	sample     func() float64 // in [0, 1); rand.Float64 if nil
+	next       http.Handler
 }
 
+// unloggedPrefixes are the paths of the requests too frequent and too
+// uneventful to log.
+var unloggedPrefixes = []string{"/_healthz", "/_readyz", "/metrics", "/static/"}
+
 type responseRecorder struct {
 	b      int
 	status int
@@ -53,52 +67,121 @@ func (r *responseRecorder) WriteHeader(statusCode int) {
 	r.w.WriteHeader(statusCode)
 }
 
+// Flush passes the flushes of streamed pages through, when the underlying
+// writer supports them.
+func (r *responseRecorder) Flush() {
+	f, ok := r.w.(http.Flusher)
+	if !ok {
+		return
+	}
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	f.Flush()
+}
+
 func (lh *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	requestID, _ := uuid.NewRandom()
-	ctx = context.WithValue(ctx, ctxKeyRequestID{}, requestID.String())
+	requestID := requestIDFrom(ctx)
 
 	start := time.Now()
 	rr := &responseRecorder{w: w}
 	log := lh.log.WithFields(logrus.Fields{
 		"http.req.path":   r.URL.Path,
 		"http.req.method": r.Method,
-		"http.req.id":     requestID.String(),
+		"http.req.id":     requestID,
 	})
 	if v, ok := r.Context().Value(ctxKeySessionID{}).(string); ok {
-		log = log.WithField("session", v)
+		log = log.WithField("session", hashSessionID(v))
+	}
+	// Everything logged while the demo clock is moved says so.
+	if lh.clock != nil {
+		if off := lh.clock.Offset(); off != 0 {
+			log = log.WithField("clock_offset", off.String())
+		}
 	}
-	log.Debug("request started")
-	defer func() {
-		log.WithFields(logrus.Fields{
-			"http.resp.took_ms": int64(time.Since(start) / time.Millisecond),
-			"http.resp.status":  rr.status,
-			"http.resp.bytes":   rr.b}).Debugf("request complete")
-	}()
-
 	ctx = context.WithValue(ctx, ctxKeyLog{}, log)
 	r = r.WithContext(ctx)
 	lh.next.ServeHTTP(rr, r)
+
+	if !lh.logged(r.URL.Path, rr.status) {
+		return
+	}
+	entry := lh.log.WithFields(logrus.Fields{
+		"event":       "request",
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"status":      rr.status,
+		"bytes":       rr.b,
+		"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+		"request_id":  requestID,
+		"user_agent":  r.UserAgent(),
+		"remote_ip":   clientIP(r.RemoteAddr, r.Header["X-Forwarded-For"], lh.trusted),
+		"trace_id":    traceIDFromContext(ctx),
+	})
+	if v, ok := ctx.Value(ctxKeySessionID{}).(string); ok {
+		entry = entry.WithField("session", hashSessionID(v))
+	}
+	if rr.status >= http.StatusInternalServerError {
+		entry.Warn("request served")
+	} else {
+		entry.Info("request served")
+	}
+}
+
+// logged reports whether a request for path answered with status is
+// logged.
+func (lh *logHandler) logged(path string, status int) bool {
+	for _, p := range unloggedPrefixes {
+		if strings.HasPrefix(path, p) {
+			return false
+		}
+	}
+	if status >= http.StatusBadRequest || lh.sampleRate >= 1 {
+		return true
+	}
+	sample := lh.sample
+	if sample == nil {
+		sample = rand.Float64
+	}
+	return sample() < lh.sampleRate
 }
 
-func ensureSessionID(next http.Handler) http.HandlerFunc {
+// ensureSessionID puts the session ID in the request context, starting a new
+// session when there is no valid session cookie. With session keys, cookies
+// are signed; a cookie signed with the previous key starts a new session
+// into which its cart is migrated when cart migration is enabled. Cookies
+// failing verification otherwise never cause backend calls.
+func (fe *frontendServer) ensureSessionID(log logrus.FieldLogger, next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var sessionID string
+		var sessionID, oldSessionID string
+		var reissue, minted bool
 		c, err := r.Cookie(cookieSessionID)
-		if err == http.ErrNoCookie {
+		if err != nil && err != http.ErrNoCookie {
+			return
+		}
+		if c != nil {
+			sessionID, oldSessionID, reissue = fe.sessions.check(log, c.Value)
+		}
+		if sessionID == "" {
 			u, _ := uuid.NewRandom()
 			sessionID = u.String()
-			http.SetCookie(w, &http.Cookie{
-				Name:   cookieSessionID,
-				Value:  sessionID,
-				MaxAge: cookieMaxAge,
-			})
-		} else if err != nil {
-			return
-		} else {
-			sessionID = c.Value
+			reissue, minted = true, true
+		}
+		if reissue {
+			http.SetCookie(w, fe.sessions.cookie(sessionID))
+		}
+		if oldSessionID != "" && fe.cartMigration.begin(oldSessionID, fe.sessions.maxAge) {
+			if err := fe.migrateCart(r.Context(), log, oldSessionID, sessionID); err != nil {
+				fe.cartMigration.forget(oldSessionID)
+				log.WithField("error", err).Warn("failed to migrate the cart of a rotated session")
+			}
+		}
+		if !untrackedPath(r.URL.Path) {
+			fe.sessions.touch(sessionID, fe.clock.Now())
 		}
 		ctx := context.WithValue(r.Context(), ctxKeySessionID{}, sessionID)
+		ctx = context.WithValue(ctx, ctxKeyNewSession{}, minted)
 		r = r.WithContext(ctx)
 		next.ServeHTTP(w, r)
 	}
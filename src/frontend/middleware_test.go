@@ -0,0 +1,95 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRequestLog(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) {
+		fe.trustedProxies, _ = parseTrustedProxies("127.0.0.1,10.0.0.0/8")
+	})
+	defer h.close()
+
+	req, err := http.NewRequest(http.MethodGet, h.srv.URL+"/product/OLJCESPC7Z", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", "request-log-test")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	h.do(req)
+
+	entries := h.logs.find("request")
+	if len(entries) != 1 {
+		t.Fatalf("%d request entries, want 1", len(entries))
+	}
+	e := entries[0]
+	for field, want := range map[string]interface{}{
+		"method":     http.MethodGet,
+		"path":       "/product/OLJCESPC7Z",
+		"status":     http.StatusOK,
+		"user_agent": "request-log-test",
+		"remote_ip":  "203.0.113.7",
+		"session":    hashSessionID(h.cookie(cookieSessionID)),
+	} {
+		if got := e.Data[field]; got != want {
+			t.Errorf("%s = %v, want %v", field, got, want)
+		}
+	}
+	for _, field := range []string{"duration_ms", "request_id", "trace_id"} {
+		if v, ok := e.Data[field]; !ok || v == "" {
+			t.Errorf("%s missing from the request entry", field)
+		}
+	}
+	if e.Level != logrus.InfoLevel {
+		t.Errorf("level = %v, want info", e.Level)
+	}
+
+	h.get("/_healthz")
+	h.get("/static/styles/styles.css")
+	if n := len(h.logs.find("request")); n != 1 {
+		t.Errorf("%d request entries after probes and static files, want still 1", n)
+	}
+}
+
+func TestRequestLogSampling(t *testing.T) {
+	lh := &logHandler{sampleRate: 0.25, sample: func() float64 { return 0.5 }}
+	if lh.logged("/", http.StatusOK) {
+		t.Error("successful request logged above the sampling rate")
+	}
+	if !lh.logged("/", http.StatusNotFound) || !lh.logged("/", http.StatusInternalServerError) {
+		t.Error("failed request not logged")
+	}
+	lh.sample = func() float64 { return 0.1 }
+	if !lh.logged("/", http.StatusOK) {
+		t.Error("successful request not logged under the sampling rate")
+	}
+	if lh.logged("/_healthz", http.StatusServiceUnavailable) {
+		t.Error("health check logged")
+	}
+
+	h := newTestHarness(t, func(fe *frontendServer) { fe.logSampleRate = 0 })
+	defer h.close()
+	h.get("/")
+	h.get("/product/NOSUCHITEM")
+	entries := h.logs.find("request")
+	if len(entries) != 1 || entries[0].Data["status"] == http.StatusOK {
+		t.Errorf("request entries = %d, want only the failed one", len(entries))
+	}
+}
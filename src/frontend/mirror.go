@@ -0,0 +1,255 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+const (
+	defaultShadowPercent     = 10
+	defaultShadowConcurrency = 4
+	shadowQueueDepth         = 100
+	maxShadowBody            = 1 << 20 // read from shadow responses, then dropped
+	headerShadow             = "X-Shadow"
+)
+
+// mirrorExcludedPaths are never mirrored: they change state even on GET, or
+// are not meant for the shadow environment.
+var mirrorExcludedPaths = []string{"/admin/", "/debug/", "/auth/", "/logout", "/_healthz", "/_readyz"}
+
+var (
+	shadowStatusKey, _ = tag.NewKey("shadow_status")
+
+	shadowRequests = stats.Int64("frontend/shadow/requests",
+		"Requests replayed against the shadow environment", stats.UnitDimensionless)
+	shadowLatency = stats.Float64("frontend/shadow/latency",
+		"Latency of the requests replayed against the shadow environment", stats.UnitMilliseconds)
+	shadowDivergences = stats.Int64("frontend/shadow/divergences",
+		"Replayed requests answered with another status than the primary's", stats.UnitDimensionless)
+	shadowDropped = stats.Int64("frontend/shadow/dropped",
+		"Requests not replayed because the mirroring queue was full", stats.UnitDimensionless)
+
+	shadowRequestsView = &view.View{
+		Name:        "frontend/shadow/requests",
+		Measure:     shadowRequests,
+		Description: shadowRequests.Description(),
+		TagKeys:     []tag.Key{shadowStatusKey},
+		Aggregation: view.Count(),
+	}
+	shadowLatencyView = &view.View{
+		Name:        "frontend/shadow/latency",
+		Measure:     shadowLatency,
+		Description: shadowLatency.Description(),
+		Aggregation: view.Distribution(5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000),
+	}
+	shadowDivergencesView = &view.View{
+		Name:        "frontend/shadow/divergences",
+		Measure:     shadowDivergences,
+		Description: shadowDivergences.Description(),
+		Aggregation: view.Count(),
+	}
+	shadowDroppedView = &view.View{
+		Name:        "frontend/shadow/dropped",
+		Measure:     shadowDropped,
+		Description: shadowDropped.Description(),
+		Aggregation: view.Count(),
+	}
+)
+
+// shadowRequest is a served request to replay, with the primary's status.
+type shadowRequest struct {
+	method  string
+	uri     string
+	header  http.Header
+	primary int
+}
+
+// shadowMirror replays a sample of the GET requests against a shadow
+// environment, to compare a new build with the one serving. Requests are
+// queued once served and replayed by a fixed number of workers; when the
+// queue is full they are dropped, so a slow shadow never slows down the
+// primary.
+type shadowMirror struct {
+	base    *url.URL
+	percent float64
+	client  *http.Client
+	log     logrus.FieldLogger
+	sample  func() float64 // in [0, 100)
+
+	mu     sync.RWMutex // held to send on jobs, and to close it
+	closed bool
+	jobs   chan shadowRequest
+	wg     sync.WaitGroup
+}
+
+// newShadowMirror starts a mirror with the given number of workers.
+func newShadowMirror(base *url.URL, percent float64, workers int, client *http.Client, log logrus.FieldLogger) *shadowMirror {
+	// The shadow's redirects are compared with the primary's, not followed.
+	c := *client
+	c.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	m := &shadowMirror{
+		base:    base,
+		percent: percent,
+		client:  &c,
+		log:     log,
+		sample:  func() float64 { return rand.Float64() * 100 },
+		jobs:    make(chan shadowRequest, shadowQueueDepth),
+	}
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go m.work()
+	}
+	return m
+}
+
+// mirrorable reports whether a request may be replayed: GET requests out of
+// the excluded paths, not themselves replayed by another frontend.
+func mirrorable(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get(headerShadow) != "" {
+		return false
+	}
+	for _, p := range mirrorExcludedPaths {
+		if strings.HasPrefix(r.URL.Path, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// wrap mirrors the sampled requests served by next.
+func (m *shadowMirror) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !mirrorable(r) || m.sample() >= m.percent {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The request is copied before serving it, as handlers may alter it.
+		req := shadowRequest{method: r.Method, uri: r.URL.RequestURI(), header: make(http.Header, len(r.Header))}
+		for k, v := range r.Header {
+			req.header[k] = append([]string(nil), v...)
+		}
+		req.header.Del("Cookie")
+		req.header.Del("Authorization")
+		req.header.Set(headerShadow, "true")
+		rr := &responseRecorder{w: w}
+		next.ServeHTTP(rr, r)
+		req.primary = rr.status
+		if req.primary == 0 {
+			req.primary = http.StatusOK
+		}
+		m.enqueue(r.Context(), req)
+	})
+}
+
+// queued returns the number of requests waiting to be replayed.
+func (m *shadowMirror) queued() int { return len(m.jobs) }
+
+// enqueue queues a request without ever blocking.
+func (m *shadowMirror) enqueue(ctx context.Context, req shadowRequest) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return
+	}
+	select {
+	case m.jobs <- req:
+	default:
+		stats.Record(ctx, shadowDropped.M(1))
+	}
+}
+
+func (m *shadowMirror) work() {
+	defer m.wg.Done()
+	for req := range m.jobs {
+		m.replay(req)
+	}
+}
+
+// replay sends a request to the shadow and records its status and latency.
+// The response body is discarded.
+func (m *shadowMirror) replay(req shadowRequest) {
+	u := *m.base
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	target := u.String() + req.uri
+	status := "error"
+	start := time.Now()
+	r, err := http.NewRequest(req.method, target, nil)
+	if err == nil {
+		r.Header = req.header
+		var resp *http.Response
+		if resp, err = m.client.Do(r); err == nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxShadowBody))
+			resp.Body.Close()
+			status = strconv.Itoa(resp.StatusCode)
+		}
+	}
+	ctx, _ := tag.New(context.Background(), tag.Upsert(shadowStatusKey, status))
+	stats.Record(ctx, shadowRequests.M(1),
+		shadowLatency.M(float64(time.Since(start))/float64(time.Millisecond)))
+	if status != strconv.Itoa(req.primary) {
+		stats.Record(ctx, shadowDivergences.M(1))
+		m.log.WithFields(logrus.Fields{
+			"event":   "shadow_divergence",
+			"path":    req.uri,
+			"primary": req.primary,
+			"shadow":  status,
+			"error":   err,
+		}).Debug("shadow answered differently")
+	}
+}
+
+// close stops mirroring and waits for the queued requests to be replayed,
+// or for ctx to be done. Then, the requests still queued are dropped; those
+// being replayed are left to finish.
+func (m *shadowMirror) close(ctx context.Context) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.jobs)
+	}
+	m.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for range m.jobs {
+			stats.Record(context.Background(), shadowDropped.M(1))
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats/view"
+)
+
+// withMirror mirrors every GET request to shadow with the given number of
+// workers.
+func withMirror(shadow *httptest.Server, workers int) func(*frontendServer) {
+	return func(fe *frontendServer) {
+		base, _ := url.Parse(shadow.URL)
+		log := logrus.New()
+		log.Out = ioutil.Discard
+		fe.mirror = newShadowMirror(base, 100, workers, fe.httpClient, log)
+	}
+}
+
+// viewCount returns the count recorded by a count view without tags.
+func viewCount(t *testing.T, v *view.View) int64 {
+	t.Helper()
+	rows, err := view.RetrieveData(v.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 {
+		return 0
+	}
+	return rows[0].Data.(*view.CountData).Value
+}
+
+func TestMirrorable(t *testing.T) {
+	for _, tc := range []struct {
+		method, path string
+		shadow       bool
+		want         bool
+	}{
+		{http.MethodGet, "/", false, true},
+		{http.MethodGet, "/product/OLJCESPC7Z?utm=1", false, true},
+		{http.MethodGet, "/api/cart/totals", false, true},
+		{http.MethodHead, "/", false, false},
+		{http.MethodPost, "/cart", false, false},
+		{http.MethodPost, "/cart/checkout", false, false},
+		{http.MethodPost, "/logout", false, false},
+		{http.MethodGet, "/auth/callback", false, false},
+		{http.MethodGet, "/admin/orders/export", false, false},
+		{http.MethodGet, "/debug/config", false, false},
+		{http.MethodGet, "/_healthz", false, false},
+		{http.MethodGet, "/", true, false},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.shadow {
+			r.Header.Set(headerShadow, "true")
+		}
+		if got := mirrorable(r); got != tc.want {
+			t.Errorf("mirrorable(%s %s, shadow=%v) = %v, want %v", tc.method, tc.path, tc.shadow, got, tc.want)
+		}
+	}
+}
+
+func TestMirrorReplays(t *testing.T) {
+	if err := view.Register(shadowRequestsView, shadowDivergencesView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(shadowRequestsView, shadowDivergencesView)
+
+	var mu sync.Mutex
+	var replayed []*http.Request
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		replayed = append(replayed, r)
+		mu.Unlock()
+		if r.URL.Path == "/cart" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer shadow.Close()
+	h := newTestHarness(t, withMirror(shadow, 1))
+	defer h.close()
+
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/product/OLJCESPC7Z", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	h.do(req)
+	// Both redirect to GET requests, of the cart and of the home page.
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	h.post("/logout", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.fe.mirror.close(ctx); err != nil {
+		t.Fatalf("mirror did not shut down: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var paths []string
+	for _, r := range replayed {
+		paths = append(paths, r.URL.Path)
+		if r.Header.Get(headerShadow) != "true" || r.Header.Get("Cookie") != "" || r.Header.Get("Authorization") != "" {
+			t.Errorf("replay of %s has headers %v, want the shadow marker and no credentials", r.URL.Path, r.Header)
+		}
+	}
+	if strings.Join(paths, " ") != "/product/OLJCESPC7Z /cart /" {
+		t.Errorf("replayed %v, want the product page, the cart and the home page", paths)
+	}
+	if n := viewCount(t, shadowDivergencesView); n != 1 {
+		t.Errorf("%d divergences, want the cart only", n)
+	}
+}
+
+func TestMirrorSlowShadow(t *testing.T) {
+	if err := view.Register(shadowDroppedView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(shadowDroppedView)
+
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer shadow.Close()
+	h := newTestHarness(t, withMirror(shadow, 1))
+	defer h.close()
+
+	// The worker is stuck and the queue fills up; the primary does not notice.
+	const requests = shadowQueueDepth + 20
+	start := time.Now()
+	for i := 0; i < requests; i++ {
+		if resp := h.get("/robots.txt"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("primary answered %d", resp.StatusCode)
+		}
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("%d requests took %v with a stuck shadow", requests, d)
+	}
+	if n := viewCount(t, shadowDroppedView); n < requests-shadowQueueDepth-1 {
+		t.Errorf("%d requests dropped, want at least %d", n, requests-shadowQueueDepth-1)
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.fe.mirror.close(ctx); err != nil {
+		t.Fatalf("mirror did not drain its queue: %v", err)
+	}
+}
@@ -16,6 +16,7 @@ package money
 
 import (
 	"errors"
+	"math"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
 )
@@ -29,8 +30,24 @@ const (
 var (
 	ErrInvalidValue        = errors.New("one of the specified money values is invalid")
 	ErrMismatchingCurrency = errors.New("mismatching currency codes")
+	ErrOverflow            = errors.New("money value out of range")
+
+	ErrNanosOutOfRange = errors.New("nanos out of range")
+	ErrSignMismatch    = errors.New("units and nanos of different signs")
 )
 
+// Validate returns ErrNanosOutOfRange or ErrSignMismatch for an invalid
+// value, nil for a valid one.
+func Validate(m pb.Money) error {
+	if !validNanos(m.GetNanos()) {
+		return ErrNanosOutOfRange
+	}
+	if !signMatches(m) {
+		return ErrSignMismatch
+	}
+	return nil
+}
+
 // IsValid checks if specified value has a valid units/nanos signs and ranges.
 func IsValid(m pb.Money) bool {
 	return signMatches(m) && validNanos(m.GetNanos())
@@ -96,12 +113,17 @@ func Sum(l, r pb.Money) (pb.Money, error) {
 	} else if l.GetCurrencyCode() != r.GetCurrencyCode() {
 		return pb.Money{}, ErrMismatchingCurrency
 	}
-	units := l.GetUnits() + r.GetUnits()
+	units, ok := addUnits(l.GetUnits(), r.GetUnits())
+	if !ok {
+		return pb.Money{}, ErrOverflow
+	}
 	nanos := l.GetNanos() + r.GetNanos()
 
-	if (units == 0 && nanos == 0) || (units > 0 && nanos >= 0) || (units < 0 && nanos <= 0) {
+	if (units >= 0 && nanos >= 0) || (units <= 0 && nanos <= 0) {
 		// same sign <units, nanos>
-		units += int64(nanos / nanosMod)
+		if units, ok = addUnits(units, int64(nanos/nanosMod)); !ok {
+			return pb.Money{}, ErrOverflow
+		}
 		nanos = nanos % nanosMod
 	} else {
 		// different sign. nanos guaranteed to not to go over the limit
@@ -120,8 +142,68 @@ func Sum(l, r pb.Money) (pb.Money, error) {
 		CurrencyCode: l.GetCurrencyCode()}, nil
 }
 
+// SumAll adds values of the same currency. It returns the zero value for
+// none, and the errors of Sum.
+func SumAll(ms []pb.Money) (pb.Money, error) {
+	if len(ms) == 0 {
+		return pb.Money{}, nil
+	}
+	total := ms[0]
+	if !IsValid(total) {
+		return pb.Money{}, ErrInvalidValue
+	}
+	for _, m := range ms[1:] {
+		var err error
+		if total, err = Sum(total, m); err != nil {
+			return pb.Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// Multiply returns m times n. It returns ErrInvalidValue for an invalid m,
+// and ErrOverflow when the product does not fit.
+func Multiply(m pb.Money, n uint32) (pb.Money, error) {
+	if !IsValid(m) {
+		return pb.Money{}, ErrInvalidValue
+	}
+	// At most 999999999 × (2^32-1), well within an int64.
+	nanos := int64(m.GetNanos()) * int64(n)
+	units, ok := mulUnits(m.GetUnits(), int64(n))
+	if ok {
+		units, ok = addUnits(units, nanos/nanosMod)
+	}
+	if !ok {
+		return pb.Money{}, ErrOverflow
+	}
+	return pb.Money{
+		Units:        units,
+		Nanos:        int32(nanos % nanosMod),
+		CurrencyCode: m.GetCurrencyCode()}, nil
+}
+
+// addUnits returns a+b, and false if it overflows.
+func addUnits(a, b int64) (int64, bool) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, false
+	}
+	return a + b, true
+}
+
+// mulUnits returns a×b for b >= 0, and false if it overflows.
+func mulUnits(a, b int64) (int64, bool) {
+	if b == 0 {
+		return 0, true
+	}
+	if a > math.MaxInt64/b || a < math.MinInt64/b {
+		return 0, false
+	}
+	return a * b, true
+}
+
 // MultiplySlow is a slow multiplication operation done through adding the value
-// to itself n-1 times.
+// to itself n-1 times. It panics on overflow; Multiply returns an error
+// instead.
 func MultiplySlow(m pb.Money, n uint32) pb.Money {
 	out := m
 	for n > 1 {
@@ -16,8 +16,11 @@ package money
 
 import (
 	"fmt"
+	"math"
+	"math/big"
 	"reflect"
 	"testing"
+	"testing/quick"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
 )
@@ -228,8 +231,18 @@ func TestSum(t *testing.T) {
 		{"mixed (larger positive, with borrow)", args{mm(11, 100000000), mm(-2, -9000000 /*.09*/)}, mm(9, 91000000 /*.091*/), nil},
 		{"mixed (larger negative, no borrow)", args{mm(-11, -100000000), mm(2, 100000000)}, mm(-9, 0), nil},
 		{"mixed (larger negative, with borrow)", args{mm(-11, -100000000), mm(2, 9000000 /*.09*/)}, mm(-9, -91000000 /*.091*/), nil},
+		{"nanos only (no carry)", args{mm(0, 300000000), mm(0, 200000000)}, mm(0, 500000000), nil},
+		{"nanos only (carry)", args{mm(0, 600000000), mm(0, 700000000)}, mm(1, 300000000), nil},
+		{"negative nanos only (carry)", args{mm(0, -600000000), mm(0, -700000000)}, mm(-1, -300000000), nil},
 		{"0+negative", args{mm(0, 0), mm(-2, -100000000)}, mm(-2, -100000000), nil},
 		{"negative+0", args{mm(-2, -100000000), mm(0, 0)}, mm(-2, -100000000), nil},
+		{"max units", args{mm(math.MaxInt64-1, 0), mm(1, 0)}, mm(math.MaxInt64, 0), nil},
+		{"min units", args{mm(math.MinInt64+1, 0), mm(-1, 0)}, mm(math.MinInt64, 0), nil},
+		{"max units (borrow)", args{mm(math.MaxInt64, 100000000), mm(0, -200000000)}, mm(math.MaxInt64-1, 900000000), nil},
+		{"Error: units overflow", args{mm(math.MaxInt64, 0), mm(1, 0)}, mm(0, 0), ErrOverflow},
+		{"Error: units underflow", args{mm(math.MinInt64, 0), mm(-1, 0)}, mm(0, 0), ErrOverflow},
+		{"Error: carry overflow", args{mm(math.MaxInt64, 600000000), mm(0, 700000000)}, mm(0, 0), ErrOverflow},
+		{"Error: carry underflow", args{mm(math.MinInt64, -600000000), mm(0, -700000000)}, mm(0, 0), ErrOverflow},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -243,3 +256,161 @@ func TestSum(t *testing.T) {
 		})
 	}
 }
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		in   pb.Money
+		want error
+	}{
+		{mm(0, 0), nil},
+		{mm(1, 999999999), nil},
+		{mm(-1, -999999999), nil},
+		{mm(0, -1), nil},
+		{mm(math.MaxInt64, nanosMax), nil},
+		{mm(math.MinInt64, nanosMin), nil},
+		{mm(0, 1000000000), ErrNanosOutOfRange},
+		{mm(0, -1000000000), ErrNanosOutOfRange},
+		{mm(-1, 1000000000), ErrNanosOutOfRange},
+		{mm(1, -1), ErrSignMismatch},
+		{mm(-1, 1), ErrSignMismatch},
+	}
+	for _, tt := range tests {
+		if got := Validate(tt.in); got != tt.want {
+			t.Errorf("Validate(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+		if IsValid(tt.in) != (tt.want == nil) {
+			t.Errorf("IsValid(%v) disagrees with Validate", tt.in)
+		}
+	}
+}
+
+func TestMultiply(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       pb.Money
+		n       uint32
+		want    pb.Money
+		wantErr error
+	}{
+		{"zero times", mmc(3, 500000000, "USD"), 0, mmc(0, 0, "USD"), nil},
+		{"once", mmc(3, 500000000, "USD"), 1, mmc(3, 500000000, "USD"), nil},
+		{"no carry", mm(1, 200000000), 3, mm(3, 600000000), nil},
+		{"carry exactly one unit", mm(0, 500000000), 2, mm(1, 0), nil},
+		{"carry with remainder", mm(2, 999999999), 3, mm(8, 999999997), nil},
+		{"nanos only, large n", mm(0, 999999999), math.MaxUint32, mm(4294967290, 705032705), nil},
+		{"negative (carry)", mm(-1, -750000000), 2, mm(-3, -500000000), nil},
+		{"negative nanos only", mm(0, -1), 1000000000, mm(-1, 0), nil},
+		{"max units", mm(math.MaxInt64, 0), 1, mm(math.MaxInt64, 0), nil},
+		{"min units", mm(math.MinInt64, 0), 1, mm(math.MinInt64, 0), nil},
+		{"largest fitting product", mm(math.MaxInt64/2, 0), 2, mm(math.MaxInt64-1, 0), nil},
+		{"Error: units overflow", mm(math.MaxInt64/2+1, 0), 2, mm(0, 0), ErrOverflow},
+		{"Error: units underflow", mm(math.MinInt64/2-1, 0), 2, mm(0, 0), ErrOverflow},
+		{"Error: carry overflow", mm(math.MaxInt64, 500000000), 2, mm(0, 0), ErrOverflow},
+		{"Error: carry underflow", mm(math.MinInt64, -500000000), 2, mm(0, 0), ErrOverflow},
+		{"Error: invalid", mm(1, -1), 2, mm(0, 0), ErrInvalidValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Multiply(tt.m, tt.n)
+			if err != tt.wantErr {
+				t.Errorf("Multiply(%v, %d): expected err=%v got=%v", tt.m, tt.n, tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Multiply(%v, %d) = %v, want %v", tt.m, tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultiply_matchesMultiplySlow(t *testing.T) {
+	for _, m := range []pb.Money{mm(0, 0), mm(1, 999999999), mm(-7, -123456789), mm(0, 1)} {
+		for n := uint32(1); n <= 20; n++ {
+			got, err := Multiply(m, n)
+			if err != nil {
+				t.Fatalf("Multiply(%v, %d): %v", m, n, err)
+			}
+			if want := MultiplySlow(m, n); !reflect.DeepEqual(got, want) {
+				t.Errorf("Multiply(%v, %d) = %v, want %v", m, n, got, want)
+			}
+		}
+	}
+}
+
+func TestSumAll(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []pb.Money
+		want    pb.Money
+		wantErr error
+	}{
+		{"empty", nil, mm(0, 0), nil},
+		{"single", []pb.Money{mmc(1, 5, "EUR")}, mmc(1, 5, "EUR"), nil},
+		{"carry across several", []pb.Money{mm(0, 400000000), mm(0, 400000000), mm(0, 400000000)}, mm(1, 200000000), nil},
+		{"cancel out", []pb.Money{mm(5, 250000000), mm(-5, -250000000)}, mm(0, 0), nil},
+		{"overflow recovered by later term", []pb.Money{mm(math.MaxInt64, 0), mm(-1, 0), mm(1, 0)}, mm(math.MaxInt64, 0), nil},
+		{"Error: invalid single", []pb.Money{mm(1, -1)}, mm(0, 0), ErrInvalidValue},
+		{"Error: invalid later", []pb.Money{mm(1, 0), mm(0, nanosMod)}, mm(0, 0), ErrInvalidValue},
+		{"Error: currency", []pb.Money{mmc(1, 0, "USD"), mmc(1, 0, "EUR")}, mm(0, 0), ErrMismatchingCurrency},
+		{"Error: overflow", []pb.Money{mm(math.MaxInt64, 0), mm(0, 999999999), mm(0, 1)}, mm(0, 0), ErrOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SumAll(tt.in)
+			if err != tt.wantErr {
+				t.Errorf("SumAll(%v): expected err=%v got=%v", tt.in, tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SumAll(%v) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// bigNanos returns m as a count of nanos.
+func bigNanos(m pb.Money) *big.Int {
+	v := new(big.Int).Mul(big.NewInt(m.GetUnits()), big.NewInt(nanosMod))
+	return v.Add(v, big.NewInt(int64(m.GetNanos())))
+}
+
+// TestSumAll_quick checks SumAll against arbitrary precision arithmetic: it
+// either returns the exact, valid total or ErrOverflow when the total does
+// not fit. Running sums can overflow before later terms bring them back
+// into range, so ErrOverflow is also accepted when a prefix sum is out of
+// range.
+func TestSumAll_quick(t *testing.T) {
+	maxNanos := bigNanos(mm(math.MaxInt64, nanosMax))
+	minNanos := bigNanos(mm(math.MinInt64, nanosMin))
+	inRange := func(v *big.Int) bool { return v.Cmp(minNanos) >= 0 && v.Cmp(maxNanos) <= 0 }
+
+	f := func(units []int64, nanos []int32, wide bool) bool {
+		ms := make([]pb.Money, 0, len(units))
+		for i, u := range units {
+			if !wide {
+				u %= 1 << 40
+			}
+			var n int32
+			if i < len(nanos) {
+				n = nanos[i] % nanosMod
+			}
+			if (u > 0 && n < 0) || (u < 0 && n > 0) {
+				n = -n
+			}
+			ms = append(ms, mm(u, n))
+		}
+
+		want := new(big.Int)
+		prefixOverflow := false
+		for _, m := range ms {
+			want.Add(want, bigNanos(m))
+			prefixOverflow = prefixOverflow || !inRange(want)
+		}
+		got, err := SumAll(ms)
+		if err == ErrOverflow {
+			return prefixOverflow
+		}
+		return err == nil && IsValid(got) && bigNanos(got).Cmp(want) == 0
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package money
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// ParseAmount parses a decimal amount such as "12", "0.01" or "-3.5" into a
+// Money value without a currency code. At most nine fractional digits are
+// accepted.
+func ParseAmount(s string) (pb.Money, error) {
+	in := strings.TrimSpace(s)
+	neg := strings.HasPrefix(in, "-")
+	in = strings.TrimPrefix(in, "-")
+	intPart, fracPart := in, ""
+	if i := strings.IndexByte(in, '.'); i >= 0 {
+		intPart, fracPart = in[:i], in[i+1:]
+	}
+	if (intPart == "" && fracPart == "") || len(fracPart) > 9 || !isDigits(intPart) || !isDigits(fracPart) {
+		return pb.Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+
+	var m pb.Money
+	if intPart != "" {
+		units, err := strconv.ParseInt(intPart, 10, 64)
+		if err != nil {
+			return pb.Money{}, fmt.Errorf("invalid amount %q: %v", s, err)
+		}
+		m.Units = units
+	}
+	if fracPart != "" {
+		nanos, _ := strconv.ParseInt(fracPart+strings.Repeat("0", 9-len(fracPart)), 10, 32)
+		m.Nanos = int32(nanos)
+	}
+	if neg {
+		m = Negate(m)
+	}
+	return m, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package money
+
+import (
+	"fmt"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// RoundingMode selects how a value is rounded to the minor unit of its
+// currency. Arithmetic is always done at full nano precision; rounding should
+// only happen once, where a value is displayed or charged.
+type RoundingMode int
+
+const (
+	// RoundHalfUp rounds halfway values away from zero (0.125 -> 0.13).
+	RoundHalfUp RoundingMode = iota
+	// RoundHalfEven rounds halfway values to the nearest even minor unit
+	// (0.125 -> 0.12, 0.135 -> 0.14), also known as banker's rounding.
+	RoundHalfEven
+)
+
+func (m RoundingMode) String() string {
+	switch m {
+	case RoundHalfUp:
+		return "half_up"
+	case RoundHalfEven:
+		return "half_even"
+	}
+	return fmt.Sprintf("RoundingMode(%d)", int(m))
+}
+
+// ParseRoundingMode parses a rounding mode name. The empty string selects
+// the default RoundHalfUp mode.
+func ParseRoundingMode(s string) (RoundingMode, error) {
+	switch strings.ToLower(s) {
+	case "", "half_up":
+		return RoundHalfUp, nil
+	case "half_even", "bankers":
+		return RoundHalfEven, nil
+	}
+	return RoundHalfUp, fmt.Errorf("unknown rounding mode %q", s)
+}
+
+// minorUnitDigits lists the ISO 4217 currencies whose minor unit is not
+// 1/100 of the major unit.
+var minorUnitDigits = map[string]int{
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0,
+	"KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0,
+	"XOF": 0, "XPF": 0,
+}
+
+// MinorUnitDigits returns the number of decimal digits of the minor unit of
+// the given currency (2 for USD, 0 for JPY). Unknown codes default to 2.
+func MinorUnitDigits(currencyCode string) int {
+	if d, ok := minorUnitDigits[currencyCode]; ok {
+		return d
+	}
+	return 2
+}
+
+// Round returns m rounded to the minor unit of its currency using the given
+// mode. The value must be valid.
+func Round(m pb.Money, mode RoundingMode) pb.Money {
+	step := int32(nanosMod)
+	for i := 0; i < MinorUnitDigits(m.GetCurrencyCode()); i++ {
+		step /= 10
+	}
+	units, nanos := m.GetUnits(), m.GetNanos()
+	q, rem := nanos/step, nanos%step
+	sign := int32(1)
+	if rem < 0 || units < 0 {
+		sign = -1
+	}
+	if rem < 0 {
+		rem = -rem
+	}
+
+	roundAway := 2*rem > step
+	if 2*rem == step {
+		switch mode {
+		case RoundHalfEven:
+			// The last kept digit is the last digit of units when rounding
+			// to whole units, otherwise the last digit of the quotient.
+			if step == nanosMod {
+				roundAway = units%2 != 0
+			} else {
+				roundAway = q%2 != 0
+			}
+		default:
+			roundAway = true
+		}
+	}
+	if roundAway {
+		q += sign
+	}
+
+	nanos = q * step
+	if nanos >= nanosMod || nanos <= -nanosMod {
+		units += int64(nanos / nanosMod)
+		nanos %= nanosMod
+	}
+	return pb.Money{Units: units, Nanos: nanos, CurrencyCode: m.GetCurrencyCode()}
+}
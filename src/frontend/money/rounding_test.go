@@ -0,0 +1,166 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package money
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		name string
+		in   pb.Money
+		mode RoundingMode
+		want pb.Money
+	}{
+		{"exact", mmc(1, 250000000, "USD"), RoundHalfUp, mmc(1, 250000000, "USD")},
+		{"down", mmc(1, 124999999, "USD"), RoundHalfUp, mmc(1, 120000000, "USD")},
+		{"half up", mmc(1, 125000000, "USD"), RoundHalfUp, mmc(1, 130000000, "USD")},
+		{"half even down", mmc(1, 125000000, "USD"), RoundHalfEven, mmc(1, 120000000, "USD")},
+		{"half even up", mmc(1, 135000000, "USD"), RoundHalfEven, mmc(1, 140000000, "USD")},
+		{"carry into units", mmc(1, 999000000, "USD"), RoundHalfUp, mmc(2, 0, "USD")},
+		{"negative half up", mmc(-1, -125000000, "USD"), RoundHalfUp, mmc(-1, -130000000, "USD")},
+		{"negative half even", mmc(-1, -125000000, "USD"), RoundHalfEven, mmc(-1, -120000000, "USD")},
+		{"negative carry", mmc(-1, -995000000, "USD"), RoundHalfUp, mmc(-2, 0, "USD")},
+		{"nanos only negative", mm(0, -5000000), RoundHalfUp, mm(0, -10000000)},
+		{"JPY half up", mmc(100, 500000000, "JPY"), RoundHalfUp, mmc(101, 0, "JPY")},
+		{"JPY half even to even", mmc(100, 500000000, "JPY"), RoundHalfEven, mmc(100, 0, "JPY")},
+		{"JPY half even from odd", mmc(101, 500000000, "JPY"), RoundHalfEven, mmc(102, 0, "JPY")},
+		{"JPY below half", mmc(0, 499999999, "JPY"), RoundHalfUp, mmc(0, 0, "JPY")},
+		{"KWD three digits", mmc(1, 123500000, "KWD"), RoundHalfUp, mmc(1, 124000000, "KWD")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Round(tt.in, tt.mode); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Round(%v, %v) = %v, want %v", tt.in, tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRoundingMode(t *testing.T) {
+	for in, want := range map[string]RoundingMode{
+		"":          RoundHalfUp,
+		"half_up":   RoundHalfUp,
+		"HALF_EVEN": RoundHalfEven,
+		"bankers":   RoundHalfEven,
+	} {
+		if got, err := ParseRoundingMode(in); err != nil || got != want {
+			t.Errorf("ParseRoundingMode(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseRoundingMode("up"); err == nil {
+		t.Error("ParseRoundingMode(\"up\") returned no error")
+	}
+}
+
+var testCurrencies = []string{"USD", "EUR", "CAD", "JPY", "GBP", "TRY"}
+
+// randomCart is a cart of converted unit prices (at full nano precision, as
+// returned by the currency service) and quantities in a single currency.
+type randomCart struct {
+	currency   string
+	unitPrices []pb.Money
+	quantities []uint32
+	shipping   pb.Money
+}
+
+func (randomCart) Generate(r *rand.Rand, _ int) reflect.Value {
+	c := randomCart{currency: testCurrencies[r.Intn(len(testCurrencies))]}
+	price := func() pb.Money {
+		return mmc(r.Int63n(5000), r.Int31n(nanosMod), c.currency)
+	}
+	for i := r.Intn(10) + 1; i > 0; i-- {
+		c.unitPrices = append(c.unitPrices, price())
+		c.quantities = append(c.quantities, uint32(r.Intn(10)+1))
+	}
+	c.shipping = price()
+	return reflect.ValueOf(c)
+}
+
+// TestCartTotalsAgree asserts that the grid, the cart page and the checkout
+// confirmation agree for random carts: each path keeps intermediate values
+// at full precision and rounds exactly once, so they only differ by the
+// expected rounding of the individual displayed values.
+func TestCartTotalsAgree(t *testing.T) {
+	for _, mode := range []RoundingMode{RoundHalfUp, RoundHalfEven} {
+		// halfMinorUnit is the largest difference a single rounding can
+		// introduce, in nanos.
+		halfMinorUnit := func(currency string) int64 {
+			step := int64(nanosMod)
+			for i := 0; i < MinorUnitDigits(currency); i++ {
+				step /= 10
+			}
+			return step / 2
+		}
+		toNanos := func(m pb.Money) int64 { return m.GetUnits()*nanosMod + int64(m.GetNanos()) }
+
+		f := func(c randomCart) bool {
+			// Cart page: rows at full precision, subtotal of the unrounded
+			// rows plus shipping, rounded once for display.
+			cartTotal := c.shipping
+			var displayedRows int64
+			for i, unit := range c.unitPrices {
+				row := MultiplySlow(unit, c.quantities[i])
+				cartTotal = Must(Sum(cartTotal, row))
+
+				// Grid price x quantity and the displayed row total can
+				// only differ by the rounding of each of the grid prices
+				// plus the rounding of the row.
+				grid := toNanos(Round(unit, mode)) * int64(c.quantities[i])
+				displayedRow := toNanos(Round(row, mode))
+				diff := grid - displayedRow
+				if diff < 0 {
+					diff = -diff
+				}
+				if diff > halfMinorUnit(c.currency)*int64(c.quantities[i]+1) {
+					t.Logf("grid %d x %d disagrees with row %d", grid, c.quantities[i], displayedRow)
+					return false
+				}
+				displayedRows += displayedRow
+			}
+
+			// Checkout confirmation: the checkout service returns the item
+			// costs and the shipping cost; the total is summed in a
+			// different order but must round to the same value.
+			checkoutTotal := mmc(0, 0, c.currency)
+			for i := len(c.unitPrices) - 1; i >= 0; i-- {
+				checkoutTotal = Must(Sum(checkoutTotal, MultiplySlow(c.unitPrices[i], c.quantities[i])))
+			}
+			checkoutTotal = Must(Sum(checkoutTotal, c.shipping))
+
+			if got, want := Round(checkoutTotal, mode), Round(cartTotal, mode); !AreEquals(got, want) {
+				t.Logf("checkout total %v != cart total %v", got, want)
+				return false
+			}
+
+			// The displayed total is rounded once, so it stays within the
+			// accumulated rounding of the displayed rows and shipping.
+			diff := toNanos(Round(cartTotal, mode)) - displayedRows - toNanos(Round(c.shipping, mode))
+			if diff < 0 {
+				diff = -diff
+			}
+			return diff <= halfMinorUnit(c.currency)*int64(len(c.unitPrices)+2)
+		}
+		if err := quick.Check(f, &quick.Config{MaxCount: 5000}); err != nil {
+			t.Errorf("mode %v: %v", mode, err)
+		}
+	}
+}
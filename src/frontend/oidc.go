@@ -0,0 +1,517 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/cache"
+)
+
+const (
+	cookieIdentity = cookiePrefix + "identity"
+
+	oidcLoginTimeout = 10 * time.Minute // between /auth/login and the callback
+	maxPendingLogins = 1000
+	maxClockSkew     = time.Minute // tolerated in the times of ID tokens
+)
+
+var errOIDCState = errors.New("unknown or expired login state")
+
+// oidcMetadata is the part of the provider's discovery document the
+// frontend uses.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// pendingLogin is a login started by /auth/login, kept by its state until
+// the provider redirects back.
+type pendingLogin struct {
+	session  string
+	nonce    string
+	verifier string // PKCE code verifier
+	returnTo string
+}
+
+// identity is the user signed in with the OIDC provider, as kept in the
+// identity cookie. Tokens are never kept.
+type identity struct {
+	Subject string `json:"sub"`
+	Name    string `json:"name"`
+	Expires int64  `json:"exp"`
+}
+
+// oidcProvider is an OpenID Connect relying party using the authorization
+// code flow with PKCE. It only adds an identity to the session: pages stay
+// open to anonymous users, except checkout with requireCheckout. A nil
+// *oidcProvider disables OIDC logins.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string // derived from the request when empty
+
+	requireCheckout bool
+
+	client  *http.Client
+	key     []byte // signs identity cookies
+	pending *cache.Cache
+	now     func() time.Time
+
+	mu   sync.Mutex
+	meta *oidcMetadata             // discovered on first use
+	keys map[string]*rsa.PublicKey // by key ID, from the JWKS
+}
+
+func newOIDCProvider(issuer, clientID, clientSecret string, client *http.Client) *oidcProvider {
+	p := &oidcProvider{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       client,
+		pending:      cache.New(maxPendingLogins),
+		now:          time.Now,
+	}
+	if clientSecret != "" {
+		// Replicas sharing the client secret accept each other's cookies.
+		h := hmac.New(sha256.New, []byte(clientSecret))
+		h.Write([]byte("identity cookie"))
+		p.key = h.Sum(nil)
+	} else {
+		p.key = make([]byte, 32)
+		rand.Read(p.key)
+	}
+	return p
+}
+
+// getJSON fetches url into v.
+func (p *oidcProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(v), "GET %s", url)
+}
+
+// metadata returns the discovery document of the provider, fetching it on
+// first use so that the frontend starts while the provider is down.
+func (p *oidcProvider) metadata(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	meta := p.meta
+	p.mu.Unlock()
+	if meta != nil {
+		return meta, nil
+	}
+	meta = new(oidcMetadata)
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", meta); err != nil {
+		return nil, errors.Wrap(err, "failed to discover the OIDC provider")
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != p.issuer {
+		return nil, errors.Errorf("OIDC provider claims to be %q, not %q", meta.Issuer, p.issuer)
+	}
+	p.mu.Lock()
+	p.meta = meta
+	p.mu.Unlock()
+	return meta, nil
+}
+
+// publicKey returns the signing key of ID tokens with the given key ID,
+// fetching the provider's keys again when it is unknown, as happens after
+// a key rotation.
+func (p *oidcProvider) publicKey(ctx context.Context, meta *oidcMetadata, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, meta.JWKSURI, &jwks); err != nil {
+		return nil, errors.Wrap(err, "failed to fetch the OIDC signing keys")
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	if key, ok = keys[kid]; !ok {
+		return nil, errors.Errorf("unknown OIDC signing key %q", kid)
+	}
+	return key, nil
+}
+
+// audience is the aud claim, a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	Expires           int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+	Email             string   `json:"email"`
+}
+
+// displayName is the name shown in the header.
+func (c *idTokenClaims) displayName() string {
+	for _, name := range []string{c.Name, c.PreferredUsername, c.Email} {
+		if name != "" {
+			return name
+		}
+	}
+	return c.Subject
+}
+
+// verifyIDToken checks the signature and claims of an RS256 ID token.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, meta *oidcMetadata, raw, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(b, &header) != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+	if header.Alg != "RS256" {
+		return nil, errors.Errorf("ID token signed with %q, not RS256", header.Alg)
+	}
+	key, err := p.publicKey(ctx, meta, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("invalid ID token signature")
+	}
+
+	var claims idTokenClaims
+	if b, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(b, &claims) != nil {
+		return nil, errors.New("malformed ID token claims")
+	}
+	now := p.now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != p.issuer:
+		return nil, errors.Errorf("ID token issued by %q", claims.Issuer)
+	case !claims.Audience.contains(p.clientID):
+		return nil, errors.New("ID token issued to another client")
+	case now.After(time.Unix(claims.Expires, 0).Add(maxClockSkew)):
+		return nil, errors.New("expired ID token")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(maxClockSkew)):
+		return nil, errors.New("ID token issued in the future")
+	case !hmac.Equal([]byte(claims.Nonce), []byte(nonce)):
+		return nil, errors.New("ID token nonce mismatch")
+	case claims.Subject == "":
+		return nil, errors.New("ID token without a subject")
+	}
+	return &claims, nil
+}
+
+// exchange trades an authorization code for the claims of its ID token. The
+// error never contains the tokens, only the OAuth error code.
+func (p *oidcProvider) exchange(ctx context.Context, meta *oidcMetadata, code, redirectURL string, login *pendingLogin) (*idTokenClaims, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {p.clientID},
+		"code_verifier": {login.verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to reach the token endpoint")
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, errors.Errorf("token endpoint answered %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, errors.Errorf("token endpoint answered %s: %q", resp.Status, tokens.Error)
+	}
+	return p.verifyIDToken(ctx, meta, tokens.IDToken, login.nonce)
+}
+
+// signIdentity returns the identity cookie value, "<payload>.<signature>".
+func (p *oidcProvider) signIdentity(id *identity) string {
+	b, _ := json.Marshal(id)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(p.mac(payload))
+}
+
+func (p *oidcProvider) verifyIdentity(value string) *identity {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return nil
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil || !hmac.Equal(sig, p.mac(value[:i])) {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(value[:i])
+	if err != nil {
+		return nil
+	}
+	var id identity
+	if json.Unmarshal(b, &id) != nil || p.now().After(time.Unix(id.Expires, 0)) {
+		return nil
+	}
+	return &id
+}
+
+func (p *oidcProvider) mac(payload string) []byte {
+	h := hmac.New(sha256.New, p.key)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// identity returns the user of the request signed in with the OIDC
+// provider, or nil.
+func (fe *frontendServer) identity(r *http.Request) *identity {
+	if fe.oidc == nil {
+		return nil
+	}
+	c, err := r.Cookie(cookieIdentity)
+	if err != nil {
+		return nil
+	}
+	return fe.oidc.verifyIdentity(c.Value)
+}
+
+// callbackURL is the redirect URL registered with the provider.
+func (p *oidcProvider) callbackURL(r *http.Request) string {
+	if p.redirectURL != "" {
+		return p.redirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/auth/callback"
+}
+
+// localPath returns path if it is a path on this site, "/" otherwise, so
+// that the login flow cannot redirect elsewhere.
+func localPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (fe *frontendServer) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	meta, err := fe.oidc.metadata(r.Context())
+	if err != nil {
+		fe.renderHTTPError(log, r, w, err, http.StatusBadGateway)
+		return
+	}
+	state := randomToken()
+	login := &pendingLogin{
+		session:  sessionID(r),
+		nonce:    randomToken(),
+		verifier: randomToken(),
+		returnTo: localPath(r.URL.Query().Get("return")),
+	}
+	fe.oidc.pending.Set(state, login, oidcLoginTimeout)
+	challenge := sha256.Sum256([]byte(login.verifier))
+
+	u, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "invalid OIDC authorization endpoint"), http.StatusBadGateway)
+		return
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", fe.oidc.clientID)
+	q.Set("redirect_uri", fe.oidc.callbackURL(r))
+	q.Set("scope", "openid profile email")
+	q.Set("state", state)
+	q.Set("nonce", login.nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func (fe *frontendServer) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	q := r.URL.Query()
+	// The state is taken whatever the outcome: it is good for one attempt.
+	v, ok := fe.oidc.pending.Take(q.Get("state"))
+	if !ok || v.(*pendingLogin).session != sessionID(r) {
+		log.WithField("event", "oidc_login_failed").Warn("OIDC callback with an unknown state")
+		fe.renderHTTPError(log, r, w, errOIDCState, http.StatusBadRequest)
+		return
+	}
+	login := v.(*pendingLogin)
+	if e := q.Get("error"); e != "" {
+		log.WithFields(logrus.Fields{"event": "oidc_login_failed", "error": e}).Warn("OIDC provider refused the login")
+		fe.renderHTTPError(log, r, w, errors.Errorf("the identity provider refused the login: %s", e), http.StatusUnauthorized)
+		return
+	}
+	meta, err := fe.oidc.metadata(r.Context())
+	if err != nil {
+		fe.renderHTTPError(log, r, w, err, http.StatusBadGateway)
+		return
+	}
+	claims, err := fe.oidc.exchange(r.Context(), meta, q.Get("code"), fe.oidc.callbackURL(r), login)
+	if err != nil {
+		log.WithFields(logrus.Fields{"event": "oidc_login_failed", "error": err}).Warn("OIDC code exchange failed")
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "login failed"), http.StatusUnauthorized)
+		return
+	}
+
+	id := &identity{
+		Subject: claims.Subject,
+		Name:    claims.displayName(),
+		Expires: fe.oidc.now().Add(cookieMaxAge * time.Second).Unix(),
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieIdentity,
+		Value:    fe.oidc.signIdentity(id),
+		Path:     "/",
+		MaxAge:   cookieMaxAge,
+		HttpOnly: true,
+	})
+	log.WithFields(logrus.Fields{
+		"event":   "oidc_login",
+		"subject": hashSessionID(claims.Subject),
+	}).Info("signed in with the OIDC provider")
+	http.Redirect(w, r, login.returnTo, http.StatusSeeOther)
+}
+
+// oidcLogoutHandler forgets the identity and, when the provider supports
+// RP-initiated logout, ends the session at the provider too, which then
+// redirects back to the home page.
+func (fe *frontendServer) oidcLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: cookieIdentity, Path: "/", MaxAge: -1})
+	meta, err := fe.oidc.metadata(r.Context())
+	if err != nil || meta.EndSessionEndpoint == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	u, err := url.Parse(meta.EndSessionEndpoint)
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	home := strings.TrimSuffix(fe.oidc.callbackURL(r), "/auth/callback") + "/"
+	q := u.Query()
+	q.Set("client_id", fe.oidc.clientID)
+	q.Set("post_logout_redirect_uri", home)
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// requireIdentity redirects to the OIDC login when checkout requires one,
+// and reports whether it did.
+func (fe *frontendServer) requireIdentity(w http.ResponseWriter, r *http.Request, returnTo string) bool {
+	if fe.oidc == nil || !fe.oidc.requireCheckout || fe.identity(r) != nil {
+		return false
+	}
+	http.Redirect(w, r, "/auth/login?return="+url.QueryEscape(returnTo), http.StatusSeeOther)
+	return true
+}
@@ -0,0 +1,261 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeAccessToken = "fake-access-token"
+
+var (
+	idpKeyOnce sync.Once
+	idpKey     *rsa.PrivateKey
+)
+
+// fakeIdP is an OIDC provider approving every login of user-42 at once.
+type fakeIdP struct {
+	srv *httptest.Server
+
+	mu          sync.Mutex
+	grants      map[string]fakeGrant // by authorization code
+	expireCodes bool                 // codes are expired when exchanged
+	tamperState bool                 // the state is altered on the way back
+	logouts     []url.Values
+}
+
+type fakeGrant struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	idpKeyOnce.Do(func() {
+		var err error
+		if idpKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+	})
+	idp := &fakeIdP{grants: make(map[string]fakeGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcMetadata{
+			Issuer:                idp.srv.URL,
+			AuthorizationEndpoint: idp.srv.URL + "/authorize",
+			TokenEndpoint:         idp.srv.URL + "/token",
+			JWKSURI:               idp.srv.URL + "/jwks",
+			EndSessionEndpoint:    idp.srv.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"k1","n":%q,"e":%q}]}`,
+			base64.RawURLEncoding.EncodeToString(idpKey.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idpKey.E)).Bytes()))
+	})
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		idp.logouts = append(idp.logouts, r.URL.Query())
+		idp.mu.Unlock()
+		http.Redirect(w, r, r.URL.Query().Get("post_logout_redirect_uri"), http.StatusFound)
+	})
+	idp.srv = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *fakeIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != "shop" || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	code := randomToken()
+	idp.mu.Lock()
+	idp.grants[code] = fakeGrant{redirectURI: q.Get("redirect_uri"), challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	state := q.Get("state")
+	if idp.tamperState {
+		state = randomToken()
+	}
+	idp.mu.Unlock()
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {state}}.Encode(), http.StatusFound)
+}
+
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	invalid := func() {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_grant"}`)
+	}
+	if id, secret, ok := r.BasicAuth(); !ok || id != "shop" || secret != "shop-secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"invalid_client"}`)
+		return
+	}
+	idp.mu.Lock()
+	g, ok := idp.grants[r.FormValue("code")]
+	delete(idp.grants, r.FormValue("code"))
+	expired := idp.expireCodes
+	idp.mu.Unlock()
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || expired || g.redirectURI != r.FormValue("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != g.challenge {
+		invalid()
+		return
+	}
+
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"k1"}`))
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   idp.srv.URL,
+		"sub":   "user-42",
+		"aud":   "shop",
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"iat":   now.Unix(),
+		"nonce": g.nonce,
+		"name":  "Jane Shopper",
+	})
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, idpKey, crypto.SHA256, digest[:])
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": fakeAccessToken,
+		"token_type":   "Bearer",
+		"id_token":     signed + "." + base64.RawURLEncoding.EncodeToString(sig),
+	})
+}
+
+func withOIDC(idp *fakeIdP) func(*frontendServer) {
+	return func(fe *frontendServer) {
+		fe.oidc = newOIDCProvider(idp.srv.URL, "shop", "shop-secret", fe.httpClient)
+	}
+}
+
+// assertNoTokensLogged fails the test if a log entry contains a token.
+func assertNoTokensLogged(t *testing.T, h *testHarness) {
+	t.Helper()
+	h.logs.mu.Lock()
+	defer h.logs.mu.Unlock()
+	for _, e := range h.logs.entries {
+		line, _ := e.String()
+		if strings.Contains(line, fakeAccessToken) || strings.Contains(line, "eyJ") {
+			t.Errorf("token logged: %s", line)
+		}
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.srv.Close()
+	h := newTestHarness(t, withOIDC(idp))
+	defer h.close()
+	if resp := h.get("/"); !strings.Contains(resp.body, `href="/auth/login"`) {
+		t.Error("no login link for anonymous users")
+	}
+
+	resp := h.get("/auth/login?return=/cart")
+	if resp.Request.URL.Path != "/cart" {
+		t.Errorf("login ended on %s, want /cart", resp.Request.URL.Path)
+	}
+	if !strings.Contains(resp.body, "Signed in as Jane Shopper") {
+		t.Fatal("name of the signed-in user not shown")
+	}
+	if entries := h.logs.find("oidc_login"); len(entries) != 1 {
+		t.Errorf("login logged %d times, want once", len(entries))
+	}
+	assertNoTokensLogged(t, h)
+
+	resp = h.get("/auth/logout")
+	if resp.Request.URL.Path != "/" || strings.Contains(resp.body, "Signed in as") {
+		t.Error("still signed in after logging out")
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	if len(idp.logouts) != 1 || idp.logouts[0].Get("post_logout_redirect_uri") != h.srv.URL+"/" {
+		t.Errorf("provider logouts = %v, want one returning to the shop", idp.logouts)
+	}
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.srv.Close()
+	idp.tamperState = true
+	h := newTestHarness(t, withOIDC(idp))
+	defer h.close()
+
+	resp := h.get("/auth/login")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback with another state = %d, want 400", resp.StatusCode)
+	}
+	if h.cookie(cookieIdentity) != "" || strings.Contains(resp.body, "Signed in as") {
+		t.Error("signed in with another state")
+	}
+	if len(h.logs.find("oidc_login_failed")) != 1 {
+		t.Error("failed login not logged")
+	}
+}
+
+func TestOIDCExpiredCode(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.srv.Close()
+	idp.expireCodes = true
+	h := newTestHarness(t, withOIDC(idp))
+	defer h.close()
+
+	resp := h.get("/auth/login")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(resp.body, "invalid_grant") {
+		t.Errorf("callback with an expired code = %d, want 401 with the OAuth error", resp.StatusCode)
+	}
+	if h.cookie(cookieIdentity) != "" {
+		t.Error("signed in with an expired code")
+	}
+	assertNoTokensLogged(t, h)
+}
+
+func TestOIDCRequiredForCheckout(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.srv.Close()
+	h := newTestHarness(t, withOIDC(idp), func(fe *frontendServer) { fe.oidc.requireCheckout = true })
+	defer h.close()
+	if resp := h.get("/"); strings.Contains(resp.body, "Signed in as") || resp.StatusCode != http.StatusOK {
+		t.Fatal("home page not open to anonymous users")
+	}
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+
+	resp := h.post("/cart/checkout", checkoutForm)
+	if resp.Request.URL.Path != "/cart" || !strings.Contains(resp.body, "Signed in as Jane Shopper") {
+		t.Fatalf("anonymous checkout ended on %s without a login", resp.Request.URL.Path)
+	}
+	if got := h.faults.calls(placeOrderMethod); got != 0 {
+		t.Errorf("anonymous checkout placed %d orders", got)
+	}
+	if resp := h.post("/cart/checkout", checkoutForm); !strings.Contains(resp.body, "Your order is complete!") {
+		t.Error("signed-in checkout failed")
+	}
+}
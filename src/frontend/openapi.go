@@ -0,0 +1,315 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// apiOperation documents a JSON route for the OpenAPI description of the
+// API, next to its registration.
+type apiOperation struct {
+	Summary  string
+	Admin    bool // the admin token is required
+	Debug    bool // the admin token is required outside of demo mode
+	Params   []apiParam
+	Request  interface{} // a value of the type of the JSON request body, if any
+	Response interface{} // a value of the type of the response body
+	Errors   []int       // statuses answered with a problem document
+}
+
+// apiParam is a query parameter of an API route. Path parameters are
+// taken from the path template.
+type apiParam struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+var apiCurrenciesParam = apiParam{
+	Name:        "currencies",
+	Description: "Comma-separated ISO 4217 codes of supported currencies, e.g. USD,EUR",
+	Required:    true,
+}
+
+// problem is an RFC 7807 problem document, the body of the errors of the
+// JSON API.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// InvalidParams lists the fields of the request that were rejected.
+	InvalidParams []invalidParam `json:"invalid_params,omitempty"`
+}
+
+type invalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// writeProblem answers an API request with a problem document.
+func writeProblem(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: detail})
+}
+
+// writeInvalidParams answers an API request whose fields were rejected,
+// with the same messages as the form.
+func writeInvalidParams(w http.ResponseWriter, r *http.Request, f *formState) {
+	f.annotate(r.Context())
+	p := problem{Type: "about:blank", Title: http.StatusText(http.StatusBadRequest), Status: http.StatusBadRequest, Detail: "invalid fields"}
+	for _, e := range f.Errors {
+		p.InvalidParams = append(p.InvalidParams, invalidParam{Name: e.Field, Reason: e.Message})
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(p)
+}
+
+// document describes a route already registered for the method.
+func (t *routeTable) document(path, method string, op apiOperation) {
+	registrant, ok := t.seen[path][method]
+	if !ok {
+		t.errs = append(t.errs, fmt.Sprintf("documented route %s %s is not registered", method, path))
+		return
+	}
+	if t.apiDocs[path] == nil {
+		t.apiDocs[path] = make(map[string]documentedOperation)
+	}
+	t.apiDocs[path][method] = documentedOperation{apiOperation: op, id: strings.TrimSuffix(strings.SplitN(registrant, " ", 2)[0], "Handler")}
+}
+
+type documentedOperation struct {
+	apiOperation
+	id string // operationId, from the name of the handler
+}
+
+var pathVariable = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// openAPI returns the OpenAPI 3 description of the documented routes.
+func (t *routeTable) openAPI() map[string]interface{} {
+	schemas := make(openAPISchemas)
+	schemas.of(reflect.TypeOf(problem{}), false)
+	paths := make(map[string]interface{})
+	for path, byMethod := range t.apiDocs {
+		item := make(map[string]interface{})
+		for method, op := range byMethod {
+			item[strings.ToLower(method)] = op.openAPI(path, schemas)
+		}
+		paths[pathVariable.ReplaceAllString(path, "{$1}")] = item
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Online Boutique frontend API",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]interface{}{"type": "http", "scheme": "bearer", "description": "ADMIN_TOKEN of the frontend"},
+			},
+		},
+	}
+}
+
+func (op documentedOperation) openAPI(path string, schemas openAPISchemas) map[string]interface{} {
+	var params []interface{}
+	for _, m := range pathVariable.FindAllStringSubmatch(path, -1) {
+		params = append(params, map[string]interface{}{
+			"name": m[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	for _, p := range op.Params {
+		params = append(params, map[string]interface{}{
+			"name": p.Name, "in": "query", "required": p.Required, "description": p.Description,
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+
+	ok := map[string]interface{}{"description": "OK"}
+	if op.Response != nil {
+		ok["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemas.of(reflect.TypeOf(op.Response), false)},
+		}
+	}
+	responses := map[string]interface{}{"200": ok}
+	for _, status := range op.Errors {
+		responses[strconv.Itoa(status)] = map[string]interface{}{
+			"description": http.StatusText(status),
+			"content": map[string]interface{}{
+				"application/problem+json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/Problem"}},
+			},
+		}
+	}
+	out := map[string]interface{}{"operationId": op.id, "summary": op.Summary, "responses": responses}
+	if len(params) > 0 {
+		out["parameters"] = params
+	}
+	if op.Request != nil {
+		out["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemas.of(reflect.TypeOf(op.Request), false)},
+			},
+		}
+	}
+	switch {
+	case op.Admin:
+		out["security"] = []interface{}{map[string]interface{}{"adminToken": []string{}}}
+		responses["401"] = map[string]interface{}{"description": "The admin token is missing or wrong"}
+	case op.Debug:
+		out["security"] = []interface{}{map[string]interface{}{"adminToken": []string{}}}
+		out["description"] = "Served to everyone in demo mode or with DEBUG_ENDPOINTS, otherwise with the admin token only."
+		responses["404"] = map[string]interface{}{"description": "Debugging is not enabled for the request"}
+	}
+	return out
+}
+
+// openAPISchemas holds the schemas of the named Go types met while
+// describing the API, by name.
+type openAPISchemas map[string]interface{}
+
+// of returns the schema of values of type t as encoded by encoding/json.
+// Named struct types are described once among the schemas and referenced.
+func (s openAPISchemas) of(t reflect.Type, nullable bool) map[string]interface{} {
+	schema := s.describe(t)
+	if nullable {
+		if _, ref := schema["$ref"]; ref {
+			return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+	}
+	return schema
+}
+
+func (s openAPISchemas) describe(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(time.Duration(0)):
+		return map[string]interface{}{"type": "integer", "format": "int64", "description": "nanoseconds"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.of(t.Elem(), true)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer", "format": intFormat(t)}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": intFormat(t), "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.of(t.Elem(), false)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.of(t.Elem(), false)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		name := exportedName(t.Name())
+		if _, ok := s[name]; !ok {
+			s[name] = nil // for recursive types to reference it
+			s[name] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// object describes a struct, with the fields of its embedded structs.
+func (s openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			if f.Anonymous && f.Type.Kind() == reflect.Struct && tag == "" {
+				add(f.Type)
+				continue
+			}
+			if f.PkgPath != "" {
+				continue // unexported
+			}
+			parts := strings.Split(tag, ",")
+			name := parts[0]
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = s.of(f.Type, false)
+			if !contains(parts[1:], "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	add(t)
+	out := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		out["required"] = required
+	}
+	return out
+}
+
+func intFormat(t reflect.Type) string {
+	if t.Bits() <= 32 {
+		return "int32"
+	}
+	return "int64"
+}
+
+func exportedName(name string) string {
+	r := []rune(name)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// openAPIHandler serves the OpenAPI description of the JSON API.
+func (t *routeTable) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.openAPI())
+}
+
+// openAPIPageHandler serves Swagger UI on the OpenAPI description, for
+// browsing the API during demos.
+func (fe *frontendServer) openAPIPageHandler(w http.ResponseWriter, r *http.Request) {
+	if !fe.demoMode && !fe.debugEnabled(r) {
+		http.NotFound(w, r)
+		return
+	}
+	fe.render(w, r, http.StatusOK, "openapi", nil)
+}
@@ -0,0 +1,189 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// servedSpec fetches the OpenAPI description from the frontend.
+func servedSpec(h *testHarness) map[string]interface{} {
+	h.t.Helper()
+	resp := h.get("/api/openapi.json")
+	if resp.StatusCode != http.StatusOK {
+		h.t.Fatalf("GET /api/openapi.json = %d", resp.StatusCode)
+	}
+	var spec map[string]interface{}
+	if err := json.Unmarshal([]byte(resp.body), &spec); err != nil {
+		h.t.Fatal(err)
+	}
+	return spec
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.srv.Close()
+	h := newTestHarness(t, withAccounts, withOIDC(idp), withAdminToken, func(fe *frontendServer) { fe.demoMode = true })
+	defer h.close()
+	paths := servedSpec(h)["paths"].(map[string]interface{})
+
+	router, err := h.fe.router()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tpl, "/api/") {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, m := range methods {
+			if m == http.MethodHead {
+				continue
+			}
+			n++
+			item, _ := paths[pathVariable.ReplaceAllString(tpl, "{$1}")].(map[string]interface{})
+			if _, ok := item[strings.ToLower(m)]; !ok {
+				t.Errorf("%s %s is not in the OpenAPI description", m, tpl)
+			}
+		}
+		return nil
+	})
+	if n == 0 {
+		t.Fatal("no /api routes found")
+	}
+}
+
+func TestOpenAPIValid(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	spec := servedSpec(h)
+
+	if v, _ := spec["openapi"].(string); !strings.HasPrefix(v, "3.") {
+		t.Errorf("openapi = %q, want 3.x", v)
+	}
+	info, _ := spec["info"].(map[string]interface{})
+	if info["title"] == "" || info["version"] == nil {
+		t.Errorf("info = %v, want a title and a version", info)
+	}
+	components := spec["components"].(map[string]interface{})
+	schemas := components["schemas"].(map[string]interface{})
+	schemes := components["securitySchemes"].(map[string]interface{})
+
+	// Every reference must resolve, wherever it is.
+	var refs func(v interface{})
+	refs = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				name := strings.TrimPrefix(ref, "#/components/schemas/")
+				if _, ok := schemas[name]; !ok || name == ref {
+					t.Errorf("unresolved $ref %q", ref)
+				}
+			}
+			for _, e := range v {
+				refs(e)
+			}
+		case []interface{}:
+			for _, e := range v {
+				refs(e)
+			}
+		}
+	}
+	refs(spec)
+
+	ids := make(map[string]string)
+	for path, item := range spec["paths"].(map[string]interface{}) {
+		for method, op := range item.(map[string]interface{}) {
+			op := op.(map[string]interface{})
+			where := strings.ToUpper(method) + " " + path
+			id, _ := op["operationId"].(string)
+			if id == "" {
+				t.Errorf("%s: no operationId", where)
+			} else if other, dup := ids[id]; dup {
+				t.Errorf("%s: operationId %q already used by %s", where, id, other)
+			}
+			ids[id] = where
+			if r, _ := op["responses"].(map[string]interface{}); len(r) == 0 {
+				t.Errorf("%s: no responses", where)
+			}
+			declared := make(map[string]bool)
+			params, _ := op["parameters"].([]interface{})
+			for _, p := range params {
+				p := p.(map[string]interface{})
+				if p["in"] == "path" {
+					declared[p["name"].(string)] = true
+				}
+			}
+			for _, m := range pathVariable.FindAllStringSubmatch(path, -1) {
+				if !declared[m[1]] {
+					t.Errorf("%s: path parameter %s not declared", where, m[1])
+				}
+			}
+			security, _ := op["security"].([]interface{})
+			for _, s := range security {
+				for name := range s.(map[string]interface{}) {
+					if _, ok := schemes[name]; !ok {
+						t.Errorf("%s: unknown security scheme %s", where, name)
+					}
+				}
+			}
+		}
+	}
+
+	totals := schemas["CartTotals"].(map[string]interface{})
+	if _, ok := totals["properties"].(map[string]interface{})["totals"]; !ok {
+		t.Errorf("CartTotals schema = %v, want the totals", totals)
+	}
+}
+
+func TestAPIProblem(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	resp := h.get("/api/cart/totals?currencies=XXX")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unsupported currency = %d, want 400", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var p problem
+	if err := json.Unmarshal([]byte(resp.body), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != http.StatusBadRequest || p.Title != "Bad Request" || p.Detail == "" {
+		t.Errorf("problem = %+v", p)
+	}
+}
+
+func TestOpenAPIPage(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	if resp := h.get("/debug/openapi"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /debug/openapi without debugging = %d, want 404", resp.StatusCode)
+	}
+	h = newTestHarness(t, func(fe *frontendServer) { fe.demoMode = true })
+	defer h.close()
+	resp := h.get("/debug/openapi")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.body, "/api/openapi.json") {
+		t.Errorf("GET /debug/openapi in demo mode = %d", resp.StatusCode)
+	}
+}
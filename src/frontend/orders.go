@@ -0,0 +1,213 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	maxOrderHistory = 10000 // orders kept for the export
+	maxOrderExport  = 1000  // orders in one export response
+)
+
+// orderRecord is what the export tells about an order. It deliberately has
+// no field for the shipping address, email or payment details.
+type orderRecord struct {
+	OrderID        string    `json:"order_id"`
+	Time           time.Time `json:"time"`
+	Items          int       `json:"items"`
+	Currency       string    `json:"currency"`
+	DisplayedTotal string    `json:"displayed_total"` // empty when the cart could not be priced
+	ChargedTotal   string    `json:"charged_total"`
+	Synthetic      bool      `json:"synthetic"`
+	Session        string    `json:"session"` // hashed
+
+	items []*pb.CartItem // for buying the order again; never exported
+	seq   int64          // position in the history, the export's cursor
+}
+
+var orderCSVHeader = []string{"order_id", "time", "items", "currency", "displayed_total", "charged_total", "synthetic", "session"}
+
+func (o orderRecord) csv() []string {
+	return []string{o.OrderID, o.Time.Format(time.RFC3339Nano), strconv.Itoa(o.Items), o.Currency,
+		o.DisplayedTotal, o.ChargedTotal, strconv.FormatBool(o.Synthetic), o.Session}
+}
+
+// newOrderRecord describes an order placed by a request at the given time,
+// along with the total displayed in the cart, if known.
+func newOrderRecord(r *http.Request, at time.Time, order *pb.OrderResult, displayed *cartQuote) orderRecord {
+	rec := orderRecord{
+		OrderID:   order.GetOrderId(),
+		Time:      at,
+		Synthetic: isSynthetic(r),
+		Session:   hashSessionID(sessionID(r)),
+	}
+	charged := orderTotal(order)
+	rec.Currency, rec.ChargedTotal = charged.GetCurrencyCode(), formatDecimal(charged)
+	for _, it := range order.GetItems() {
+		rec.Items += int(it.GetItem().GetQuantity())
+		rec.items = append(rec.items, it.GetItem())
+	}
+	if displayed != nil {
+		rec.DisplayedTotal = formatDecimal(displayed.Total)
+	}
+	return rec
+}
+
+// isSynthetic reports whether a request comes from the load generator, or
+// the frontend's own traffic generator, rather than from a person.
+func isSynthetic(r *http.Request) bool {
+	return strings.HasPrefix(r.UserAgent(), "python-requests/") || r.Header.Get(headerSynthetic) == "true"
+}
+
+// orderHistory keeps the last orders placed through this frontend, across
+// all sessions, in the order they were placed.
+type orderHistory struct {
+	mu     sync.Mutex
+	orders []orderRecord
+	added  int64 // orders ever added, the seq of the last one
+}
+
+func newOrderHistory() *orderHistory { return &orderHistory{} }
+
+func (h *orderHistory) add(o orderRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.added++
+	o.seq = h.added
+	h.orders = append(h.orders, o)
+	if len(h.orders) > maxOrderHistory {
+		h.orders = append([]orderRecord(nil), h.orders[len(h.orders)-maxOrderHistory:]...)
+	}
+}
+
+// placedBy returns the order with the given ID if the session with the
+// given hash placed it.
+func (h *orderHistory) placedBy(orderID, session string) (orderRecord, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.orders) - 1; i >= 0; i-- {
+		if o := h.orders[i]; o.OrderID == orderID {
+			return o, o.Session == session
+		}
+	}
+	return orderRecord{}, false
+}
+
+// page returns up to limit orders added after the one at cursor after and
+// placed after t, and whether there are more. Orders are in the order they
+// were added, which need not be that of their times: the demo clock may
+// have been moved in between.
+func (h *orderHistory) page(after int64, t time.Time, limit int) ([]orderRecord, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []orderRecord
+	for _, o := range h.orders {
+		if o.seq <= after || !o.Time.After(t) {
+			continue
+		}
+		if len(out) == limit {
+			return out, true
+		}
+		out = append(out, o)
+	}
+	return out, false
+}
+
+// exportOrdersHandler serves the order history to admins, as CSV or JSON
+// depending on the format parameter or the Accept header. Only orders
+// placed after the since parameter (RFC 3339) are exported, at most
+// maxOrderExport of them. A truncated export links to the rest with a Link
+// header, whose after parameter is the cursor of its last order; the JSON
+// export also has the cursor in next_after.
+func (fe *frontendServer) exportOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	if !fe.isAdmin(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var since time.Time
+	if v := r.FormValue("since"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid since %q, want an RFC 3339 timestamp", v), http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	var after int64
+	if v := r.FormValue("after"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid after %q, want the cursor of a previous export", v), http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+	format := r.FormValue("format")
+	if format == "" {
+		format = "json"
+		if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			format = "csv"
+		}
+	}
+
+	orders, truncated := fe.orders.page(after, since, maxOrderExport)
+	var next int64
+	if truncated {
+		next = orders[len(orders)-1].seq
+		q := r.URL.Query()
+		q.Set("after", strconv.FormatInt(next, 10))
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, q.Encode()))
+	}
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.Write(orderCSVHeader)
+		for _, o := range orders {
+			cw.Write(o.csv())
+		}
+		cw.Flush()
+	case "json":
+		// The orders are encoded one by one rather than as a whole.
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"orders":[`)
+		enc := json.NewEncoder(w)
+		for i, o := range orders {
+			if i > 0 {
+				fmt.Fprint(w, ",")
+			}
+			enc.Encode(o)
+		}
+		fmt.Fprintf(w, `],"truncated":%t`, truncated)
+		if truncated {
+			fmt.Fprintf(w, `,"next_after":%d`, next)
+		}
+		fmt.Fprint(w, "}\n")
+	default:
+		http.Error(w, fmt.Sprintf("unsupported format %q", format), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withAdminToken(fe *frontendServer) { fe.adminToken = "s3cret" }
+
+// export gets the order export with the admin token.
+func (h *testHarness) export(query, accept string) *response {
+	h.t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/admin/orders/export"+query, nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	return h.do(req)
+}
+
+// placeOrders places n orders of 2 typewriters each.
+func placeOrders(t *testing.T, h *testHarness, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"2"}})
+		if resp := h.post("/cart/checkout", checkoutForm); resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST /cart/checkout = %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+type orderExport struct {
+	Orders    []orderRecord `json:"orders"`
+	Truncated bool          `json:"truncated"`
+	NextAfter int64         `json:"next_after"`
+}
+
+func TestExportOrdersJSON(t *testing.T) {
+	h := newTestHarness(t, withAdminToken)
+	defer h.close()
+	placeOrders(t, h, 2)
+
+	resp := h.export("", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("export = %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var got orderExport
+	if err := json.Unmarshal([]byte(resp.body), &got); err != nil {
+		t.Fatalf("invalid JSON export: %v\n%s", err, resp.body)
+	}
+	if len(got.Orders) != 2 || got.Truncated {
+		t.Fatalf("exported %d orders (truncated: %v), want 2", len(got.Orders), got.Truncated)
+	}
+	o := got.Orders[0]
+	if o.OrderID == "" || o.Items != 2 || o.Currency != "USD" || o.ChargedTotal != "144.970000000" || o.DisplayedTotal != o.ChargedTotal {
+		t.Errorf("exported order = %+v", o)
+	}
+}
+
+func TestExportOrdersCSV(t *testing.T) {
+	h := newTestHarness(t, withAdminToken)
+	defer h.close()
+	placeOrders(t, h, 2)
+
+	for _, tc := range []struct{ query, accept string }{{"?format=csv", ""}, {"", "text/csv"}} {
+		resp := h.export(tc.query, tc.accept)
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/csv") {
+			t.Errorf("export%s with Accept %q is %s, want CSV", tc.query, tc.accept, resp.Header.Get("Content-Type"))
+			continue
+		}
+		rows, err := csv.NewReader(strings.NewReader(resp.body)).ReadAll()
+		if err != nil {
+			t.Fatalf("invalid CSV export: %v", err)
+		}
+		if len(rows) != 3 || strings.Join(rows[0], ",") != strings.Join(orderCSVHeader, ",") {
+			t.Errorf("CSV export = %q", rows)
+		}
+	}
+}
+
+func TestExportOrdersSince(t *testing.T) {
+	h := newTestHarness(t, withAdminToken)
+	defer h.close()
+	placeOrders(t, h, 1)
+	var first orderExport
+	json.Unmarshal([]byte(h.export("", "").body), &first)
+	placeOrders(t, h, 2)
+
+	var got orderExport
+	since := url.QueryEscape(first.Orders[0].Time.Format(time.RFC3339Nano))
+	json.Unmarshal([]byte(h.export("?since="+since, "").body), &got)
+	if len(got.Orders) != 2 {
+		t.Errorf("exported %d orders since the first one, want 2", len(got.Orders))
+	}
+	for _, o := range got.Orders {
+		if o.OrderID == first.Orders[0].OrderID {
+			t.Error("the since filter includes the order it refers to")
+		}
+	}
+	if resp := h.export("?since=yesterday", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("export with an invalid since = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestExportOrdersTruncated(t *testing.T) {
+	h := newTestHarness(t, withAdminToken)
+	defer h.close()
+	// Orders share their time across the page boundary, and the demo clock
+	// was moved back in between.
+	start := time.Now()
+	for i := 0; i < maxOrderExport+5; i++ {
+		at := start
+		if i > maxOrderExport {
+			at = start.Add(-time.Hour)
+		}
+		h.fe.orders.add(orderRecord{OrderID: fmt.Sprintf("o%d", i), Time: at})
+	}
+
+	var got orderExport
+	resp := h.export("", "")
+	json.Unmarshal([]byte(resp.body), &got)
+	if len(got.Orders) != maxOrderExport || !got.Truncated {
+		t.Fatalf("exported %d orders (truncated: %v), want %d truncated", len(got.Orders), got.Truncated, maxOrderExport)
+	}
+	next := fmt.Sprintf("</admin/orders/export?after=%d>; rel=\"next\"", got.NextAfter)
+	if link := resp.Header.Get("Link"); link != next {
+		t.Errorf("Link = %q, want %q", link, next)
+	}
+	json.Unmarshal([]byte(h.export(fmt.Sprintf("?after=%d", got.NextAfter), "").body), &got)
+	if len(got.Orders) != 5 || got.Truncated || got.Orders[0].OrderID != fmt.Sprintf("o%d", maxOrderExport) {
+		t.Errorf("continued export has %d orders (truncated: %v), want the last 5", len(got.Orders), got.Truncated)
+	}
+
+	resp = h.export("?format=csv", "")
+	rows, err := csv.NewReader(strings.NewReader(resp.body)).ReadAll()
+	if err != nil || len(rows) != maxOrderExport+1 {
+		t.Errorf("truncated CSV export has %d rows (%v), want only the header and orders", len(rows), err)
+	}
+	if link := resp.Header.Get("Link"); !strings.Contains(link, "format=csv") || !strings.HasSuffix(link, `rel="next"`) {
+		t.Errorf("truncated CSV export links to %q, want the next CSV page", link)
+	}
+	if resp := h.export("?after=x", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("export with an invalid after = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestExportOrdersPrivacy(t *testing.T) {
+	h := newTestHarness(t, withAdminToken)
+	defer h.close()
+	placeOrders(t, h, 1)
+
+	for _, format := range []string{"json", "csv"} {
+		body := h.export("?format="+format, "").body
+		for _, field := range []string{"email", "street_address", "zip_code", "city", "credit_card_number"} {
+			if v := checkoutForm.Get(field); strings.Contains(body, v) {
+				t.Errorf("%s export contains the %s %q", format, field, v)
+			}
+		}
+	}
+}
+
+func TestExportOrdersUnauthorized(t *testing.T) {
+	h := newTestHarness(t, withAdminToken, func(fe *frontendServer) { fe.demoMode = true })
+	defer h.close()
+	if resp := h.get("/admin/orders/export"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("export without the admin token = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,522 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	otlpFlushInterval = 5 * time.Second
+	otlpBatchSize     = 512  // spans sent at once
+	otlpMaxQueued     = 4096 // spans waiting to be sent; more are dropped
+	otlpTimeout       = 10 * time.Second
+	otlpScopeName     = "go.opencensus.io"
+)
+
+// OTLP transports, selected with OTEL_EXPORTER_OTLP_PROTOCOL as in the
+// OpenTelemetry SDKs, and their default endpoints.
+const (
+	otlpProtocolGRPC        = "grpc"
+	otlpProtocolJSON        = "http/json"
+	defaultOTLPGRPCEndpoint = "http://localhost:4317"
+	defaultOTLPHTTPEndpoint = "http://localhost:4318"
+
+	otlpExportMethod = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+)
+
+// otlpProtocol is the transport of the spans, gRPC unless
+// OTEL_EXPORTER_OTLP_PROTOCOL asks for HTTP with JSON.
+func otlpProtocol(log logrus.FieldLogger) string {
+	switch v := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); v {
+	case otlpProtocolGRPC, otlpProtocolJSON:
+		return v
+	case "":
+	default:
+		log.Warnf("invalid OTEL_EXPORTER_OTLP_PROTOCOL %q, want %s or %s; using %s", v, otlpProtocolGRPC, otlpProtocolJSON, otlpProtocolGRPC)
+	}
+	return otlpProtocolGRPC
+}
+
+// otlpEndpoint is the collector the spans are sent to, from
+// OTEL_EXPORTER_OTLP_ENDPOINT, or the default port of the protocol.
+func otlpEndpoint(protocol string) string {
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); v != "" {
+		return v
+	}
+	if protocol == otlpProtocolJSON {
+		return defaultOTLPHTTPEndpoint
+	}
+	return defaultOTLPGRPCEndpoint
+}
+
+// otlpExporter sends the spans to an OpenTelemetry collector with OTLP,
+// over gRPC or over HTTP with JSON, which Jaeger and Tempo accept as well.
+// The spans are queued and sent in batches, by run.
+type otlpExporter struct {
+	service string
+	send    func(ctx context.Context, spans []*trace.SpanData) error
+
+	// Over gRPC. The connection is not traced, for the exports not to be
+	// exported in turn.
+	conn *grpc.ClientConn
+	// Over HTTP. The client is not traced either.
+	url    string // of the traces
+	client *http.Client
+
+	mu      sync.Mutex
+	queued  []*trace.SpanData
+	dropped int
+	full    chan struct{} // a batch is ready
+}
+
+func newOTLPExporter(endpoint, protocol, service string) (*otlpExporter, error) {
+	e := &otlpExporter{service: service, full: make(chan struct{}, 1)}
+	if protocol == otlpProtocolJSON {
+		e.url = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+		e.client = &http.Client{Timeout: otlpTimeout}
+		e.send = e.sendJSON
+		return e, nil
+	}
+	target, creds := otlpGRPCTarget(endpoint)
+	conn, err := grpc.Dial(target, creds)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not dial the collector at %s", endpoint)
+	}
+	e.conn = conn
+	e.send = e.sendGRPC
+	return e, nil
+}
+
+// otlpGRPCTarget is the address to dial for an endpoint, a URL or a bare
+// host and port, with TLS for https URLs only.
+func otlpGRPCTarget(endpoint string) (string, grpc.DialOption) {
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		if u.Scheme == "https" {
+			return u.Host, grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, ""))
+		}
+		return u.Host, grpc.WithInsecure()
+	}
+	return endpoint, grpc.WithInsecure()
+}
+
+// close closes the connection to the collector, once flushed.
+func (e *otlpExporter) close() {
+	if e.conn != nil {
+		e.conn.Close()
+	}
+}
+
+// ExportSpan queues a span, dropping it when the collector cannot keep up.
+func (e *otlpExporter) ExportSpan(sd *trace.SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queued) >= otlpMaxQueued {
+		e.dropped++
+		return
+	}
+	e.queued = append(e.queued, sd)
+	if len(e.queued) == otlpBatchSize {
+		select {
+		case e.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run sends the queued spans every interval, or as soon as a batch is
+// ready, until ctx is done.
+func (e *otlpExporter) run(ctx context.Context, log logrus.FieldLogger, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		case <-e.full:
+		}
+		if err := e.flush(ctx, log); err != nil {
+			log.WithFields(logrus.Fields{"event": "otlp_export_failed", "error": err}).Warn("could not export spans")
+		}
+	}
+}
+
+// flush sends the queued spans, in batches. Spans of a batch the collector
+// did not take are dropped.
+func (e *otlpExporter) flush(ctx context.Context, log logrus.FieldLogger) error {
+	e.mu.Lock()
+	spans, dropped := e.queued, e.dropped
+	e.queued, e.dropped = nil, 0
+	e.mu.Unlock()
+	if dropped > 0 {
+		log.WithFields(logrus.Fields{"event": "otlp_spans_dropped", "dropped": dropped}).Warn("spans dropped, the collector is too slow")
+	}
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > otlpBatchSize {
+			n = otlpBatchSize
+		}
+		if err := e.send(ctx, spans[:n]); err != nil {
+			return err
+		}
+		spans = spans[n:]
+	}
+	return nil
+}
+
+func (e *otlpExporter) sendGRPC(ctx context.Context, spans []*trace.SpanData) error {
+	ctx, cancel := context.WithTimeout(ctx, otlpTimeout)
+	defer cancel()
+	req := otlpRequest(encodeOTLPTraces(e.service, spans))
+	return errors.Wrap(e.conn.Invoke(ctx, otlpExportMethod, req, new(otlpResponse)), "collector did not take the spans")
+}
+
+func (e *otlpExporter) sendJSON(ctx context.Context, spans []*trace.SpanData) error {
+	body, err := json.Marshal(newOTLPTraces(e.service, spans))
+	if err != nil {
+		return errors.Wrap(err, "could not encode spans")
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "could not reach the collector")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP span kinds and status codes.
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpKindClient   = 3
+	otlpStatusError  = 2
+)
+
+func otlpKind(sd *trace.SpanData) int {
+	switch sd.SpanKind {
+	case trace.SpanKindServer:
+		return otlpKindServer
+	case trace.SpanKindClient:
+		return otlpKindClient
+	}
+	return otlpKindInternal
+}
+
+// otlpAttributeKeys returns the keys of the attributes OTLP can carry,
+// sorted. Those of OpenCensus are strings, booleans, int64 or float64.
+func otlpAttributeKeys(attrs map[string]interface{}) []string {
+	keys := make([]string, 0, len(attrs))
+	for k, v := range attrs {
+		switch v.(type) {
+		case string, bool, int64, float64:
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The OTLP protobuf encoding of spans, as an ExportTraceServiceRequest.
+// The field numbers are those of opentelemetry-proto's
+// collector/trace/v1/trace_service.proto, trace/v1/trace.proto,
+// resource/v1/resource.proto and common/v1/common.proto.
+const (
+	pbRequestResourceSpans    = 1
+	pbResourceSpansResource   = 1
+	pbResourceSpansScopeSpans = 2
+	pbResourceAttributes      = 1
+	pbScopeSpansScope         = 1
+	pbScopeSpansSpans         = 2
+	pbScopeName               = 1
+	pbSpanTraceID             = 1
+	pbSpanSpanID              = 2
+	pbSpanParentSpanID        = 4
+	pbSpanName                = 5
+	pbSpanKind                = 6
+	pbSpanStartTime           = 7
+	pbSpanEndTime             = 8
+	pbSpanAttributes          = 9
+	pbSpanEvents              = 11
+	pbSpanStatus              = 15
+	pbEventTime               = 1
+	pbEventName               = 2
+	pbEventAttributes         = 3
+	pbStatusMessage           = 2
+	pbStatusCode              = 3
+	pbKeyValueKey             = 1
+	pbKeyValueValue           = 2
+	pbValueString             = 1
+	pbValueBool               = 2
+	pbValueInt                = 3
+	pbValueDouble             = 4
+)
+
+// pbWriter appends the fields of a protobuf message. Fields are written
+// even with their zero value, which the attribute values need to tell
+// their type.
+type pbWriter struct{ proto.Buffer }
+
+func (w *pbWriter) putKey(field int, wire int) {
+	w.EncodeVarint(uint64(field)<<3 | uint64(wire))
+}
+
+func (w *pbWriter) putBytes(field int, b []byte) {
+	w.putKey(field, proto.WireBytes)
+	w.EncodeRawBytes(b)
+}
+
+func (w *pbWriter) putString(field int, s string) {
+	w.putKey(field, proto.WireBytes)
+	w.EncodeStringBytes(s)
+}
+
+func (w *pbWriter) putVarint(field int, v uint64) {
+	w.putKey(field, proto.WireVarint)
+	w.EncodeVarint(v)
+}
+
+func (w *pbWriter) putFixed64(field int, v uint64) {
+	w.putKey(field, proto.WireFixed64)
+	w.EncodeFixed64(v)
+}
+
+func (w *pbWriter) putMessage(field int, fill func(*pbWriter)) {
+	var m pbWriter
+	fill(&m)
+	w.putBytes(field, m.Bytes())
+}
+
+func encodeOTLPTraces(service string, spans []*trace.SpanData) []byte {
+	var req pbWriter
+	req.putMessage(pbRequestResourceSpans, func(rs *pbWriter) {
+		rs.putMessage(pbResourceSpansResource, func(r *pbWriter) {
+			putOTLPAttributes(r, pbResourceAttributes, map[string]interface{}{"service.name": service})
+		})
+		rs.putMessage(pbResourceSpansScopeSpans, func(ss *pbWriter) {
+			ss.putMessage(pbScopeSpansScope, func(s *pbWriter) { s.putString(pbScopeName, otlpScopeName) })
+			for _, sd := range spans {
+				ss.putMessage(pbScopeSpansSpans, func(s *pbWriter) { encodeOTLPSpan(s, sd) })
+			}
+		})
+	})
+	return req.Bytes()
+}
+
+func encodeOTLPSpan(w *pbWriter, sd *trace.SpanData) {
+	w.putBytes(pbSpanTraceID, sd.TraceID[:])
+	w.putBytes(pbSpanSpanID, sd.SpanID[:])
+	if sd.ParentSpanID != (trace.SpanID{}) {
+		w.putBytes(pbSpanParentSpanID, sd.ParentSpanID[:])
+	}
+	w.putString(pbSpanName, sd.Name)
+	w.putVarint(pbSpanKind, uint64(otlpKind(sd)))
+	w.putFixed64(pbSpanStartTime, uint64(sd.StartTime.UnixNano()))
+	w.putFixed64(pbSpanEndTime, uint64(sd.EndTime.UnixNano()))
+	putOTLPAttributes(w, pbSpanAttributes, sd.Attributes)
+	for _, a := range sd.Annotations {
+		w.putMessage(pbSpanEvents, func(ev *pbWriter) {
+			ev.putFixed64(pbEventTime, uint64(a.Time.UnixNano()))
+			ev.putString(pbEventName, a.Message)
+			putOTLPAttributes(ev, pbEventAttributes, a.Attributes)
+		})
+	}
+	if sd.Code != trace.StatusCodeOK {
+		w.putMessage(pbSpanStatus, func(st *pbWriter) {
+			st.putString(pbStatusMessage, sd.Message)
+			st.putVarint(pbStatusCode, otlpStatusError)
+		})
+	}
+}
+
+// putOTLPAttributes writes attrs as KeyValue messages in field.
+func putOTLPAttributes(w *pbWriter, field int, attrs map[string]interface{}) {
+	for _, k := range otlpAttributeKeys(attrs) {
+		w.putMessage(field, func(kv *pbWriter) {
+			kv.putString(pbKeyValueKey, k)
+			kv.putMessage(pbKeyValueValue, func(value *pbWriter) {
+				switch v := attrs[k].(type) {
+				case string:
+					value.putString(pbValueString, v)
+				case bool:
+					var b uint64
+					if v {
+						b = 1
+					}
+					value.putVarint(pbValueBool, b)
+				case int64:
+					value.putVarint(pbValueInt, uint64(v))
+				case float64:
+					value.putFixed64(pbValueDouble, math.Float64bits(v))
+				}
+			})
+		})
+	}
+}
+
+// otlpRequest is an encoded ExportTraceServiceRequest, which the gRPC
+// codec sends as is.
+type otlpRequest []byte
+
+func (r otlpRequest) Marshal() ([]byte, error) { return r, nil }
+
+// otlpResponse is an ExportTraceServiceResponse. Its partial success is
+// not looked at: the spans a collector rejects are lost either way.
+type otlpResponse struct{}
+
+func (*otlpResponse) Reset()                 {}
+func (*otlpResponse) String() string         { return "ExportTraceServiceResponse" }
+func (*otlpResponse) ProtoMessage()          {}
+func (*otlpResponse) Unmarshal([]byte) error { return nil }
+
+// The OTLP JSON encoding of spans, as defined by the OpenTelemetry
+// protocol: IDs are hex, 64-bit integers are strings.
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Events            []otlpEvent    `json:"events,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpEvent struct {
+		TimeUnixNano string         `json:"timeUnixNano"`
+		Name         string         `json:"name"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+func newOTLPTraces(service string, spans []*trace.SpanData) otlpTraces {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: otlpScopeName}}
+	for _, sd := range spans {
+		scope.Spans = append(scope.Spans, newOTLPSpan(sd))
+	}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(map[string]interface{}{"service.name": service})},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}}
+}
+
+func newOTLPSpan(sd *trace.SpanData) otlpSpan {
+	s := otlpSpan{
+		TraceID:           sd.TraceID.String(),
+		SpanID:            sd.SpanID.String(),
+		Name:              sd.Name,
+		Kind:              otlpKind(sd),
+		StartTimeUnixNano: strconv.FormatInt(sd.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(sd.EndTime.UnixNano(), 10),
+		Attributes:        otlpAttributes(sd.Attributes),
+	}
+	if sd.ParentSpanID != (trace.SpanID{}) {
+		s.ParentSpanID = sd.ParentSpanID.String()
+	}
+	for _, a := range sd.Annotations {
+		s.Events = append(s.Events, otlpEvent{
+			TimeUnixNano: strconv.FormatInt(a.Time.UnixNano(), 10),
+			Name:         a.Message,
+			Attributes:   otlpAttributes(a.Attributes),
+		})
+	}
+	if sd.Code != trace.StatusCodeOK {
+		s.Status = otlpStatus{Code: otlpStatusError, Message: sd.Message}
+	}
+	return s
+}
+
+// otlpAttributes converts the attributes of OpenCensus, sorted by key.
+func otlpAttributes(attrs map[string]interface{}) []otlpKeyValue {
+	var out []otlpKeyValue
+	for _, k := range otlpAttributeKeys(attrs) {
+		var value otlpValue
+		switch v := attrs[k].(type) {
+		case string:
+			value.StringValue = &v
+		case bool:
+			value.BoolValue = &v
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		}
+		out = append(out, otlpKeyValue{Key: k, Value: value})
+	}
+	return out
+}
@@ -0,0 +1,369 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// otlpTestSpans are a server span and its client child, with every kind
+// of attribute, an event and an error status.
+func otlpTestSpans() (parent, child *trace.SpanData) {
+	start := time.Unix(1700000000, 123456789)
+	tid := trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+	parent = &trace.SpanData{
+		SpanContext: trace.SpanContext{TraceID: tid, SpanID: trace.SpanID{0, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7}},
+		SpanKind:    trace.SpanKindServer,
+		Name:        "GET /cart",
+		StartTime:   start,
+		EndTime:     start.Add(30 * time.Millisecond),
+	}
+	child = &trace.SpanData{
+		SpanContext:  trace.SpanContext{TraceID: tid, SpanID: trace.SpanID{0x53, 0x99, 0x5c, 0x3f, 0x42, 0xcd, 0x8a, 0xd8}},
+		ParentSpanID: parent.SpanID,
+		SpanKind:     trace.SpanKindClient,
+		Name:         "hipstershop.CartService.GetCart",
+		StartTime:    start.Add(time.Millisecond),
+		EndTime:      start.Add(20 * time.Millisecond),
+		Attributes: map[string]interface{}{
+			"cart.lines": int64(-3),
+			"cart.total": 12.5,
+			"cart.user":  "u1",
+			"retried":    false,
+		},
+		Annotations: []trace.Annotation{{
+			Time:       start.Add(10 * time.Millisecond),
+			Message:    "retry",
+			Attributes: map[string]interface{}{"attempt": int64(2)},
+		}},
+		Status: trace.Status{Code: trace.StatusCodeUnavailable, Message: "cart down"},
+	}
+	return parent, child
+}
+
+func TestOTLPJSONSchema(t *testing.T) {
+	parent, child := otlpTestSpans()
+	got, err := json.Marshal(newOTLPTraces("frontend", []*trace.SpanData{parent, child}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// IDs are hex, timestamps are unix nanos as decimal strings, as are
+	// int values, and each value is wrapped by its type.
+	want := `{"resourceSpans": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "frontend"}}]},
+		"scopeSpans": [{
+			"scope": {"name": "go.opencensus.io"},
+			"spans": [{
+				"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+				"spanId": "00f067aa0ba902b7",
+				"name": "GET /cart",
+				"kind": 2,
+				"startTimeUnixNano": "1700000000123456789",
+				"endTimeUnixNano": "1700000000153456789",
+				"status": {}
+			}, {
+				"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+				"spanId": "53995c3f42cd8ad8",
+				"parentSpanId": "00f067aa0ba902b7",
+				"name": "hipstershop.CartService.GetCart",
+				"kind": 3,
+				"startTimeUnixNano": "1700000000124456789",
+				"endTimeUnixNano": "1700000000143456789",
+				"attributes": [
+					{"key": "cart.lines", "value": {"intValue": "-3"}},
+					{"key": "cart.total", "value": {"doubleValue": 12.5}},
+					{"key": "cart.user", "value": {"stringValue": "u1"}},
+					{"key": "retried", "value": {"boolValue": false}}
+				],
+				"events": [{
+					"timeUnixNano": "1700000000133456789",
+					"name": "retry",
+					"attributes": [{"key": "attempt", "value": {"intValue": "2"}}]
+				}],
+				"status": {"code": 2, "message": "cart down"}
+			}]
+		}]
+	}]}`
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("encoded\n%s\nwant\n%s", got, want)
+	}
+}
+
+// pbField is a decoded protobuf field: a varint or fixed64 in v, or the
+// bytes of a length-delimited field in b.
+type pbField struct {
+	v uint64
+	b []byte
+}
+
+// decodePB splits a protobuf message into its fields, by number.
+func decodePB(t *testing.T, b []byte) map[int][]pbField {
+	t.Helper()
+	fields := make(map[int][]pbField)
+	for len(b) > 0 {
+		key, n := proto.DecodeVarint(b)
+		if n == 0 {
+			t.Fatalf("bad key in % x", b)
+		}
+		b = b[n:]
+		var f pbField
+		switch key & 7 {
+		case proto.WireVarint:
+			f.v, n = proto.DecodeVarint(b)
+			if n == 0 {
+				t.Fatalf("bad varint in % x", b)
+			}
+			b = b[n:]
+		case proto.WireFixed64:
+			if len(b) < 8 {
+				t.Fatalf("short fixed64 in % x", b)
+			}
+			f.v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case proto.WireBytes:
+			l, n := proto.DecodeVarint(b)
+			if n == 0 || uint64(len(b)-n) < l {
+				t.Fatalf("bad length in % x", b)
+			}
+			f.b, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		fields[int(key>>3)] = append(fields[int(key>>3)], f)
+	}
+	return fields
+}
+
+// one returns the only field number n of m.
+func one(t *testing.T, m map[int][]pbField, n int) pbField {
+	t.Helper()
+	if len(m[n]) != 1 {
+		t.Fatalf("field %d appears %d times, want once", n, len(m[n]))
+	}
+	return m[n][0]
+}
+
+// decodePBAttributes returns the KeyValue messages of field n of m, with
+// their AnyValue decoded.
+func decodePBAttributes(t *testing.T, m map[int][]pbField, n int) map[string]map[int][]pbField {
+	t.Helper()
+	attrs := make(map[string]map[int][]pbField)
+	for _, f := range m[n] {
+		kv := decodePB(t, f.b)
+		attrs[string(one(t, kv, pbKeyValueKey).b)] = decodePB(t, one(t, kv, pbKeyValueValue).b)
+	}
+	return attrs
+}
+
+// rawMessage is a protobuf message the test collector keeps encoded.
+type rawMessage struct{ b []byte }
+
+func (m *rawMessage) Reset()                   { m.b = nil }
+func (m *rawMessage) String() string           { return "raw" }
+func (m *rawMessage) ProtoMessage()            {}
+func (m *rawMessage) Marshal() ([]byte, error) { return m.b, nil }
+func (m *rawMessage) Unmarshal(b []byte) error { m.b = append([]byte(nil), b...); return nil }
+
+// otlpCollector serves the OTLP trace service, passing the requests to
+// export, and returns its endpoint.
+func otlpCollector(t *testing.T, export func([]byte) error) (string, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "opentelemetry.proto.collector.trace.v1.TraceService",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Export",
+			Handler: func(_ interface{}, _ context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				var req rawMessage
+				if err := dec(&req); err != nil {
+					return nil, err
+				}
+				return &rawMessage{}, export(req.b)
+			},
+		}},
+	}, struct{}{})
+	go srv.Serve(lis)
+	return "http://" + lis.Addr().String(), srv.Stop
+}
+
+func TestOTLPExportGRPC(t *testing.T) {
+	received := make(chan []byte, 1)
+	var refuse error
+	endpoint, stop := otlpCollector(t, func(req []byte) error {
+		received <- req
+		return refuse
+	})
+	defer stop()
+
+	e, err := newOTLPExporter(endpoint, otlpProtocolGRPC, "frontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.close()
+	parent, child := otlpTestSpans()
+	e.ExportSpan(parent)
+	e.ExportSpan(child)
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	if err := e.flush(context.Background(), log); err != nil {
+		t.Fatal(err)
+	}
+
+	req := decodePB(t, <-received)
+	rs := decodePB(t, one(t, req, pbRequestResourceSpans).b)
+	resource := decodePB(t, one(t, rs, pbResourceSpansResource).b)
+	if v := decodePBAttributes(t, resource, pbResourceAttributes)["service.name"]; v == nil || string(one(t, v, pbValueString).b) != "frontend" {
+		t.Errorf("resource = %v, want the service name", resource)
+	}
+	ss := decodePB(t, one(t, rs, pbResourceSpansScopeSpans).b)
+	if scope := decodePB(t, one(t, ss, pbScopeSpansScope).b); string(one(t, scope, pbScopeName).b) != otlpScopeName {
+		t.Errorf("scope = %v", scope)
+	}
+	if len(ss[pbScopeSpansSpans]) != 2 {
+		t.Fatalf("%d spans exported, want 2", len(ss[pbScopeSpansSpans]))
+	}
+
+	// IDs are raw bytes, timestamps unix nanos in fixed64.
+	for i, sd := range []*trace.SpanData{parent, child} {
+		s := decodePB(t, ss[pbScopeSpansSpans][i].b)
+		if got := one(t, s, pbSpanTraceID).b; string(got) != string(sd.TraceID[:]) {
+			t.Errorf("span %d: trace ID % x, want % x", i, got, sd.TraceID[:])
+		}
+		if got := one(t, s, pbSpanSpanID).b; string(got) != string(sd.SpanID[:]) {
+			t.Errorf("span %d: span ID % x, want % x", i, got, sd.SpanID[:])
+		}
+		if got := string(one(t, s, pbSpanName).b); got != sd.Name {
+			t.Errorf("span %d: name %q", i, got)
+		}
+		if got, want := one(t, s, pbSpanStartTime).v, uint64(sd.StartTime.UnixNano()); got != want {
+			t.Errorf("span %d: start %d, want %d", i, got, want)
+		}
+		if got, want := one(t, s, pbSpanEndTime).v, uint64(sd.EndTime.UnixNano()); got != want {
+			t.Errorf("span %d: end %d, want %d", i, got, want)
+		}
+	}
+	p, c := decodePB(t, ss[pbScopeSpansSpans][0].b), decodePB(t, ss[pbScopeSpansSpans][1].b)
+	if len(p[pbSpanParentSpanID]) != 0 || string(one(t, c, pbSpanParentSpanID).b) != string(parent.SpanID[:]) {
+		t.Errorf("parents = %v, %v", p[pbSpanParentSpanID], c[pbSpanParentSpanID])
+	}
+	if one(t, p, pbSpanKind).v != otlpKindServer || one(t, c, pbSpanKind).v != otlpKindClient {
+		t.Errorf("kinds = %v, %v", p[pbSpanKind], c[pbSpanKind])
+	}
+	if len(p[pbSpanStatus]) != 0 {
+		t.Errorf("status of the parent = %v, want none", p[pbSpanStatus])
+	}
+	if st := decodePB(t, one(t, c, pbSpanStatus).b); one(t, st, pbStatusCode).v != otlpStatusError || string(one(t, st, pbStatusMessage).b) != "cart down" {
+		t.Errorf("status of the child = %v", st)
+	}
+
+	// Each value is wrapped in the AnyValue field of its type, zero
+	// values included.
+	attrs := decodePBAttributes(t, c, pbSpanAttributes)
+	if len(attrs) != 4 {
+		t.Errorf("attributes = %v", attrs)
+	}
+	if v := attrs["cart.lines"]; v == nil || int64(one(t, v, pbValueInt).v) != -3 {
+		t.Errorf("int attribute = %v", v)
+	}
+	if v := attrs["cart.total"]; v == nil || math.Float64frombits(one(t, v, pbValueDouble).v) != 12.5 {
+		t.Errorf("double attribute = %v", v)
+	}
+	if v := attrs["cart.user"]; v == nil || string(one(t, v, pbValueString).b) != "u1" {
+		t.Errorf("string attribute = %v", v)
+	}
+	if v := attrs["retried"]; v == nil || one(t, v, pbValueBool).v != 0 {
+		t.Errorf("bool attribute = %v", v)
+	}
+	ev := decodePB(t, one(t, c, pbSpanEvents).b)
+	if one(t, ev, pbEventTime).v != uint64(child.Annotations[0].Time.UnixNano()) || string(one(t, ev, pbEventName).b) != "retry" {
+		t.Errorf("event = %v", ev)
+	}
+	if v := decodePBAttributes(t, ev, pbEventAttributes)["attempt"]; v == nil || one(t, v, pbValueInt).v != 2 {
+		t.Errorf("event attributes = %v", ev)
+	}
+
+	refuse = status.Error(codes.Unavailable, "overloaded")
+	e.ExportSpan(parent)
+	if err := e.flush(context.Background(), log); err == nil {
+		t.Error("no error when the collector refuses spans")
+	}
+	<-received
+}
+
+func TestOTLPGRPCTarget(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint, want string
+	}{
+		{"http://collector:4317", "collector:4317"},
+		{"https://collector:4317", "collector:4317"},
+		{"http://collector:4317/", "collector:4317"},
+		{"collector:4317", "collector:4317"},
+	} {
+		if got, _ := otlpGRPCTarget(tc.endpoint); got != tc.want {
+			t.Errorf("otlpGRPCTarget(%q) = %q, want %q", tc.endpoint, got, tc.want)
+		}
+	}
+}
+
+func TestOTLPProtocolFromEnv(t *testing.T) {
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	for _, tc := range []struct {
+		protocol, endpoint         string
+		wantProtocol, wantEndpoint string
+	}{
+		{"", "", otlpProtocolGRPC, "http://localhost:4317"},
+		{"grpc", "", otlpProtocolGRPC, "http://localhost:4317"},
+		{"http/json", "", otlpProtocolJSON, "http://localhost:4318"},
+		{"http/protobuf", "", otlpProtocolGRPC, "http://localhost:4317"},
+		{"http/json", "http://collector:4318", otlpProtocolJSON, "http://collector:4318"},
+		{"", "http://collector:4317", otlpProtocolGRPC, "http://collector:4317"},
+	} {
+		os.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", tc.protocol)
+		os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", tc.endpoint)
+		protocol := otlpProtocol(log)
+		if endpoint := otlpEndpoint(protocol); protocol != tc.wantProtocol || endpoint != tc.wantEndpoint {
+			t.Errorf("protocol %q, endpoint %q: %s to %s, want %s to %s", tc.protocol, tc.endpoint, protocol, endpoint, tc.wantProtocol, tc.wantEndpoint)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.opencensus.io/plugin/ocgrpc"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+// defaultOutboundTimeout bounds the calls made with the outbound HTTP
+// client.
+const defaultOutboundTimeout = 10 * time.Second
+
+// newOutboundClient returns the HTTP client shared by the features calling
+// non-gRPC services. Each request made with a context gets a client span,
+// named after its method and host, under the span of that context, and is
+// counted in the ochttp client views.
+func newOutboundClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &ochttp.Transport{
+			FormatSpanName: func(r *http.Request) string { return "HTTP " + r.Method + " " + r.URL.Host },
+		},
+	}
+}
+
+// redisDoer is the part of a Redis client the frontend uses. For keyed
+// commands the first argument is the key.
+type redisDoer interface {
+	Do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error)
+}
+
+var (
+	redisCommandKey, _ = tag.NewKey("redis_command")
+	redisStatusKey, _  = tag.NewKey("redis_status")
+
+	redisLatency = stats.Float64("frontend/redis/roundtrip_latency",
+		"Time between sending a Redis command and receiving its reply", stats.UnitMilliseconds)
+
+	// The Redis views mirror the gRPC client views: latency by command,
+	// and completed commands by command and status.
+	redisLatencyView = &view.View{
+		Name:        "frontend/redis/roundtrip_latency",
+		Measure:     redisLatency,
+		Description: redisLatency.Description(),
+		TagKeys:     []tag.Key{redisCommandKey},
+		Aggregation: ocgrpc.DefaultMillisecondsDistribution,
+	}
+	redisCommandsView = &view.View{
+		Name:        "frontend/redis/completed_commands",
+		Measure:     redisLatency,
+		Description: "Redis commands completed, by command and status",
+		TagKeys:     []tag.Key{redisCommandKey, redisStatusKey},
+		Aggregation: view.Count(),
+	}
+)
+
+// tracedRedis instruments a Redis client: every command gets a client span
+// under the span of its context, tagged with the command and the pattern of
+// its key, and is recorded in the Redis views.
+type tracedRedis struct {
+	next redisDoer
+}
+
+func traceRedis(c redisDoer) redisDoer { return tracedRedis{next: c} }
+
+func (t tracedRedis) Do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	cmd = strings.ToUpper(cmd)
+	ctx, span := trace.StartSpan(ctx, "redis "+cmd, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("redis.command", cmd))
+	if len(args) > 0 {
+		if key, ok := args[0].(string); ok {
+			span.AddAttributes(trace.StringAttribute("redis.key_pattern", redisKeyPattern(key)))
+		}
+	}
+
+	start := time.Now()
+	reply, err := t.next.Do(ctx, cmd, args...)
+	status := "OK"
+	if err != nil {
+		status = "ERROR"
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	if ctx, terr := tag.New(ctx, tag.Upsert(redisCommandKey, cmd), tag.Upsert(redisStatusKey, status)); terr == nil {
+		stats.Record(ctx, redisLatency.M(float64(time.Since(start))/float64(time.Millisecond)))
+	}
+	return reply, err
+}
+
+// redisKeyPattern replaces the identifiers in a key such as
+// "session:2f9a1c:cart" with "*", giving "session:*:cart", so that spans do
+// not carry session or product IDs. Segments are separated by colons; those
+// with a digit or over 24 characters long are taken for identifiers.
+func redisKeyPattern(key string) string {
+	segs := strings.Split(key, ":")
+	for i, s := range segs {
+		if len(s) > 24 || strings.IndexFunc(s, unicode.IsDigit) >= 0 {
+			segs[i] = "*"
+		}
+	}
+	return strings.Join(segs, ":")
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+)
+
+// clientSpans starts a sampled parent span, runs f under it and returns
+// the parent along with the client spans f created.
+func clientSpans(t *testing.T, f func(ctx context.Context)) (trace.SpanContext, []*trace.SpanData) {
+	t.Helper()
+	rec := &spanRecorder{kind: trace.SpanKindClient}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+
+	ctx, parent := trace.StartSpan(context.Background(), "GET /cart", trace.WithSampler(trace.AlwaysSample()))
+	f(ctx)
+	parent.End()
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return parent.SpanContext(), rec.spans
+}
+
+func TestOutboundClientSpans(t *testing.T) {
+	var traceHeader string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceHeader = r.Header.Get("X-B3-TraceId")
+		if strings.HasSuffix(r.URL.Path, "/fail") {
+			http.Error(w, "boom", http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+	client := newOutboundClient(defaultOutboundTimeout)
+
+	parent, spans := clientSpans(t, func(ctx context.Context) {
+		for _, path := range []string{"/hooks/order/1234", "/hooks/fail"} {
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+path, nil)
+			resp, err := client.Do(req.WithContext(ctx))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	})
+	if len(spans) != 2 {
+		t.Fatalf("got %d client spans, want 2", len(spans))
+	}
+	host := strings.TrimPrefix(srv.URL, "http://")
+	for i, sd := range spans {
+		if sd.ParentSpanID != parent.SpanID || sd.TraceID != parent.TraceID {
+			t.Errorf("span %q not parented from the request span", sd.Name)
+		}
+		if want := "HTTP POST " + host; sd.Name != want {
+			t.Errorf("span name = %q, want %q", sd.Name, want)
+		}
+		if sd.Attributes["http.method"] != "POST" || sd.Attributes["http.host"] != host {
+			t.Errorf("span attributes %v lack the method or host", sd.Attributes)
+		}
+		wantStatus, wantOK := int64(200), true
+		if i == 1 {
+			wantStatus, wantOK = 502, false
+		}
+		if sd.Attributes["http.status_code"] != wantStatus || (sd.Status.Code == trace.StatusCodeOK) != wantOK {
+			t.Errorf("span %d: status %v, code %d; want %d", i, sd.Attributes["http.status_code"], sd.Status.Code, wantStatus)
+		}
+	}
+	if traceHeader != parent.TraceID.String() {
+		t.Errorf("trace context not propagated: got trace ID %q", traceHeader)
+	}
+}
+
+// fakeRedis answers GET with the value of the key, or fails.
+type fakeRedis map[string]string
+
+func (f fakeRedis) Do(_ context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if v, ok := f[args[0].(string)]; ok {
+		return v, nil
+	}
+	return nil, errors.New("connection reset")
+}
+
+func TestTracedRedis(t *testing.T) {
+	if err := view.Register(redisCommandsView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(redisCommandsView)
+	const session = "session:6f1c2a9e-8b1d-4a3e-9c55-0d2d6a1f7e4b:cart"
+	c := traceRedis(fakeRedis{session: "OLJCESPC7Z"})
+
+	parent, spans := clientSpans(t, func(ctx context.Context) {
+		if v, err := c.Do(ctx, "get", session); err != nil || v != "OLJCESPC7Z" {
+			t.Errorf("GET = %v, %v; want the value from the client", v, err)
+		}
+		if _, err := c.Do(ctx, "get", "ratelimit:203.0.113.7"); err == nil {
+			t.Error("error from the client lost")
+		}
+	})
+	if len(spans) != 2 {
+		t.Fatalf("got %d client spans, want 2", len(spans))
+	}
+	for i, want := range []string{"session:*:cart", "ratelimit:*"} {
+		sd := spans[i]
+		if sd.Name != "redis GET" || sd.ParentSpanID != parent.SpanID {
+			t.Errorf("span %q with parent %v, want redis GET under the request span", sd.Name, sd.ParentSpanID)
+		}
+		if got := sd.Attributes["redis.key_pattern"]; got != want {
+			t.Errorf("key pattern = %v, want %q", got, want)
+		}
+	}
+	if spans[0].Status.Code != trace.StatusCodeOK || spans[1].Status.Code == trace.StatusCodeOK {
+		t.Error("failed command not tagged as an error")
+	}
+
+	rows, err := view.RetrieveData(redisCommandsView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]int64)
+	for _, row := range rows {
+		for _, tg := range row.Tags {
+			if tg.Key == redisStatusKey {
+				statuses[tg.Value] += row.Data.(*view.CountData).Value
+			}
+		}
+	}
+	if statuses["OK"] != 1 || statuses["ERROR"] != 1 {
+		t.Errorf("completed commands by status = %v, want one OK and one ERROR", statuses)
+	}
+}
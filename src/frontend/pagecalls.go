@@ -0,0 +1,90 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// callClass says what a page does when one of its backend calls fails.
+type callClass int
+
+const (
+	// essential calls provide what the page is about; their failure
+	// renders the error page.
+	essential callClass = iota
+	// decorative calls provide optional parts of the page; their failure
+	// only leaves that part out.
+	decorative
+)
+
+func (c callClass) String() string {
+	if c == decorative {
+		return "decorative"
+	}
+	return "essential"
+}
+
+// callClassTimeouts bounds each backend call of a page by its class, so a
+// slow decorative backend cannot hold back the page for long.
+var callClassTimeouts = map[callClass]time.Duration{
+	essential:  3 * time.Second,
+	decorative: 500 * time.Millisecond,
+}
+
+// pageCallClasses classifies the backend calls made by each page, by page
+// and gRPC method name. Calls not listed are essential.
+var pageCallClasses = map[string]map[string]callClass{
+	"product": {
+		"GetProduct":             essential,
+		"GetSupportedCurrencies": essential,
+		"Convert":                essential,
+		"GetCart":                decorative,
+		"ListRecommendations":    decorative,
+		"GetAds":                 decorative,
+	},
+	"resume": {
+		"GetCart":    decorative,
+		"GetQuote":   decorative,
+		"GetProduct": decorative,
+	},
+}
+
+func classifyCall(page, call string) callClass {
+	if c, ok := pageCallClasses[page][call]; ok {
+		return c
+	}
+	return essential
+}
+
+// pageCall runs a backend call made by page with the timeout of its class.
+// The error of an essential call is returned for the page to fail with. A
+// failed decorative call is logged and tagged on the span, and nil is
+// returned so the page renders without it.
+func pageCall(ctx context.Context, log logrus.FieldLogger, page, call string, fn func(ctx context.Context) error) error {
+	class := classifyCall(page, call)
+	callCtx, cancel := context.WithTimeout(ctx, callClassTimeouts[class])
+	defer cancel()
+
+	err := fn(callCtx)
+	if err == nil || class == essential {
+		return err
+	}
+	degradeOptional(ctx, log, call, err)
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestProductPageCallFailures(t *testing.T) {
+	for _, tc := range []struct {
+		method   string
+		degraded bool
+	}{
+		{"/hipstershop.ProductCatalogService/GetProduct", false},
+		{"/hipstershop.CurrencyService/GetSupportedCurrencies", false},
+		{"/hipstershop.CurrencyService/Convert", true}, // shown in USD
+		{"/hipstershop.CartService/GetCart", true},
+		{"/hipstershop.RecommendationService/ListRecommendations", true},
+		{"/hipstershop.AdService/GetAds", true},
+	} {
+		t.Run(tc.method, func(t *testing.T) {
+			h := newTestHarness(t)
+			defer h.close()
+			h.fail(tc.method, status.Error(codes.Unavailable, "injected failure"))
+
+			resp := h.get("/product/OLJCESPC7Z")
+			if h.faults.calls(tc.method) == 0 {
+				t.Fatalf("%s was never called", tc.method)
+			}
+			if !tc.degraded {
+				if resp.StatusCode != http.StatusServiceUnavailable {
+					t.Errorf("status = %d, want %d for an essential call", resp.StatusCode, http.StatusServiceUnavailable)
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d for a decorative call", resp.StatusCode, http.StatusOK)
+			}
+			if !strings.Contains(resp.body, "Vintage Typewriter") {
+				t.Error("degraded page does not show the product")
+			}
+		})
+	}
+}
+
+func TestDecorativeCallTimeout(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.delay("/hipstershop.CartService/GetCart", 2*callClassTimeouts[decorative])
+
+	start := time.Now()
+	resp := h.get("/product/OLJCESPC7Z")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if d := time.Since(start); d >= 2*callClassTimeouts[decorative] {
+		t.Errorf("page took %v, the slow decorative call was not cut short", d)
+	}
+}
+
+func TestClassifyCall(t *testing.T) {
+	if got := classifyCall("product", "GetAds"); got != decorative {
+		t.Errorf("product GetAds = %v, want decorative", got)
+	}
+	if got := classifyCall("product", "Unknown"); got != essential {
+		t.Errorf("unlisted call = %v, want essential", got)
+	}
+	if got := classifyCall("unknown", "GetAds"); got != essential {
+		t.Errorf("call of an unlisted page = %v, want essential", got)
+	}
+}
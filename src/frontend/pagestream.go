@@ -0,0 +1,101 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+// defaultComposeBudget is how long after a streamed page starts its
+// decorative sections are waited for. It leaves room for the ad client's
+// own timeout.
+const defaultComposeBudget = 300 * time.Millisecond
+
+// pageStream renders a page section by section, flushing after each one so
+// that the browser gets the top of the page while the later sections still
+// wait on slower backends. The status and headers go out with the first
+// section and cannot change afterwards, so everything that may fail the
+// page must be done before it. Each section is rendered in full before it
+// is sent; a failing first section still gets the error page.
+type pageStream struct {
+	fe    *frontendServer
+	w     http.ResponseWriter
+	r     *http.Request
+	ts    *templateSet
+	start time.Time
+	sent  bool
+	err   error // of the first section that failed; the later ones are skipped
+}
+
+func (fe *frontendServer) newPageStream(w http.ResponseWriter, r *http.Request, start time.Time) *pageStream {
+	s := &pageStream{fe: fe, w: w, r: r, start: start}
+	if s.ts, s.err = fe.renderer.templates(); s.err != nil {
+		templateFailed(r, "page", nil, s.err)
+		writeFallbackError(w, r, http.StatusInternalServerError)
+	}
+	return s
+}
+
+// section renders the named template and flushes it. Before the first
+// section, the time spent getting there is added to the Server-Timing
+// header.
+func (s *pageStream) section(name string, data interface{}) {
+	if s.err != nil {
+		return
+	}
+	if s.start != (time.Time{}) {
+		d := time.Since(s.start)
+		s.w.Header().Add("Server-Timing", fmt.Sprintf("essential;dur=%.1f", float64(d)/float64(time.Millisecond)))
+		s.start = time.Time{}
+	}
+	var buf bytes.Buffer
+	if s.err = s.ts.execute(&buf, name, data); s.err != nil {
+		templateFailed(s.r, name, data, s.err)
+		if !s.sent {
+			s.fe.renderTemplateError(s.w, s.r)
+		}
+		return
+	}
+	buf.WriteTo(s.w)
+	s.sent = true
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// awaitDecorative waits for the data of a decorative section until the
+// budget fires, and reports whether it came in time. A nil budget waits
+// as long as the request lasts.
+func awaitDecorative(ctx context.Context, log logrus.FieldLogger, section string, done <-chan struct{}, budget <-chan time.Time) bool {
+	select {
+	case <-done:
+		return true
+	case <-budget:
+	case <-ctx.Done():
+		return false
+	}
+	log.WithField("section", section).Warn("section missed the composition budget, rendering it empty")
+	span := trace.FromContext(ctx)
+	span.AddAttributes(trace.BoolAttribute("page.degraded", true))
+	span.Annotate([]trace.Attribute{trace.StringAttribute("section", section)}, "section missed the composition budget")
+	return false
+}
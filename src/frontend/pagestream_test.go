@@ -0,0 +1,136 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/adclient"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const getAdsMethod = "/hipstershop.AdService/GetAds"
+
+// withSlowAds lets ad calls last up to five seconds, so that the
+// composition budget rather than the ad client's timeout drops the ad.
+func withSlowAds(h *testHarness, d time.Duration) {
+	h.fe.ads = adclient.New(pb.NewAdServiceClient(h.conn), adclient.Config{Timeout: 5 * time.Second})
+	h.delay(getAdsMethod, d)
+}
+
+// timedGet fetches path, returning the body along with the time to the
+// first byte of the response and to its end.
+func timedGet(h *testHarness, path string) (body string, ttfb, total time.Duration) {
+	h.t.Helper()
+	start := time.Now()
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+path, nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { ttfb = time.Since(start) },
+	}))
+	resp, err := h.client.Do(req)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return string(b), ttfb, time.Since(start)
+}
+
+var (
+	htmlTag      = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9]*)[^>]*?(/?)>`)
+	htmlComment  = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlVoidTags = map[string]bool{"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true,
+		"img": true, "input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true}
+)
+
+// checkWellFormed fails when the elements of doc are not properly nested
+// and closed, or when the document does not end with </html>.
+func checkWellFormed(t *testing.T, doc string) {
+	t.Helper()
+	var open []string
+	for _, m := range htmlTag.FindAllStringSubmatch(htmlComment.ReplaceAllString(doc, ""), -1) {
+		name := strings.ToLower(m[2])
+		switch {
+		case htmlVoidTags[name] || m[3] == "/":
+		case m[1] == "":
+			open = append(open, name)
+		case len(open) == 0 || open[len(open)-1] != name:
+			t.Fatalf("</%s> closes %v", name, open)
+		default:
+			open = open[:len(open)-1]
+		}
+	}
+	if len(open) != 0 {
+		t.Errorf("unclosed elements %v", open)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(doc), "</html>") {
+		t.Error("document does not end with </html>")
+	}
+}
+
+func TestHomeStreamsBeforeSlowAd(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.get("/")
+	withSlowAds(h, 500*time.Millisecond)
+
+	body, ttfb, total := timedGet(h, "/")
+	if total < 500*time.Millisecond {
+		t.Errorf("page took %v, want it to wait for the ad without a budget", total)
+	}
+	if ttfb > total-300*time.Millisecond {
+		t.Errorf("first byte after %v of %v, want it well before the ad", ttfb, total)
+	}
+	if !strings.Contains(body, "Vintage camera lens for sale") {
+		t.Error("page without the ad")
+	}
+	checkWellFormed(t, body)
+}
+
+func TestHomeDropsAdPastBudget(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) { fe.composeBudget = 100 * time.Millisecond })
+	defer h.close()
+	h.get("/")
+	withSlowAds(h, 2*time.Second)
+
+	body, _, total := timedGet(h, "/")
+	if total > time.Second {
+		t.Errorf("page took %v, want the ad dropped after the budget", total)
+	}
+	if strings.Contains(body, "Advertisement:") {
+		t.Error("page with an ad that missed the budget")
+	}
+	if !strings.Contains(body, "/product/OLJCESPC7Z") {
+		t.Error("page without the product grid")
+	}
+	checkWellFormed(t, body)
+}
+
+func TestHomeServerTiming(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	if got := h.get("/").Header.Get("Server-Timing"); !regexp.MustCompile(`^essential;dur=\d+\.\d$`).MatchString(got) {
+		t.Errorf("Server-Timing = %q, want the time to the first section", got)
+	}
+}
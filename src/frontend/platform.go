@@ -0,0 +1,139 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// platform is the environment the frontend runs in, shown in a banner on
+// every page so that deployments to different clouds can be told apart.
+type platform struct {
+	ID    string
+	Name  string
+	Color string
+}
+
+// platforms are the values of ENV_PLATFORM.
+var platforms = map[string]platform{
+	"gcp":    {ID: "gcp", Name: "Google Cloud", Color: "#4285f4"},
+	"aws":    {ID: "aws", Name: "AWS", Color: "#ff9900"},
+	"azure":  {ID: "azure", Name: "Azure", Color: "#0078d4"},
+	"onprem": {ID: "onprem", Name: "On-premises", Color: "#6c757d"},
+	"local":  {ID: "local", Name: "Local", Color: "#28a745"},
+}
+
+// platformIDs returns the valid values of ENV_PLATFORM, sorted.
+func platformIDs() []string {
+	ids := make([]string, 0, len(platforms))
+	for id := range platforms {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Metadata endpoints probed to detect the platform; variables so that
+// tests can point them at local servers.
+var (
+	gceMetadataURL = "http://metadata.google.internal/computeMetadata/v1/"
+	ec2MetadataURL = "http://169.254.169.254/latest/meta-data/"
+)
+
+// platformProbeTimeout bounds the detection of the platform: off the
+// clouds the metadata endpoints usually do not answer at all.
+const platformProbeTimeout = 300 * time.Millisecond
+
+// platformBanner holds the platform shown on the pages, which may only be
+// known once detected in the background after startup.
+type platformBanner struct {
+	mu sync.RWMutex
+	p  *platform
+}
+
+func newPlatformBanner() *platformBanner { return &platformBanner{} }
+
+// get returns the platform, nil when unknown. A nil banner is never shown.
+func (b *platformBanner) get() *platform {
+	if b == nil {
+		return nil
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.p
+}
+
+func (b *platformBanner) set(p platform) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.p = &p
+}
+
+// detectPlatform probes the GCE and EC2 metadata endpoints concurrently and
+// shows the platform of the first that answers. It fails when neither does,
+// leaving the platform unknown.
+func (fe *frontendServer) detectPlatform(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, platformProbeTimeout)
+	defer cancel()
+	found := make(chan string, 2)
+	probe := func(id, url string, header http.Header, is func(*http.Response) bool) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			found <- ""
+			return
+		}
+		if header != nil {
+			req.Header = header
+		}
+		resp, err := fe.httpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			found <- ""
+			return
+		}
+		resp.Body.Close()
+		if !is(resp) {
+			id = ""
+		}
+		found <- id
+	}
+	go probe("gcp", gceMetadataURL, http.Header{"Metadata-Flavor": {"Google"}}, func(resp *http.Response) bool {
+		return resp.Header.Get("Metadata-Flavor") == "Google"
+	})
+	// With IMDSv2 enforced, unauthenticated reads are refused with a 401,
+	// which still tells EC2 apart.
+	go probe("aws", ec2MetadataURL, nil, func(resp *http.Response) bool {
+		return resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusUnauthorized
+	})
+	for i := 0; i < 2; i++ {
+		if id := <-found; id != "" {
+			fe.platform.set(platforms[id])
+			return nil
+		}
+	}
+	return errors.New("no metadata endpoint answered")
+}
+
+// parsePlatform returns the platform named by ENV_PLATFORM.
+func parsePlatform(v string) (platform, bool) {
+	p, ok := platforms[strings.ToLower(strings.TrimSpace(v))]
+	return p, ok
+}
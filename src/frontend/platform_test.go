@@ -0,0 +1,124 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func withPlatform(id string) func(*frontendServer) {
+	return func(fe *frontendServer) {
+		fe.platform = newPlatformBanner()
+		fe.platform.set(platforms[id])
+	}
+}
+
+// withMetadataEndpoints points the platform detection at the given servers
+// until the returned function is called.
+func withMetadataEndpoints(gce, ec2 string) func() {
+	gceURL, ec2URL := gceMetadataURL, ec2MetadataURL
+	gceMetadataURL, ec2MetadataURL = gce, ec2
+	return func() { gceMetadataURL, ec2MetadataURL = gceURL, ec2URL }
+}
+
+func TestPlatformBanner(t *testing.T) {
+	h := newTestHarness(t, withPlatform("aws"))
+	body := h.get("/").body
+	if !strings.Contains(body, `id="platform_banner"`) || !strings.Contains(body, "AWS") ||
+		!strings.Contains(body, "#ff9900") {
+		t.Error("no AWS banner on the home page")
+	}
+	if !strings.Contains(h.get("/cart").body, `id="platform_banner"`) {
+		t.Error("no banner on the cart page")
+	}
+
+	if strings.Contains(newTestHarness(t).get("/").body, `id="platform_banner"`) {
+		t.Error("banner shown with an unknown platform")
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	if p, ok := parsePlatform(" GCP "); !ok || p.ID != "gcp" {
+		t.Errorf("parsePlatform(GCP) = %v, %v", p, ok)
+	}
+	if _, ok := parsePlatform("heroku"); ok {
+		t.Error("heroku accepted")
+	}
+}
+
+func TestDetectPlatform(t *testing.T) {
+	gce := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Metadata-Flavor", "Google")
+	}))
+	defer gce.Close()
+	ec2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized) // IMDSv2 only
+	}))
+	defer ec2.Close()
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	for _, tc := range []struct {
+		name     string
+		gce, ec2 string
+		want     string
+	}{
+		{"gce", gce.URL, down.URL, "gcp"},
+		{"ec2", down.URL, ec2.URL, "aws"},
+		{"not a cloud", other.URL, other.URL, ""},
+		{"no metadata server", down.URL, down.URL, ""},
+	} {
+		restore := withMetadataEndpoints(tc.gce, tc.ec2)
+		fe := &frontendServer{httpClient: newOutboundClient(defaultOutboundTimeout), platform: newPlatformBanner()}
+		err := fe.detectPlatform(context.Background())
+		restore()
+		var got string
+		if p := fe.platform.get(); p != nil {
+			got = p.ID
+		}
+		if got != tc.want || (err == nil) != (tc.want != "") {
+			t.Errorf("%s: detected %q (%v), want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestPlatformDetectionStep(t *testing.T) {
+	hasStep := func(fe *frontendServer) bool {
+		for _, step := range fe.startupSteps(nil) {
+			if step.name == "platform_detection" {
+				return true
+			}
+		}
+		return false
+	}
+	fe := &frontendServer{platform: newPlatformBanner()}
+	if !hasStep(fe) {
+		t.Error("platform not detected when unknown")
+	}
+	fe.platform.set(platforms["onprem"])
+	if hasStep(fe) {
+		t.Error("platform detected when set")
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+const (
+	defaultPreflightTimeout = 30 * time.Second
+	maxPreflightTimeout     = 2 * time.Minute
+
+	// preflightConcurrency bounds the backend calls in flight per check.
+	preflightConcurrency = 8
+)
+
+// Preflight checks, by the name used in the report and the skip lists.
+const (
+	checkPrices      = "prices"
+	checkConversions = "conversions"
+	checkImages      = "images"
+	checkSearch      = "search"
+	checkShipping    = "shipping"
+)
+
+var preflightChecks = []string{checkPrices, checkConversions, checkImages, checkSearch, checkShipping}
+
+// Outcomes of a preflight check.
+const (
+	preflightPassed  = "passed"
+	preflightFailed  = "failed"
+	preflightSkipped = "skipped"
+)
+
+// preflightReport is the outcome of the preflight checks, in the order of
+// preflightChecks. Each problem names the product it is about.
+type preflightReport struct {
+	OK       bool              `json:"ok"`
+	Products int               `json:"products"`
+	Checks   []preflightResult `json:"checks"`
+}
+
+type preflightResult struct {
+	Name       string   `json:"name"`
+	Status     string   `json:"status"`
+	DurationMS int64    `json:"duration_ms"`
+	Problems   []string `json:"problems,omitempty"`
+}
+
+func (r preflightReport) failed() []string {
+	var out []string
+	for _, c := range r.Checks {
+		if c.Status == preflightFailed {
+			out = append(out, c.Name)
+		}
+	}
+	return out
+}
+
+// parsePreflightSkip parses a comma-separated list of checks to skip.
+func parsePreflightSkip(s string) (map[string]bool, error) {
+	skip := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		known := false
+		for _, c := range preflightChecks {
+			known = known || c == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown preflight check %q, want one of %s", name, strings.Join(preflightChecks, ", "))
+		}
+		skip[name] = true
+	}
+	return skip, nil
+}
+
+// runPreflight checks that the catalog can be sold in every whitelisted
+// currency, calling the backends rather than the caches. The checks run
+// concurrently until ctx is done; those still running then fail.
+func (fe *frontendServer) runPreflight(ctx context.Context, skip map[string]bool) preflightReport {
+	report := preflightReport{Checks: make([]preflightResult, len(preflightChecks))}
+	for i, name := range preflightChecks {
+		report.Checks[i] = preflightResult{Name: name, Status: preflightSkipped}
+	}
+
+	products, err := fe.listProducts(ctx)
+	if err == nil && len(products) == 0 {
+		err = fmt.Errorf("the catalog is empty")
+	}
+	report.Products = len(products)
+	if err != nil {
+		for i := range report.Checks {
+			if !skip[report.Checks[i].Name] {
+				report.Checks[i].Status = preflightFailed
+				report.Checks[i].Problems = []string{fmt.Sprintf("failed to list products: %v", err)}
+			}
+		}
+		return report
+	}
+
+	run := map[string]func(context.Context, []*pb.Product) []string{
+		checkPrices:      fe.checkPrices,
+		checkConversions: fe.checkConversions,
+		checkImages:      fe.checkImages,
+		checkSearch:      fe.checkSearch,
+		checkShipping:    fe.checkShipping,
+	}
+	done := make([]chan preflightResult, len(preflightChecks))
+	start := time.Now()
+	for i, name := range preflightChecks {
+		if skip[name] {
+			continue
+		}
+		done[i] = make(chan preflightResult, 1)
+		go func(res preflightResult, check func(context.Context, []*pb.Product) []string, c chan<- preflightResult) {
+			res.Problems = check(ctx, products)
+			res.DurationMS = int64(time.Since(start) / time.Millisecond)
+			c <- res
+		}(report.Checks[i], run[name], done[i])
+	}
+	for i := range preflightChecks {
+		if done[i] == nil {
+			continue
+		}
+		select {
+		case report.Checks[i] = <-done[i]:
+		case <-ctx.Done():
+			// Keep the results of the checks that finished in time.
+			select {
+			case report.Checks[i] = <-done[i]:
+			default:
+				report.Checks[i].Problems = []string{"did not finish in time: " + ctx.Err().Error()}
+				report.Checks[i].DurationMS = int64(time.Since(start) / time.Millisecond)
+			}
+		}
+		report.Checks[i].Status = preflightPassed
+		if len(report.Checks[i].Problems) > 0 {
+			report.Checks[i].Status = preflightFailed
+		}
+	}
+	report.OK = len(report.failed()) == 0
+	return report
+}
+
+// forEachConcurrently calls f for 0 <= i < n, preflightConcurrency calls
+// at a time, and returns the problems reported in the order of i.
+func forEachConcurrently(n int, f func(i int) string) []string {
+	results := make([]string, n)
+	sem := make(chan struct{}, preflightConcurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			results[i] = f(i)
+		}(i)
+	}
+	wg.Wait()
+	var problems []string
+	for _, p := range results {
+		if p != "" {
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+func (fe *frontendServer) checkPrices(_ context.Context, products []*pb.Product) []string {
+	var problems []string
+	for _, p := range products {
+		price := p.GetPriceUsd()
+		if price == nil {
+			problems = append(problems, p.GetId()+": no price")
+		} else if price.GetCurrencyCode() != "USD" || !money.IsValid(*price) || !money.IsPositive(*price) {
+			problems = append(problems, fmt.Sprintf("%s: price %s %d.%09d is not a positive USD amount",
+				p.GetId(), price.GetCurrencyCode(), price.GetUnits(), price.GetNanos()))
+		}
+	}
+	return problems
+}
+
+func (fe *frontendServer) checkConversions(ctx context.Context, products []*pb.Product) []string {
+	currencies := fe.currencies.configured()
+	client := pb.NewCurrencyServiceClient(fe.currencySvcConn)
+	return forEachConcurrently(len(products)*len(currencies), func(i int) string {
+		p, code := products[i/len(currencies)], currencies[i%len(currencies)]
+		// Each request gets its own copy of the price: marshaling caches
+		// sizes in the message.
+		price := p.GetPriceUsd()
+		from := &pb.Money{CurrencyCode: price.GetCurrencyCode(), Units: price.GetUnits(), Nanos: price.GetNanos()}
+		m, err := client.Convert(ctx, &pb.CurrencyConversionRequest{From: from, ToCode: code})
+		switch {
+		case err != nil:
+			return fmt.Sprintf("%s: conversion to %s failed: %v", p.GetId(), code, err)
+		case m.GetCurrencyCode() != code || !money.IsValid(*m):
+			return fmt.Sprintf("%s: conversion to %s returned %s %d.%09d", p.GetId(), code, m.GetCurrencyCode(), m.GetUnits(), m.GetNanos())
+		}
+		return ""
+	})
+}
+
+// checkImages looks for the images under /static/ in the static directory
+// and asks the servers of absolute image URLs for theirs.
+func (fe *frontendServer) checkImages(ctx context.Context, products []*pb.Product) []string {
+	return forEachConcurrently(len(products), func(i int) string {
+		p := products[i]
+		path := p.GetPicture()
+		switch {
+		case strings.HasPrefix(path, "/static/"):
+			if !staticFileExists(path) {
+				return fmt.Sprintf("%s: image %s not found", p.GetId(), path)
+			}
+		case strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://"):
+			req, err := http.NewRequest(http.MethodHead, path, nil)
+			if err != nil {
+				return fmt.Sprintf("%s: invalid image URL %s", p.GetId(), path)
+			}
+			resp, err := fe.httpClient.Do(req.WithContext(ctx))
+			if err != nil {
+				return fmt.Sprintf("%s: image %s: %v", p.GetId(), path, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 400 {
+				return fmt.Sprintf("%s: image %s: %s", p.GetId(), path, resp.Status)
+			}
+		default:
+			return fmt.Sprintf("%s: image path %q is neither under /static/ nor an http(s) URL", p.GetId(), path)
+		}
+		return ""
+	})
+}
+
+func (fe *frontendServer) checkSearch(ctx context.Context, products []*pb.Product) []string {
+	client := pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn)
+	return forEachConcurrently(len(products), func(i int) string {
+		p := products[i]
+		resp, err := client.SearchProducts(ctx, &pb.SearchProductsRequest{Query: p.GetName()})
+		if err != nil {
+			return fmt.Sprintf("%s: search for %q failed: %v", p.GetId(), p.GetName(), err)
+		}
+		for _, r := range resp.GetResults() {
+			if r.GetId() == p.GetId() {
+				return ""
+			}
+		}
+		return fmt.Sprintf("%s: search for %q does not return the product", p.GetId(), p.GetName())
+	})
+}
+
+// checkShipping quotes a cart holding one of the first product.
+func (fe *frontendServer) checkShipping(ctx context.Context, products []*pb.Product) []string {
+	p := products[0]
+	cost, err := fe.getShippingQuote(ctx, []*pb.CartItem{{ProductId: p.GetId(), Quantity: 1}}, nil)
+	switch {
+	case err != nil:
+		return []string{fmt.Sprintf("%s: shipping quote failed: %v", p.GetId(), err)}
+	case cost.GetCurrencyCode() != "USD" || !money.IsValid(*cost) || money.IsNegative(*cost):
+		return []string{fmt.Sprintf("%s: shipping quote %s %d.%09d is not a USD amount",
+			p.GetId(), cost.GetCurrencyCode(), cost.GetUnits(), cost.GetNanos())}
+	}
+	return nil
+}
+
+// logPreflight logs the outcome of a preflight run, in full when it failed.
+func logPreflight(log logrus.FieldLogger, report preflightReport) {
+	entry := log.WithFields(logrus.Fields{
+		"event":    "preflight",
+		"ok":       report.OK,
+		"products": report.Products,
+	})
+	if report.OK {
+		entry.Info("preflight checks passed")
+		return
+	}
+	entry.WithField("failed", report.failed()).Warn("preflight checks failed")
+}
+
+// preflight runs the checks for the --preflight flag, writes the report to
+// w and returns the exit status: 0 when every check passed, 1 otherwise.
+func (fe *frontendServer) preflight(ctx context.Context, log logrus.FieldLogger, w io.Writer, skip map[string]bool, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	report := fe.runPreflight(ctx, skip)
+	logPreflight(log, report)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil || !report.OK {
+		return 1
+	}
+	return 0
+}
+
+// preflightHandler runs the preflight checks for admins, skipping those
+// listed in the skip parameter and stopping after the timeout parameter.
+// It answers 503 when a check failed so that scripts can test the status.
+func (fe *frontendServer) preflightHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	if !fe.isAdmin(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	skip, err := parsePreflightSkip(r.FormValue("skip"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timeout := defaultPreflightTimeout
+	if v := r.FormValue("timeout"); v != "" {
+		timeout, err = time.ParseDuration(v)
+		if err != nil || timeout <= 0 || timeout > maxPreflightTimeout {
+			http.Error(w, fmt.Sprintf("timeout must be a positive duration up to %v", maxPreflightTimeout), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	report := fe.runPreflight(ctx, skip)
+	logPreflight(log, report)
+	w.Header().Set("Content-Type", "application/json")
+	if !report.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
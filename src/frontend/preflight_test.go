@@ -0,0 +1,177 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const searchProductsMethod = "/hipstershop.ProductCatalogService/SearchProducts"
+
+var durationPattern = regexp.MustCompile(`"duration_ms": \d+`)
+
+func (h *testHarness) preflight(query, token string) *response {
+	h.t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/admin/preflight"+query, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return h.do(req)
+}
+
+func runPreflightCommand(t *testing.T, h *testHarness, skip string, timeout time.Duration) (int, preflightReport) {
+	t.Helper()
+	s, err := parsePreflightSkip(skip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	var out bytes.Buffer
+	code := h.fe.preflight(context.Background(), log, &out, s, timeout)
+	var report preflightReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("report is not JSON: %v\n%s", err, out.String())
+	}
+	return code, report
+}
+
+func TestPreflightPasses(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	code, report := runPreflightCommand(t, h, "", defaultPreflightTimeout)
+	if code != 0 || !report.OK || report.Products != len(fakeProducts) {
+		t.Errorf("exit status %d, report %+v; want 0 and every check passed", code, report)
+	}
+	for _, c := range report.Checks {
+		if c.Status != preflightPassed {
+			t.Errorf("check %s %s: %v", c.Name, c.Status, c.Problems)
+		}
+	}
+	if calls, want := h.faults.calls(convertMethod), len(fakeProducts)*len(whitelistedCurrencies); calls != want {
+		t.Errorf("%d conversions, want %d: one per product and currency", calls, want)
+	}
+}
+
+// TestPreflightReport breaks the catalog in several ways and compares the
+// report with testdata/preflight.golden.json.
+func TestPreflightReport(t *testing.T) {
+	h := newTestHarness(t, withAdminToken)
+	defer h.close()
+	h.catalog.mu.Lock()
+	h.catalog.products = append(append([]*pb.Product(nil), fakeProducts...), &pb.Product{
+		Id: "9SIQT8TOJO", Name: "Unicycle", Picture: "/static/img/products/unicycle.jpg",
+		PriceUsd: &pb.Money{CurrencyCode: "EUR", Units: 789, Nanos: 500000000},
+	})
+	h.catalog.mu.Unlock()
+	h.rates.mu.Lock()
+	delete(h.rates.rates, "TRY")
+	h.rates.mu.Unlock()
+
+	if resp := h.preflight("", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("preflight without the admin token = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	for _, query := range []string{"?skip=typos", "?timeout=1h"} {
+		if resp := h.preflight(query, "s3cret"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("preflight%s = %d, want %d", query, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+
+	resp := h.preflight("?skip=search", "s3cret")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("failed preflight = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	got := durationPattern.ReplaceAllString(resp.body, `"duration_ms": 0`)
+	path := filepath.Join("testdata", "preflight.golden.json")
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file (run with -update to create it): %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("report does not match %s (run with -update to accept changes):\n%s", path, got)
+	}
+	if entries := h.logs.find("preflight"); len(entries) != 1 || entries[0].Level != logrus.WarnLevel {
+		t.Errorf("failed preflight not logged as a warning: %v", entries)
+	}
+}
+
+func TestPreflightTimeout(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.delay(searchProductsMethod, 5*time.Second)
+	start := time.Now()
+	code, report := runPreflightCommand(t, h, "", 500*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("preflight took %v, past its timeout", elapsed)
+	}
+	if code != 1 || report.OK {
+		t.Errorf("exit status %d, ok %v; want a failure", code, report.OK)
+	}
+	for _, c := range report.Checks {
+		if failed := c.Status == preflightFailed; failed != (c.Name == checkSearch) {
+			t.Errorf("check %s %s: %v", c.Name, c.Status, c.Problems)
+		}
+	}
+}
+
+func TestPreflightCatalogDown(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.fail(listProductsMethod, status.Error(codes.Unavailable, "catalog down"))
+	code, report := runPreflightCommand(t, h, "images,shipping", defaultPreflightTimeout)
+	if code != 1 {
+		t.Errorf("exit status %d, want 1", code)
+	}
+	for _, c := range report.Checks {
+		skipped := c.Name == checkImages || c.Name == checkShipping
+		if skipped && c.Status != preflightSkipped {
+			t.Errorf("check %s %s, want it skipped", c.Name, c.Status)
+		}
+		if !skipped && (c.Status != preflightFailed || len(c.Problems) != 1 || !strings.Contains(c.Problems[0], "catalog down")) {
+			t.Errorf("check %s %s with %v, want it failed by the catalog", c.Name, c.Status, c.Problems)
+		}
+	}
+}
+
+func TestParsePreflightSkip(t *testing.T) {
+	skip, err := parsePreflightSkip(" images, search,")
+	if err != nil || len(skip) != 2 || !skip[checkImages] || !skip[checkSearch] {
+		t.Errorf("parsePreflightSkip = %v, %v", skip, err)
+	}
+	if _, err := parsePreflightSkip("images,prices,currency"); err == nil {
+		t.Error("unknown check accepted")
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/cache"
+)
+
+const (
+	// maxRateLimitKeys bounds the buckets kept, so that a flood of
+	// requests from spoofed addresses cannot grow them without limit.
+	maxRateLimitKeys = 10000
+
+	rateLimitRuleGlobal = "global"
+)
+
+// Default limits of the routes that reach the cart service's Redis, when
+// rate limiting is enabled.
+var (
+	defaultCheckoutRateLimit = rateLimit{rate: 1, burst: 5}
+	defaultCartRateLimit     = rateLimit{rate: 5, burst: 10}
+)
+
+// rateLimit is a token bucket: rate tokens per second, up to burst.
+type rateLimit struct {
+	rate  float64
+	burst int
+}
+
+// refill is how long an empty bucket takes to fill up. A bucket untouched
+// for that long is the same as a new one.
+func (l rateLimit) refill() time.Duration {
+	return time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token if there is one, and otherwise returns how long until
+// there is.
+func (b *tokenBucket) take(l rateLimit, now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// rateLimitFromEnv is def with the rate and burst set in the environment,
+// or def itself if they do not make a valid limit.
+func rateLimitFromEnv(log logrus.FieldLogger, def rateLimit, rateKey, burstKey string) rateLimit {
+	l := def
+	mapFloatEnv(log, &l.rate, rateKey)
+	mapIntEnv(log, &l.burst, burstKey)
+	if l.rate <= 0 || l.burst < 1 {
+		log.Warnf("invalid %s %v and %s %d, using %v and %d", rateKey, l.rate, burstKey, l.burst, def.rate, def.burst)
+		return def
+	}
+	return l
+}
+
+// rateLimiter keeps a token bucket per client for the global limit, and
+// one per client and route for the routes with their own. The buckets
+// expire once full again; when there are too many, arbitrary ones are
+// dropped, which only lets their clients start over with a full bucket.
+type rateLimiter struct {
+	global    rateLimit
+	routes    map[string]rateLimit // by method and path, e.g. "POST /cart"
+	bySession bool                 // key on the session rather than the client IP
+
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets *cache.Cache
+}
+
+func newRateLimiter(global rateLimit, routes map[string]rateLimit, bySession bool) *rateLimiter {
+	return &rateLimiter{
+		global:    global,
+		routes:    routes,
+		bySession: bySession,
+		now:       time.Now,
+		buckets:   cache.New(maxRateLimitKeys),
+	}
+}
+
+// allow takes a token for a request of client to route. It returns the
+// rule applied, and how long until the request would be allowed if it is
+// not.
+func (l *rateLimiter) allow(route, client string) (rule string, ok bool, wait time.Duration) {
+	rule, lim := rateLimitRuleGlobal, l.global
+	if r, found := l.routes[route]; found {
+		rule, lim = route, r
+	}
+	key := rule + "|" + client
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, _ := l.buckets.Get(key)
+	bucket, found := b.(*tokenBucket)
+	if !found {
+		bucket = &tokenBucket{tokens: float64(lim.burst), last: now}
+	}
+	ok, wait = bucket.take(lim, now)
+	l.buckets.Set(key, bucket, lim.refill())
+	return rule, ok, wait
+}
+
+// client is the key of the requests of r's client, whose address is ip.
+// A session minted for r itself falls back to ip: a client dropping its
+// cookies would otherwise start a new session, and bucket, each request.
+func (l *rateLimiter) client(r *http.Request, ip string) string {
+	if minted, _ := r.Context().Value(ctxKeyNewSession{}).(bool); l.bySession && !minted {
+		return "session:" + sessionID(r)
+	}
+	return "ip:" + ip
+}
+
+func (l *rateLimiter) len() int { return l.buckets.Len() }
+
+// exemptFromRateLimit tells the routes never limited: the probes, and the
+// static files each page loads several of.
+func exemptFromRateLimit(path string) bool {
+	return strings.HasPrefix(path, "/_") || strings.HasPrefix(path, "/static/")
+}
+
+// rateLimit rejects the requests of a client over its limit with a 429
+// and a Retry-After header.
+func (fe *frontendServer) rateLimit(next http.Handler) http.Handler {
+	if fe.limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exemptFromRateLimit(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rule, ok, wait := fe.limiter.allow(r.Method+" "+r.URL.Path, fe.limiter.client(r, fe.clientIP(r)))
+		if ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+		log.WithFields(logrus.Fields{
+			"event":       "rate_limited",
+			"rule":        rule,
+			"retry_after": retryAfter,
+		}).Warn("request over the rate limit")
+		trace.FromContext(r.Context()).AddAttributes(
+			trace.BoolAttribute("ratelimit.rejected", true),
+			trace.StringAttribute("ratelimit.rule", rule))
+
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeProblem(w, http.StatusTooManyRequests, "too many requests, retry later")
+			return
+		}
+		fe.render(w, r, http.StatusTooManyRequests, "error", fe.injectCommonTemplateData(r, map[string]interface{}{
+			"status_code": http.StatusTooManyRequests,
+			"status":      http.StatusText(http.StatusTooManyRequests),
+			"retry_after": retryAfter,
+		}))
+	})
+}
@@ -0,0 +1,227 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+func withRateLimit(global rateLimit, routes map[string]rateLimit) func(*frontendServer) {
+	return func(fe *frontendServer) {
+		fe.limiter = newRateLimiter(global, routes, false)
+		// Clients are told apart by the X-Forwarded-For of the test client.
+		fe.trustedProxies, _ = parseTrustedProxies("127.0.0.1")
+	}
+}
+
+// getFrom gets path as the client at the given address.
+func (h *testHarness) getFrom(ip, path string) *response {
+	h.t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+path, nil)
+	req.Header.Set("X-Forwarded-For", ip)
+	return h.do(req)
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	rec := &spanRecorder{kind: trace.SpanKindServer}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+	h := newTestHarness(t, withRateLimit(rateLimit{rate: 0.5, burst: 3}, nil))
+	defer h.close()
+
+	for i := 0; i < 3; i++ {
+		if resp := h.getFrom("192.0.2.1", "/robots.txt"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d of the burst = %d, want %d", i+1, resp.StatusCode, http.StatusOK)
+		}
+	}
+	traceID := strings.Repeat("0", 30) + "e1"
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/robots.txt", nil)
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	req.Header.Set("X-B3-TraceId", traceID)
+	req.Header.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+	req.Header.Set("X-B3-Sampled", "1")
+	resp := h.do(req)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("request over the burst = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2 seconds for a token at 0.5/s", got)
+	}
+	if !strings.Contains(resp.body, "Too many requests") {
+		t.Error("429 page does not say what happened")
+	}
+	events := h.logs.find("rate_limited")
+	if len(events) != 1 || events[0].Data["rule"] != rateLimitRuleGlobal {
+		t.Errorf("rate_limited events = %v, want one for the global rule", events)
+	}
+	span := rec.wait(t, traceID)
+	if span.Attributes["ratelimit.rejected"] != true || span.Attributes["ratelimit.rule"] != rateLimitRuleGlobal {
+		t.Errorf("span attributes = %v, want the rejection tagged", span.Attributes)
+	}
+
+	// Other clients have their own bucket, and probes and static files are
+	// never limited.
+	if resp := h.getFrom("192.0.2.2", "/robots.txt"); resp.StatusCode != http.StatusOK {
+		t.Errorf("another client = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	for _, path := range []string{"/_healthz", "/static/img/products/typewriter.jpg"} {
+		if resp := h.getFrom("192.0.2.1", path); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s over the limit = %d, want %d", path, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	// The API answers with a problem.
+	apiReq, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/api/v1/products", nil)
+	apiReq.Header.Set("X-Forwarded-For", "192.0.2.1")
+	if resp := h.do(apiReq); resp.StatusCode != http.StatusTooManyRequests ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "application/problem+json") {
+		t.Errorf("API over the limit = %d %s, want a 429 problem", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// One token comes back every two seconds.
+	h.fe.clock.setOffset(2 * time.Second)
+	if resp := h.getFrom("192.0.2.1", "/robots.txt"); resp.StatusCode != http.StatusOK {
+		t.Errorf("request after a refill = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp := h.getFrom("192.0.2.1", "/robots.txt"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second request after one token = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+}
+
+func TestRateLimitRouteOverrides(t *testing.T) {
+	h := newTestHarness(t, withRateLimit(rateLimit{rate: 100, burst: 100}, map[string]rateLimit{
+		"POST /cart":          {rate: 1, burst: 2},
+		"POST /cart/checkout": {rate: 1, burst: 1},
+	}))
+	defer h.close()
+
+	add := url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}}
+	for i := 0; i < 2; i++ {
+		if resp := h.post("/cart", add); resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST /cart %d = %d, want %d", i+1, resp.StatusCode, http.StatusOK)
+		}
+	}
+	resp := h.post("/cart", add)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("third POST /cart = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if events := h.logs.find("rate_limited"); len(events) != 1 || events[0].Data["rule"] != "POST /cart" {
+		t.Errorf("rate_limited events = %v, want one for POST /cart", events)
+	}
+	// The other routes, the cart page included, keep the global limit.
+	if resp := h.get("/cart"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /cart = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	if resp := h.post("/cart/checkout", checkoutForm); resp.StatusCode != http.StatusOK {
+		t.Fatalf("checkout = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp := h.post("/cart/checkout", checkoutForm); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second checkout = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if n := h.faults.calls(placeOrderMethod); n != 1 {
+		t.Errorf("PlaceOrder called %d times, want once", n)
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(rateLimit{rate: 1, burst: 5}, nil, false)
+	l.now = func() time.Time { return now }
+	l.buckets.Now = l.now
+
+	// A flood of spoofed addresses fills the buckets up to the bound.
+	for i := 0; i < maxRateLimitKeys+500; i++ {
+		if _, ok, _ := l.allow("GET /", fmt.Sprintf("ip:10.%d.%d.%d", i>>16&255, i>>8&255, i&255)); !ok {
+			t.Fatalf("first request of client %d rejected", i)
+		}
+	}
+	if n := l.len(); n > maxRateLimitKeys {
+		t.Fatalf("%d buckets kept, want at most %d", n, maxRateLimitKeys)
+	}
+
+	// Once refilled, the buckets expire, and are dropped for new ones.
+	now = now.Add(5 * time.Second)
+	l.allow("GET /", "ip:192.0.2.1")
+	if n := l.len(); n != 1 {
+		t.Errorf("%d buckets kept after they all refilled, want 1", n)
+	}
+
+	// A client whose bucket expired starts over with a full one, as it
+	// would have had anyway.
+	for i := 0; i < 5; i++ {
+		l.allow("GET /", "ip:192.0.2.2")
+	}
+	if _, ok, wait := l.allow("GET /", "ip:192.0.2.2"); ok || wait != time.Second {
+		t.Errorf("request over the burst: allowed %v, wait %v; want rejected for 1s", ok, wait)
+	}
+	now = now.Add(10 * time.Second)
+	for i := 0; i < 5; i++ {
+		if _, ok, _ := l.allow("GET /", "ip:192.0.2.2"); !ok {
+			t.Fatalf("request %d after a refill rejected", i+1)
+		}
+	}
+}
+
+func TestRateLimitIgnoresUntrustedForwardedFor(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) {
+		fe.limiter = newRateLimiter(rateLimit{rate: 0.5, burst: 1}, nil, false)
+	})
+	defer h.close()
+
+	// Without trusted proxies, a client cannot pass as another by naming a
+	// different address in X-Forwarded-For.
+	if resp := h.getFrom("192.0.2.1", "/robots.txt"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first request = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp := h.getFrom("192.0.2.2", "/robots.txt"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("request under a spoofed address = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+}
+
+func TestRateLimitBySession(t *testing.T) {
+	h := newTestHarness(t, withRateLimit(rateLimit{rate: 0.5, burst: 2}, nil), func(fe *frontendServer) {
+		fe.limiter.bySession = true
+	})
+	defer h.close()
+
+	// The first request mints the session and takes from the bucket of the
+	// address; the next ones have the session's own.
+	for i := 0; i < 3; i++ {
+		if resp := h.getFrom("192.0.2.1", "/robots.txt"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d = %d, want %d", i+1, resp.StatusCode, http.StatusOK)
+		}
+	}
+	if resp := h.getFrom("192.0.2.1", "/robots.txt"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("request over the session's burst = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+
+	// A client dropping its cookies gets a new session each request, and is
+	// limited by its address instead.
+	h.client.Jar = nil
+	if resp := h.getFrom("192.0.2.1", "/robots.txt"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("cookieless request = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp := h.getFrom("192.0.2.1", "/robots.txt"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("cookieless request over the address's burst = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	defaultRateRefresh   = 5 * time.Minute
+	defaultRatePinWindow = 10 * time.Minute
+
+	// maxSnapshotConversions bounds the conversions remembered by a rate
+	// snapshot; conversions beyond it are still made, but not cached.
+	maxSnapshotConversions = 10000
+)
+
+// rateSnapshot remembers the currency conversions made during one rate
+// generation, so that every page rendered from it shows the same prices.
+type rateSnapshot struct {
+	generation uint64
+	created    time.Time
+	retired    time.Time // zero while the snapshot is current
+
+	mu          sync.Mutex
+	conversions map[string]pb.Money
+}
+
+// convert returns the conversion of m to currency made in this snapshot,
+// calling fetch the first time it is needed.
+func (s *rateSnapshot) convert(ctx context.Context, m *pb.Money, currency string,
+	fetch func(context.Context) (*pb.Money, error)) (*pb.Money, error) {
+	key := fmt.Sprintf("%s %d %d>%s", m.GetCurrencyCode(), m.GetUnits(), m.GetNanos(), currency)
+	s.mu.Lock()
+	v, ok := s.conversions[key]
+	s.mu.Unlock()
+	if ok {
+		return &v, nil
+	}
+
+	res, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if len(s.conversions) < maxSnapshotConversions {
+		s.conversions[key] = *res
+	}
+	s.mu.Unlock()
+	return res, nil
+}
+
+// rateCache hands out rate snapshots. A new generation starts every refresh
+// interval; superseded snapshots stay available for pinWindow so in-flight
+// checkouts can keep using the prices they displayed.
+type rateCache struct {
+	refresh   time.Duration
+	pinWindow time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	next      uint64
+	current   *rateSnapshot
+	snapshots map[uint64]*rateSnapshot
+}
+
+func newRateCache(refresh, pinWindow time.Duration) *rateCache {
+	return &rateCache{
+		refresh:   refresh,
+		pinWindow: pinWindow,
+		now:       time.Now,
+		snapshots: make(map[uint64]*rateSnapshot),
+	}
+}
+
+// snapshot returns the current rate snapshot.
+func (c *rateCache) snapshot() *rateSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if c.current == nil || now.Sub(c.current.created) >= c.refresh {
+		c.rotateLocked(now)
+	}
+	c.pruneLocked(now)
+	return c.current
+}
+
+// rotate starts a new rate generation.
+func (c *rateCache) rotate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rotateLocked(c.now())
+}
+
+func (c *rateCache) rotateLocked(now time.Time) {
+	if c.current != nil {
+		// A snapshot rotated lazily was superseded when its refresh
+		// interval ended, not when it was next asked for.
+		c.current.retired = now
+		if due := c.current.created.Add(c.refresh); due.Before(now) {
+			c.current.retired = due
+		}
+	}
+	c.next++
+	c.current = &rateSnapshot{generation: c.next, created: now, conversions: make(map[string]pb.Money)}
+	c.snapshots[c.next] = c.current
+}
+
+func (c *rateCache) pruneLocked(now time.Time) {
+	for gen, s := range c.snapshots {
+		if !s.retired.IsZero() && now.Sub(s.retired) > c.pinWindow {
+			delete(c.snapshots, gen)
+		}
+	}
+}
+
+// pinned returns the snapshot of the given generation, if it is still
+// available.
+func (c *rateCache) pinned(generation uint64) (*rateSnapshot, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pruneLocked(c.now())
+	s, ok := c.snapshots[generation]
+	return s, ok
+}
+
+type ctxKeyRateSnapshot struct{}
+
+// withRateSnapshot makes the currency conversions made with ctx use s
+// instead of the current snapshot.
+func withRateSnapshot(ctx context.Context, s *rateSnapshot) context.Context {
+	return context.WithValue(ctx, ctxKeyRateSnapshot{}, s)
+}
+
+// rateSnapshot returns the snapshot pinned in ctx, or the current one.
+func (fe *frontendServer) rateSnapshot(ctx context.Context) *rateSnapshot {
+	if s, ok := ctx.Value(ctxKeyRateSnapshot{}).(*rateSnapshot); ok {
+		return s
+	}
+	return fe.rates.snapshot()
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var checkoutStateValue = regexp.MustCompile(`name="checkout_state" value="([^"]*)"`)
+
+// startCheckout fills a cart in EUR and returns the checkout form of the
+// rendered cart page, including its checkout state.
+func startCheckout(t *testing.T, h *testHarness) (url.Values, string) {
+	t.Helper()
+	h.post("/setCurrency", url.Values{"currency_code": {"EUR"}})
+	cart := h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	m := checkoutStateValue.FindStringSubmatch(cart.body)
+	if m == nil {
+		t.Fatal("cart page has no checkout state")
+	}
+	form := url.Values{}
+	for k, v := range checkoutForm {
+		form[k] = v
+	}
+	form.Set("checkout_state", m[1])
+	return form, cart.body
+}
+
+func TestCheckoutRatePinning(t *testing.T) {
+	const placeOrder = "/hipstershop.CheckoutService/PlaceOrder"
+
+	t.Run("rate change within the pin window", func(t *testing.T) {
+		h := newTestHarness(t)
+		defer h.close()
+		form, cartPage := startCheckout(t, h)
+		if !strings.Contains(cartPage, "EUR 69.28") {
+			t.Fatal("cart page does not show the EUR total")
+		}
+
+		// The operator refreshes the rates between the cart page and the
+		// order.
+		h.rates.set("EUR", 0.95)
+		h.fe.rates.rotate()
+
+		resp := h.post("/cart/checkout", form)
+		if resp.StatusCode != http.StatusOK || h.faults.calls(placeOrder) != 1 {
+			t.Fatalf("POST /cart/checkout = %d with %d orders, want an order", resp.StatusCode, h.faults.calls(placeOrder))
+		}
+		events := h.logs.find("checkout_total_discrepancy")
+		if len(events) != 1 {
+			t.Fatalf("got %d discrepancy events, want 1", len(events))
+		}
+		// The comparison uses the prices the user saw, not fresh ones.
+		if got := events[0].Data["displayed"].(totalBreakdown).Total; got != "EUR 69.282000000" {
+			t.Errorf("displayed total = %s, want the pinned EUR 69.282000000", got)
+		}
+	})
+
+	t.Run("expired snapshot", func(t *testing.T) {
+		h := newTestHarness(t)
+		defer h.close()
+		now := time.Now()
+		h.fe.rates.now = func() time.Time { return now }
+		form, _ := startCheckout(t, h)
+
+		h.rates.set("EUR", 0.95)
+		now = now.Add(defaultRateRefresh + defaultRatePinWindow + time.Second)
+		h.fe.rates.snapshot()
+
+		resp := h.post("/cart/checkout", form)
+		if h.faults.calls(placeOrder) != 0 {
+			t.Fatal("order placed with an expired rate snapshot")
+		}
+		if want := []string{"/cart"}; len(resp.redirects) != 1 || resp.redirects[0] != want[0] {
+			t.Errorf("redirects = %v, want %v", resp.redirects, want)
+		}
+		if !strings.Contains(resp.body, `id="repriced_notice"`) || !strings.Contains(resp.body, "EUR 73.13") {
+			t.Error("cart page not shown again with the notice and fresh totals")
+		}
+	})
+
+	t.Run("tampered state", func(t *testing.T) {
+		h := newTestHarness(t)
+		defer h.close()
+		form, _ := startCheckout(t, h)
+		form.Set("checkout_state", "2"+form.Get("checkout_state")[1:])
+
+		h.post("/cart/checkout", form)
+		if h.faults.calls(placeOrder) != 0 {
+			t.Error("order placed with a tampered checkout state")
+		}
+	})
+}
+
+func TestRateCacheGenerations(t *testing.T) {
+	now := time.Now()
+	c := newRateCache(time.Minute, 2*time.Minute)
+	c.now = func() time.Time { return now }
+
+	first := c.snapshot()
+	if c.snapshot() != first {
+		t.Fatal("snapshot changed before the refresh interval")
+	}
+	now = now.Add(time.Minute)
+	second := c.snapshot()
+	if second == first || second.generation != first.generation+1 {
+		t.Fatalf("got generation %d after the refresh interval, want %d", second.generation, first.generation+1)
+	}
+	if s, ok := c.pinned(first.generation); !ok || s != first {
+		t.Error("superseded snapshot not available within the pin window")
+	}
+	now = now.Add(2*time.Minute + time.Second)
+	if _, ok := c.pinned(first.generation); ok {
+		t.Error("superseded snapshot still available after the pin window")
+	}
+}
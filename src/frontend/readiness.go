@@ -0,0 +1,81 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+const defaultReadinessCacheTTL = 2 * time.Second
+
+// criticalBackends are the backends without which the pages can only show
+// errors. The others (ads, recommendations) are reported by the readiness
+// probe but do not fail it.
+var criticalBackends = map[string]bool{
+	"productcatalog": true,
+	"cart":           true,
+	"currency":       true,
+	"checkout":       true,
+	"shipping":       true, // quotes of the cart and checkout
+}
+
+// backendReadiness is the state of a backend as seen by the readiness
+// probe.
+type backendReadiness struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Critical bool   `json:"critical"`
+	OK       bool   `json:"ok"`
+}
+
+// backendCheck checks the connections to the backends for the readiness
+// probe, reusing its result for ttl so that probes stay cheap.
+type backendCheck struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu       sync.Mutex
+	at       time.Time
+	backends []backendReadiness
+}
+
+func newBackendCheck(ttl time.Duration) *backendCheck {
+	return &backendCheck{ttl: ttl, now: time.Now}
+}
+
+// check returns the state of the backends and the critical ones failing.
+// A connection is fine while ready, or idle for lack of calls.
+func (c *backendCheck) check(backends func() []backendInfo) ([]backendReadiness, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.backends == nil || c.now().Sub(c.at) >= c.ttl {
+		c.backends = c.backends[:0]
+		for _, b := range backends() {
+			ok := b.State == connectivity.Ready.String() || b.State == connectivity.Idle.String()
+			c.backends = append(c.backends, backendReadiness{Name: b.Name, State: b.State, Critical: criticalBackends[b.Name], OK: ok})
+		}
+		c.at = c.now()
+	}
+	var failing []string
+	for _, b := range c.backends {
+		if b.Critical && !b.OK {
+			failing = append(failing, b.Name)
+		}
+	}
+	return append([]backendReadiness(nil), c.backends...), failing
+}
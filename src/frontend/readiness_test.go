@@ -0,0 +1,89 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackendCheck(t *testing.T) {
+	states := map[string]string{
+		"productcatalog": "READY", "currency": "READY", "cart": "IDLE", "recommendation": "READY",
+		"shipping": "READY", "checkout": "READY", "ad": "READY",
+	}
+	var calls int
+	backends := func() []backendInfo {
+		calls++
+		var out []backendInfo
+		for _, name := range []string{"productcatalog", "currency", "cart", "recommendation", "shipping", "checkout", "ad"} {
+			out = append(out, backendInfo{Name: name, State: states[name]})
+		}
+		return out
+	}
+	now := time.Now()
+	c := newBackendCheck(2 * time.Second)
+	c.now = func() time.Time { return now }
+
+	if _, failing := c.check(backends); len(failing) != 0 {
+		t.Errorf("failing = %v with every backend up", failing)
+	}
+	states["productcatalog"], states["ad"] = "TRANSIENT_FAILURE", "TRANSIENT_FAILURE"
+	if _, failing := c.check(backends); len(failing) != 0 || calls != 1 {
+		t.Errorf("failing = %v after %d checks within the TTL, want the cached result", failing, calls)
+	}
+
+	now = now.Add(2 * time.Second)
+	got, failing := c.check(backends)
+	if want := []string{"productcatalog"}; !reflect.DeepEqual(failing, want) {
+		t.Errorf("failing = %v, want %v: the ad service is not critical", failing, want)
+	}
+	for _, b := range got {
+		if b.Name == "ad" && (b.OK || b.Critical) {
+			t.Errorf("ad service reported as %+v", b)
+		}
+	}
+}
+
+func TestReadinessWithBackendDown(t *testing.T) {
+	h := newTestHarness(t, withUnreachable(t, catalogConn))
+	defer h.close()
+	defer h.fe.productCatalogSvcConn.Close()
+	h.get("/") // connects the other backends
+	h.fe.backendCheck = newBackendCheck(0)
+
+	code, body := readiness(t, h.fe)
+	var report readinessReport
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusServiceUnavailable || report.Ready || !reflect.DeepEqual(report.Failing, []string{"productcatalog"}) {
+		t.Errorf("readiness = %d %+v, want 503 failing on the catalog", code, report)
+	}
+	if len(report.Backends) != 7 {
+		t.Errorf("%d backends reported, want 7", len(report.Backends))
+	}
+
+	h = newTestHarness(t)
+	defer h.close()
+	h.get("/")
+	h.fe.backendCheck = newBackendCheck(0)
+	if code, body := readiness(t, h.fe); code != http.StatusOK {
+		t.Errorf("readiness with every backend up = %d %s", code, body)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultCartTTL matches the lifetime of the session cookie: once a
+	// session is idle that long, its cookie is gone and its cart with it.
+	defaultCartTTL          = cookieMaxAge * time.Second
+	defaultCartReapInterval = 10 * time.Minute
+	cartReapBatch           = 100 // sessions reaped before checking on the cart service
+	cartReapConcurrency     = 4   // calls to the cart service at once
+)
+
+// reaperStats are the counters of the cart reaper, as served on
+// /debug/reaper.
+type reaperStats struct {
+	TTL     string    `json:"ttl"`
+	LastRun time.Time `json:"last_run,omitempty"`
+	// Of the last sweep.
+	Scanned int `json:"sessions_scanned"`
+	Idle    int `json:"sessions_idle"`
+	Emptied int `json:"carts_emptied"`
+	Errors  int `json:"errors"`
+	// Since the start.
+	Sweeps       int `json:"sweeps"`
+	TotalEmptied int `json:"total_carts_emptied"`
+	TotalErrors  int `json:"total_errors"`
+}
+
+// cartReaper empties the carts of the sessions idle beyond the TTL, which
+// the cart service would otherwise keep forever, and forgets the sessions.
+// Sessions are tracked per replica: without session affinity, a replica
+// may reap the cart of a session only active on the others for the TTL.
+type cartReaper struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	stats reaperStats
+}
+
+func newCartReaper(ttl time.Duration) *cartReaper {
+	return &cartReaper{ttl: ttl, stats: reaperStats{TTL: ttl.String()}}
+}
+
+func (c *cartReaper) snapshot() reaperStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// reapCarts sweeps the idle sessions every interval until ctx is done.
+func (fe *frontendServer) reapCarts(ctx context.Context, log logrus.FieldLogger, interval time.Duration) {
+	for {
+		t := fe.clock.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C():
+		}
+		fe.sweepCarts(ctx, log)
+	}
+}
+
+// sweepCarts empties the carts of the sessions idle beyond the TTL, in
+// batches of cartReapBatch. A batch failing altogether means the cart
+// service is down: the sweep stops there, and the sessions left are tried
+// again on the next one. Sessions whose cart could not be emptied are kept
+// for the next sweep too.
+func (fe *frontendServer) sweepCarts(ctx context.Context, log logrus.FieldLogger) {
+	start := fe.clock.Now()
+	cutoff := start.Add(-fe.reaper.ttl)
+	idle, scanned := fe.sessions.idle(cutoff)
+	var emptied, errs int
+	for i := 0; i < len(idle) && ctx.Err() == nil; i += cartReapBatch {
+		end := i + cartReapBatch
+		if end > len(idle) {
+			end = len(idle)
+		}
+		n, failed := fe.reapBatch(ctx, log, idle[i:end], cutoff)
+		emptied, errs = emptied+n, errs+failed
+		if failed == end-i {
+			log.WithFields(logrus.Fields{
+				"event":   "cart_reap_aborted",
+				"pending": len(idle) - end,
+			}).Warn("the cart service failed a whole batch, retrying on the next sweep")
+			break
+		}
+	}
+
+	fe.reaper.mu.Lock()
+	s := &fe.reaper.stats
+	s.LastRun, s.Scanned, s.Idle, s.Emptied, s.Errors = start, scanned, len(idle), emptied, errs
+	s.Sweeps++
+	s.TotalEmptied += emptied
+	s.TotalErrors += errs
+	fe.reaper.mu.Unlock()
+	if len(idle) > 0 {
+		log.WithFields(logrus.Fields{
+			"event":   "cart_sweep",
+			"scanned": scanned,
+			"idle":    len(idle),
+			"emptied": emptied,
+			"errors":  errs,
+		}).Info("swept the carts of idle sessions")
+	}
+}
+
+// reapBatch empties the carts of a batch of idle sessions, a few at a time,
+// and returns the number emptied and failed.
+func (fe *frontendServer) reapBatch(ctx context.Context, log logrus.FieldLogger, ids []string, cutoff time.Time) (emptied, failed int) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, cartReapConcurrency)
+	for _, id := range ids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return emptied, failed
+		}
+		wg.Add(1)
+		go func(id string) {
+			defer func() { <-sem; wg.Done() }()
+			// The session is forgotten before its cart is emptied, so that
+			// one active since is left alone.
+			last, ok := fe.sessions.forget(id, cutoff)
+			if !ok {
+				return
+			}
+			items, err := fe.reapCart(ctx, id)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				fe.sessions.restore(id, last)
+				failed++
+				log.WithFields(logrus.Fields{
+					"session": hashSessionID(id),
+					"error":   err,
+				}).Debug("failed to reap a cart")
+				return
+			}
+			if items == 0 {
+				return
+			}
+			emptied++
+			log.WithFields(logrus.Fields{
+				"event":   "cart_reaped",
+				"session": hashSessionID(id),
+				"items":   items,
+			}).Info("emptied the cart of an idle session")
+		}(id)
+	}
+	wg.Wait()
+	return emptied, failed
+}
+
+// reapCart empties the cart of a session, if it has items, and returns the
+// number of items it had.
+func (fe *frontendServer) reapCart(ctx context.Context, id string) (int, error) {
+	items, err := fe.getCart(ctx, id)
+	if err != nil || len(items) == 0 {
+		return 0, err
+	}
+	n := 0
+	for _, it := range items {
+		n += int(it.GetQuantity())
+	}
+	return n, fe.emptyCart(ctx, id)
+}
+
+// debugReaperHandler serves the counters of the cart reaper as JSON, for
+// demo presenters and when debugging is enabled only.
+func (fe *frontendServer) debugReaperHandler(w http.ResponseWriter, r *http.Request) {
+	fe.serveDebugJSON(w, r, fe.reaper.snapshot())
+}
@@ -0,0 +1,240 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func withCartReaper(ttl time.Duration) func(*frontendServer) {
+	return func(fe *frontendServer) {
+		fe.sessions = &sessionManager{maxAge: cookieMaxAge * time.Second, seen: newSessionsSeen(maxTrackedSessions)}
+		fe.reaper = newCartReaper(ttl)
+	}
+}
+
+// newSession makes the client of h start a new session, and returns its ID.
+func (h *testHarness) newSession() string {
+	h.client.Jar, _ = cookiejar.New(nil)
+	return h.session()
+}
+
+// sweepCarts runs one sweep of the cart reaper of h.
+func (h *testHarness) sweepCarts() reaperStats {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.AddHook(h.logs)
+	h.fe.sweepCarts(context.Background(), log)
+	return h.fe.reaper.snapshot()
+}
+
+func (h *testHarness) cartItems(id string) int {
+	h.t.Helper()
+	items, err := h.fe.getCart(context.Background(), id)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return len(items)
+}
+
+func TestCartReaperTTL(t *testing.T) {
+	clock := newFakeClock()
+	h := newTestHarness(t, withFakeClock(clock), withCartReaper(time.Hour))
+	defer h.close()
+
+	a := h.newSession()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"2"}})
+	clock.Advance(30 * time.Minute)
+	b := h.newSession()
+	h.post("/cart", url.Values{"product_id": {"66VCHSJNUP"}, "quantity": {"1"}})
+	empty := h.newSession()
+	h.get("/")
+
+	// a is idle for exactly the TTL.
+	clock.Advance(30 * time.Minute)
+	if s := h.sweepCarts(); s.Scanned != 3 || s.Idle != 0 || h.cartItems(a) != 1 {
+		t.Errorf("sweep at the TTL = %+v, want the cart kept", s)
+	}
+
+	clock.Advance(time.Second)
+	if s := h.sweepCarts(); s.Scanned != 3 || s.Idle != 1 || s.Emptied != 1 || s.Errors != 0 {
+		t.Errorf("sweep past the TTL = %+v, want one cart emptied", s)
+	}
+	if h.cartItems(a) != 0 || h.cartItems(b) != 1 {
+		t.Error("reaped the wrong cart")
+	}
+	entries := h.logs.find("cart_reaped")
+	if len(entries) != 1 || entries[0].Data["items"] != 2 || entries[0].Data["session"] != hashSessionID(a) {
+		t.Errorf("logged %d reaped carts, want the one of 2 items", len(entries))
+	}
+	if n := h.fe.sessions.tracked(); n != 2 {
+		t.Errorf("%d sessions tracked after the sweep, want 2", n)
+	}
+
+	// Activity puts off reaping.
+	h.newSession()
+	h.setSessionCookie(b)
+	clock.Advance(45 * time.Minute)
+	h.get("/cart")
+	clock.Advance(30 * time.Minute)
+	if s := h.sweepCarts(); s.Idle != 1 || s.Emptied != 0 || h.cartItems(b) != 1 {
+		t.Errorf("sweep after activity = %+v, want only the empty cart idle", s)
+	}
+	if n := h.faults.calls(emptyCartMethod); n != 1 {
+		t.Errorf("EmptyCart called %d times, want once, not for the empty cart", n)
+	}
+	if ids, _ := h.fe.sessions.idle(clock.Now()); len(ids) != 1 || ids[0] != b {
+		t.Errorf("sessions tracked = %v, want %s only, not %s", ids, b, empty)
+	}
+	if s := h.fe.reaper.snapshot(); s.Sweeps != 3 || s.TotalEmptied != 1 || !s.LastRun.Equal(clock.Now()) {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+func TestCartReaperActivityDuringSweep(t *testing.T) {
+	clock := newFakeClock()
+	h := newTestHarness(t, withFakeClock(clock), withCartReaper(time.Hour))
+	defer h.close()
+
+	a := h.newSession()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	clock.Advance(2 * time.Hour)
+
+	// Probes and static files are not activity.
+	h.get("/_healthz")
+	h.get("/static/styles/styles.css")
+	cutoff := clock.Now().Add(-time.Hour)
+	ids, _ := h.fe.sessions.idle(cutoff)
+	if len(ids) != 1 || ids[0] != a {
+		t.Fatalf("idle sessions = %v, want %s", ids, a)
+	}
+
+	// A session active between the scan and the reaping keeps its cart.
+	h.get("/cart")
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	if emptied, failed := h.fe.reapBatch(context.Background(), log, ids, cutoff); emptied != 0 || failed != 0 {
+		t.Errorf("reaped %d carts (%d failed), want the active one left alone", emptied, failed)
+	}
+	if h.cartItems(a) != 1 || h.faults.calls(emptyCartMethod) != 0 {
+		t.Error("emptied the cart of a session active since the scan")
+	}
+	if n := h.fe.sessions.tracked(); n != 1 {
+		t.Errorf("%d sessions tracked, want the active one", n)
+	}
+}
+
+func TestSessionsSeenBounded(t *testing.T) {
+	m := &sessionManager{seen: newSessionsSeen(3)}
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		m.touch(fmt.Sprintf("session-%d", i), now)
+	}
+	if n := m.tracked(); n != 3 {
+		t.Errorf("%d sessions tracked, want at most 3", n)
+	}
+	// Sessions already tracked are updated in place.
+	ids, _ := m.idle(now.Add(time.Second))
+	for _, id := range ids {
+		m.touch(id, now.Add(time.Minute))
+	}
+	if after, _ := m.idle(now.Add(time.Second)); len(after) != 0 || m.tracked() != 3 {
+		t.Errorf("idle sessions after activity = %v, tracked %d; want none of 3", after, m.tracked())
+	}
+}
+
+func TestCartReaperCartServiceDown(t *testing.T) {
+	clock := newFakeClock()
+	h := newTestHarness(t, withFakeClock(clock), withCartReaper(time.Hour))
+	defer h.close()
+
+	a := h.newSession()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	// More idle sessions than fit in a batch.
+	for i := 0; i < cartReapBatch+10; i++ {
+		h.fe.sessions.touch(fmt.Sprintf("idle-%03d", i), clock.Now())
+	}
+	clock.Advance(2 * time.Hour)
+
+	h.fail(getCartMethod, status.Error(codes.Unavailable, "cart service down"))
+	h.delay(getCartMethod, 5*time.Millisecond)
+	before := h.faults.calls(getCartMethod)
+	s := h.sweepCarts()
+	if s.Errors != cartReapBatch || s.Emptied != 0 {
+		t.Errorf("sweep with the cart service down = %+v, want the first batch failed", s)
+	}
+	if n := h.faults.calls(getCartMethod) - before; n != cartReapBatch {
+		t.Errorf("GetCart called %d times, want the sweep to stop after a batch", n)
+	}
+	if n := h.faults.concurrency(getCartMethod); n > cartReapConcurrency {
+		t.Errorf("%d calls to the cart service at once, want at most %d", n, cartReapConcurrency)
+	}
+	if entries := h.logs.find("cart_reap_aborted"); len(entries) != 1 || entries[0].Data["pending"] != 11 {
+		t.Errorf("logged %d aborted sweeps, want one with 11 sessions pending", len(entries))
+	}
+	if n := h.fe.sessions.tracked(); n != cartReapBatch+11 {
+		t.Errorf("%d sessions tracked, want all kept for the next sweep", n)
+	}
+
+	h.fail(getCartMethod, nil)
+	s = h.sweepCarts()
+	if s.Errors != 0 || s.Emptied != 1 || h.cartItems(a) != 0 {
+		t.Errorf("sweep once the cart service is back = %+v, want the cart emptied", s)
+	}
+	if n := h.fe.sessions.tracked(); n != 0 {
+		t.Errorf("%d sessions tracked, want all reaped", n)
+	}
+	if s.TotalErrors != cartReapBatch || s.Sweeps != 2 {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+func TestCartReaperEndpoint(t *testing.T) {
+	for _, ttl := range []time.Duration{time.Hour, 0} {
+		reaper := func(fe *frontendServer) {
+			// As with CART_TTL=0: sessions are managed, but not tracked.
+			fe.sessions = &sessionManager{maxAge: cookieMaxAge * time.Second}
+		}
+		if ttl > 0 {
+			reaper = withCartReaper(ttl)
+		}
+		h := newTestHarness(t, reaper, func(fe *frontendServer) { fe.demoMode = true })
+		h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+
+		resp := h.get("/debug/reaper")
+		switch {
+		case ttl == 0 && resp.StatusCode != http.StatusNotFound:
+			t.Errorf("disabled: GET /debug/reaper = %d, want 404", resp.StatusCode)
+		case ttl > 0 && (resp.StatusCode != http.StatusOK || !strings.Contains(resp.body, `"ttl":"1h0m0s"`)):
+			t.Errorf("GET /debug/reaper = %d %s", resp.StatusCode, resp.body)
+		}
+		if n := h.fe.sessions.tracked(); (n > 0) != (ttl > 0) {
+			t.Errorf("ttl=%v: %d sessions tracked", ttl, n)
+		}
+		h.close()
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// templateDir holds the shared templates: the layout, the partials and the
+// streamed pages. Its pages/ subdirectory holds the pages filling the
+// layout, one per file, named after the file.
+const templateDir = "templates"
+
+// templateSet is one parse of the template directory.
+type templateSet struct {
+	shared       *template.Template
+	pages        map[string]*template.Template // each over its own clone of shared
+	nonCacheable map[string]bool               // see findNonCacheable
+	uncached     bool                          // renders every partial, see cacheFragment
+}
+
+// parseTemplateSet parses the templates in dir. A page defines the
+// "content" block of the layout, and may use the shared templates.
+func parseTemplateSet(dir string) (*templateSet, error) {
+	ts := &templateSet{pages: make(map[string]*template.Template)}
+	shared, err := template.New("").
+		Funcs(template.FuncMap{
+			"formatMoney":   func(l *locale, m pb.Money) string { return l.formatMoney(m) },
+			"formatTime":    func(l *locale, t time.Time) string { return l.formatTime(t) },
+			"assetURL":      assetURL,
+			"cacheFragment": ts.cacheFragment,
+			"noCache":       func() string { return "" },
+		}).ParseGlob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "pages", "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), ".html")
+		if shared.Lookup(name) != nil {
+			return nil, errors.Errorf("page %s is also a shared template", name)
+		}
+		t, err := shared.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if t, err = t.ParseFiles(f); err != nil {
+			return nil, err
+		}
+		ts.pages[name] = t
+	}
+	ts.shared = shared
+	ts.nonCacheable = findNonCacheable(shared)
+	return ts, nil
+}
+
+// execute renders the named page, or else the named shared template, to w.
+func (ts *templateSet) execute(w io.Writer, name string, data interface{}) error {
+	if t, ok := ts.pages[name]; ok {
+		return t.ExecuteTemplate(w, "layout", data)
+	}
+	return ts.shared.ExecuteTemplate(w, name, data)
+}
+
+// renderer holds the templates of the server. They are parsed once at
+// startup, or for every page when reloading, so that changes to the
+// template files show without a restart.
+type renderer struct {
+	dir    string
+	reload bool
+	set    *templateSet
+}
+
+// newRenderer parses the templates in dir. They are parsed even when
+// reloading, for broken templates to fail the startup.
+func newRenderer(dir string, reload bool) (*renderer, error) {
+	ts, err := parseTemplateSet(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &renderer{dir: dir, reload: reload, set: ts}, nil
+}
+
+// templates returns the templates to render a page with.
+func (rd *renderer) templates() (*templateSet, error) {
+	if !rd.reload {
+		return rd.set, nil
+	}
+	ts, err := parseTemplateSet(rd.dir)
+	if err != nil {
+		return nil, err
+	}
+	ts.uncached = true
+	return ts, nil
+}
+
+// render sends the named page with status. The page is rendered in full
+// before anything is sent: if it fails, the failure is logged and an error
+// page is sent instead, without the template internals.
+func (fe *frontendServer) render(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) {
+	var buf bytes.Buffer
+	ts, err := fe.renderer.templates()
+	if err == nil {
+		err = ts.execute(&buf, name, data)
+	}
+	if err != nil {
+		templateFailed(r, name, data, err)
+		if ts == nil || name == "error" {
+			writeFallbackError(w, r, status)
+			return
+		}
+		fe.renderTemplateError(w, r)
+		return
+	}
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// renderTemplateError sends the error page for a page that failed to
+// render. The error itself is left out, it tells about the templates only.
+func (fe *frontendServer) renderTemplateError(w http.ResponseWriter, r *http.Request) {
+	fe.render(w, r, http.StatusInternalServerError, "error", fe.injectCommonTemplateData(r, map[string]interface{}{
+		"status_code": http.StatusInternalServerError,
+		"status":      http.StatusText(http.StatusInternalServerError),
+	}))
+}
+
+// templateFailed logs a failed rendering, with the keys of its data for
+// finding what the template missed, and tags the request span with it.
+func templateFailed(r *http.Request, name string, data interface{}, err error) {
+	log, ok := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	if !ok {
+		log = logrus.StandardLogger()
+	}
+	log.WithFields(logrus.Fields{
+		"event":     "template_failed",
+		"template":  name,
+		"data_keys": dataKeys(data),
+	}).Error(err)
+	span := trace.FromContext(r.Context())
+	span.AddAttributes(trace.StringAttribute("template.failed", name))
+	span.SetStatus(trace.Status{Code: trace.StatusCodeInternal, Message: "template failed"})
+}
+
+// dataKeys describes the data of a template: the sorted keys of a map, or
+// else its type.
+func dataKeys(data interface{}) string {
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return fmt.Sprintf("%T", data)
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// fallbackErrorPage is sent when the error page itself cannot be rendered.
+const fallbackErrorPage = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"><title>Hipster Shop</title></head>
+<body>
+<h1>%d %s</h1>
+<p>Something has failed. Request ID: <code>%s</code></p>
+</body>
+</html>
+`
+
+func writeFallbackError(w http.ResponseWriter, r *http.Request, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, fallbackErrorPage, status, http.StatusText(status), html.EscapeString(requestIDFrom(r.Context())))
+}
@@ -0,0 +1,167 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// copyTemplates copies the templates to a temporary directory, with the
+// given files replaced, for the caller to remove.
+func copyTemplates(t *testing.T, replace map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "pages"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, pattern := range []string{"*.html", "pages/*.html"} {
+		files, err := filepath.Glob(filepath.Join(templateDir, pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			b, err := ioutil.ReadFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name, _ := filepath.Rel(templateDir, f)
+			writeTemplate(t, dir, name, string(b))
+		}
+	}
+	for name, text := range replace {
+		writeTemplate(t, dir, name, text)
+	}
+	return dir
+}
+
+func writeTemplate(t *testing.T, dir, name, text string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func withTemplates(t *testing.T, dir string, reload bool) func(*frontendServer) {
+	rd, err := newRenderer(dir, reload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(fe *frontendServer) { fe.renderer = rd }
+}
+
+// failingPage fails halfway, indexing past the end of its orders.
+const failingPage = `{{ define "content" }}<p id="before_failure">rendered</p>{{ index $.orders 99 }}{{ end }}`
+
+func TestRenderFailureSendsNothingOfThePage(t *testing.T) {
+	dir := copyTemplates(t, map[string]string{"pages/orders.html": failingPage})
+	defer os.RemoveAll(dir)
+	h := newTestHarness(t, withTemplates(t, dir, false))
+
+	resp := h.get("/orders")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", resp.StatusCode)
+	}
+	if strings.Contains(resp.body, "before_failure") {
+		t.Error("the failed page was partly sent")
+	}
+	if !strings.Contains(resp.body, "Uh, oh!") {
+		t.Error("no error page sent")
+	}
+	for _, internal := range []string{"out of range", "orders.html", "executing"} {
+		if strings.Contains(resp.body, internal) {
+			t.Errorf("error page shows %q of the template error", internal)
+		}
+	}
+
+	entries := h.logs.find("template_failed")
+	if len(entries) != 1 {
+		t.Fatalf("%d template_failed logs, want 1", len(entries))
+	}
+	if got := entries[0].Data["template"]; got != "orders" {
+		t.Errorf("logged template = %v, want orders", got)
+	}
+	if keys, _ := entries[0].Data["data_keys"].(string); !strings.Contains(keys, "orders") {
+		t.Errorf("logged data keys = %q, want the orders among them", keys)
+	}
+}
+
+func TestRenderFallsBackWhenErrorPageFails(t *testing.T) {
+	dir := copyTemplates(t, map[string]string{
+		"pages/orders.html": failingPage,
+		"pages/error.html":  `{{ define "content" }}{{ index $.status 99 }}{{ end }}`,
+	})
+	defer os.RemoveAll(dir)
+	h := newTestHarness(t, withTemplates(t, dir, false))
+
+	resp := h.get("/orders")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", resp.StatusCode)
+	}
+	if !strings.Contains(resp.body, "500 Internal Server Error") {
+		t.Errorf("fallback error page not sent, got %q", resp.body)
+	}
+	if id := resp.Header.Get(requestIDHeader); !strings.Contains(resp.body, id) {
+		t.Errorf("fallback error page does not show the request ID %q", id)
+	}
+	if n := len(h.logs.find("template_failed")); n != 2 {
+		t.Errorf("%d template_failed logs, want 2", n)
+	}
+}
+
+func TestTemplateReload(t *testing.T) {
+	for _, reload := range []bool{false, true} {
+		dir := copyTemplates(t, nil)
+		defer os.RemoveAll(dir)
+		h := newTestHarness(t, withTemplates(t, dir, reload))
+
+		if resp := h.get("/orders"); !strings.Contains(resp.body, "Your recent orders") {
+			t.Fatalf("reload=%v: orders page not rendered", reload)
+		}
+		writeTemplate(t, dir, "pages/orders.html", `{{ define "content" }}<p id="edited">edited</p>{{ end }}`)
+		resp := h.get("/orders")
+		if got := strings.Contains(resp.body, `id="edited"`); got != reload {
+			t.Errorf("reload=%v: edited page shown = %v", reload, got)
+		}
+		if !strings.Contains(resp.body, "<footer") {
+			t.Errorf("reload=%v: page rendered without the layout", reload)
+		}
+	}
+}
+
+func TestParseTemplateSet(t *testing.T) {
+	ts := testRenderer.set
+	if len(ts.pages) == 0 {
+		t.Fatal("no pages parsed")
+	}
+	for name := range ts.pages {
+		if ts.shared.Lookup(name) != nil {
+			t.Errorf("page %s is also a shared template", name)
+		}
+	}
+
+	dir := copyTemplates(t, map[string]string{"pages/home.html": `{{ define "content" }}{{ end }}`})
+	defer os.RemoveAll(dir)
+	if _, err := parseTemplateSet(dir); err == nil {
+		t.Error("page named after a shared template accepted")
+	}
+}
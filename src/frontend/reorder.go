@@ -0,0 +1,219 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/cache"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	reorderWindow  = 10 * time.Second // in which buying an order again once more does nothing
+	maxReorderKeys = 1000
+)
+
+// reorderOutcome tells what buying an order again did, item by item, for
+// the notice on the cart page. Done is closed once it is known.
+type reorderOutcome struct {
+	done chan struct{}
+
+	Added       int // products added in full
+	Unavailable int // products no longer in the catalog
+	Truncated   int // products added in part, or not at all, for the cart size limit
+	MaxItems    int
+}
+
+// Summary is the notice of the cart page, e.g. "3 added, 1 no longer
+// available".
+func (o *reorderOutcome) Summary() string {
+	parts := []string{fmt.Sprintf("%d added", o.Added)}
+	if o.Unavailable > 0 {
+		parts = append(parts, fmt.Sprintf("%d no longer available", o.Unavailable))
+	}
+	if o.Truncated > 0 {
+		parts = append(parts, fmt.Sprintf("%d did not fit: a cart holds at most %d items", o.Truncated, o.MaxItems))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// reorders remembers the orders each session recently bought again, so that
+// a double click adds the items once.
+type reorders struct {
+	mu       sync.Mutex
+	outcomes *cache.Cache // by session ID and order ID
+}
+
+func newReorders() *reorders {
+	return &reorders{outcomes: cache.New(maxReorderKeys)}
+}
+
+func reorderKey(sessionID, orderID string) string { return sessionID + "/" + orderID }
+
+// begin returns the outcome of buying the order again, and whether the
+// caller is the one to buy it; otherwise the outcome is, or will be, that of
+// an earlier request.
+func (s *reorders) begin(sessionID, orderID string) (*reorderOutcome, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := reorderKey(sessionID, orderID)
+	if v, ok := s.outcomes.Get(key); ok {
+		return v.(*reorderOutcome), false
+	}
+	o := &reorderOutcome{done: make(chan struct{})}
+	s.outcomes.Set(key, o, reorderWindow)
+	return o, true
+}
+
+// forget drops an outcome that could not be completed, for the order to be
+// bought again.
+func (s *reorders) forget(sessionID, orderID string, o *reorderOutcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.outcomes.Get(reorderKey(sessionID, orderID)); ok && v == o {
+		s.outcomes.Take(reorderKey(sessionID, orderID))
+	}
+	close(o.done)
+}
+
+// outcome returns the completed outcome of the session buying the order
+// again, or nil.
+func (s *reorders) outcome(sessionID, orderID string) *reorderOutcome {
+	v, ok := s.outcomes.Get(reorderKey(sessionID, orderID))
+	if !ok {
+		return nil
+	}
+	o := v.(*reorderOutcome)
+	select {
+	case <-o.done:
+		return o
+	default:
+		return nil
+	}
+}
+
+// reorderHandler adds the items of an order placed by the session to its
+// cart, in one traced operation. Products gone from the catalog are skipped,
+// and items are added until the cart reaches the checkout size limit. The
+// order must have been placed by the session, so a form forged elsewhere
+// cannot name one. The cart page then shows what was added.
+func (fe *frontendServer) reorderHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	orderID := r.FormValue("order_id")
+	order, ok := fe.orders.placedBy(orderID, hashSessionID(sessionID(r)))
+	if !ok || orderID == "" {
+		fe.renderHTTPError(log, r, w, errors.New("no such order"), http.StatusNotFound)
+		return
+	}
+	next := "/cart?" + url.Values{"reordered": {orderID}}.Encode()
+
+	outcome, first := fe.reorders.begin(sessionID(r), orderID)
+	if !first {
+		select {
+		case <-outcome.done:
+		case <-r.Context().Done():
+		}
+		log.WithFields(logrus.Fields{"event": "cart_reorder", "order": orderID, "repeated": true}).
+			Info("order already bought again")
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	ctx, span := trace.StartSpan(r.Context(), "frontend.reorder")
+	defer span.End()
+	added, err := fe.reorder(ctx, cartID(r), order.items, outcome)
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+		fe.reorders.forget(sessionID(r), orderID, outcome)
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "failed to buy the order again"), http.StatusInternalServerError)
+		return
+	}
+	close(outcome.done)
+	span.AddAttributes(
+		trace.Int64Attribute("reorder.added", int64(outcome.Added)),
+		trace.Int64Attribute("reorder.unavailable", int64(outcome.Unavailable)),
+		trace.Int64Attribute("reorder.truncated", int64(outcome.Truncated)))
+	log.WithFields(logrus.Fields{
+		"event":       "cart_reorder",
+		"order":       orderID,
+		"added":       outcome.Added,
+		"unavailable": outcome.Unavailable,
+		"truncated":   outcome.Truncated,
+	}).Info("order bought again")
+
+	if n, ok := fe.cartCount(r); ok {
+		fe.setCartCount(w, n+added)
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// reorder adds the items to the cart and fills in the outcome, returning
+// the number of items added. Items added before an error stay in the cart.
+func (fe *frontendServer) reorder(ctx context.Context, cartID string, items []*pb.CartItem, outcome *reorderOutcome) (int, error) {
+	room := -1 // unlimited
+	if fe.checkoutMaxItems > 0 {
+		cart, err := fe.getCart(ctx, cartID)
+		if err != nil {
+			return 0, errors.Wrap(err, "could not retrieve cart")
+		}
+		outcome.MaxItems = fe.checkoutMaxItems
+		if room = fe.checkoutMaxItems - cartQuantity(cart); room < 0 {
+			room = 0
+		}
+	}
+
+	var added int
+	for _, it := range items {
+		p, err := fe.getProduct(ctx, it.GetProductId())
+		if status.Code(err) == codes.NotFound {
+			outcome.Unavailable++
+			continue
+		}
+		if err != nil {
+			return added, errors.Wrap(err, "could not retrieve product")
+		}
+		quantity := int(it.GetQuantity())
+		if room >= 0 && quantity > room {
+			quantity = room
+			outcome.Truncated++
+		} else {
+			outcome.Added++
+		}
+		if quantity == 0 {
+			continue
+		}
+		if err := fe.insertCart(ctx, cartID, p.GetId(), int32(quantity)); err != nil {
+			return added, errors.Wrap(err, "failed to add to cart")
+		}
+		added += quantity
+		if room >= 0 {
+			room -= quantity
+		}
+	}
+	return added, nil
+}
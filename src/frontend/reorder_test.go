@@ -0,0 +1,123 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+var orderIDValue = regexp.MustCompile(`name="order_id" value="([^"]*)"`)
+
+// placeOrder orders the given quantities of products and returns the ID
+// offered by "buy it again" on the confirmation page.
+func placeOrder(h *testHarness, quantities map[string]string) string {
+	h.t.Helper()
+	for id, n := range quantities {
+		h.post("/cart", url.Values{"product_id": {id}, "quantity": {n}})
+	}
+	resp := h.post("/cart/checkout", checkoutForm)
+	m := orderIDValue.FindStringSubmatch(resp.body)
+	if m == nil {
+		h.t.Fatalf("order page (status %d) offers no buy it again", resp.StatusCode)
+	}
+	return m[1]
+}
+
+// cartOf returns the quantities in the cart of the harness session.
+func cartOf(h *testHarness) map[string]int32 {
+	h.cart.mu.Lock()
+	defer h.cart.mu.Unlock()
+	out := make(map[string]int32)
+	for _, it := range h.cart.carts[h.cookie(cookieSessionID)] {
+		out[it.GetProductId()] = it.GetQuantity()
+	}
+	return out
+}
+
+func TestReorderPartlyAvailable(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.get("/")
+	orderID := placeOrder(h, map[string]string{"OLJCESPC7Z": "2", "66VCHSJNUP": "1", "1YMWWN1N4O": "3"})
+
+	// The lens left the catalog since.
+	h.catalog.mu.Lock()
+	h.catalog.products = []*pb.Product{fakeProducts[0], fakeProducts[2]}
+	h.catalog.mu.Unlock()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+
+	resp := h.post("/cart/reorder", url.Values{"order_id": {orderID}})
+	if !strings.Contains(resp.body, "Bought again: 2 added, 1 no longer available.") {
+		t.Errorf("cart page (status %d) does not say what was added", resp.StatusCode)
+	}
+	want := map[string]int32{"OLJCESPC7Z": 3, "1YMWWN1N4O": 3}
+	if got := cartOf(h); !reflect.DeepEqual(got, want) {
+		t.Errorf("cart = %v, want %v", got, want)
+	}
+	if entries := h.logs.find("cart_reorder"); len(entries) != 1 || entries[0].Data["unavailable"] != 1 {
+		t.Errorf("reorder logged as %v", entries)
+	}
+
+	// A double click adds nothing more.
+	if resp := h.post("/cart/reorder", url.Values{"order_id": {orderID}}); !strings.Contains(resp.body, "2 added") {
+		t.Error("repeated reorder does not show the outcome of the first")
+	}
+	if got := cartOf(h); !reflect.DeepEqual(got, want) {
+		t.Errorf("cart after a double click = %v, want %v", got, want)
+	}
+}
+
+func TestReorderCartLimit(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) { fe.checkoutMaxItems = 4 })
+	defer h.close()
+	h.get("/")
+	orderID := placeOrder(h, map[string]string{"OLJCESPC7Z": "1", "66VCHSJNUP": "3"})
+
+	h.post("/cart", url.Values{"product_id": {"1YMWWN1N4O"}, "quantity": {"2"}})
+	resp := h.post("/cart/reorder", url.Values{"order_id": {orderID}})
+	if !strings.Contains(resp.body, "did not fit: a cart holds at most 4 items") {
+		t.Error("cart page does not say the order did not fit")
+	}
+	if got := cartOf(h); got["1YMWWN1N4O"]+got["OLJCESPC7Z"]+got["66VCHSJNUP"] != 4 || got["1YMWWN1N4O"] != 2 {
+		t.Errorf("cart = %v, want it filled to 4 items", got)
+	}
+	if got := h.cookie(cookieCartCount); !strings.HasPrefix(got, "4.") {
+		t.Errorf("cart count cookie = %q, want 4 items", got)
+	}
+}
+
+func TestReorderOtherSession(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.get("/")
+	orderID := placeOrder(h, map[string]string{"OLJCESPC7Z": "1"})
+
+	h.client.Jar, _ = cookiejar.New(nil)
+	h.get("/")
+	if resp := h.post("/cart/reorder", url.Values{"order_id": {orderID}}); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("reordering another session's order = %d, want 404", resp.StatusCode)
+	}
+	if got := cartOf(h); len(got) != 0 {
+		t.Errorf("cart = %v, want it empty", got)
+	}
+}
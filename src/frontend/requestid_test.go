@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidRequestID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"0f8fad5b-d9cb-469f-a165-70867728950e":     true,
+		"Root=1-67891233-abcdef012345678912345678": true,
+		"req_42.a:b/c+d":                        true,
+		"":                                      false,
+		strings.Repeat("a", maxRequestIDLength): true,
+		strings.Repeat("a", maxRequestIDLength+1): false,
+		"abc\ninjected=true":                      false,
+		"abc def":                                 false,
+		`"><script>`:                              false,
+		"ßpecial":                                 false,
+	} {
+		if got := validRequestID(id); got != want {
+			t.Errorf("validRequestID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	const id = "lb-4f2a9c:7"
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/product/OLJCESPC7Z", nil)
+	req.Header.Set(requestIDHeader, id)
+	resp := h.do(req)
+	if got := resp.Header.Get(requestIDHeader); got != id {
+		t.Errorf("response %s = %q, want %q", requestIDHeader, got, id)
+	}
+	if got := h.faults.metadata(getProductMethod).Get(requestIDMetadata); len(got) != 1 || got[0] != id {
+		t.Errorf("GetProduct metadata %s = %q, want %q", requestIDMetadata, got, id)
+	}
+	found := false
+	for _, e := range h.logs.find("request") {
+		found = found || e.Data["request_id"] == id
+	}
+	if !found {
+		t.Error("request not logged with its ID")
+	}
+
+	// An error page shows the ID for the user to report.
+	h.fail(getProductMethod, status.Error(codes.Internal, "injected failure"))
+	req, _ = http.NewRequest(http.MethodGet, h.srv.URL+"/product/OLJCESPC7Z", nil)
+	req.Header.Set(requestIDHeader, id)
+	if resp := h.do(req); !strings.Contains(resp.body, "<code>"+id+"</code>") {
+		t.Errorf("error page (%d) does not show the request ID", resp.StatusCode)
+	}
+}
+
+func TestRequestIDReplaced(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	for _, inbound := range []string{"", `forged" severity="ERROR`, strings.Repeat("x", maxRequestIDLength+1)} {
+		req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/product/OLJCESPC7Z", nil)
+		if inbound != "" {
+			req.Header[requestIDHeader] = []string{inbound}
+		}
+		resp := h.do(req)
+		id := resp.Header.Get(requestIDHeader)
+		if id == inbound || !validRequestID(id) {
+			t.Errorf("inbound %q: request ID %q", inbound, id)
+		}
+		if got := h.faults.metadata(getProductMethod).Get(requestIDMetadata); len(got) != 1 || got[0] != id {
+			t.Errorf("inbound %q: GetProduct metadata %q, want %q", inbound, got, id)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	cookieLastViewed      = cookiePrefix + "last-viewed"
+	cookieResumeDismissed = cookiePrefix + "resume-dismissed"
+)
+
+// resumeCard invites a returning shopper to continue where they left off.
+type resumeCard struct {
+	Items      int
+	Total      *pb.Money   // in the session currency; nil if it could not be priced
+	LastViewed *pb.Product // nil if unknown
+}
+
+// rememberViewed keeps the last product viewed by the session, for the
+// resume card. Viewing the same product again sets no cookie, which would
+// keep the page from being cached.
+func rememberViewed(w http.ResponseWriter, r *http.Request, id string) {
+	if c, err := r.Cookie(cookieLastViewed); err == nil && c.Value == id {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   cookieLastViewed,
+		Value:  id,
+		Path:   "/",
+		MaxAge: cookieMaxAge,
+	})
+}
+
+// resumeCard returns the card of the home page, or nil when there is
+// nothing to resume: a new session, an empty cart, synthetic traffic or a
+// card dismissed in this session. It only reads what the session already
+// has; its calls are decorative, so a failing backend leaves out the card
+// or a part of it. The cart is returned when it was read, for the page not
+// to read it again.
+func (fe *frontendServer) resumeCard(ctx context.Context, log logrus.FieldLogger, r *http.Request) (*resumeCard, []*pb.CartItem, bool) {
+	if _, err := r.Cookie(cookieSessionID); err != nil || isSynthetic(r) {
+		return nil, nil, false // the session started with this request
+	}
+	if c, err := r.Cookie(cookieResumeDismissed); err == nil && c.Value == hashSessionID(sessionID(r)) {
+		return nil, nil, false
+	}
+	if n, ok := fe.cartCount(r); ok && n == 0 {
+		return nil, nil, false
+	}
+
+	var cart []*pb.CartItem
+	var read bool
+	pageCall(ctx, log, "resume", "GetCart", func(ctx context.Context) (err error) {
+		cart, err = fe.getCart(ctx, cartID(r))
+		read = err == nil
+		return
+	})
+	if len(cart) == 0 {
+		return nil, cart, read
+	}
+	card := &resumeCard{Items: cartQuantity(cart)}
+	pageCall(ctx, log, "resume", "GetQuote", func(ctx context.Context) error {
+		quote, err := fe.quoteCart(ctx, cart, fe.addresses.get(sessionID(r)).proto(), currentCurrency(r))
+		if err == nil {
+			card.Total = &quote.Total
+		}
+		return err
+	})
+	if c, err := r.Cookie(cookieLastViewed); err == nil && c.Value != "" {
+		pageCall(ctx, log, "resume", "GetProduct", func(ctx context.Context) (err error) {
+			card.LastViewed, err = fe.getProduct(ctx, c.Value)
+			return
+		})
+	}
+	return card, cart, read
+}
+
+// dismissResumeHandler hides the resume card for the rest of the session.
+func (fe *frontendServer) dismissResumeHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   cookieResumeDismissed,
+		Value:  hashSessionID(sessionID(r)),
+		Path:   "/",
+		MaxAge: cookieMaxAge,
+	})
+	w.Header().Set("Location", "/")
+	w.WriteHeader(http.StatusSeeOther)
+}
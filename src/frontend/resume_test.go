@@ -0,0 +1,109 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	getProductMethod = "/hipstershop.ProductCatalogService/GetProduct"
+	getQuoteMethod   = "/hipstershop.ShippingService/GetQuote"
+)
+
+func TestResumeCard(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "down")
+	for _, tc := range []struct {
+		name        string
+		viewed      bool // a product page was viewed
+		cart        bool // the cart has an item
+		fail        string
+		wantCard    bool
+		wantTotal   bool
+		wantProduct bool
+	}{
+		{name: "nothing"},
+		{name: "viewed only", viewed: true},
+		{name: "cart only", cart: true, wantCard: true, wantTotal: true},
+		{name: "cart and viewed", viewed: true, cart: true, wantCard: true, wantTotal: true, wantProduct: true},
+		{name: "quote failing", viewed: true, cart: true, fail: getQuoteMethod, wantCard: true, wantProduct: true},
+		{name: "catalog failing", viewed: true, cart: true, fail: getProductMethod, wantCard: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHarness(t)
+			defer h.close()
+			h.get("/") // start the session
+			if tc.viewed {
+				h.get("/product/66VCHSJNUP")
+			}
+			if tc.cart {
+				h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"2"}})
+			}
+			if tc.fail != "" {
+				h.fail(tc.fail, unavailable)
+			}
+
+			resp := h.get("/")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET / = %d", resp.StatusCode)
+			}
+			if got := strings.Contains(resp.body, `id="resume"`); got != tc.wantCard {
+				t.Fatalf("card shown = %v, want %v", got, tc.wantCard)
+			}
+			if !tc.wantCard {
+				return
+			}
+			if !strings.Contains(resp.body, "Your cart has 2 item(s)") {
+				t.Error("card does not show the cart size")
+			}
+			if got := strings.Contains(resp.body, "in total"); got != tc.wantTotal {
+				t.Errorf("total shown = %v, want %v", got, tc.wantTotal)
+			}
+			if got := strings.Contains(resp.body, `You last looked at <a href="/product/66VCHSJNUP">`); got != tc.wantProduct {
+				t.Errorf("last viewed product shown = %v, want %v", got, tc.wantProduct)
+			}
+		})
+	}
+}
+
+func TestResumeCardHidden(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	// A fresh session has no cart to resume.
+	if resp := h.get("/"); strings.Contains(resp.body, `id="resume"`) {
+		t.Error("card shown to a fresh session")
+	}
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/", nil)
+	req.Header.Set("User-Agent", "python-requests/2.21.0")
+	if resp := h.do(req); strings.Contains(resp.body, `id="resume"`) {
+		t.Error("card shown to synthetic traffic")
+	}
+
+	resp := h.post("/resume/dismiss", nil)
+	if resp.Request.URL.Path != "/" || strings.Contains(resp.body, `id="resume"`) {
+		t.Error("card shown after dismissing it")
+	}
+	if h.cookie(cookieResumeDismissed) != hashSessionID(h.cookie(cookieSessionID)) {
+		t.Error("dismissal not bound to the session")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultRPCRetries    = 2
+	defaultRPCRetryDelay = 25 * time.Millisecond
+	maxRPCRetryDelay     = time.Second
+)
+
+// idempotentMethods are the backend calls that only read, and may be made
+// again when the backend could not be reached. Calls changing state, such
+// as AddItem, EmptyCart or PlaceOrder, are never retried: the first attempt
+// may have gone through.
+var idempotentMethods = map[string]bool{
+	"/hipstershop.ProductCatalogService/GetProduct":       true,
+	"/hipstershop.ProductCatalogService/ListProducts":     true,
+	"/hipstershop.CartService/GetCart":                    true,
+	"/hipstershop.CurrencyService/GetSupportedCurrencies": true,
+	"/hipstershop.CurrencyService/Convert":                true,
+	"/hipstershop.ShippingService/GetQuote":               true,
+}
+
+// retryPolicy retries the idempotent calls failing with Unavailable, with
+// an exponential backoff and jitter, within the deadline of the call. A
+// nil policy makes every call once.
+type retryPolicy struct {
+	retries int           // after the first attempt
+	delay   time.Duration // before the first retry, doubled for each next one
+	jitter  func() float64
+}
+
+func newRetryPolicy(retries int, delay time.Duration) *retryPolicy {
+	return &retryPolicy{retries: retries, delay: delay, jitter: rand.Float64}
+}
+
+// backoff returns the wait before the given retry, counted from 1: half
+// the exponential delay, plus up to as much again at random so that the
+// clients of a restarting backend do not retry all at once.
+func (p *retryPolicy) backoff(retry int) time.Duration {
+	d := p.delay << uint(retry-1)
+	if d > maxRPCRetryDelay || d <= 0 {
+		d = maxRPCRetryDelay
+	}
+	return d/2 + time.Duration(p.jitter()*float64(d/2))
+}
+
+// intercept is a unary client interceptor applying the policy.
+func (p *retryPolicy) intercept(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if p == nil || !idempotentMethods[method] {
+		return err
+	}
+	retry := 0
+	for ; retry < p.retries && status.Code(err) == codes.Unavailable; retry++ {
+		wait := p.backoff(retry + 1)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			break // no time left for another attempt
+		}
+		retryAnnotate(ctx, method, retry+1, wait, err)
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+		err = invoker(ctx, method, req, reply, cc, opts...)
+	}
+	if retry > 0 {
+		trace.FromContext(ctx).AddAttributes(trace.Int64Attribute("rpc.retries", int64(retry)))
+	}
+	return err
+}
+
+// retryAnnotate records a retry on the span of the request and in its log.
+func retryAnnotate(ctx context.Context, method string, retry int, wait time.Duration, err error) {
+	trace.FromContext(ctx).Annotate([]trace.Attribute{
+		trace.StringAttribute("method", method),
+		trace.Int64Attribute("retry", int64(retry)),
+		trace.StringAttribute("backoff", wait.String()),
+		trace.StringAttribute("error", err.Error()),
+	}, "retrying call")
+	if log, ok := ctx.Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+		log.WithFields(logrus.Fields{
+			"event":   "rpc_retry",
+			"method":  method,
+			"retry":   retry,
+			"backoff": wait.String(),
+			"error":   err,
+		}).Info("retrying call")
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// withRetries retries the idempotent calls without jitter.
+func withRetries(retries int, delay time.Duration) func(*frontendServer) {
+	return func(fe *frontendServer) {
+		fe.retries = &retryPolicy{retries: retries, delay: delay, jitter: func() float64 { return 0 }}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := &retryPolicy{delay: 100 * time.Millisecond, jitter: func() float64 { return 0 }}
+	for retry, want := range map[int]time.Duration{
+		1:  50 * time.Millisecond,
+		2:  100 * time.Millisecond,
+		3:  200 * time.Millisecond,
+		10: maxRPCRetryDelay / 2,
+		70: maxRPCRetryDelay / 2,
+	} {
+		if got := p.backoff(retry); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", retry, got, want)
+		}
+	}
+	p.jitter = func() float64 { return 0.5 }
+	if got, want := p.backoff(1), 75*time.Millisecond; got != want {
+		t.Errorf("backoff(1) with jitter = %v, want %v", got, want)
+	}
+}
+
+func TestRetryFlakyBackend(t *testing.T) {
+	h := newTestHarness(t, withRetries(2, time.Millisecond))
+	defer h.close()
+	const method = "/hipstershop.CartService/GetCart"
+	h.failTimes(method, status.Error(codes.Unavailable, "injected failure"), 2)
+
+	resp := h.get("/cart")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d after two transient failures", resp.StatusCode, http.StatusOK)
+	}
+	if n := len(h.logs.find("rpc_retry")); n != 2 {
+		t.Errorf("%d rpc_retry events logged, want 2", n)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "injected failure")
+	for _, tc := range []struct {
+		name   string
+		method string
+		err    error
+		call   func(*frontendServer) error
+		calls  int
+	}{
+		{"exhausted", "/hipstershop.CurrencyService/GetSupportedCurrencies", unavailable,
+			func(fe *frontendServer) error { _, err := fe.getCurrencies(context.Background()); return err }, 3},
+		{"not unavailable", "/hipstershop.ProductCatalogService/GetProduct", status.Error(codes.NotFound, "no such product"),
+			func(fe *frontendServer) error {
+				_, err := fe.getProduct(context.Background(), "OLJCESPC7Z")
+				return err
+			}, 1},
+		{"AddItem", "/hipstershop.CartService/AddItem", unavailable,
+			func(fe *frontendServer) error { return fe.insertCart(context.Background(), "u", "OLJCESPC7Z", 1) }, 1},
+		{"EmptyCart", "/hipstershop.CartService/EmptyCart", unavailable,
+			func(fe *frontendServer) error { return fe.emptyCart(context.Background(), "u") }, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHarness(t, withRetries(2, time.Millisecond))
+			defer h.close()
+			h.fail(tc.method, tc.err)
+
+			if err := tc.call(h.fe); status.Code(err) != status.Code(tc.err) {
+				t.Errorf("error = %v, want code %v", err, status.Code(tc.err))
+			}
+			if n := h.faults.calls(tc.method); n != tc.calls {
+				t.Errorf("%d calls, want %d", n, tc.calls)
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	h := newTestHarness(t, withRetries(10, 20*time.Millisecond), func(fe *frontendServer) {
+		fe.rpcTimeouts = rpcTimeouts{rpcTimeoutDefault: timeout}
+	})
+	defer h.close()
+	const method = "/hipstershop.CurrencyService/GetSupportedCurrencies"
+	h.fail(method, status.Error(codes.Unavailable, "injected failure"))
+
+	start := time.Now()
+	if _, err := h.fe.getCurrencies(context.Background()); err == nil {
+		t.Fatal("call succeeded against a failing backend")
+	}
+	if d := time.Since(start); d > timeout {
+		t.Errorf("retries took %v, beyond the %v call timeout", d, timeout)
+	}
+	// At most 10, 20 and 40ms of backoff fit in the timeout, 80ms more
+	// does not.
+	if n := h.faults.calls(method); n < 2 || n > 4 {
+		t.Errorf("%d calls, want 2 to 4", n)
+	}
+}
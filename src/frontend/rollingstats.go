@@ -0,0 +1,452 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	statsBuckets          = 60 // one per minute, for the longest window
+	maxStatsRoutes        = 64 // routes beyond are counted together as "other"
+	maxStatsSessions      = 10000
+	statsSessionShards    = 16
+	statsOtherRoute       = "other"
+	statsOtherCurrency    = "other"
+	statsDashboardRefresh = 10 // seconds
+)
+
+// statsWindows are the windows reported by /api/stats.
+var statsWindows = []time.Duration{5 * time.Minute, time.Hour}
+
+// statsLatencyBounds are the upper bounds, in milliseconds, of the latency
+// histogram of each route; the percentiles are reported as bucket bounds.
+var statsLatencyBounds = [...]float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// Caches whose hit ratio is reported.
+const (
+	statsCacheFragments = iota
+	statsCacheFacets
+	statsCacheRates
+	statsCacheCatalog
+	numStatsCaches
+)
+
+var statsCacheNames = [numStatsCaches]string{"fragments", "facets", "rates", "catalog"}
+
+// statsCurrencies are the currencies revenue is reported in, sorted; other
+// currencies are counted together.
+var statsCurrencies = func() []string {
+	var out []string
+	for c := range whitelistedCurrencies {
+		out = append(out, c)
+	}
+	sort.Strings(out)
+	return out
+}()
+
+type routeCounters struct {
+	requests int64
+	errors   int64
+	latency  [len(statsLatencyBounds) + 1]int64 // by bound, then above them
+}
+
+// statsBucket has the counters of one minute. Every field is accessed
+// atomically.
+type statsBucket struct {
+	minute      int64 // since the epoch
+	routes      [maxStatsRoutes + 1]routeCounters
+	orders      int64
+	revenue     []int64 // nanos, by statsCurrencies then other
+	cacheHits   [numStatsCaches]int64
+	cacheMisses [numStatsCaches]int64
+}
+
+// reset zeroes the counters. Counts added concurrently may be lost.
+func (b *statsBucket) reset() {
+	for i := range b.routes {
+		rc := &b.routes[i]
+		atomic.StoreInt64(&rc.requests, 0)
+		atomic.StoreInt64(&rc.errors, 0)
+		for j := range rc.latency {
+			atomic.StoreInt64(&rc.latency[j], 0)
+		}
+	}
+	atomic.StoreInt64(&b.orders, 0)
+	for i := range b.revenue {
+		atomic.StoreInt64(&b.revenue[i], 0)
+	}
+	for i := 0; i < numStatsCaches; i++ {
+		atomic.StoreInt64(&b.cacheHits[i], 0)
+		atomic.StoreInt64(&b.cacheMisses[i], 0)
+	}
+}
+
+type sessionShard struct {
+	mu   sync.Mutex
+	seen map[string]int64 // last minute seen, by session ID
+}
+
+// rollingStats counts what the shop did in the last hour, by minute, in a
+// ring of buckets reused as time goes: it needs no Prometheus and its
+// memory is bounded whatever the traffic. Counters are updated atomically;
+// a bucket is zeroed by the first update of its new minute. Its methods
+// accept a nil *rollingStats, which counts nothing.
+type rollingStats struct {
+	now           func() time.Time
+	countInjected bool // count the requests failed by the errorInjector
+
+	buckets [statsBuckets]statsBucket
+
+	routesMu sync.Mutex
+	routes   sync.Map // route name to index in statsBucket.routes
+	names    [maxStatsRoutes + 1]string
+	nroutes  int
+
+	sessions [statsSessionShards]sessionShard
+}
+
+func newRollingStats() *rollingStats {
+	s := &rollingStats{now: time.Now}
+	s.names[maxStatsRoutes] = statsOtherRoute
+	for i := range s.buckets {
+		s.buckets[i].revenue = make([]int64, len(statsCurrencies)+1)
+	}
+	for i := range s.sessions {
+		s.sessions[i].seen = make(map[string]int64)
+	}
+	return s
+}
+
+func unixMinute(t time.Time) int64 { return t.Unix() / 60 }
+
+// bucket returns the bucket of the current minute, or nil if the clock went
+// back past its ring.
+func (s *rollingStats) bucket() *statsBucket {
+	m := unixMinute(s.now())
+	b := &s.buckets[m%statsBuckets]
+	for {
+		cur := atomic.LoadInt64(&b.minute)
+		switch {
+		case cur == m:
+			return b
+		case cur > m:
+			return nil
+		case atomic.CompareAndSwapInt64(&b.minute, cur, m):
+			b.reset()
+			return b
+		}
+	}
+}
+
+// routeIndex returns the counters index of a route, registering it while
+// there is room.
+func (s *rollingStats) routeIndex(route string) int {
+	if i, ok := s.routes.Load(route); ok {
+		return i.(int)
+	}
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	if i, ok := s.routes.Load(route); ok {
+		return i.(int)
+	}
+	if s.nroutes == maxStatsRoutes {
+		return maxStatsRoutes
+	}
+	i := s.nroutes
+	s.names[i] = route
+	s.nroutes++
+	s.routes.Store(route, i)
+	return i
+}
+
+// request counts a request served by route.
+func (s *rollingStats) request(route string, status int, d time.Duration) {
+	if s == nil {
+		return
+	}
+	b := s.bucket()
+	if b == nil {
+		return
+	}
+	rc := &b.routes[s.routeIndex(route)]
+	atomic.AddInt64(&rc.requests, 1)
+	if status >= 500 {
+		atomic.AddInt64(&rc.errors, 1)
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	atomic.AddInt64(&rc.latency[sort.SearchFloat64s(statsLatencyBounds[:], ms)], 1)
+}
+
+// order counts an order placed for total.
+func (s *rollingStats) order(total pb.Money) {
+	if s == nil {
+		return
+	}
+	b := s.bucket()
+	if b == nil {
+		return
+	}
+	atomic.AddInt64(&b.orders, 1)
+	i := sort.SearchStrings(statsCurrencies, total.GetCurrencyCode())
+	if i == len(statsCurrencies) || statsCurrencies[i] != total.GetCurrencyCode() {
+		i = len(statsCurrencies)
+	}
+	atomic.AddInt64(&b.revenue[i], total.GetUnits()*1e9+int64(total.GetNanos()))
+}
+
+// cacheLookup counts a hit or a miss of one of the reported caches.
+func (s *rollingStats) cacheLookup(cache int, hit bool) {
+	if s == nil {
+		return
+	}
+	b := s.bucket()
+	if b == nil {
+		return
+	}
+	if hit {
+		atomic.AddInt64(&b.cacheHits[cache], 1)
+	} else {
+		atomic.AddInt64(&b.cacheMisses[cache], 1)
+	}
+}
+
+// session notes that a session was active. Sessions beyond
+// maxStatsSessions active in the last hour are not counted.
+func (s *rollingStats) session(id string) {
+	if s == nil || id == "" {
+		return
+	}
+	m := unixMinute(s.now())
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	sh := &s.sessions[h.Sum32()%statsSessionShards]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.seen[id]; !ok && len(sh.seen) >= maxStatsSessions/statsSessionShards {
+		for k, last := range sh.seen {
+			if last <= m-statsBuckets {
+				delete(sh.seen, k)
+			}
+		}
+		if len(sh.seen) >= maxStatsSessions/statsSessionShards {
+			return
+		}
+	}
+	sh.seen[id] = m
+}
+
+// reset forgets everything counted so far.
+func (s *rollingStats) reset() {
+	for i := range s.buckets {
+		s.buckets[i].reset()
+	}
+	for i := range s.sessions {
+		sh := &s.sessions[i]
+		sh.mu.Lock()
+		sh.seen = make(map[string]int64)
+		sh.mu.Unlock()
+	}
+}
+
+// wrap counts the requests served by the handler of router.
+func (s *rollingStats) wrap(router *mux.Router, next http.Handler) http.Handler {
+	name := routeSpanName(router)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rr := &responseRecorder{w: w}
+		next.ServeHTTP(rr, r)
+		if w.Header().Get(headerInjectedError) != "" && !s.countInjected {
+			return
+		}
+		status := rr.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.request(name(r), status, time.Since(start))
+		s.session(hashSessionID(sessionID(r)))
+	})
+}
+
+type routeStats struct {
+	Route    string  `json:"route"`
+	Requests int64   `json:"requests"`
+	Errors   int64   `json:"errors"`
+	P50MS    float64 `json:"p50_ms"`
+	P95MS    float64 `json:"p95_ms"`
+}
+
+type windowStats struct {
+	Window         string             `json:"window"`
+	Requests       int64              `json:"requests"`
+	Errors         int64              `json:"errors"`
+	Routes         []routeStats       `json:"routes"` // busiest first
+	Orders         int64              `json:"orders"`
+	Revenue        map[string]string  `json:"revenue"`         // by currency
+	CacheHitRatio  map[string]float64 `json:"cache_hit_ratio"` // of the caches looked up
+	ActiveSessions int                `json:"active_sessions"`
+}
+
+type statsReport struct {
+	Time    time.Time     `json:"time"`
+	Windows []windowStats `json:"windows"`
+}
+
+// percentile returns the upper bound of the histogram bucket holding the
+// quantile q of the latencies, or the highest bound for the last bucket.
+func percentile(hist []int64, total int64, q float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	rank := int64(q*float64(total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var n int64
+	for i, c := range hist {
+		if n += c; n >= rank && i < len(statsLatencyBounds) {
+			return statsLatencyBounds[i]
+		}
+	}
+	return statsLatencyBounds[len(statsLatencyBounds)-1]
+}
+
+// window sums the buckets of the last d.
+func (s *rollingStats) window(d time.Duration) windowStats {
+	now := unixMinute(s.now())
+	oldest := now - int64(d/time.Minute) + 1
+	var routes [maxStatsRoutes + 1]routeCounters
+	var orders int64
+	revenue := make([]int64, len(statsCurrencies)+1)
+	var hits, misses [numStatsCaches]int64
+	for i := range s.buckets {
+		b := &s.buckets[i]
+		if m := atomic.LoadInt64(&b.minute); m < oldest || m > now {
+			continue
+		}
+		for j := range b.routes {
+			routes[j].requests += atomic.LoadInt64(&b.routes[j].requests)
+			routes[j].errors += atomic.LoadInt64(&b.routes[j].errors)
+			for k := range b.routes[j].latency {
+				routes[j].latency[k] += atomic.LoadInt64(&b.routes[j].latency[k])
+			}
+		}
+		orders += atomic.LoadInt64(&b.orders)
+		for j := range b.revenue {
+			revenue[j] += atomic.LoadInt64(&b.revenue[j])
+		}
+		for j := 0; j < numStatsCaches; j++ {
+			hits[j] += atomic.LoadInt64(&b.cacheHits[j])
+			misses[j] += atomic.LoadInt64(&b.cacheMisses[j])
+		}
+	}
+
+	w := windowStats{
+		Window:        d.String(),
+		Orders:        orders,
+		Revenue:       make(map[string]string),
+		CacheHitRatio: make(map[string]float64),
+	}
+	s.routesMu.Lock()
+	names := s.names
+	s.routesMu.Unlock()
+	for i, rc := range routes {
+		if rc.requests == 0 {
+			continue
+		}
+		w.Requests += rc.requests
+		w.Errors += rc.errors
+		w.Routes = append(w.Routes, routeStats{
+			Route:    names[i],
+			Requests: rc.requests,
+			Errors:   rc.errors,
+			P50MS:    percentile(rc.latency[:], rc.requests, 0.5),
+			P95MS:    percentile(rc.latency[:], rc.requests, 0.95),
+		})
+	}
+	sort.SliceStable(w.Routes, func(i, j int) bool { return w.Routes[i].Requests > w.Routes[j].Requests })
+	for i, nanos := range revenue {
+		if nanos == 0 {
+			continue
+		}
+		currency := statsOtherCurrency
+		if i < len(statsCurrencies) {
+			currency = statsCurrencies[i]
+		}
+		w.Revenue[currency] = formatDecimal(pb.Money{Units: nanos / 1e9, Nanos: int32(nanos % 1e9)})
+	}
+	for i, name := range statsCacheNames {
+		if total := hits[i] + misses[i]; total > 0 {
+			w.CacheHitRatio[name] = float64(hits[i]) / float64(total)
+		}
+	}
+	for i := range s.sessions {
+		sh := &s.sessions[i]
+		sh.mu.Lock()
+		for _, last := range sh.seen {
+			if last >= oldest {
+				w.ActiveSessions++
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return w
+}
+
+// report returns the statistics of every window of statsWindows.
+func (s *rollingStats) report() statsReport {
+	rep := statsReport{Time: s.now()}
+	for _, d := range statsWindows {
+		rep.Windows = append(rep.Windows, s.window(d))
+	}
+	return rep
+}
+
+// statsHandler serves the statistics as JSON, like the debug endpoints.
+func (fe *frontendServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	fe.serveDebugJSON(w, r, fe.stats.report())
+}
+
+// dashboardHandler renders the statistics as a page refreshing itself.
+func (fe *frontendServer) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if !fe.demoMode && !fe.debugEnabled(r) {
+		http.NotFound(w, r)
+		return
+	}
+	fe.render(w, r, http.StatusOK, "dashboard", map[string]interface{}{
+		"report":  fe.stats.report(),
+		"refresh": statsDashboardRefresh,
+	})
+}
+
+// resetStatsHandler forgets the statistics, e.g. before a demo.
+func (fe *frontendServer) resetStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !fe.isAdmin(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	fe.stats.reset()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func newTestStats(c *fakeClock) *rollingStats {
+	s := newRollingStats()
+	s.now = c.Now
+	return s
+}
+
+func TestRollingStatsWindows(t *testing.T) {
+	c := newFakeClock()
+	s := newTestStats(c)
+	s.request("GET /", http.StatusOK, 3*time.Millisecond)
+	s.request("GET /", http.StatusBadGateway, 40*time.Millisecond)
+	s.order(pb.Money{CurrencyCode: "USD", Units: 10, Nanos: 500000000})
+	s.session("a")
+
+	c.Advance(10 * time.Minute)
+	s.request("GET /", http.StatusOK, 3*time.Millisecond)
+	s.order(pb.Money{CurrencyCode: "USD", Units: 1})
+	s.order(pb.Money{CurrencyCode: "XXX", Units: 2})
+	s.session("b")
+
+	rep := s.report()
+	short, long := rep.Windows[0], rep.Windows[1]
+	if short.Requests != 1 || short.Errors != 0 || short.Orders != 2 || short.ActiveSessions != 1 {
+		t.Errorf("5m window = %+v, want 1 request, 2 orders and 1 session", short)
+	}
+	if long.Requests != 3 || long.Errors != 1 || long.Orders != 3 || long.ActiveSessions != 2 {
+		t.Errorf("1h window = %+v, want 3 requests, 1 error, 3 orders and 2 sessions", long)
+	}
+	if got := long.Revenue["USD"]; got != formatDecimal(pb.Money{Units: 11, Nanos: 500000000}) {
+		t.Errorf("USD revenue = %s, want 11.5", got)
+	}
+	if got := long.Revenue[statsOtherCurrency]; got == "" {
+		t.Error("revenue in other currencies not reported")
+	}
+	if r := long.Routes[0]; r.P50MS != 5 || r.P95MS != 50 {
+		t.Errorf("percentiles = %v/%v, want 5/50", r.P50MS, r.P95MS)
+	}
+
+	// An hour later, the ring reuses the buckets of the first minutes.
+	c.Advance(55 * time.Minute)
+	s.request("GET /cart", http.StatusOK, time.Millisecond)
+	rep = s.report()
+	if long := rep.Windows[1]; long.Requests != 2 || long.Orders != 2 || long.ActiveSessions != 1 {
+		t.Errorf("1h window after an hour = %+v, want the requests of the last hour only", long)
+	}
+}
+
+func TestRollingStatsConcurrent(t *testing.T) {
+	c := newFakeClock()
+	s := newTestStats(c)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				s.request(fmt.Sprintf("GET /r%d", j%4), http.StatusOK, time.Millisecond)
+				s.cacheLookup(statsCacheRates, j%2 == 0)
+				s.session(fmt.Sprintf("s%d", i))
+			}
+		}(i)
+	}
+	wg.Wait()
+	w := s.report().Windows[0]
+	if w.Requests != 4000 || len(w.Routes) != 4 || w.ActiveSessions != 8 {
+		t.Errorf("counted %d requests on %d routes for %d sessions, want 4000 on 4 for 8",
+			w.Requests, len(w.Routes), w.ActiveSessions)
+	}
+	if got := w.CacheHitRatio["rates"]; got != 0.5 {
+		t.Errorf("rates hit ratio = %v, want 0.5", got)
+	}
+}
+
+func TestRollingStatsRouteCap(t *testing.T) {
+	s := newTestStats(newFakeClock())
+	for i := 0; i < maxStatsRoutes+10; i++ {
+		s.request(fmt.Sprintf("GET /r%d", i), http.StatusOK, time.Millisecond)
+	}
+	w := s.report().Windows[0]
+	if len(w.Routes) != maxStatsRoutes+1 || w.Requests != maxStatsRoutes+10 {
+		t.Fatalf("counted %d requests on %d routes, want %d on %d",
+			w.Requests, len(w.Routes), maxStatsRoutes+10, maxStatsRoutes+1)
+	}
+	if r := w.Routes[0]; r.Route != statsOtherRoute || r.Requests != 10 {
+		t.Errorf("busiest route = %+v, want %q with 10 requests", r, statsOtherRoute)
+	}
+}
+
+func TestStatsEndpoints(t *testing.T) {
+	h := newTestHarness(t, withAdminToken)
+	defer h.close()
+	h.get("/product/OLJCESPC7Z")
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	h.post("/cart/checkout", checkoutForm)
+
+	if resp := h.get("/api/stats"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("stats without the admin token = %d, want 404", resp.StatusCode)
+	}
+	admin := func(method, path string) *response {
+		req, _ := http.NewRequest(method, h.srv.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		return h.do(req)
+	}
+	var rep statsReport
+	if err := json.Unmarshal([]byte(admin(http.MethodGet, "/api/stats").body), &rep); err != nil {
+		t.Fatal(err)
+	}
+	w := rep.Windows[0]
+	if w.Orders != 1 || w.ActiveSessions != 1 {
+		t.Errorf("5m window = %+v, want 1 order for 1 session", w)
+	}
+	routes := make(map[string]int64)
+	for _, r := range w.Routes {
+		routes[r.Route] = r.Requests
+	}
+	if routes["GET /product/{id}"] != 1 || routes["POST /cart/checkout"] != 1 {
+		t.Errorf("routes = %v, want requests counted by route template", routes)
+	}
+	if resp := admin(http.MethodGet, "/admin/dashboard"); !strings.Contains(resp.body, `http-equiv="refresh"`) ||
+		!strings.Contains(resp.body, "GET /product/{id}") {
+		t.Error("dashboard does not show the routes or refresh itself")
+	}
+
+	if resp := h.post("/admin/stats/reset", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("reset without the admin token = %d, want 401", resp.StatusCode)
+	}
+	if resp := admin(http.MethodPost, "/admin/stats/reset"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("reset = %d, want 204", resp.StatusCode)
+	}
+	// Only the reset itself is counted afterwards.
+	if w := h.fe.stats.report().Windows[1]; w.Orders != 0 || w.Requests != 1 {
+		t.Errorf("after a reset, 1h window = %+v, want the reset request only", w)
+	}
+}
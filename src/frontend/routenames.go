@@ -0,0 +1,99 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+)
+
+// spanNameOverrides replaces the span names derived from the routes, for
+// the few routes deserving a more telling name.
+var spanNameOverrides = map[string]string{
+	"GET /_healthz": "health check",
+	"GET /_readyz":  "readiness check",
+}
+
+// routeSpanName names the server span of a request after the route it
+// matches, as "<method> <route template>", e.g. "GET /product/{id}", so that
+// names never contain IDs from the URL. Requests matching no route are
+// named "<method> [not found]" or "<method> [method not allowed]".
+func routeSpanName(router *mux.Router) func(*http.Request) string {
+	return func(r *http.Request) string {
+		var name string
+		var match mux.RouteMatch
+		switch {
+		case router.Match(r, &match) && match.MatchErr == nil && match.Route != nil:
+			tmpl, err := match.Route.GetPathTemplate()
+			if err != nil {
+				tmpl = "[unnamed route]"
+			}
+			name = r.Method + " " + tmpl
+		case match.MatchErr == mux.ErrMethodMismatch:
+			name = r.Method + " [method not allowed]"
+		default:
+			name = r.Method + " [not found]"
+		}
+		if n, ok := spanNameOverrides[name]; ok {
+			return n
+		}
+		return name
+	}
+}
+
+// tagRoute is a router middleware recording the matched route template on
+// the request metrics, and the name of the handler serving it and the
+// hashed session on the span.
+func tagRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				ochttp.SetRoute(r.Context(), tmpl)
+			}
+			trace.FromContext(r.Context()).AddAttributes(
+				trace.StringAttribute("http.handler", handlerName(route.GetHandler())),
+				trace.StringAttribute("session", hashSessionID(sessionID(r))))
+		}
+		if isSynthetic(r) {
+			trace.FromContext(r.Context()).AddAttributes(trace.BoolAttribute("synthetic", true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handlerName returns the name of the function behind a handler, e.g.
+// "productHandler".
+func handlerName(h http.Handler) string {
+	if d, ok := h.(*deprecatedHandler); ok {
+		h = d.next
+	}
+	f, ok := h.(http.HandlerFunc)
+	if !ok {
+		return fmt.Sprintf("%T", h)
+	}
+	name := runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+	name = strings.TrimSuffix(name, "-fm") // method values
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// spanRecorder is a trace exporter keeping the spans of one kind.
+type spanRecorder struct {
+	kind int
+
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (s *spanRecorder) ExportSpan(sd *trace.SpanData) {
+	if sd.SpanKind != s.kind {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spans = append(s.spans, sd)
+}
+
+// wait returns the span with the given trace ID, once it ended.
+func (s *spanRecorder) wait(t *testing.T, traceID string) *trace.SpanData {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		s.mu.Lock()
+		for _, sd := range s.spans {
+			if sd.TraceID.String() == traceID {
+				s.mu.Unlock()
+				return sd
+			}
+		}
+		s.mu.Unlock()
+	}
+	t.Fatalf("no span for trace %s", traceID)
+	return nil
+}
+
+func TestRouteSpanNames(t *testing.T) {
+	rec := &spanRecorder{kind: trace.SpanKindServer}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+	h := newTestHarness(t)
+	defer h.close()
+
+	for i, tc := range []struct {
+		method, path string
+		wantName     string
+		wantHandler  string
+	}{
+		{"GET", "/product/OLJCESPC7Z", "GET /product/{id}", "productHandler"},
+		{"GET", "/product/66VCHSJNUP", "GET /product/{id}", "productHandler"},
+		{"GET", "/category/vintage", "GET /category/{name}", "categoryHandler"},
+		{"GET", "/", "GET /", "homeHandler"},
+		{"POST", "/cart/empty", "POST /cart/empty", "emptyCartHandler"},
+		{"GET", "/api/status", "GET /api/status", "statusHandler"},
+		{"GET", "/static/img/products/typewriter.jpg", "GET /static/", ""},
+		{"GET", "/_healthz", "health check", ""},
+		{"GET", "/no/such/page/42", "GET [not found]", ""},
+		{"DELETE", "/product/OLJCESPC7Z", "DELETE [method not allowed]", ""},
+	} {
+		traceID := strings.Repeat("0", 30) + string('a'+rune(i/10)) + string('0'+rune(i%10))
+		req, _ := http.NewRequest(tc.method, h.srv.URL+tc.path, nil)
+		req.Header.Set("X-B3-TraceId", traceID)
+		req.Header.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+		req.Header.Set("X-B3-Sampled", "1")
+		req.Header.Set(csrfHeader, h.fe.csrfToken(h.session()))
+		h.do(req)
+
+		sd := rec.wait(t, traceID)
+		if sd.Name != tc.wantName {
+			t.Errorf("%s %s: span name = %q, want %q", tc.method, tc.path, sd.Name, tc.wantName)
+		}
+		for _, seg := range strings.Split(tc.path, "/") {
+			if len(seg) > 4 && strings.Contains(sd.Name, seg) && !strings.Contains(tc.wantName, seg) {
+				t.Errorf("%s %s: span name %q contains %q from the URL", tc.method, tc.path, sd.Name, seg)
+			}
+		}
+		if tc.wantHandler != "" && sd.Attributes["http.handler"] != tc.wantHandler {
+			t.Errorf("%s %s: handler tag = %v, want %q", tc.method, tc.path, sd.Attributes["http.handler"], tc.wantHandler)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// anyMethod stands for the routes matching every method.
+const anyMethod = "*"
+
+// routeTable registers routes on a router, checking them as it goes: mux
+// would silently let the first of two routes for the same method and path
+// template shadow the other, and only panic on the first request to a nil
+// handler. Problems are collected and reported together by err, so a
+// broken combination of features fails the boot with all of them.
+type routeTable struct {
+	router *mux.Router
+	seen   map[string]map[string]string // registrant by path template and method
+	errs   []string
+
+	publicPages map[string]bool                           // by path template
+	apiDocs     map[string]map[string]documentedOperation // by path template and method
+}
+
+func newRouteTable(r *mux.Router) *routeTable {
+	return &routeTable{
+		router:      r,
+		seen:        make(map[string]map[string]string),
+		publicPages: make(map[string]bool),
+		apiDocs:     make(map[string]map[string]documentedOperation),
+	}
+}
+
+// handleFunc registers f for the path template and methods, or for every
+// method if none is given.
+func (t *routeTable) handleFunc(path string, f http.HandlerFunc, methods ...string) {
+	var h http.Handler
+	if f != nil {
+		h = f
+	}
+	t.register(path, false, h, methods)
+}
+
+// handlePrefix registers h for every path starting with prefix.
+func (t *routeTable) handlePrefix(prefix string, h http.Handler) {
+	t.register(prefix, true, h, nil)
+}
+
+func (t *routeTable) register(path string, prefix bool, h http.Handler, methods []string) {
+	registrant := "<nil>"
+	if h != nil {
+		registrant = handlerName(h)
+	}
+	if _, file, line, ok := runtime.Caller(2); ok {
+		registrant += fmt.Sprintf(" (%s:%d)", filepath.Base(file), line)
+	}
+	if h == nil {
+		t.errs = append(t.errs, fmt.Sprintf("nil handler for %s registered at %s", path, registrant))
+		return
+	}
+	if !strings.HasPrefix(path, "/") {
+		t.errs = append(t.errs, fmt.Sprintf("path template %q of %s does not start with /", path, registrant))
+		return
+	}
+
+	key := path
+	if prefix {
+		key += "*"
+	}
+	if len(methods) == 0 {
+		methods = []string{anyMethod}
+	}
+	byMethod := t.seen[key]
+	if byMethod == nil {
+		byMethod = make(map[string]string)
+		t.seen[key] = byMethod
+	}
+	for _, m := range methods {
+		for other, by := range byMethod {
+			if other == m || other == anyMethod || m == anyMethod {
+				t.errs = append(t.errs, fmt.Sprintf("duplicate route %s %s: registered by %s and by %s", m, path, by, registrant))
+				return
+			}
+		}
+	}
+	for _, m := range methods {
+		byMethod[m] = registrant
+	}
+
+	var route *mux.Route
+	if prefix {
+		route = t.router.PathPrefix(path).Handler(h)
+	} else {
+		route = t.router.Handle(path, h)
+	}
+	if methods[0] != anyMethod {
+		route.Methods(methods...)
+	}
+	if err := route.GetError(); err != nil {
+		t.errs = append(t.errs, fmt.Sprintf("invalid path template %q of %s: %v", path, registrant, err))
+	}
+}
+
+// public marks the routes of the path templates as public pages, the same
+// for every session unless their rendering finds otherwise, which a CDN may
+// cache. They must already be registered for GET.
+func (t *routeTable) public(paths ...string) {
+	for _, path := range paths {
+		if _, ok := t.seen[path][http.MethodGet]; !ok {
+			t.errs = append(t.errs, fmt.Sprintf("public page %s is not registered for GET", path))
+			continue
+		}
+		t.publicPages[path] = true
+	}
+}
+
+// err returns the problems found while registering, if any.
+func (t *routeTable) err() error {
+	if len(t.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid routes:\n\t%s", strings.Join(t.errs, "\n\t"))
+}
+
+// selfCheckPaths returns the paths of the routes answering HEAD requests
+// without any variable in their path template.
+func selfCheckPaths(router *mux.Router) []string {
+	var paths []string
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || strings.Contains(tmpl, "{") {
+			return nil
+		}
+		if re, err := route.GetPathRegexp(); err != nil || !strings.HasSuffix(re, "$") {
+			return nil // a prefix
+		}
+		methods, err := route.GetMethods()
+		if err == nil && !contains(methods, http.MethodHead) {
+			return nil
+		}
+		paths = append(paths, tmpl)
+		return nil
+	})
+	return paths
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// selfCheck sends a HEAD request for each of paths to h in process, and
+// reports the ones answered with a server error or a panic, e.g. because of
+// a broken template or a missing dependency.
+func selfCheck(h http.Handler, paths []string) error {
+	var failed []string
+	for _, p := range paths {
+		status, panicked := selfCheckRequest(h, p)
+		switch {
+		case panicked != nil:
+			failed = append(failed, fmt.Sprintf("HEAD %s: panic: %v", p, panicked))
+		case status >= 500:
+			failed = append(failed, fmt.Sprintf("HEAD %s: %d %s", p, status, http.StatusText(status)))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("route self-check failed:\n\t%s", strings.Join(failed, "\n\t"))
+	}
+	return nil
+}
+
+func selfCheckRequest(h http.Handler, path string) (status int, panicked interface{}) {
+	defer func() { panicked = recover() }()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodHead, path, nil))
+	return w.Code, nil
+}
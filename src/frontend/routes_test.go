@@ -0,0 +1,130 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRouteTableDuplicates(t *testing.T) {
+	fe := &frontendServer{}
+	tests := []struct {
+		name     string
+		register func(*routeTable)
+		want     string // regexp of the error
+	}{
+		{"same method", func(t *routeTable) {
+			t.handleFunc("/cart", fe.viewCartHandler, http.MethodGet, http.MethodHead)
+			t.handleFunc("/cart", fe.homeHandler, http.MethodGet)
+		}, `duplicate route GET /cart: registered by viewCartHandler \(routes_test.go:\d+\) and by homeHandler \(routes_test.go:\d+\)`},
+		{"any method", func(t *routeTable) {
+			t.handleFunc("/cart", fe.addToCartHandler, http.MethodPost)
+			t.handleFunc("/cart", fe.homeHandler)
+		}, `duplicate route \* /cart: registered by addToCartHandler .* and by homeHandler`},
+		{"nil handler", func(t *routeTable) {
+			t.handleFunc("/cart", nil, http.MethodGet)
+		}, `nil handler for /cart registered at <nil> \(routes_test.go:\d+\)`},
+		{"invalid template", func(t *routeTable) {
+			t.handleFunc("/product/{id", fe.productHandler, http.MethodGet)
+		}, `invalid path template "/product/{id" of productHandler`},
+		{"relative template", func(t *routeTable) {
+			t.handleFunc("cart", fe.viewCartHandler, http.MethodGet)
+		}, `path template "cart" of viewCartHandler .* does not start with /`},
+		{"public without GET", func(t *routeTable) {
+			t.handleFunc("/cart", fe.addToCartHandler, http.MethodPost)
+			t.public("/cart")
+		}, `public page /cart is not registered for GET`},
+		{"documented without route", func(t *routeTable) {
+			t.handleFunc("/api/status", fe.statusHandler, http.MethodGet)
+			t.document("/api/status", http.MethodPost, apiOperation{})
+		}, `documented route POST /api/status is not registered`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newRouteTable(mux.NewRouter())
+			tt.register(rt)
+			err := rt.err()
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if !regexp.MustCompile(tt.want).MatchString(err.Error()) {
+				t.Errorf("error = %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteTableDistinctRoutes(t *testing.T) {
+	fe := &frontendServer{}
+	rt := newRouteTable(mux.NewRouter())
+	rt.handleFunc("/cart", fe.viewCartHandler, http.MethodGet, http.MethodHead)
+	rt.handleFunc("/cart", fe.addToCartHandler, http.MethodPost)
+	rt.handlePrefix("/cart", http.NotFoundHandler())
+	if err := rt.err(); err != nil {
+		t.Errorf("distinct routes rejected: %v", err)
+	}
+}
+
+func TestRouterFeatureCombinations(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.srv.Close()
+	// Every optional feature at once must not register conflicting routes.
+	h := newTestHarness(t, withAccounts, withOIDC(idp), func(fe *frontendServer) { fe.demoMode = true })
+	defer h.close()
+	if _, err := h.fe.router(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	router, err := h.fe.router()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := selfCheckPaths(router)
+	want := []string{"/", "/cart", "/orders", "/robots.txt", "/_healthz", "/_readyz"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("self-checked paths = %v, want %v", paths, want)
+	}
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	handler := h.fe.handler(log, router)
+	if err := selfCheck(handler, paths); err != nil {
+		t.Errorf("self-check of a working frontend: %v", err)
+	}
+
+	h.fail(listProductsMethod, status.Error(codes.Unavailable, "catalog down"))
+	if err := selfCheck(handler, paths); err == nil || !strings.Contains(err.Error(), "HEAD /: 503") {
+		t.Errorf("self-check with the catalog down = %v, want / failing", err)
+	}
+
+	broken := mux.NewRouter()
+	broken.HandleFunc("/boom", func(http.ResponseWriter, *http.Request) { panic("wired wrong") })
+	if err := selfCheck(broken, []string{"/boom"}); err == nil || !strings.Contains(err.Error(), "HEAD /boom: panic: wired wrong") {
+		t.Errorf("self-check of a panicking handler = %v", err)
+	}
+}
@@ -16,55 +16,109 @@ package main
 
 import (
 	"context"
-	"time"
+	"sync"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
 
 	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
 )
 
 const (
 	avoidNoopCurrencyConversionRPC = false
+
+	// defaultConversionConcurrency bounds the Convert calls made in
+	// parallel by convertAll, unless CONVERSION_CONCURRENCY says otherwise.
+	defaultConversionConcurrency = 8
 )
 
 func (fe *frontendServer) getCurrencies(ctx context.Context) ([]string, error) {
-	currs, err := pb.NewCurrencyServiceClient(fe.currencySvcConn).
-		GetSupportedCurrencies(ctx, &pb.Empty{})
+	v, err := fe.catalogCache.get(ctx, "currencies", func(ctx context.Context) (interface{}, error) {
+		ctx, cancel := fe.withRPCTimeout(ctx, "currency")
+		defer cancel()
+		currs, err := pb.NewCurrencyServiceClient(fe.currencySvcConn).
+			GetSupportedCurrencies(ctx, &pb.Empty{})
+		if err != nil {
+			return nil, err
+		}
+		var out []string
+		for _, c := range currs.CurrencyCodes {
+			if fe.currencies.allowed(c) {
+				out = append(out, c)
+			}
+		}
+		return out, nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	var out []string
-	for _, c := range currs.CurrencyCodes {
-		if _, ok := whitelistedCurrencies[c]; ok {
-			out = append(out, c)
-		}
-	}
-	return out, nil
+	return append([]string(nil), v.([]string)...), nil
 }
 
+// getProducts lists the products, from the catalog cache if there.
 func (fe *frontendServer) getProducts(ctx context.Context) ([]*pb.Product, error) {
+	v, err := fe.catalogCache.get(ctx, "products", func(ctx context.Context) (interface{}, error) {
+		return fe.listProducts(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]*pb.Product(nil), v.([]*pb.Product)...), nil
+}
+
+// listProducts lists the products from the catalog service, for the
+// callers that need the current listing.
+func (fe *frontendServer) listProducts(ctx context.Context) ([]*pb.Product, error) {
+	ctx, cancel := fe.withRPCTimeout(ctx, "productcatalog")
+	defer cancel()
 	resp, err := pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).
 		ListProducts(ctx, &pb.Empty{})
+	if err == nil {
+		fe.catalog.update(resp.GetProducts())
+	}
 	return resp.GetProducts(), err
 }
 
-func (fe *frontendServer) getProduct(ctx context.Context, id string) (*pb.Product, error) {
+// searchProducts returns the products of the catalog matching query. The
+// results are not cached, queries being too many.
+func (fe *frontendServer) searchProducts(ctx context.Context, query string) ([]*pb.Product, error) {
+	ctx, cancel := fe.withRPCTimeout(ctx, "productcatalog")
+	defer cancel()
 	resp, err := pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).
-		GetProduct(ctx, &pb.GetProductRequest{Id: id})
-	return resp, err
+		SearchProducts(ctx, &pb.SearchProductsRequest{Query: query})
+	return resp.GetResults(), err
+}
+
+func (fe *frontendServer) getProduct(ctx context.Context, id string) (*pb.Product, error) {
+	v, err := fe.catalogCache.get(ctx, "product/"+id, func(ctx context.Context) (interface{}, error) {
+		ctx, cancel := fe.withRPCTimeout(ctx, "productcatalog")
+		defer cancel()
+		return pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).
+			GetProduct(ctx, &pb.GetProductRequest{Id: id})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*pb.Product), nil
 }
 
 func (fe *frontendServer) getCart(ctx context.Context, userID string) ([]*pb.CartItem, error) {
+	ctx, cancel := fe.withRPCTimeout(ctx, "cart")
+	defer cancel()
 	resp, err := pb.NewCartServiceClient(fe.cartSvcConn).GetCart(ctx, &pb.GetCartRequest{UserId: userID})
 	return resp.GetItems(), err
 }
 
 func (fe *frontendServer) emptyCart(ctx context.Context, userID string) error {
+	ctx, cancel := fe.withRPCTimeout(ctx, "cart")
+	defer cancel()
 	_, err := pb.NewCartServiceClient(fe.cartSvcConn).EmptyCart(ctx, &pb.EmptyCartRequest{UserId: userID})
 	return err
 }
 
 func (fe *frontendServer) insertCart(ctx context.Context, userID, productID string, quantity int32) error {
+	ctx, cancel := fe.withRPCTimeout(ctx, "cart")
+	defer cancel()
 	_, err := pb.NewCartServiceClient(fe.cartSvcConn).AddItem(ctx, &pb.AddItemRequest{
 		UserId: userID,
 		Item: &pb.CartItem{
@@ -78,50 +132,182 @@ func (fe *frontendServer) convertCurrency(ctx context.Context, money *pb.Money,
 	if avoidNoopCurrencyConversionRPC && money.GetCurrencyCode() == currency {
 		return money, nil
 	}
-	return pb.NewCurrencyServiceClient(fe.currencySvcConn).
-		Convert(ctx, &pb.CurrencyConversionRequest{
-			From:   money,
-			ToCode: currency})
+	hit := true
+	defer func() { fe.stats.cacheLookup(statsCacheRates, hit) }()
+	return fe.rateSnapshot(ctx).convert(ctx, money, currency, func(ctx context.Context) (*pb.Money, error) {
+		hit = false
+		ctx, cancel := fe.withRPCTimeout(ctx, "currency")
+		defer cancel()
+		return pb.NewCurrencyServiceClient(fe.currencySvcConn).
+			Convert(ctx, &pb.CurrencyConversionRequest{
+				From:   money,
+				ToCode: currency})
+	})
+}
+
+// conversionResult is the outcome of converting one amount in convertAll.
+type conversionResult struct {
+	Money *pb.Money
+	Err   error
 }
 
-func (fe *frontendServer) getShippingQuote(ctx context.Context, items []*pb.CartItem, currency string) (*pb.Money, error) {
+// convertAll converts each amount to currency. The items are converted
+// independently, so a failure only affects its own result. Identical
+// amounts are converted once, and at most fe.conversionConcurrency
+// conversions are in flight at a time. Items not started before ctx is done
+// fail with the context error. The conversions of a page are tallied by
+// its pageConversions.
+func (fe *frontendServer) convertAll(ctx context.Context, amounts []*pb.Money, currency string) []conversionResult {
+	results := make([]conversionResult, len(amounts))
+	byAmount := make(map[string][]int)
+	var order []string
+	for i, m := range amounts {
+		k := m.String()
+		if _, ok := byAmount[k]; !ok {
+			order = append(order, k)
+		}
+		byAmount[k] = append(byAmount[k], i)
+	}
+
+	limit := fe.conversionConcurrency
+	if limit <= 0 {
+		limit = defaultConversionConcurrency
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+	for _, k := range order {
+		idx := byAmount[k]
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			for _, i := range idx {
+				results[i].Err = ctx.Err()
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(idx []int) {
+			defer func() { <-sem; wg.Done() }()
+			m, err := fe.convertCurrency(ctx, amounts[idx[0]], currency)
+			for _, i := range idx {
+				results[i] = conversionResult{Money: m, Err: err}
+			}
+		}(idx)
+	}
+	wg.Wait()
+	pageConversionsFrom(ctx).record(ctx, amounts, results, len(order))
+	return results
+}
+
+type ctxKeyPageConversions struct{}
+
+// pageConversions tallies the currency conversions made for a page, and
+// whether its prices fell back to USD.
+type pageConversions struct {
+	mu           sync.Mutex
+	converted    int64 // distinct amounts converted
+	deduplicated int64 // amounts identical to another of their batch
+	fellBack     bool
+}
+
+// withPageConversions makes the conversions made with ctx tallied on the
+// span of the page, and shown in USD when the currency service fails all
+// of them.
+func withPageConversions(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyPageConversions{}, new(pageConversions))
+}
+
+func pageConversionsFrom(ctx context.Context) *pageConversions {
+	p, _ := ctx.Value(ctxKeyPageConversions{}).(*pageConversions)
+	return p
+}
+
+// record counts a batch of convertAll. When every amount of the batch
+// failed, the prices are shown as they are, in USD, rather than not at all.
+func (p *pageConversions) record(ctx context.Context, amounts []*pb.Money, results []conversionResult, distinct int) {
+	if p == nil {
+		return
+	}
+	failed := 0
+	for _, res := range results {
+		if res.Err != nil {
+			failed++
+		}
+	}
+	fellBack := len(results) > 0 && failed == len(results)
+	if fellBack {
+		for i, m := range amounts {
+			results[i] = conversionResult{Money: m}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.converted += int64(distinct)
+	p.deduplicated += int64(len(amounts) - distinct)
+	p.fellBack = p.fellBack || fellBack
+	trace.FromContext(ctx).AddAttributes(
+		trace.Int64Attribute("currency.conversions", p.converted),
+		trace.Int64Attribute("currency.conversions_deduplicated", p.deduplicated))
+}
+
+// usdFallback reports whether prices of the page were shown in USD
+// because they could not be converted.
+func (p *pageConversions) usdFallback() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fellBack
+}
+
+// getShippingQuote quotes shipping the items to addr, or to anywhere when
+// addr is nil.
+func (fe *frontendServer) getShippingQuote(ctx context.Context, items []*pb.CartItem, addr *pb.Address) (*pb.Money, error) {
+	ctx, cancel := fe.withRPCTimeout(ctx, "shipping")
+	defer cancel()
 	quote, err := pb.NewShippingServiceClient(fe.shippingSvcConn).GetQuote(ctx,
 		&pb.GetQuoteRequest{
-			Address: nil,
+			Address: addr,
 			Items:   items})
-	if err != nil {
-		return nil, err
-	}
-	localized, err := fe.convertCurrency(ctx, quote.GetCostUsd(), currency)
-	return localized, errors.Wrap(err, "failed to convert currency for shipping cost")
+	return quote.GetCostUsd(), err
 }
 
 func (fe *frontendServer) getRecommendations(ctx context.Context, userID string, productIDs []string) ([]*pb.Product, error) {
-	resp, err := pb.NewRecommendationServiceClient(fe.recommendationSvcConn).ListRecommendations(ctx,
+	if err := fe.recommendationBreaker.allow(ctx); err != nil {
+		fe.degradation.observe(depRecommendations, err)
+		return nil, err
+	}
+	rctx, cancel := fe.withRPCTimeout(ctx, "recommendation")
+	resp, err := pb.NewRecommendationServiceClient(fe.recommendationSvcConn).ListRecommendations(rctx,
 		&pb.ListRecommendationsRequest{UserId: userID, ProductIds: productIDs})
+	cancel()
+	fe.degradation.observe(depRecommendations, err)
+	fe.recommendationBreaker.record(err)
 	if err != nil {
 		return nil, err
 	}
-	out := make([]*pb.Product, len(resp.GetProductIds()))
-	for i, v := range resp.GetProductIds() {
+	// Take only the first four live products to fit the UI.
+	ids := fe.liveRecommendations(ctx, resp.GetProductIds(), 4)
+	out := make([]*pb.Product, len(ids))
+	for i, v := range ids {
 		p, err := fe.getProduct(ctx, v)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to get recommended product info (#%s)", v)
 		}
 		out[i] = p
 	}
-	if len(out) > 4 {
-		out = out[:4] // take only first four to fit the UI
-	}
 	return out, err
 }
 
+// getAd is bounded by the ad client, configured with the ad timeout. The
+// outcome of its calls reaches the breaker through the ad client.
 func (fe *frontendServer) getAd(ctx context.Context, ctxKeys []string) ([]*pb.Ad, error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
-	defer cancel()
-
-	resp, err := pb.NewAdServiceClient(fe.adSvcConn).GetAds(ctx, &pb.AdRequest{
-		ContextKeys: ctxKeys,
-	})
-	return resp.GetAds(), errors.Wrap(err, "failed to get ads")
+	if err := fe.adBreaker.allow(ctx); err != nil {
+		fe.degradation.observe(depAds, err)
+		return nil, errors.Wrap(err, "failed to get ads")
+	}
+	ads, err := fe.ads.GetAds(ctx, ctxKeys)
+	return ads, errors.Wrap(err, "failed to get ads")
 }
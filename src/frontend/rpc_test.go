@@ -0,0 +1,183 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const convertMethod = "/hipstershop.CurrencyService/Convert"
+
+func TestConvertAllPartialFailure(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	// The fake currency service does not know XXX, so only that item fails.
+	amounts := []*pb.Money{
+		{CurrencyCode: "USD", Units: 10},
+		{CurrencyCode: "XXX", Units: 5},
+		{CurrencyCode: "USD", Units: 10},
+		{CurrencyCode: "USD", Units: 3, Nanos: 500000000},
+	}
+	results := h.fe.convertAll(context.Background(), amounts, "EUR")
+	if len(results) != len(amounts) {
+		t.Fatalf("got %d results, want %d", len(results), len(amounts))
+	}
+	for i, want := range []string{"EUR 9.00", "", "EUR 9.00", "EUR 3.15"} {
+		res := results[i]
+		if want == "" {
+			if res.Err == nil {
+				t.Errorf("item %d: no error for an unconvertible amount", i)
+			}
+			continue
+		}
+		if res.Err != nil {
+			t.Errorf("item %d: unexpected error %v", i, res.Err)
+			continue
+		}
+		if got := renderMoney(*res.Money); got != want {
+			t.Errorf("item %d = %s, want %s", i, got, want)
+		}
+	}
+	if got := h.faults.calls(convertMethod); got != 3 {
+		t.Errorf("made %d Convert calls, want 3 for the distinct amounts", got)
+	}
+}
+
+func TestConvertAllDeadline(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	amounts := make([]*pb.Money, 2*defaultConversionConcurrency)
+	for i := range amounts {
+		amounts[i] = &pb.Money{CurrencyCode: "USD", Units: int64(i + 1)}
+	}
+	for i, res := range h.fe.convertAll(ctx, amounts, "EUR") {
+		if res.Err == nil {
+			t.Errorf("item %d converted after the deadline", i)
+		}
+	}
+}
+
+func TestHomePriceUnavailable(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.catalog.products = append(append([]*pb.Product(nil), fakeProducts...), &pb.Product{
+		Id: "XXXXXXXXXX", Name: "Mystery Box", Picture: "/static/img/products/mystery.jpg",
+		PriceUsd: &pb.Money{CurrencyCode: "XXX", Units: 1}})
+
+	resp := h.get("/")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET / = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if !strings.Contains(resp.body, "Price unavailable") {
+		t.Error("home page does not mark the unconvertible price")
+	}
+	if !strings.Contains(resp.body, "USD 67.99") {
+		t.Error("home page does not show the other prices")
+	}
+}
+
+func TestConvertAllConcurrency(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) { fe.conversionConcurrency = 3 })
+	defer h.close()
+	h.delay(convertMethod, 20*time.Millisecond)
+
+	amounts := make([]*pb.Money, 12)
+	for i := range amounts {
+		amounts[i] = &pb.Money{CurrencyCode: "USD", Units: int64(i + 1)}
+	}
+	for i, res := range h.fe.convertAll(context.Background(), amounts, "EUR") {
+		if res.Err != nil {
+			t.Errorf("item %d: unexpected error %v", i, res.Err)
+		}
+	}
+	if got := h.faults.calls(convertMethod); got != len(amounts) {
+		t.Errorf("made %d Convert calls, want %d", got, len(amounts))
+	}
+	if got := h.faults.concurrency(convertMethod); got != 3 {
+		t.Errorf("at most %d Convert calls at once, want 3", got)
+	}
+}
+
+func TestPageConversionsSpan(t *testing.T) {
+	rec := &spanRecorder{kind: trace.SpanKindServer}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+	h := newTestHarness(t)
+	defer h.close()
+	// A second product at the typewriter's price is converted with it.
+	h.catalog.products = append(append([]*pb.Product(nil), fakeProducts...), &pb.Product{
+		Id: "TWINTWIN00", Name: "Twin Typewriter", Picture: "/static/img/products/typewriter.jpg",
+		PriceUsd: fakeProducts[0].GetPriceUsd()})
+
+	traceID := strings.Repeat("0", 30) + "c1"
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/", nil)
+	req.Header.Set("X-B3-TraceId", traceID)
+	req.Header.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+	req.Header.Set("X-B3-Sampled", "1")
+	if resp := h.do(req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET / = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	span := rec.wait(t, traceID)
+	if got, want := span.Attributes["currency.conversions"], int64(len(fakeProducts)); got != want {
+		t.Errorf("currency.conversions = %v, want %v", got, want)
+	}
+	if got := span.Attributes["currency.conversions_deduplicated"]; got != int64(1) {
+		t.Errorf("currency.conversions_deduplicated = %v, want 1", got)
+	}
+}
+
+func TestCurrencyFallback(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	// Failing before any price is converted to EUR, which the rate cache
+	// would keep.
+	h.fail(convertMethod, status.Error(codes.Unavailable, "injected failure"))
+	h.post("/setCurrency", url.Values{"currency_code": {"EUR"}})
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+
+	for _, path := range []string{"/", "/product/OLJCESPC7Z", "/cart"} {
+		resp := h.get(path)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s = %d, want %d", path, resp.StatusCode, http.StatusOK)
+			continue
+		}
+		if !strings.Contains(resp.body, `id="usd_fallback"`) {
+			t.Errorf("GET %s does not say prices are in USD", path)
+		}
+		if !strings.Contains(resp.body, "USD 67.99") {
+			t.Errorf("GET %s does not show the USD price", path)
+		}
+	}
+
+	h.fail(convertMethod, nil)
+	if resp := h.get("/"); strings.Contains(resp.body, `id="usd_fallback"`) {
+		t.Error("prices still shown in USD once the currency service is back")
+	}
+}
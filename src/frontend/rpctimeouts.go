@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// rpcTimeoutDefault is the key of the timeout of the backends without one
+// of their own.
+const rpcTimeoutDefault = "default"
+
+// rpcTimeouts bounds each call to a backend, by backend name as listed by
+// fe.backends(), so that a hung backend fails the call instead of holding
+// the request until the client gives up.
+type rpcTimeouts map[string]time.Duration
+
+// defaultRPCTimeouts are the timeouts used unless overridden by the
+// RPC_TIMEOUT_* environment variables.
+var defaultRPCTimeouts = rpcTimeouts{
+	rpcTimeoutDefault: time.Second,
+	"ad":              200 * time.Millisecond,
+	"recommendation":  500 * time.Millisecond,
+	"checkout":        5 * time.Second, // charges the card and sends the email
+}
+
+// of returns the timeout of the calls to backend.
+func (t rpcTimeouts) of(backend string) time.Duration {
+	if d, ok := t[backend]; ok {
+		return d
+	}
+	if d, ok := defaultRPCTimeouts[backend]; ok {
+		return d
+	}
+	if d, ok := t[rpcTimeoutDefault]; ok {
+		return d
+	}
+	return defaultRPCTimeouts[rpcTimeoutDefault]
+}
+
+// loadRPCTimeouts reads the timeouts overridden by RPC_TIMEOUT_DEFAULT and
+// RPC_TIMEOUT_<BACKEND>, e.g. RPC_TIMEOUT_AD.
+func loadRPCTimeouts(log logrus.FieldLogger, backends []backendInfo) rpcTimeouts {
+	t := make(rpcTimeouts)
+	names := []string{rpcTimeoutDefault}
+	for _, b := range backends {
+		names = append(names, b.Name)
+	}
+	for _, name := range names {
+		d := t.of(name)
+		mapDurationEnv(log, &d, "RPC_TIMEOUT_"+strings.ToUpper(name))
+		if d != t.of(name) {
+			t[name] = d
+		}
+	}
+	return t
+}
+
+// withRPCTimeout returns the context of a call to backend.
+func (fe *frontendServer) withRPCTimeout(ctx context.Context, backend string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, fe.rpcTimeouts.of(backend))
+}
+
+// rpcTimedOut reports whether err comes from a call that did not complete
+// within its deadline.
+func rpcTimedOut(err error) bool {
+	err = errors.Cause(err)
+	return err == context.DeadlineExceeded || status.Code(err) == codes.DeadlineExceeded
+}
+
+// degradeOptional logs the failure of an optional call, one the page is
+// rendered without, and tags it on the span.
+func degradeOptional(ctx context.Context, log logrus.FieldLogger, call string, err error) {
+	log.WithFields(logrus.Fields{
+		"event":     "call_degraded",
+		"call":      call,
+		"error":     err,
+		"timed_out": rpcTimedOut(err),
+	}).Warn("optional call failed, rendering without it")
+	span := trace.FromContext(ctx)
+	span.AddAttributes(trace.BoolAttribute("page.degraded", true))
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute("call", call),
+		trace.StringAttribute("error", err.Error()),
+		trace.BoolAttribute("timed_out", rpcTimedOut(err)),
+	}, "optional call failed")
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLoadRPCTimeouts(t *testing.T) {
+	os.Setenv("RPC_TIMEOUT_DEFAULT", "2s")
+	os.Setenv("RPC_TIMEOUT_AD", "50ms")
+	os.Setenv("RPC_TIMEOUT_CHECKOUT", "soon")
+	defer os.Unsetenv("RPC_TIMEOUT_DEFAULT")
+	defer os.Unsetenv("RPC_TIMEOUT_AD")
+	defer os.Unsetenv("RPC_TIMEOUT_CHECKOUT")
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	timeouts := loadRPCTimeouts(log, (&frontendServer{}).backends())
+	for backend, want := range map[string]time.Duration{
+		"cart":           2 * time.Second, // the default
+		"ad":             50 * time.Millisecond,
+		"checkout":       defaultRPCTimeouts["checkout"], // invalid, kept
+		"recommendation": defaultRPCTimeouts["recommendation"],
+	} {
+		if got := timeouts.of(backend); got != want {
+			t.Errorf("%s timeout = %v, want %v", backend, got, want)
+		}
+	}
+	if got, want := rpcTimeouts(nil).of("cart"), defaultRPCTimeouts[rpcTimeoutDefault]; got != want {
+		t.Errorf("cart timeout without overrides = %v, want %v", got, want)
+	}
+}
+
+func TestCriticalRPCTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	h := newTestHarness(t, func(fe *frontendServer) {
+		fe.rpcTimeouts = rpcTimeouts{rpcTimeoutDefault: timeout}
+	})
+	defer h.close()
+	h.delay("/hipstershop.CartService/GetCart", time.Second)
+
+	start := time.Now()
+	resp := h.get("/cart")
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Errorf("page took %v, the slow call was not cut short", d)
+	}
+	if !strings.Contains(resp.body, "Service temporarily unavailable") {
+		t.Error("timeout page does not say the service is unavailable")
+	}
+}
+
+func TestOptionalRPCTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	for _, tc := range []struct {
+		path, method, call string
+	}{
+		{"/cart", "/hipstershop.RecommendationService/ListRecommendations", "ListRecommendations"},
+		{"/", "/hipstershop.AdService/GetAds", "GetAds"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			h := newTestHarness(t, func(fe *frontendServer) {
+				fe.rpcTimeouts = rpcTimeouts{"recommendation": timeout, "ad": timeout}
+				fe.houseAd = nil
+			})
+			defer h.close()
+			h.delay(tc.method, time.Second)
+
+			start := time.Now()
+			resp := h.get(tc.path)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if d := time.Since(start); d >= time.Second {
+				t.Errorf("page took %v, the slow optional call was not cut short", d)
+			}
+			deadline := time.Now().Add(time.Second) // the ad is logged after the page is served
+			for len(h.logs.find("call_degraded")) == 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			entries := h.logs.find("call_degraded")
+			if len(entries) == 0 {
+				t.Fatal("no call_degraded event logged")
+			}
+			if e := entries[0]; e.Data["call"] != tc.call || e.Data["timed_out"] != true {
+				t.Errorf("call_degraded = %v, want call %s timed out", e.Data, tc.call)
+			}
+		})
+	}
+}
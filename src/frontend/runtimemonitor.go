@@ -0,0 +1,262 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+const (
+	defaultRuntimeSampleInterval = 15 * time.Second
+	defaultMaxGoroutines         = 10000
+	defaultMaxHeapInUseMB        = 512
+	defaultMaxQueueDepth         = 1000
+)
+
+var (
+	runtimeComponentKey, _ = tag.NewKey("component")
+
+	goroutineCount = stats.Int64("frontend/runtime/goroutines",
+		"Goroutines of the frontend", stats.UnitDimensionless)
+	heapInUse = stats.Int64("frontend/runtime/heap_inuse",
+		"Bytes in in-use heap spans", stats.UnitBytes)
+	queueDepth = stats.Int64("frontend/runtime/queue_depth",
+		"Items held by a background component", stats.UnitDimensionless)
+
+	goroutineCountView = &view.View{
+		Name:        "frontend/runtime/goroutines",
+		Measure:     goroutineCount,
+		Description: goroutineCount.Description(),
+		Aggregation: view.LastValue(),
+	}
+	heapInUseView = &view.View{
+		Name:        "frontend/runtime/heap_inuse",
+		Measure:     heapInUse,
+		Description: heapInUse.Description(),
+		Aggregation: view.LastValue(),
+	}
+	queueDepthView = &view.View{
+		Name:        "frontend/runtime/queue_depth",
+		Measure:     queueDepth,
+		Description: queueDepth.Description(),
+		TagKeys:     []tag.Key{runtimeComponentKey},
+		Aggregation: view.LastValue(),
+	}
+)
+
+// runtimeLimits are the values past which the monitor reports a leak.
+type runtimeLimits struct {
+	Goroutines int    `json:"goroutines"`
+	HeapInUse  uint64 `json:"heap_inuse_bytes"`
+	QueueDepth int    `json:"queue_depth"` // of every component
+}
+
+// runtimeSample is what the monitor measured once.
+type runtimeSample struct {
+	Goroutines int            `json:"goroutines"`
+	HeapInUse  uint64         `json:"heap_inuse_bytes"`
+	Queues     map[string]int `json:"queues"`   // depth by component
+	Exceeded   []string       `json:"exceeded"` // the goroutines, heap_inuse or queue:<component> over their limit
+}
+
+// runtimeMonitor samples the goroutines, the heap and the depth of the
+// queues and caches of the background components, to catch leaks before
+// they exhaust the frontend. Components plug in with register. A nil
+// *runtimeMonitor monitors nothing.
+type runtimeMonitor struct {
+	limits runtimeLimits
+
+	mu     sync.Mutex
+	depths map[string]func() int // by component
+	over   map[string]bool       // limits exceeded at the last sample
+}
+
+func newRuntimeMonitor(limits runtimeLimits) *runtimeMonitor {
+	return &runtimeMonitor{limits: limits, depths: make(map[string]func() int), over: make(map[string]bool)}
+}
+
+// register adds a component whose depth is sampled along with the runtime,
+// replacing a component of the same name. depth must be cheap and safe to
+// call from any goroutine.
+func (m *runtimeMonitor) register(component string, depth func() int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.depths[component] = depth
+}
+
+// sample measures once, records the metrics, and logs the limits newly
+// exceeded, and those no longer exceeded.
+func (m *runtimeMonitor) sample(ctx context.Context, log logrus.FieldLogger) runtimeSample {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	s := runtimeSample{Goroutines: runtime.NumGoroutine(), HeapInUse: mem.HeapInuse, Queues: make(map[string]int)}
+	stats.Record(ctx, goroutineCount.M(int64(s.Goroutines)), heapInUse.M(int64(s.HeapInUse)))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	exceeded := map[string]bool{
+		"goroutines": m.limits.Goroutines > 0 && s.Goroutines > m.limits.Goroutines,
+		"heap_inuse": m.limits.HeapInUse > 0 && s.HeapInUse > m.limits.HeapInUse,
+	}
+	values := map[string]interface{}{"goroutines": s.Goroutines, "heap_inuse": s.HeapInUse}
+	limits := map[string]interface{}{"goroutines": m.limits.Goroutines, "heap_inuse": m.limits.HeapInUse}
+	for name, depth := range m.depths {
+		d := depth()
+		s.Queues[name] = d
+		if ctx, err := tag.New(ctx, tag.Upsert(runtimeComponentKey, name)); err == nil {
+			stats.Record(ctx, queueDepth.M(int64(d)))
+		}
+		key := "queue:" + name
+		exceeded[key] = m.limits.QueueDepth > 0 && d > m.limits.QueueDepth
+		values[key], limits[key] = d, m.limits.QueueDepth
+	}
+
+	for key, over := range exceeded {
+		if over {
+			s.Exceeded = append(s.Exceeded, key)
+		}
+		switch {
+		case over && !m.over[key]:
+			log.WithFields(logrus.Fields{
+				"event": "runtime_limit_exceeded",
+				"limit": key,
+				"value": values[key],
+				"max":   limits[key],
+			}).Warn("runtime limit exceeded, something may be leaking")
+		case !over && m.over[key]:
+			log.WithFields(logrus.Fields{
+				"event": "runtime_limit_recovered",
+				"limit": key,
+				"value": values[key],
+			}).Info("runtime back under its limit")
+		}
+	}
+	sort.Strings(s.Exceeded)
+	m.over = exceeded
+	return s
+}
+
+// run samples every interval until ctx is done.
+func (m *runtimeMonitor) run(ctx context.Context, log logrus.FieldLogger, clock clock, interval time.Duration) {
+	for {
+		t := clock.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C():
+		}
+		m.sample(ctx, log)
+	}
+}
+
+// goroutineGroup is the goroutines started by one function.
+type goroutineGroup struct {
+	Creator string         `json:"creator"` // "" for the goroutines started by the runtime
+	Count   int            `json:"count"`
+	States  map[string]int `json:"states"` // e.g. "chan receive", "IO wait"
+}
+
+// goroutineGroups summarizes a goroutine profile printed with debug=2,
+// grouping the goroutines by the function that started them, largest
+// group first.
+func goroutineGroups(profile []byte) []goroutineGroup {
+	byCreator := make(map[string]*goroutineGroup)
+	var state string
+	sc := bufio.NewScanner(bytes.NewReader(profile))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	flush := func(creator string) {
+		if state == "" {
+			return
+		}
+		g := byCreator[creator]
+		if g == nil {
+			g = &goroutineGroup{Creator: creator, States: make(map[string]int)}
+			byCreator[creator] = g
+		}
+		g.Count++
+		g.States[state]++
+		state = ""
+	}
+	var creator string
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "goroutine "):
+			flush(creator)
+			creator = ""
+			if i, j := strings.Index(line, "["), strings.LastIndex(line, "]"); i >= 0 && j > i {
+				state = strings.SplitN(line[i+1:j], ",", 2)[0]
+			}
+		case strings.HasPrefix(line, "created by "):
+			creator = strings.TrimPrefix(line, "created by ")
+			if i := strings.Index(creator, " in goroutine "); i >= 0 {
+				creator = creator[:i]
+			}
+		}
+	}
+	flush(creator)
+
+	groups := make([]goroutineGroup, 0, len(byCreator))
+	for _, g := range byCreator {
+		groups = append(groups, *g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].Creator < groups[j].Creator
+	})
+	return groups
+}
+
+// goroutinesHandler serves a sample of the runtime along with the
+// goroutines grouped by the function that started them.
+func (fe *frontendServer) goroutinesHandler(w http.ResponseWriter, r *http.Request) {
+	if !fe.demoMode && !fe.debugEnabled(r) {
+		http.NotFound(w, r) // before taking the profile
+		return
+	}
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	var profile bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&profile, 2)
+	resp := struct {
+		runtimeSample
+		Limits runtimeLimits    `json:"limits"`
+		Groups []goroutineGroup `json:"groups"`
+	}{Groups: goroutineGroups(profile.Bytes())}
+	if fe.monitor != nil {
+		resp.runtimeSample = fe.monitor.sample(r.Context(), log)
+		resp.Limits = fe.monitor.limits
+	}
+	fe.serveDebugJSON(w, r, resp)
+}
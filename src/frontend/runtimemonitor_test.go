@@ -0,0 +1,169 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// leakyWorker starts a goroutine per job and never lets any of them finish
+// until stopped, while its backlog grows without bound.
+type leakyWorker struct {
+	mu      sync.Mutex
+	backlog []int
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func (l *leakyWorker) depth() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.backlog)
+}
+
+func (l *leakyWorker) add(n int) {
+	for i := 0; i < n; i++ {
+		l.mu.Lock()
+		l.backlog = append(l.backlog, i)
+		l.mu.Unlock()
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			<-l.stop
+		}()
+	}
+}
+
+func TestRuntimeMonitorFlagsLeak(t *testing.T) {
+	logs := &logCapture{}
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.AddHook(logs)
+
+	m := newRuntimeMonitor(runtimeLimits{Goroutines: runtime.NumGoroutine() + 100, QueueDepth: 100})
+	leak := &leakyWorker{stop: make(chan struct{})}
+	m.register("leaky", leak.depth)
+
+	if s := m.sample(context.Background(), log); len(s.Exceeded) != 0 {
+		t.Fatalf("limits exceeded before the leak: %v", s.Exceeded)
+	}
+	leak.add(200)
+	s := m.sample(context.Background(), log)
+	if want := []string{"goroutines", "queue:leaky"}; !reflect.DeepEqual(s.Exceeded, want) {
+		t.Errorf("exceeded = %v, want %v", s.Exceeded, want)
+	}
+	if s.Queues["leaky"] != 200 {
+		t.Errorf("depth of the leaky component = %d, want 200", s.Queues["leaky"])
+	}
+	m.sample(context.Background(), log)
+	if got := len(logs.find("runtime_limit_exceeded")); got != 2 {
+		t.Errorf("logged %d exceeded limits, want each of the 2 once", got)
+	}
+
+	close(leak.stop)
+	leak.wg.Wait()
+	leak.mu.Lock()
+	leak.backlog = nil
+	leak.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(m.sample(context.Background(), log).Exceeded) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := len(logs.find("runtime_limit_recovered")); got != 2 {
+		t.Errorf("logged %d recovered limits, want 2", got)
+	}
+}
+
+func TestRuntimeMonitorNil(t *testing.T) {
+	var m *runtimeMonitor
+	m.register("cart_undo", func() int { return 0 }) // must not panic
+}
+
+func TestGoroutineGroups(t *testing.T) {
+	profile := []byte(`goroutine 1 [running]:
+main.main()
+	/src/main.go:10 +0x20
+
+goroutine 7 [chan receive, 5 minutes]:
+main.(*shadowMirror).work(0xc000010000)
+	/src/mirror.go:190 +0x40
+created by main.newShadowMirror in goroutine 1
+	/src/mirror.go:130 +0x100
+
+goroutine 8 [chan receive]:
+main.(*shadowMirror).work(0xc000010000)
+	/src/mirror.go:190 +0x40
+created by main.newShadowMirror
+	/src/mirror.go:130 +0x100
+
+goroutine 9 [select]:
+main.(*frontendServer).watchCatalog(0xc000020000)
+	/src/catalogwatch.go:50 +0x40
+created by main.main
+	/src/main.go:435 +0x100
+`)
+	want := []goroutineGroup{
+		{Creator: "main.newShadowMirror", Count: 2, States: map[string]int{"chan receive": 2}},
+		{Creator: "", Count: 1, States: map[string]int{"running": 1}},
+		{Creator: "main.main", Count: 1, States: map[string]int{"select": 1}},
+	}
+	if got := goroutineGroups(profile); !reflect.DeepEqual(got, want) {
+		t.Errorf("groups = %+v, want %+v", got, want)
+	}
+}
+
+func TestGoroutinesEndpoint(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	if resp := h.get("/debug/goroutines"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /debug/goroutines without debugging = %d, want 404", resp.StatusCode)
+	}
+
+	h = newTestHarness(t, func(fe *frontendServer) {
+		fe.demoMode = true
+		fe.monitor = newRuntimeMonitor(runtimeLimits{})
+		fe.monitor.register("cart_undo", fe.undo.snapshots.Len)
+	})
+	defer h.close()
+	resp := h.get("/debug/goroutines")
+	var got struct {
+		Goroutines int            `json:"goroutines"`
+		Queues     map[string]int `json:"queues"`
+		Groups     []goroutineGroup
+	}
+	if err := json.Unmarshal([]byte(resp.body), &got); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for _, g := range got.Groups {
+		n += g.Count
+	}
+	if got.Goroutines == 0 || n == 0 || len(got.Groups) < 2 {
+		t.Errorf("goroutines = %d in %d groups", got.Goroutines, len(got.Groups))
+	}
+	if _, ok := got.Queues["cart_undo"]; !ok {
+		t.Errorf("queues = %v, want the registered component", got.Queues)
+	}
+}
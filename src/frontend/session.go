@@ -0,0 +1,441 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/cache"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// cartMaxLines bounds the lines of a cart built by merging another cart
+// into it; the quantity of each is bounded by CART_MAX_QUANTITY.
+const cartMaxLines = 50
+
+// maxMigratedSessions bounds the old session IDs remembered as migrated.
+const maxMigratedSessions = 10000
+
+// sessionKeys signs session cookies. Cookies signed with the previous key
+// are recognized after a key rotation, so that their cart can be migrated.
+type sessionKeys struct {
+	current  []byte
+	previous []byte
+}
+
+// cookieStatus is the outcome of verifying a session cookie.
+type cookieStatus int
+
+const (
+	cookieValid     cookieStatus = iota
+	cookieRotated                // signed with the previous key
+	cookieBadSig                 // well-formed, but signed with neither key
+	cookieMalformed              // not a signed session ID at all
+)
+
+func (k *sessionKeys) mac(key []byte, id string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(id))
+	return h.Sum(nil)
+}
+
+// sign returns the cookie value for a session ID, "<id>.<signature>".
+func (k *sessionKeys) sign(id string) string {
+	return id + "." + base64.RawURLEncoding.EncodeToString(k.mac(k.current, id))
+}
+
+// verify checks a cookie value and returns the session ID it carries. The ID
+// is only meaningful when the status is not cookieMalformed.
+func (k *sessionKeys) verify(value string) (string, cookieStatus) {
+	i := strings.IndexByte(value, '.')
+	if i < 0 {
+		return "", cookieMalformed
+	}
+	id := value[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil || len(sig) != sha256.Size {
+		return "", cookieMalformed
+	}
+	if u, err := uuid.Parse(id); err != nil || u.String() != id {
+		return "", cookieMalformed
+	}
+	switch {
+	case hmac.Equal(sig, k.mac(k.current, id)):
+		return id, cookieValid
+	case k.previous != nil && hmac.Equal(sig, k.mac(k.previous, id)):
+		return id, cookieRotated
+	}
+	return id, cookieBadSig
+}
+
+// maxRevokedSessions bounds the session IDs remembered as logged out.
+const maxRevokedSessions = 10000
+
+// maxTrackedSessions bounds the sessions tracked for the cart reaper.
+const maxTrackedSessions = 100000
+
+// sessionManager issues and checks session cookies. It signs them when it
+// has keys, sets their attributes, and, when revocation is on, remembers
+// the IDs of logged out sessions for the cookie's lifetime so that a copy
+// of the cookie no longer resumes them. Revocation is per replica.
+//
+// Its methods accept a nil *sessionManager, which issues unsigned cookies
+// with the default attributes and revokes nothing.
+type sessionManager struct {
+	keys *sessionKeys // nil leaves cookies unsigned
+	// acceptUnsigned re-issues, signed, the unsigned cookies of replicas
+	// that predate the keys instead of starting a new session.
+	acceptUnsigned bool
+	maxAge         time.Duration
+	secure         bool
+	sameSite       http.SameSite
+	revoked        *cache.Cache  // by session ID; nil unless revocation is on
+	seen           *sessionsSeen // nil unless the cart reaper is on
+}
+
+// parseSameSite maps SESSION_COOKIE_SAMESITE to a cookie attribute; "" leaves
+// the attribute out. SameSite=None needs a newer Go than the image's 1.12.
+func parseSameSite(s string) (http.SameSite, bool) {
+	switch strings.ToLower(s) {
+	case "":
+		return 0, true
+	case "lax":
+		return http.SameSiteLaxMode, true
+	case "strict":
+		return http.SameSiteStrictMode, true
+	}
+	return 0, false
+}
+
+// check returns the session ID carried by a cookie value, or "" when a new
+// session must start. old is the ID of a cookie signed with the previous
+// key, and reissue is set when the cookie must be set again.
+func (m *sessionManager) check(log logrus.FieldLogger, value string) (id, old string, reissue bool) {
+	if m == nil {
+		return value, "", false
+	}
+	if m.keys == nil {
+		id = value
+	} else {
+		sid, st := m.keys.verify(value)
+		switch st {
+		case cookieValid:
+			id = sid
+		case cookieRotated:
+			old = sid
+		case cookieBadSig:
+			log.WithField("session", hashSessionID(sid)).Warn("session cookie with an invalid signature")
+		case cookieMalformed:
+			if u, err := uuid.Parse(value); m.acceptUnsigned && err == nil && u.String() == value {
+				log.WithFields(logrus.Fields{
+					"event":   "session_cookie_signed",
+					"session": hashSessionID(value),
+				}).Info("signed an unsigned session cookie")
+				id, reissue = value, true
+			}
+		}
+	}
+	if m.isRevoked(id) || m.isRevoked(old) {
+		log.WithField("session", hashSessionID(id+old)).Debug("session cookie of a logged out session")
+		return "", "", false
+	}
+	return id, old, reissue
+}
+
+func (m *sessionManager) isRevoked(id string) bool {
+	if m == nil || m.revoked == nil || id == "" {
+		return false
+	}
+	_, ok := m.revoked.Get(id)
+	return ok
+}
+
+// cookie returns the session cookie to set for a session ID.
+func (m *sessionManager) cookie(id string) *http.Cookie {
+	if m != nil && m.keys != nil {
+		id = m.keys.sign(id)
+	}
+	return m.newCookie(cookieSessionID, id)
+}
+
+// newCookie returns a cookie with the attributes of the session cookie:
+// its path, lifetime, Secure and SameSite.
+func (m *sessionManager) newCookie(name, value string) *http.Cookie {
+	c := &http.Cookie{Name: name, Value: value, Path: "/", MaxAge: cookieMaxAge}
+	if m == nil {
+		return c
+	}
+	c.MaxAge = int(m.maxAge / time.Second)
+	c.Secure = m.secure
+	c.SameSite = m.sameSite
+	return c
+}
+
+// revoke ends a session on logout, when revocation is on.
+func (m *sessionManager) revoke(id string) {
+	if m == nil || m.revoked == nil || id == "" {
+		return
+	}
+	m.revoked.Set(id, struct{}{}, m.maxAge)
+}
+
+// sessionsSeen is when each session was last active on this replica, for
+// the cart reaper. Sessions stay in it until reaped, so it holds those
+// active within the cart TTL, up to max of them.
+type sessionsSeen struct {
+	max int
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newSessionsSeen(max int) *sessionsSeen {
+	return &sessionsSeen{max: max, last: make(map[string]time.Time)}
+}
+
+// set records that id was last active at t. When full, an arbitrary
+// session is dropped, as the caches do: its cart is left to the replicas
+// it is active on, or to the cart service.
+func (s *sessionsSeen) set(id string, t time.Time) {
+	if _, ok := s.last[id]; !ok && len(s.last) >= s.max {
+		for old := range s.last {
+			delete(s.last, old)
+			break
+		}
+	}
+	s.last[id] = t
+}
+
+// untrackedPath tells the requests that do not count as session activity:
+// the probes and the static files.
+func untrackedPath(path string) bool {
+	return strings.HasPrefix(path, "/_") || strings.HasPrefix(path, "/static/")
+}
+
+// touch records that a session is active at t.
+func (m *sessionManager) touch(id string, t time.Time) {
+	if m == nil || m.seen == nil || id == "" {
+		return
+	}
+	m.seen.mu.Lock()
+	defer m.seen.mu.Unlock()
+	m.seen.set(id, t)
+}
+
+// idle returns the sessions last active before t, and the number of
+// sessions tracked.
+func (m *sessionManager) idle(t time.Time) (ids []string, tracked int) {
+	if m == nil || m.seen == nil {
+		return nil, 0
+	}
+	m.seen.mu.Lock()
+	defer m.seen.mu.Unlock()
+	for id, last := range m.seen.last {
+		if last.Before(t) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, len(m.seen.last)
+}
+
+// forget drops a session last active before t, and returns when that was;
+// a session active since is kept.
+func (m *sessionManager) forget(id string, t time.Time) (time.Time, bool) {
+	if m == nil || m.seen == nil {
+		return time.Time{}, false
+	}
+	m.seen.mu.Lock()
+	defer m.seen.mu.Unlock()
+	last, ok := m.seen.last[id]
+	if !ok || !last.Before(t) {
+		return time.Time{}, false
+	}
+	delete(m.seen.last, id)
+	return last, true
+}
+
+// restore tracks again a session forgotten as last active at last, unless
+// it has been active since.
+func (m *sessionManager) restore(id string, last time.Time) {
+	if m == nil || m.seen == nil {
+		return
+	}
+	m.seen.mu.Lock()
+	defer m.seen.mu.Unlock()
+	if _, ok := m.seen.last[id]; !ok {
+		m.seen.set(id, last)
+	}
+}
+
+// tracked returns the number of sessions tracked.
+func (m *sessionManager) tracked() int {
+	if m == nil || m.seen == nil {
+		return 0
+	}
+	m.seen.mu.Lock()
+	defer m.seen.mu.Unlock()
+	return len(m.seen.last)
+}
+
+// sessionHashLen is the length of a hashed identifier, in hex characters.
+const sessionHashLen = 12
+
+// sessionHashKey keys hashSessionID. SESSION_HASH_KEY sets it, so that all
+// the replicas give an identifier the same hash.
+var sessionHashKey []byte
+
+// hashSessionID identifies a session, or another identifier of a shopper,
+// wherever it leaves the cookie layer: logs, spans, metrics, exports and
+// pages. The hash is one-way; matchSessionHashHandler can only confirm it
+// for a given ID. It is empty for an empty ID.
+func hashSessionID(id string) string {
+	if id == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, sessionHashKey)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))[:sessionHashLen]
+}
+
+// matchSessionHashHandler lets support confirm that a session ID, read from
+// a shopper's cookie, matches a hash found in the logs.
+func (fe *frontendServer) matchSessionHashHandler(w http.ResponseWriter, r *http.Request) {
+	if !fe.isAdmin(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	id, hash := r.FormValue("session_id"), strings.ToLower(r.FormValue("hash"))
+	if id == "" || hash == "" {
+		http.Error(w, "session_id and hash are required", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{
+		"match": hmac.Equal([]byte(hashSessionID(id)), []byte(hash)),
+	})
+}
+
+// cartMigrations remembers the old sessions whose cart was migrated, so
+// that a client presenting an old cookie again, or many times at once,
+// causes cart calls once. A nil *cartMigrations disables cart migration.
+type cartMigrations struct {
+	mu   sync.Mutex
+	done *cache.Cache // by old session ID
+}
+
+func newCartMigrations() *cartMigrations {
+	return &cartMigrations{done: cache.New(maxMigratedSessions)}
+}
+
+// begin reports whether the cart of the old session is to be migrated by
+// the caller, remembering it for ttl, the lifetime of its cookie.
+func (m *cartMigrations) begin(old string, ttl time.Duration) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.done.Get(old); ok {
+		return false
+	}
+	m.done.Set(old, struct{}{}, ttl)
+	return true
+}
+
+// forget lets the cart of the old session be migrated again, after a
+// migration that failed.
+func (m *cartMigrations) forget(old string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.done.Take(old)
+}
+
+// migrateCart merges the cart of a session signed with the previous key
+// into the cart of the session replacing it.
+func (fe *frontendServer) migrateCart(ctx context.Context, log logrus.FieldLogger, from, to string) error {
+	moved, dropped, err := fe.mergeCart(ctx, from, to)
+	if err != nil || moved+dropped == 0 {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		"event":       "session_cart_migrated",
+		"old_session": hashSessionID(from),
+		"new_session": hashSessionID(to),
+		"moved":       moved,
+		"dropped":     dropped,
+	}).Info("migrated the cart of a rotated session")
+	return nil
+}
+
+// mergeCart merges the cart of user from into the cart of user to, then
+// empties it, and returns the number of cart lines moved and dropped.
+// Quantities of a product in both carts add up, bounded by
+// fe.cartMaxQuantity; products beyond cartMaxLines are dropped.
+func (fe *frontendServer) mergeCart(ctx context.Context, from, to string) (moved, dropped int, err error) {
+	old, err := fe.getCart(ctx, from)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to read the old cart")
+	}
+	if len(old) == 0 {
+		return 0, 0, nil
+	}
+	cur, err := fe.getCart(ctx, to)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to read the new cart")
+	}
+	quantities := make(map[string]int32, len(cur))
+	for _, it := range cur {
+		quantities[it.GetProductId()] = it.GetQuantity()
+	}
+
+	for _, it := range old {
+		have, ok := quantities[it.GetProductId()]
+		if !ok && len(quantities) >= cartMaxLines {
+			dropped++
+			continue
+		}
+		add := it.GetQuantity()
+		if max := int32(fe.cartMaxQuantity); have+add > max {
+			add = max - have
+		}
+		if add <= 0 {
+			dropped++
+			continue
+		}
+		if err := fe.insertCart(ctx, to, it.GetProductId(), add); err != nil {
+			return moved, dropped, errors.Wrapf(err, "failed to move product #%s", it.GetProductId())
+		}
+		quantities[it.GetProductId()] = have + add
+		moved++
+	}
+	if err := fe.emptyCart(ctx, from); err != nil {
+		return moved, dropped, errors.Wrap(err, "failed to empty the old cart")
+	}
+	return moved, dropped, nil
+}
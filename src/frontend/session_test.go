@@ -0,0 +1,413 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/cache"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	getCartMethod = "/hipstershop.CartService/GetCart"
+	oldSession    = "2d7b1f0e-6c1a-4a8e-9f3b-2f1a5c0e7d11"
+	otherSession  = "9a0c6e2b-3d4f-4b1a-8e7c-5f6d7a8b9c0d"
+)
+
+// withRotatedSessionKeys signs sessions with a new key, the previous one
+// being "old key".
+func withRotatedSessionKeys(migrate bool) func(*frontendServer) {
+	return func(fe *frontendServer) {
+		fe.sessions = &sessionManager{
+			keys:   &sessionKeys{current: []byte("new key"), previous: []byte("old key")},
+			maxAge: cookieMaxAge * time.Second,
+		}
+		if migrate {
+			fe.cartMigration = newCartMigrations()
+		}
+	}
+}
+
+func (h *testHarness) setSessionCookie(value string) {
+	u, _ := url.Parse(h.srv.URL)
+	h.client.Jar.SetCookies(u, []*http.Cookie{{Name: cookieSessionID, Value: value, Path: "/"}})
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	for _, migrate := range []bool{false, true} {
+		h := newTestHarness(t, withRotatedSessionKeys(migrate))
+		h.cart.carts[oldSession] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+		old := &sessionKeys{current: []byte("old key")}
+		h.setSessionCookie(old.sign(oldSession))
+
+		resp := h.get("/cart")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /cart = %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+		id, st := h.fe.sessions.keys.verify(h.cookie(cookieSessionID))
+		if st != cookieValid || id == oldSession {
+			t.Errorf("migrate=%v: session cookie not replaced after the key rotation", migrate)
+		}
+		if got := len(h.cart.carts[id]) == 1; got != migrate {
+			t.Errorf("migrate=%v: old cart moved to the new session = %v", migrate, got)
+		}
+		if entries := h.logs.find("session_cart_migrated"); migrate {
+			if len(entries) != 1 {
+				t.Fatalf("got %d migration log entries, want 1", len(entries))
+			}
+			e := entries[0]
+			if e.Data["old_session"] != hashSessionID(oldSession) || e.Data["new_session"] != hashSessionID(id) {
+				t.Errorf("migration logged as %v", e.Data)
+			}
+			if strings.Contains(e.Message, oldSession) || e.Data["old_session"] == oldSession {
+				t.Error("migration log reveals the old session ID")
+			}
+			if len(h.cart.carts[oldSession]) != 0 {
+				t.Error("old cart not emptied after the migration")
+			}
+		} else if len(entries) != 0 {
+			t.Errorf("migrate=%v: cart migrated", migrate)
+		}
+		h.close()
+	}
+}
+
+func TestSessionCartMigratedOnce(t *testing.T) {
+	h := newTestHarness(t, withRotatedSessionKeys(true))
+	defer h.close()
+	h.cart.carts[oldSession] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	cookie := (&sessionKeys{current: []byte("old key")}).sign(oldSession)
+
+	h.setSessionCookie(cookie)
+	h.get("/robots.txt")
+	calls := h.faults.calls(getCartMethod)
+	if calls == 0 {
+		t.Fatal("cart not migrated")
+	}
+	// The old cookie presented again, as by a client replaying it.
+	for i := 0; i < 3; i++ {
+		h.setSessionCookie(cookie)
+		h.get("/robots.txt")
+	}
+	if n := h.faults.calls(getCartMethod); n != calls {
+		t.Errorf("made %d more GetCart calls for a migrated session", n-calls)
+	}
+	if entries := h.logs.find("session_cart_migrated"); len(entries) != 1 {
+		t.Errorf("got %d migration log entries, want 1", len(entries))
+	}
+}
+
+func TestSessionCartMigrationRetried(t *testing.T) {
+	h := newTestHarness(t, withRotatedSessionKeys(true))
+	defer h.close()
+	h.cart.carts[oldSession] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	cookie := (&sessionKeys{current: []byte("old key")}).sign(oldSession)
+
+	h.failTimes(getCartMethod, status.Error(codes.Unavailable, "cart down"), 1)
+	h.setSessionCookie(cookie)
+	h.get("/robots.txt")
+	if len(h.cart.carts[oldSession]) != 1 {
+		t.Fatal("old cart emptied by a failed migration")
+	}
+	h.setSessionCookie(cookie)
+	h.get("/robots.txt")
+	if len(h.cart.carts[oldSession]) != 0 || len(h.logs.find("session_cart_migrated")) != 1 {
+		t.Error("failed migration not retried")
+	}
+}
+
+func TestSessionCookieRejected(t *testing.T) {
+	// A cookie signed with the old key, whose ID was then changed.
+	old := &sessionKeys{current: []byte("old key")}
+	tampered := otherSession + strings.TrimPrefix(old.sign(oldSession), oldSession)
+
+	for name, value := range map[string]string{
+		"tampered":  tampered,
+		"garbage":   "not-a-session",
+		"unsigned":  otherSession,
+		"truncated": tampered[:len(tampered)-4],
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := newTestHarness(t, withRotatedSessionKeys(true))
+			defer h.close()
+			h.cart.carts[otherSession] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+			h.setSessionCookie(value)
+
+			h.get("/robots.txt")
+			if got := h.faults.calls(getCartMethod); got != 0 {
+				t.Errorf("made %d GetCart calls for a rejected cookie", got)
+			}
+			if len(h.cart.carts[otherSession]) != 1 {
+				t.Error("cart of the claimed session was modified")
+			}
+			if _, st := h.fe.sessions.keys.verify(h.cookie(cookieSessionID)); st != cookieValid {
+				t.Error("no new session started")
+			}
+		})
+	}
+}
+
+func TestMigrateCartConflicts(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	max := int32(h.fe.cartMaxQuantity)
+	h.cart.carts[oldSession] = []*pb.CartItem{
+		{ProductId: "OLJCESPC7Z", Quantity: max - 1},
+		{ProductId: "66VCHSJNUP", Quantity: 3},
+	}
+	h.cart.carts[otherSession] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	if err := h.fe.migrateCart(context.Background(), log, oldSession, otherSession); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int32)
+	for _, it := range h.cart.carts[otherSession] {
+		got[it.GetProductId()] = it.GetQuantity()
+	}
+	if got["OLJCESPC7Z"] != max || got["66VCHSJNUP"] != 3 {
+		t.Errorf("merged cart = %v, want OLJCESPC7Z capped to %d and 66VCHSJNUP added", got, max)
+	}
+}
+
+func TestMigrateCartLineLimit(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	for i := 0; i < cartMaxLines; i++ {
+		id := string(rune('A'+i/26)) + string(rune('A'+i%26))
+		h.cart.carts[otherSession] = append(h.cart.carts[otherSession], &pb.CartItem{ProductId: id, Quantity: 1})
+	}
+	h.cart.carts[oldSession] = []*pb.CartItem{
+		{ProductId: "AA", Quantity: 1},
+		{ProductId: "OLJCESPC7Z", Quantity: 1},
+	}
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	logs := &logCapture{}
+	log.AddHook(logs)
+	if err := h.fe.migrateCart(context.Background(), log, oldSession, otherSession); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.cart.carts[otherSession]); n != cartMaxLines {
+		t.Errorf("merged cart has %d lines, want %d", n, cartMaxLines)
+	}
+	if e := logs.find("session_cart_migrated"); len(e) != 1 || e[0].Data["moved"] != 1 || e[0].Data["dropped"] != 1 {
+		t.Errorf("migration logged as %v", e)
+	}
+}
+
+func TestSessionHashEverywhere(t *testing.T) {
+	rec := &spanRecorder{kind: trace.SpanKindServer}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+	h := newTestHarness(t, withAdminToken, func(fe *frontendServer) { fe.demoMode = true })
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	h.post("/cart/checkout", checkoutForm)
+	session := h.cookie(cookieSessionID)
+	want := hashSessionID(session)
+	if len(want) != sessionHashLen {
+		t.Fatalf("hash %q is not %d characters long", want, sessionHashLen)
+	}
+
+	traceID := strings.Repeat("0", 30) + "b1"
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/whoami", nil)
+	req.Header.Set("X-B3-TraceId", traceID)
+	req.Header.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+	req.Header.Set("X-B3-Sampled", "1")
+	page := h.do(req).body
+	var export orderExport
+	json.Unmarshal([]byte(h.export("", "").body), &export)
+
+	got := map[string]interface{}{
+		"span":         rec.wait(t, traceID).Attributes["session"],
+		"footer":       regexp.MustCompile(`session: ([0-9a-f]+)`).FindStringSubmatch(page),
+		"whoami":       regexp.MustCompile(`<code>([0-9a-f]+)</code>`).FindStringSubmatch(page),
+		"order export": nil,
+		"log":          nil,
+	}
+	if len(export.Orders) == 1 {
+		got["order export"] = export.Orders[0].Session
+	}
+	h.logs.mu.Lock()
+	for _, e := range h.logs.entries {
+		if v, ok := e.Data["session"]; ok {
+			got["log"] = v
+		}
+		if line, _ := e.String(); strings.Contains(line, session) {
+			t.Errorf("raw session ID logged: %s", line)
+		}
+	}
+	h.logs.mu.Unlock()
+	for point, v := range got {
+		if m, ok := v.([]string); ok && len(m) == 2 {
+			v = m[1]
+		}
+		if v != want {
+			t.Errorf("%s: session = %v, want %s", point, v, want)
+		}
+	}
+	if strings.Contains(page, session) {
+		t.Error("raw session ID shown on the page")
+	}
+}
+
+func TestMatchSessionHash(t *testing.T) {
+	h := newTestHarness(t, withAdminToken)
+	defer h.close()
+	match := func(id, hash string, admin bool) *response {
+		form := url.Values{"session_id": {id}, "hash": {hash}}
+		req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/admin/sessions/match", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if admin {
+			req.Header.Set("Authorization", "Bearer s3cret")
+		}
+		return h.do(req)
+	}
+	id := "0b9f6c3e-8b1a-4f2e-9d47-2c6a1e5f7a10"
+	for _, tc := range []struct {
+		id, hash string
+		want     string
+	}{
+		{id, hashSessionID(id), `{"match":true}`},
+		{id, strings.ToUpper(hashSessionID(id)), `{"match":true}`},
+		{id, hashSessionID("another"), `{"match":false}`},
+	} {
+		if resp := match(tc.id, tc.hash, true); strings.TrimSpace(resp.body) != tc.want {
+			t.Errorf("match(%s, %s) = %s, want %s", tc.id, tc.hash, resp.body, tc.want)
+		}
+	}
+	if resp := match(id, hashSessionID(id), false); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("match without the admin token = %d, want 401", resp.StatusCode)
+	}
+	if resp := match("", hashSessionID(id), true); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("match without a session ID = %d, want 400", resp.StatusCode)
+	}
+
+	defer func(key []byte) { sessionHashKey = key }(sessionHashKey)
+	before := hashSessionID(id)
+	sessionHashKey = []byte("another key")
+	if hashSessionID(id) == before {
+		t.Error("hash does not depend on SESSION_HASH_KEY")
+	}
+}
+
+func TestSessionUnsignedCookieSigned(t *testing.T) {
+	h := newTestHarness(t, withRotatedSessionKeys(false), func(fe *frontendServer) {
+		fe.sessions.acceptUnsigned = true
+	})
+	defer h.close()
+	h.cart.carts[otherSession] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	h.setSessionCookie(otherSession)
+
+	h.get("/cart")
+	h.get("/cart")
+	if id, st := h.fe.sessions.keys.verify(h.cookie(cookieSessionID)); st != cookieValid || id != otherSession {
+		t.Errorf("session cookie = %q, want the unsigned session signed", h.cookie(cookieSessionID))
+	}
+	if len(h.cart.carts[otherSession]) != 1 {
+		t.Error("cart of the unsigned session lost")
+	}
+	if n := len(h.logs.find("session_cookie_signed")); n != 1 {
+		t.Errorf("got %d session_cookie_signed events, want 1", n)
+	}
+
+	// Anything but a session ID still starts a new session.
+	h.setSessionCookie("not-a-session")
+	h.get("/robots.txt")
+	if id, _ := h.fe.sessions.keys.verify(h.cookie(cookieSessionID)); id == "" || id == "not-a-session" {
+		t.Error("no new session started for a garbage cookie")
+	}
+}
+
+func TestSessionRevokedOnLogout(t *testing.T) {
+	for _, revoke := range []bool{false, true} {
+		h := newTestHarness(t, withRotatedSessionKeys(false), func(fe *frontendServer) {
+			if revoke {
+				fe.sessions.revoked = cache.New(maxRevokedSessions)
+			}
+		})
+		h.get("/robots.txt")
+		stolen := h.cookie(cookieSessionID)
+		id, _ := h.fe.sessions.keys.verify(stolen)
+		h.post("/logout", nil)
+
+		// Replaying the cookie copied before the logout.
+		h.setSessionCookie(stolen)
+		h.get("/robots.txt")
+		if resumed := h.cookie(cookieSessionID) == stolen; resumed == revoke {
+			t.Errorf("revoke=%v: logged out session resumed = %v", revoke, resumed)
+		}
+		if got, _ := h.fe.sessions.keys.verify(h.cookie(cookieSessionID)); revoke && got == id {
+			t.Error("new session reuses the revoked ID")
+		}
+		h.close()
+	}
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) {
+		fe.sessions = &sessionManager{maxAge: time.Hour, secure: true, sameSite: http.SameSiteStrictMode}
+	})
+	defer h.close()
+
+	resp := h.get("/robots.txt")
+	var c *http.Cookie
+	for _, rc := range resp.Cookies() {
+		if rc.Name == cookieSessionID {
+			c = rc
+		}
+	}
+	if c == nil {
+		t.Fatal("no session cookie set")
+	}
+	if c.MaxAge != 3600 || !c.Secure || c.SameSite != http.SameSiteStrictMode || c.Path != "/" {
+		t.Errorf("session cookie = %+v, want one hour, secure and SameSite=Strict", c)
+	}
+	if !uuidPattern.MatchString(c.Value) || strings.Contains(c.Value, ".") {
+		t.Errorf("session cookie value = %q, want an unsigned ID", c.Value)
+	}
+}
+
+func TestParseSameSite(t *testing.T) {
+	for s, want := range map[string]http.SameSite{
+		"":       0,
+		"lax":    http.SameSiteLaxMode,
+		"Strict": http.SameSiteStrictMode,
+	} {
+		if got, ok := parseSameSite(s); !ok || got != want {
+			t.Errorf("parseSameSite(%q) = %v, %v; want %v", s, got, ok, want)
+		}
+	}
+	if _, ok := parseSameSite("none"); ok {
+		t.Error("parseSameSite accepted none")
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// sessionSnapshotVersion is bumped whenever the snapshot format changes in
+// a way older frontends cannot read.
+const sessionSnapshotVersion = 1
+
+// maxSessionSnapshotBytes caps the size of a snapshot, written or read.
+var maxSessionSnapshotBytes int64 = 32 << 20
+
+// sessionSnapshot is the live demo state kept in memory, saved so that it
+// survives a restart of the frontend.
+type sessionSnapshot struct {
+	Version int             `json:"version"`
+	Taken   time.Time       `json:"taken"`
+	Orders  []snapshotOrder `json:"orders"` // oldest first
+}
+
+// snapshotOrder is an order of the history along with its items, which
+// the export leaves out. Like the export, it has nothing identifying the
+// customer but the hashed session.
+type snapshotOrder struct {
+	orderRecord
+	LineItems []snapshotItem `json:"line_items"`
+}
+
+type snapshotItem struct {
+	ProductID string `json:"product_id"`
+	Quantity  int32  `json:"quantity"`
+}
+
+// snapshot copies the orders, holding the lock only for the copy.
+func (h *orderHistory) snapshot() []orderRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]orderRecord(nil), h.orders...)
+}
+
+// restore replaces the orders, keeping the last maxOrderHistory. They are
+// given new cursors, after those of the orders replaced.
+func (h *orderHistory) restore(orders []orderRecord) {
+	if len(orders) > maxOrderHistory {
+		orders = orders[len(orders)-maxOrderHistory:]
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.orders = append([]orderRecord(nil), orders...)
+	for i := range h.orders {
+		h.added++
+		h.orders[i].seq = h.added
+	}
+}
+
+// takeSnapshot captures the state to save.
+func (fe *frontendServer) takeSnapshot() sessionSnapshot {
+	s := sessionSnapshot{Version: sessionSnapshotVersion, Taken: fe.clock.Now().UTC()}
+	for _, o := range fe.orders.snapshot() {
+		so := snapshotOrder{orderRecord: o}
+		so.Time = o.Time.UTC()
+		for _, it := range o.items {
+			so.LineItems = append(so.LineItems, snapshotItem{ProductID: it.GetProductId(), Quantity: it.GetQuantity()})
+		}
+		so.items = nil
+		s.Orders = append(s.Orders, so)
+	}
+	return s
+}
+
+// orders returns the orders of the snapshot as kept by the history.
+func (s sessionSnapshot) orders() []orderRecord {
+	out := make([]orderRecord, 0, len(s.Orders))
+	for _, so := range s.Orders {
+		o := so.orderRecord
+		for _, it := range so.LineItems {
+			o.items = append(o.items, &pb.CartItem{ProductId: it.ProductID, Quantity: it.Quantity})
+		}
+		out = append(out, o)
+	}
+	return out
+}
+
+// writeSessionSnapshot saves s to path, replacing the file at once so that
+// a crash never leaves half a snapshot behind. It returns the size of the
+// file.
+func writeSessionSnapshot(path string, s sessionSnapshot) (int, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(b)) > maxSessionSnapshotBytes {
+		return 0, fmt.Errorf("snapshot of %d bytes exceeds the limit of %d", len(b), maxSessionSnapshotBytes)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name()) // fails once renamed
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return len(b), os.Rename(f.Name(), path)
+}
+
+// readSessionSnapshot loads a snapshot written by writeSessionSnapshot.
+func readSessionSnapshot(path string) (sessionSnapshot, error) {
+	var s sessionSnapshot
+	f, err := os.Open(path)
+	if err != nil {
+		return s, err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(f, maxSessionSnapshotBytes+1))
+	if err != nil {
+		return s, err
+	}
+	if int64(len(b)) > maxSessionSnapshotBytes {
+		return s, fmt.Errorf("snapshot exceeds the limit of %d bytes", maxSessionSnapshotBytes)
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, err
+	}
+	if s.Version != sessionSnapshotVersion {
+		return s, fmt.Errorf("snapshot version %d, want %d", s.Version, sessionSnapshotVersion)
+	}
+	return s, nil
+}
+
+// restoreSessionSnapshot loads the snapshot at fe.snapshotPath, if any,
+// into the in-memory state.
+func (fe *frontendServer) restoreSessionSnapshot(log logrus.FieldLogger) {
+	if fe.snapshotPath == "" {
+		return
+	}
+	s, err := readSessionSnapshot(fe.snapshotPath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Warnf("could not restore the session snapshot %s, starting empty: %v", fe.snapshotPath, err)
+		return
+	}
+	fe.orders.restore(s.orders())
+	log.WithFields(logrus.Fields{
+		"event":  "session_snapshot_restored",
+		"taken":  s.Taken,
+		"orders": len(s.Orders),
+	}).Info("restored the session snapshot")
+}
+
+// sessionSnapshotHandler saves the in-memory state to the file named by
+// SESSION_SNAPSHOT, to be restored when the frontend starts again.
+func (fe *frontendServer) sessionSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if !fe.isAdmin(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if fe.snapshotPath == "" {
+		http.Error(w, "SESSION_SNAPSHOT is not set", http.StatusConflict)
+		return
+	}
+	s := fe.takeSnapshot()
+	n, err := writeSessionSnapshot(fe.snapshotPath, s)
+	if err != nil {
+		http.Error(w, "could not write the snapshot: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger).WithFields(logrus.Fields{
+		"event":  "session_snapshot",
+		"orders": len(s.Orders),
+		"bytes":  n,
+	}).Info("wrote the session snapshot")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":    fe.snapshotPath,
+		"version": s.Version,
+		"taken":   s.Taken,
+		"orders":  len(s.Orders),
+		"bytes":   n,
+	})
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSessionSnapshotRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.json")
+
+	h := newTestHarness(t, withAdminToken, func(fe *frontendServer) { fe.snapshotPath = path })
+	defer h.close()
+	h.get("/")
+	placeOrder(h, map[string]string{"OLJCESPC7Z": "2", "66VCHSJNUP": "1"})
+	placeOrder(h, map[string]string{"1YMWWN1N4O": "3"})
+
+	snapshot := func(admin bool) *response {
+		req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/admin/session/snapshot", nil)
+		if admin {
+			req.Header.Set("Authorization", "Bearer s3cret")
+		}
+		return h.do(req)
+	}
+	if resp := snapshot(false); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("snapshot without the admin token = %d, want 401", resp.StatusCode)
+	}
+	if resp := snapshot(true); resp.StatusCode != http.StatusOK {
+		t.Fatalf("snapshot = %d: %s", resp.StatusCode, resp.body)
+	}
+	if len(h.logs.find("session_snapshot")) != 1 {
+		t.Error("snapshot not logged")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{h.cookie(cookieSessionID), checkoutForm.Get("email"), checkoutForm.Get("street_address")} {
+		if strings.Contains(string(b), secret) {
+			t.Errorf("snapshot contains %q", secret)
+		}
+	}
+
+	restarted := &frontendServer{orders: newOrderHistory(), snapshotPath: path}
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	restarted.restoreSessionSnapshot(log)
+	want := h.fe.orders.snapshot()
+	for i := range want {
+		want[i].Time = want[i].Time.UTC()
+	}
+	if got := restarted.orders.snapshot(); len(want) != 2 || !reflect.DeepEqual(got, want) {
+		t.Errorf("restored orders = %+v, want %+v", got, want)
+	}
+}
+
+func TestSessionSnapshotLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.json")
+	s := sessionSnapshot{Version: sessionSnapshotVersion, Orders: []snapshotOrder{{orderRecord: orderRecord{OrderID: "o1"}}}}
+
+	defer func(max int64) { maxSessionSnapshotBytes = max }(maxSessionSnapshotBytes)
+	maxSessionSnapshotBytes = 10
+	if _, err := writeSessionSnapshot(path, s); err == nil {
+		t.Error("oversized snapshot written")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("oversized snapshot left a file: %v", err)
+	}
+
+	maxSessionSnapshotBytes = 1 << 20
+	s.Version++
+	if _, err := writeSessionSnapshot(path, s); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSessionSnapshot(path); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("reading a newer snapshot = %v, want a version error", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files in the snapshot directory, want no temporary file left", len(files))
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/cache"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	maxAddressSessions = 10000 // sessions whose shipping address is remembered
+	addressTTL         = cookieMaxAge * time.Second
+)
+
+// shippingAddress is the address a session last estimated shipping to. It
+// has no street, which the estimate does not need; the checkout form asks
+// for it.
+type shippingAddress struct {
+	ZipCode string
+	City    string
+	State   string
+	Country string
+}
+
+// defaultShippingAddress fills the address fields of the forms before one
+// was entered.
+var defaultShippingAddress = shippingAddress{ZipCode: "94043", City: "Mountain View", State: "CA", Country: "United States"}
+
+// orDefault returns the address, or the default one for nil.
+func (a *shippingAddress) orDefault() *shippingAddress {
+	if a == nil {
+		d := defaultShippingAddress
+		return &d
+	}
+	return a
+}
+
+// proto is the address to quote shipping to, nil for none.
+func (a *shippingAddress) proto() *pb.Address {
+	if a == nil {
+		return nil
+	}
+	zip, _ := strconv.ParseInt(a.ZipCode, 10, 32)
+	return &pb.Address{City: a.City, State: a.State, ZipCode: int32(zip), Country: a.Country}
+}
+
+// addressBook remembers the last shipping address of each session, to
+// estimate shipping on the cart page and fill the checkout form with. A
+// nil *addressBook remembers nothing.
+type addressBook struct {
+	addresses *cache.Cache // by session ID
+}
+
+func newAddressBook() *addressBook {
+	return &addressBook{addresses: cache.New(maxAddressSessions)}
+}
+
+func (b *addressBook) save(sessionID string, a *shippingAddress) {
+	if b == nil {
+		return
+	}
+	b.addresses.Set(sessionID, a, addressTTL)
+}
+
+// get returns the address of the session, or nil.
+func (b *addressBook) get(sessionID string) *shippingAddress {
+	if b == nil {
+		return nil
+	}
+	if v, ok := b.addresses.Get(sessionID); ok {
+		return v.(*shippingAddress)
+	}
+	return nil
+}
+
+// validateShippingEstimate checks the form estimating shipping on the cart
+// page. Its fields are prefixed with ship_, apart from the checkout form's.
+func validateShippingEstimate(value func(field string) string) (*shippingAddress, *formState) {
+	f := newFormState(formShipping)
+	for _, field := range []string{"ship_zip_code", "ship_city", "ship_state", "ship_country"} {
+		f.Values[field] = value(field)
+	}
+	field := func(name string) string {
+		v := strings.TrimSpace(value("ship_" + name))
+		if n := checkoutMaxLengths[name]; n > 0 && utf8.RuneCountInString(v) > n {
+			f.add("ship_"+name, fmt.Sprintf("Enter at most %d characters", n))
+		}
+		return v
+	}
+	a := &shippingAddress{
+		ZipCode: strings.TrimSpace(value("ship_zip_code")),
+		City:    field("city"),
+		State:   field("state"),
+		Country: field("country"),
+	}
+	if !zipCodePattern.MatchString(a.ZipCode) {
+		f.add("ship_zip_code", "Enter a zip code of 4 or 5 digits")
+	}
+	if a.Country == "" {
+		f.add("ship_country", "Enter a country")
+	}
+	if len(f.Errors) > 0 {
+		return nil, f
+	}
+	return a, nil
+}
+
+// shippingEstimateHandler remembers the address to estimate shipping to and
+// goes back to the cart, which is quoted to it from then on, as its
+// contents change. An empty cart is not quoted.
+func (fe *frontendServer) shippingEstimateHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	a, f := validateShippingEstimate(r.FormValue)
+	if f != nil {
+		fe.rejectForm(w, r, f, "/cart")
+		return
+	}
+	fe.addresses.save(sessionID(r), a)
+
+	cart, err := fe.getCart(r.Context(), cartID(r))
+	if err != nil {
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
+		return
+	}
+	log.WithField("country", a.Country).WithField("lines", len(cart)).Debug("estimating shipping")
+	if len(cart) == 0 {
+		http.Redirect(w, r, "/cart?estimate=empty", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/cart#shipping_estimate", http.StatusSeeOther)
+}
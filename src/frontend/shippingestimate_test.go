@@ -0,0 +1,115 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var berlin = url.Values{
+	"ship_zip_code": {"10115"},
+	"ship_city":     {"Berlin"},
+	"ship_country":  {"Germany"},
+}
+
+func TestShippingEstimate(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	h.post("/setCurrency", url.Values{"currency_code": {"EUR"}})
+
+	resp := h.post("/cart/shipping-estimate", berlin)
+	if resp.StatusCode != 200 || resp.Request.URL.Path != "/cart" {
+		t.Fatalf("estimate: status %d at %s, want the cart", resp.StatusCode, resp.Request.URL.Path)
+	}
+	q := h.shipping.lastQuote()
+	if q == nil || q.GetAddress().GetCountry() != "Germany" || q.GetAddress().GetZipCode() != 10115 {
+		t.Fatalf("last quote = %v, want one to Berlin", q)
+	}
+	rate, _ := h.rates.get("EUR")
+	want := renderMoney(*convertMoney(fakeAbroadCostUSD, "EUR", rate))
+	if !strings.Contains(resp.body, "Shipping Cost to 10115 Germany: <strong>"+want+"</strong>") {
+		t.Errorf("cart does not show the estimate of %s to Berlin", want)
+	}
+	for _, field := range []string{`name="zip_code" id="zip_code" value="10115"`, `value="Berlin"`, `name="country" value="Germany"`} {
+		if !strings.Contains(resp.body, field) {
+			t.Errorf("checkout form not filled with the estimated address, missing %s", field)
+		}
+	}
+
+	// The estimate follows the cart.
+	h.post("/cart", url.Values{"product_id": {"66VCHSJNUP"}, "quantity": {"2"}})
+	if q := h.shipping.lastQuote(); len(q.GetItems()) != 2 || q.GetAddress().GetCountry() != "Germany" {
+		t.Errorf("quote after adding to the cart = %v, want both lines to Berlin", q)
+	}
+}
+
+func TestShippingEstimateEmptyCart(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+
+	resp := h.post("/cart/shipping-estimate", berlin)
+	if !strings.Contains(resp.body, `id="estimate_empty"`) {
+		t.Error("no message for estimating an empty cart")
+	}
+	if q := h.shipping.lastQuote(); q != nil {
+		t.Errorf("empty cart quoted: %v", q)
+	}
+}
+
+func TestShippingEstimateQuoteFailing(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+	h.fail(getQuoteMethod, status.Error(codes.Unavailable, "injected failure"))
+
+	resp := h.post("/cart/shipping-estimate", berlin)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, want the cart rendered without shipping", resp.StatusCode)
+	}
+	if !strings.Contains(resp.body, `id="shipping_unavailable"`) {
+		t.Error("no warning for the missing estimate")
+	}
+	if want := "Total Cost: <strong>USD 67.99</strong> plus shipping"; !strings.Contains(resp.body, want) {
+		t.Errorf("total without shipping not shown as %q", want)
+	}
+	if n := len(h.logs.find("call_degraded")); n != 1 {
+		t.Errorf("%d call_degraded events, want 1", n)
+	}
+}
+
+func TestShippingEstimateRejected(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}})
+
+	resp := h.post("/cart/shipping-estimate", url.Values{"ship_zip_code": {"ABC"}, "ship_country": {""}})
+	if resp.Request.URL.Fragment != "shipping_errors" {
+		t.Fatalf("invalid address not rejected, at %s", resp.Request.URL)
+	}
+	for _, id := range []string{"ship_zip_code_error", "ship_country_error"} {
+		if !strings.Contains(resp.body, `id="`+id+`"`) {
+			t.Errorf("no %s shown", id)
+		}
+	}
+	if h.fe.addresses.get(h.cookie(cookieSessionID)) != nil {
+		t.Error("rejected address remembered")
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+const defaultShutdownGracePeriod = 10 * time.Second
+
+// healthHandler answers the liveness probe, failing once shutdown began so
+// that the load balancer stops sending requests to the pod.
+func (fe *frontendServer) healthHandler(w http.ResponseWriter, _ *http.Request) {
+	if atomic.LoadInt32(&fe.shuttingDown) != 0 {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// serve serves HTTP on lis until a signal comes in on sigs. It then stops
+// the synthetic traffic, stops accepting connections, lets the requests in
+// flight and the queued shadow replays finish for up to the grace period,
+// stops the background loops with stopBackground, stops watching the
+// connections to the backends and closes them. It returns the error that
+// stopped the server, if it was not the signal.
+func (fe *frontendServer) serve(log logrus.FieldLogger, srv *http.Server, lis net.Listener, sigs <-chan os.Signal, grace time.Duration, stopBackground context.CancelFunc) error {
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(lis) }()
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-sigs:
+		atomic.StoreInt32(&fe.shuttingDown, 1)
+		fe.loadgen.stop()
+		log.WithFields(logrus.Fields{
+			"event":        "shutdown_started",
+			"signal":       sig.String(),
+			"grace_period": grace.String(),
+		}).Info("shutting down")
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err == nil {
+		err = fe.active.wait(ctx)
+	}
+	if err != nil {
+		log.WithField("error", err).Warn("requests still in flight after the grace period, closing their connections")
+		srv.Close()
+	}
+	if err := fe.mirror.close(ctx); err != nil {
+		log.WithField("error", err).Warn("shadow replays still queued after the grace period, dropping them")
+	}
+	stopBackground()
+	fe.watcher.stop()
+	fe.closeConns(log)
+	log.WithFields(logrus.Fields{
+		"event":    "shutdown_complete",
+		"duration": time.Since(start).String(),
+	}).Info("shut down")
+	return nil
+}
+
+// inFlight counts the requests being served, by the handler of the
+// frontend. srv.Shutdown does not wait for hijacked connections, as those
+// of h2c are, so serve waits for the requests with it. Behind h2c, the
+// handler is called once per stream, and the count is of those.
+type inFlight struct {
+	n int32
+}
+
+func (f *inFlight) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.n, 1)
+		defer atomic.AddInt32(&f.n, -1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wait returns once no request is in flight, or with the error of ctx.
+func (f *inFlight) wait(ctx context.Context) error {
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for atomic.LoadInt32(&f.n) > 0 {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// closeConns closes the connections to the backends.
+func (fe *frontendServer) closeConns(log logrus.FieldLogger) {
+	closed := make(map[*grpc.ClientConn]bool)
+	for _, b := range fe.backends() {
+		if b.conn == nil || closed[b.conn] {
+			continue
+		}
+		closed[b.conn] = true
+		if err := b.conn.Close(); err != nil {
+			log.WithField("backend", b.Name).WithField("error", err).Warn("failed to close the connection")
+		}
+	}
+}
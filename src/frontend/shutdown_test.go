@@ -0,0 +1,201 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/connectivity"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) { fe.extraLatency = 300 * time.Millisecond })
+	defer h.close()
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.AddHook(h.logs)
+	router, err := h.fe.router()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h.fe.handler(log, router)}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + lis.Addr().String()
+	sigs := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	// The background loops are stopped before the connections they use close.
+	bg, stopBackground := context.WithCancel(context.Background())
+	stoppedOpen := make(chan bool, 1)
+	stop := func() {
+		stopBackground()
+		stoppedOpen <- h.conn.GetState() != connectivity.Shutdown
+	}
+	go func() { served <- h.fe.serve(log, srv, lis, sigs, 5*time.Second, stop) }()
+
+	slow := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(base + "/")
+		if err != nil {
+			t.Error(err)
+			slow <- 0
+			return
+		}
+		resp.Body.Close()
+		slow <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond) // the slow request is in flight
+	sigs <- syscall.SIGTERM
+	time.Sleep(50 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/_healthz while shutting down = %d, want 503", rec.Code)
+	}
+	refused := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: time.Second}
+	if resp, err := refused.Get(base + "/_healthz"); err == nil {
+		resp.Body.Close()
+		t.Errorf("new request while shutting down answered %d, want it refused", resp.StatusCode)
+	}
+
+	if code := <-slow; code != http.StatusOK {
+		t.Errorf("request in flight at the signal = %d, want 200", code)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still running")
+	}
+	if st := h.conn.GetState(); st != connectivity.Shutdown {
+		t.Errorf("backend connection %v after shutdown", st)
+	}
+	if bg.Err() == nil || !<-stoppedOpen {
+		t.Error("background loops not stopped before the backend connections closed")
+	}
+	if len(h.logs.find("shutdown_started")) != 1 || len(h.logs.find("shutdown_complete")) != 1 {
+		t.Error("shutdown not logged")
+	}
+}
+
+// serveFor serves the harness frontend, as main would, until the returned
+// signal channel gets a signal, with the given grace period.
+func serveFor(t *testing.T, h *testHarness, grace time.Duration) (base string, sigs chan os.Signal, served chan error) {
+	t.Helper()
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.AddHook(h.logs)
+	router, err := h.fe.router()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h.fe.handler(log, router)}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigs = make(chan os.Signal, 1)
+	served = make(chan error, 1)
+	go func() { served <- h.fe.serve(log, srv, lis, sigs, grace, func() {}) }()
+	return "http://" + lis.Addr().String(), sigs, served
+}
+
+func TestShutdownDrainsMirror(t *testing.T) {
+	var h *testHarness
+	var mu sync.Mutex
+	replayed, late := 0, 0
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		replayed++
+		if h.conn.GetState() == connectivity.Shutdown {
+			late++
+		}
+	}))
+	defer shadow.Close()
+	h = newTestHarness(t, withMirror(shadow, 1))
+	defer h.close()
+	base, sigs, served := serveFor(t, h, 5*time.Second)
+
+	const requests = 10
+	for i := 0; i < requests; i++ {
+		resp, err := http.Get(base + "/robots.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	sigs <- syscall.SIGTERM
+	if err := <-served; err != nil {
+		t.Fatalf("serve = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if replayed != requests || late != 0 {
+		t.Errorf("%d of %d requests replayed, %d after the backend connections closed; want all before", replayed, requests, late)
+	}
+}
+
+func TestShutdownDropsMirrorAfterGrace(t *testing.T) {
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer shadow.Close()
+	defer close(release)
+	h := newTestHarness(t, withMirror(shadow, 1))
+	defer h.close()
+	base, sigs, served := serveFor(t, h, 200*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		resp, err := http.Get(base + "/robots.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	sigs <- syscall.SIGTERM
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("serve = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown waits for a stuck shadow")
+	}
+	if n := h.fe.mirror.queued(); n != 0 {
+		t.Errorf("%d replays still queued after shutdown, want them dropped", n)
+	}
+	if st := h.conn.GetState(); st != connectivity.Shutdown {
+		t.Errorf("backend connection %v after shutdown", st)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	startupPhaseDuration = stats.Float64("frontend/startup_phase_duration",
+		"Duration of a startup phase", stats.UnitMilliseconds)
+	startupPhaseKey, _ = tag.NewKey("phase")
+
+	startupPhaseView = &view.View{
+		Name:        "frontend/startup_phase_duration",
+		Measure:     startupPhaseDuration,
+		Description: startupPhaseDuration.Description(),
+		TagKeys:     []tag.Key{startupPhaseKey},
+		Aggregation: view.LastValue(),
+	}
+)
+
+// startupStep is a startup task run in the background while the server is
+// already listening. Required steps hold back readiness until they succeed;
+// best-effort steps are only logged when they fail.
+type startupStep struct {
+	name     string
+	required bool
+	timeout  time.Duration
+	run      func(ctx context.Context) error
+}
+
+// readinessGate tracks the required startup steps that have not completed
+// yet. The server is ready once there are none left.
+type readinessGate struct {
+	mu      sync.Mutex
+	pending map[string]bool
+	failed  map[string]error
+}
+
+func newReadinessGate() *readinessGate {
+	return &readinessGate{pending: make(map[string]bool), failed: make(map[string]error)}
+}
+
+func (g *readinessGate) add(name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pending[name] = true
+}
+
+func (g *readinessGate) done(name string, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err != nil {
+		g.failed[name] = err
+		return
+	}
+	delete(g.pending, name)
+}
+
+// ready reports whether all required steps completed, and otherwise which
+// ones are still running or have failed.
+func (g *readinessGate) ready() (bool, []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var waiting []string
+	for name := range g.pending {
+		if err, ok := g.failed[name]; ok {
+			waiting = append(waiting, fmt.Sprintf("%s (failed: %v)", name, err))
+		} else {
+			waiting = append(waiting, name)
+		}
+	}
+	sort.Strings(waiting)
+	return len(waiting) == 0, waiting
+}
+
+// readinessReport is the body of the readiness probe.
+type readinessReport struct {
+	Ready    bool               `json:"ready"`
+	Waiting  []string           `json:"waiting,omitempty"` // required startup steps
+	Failing  []string           `json:"failing,omitempty"` // critical backends
+	Backends []backendReadiness `json:"backends,omitempty"`
+}
+
+// readyHandler answers the readiness probe: the frontend is ready once the
+// required startup steps completed, as long as its critical backends can
+// be reached.
+func (fe *frontendServer) readyHandler(w http.ResponseWriter, _ *http.Request) {
+	if atomic.LoadInt32(&fe.shuttingDown) != 0 {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	var report readinessReport
+	started, waiting := fe.ready.ready()
+	report.Waiting = waiting
+	if fe.backendCheck != nil {
+		report.Backends, report.Failing = fe.backendCheck.check(fe.backends)
+	}
+	report.Ready = started && len(report.Failing) == 0
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// startup runs the startup phases, logging and recording their durations.
+// Essential phases run synchronously through phase; heavier steps run in
+// the background through background and report to the readiness gate.
+type startup struct {
+	log    logrus.FieldLogger
+	gate   *readinessGate
+	budget time.Duration // 0 disables the check
+	begin  time.Time
+	wg     sync.WaitGroup
+}
+
+func newStartup(log logrus.FieldLogger, gate *readinessGate, budget time.Duration) *startup {
+	return &startup{log: log, gate: gate, budget: budget, begin: time.Now()}
+}
+
+// phase runs an essential startup phase synchronously.
+func (s *startup) phase(name string, fn func()) {
+	start := time.Now()
+	fn()
+	s.record(name, time.Since(start))
+}
+
+// background runs step in its own goroutine, giving up on it after its
+// timeout.
+func (s *startup) background(step startupStep) {
+	if step.required {
+		s.gate.add(step.name)
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), step.timeout)
+		defer cancel()
+
+		errc := make(chan error, 1)
+		go func() { errc <- step.run(ctx) }()
+		var err error
+		select {
+		case err = <-errc:
+		case <-ctx.Done():
+			err = fmt.Errorf("timed out after %v", step.timeout)
+		}
+
+		s.record(step.name, time.Since(start))
+		if step.required {
+			s.gate.done(step.name, err)
+		}
+		if err != nil {
+			l := s.log.WithField("phase", step.name).WithField("error", err)
+			if step.required {
+				l.Error("required startup step failed, the server will not become ready")
+			} else {
+				l.Warn("best-effort startup step failed")
+			}
+		}
+	}()
+}
+
+// wait blocks until all background steps have finished, then reports the
+// total startup time.
+func (s *startup) wait() {
+	s.wg.Wait()
+	total := time.Since(s.begin)
+	s.record("total", total)
+	if s.budget > 0 && total > s.budget {
+		s.log.WithField("budget", s.budget).WithField("duration", total).
+			Warnf("startup took %v, exceeding the startup budget of %v", total, s.budget)
+	}
+}
+
+func (s *startup) record(name string, d time.Duration) {
+	s.log.WithField("phase", name).WithField("duration_ms", d.Seconds()*1000).Info("startup phase completed")
+	if ctx, err := tag.New(context.Background(), tag.Upsert(startupPhaseKey, name)); err == nil {
+		stats.Record(ctx, startupPhaseDuration.M(d.Seconds()*1000))
+	}
+}
+
+// startupSteps returns the background startup steps. Steps listed in
+// required are required, all others are best-effort; a nil required keeps
+// the default classification.
+func (fe *frontendServer) startupSteps(required []string) []startupStep {
+	steps := []startupStep{
+		{name: "catalog_prefetch", timeout: 10 * time.Second, run: fe.prefetchCatalog},
+	}
+	if fe.platform != nil && fe.platform.get() == nil {
+		steps = append(steps, startupStep{name: "platform_detection", timeout: platformProbeTimeout, run: fe.detectPlatform})
+	}
+	if required != nil {
+		for i := range steps {
+			steps[i].required = false
+			for _, name := range required {
+				if steps[i].name == name {
+					steps[i].required = true
+				}
+			}
+		}
+	}
+	return steps
+}
+
+// prefetchCatalog lists the products once so the first visitor does not
+// pay for establishing the connection to the catalog service, and so links
+// to products can be checked from the start.
+func (fe *frontendServer) prefetchCatalog(ctx context.Context) error {
+	_, err := fe.getProducts(ctx)
+	return err
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// slowStep returns a step function blocking until release is closed or its
+// context is done.
+func slowStep(release <-chan struct{}) func(context.Context) error {
+	return func(ctx context.Context) error {
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func readiness(t *testing.T, fe *frontendServer) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	fe.readyHandler(rec, httptest.NewRequest(http.MethodGet, "/_readyz", nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestStartupReadiness(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	t.Run("required step holds back readiness", func(t *testing.T) {
+		fe := &frontendServer{ready: newReadinessGate()}
+		st := newStartup(log, fe.ready, 0)
+		release := make(chan struct{})
+		st.background(startupStep{name: "slow", required: true, timeout: time.Minute, run: slowStep(release)})
+
+		if code, body := readiness(t, fe); code != http.StatusServiceUnavailable || !strings.Contains(body, "slow") {
+			t.Errorf("readiness while running = %d %q, want 503 naming the step", code, body)
+		}
+		close(release)
+		st.wait()
+		if code, _ := readiness(t, fe); code != http.StatusOK {
+			t.Errorf("readiness after completion = %d, want 200", code)
+		}
+	})
+
+	t.Run("required step timing out stays unready", func(t *testing.T) {
+		fe := &frontendServer{ready: newReadinessGate()}
+		st := newStartup(log, fe.ready, 0)
+		st.background(startupStep{name: "stuck", required: true, timeout: 10 * time.Millisecond,
+			run: func(context.Context) error { select {} }})
+		st.wait()
+		if code, body := readiness(t, fe); code != http.StatusServiceUnavailable || !strings.Contains(body, "stuck (failed: timed out") {
+			t.Errorf("readiness = %d %q, want 503 with the timeout", code, body)
+		}
+	})
+
+	t.Run("best-effort step does not hold back readiness", func(t *testing.T) {
+		fe := &frontendServer{ready: newReadinessGate()}
+		st := newStartup(log, fe.ready, 0)
+		release := make(chan struct{})
+		st.background(startupStep{name: "slow", timeout: time.Minute, run: slowStep(release)})
+		st.background(startupStep{name: "broken", timeout: time.Minute,
+			run: func(context.Context) error { return errors.New("boom") }})
+
+		if code, _ := readiness(t, fe); code != http.StatusOK {
+			t.Errorf("readiness while running = %d, want 200", code)
+		}
+		close(release)
+		st.wait()
+		if code, _ := readiness(t, fe); code != http.StatusOK {
+			t.Errorf("readiness after completion = %d, want 200", code)
+		}
+	})
+}
+
+func TestStartupBudget(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	logs := &logCapture{}
+	log.AddHook(logs)
+
+	st := newStartup(log, newReadinessGate(), time.Millisecond)
+	st.phase("config", func() { time.Sleep(5 * time.Millisecond) })
+	st.wait()
+
+	var warned bool
+	for _, e := range logs.entries {
+		if e.Level == logrus.WarnLevel && strings.Contains(e.Message, "exceeding the startup budget") {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Error("no warning logged for a startup exceeding its budget")
+	}
+}
+
+func TestStartupStepsClassification(t *testing.T) {
+	fe := &frontendServer{}
+	for _, step := range fe.startupSteps(nil) {
+		if step.required {
+			t.Errorf("step %q is required by default", step.name)
+		}
+	}
+	for _, step := range fe.startupSteps([]string{"catalog_prefetch"}) {
+		if step.name == "catalog_prefetch" && !step.required {
+			t.Error("catalog_prefetch not required when listed")
+		}
+	}
+}
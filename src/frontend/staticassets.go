@@ -0,0 +1,211 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// minGzipSavings is the share of its size a file must lose to gzip for the
+// compressed variant to be kept; images are usually compressed already.
+const minGzipSavings = 0.1
+
+// Cache-Control of the static files. A URL carrying the version of the file
+// never changes content, so it is cached for good; other URLs are
+// revalidated with their ETag.
+const (
+	cacheControlVersioned   = "public, max-age=31536000, immutable"
+	cacheControlUnversioned = "no-cache"
+)
+
+// versionedAssets versions the static file URLs of the templates, see
+// assetURL. It is set once the static files are loaded; nil leaves the URLs
+// as they are.
+var versionedAssets *staticAssets
+
+// staticAsset is a static file kept in memory, with its gzip variant when
+// compressing it is worth it.
+type staticAsset struct {
+	modTime     time.Time
+	contentType string
+	etag        string // strong, of the plain content
+	version     string // the ETag's hash, for the v parameter of URLs
+	plain       []byte
+	gzipped     []byte // nil if not worth it
+}
+
+// staticAssets serves the static files from memory. They are read and
+// compressed once, at startup, so requests accepting gzip are answered
+// with the precompressed variant without compressing anything. Range
+// requests are answered from the plain variant, so byte ranges and If-Range
+// keep the meaning they have for the file on disk. The ETag of the gzip
+// variant is the plain one's with a "-gzip" suffix.
+type staticAssets struct {
+	files map[string]*staticAsset // by slash-separated path in the directory
+
+	// notFound answers requests for missing files, http.NotFound if nil.
+	notFound http.HandlerFunc
+}
+
+// findStaticDir returns the directory to load the static files from: dir if
+// it exists, else STATIC_DIR, else the directory next to the executable
+// named like dir, for a binary run from elsewhere than its source tree.
+func findStaticDir(dir string) string {
+	candidates := []string{dir, os.Getenv("STATIC_DIR")}
+	if exe, err := os.Executable(); err == nil {
+		candidates = append(candidates, filepath.Join(filepath.Dir(exe), dir))
+	}
+	for _, d := range candidates {
+		if fi, err := os.Stat(d); d != "" && err == nil && fi.IsDir() {
+			return d
+		}
+	}
+	return dir
+}
+
+// loadStaticAssets reads every file under dir.
+func loadStaticAssets(dir string) (*staticAssets, error) {
+	a := &staticAssets{files: make(map[string]*staticAsset)}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		a.files[filepath.ToSlash(rel)] = newStaticAsset(p, fi.ModTime(), b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func newStaticAsset(name string, modTime time.Time, b []byte) *staticAsset {
+	sum := sha256.Sum256(b)
+	version := hex.EncodeToString(sum[:8])
+	f := &staticAsset{
+		modTime:     modTime,
+		contentType: mime.TypeByExtension(filepath.Ext(name)),
+		etag:        `"` + version + `"`,
+		version:     version,
+		plain:       b,
+	}
+	if f.contentType == "" {
+		f.contentType = http.DetectContentType(b)
+	}
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	zw.Write(b)
+	zw.Close()
+	if float64(buf.Len()) <= float64(len(b))*(1-minGzipSavings) {
+		f.gzipped = buf.Bytes()
+	}
+	return f
+}
+
+// acceptsGzip reports whether the request accepts gzip content encoding.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != "gzip" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// assetURL adds the version of a static file to its URL, as the v
+// parameter, so that the URL can be cached for good. Other URLs are
+// returned as they are.
+func assetURL(u string) string {
+	const prefix = "/static/"
+	if versionedAssets == nil || !strings.HasPrefix(u, prefix) || strings.Contains(u, "?") {
+		return u
+	}
+	f, ok := versionedAssets.files[strings.TrimPrefix(path.Clean(u), prefix)]
+	if !ok {
+		return u
+	}
+	return u + "?v=" + f.version
+}
+
+func (a *staticAssets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.files[strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")]
+	if !ok {
+		if a.notFound != nil {
+			a.notFound(w, r)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", f.contentType)
+	if r.URL.Query().Get("v") == f.version {
+		h.Set("Cache-Control", cacheControlVersioned)
+	} else {
+		h.Set("Cache-Control", cacheControlUnversioned)
+	}
+	content, etag := f.plain, f.etag
+	if f.gzipped != nil {
+		h.Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) && r.Header.Get("Range") == "" {
+			h.Set("Content-Encoding", "gzip")
+			// ServeContent only sets the length of unencoded content.
+			h.Set("Content-Length", strconv.Itoa(len(f.gzipped)))
+			content, etag = f.gzipped, strings.TrimSuffix(f.etag, `"`)+`-gzip"`
+		}
+	}
+	h.Set("ETag", etag)
+	http.ServeContent(w, r, "", f.modTime, bytes.NewReader(content))
+}
+
+// staticNotFoundHandler answers requests for missing static files with the
+// error page rather than plain text.
+func (fe *frontendServer) staticNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	fe.renderHTTPError(log, r, w, errors.Errorf("no static file %q", r.URL.Path), http.StatusNotFound)
+}
@@ -0,0 +1,265 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var styleCSS = []byte(strings.Repeat("body { margin: 0; padding: 0; }\n", 200))
+
+// newTestAssets loads a directory holding a compressible stylesheet and an
+// incompressible image.
+func newTestAssets(t testing.TB) *staticAssets {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	img := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(img)
+	os.MkdirAll(filepath.Join(dir, "img"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "style.css"), styleCSS, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "img", "photo.jpg"), img, 0644)
+	a, err := loadStaticAssets(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func serveAsset(a *staticAssets, path string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	return w
+}
+
+func TestStaticAssetsGzip(t *testing.T) {
+	a := newTestAssets(t)
+
+	plain := serveAsset(a, "/style.css", nil)
+	if plain.Header().Get("Content-Encoding") != "" || !bytes.Equal(plain.Body.Bytes(), styleCSS) {
+		t.Error("plain variant not served without Accept-Encoding")
+	}
+	if got := plain.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/css") {
+		t.Errorf("Content-Type = %q, want text/css", got)
+	}
+
+	gz := serveAsset(a, "/style.css", map[string]string{"Accept-Encoding": "deflate, gzip;q=0.8"})
+	if gz.Header().Get("Content-Encoding") != "gzip" || gz.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("headers = %v, want the gzip variant varying on Accept-Encoding", gz.Header())
+	}
+	if got := gz.Header().Get("Content-Length"); got != strconv.Itoa(gz.Body.Len()) || gz.Body.Len() >= len(styleCSS) {
+		t.Errorf("Content-Length = %s for %d compressed bytes", got, gz.Body.Len())
+	}
+	zr, err := gzip.NewReader(gz.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(zr); !bytes.Equal(b, styleCSS) {
+		t.Error("gzip variant does not decompress to the file")
+	}
+	if want := strings.TrimSuffix(plain.Header().Get("ETag"), `"`) + `-gzip"`; gz.Header().Get("ETag") != want {
+		t.Errorf("gzip ETag = %s, want %s", gz.Header().Get("ETag"), want)
+	}
+
+	if w := serveAsset(a, "/style.css", map[string]string{"Accept-Encoding": "gzip;q=0"}); w.Header().Get("Content-Encoding") != "" {
+		t.Error("gzip served though refused")
+	}
+	if w := serveAsset(a, "/img/photo.jpg", map[string]string{"Accept-Encoding": "gzip"}); w.Header().Get("Content-Encoding") != "" ||
+		w.Header().Get("Vary") != "" {
+		t.Error("incompressible image served compressed")
+	}
+	if w := serveAsset(a, "/img/", nil); w.Code != http.StatusNotFound {
+		t.Errorf("directory = %d, want 404", w.Code)
+	}
+	if w := serveAsset(a, "/../style.css", nil); w.Code != http.StatusOK {
+		t.Errorf("cleaned path = %d, want 200", w.Code)
+	}
+}
+
+func TestStaticAssetsConditional(t *testing.T) {
+	a := newTestAssets(t)
+	etag := serveAsset(a, "/style.css", nil).Header().Get("ETag")
+	gzETag := serveAsset(a, "/style.css", map[string]string{"Accept-Encoding": "gzip"}).Header().Get("ETag")
+
+	tests := []struct {
+		name       string
+		header     map[string]string
+		wantStatus int
+		wantBody   string
+	}{
+		{"range", map[string]string{"Range": "bytes=0-3", "Accept-Encoding": "gzip"},
+			http.StatusPartialContent, "body"},
+		{"suffix range", map[string]string{"Range": "bytes=-2"},
+			http.StatusPartialContent, "}\n"},
+		{"unsatisfiable range", map[string]string{"Range": "bytes=99999-"},
+			http.StatusRequestedRangeNotSatisfiable, ""},
+		{"if-range matching", map[string]string{"Range": "bytes=5-6", "If-Range": etag},
+			http.StatusPartialContent, "{ "},
+		{"if-range of the gzip variant", map[string]string{"Range": "bytes=5-6", "If-Range": gzETag},
+			http.StatusOK, string(styleCSS)},
+		{"if-range stale", map[string]string{"Range": "bytes=5-6", "If-Range": `"stale"`},
+			http.StatusOK, string(styleCSS)},
+		{"if-none-match", map[string]string{"If-None-Match": etag},
+			http.StatusNotModified, ""},
+		{"if-none-match gzip", map[string]string{"If-None-Match": gzETag, "Accept-Encoding": "gzip"},
+			http.StatusNotModified, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveAsset(a, "/style.css", tt.header)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			// Ranges are served from the plain variant.
+			if got := w.Header().Get("Content-Encoding"); got != "" && w.Code != http.StatusNotModified {
+				t.Errorf("Content-Encoding = %q, want none", got)
+			}
+		})
+	}
+}
+
+func BenchmarkStaticGzip(b *testing.B) {
+	a := newTestAssets(b)
+	header := map[string]string{"Accept-Encoding": "gzip"}
+	b.Run("precompressed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			serveAsset(a, "/style.css", header)
+		}
+	})
+	b.Run("runtime", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			w := httptest.NewRecorder()
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			zw.Write(styleCSS)
+			zw.Close()
+		}
+	})
+}
+
+func TestStaticAssetsCacheControl(t *testing.T) {
+	a := newTestAssets(t)
+	version := a.files["style.css"].version
+
+	for query, want := range map[string]string{
+		"?v=" + version: cacheControlVersioned,
+		"":              cacheControlUnversioned,
+		"?v=stale":      cacheControlUnversioned,
+	} {
+		w := serveAsset(a, "/style.css"+query, nil)
+		if got := w.Header().Get("Cache-Control"); got != want {
+			t.Errorf("Cache-Control of %q = %q, want %q", query, got, want)
+		}
+	}
+	w := serveAsset(a, "/style.css?v="+version, map[string]string{"If-None-Match": `"` + version + `"`})
+	if w.Code != http.StatusNotModified || w.Header().Get("Cache-Control") != cacheControlVersioned {
+		t.Errorf("revalidation = %d with Cache-Control %q, want a cacheable 304", w.Code, w.Header().Get("Cache-Control"))
+	}
+}
+
+func TestAssetURL(t *testing.T) {
+	if got := assetURL("/static/style.css"); got != "/static/style.css" {
+		t.Errorf("assetURL without versions = %q", got)
+	}
+	versionedAssets = newTestAssets(t)
+	defer func() { versionedAssets = nil }()
+
+	want := "/static/style.css?v=" + versionedAssets.files["style.css"].version
+	for in, want := range map[string]string{
+		"/static/style.css":           want,
+		"/static/missing.css":         "/static/missing.css",
+		"/static/style.css?v=1":       "/static/style.css?v=1",
+		"https://example.com/a.jpg":   "https://example.com/a.jpg",
+		"/static/img/../style.css":    "/static/img/../style.css?v=" + versionedAssets.files["style.css"].version,
+		"/product/static/img/x.jpg":   "/product/static/img/x.jpg",
+		"/static/img/photo.jpg?x=1&y": "/static/img/photo.jpg?x=1&y",
+	} {
+		if got := assetURL(in); got != want {
+			t.Errorf("assetURL(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestStaticAssetsInPages(t *testing.T) {
+	static, err := loadStaticAssets("./static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHarness(t, func(fe *frontendServer) {
+		fe.static = static
+		static.notFound = fe.staticNotFoundHandler
+	})
+	defer h.close()
+	versionedAssets = static
+	defer func() { versionedAssets = nil }()
+
+	page := h.get("/product/OLJCESPC7Z")
+	m := regexp.MustCompile(`src="(/static/img/products/typewriter\.jpg\?v=[0-9a-f]+)"`).FindStringSubmatch(page.body)
+	if m == nil {
+		t.Fatal("product picture not versioned")
+	}
+	img := h.get(m[1])
+	if img.StatusCode != http.StatusOK || img.Header.Get("Cache-Control") != cacheControlVersioned {
+		t.Errorf("versioned picture = %d with Cache-Control %q", img.StatusCode, img.Header.Get("Cache-Control"))
+	}
+
+	missing := h.get("/static/img/missing.jpg")
+	if missing.StatusCode != http.StatusNotFound || !strings.HasPrefix(missing.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("missing file = %d, %s; want the 404 page", missing.StatusCode, missing.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(missing.body, "</html>") {
+		t.Error("missing file answered without the error page")
+	}
+}
+
+func TestFindStaticDir(t *testing.T) {
+	if got := findStaticDir("./static"); got != "./static" {
+		t.Errorf("findStaticDir = %q, want the working directory's", got)
+	}
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("STATIC_DIR", dir)
+	defer os.Unsetenv("STATIC_DIR")
+	if got := findStaticDir("./no-such-dir"); got != dir {
+		t.Errorf("findStaticDir = %q, want STATIC_DIR %q", got, dir)
+	}
+	os.Unsetenv("STATIC_DIR")
+	if got := findStaticDir("./no-such-dir"); got != "./no-such-dir" {
+		t.Errorf("findStaticDir = %q, want the directory asked for", got)
+	}
+}
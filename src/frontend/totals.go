@@ -0,0 +1,292 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+var (
+	totalDiscrepancies = stats.Int64("frontend/checkout_total_discrepancies",
+		"Orders whose charged total differs from the total displayed in the cart", stats.UnitDimensionless)
+
+	totalDiscrepanciesView = &view.View{
+		Name:        "frontend/checkout_total_discrepancies",
+		Measure:     totalDiscrepancies,
+		Description: totalDiscrepancies.Description(),
+		Aggregation: view.Count(),
+	}
+)
+
+// cartQuote is the frontend's own computation of the cost of a cart, as
+// displayed on the cart page. Items only has the first rows of a large
+// cart, the total covers all of it.
+type cartQuote struct {
+	Items     []quotedItem
+	MoreItems int // cart lines beyond Items
+	Shipping  pb.Money
+	Total     pb.Money
+}
+
+type quotedItem struct {
+	Item      *pb.Product
+	Quantity  int32
+	Price     *pb.Money // unit price × quantity
+	UnitPrice pb.Money
+}
+
+// quoteCart prices the cart items and shipping to addr in the given
+// currency.
+func (fe *frontendServer) quoteCart(ctx context.Context, cart []*pb.CartItem, addr *pb.Address, currency string) (cartQuote, error) {
+	in, err := fe.cartPricing(ctx, cart, addr)
+	if err == nil {
+		err = in.shippingErr
+	}
+	if err != nil {
+		return cartQuote{}, err
+	}
+	return fe.priceCart(ctx, in, currency)
+}
+
+// totalOverflowed reports whether err is a cart total too large to be
+// represented, which no retry will fix.
+func totalOverflowed(err error) bool { return errors.Cause(err) == money.ErrOverflow }
+
+// maxQuoteItems is how many cart lines are sent for a shipping quote; the
+// quote of a larger cart is based on its first lines.
+const maxQuoteItems = 100
+
+// cartPricing is what pricing a cart needs besides the exchange rates.
+type cartPricing struct {
+	cart        []*pb.CartItem
+	products    map[string]*pb.Product // by ID, each fetched once
+	shippingUSD *pb.Money              // nil if the quote failed
+	shippingErr error
+}
+
+// cartPricing gets the products of the cart and its shipping quote to addr,
+// so it can be priced in any currency. A failed quote is left to the caller,
+// which may go on without shipping; an empty cart ships for free, without
+// asking for a quote.
+func (fe *frontendServer) cartPricing(ctx context.Context, cart []*pb.CartItem, addr *pb.Address) (cartPricing, error) {
+	in := cartPricing{cart: cart, products: make(map[string]*pb.Product), shippingUSD: &pb.Money{CurrencyCode: "USD"}}
+	if len(cart) > 0 {
+		quoted := cart
+		if len(quoted) > maxQuoteItems {
+			quoted = quoted[:maxQuoteItems]
+		}
+		var err error
+		if in.shippingUSD, err = fe.getShippingQuote(ctx, quoted, addr); err != nil {
+			in.shippingUSD, in.shippingErr = nil, errors.Wrap(err, "failed to get shipping quote")
+		}
+	}
+	for _, item := range cart {
+		id := item.GetProductId()
+		if _, ok := in.products[id]; ok {
+			continue
+		}
+		p, err := fe.getProduct(ctx, id)
+		if err != nil {
+			return cartPricing{}, errors.Wrapf(err, "could not retrieve product #%s", id)
+		}
+		in.products[id] = p
+	}
+	return in, nil
+}
+
+// priceCart prices a cart in the given currency. Only the first
+// fe.cartMaxRows lines get a quotedItem; the total is summed line by line
+// over the whole cart. Without a shipping quote, the total leaves shipping
+// out.
+func (fe *frontendServer) priceCart(ctx context.Context, in cartPricing, currency string) (cartQuote, error) {
+	// Each product is converted once, and the shipping cost along with them.
+	ids := make([]string, 0, len(in.products))
+	prices := make([]*pb.Money, 0, len(in.products)+1)
+	for id, p := range in.products {
+		ids = append(ids, id)
+		prices = append(prices, p.GetPriceUsd())
+	}
+	if in.shippingUSD != nil {
+		prices = append(prices, in.shippingUSD)
+	}
+	results := fe.convertAll(ctx, prices, currency)
+
+	// The total is in the currency the prices came in, USD if the page fell
+	// back: that of the shipping cost, or else of the products.
+	shipping := pb.Money{CurrencyCode: currency}
+	if in.shippingUSD != nil {
+		res := results[len(ids)]
+		if res.Err != nil {
+			return cartQuote{}, errors.Wrap(res.Err, "failed to convert currency for shipping cost")
+		}
+		shipping = *res.Money
+	}
+	// The total needs every price, so any failed conversion fails the quote.
+	unitPrices := make(map[string]pb.Money, len(ids))
+	for i, res := range results[:len(ids)] {
+		if res.Err != nil {
+			return cartQuote{}, errors.Wrapf(res.Err, "could not convert currency for product #%s", ids[i])
+		}
+		unitPrices[ids[i]] = *res.Money
+		if in.shippingUSD == nil {
+			shipping.CurrencyCode = res.Money.GetCurrencyCode()
+		}
+	}
+
+	rows := len(in.cart)
+	if fe.cartMaxRows > 0 && rows > fe.cartMaxRows {
+		rows = fe.cartMaxRows
+	}
+	q := cartQuote{
+		Items:     make([]quotedItem, 0, rows),
+		MoreItems: len(in.cart) - rows,
+		Shipping:  shipping,
+		Total:     pb.Money{CurrencyCode: shipping.GetCurrencyCode()},
+	}
+	for i, item := range in.cart {
+		multPrice, err := money.Multiply(unitPrices[item.GetProductId()], uint32(item.GetQuantity()))
+		if err == nil {
+			q.Total, err = money.Sum(q.Total, multPrice)
+		}
+		if err != nil {
+			return cartQuote{}, errors.Wrapf(err, "could not price product #%s", item.GetProductId())
+		}
+		if i < rows {
+			q.Items = append(q.Items, quotedItem{
+				Item:      in.products[item.GetProductId()],
+				Quantity:  item.GetQuantity(),
+				Price:     &multPrice,
+				UnitPrice: unitPrices[item.GetProductId()],
+			})
+		}
+	}
+	total, err := money.Sum(q.Total, q.Shipping)
+	if err != nil {
+		return cartQuote{}, errors.Wrap(err, "could not add the shipping cost")
+	}
+	q.Total = total
+	return q, nil
+}
+
+// totalBreakdown lists the amounts making up a total, at full precision.
+type totalBreakdown struct {
+	Items    map[string]string `json:"items"` // product ID → line cost
+	Shipping string            `json:"shipping"`
+	Total    string            `json:"total"`
+}
+
+// totalDiscrepancy describes an order that was charged a different total
+// than the one displayed in the cart.
+type totalDiscrepancy struct {
+	OrderID    string         `json:"order_id"`
+	Displayed  totalBreakdown `json:"displayed"`
+	Charged    totalBreakdown `json:"charged"`
+	Difference string         `json:"difference"`
+}
+
+// orderTotal is the total the checkout service charged for an order.
+func orderTotal(order *pb.OrderResult) pb.Money {
+	total := *order.GetShippingCost()
+	for _, v := range order.GetItems() {
+		total = money.Must(money.Sum(total, *v.GetCost()))
+	}
+	return total
+}
+
+// compareTotals checks the displayed cart total against the total charged
+// for the order. Both are compared as displayed, i.e. after rounding, and
+// may differ by up to tolerance. It returns nil when they agree.
+func compareTotals(displayed cartQuote, order *pb.OrderResult, tolerance pb.Money) *totalDiscrepancy {
+	charged := orderTotal(order)
+	d := &totalDiscrepancy{
+		OrderID: order.GetOrderId(),
+		Displayed: totalBreakdown{
+			Items:    make(map[string]string, len(displayed.Items)),
+			Shipping: formatAmount(displayed.Shipping),
+			Total:    formatAmount(displayed.Total),
+		},
+		Charged: totalBreakdown{
+			Items:    make(map[string]string, len(order.GetItems())),
+			Shipping: formatAmount(*order.GetShippingCost()),
+			Total:    formatAmount(charged),
+		},
+	}
+	for _, it := range displayed.Items {
+		d.Displayed.Items[it.Item.GetId()] = formatAmount(*it.Price)
+	}
+	for _, it := range order.GetItems() {
+		d.Charged.Items[it.GetItem().GetProductId()] = formatAmount(*it.GetCost())
+	}
+
+	diff, err := money.Sum(money.Round(charged, moneyRounding), money.Negate(money.Round(displayed.Total, moneyRounding)))
+	if err != nil {
+		// Different currencies can never be the same total.
+		d.Difference = "n/a"
+		return d
+	}
+	d.Difference = formatAmount(diff)
+	if money.IsNegative(diff) {
+		diff = money.Negate(diff)
+	}
+	tolerance.CurrencyCode = diff.GetCurrencyCode()
+	if !money.IsPositive(money.Must(money.Sum(diff, money.Negate(tolerance)))) {
+		return nil
+	}
+	return d
+}
+
+// reportDiscrepancy records a total discrepancy in the logs, on the current
+// span and in the discrepancy metric.
+func reportDiscrepancy(ctx context.Context, log logrus.FieldLogger, d *totalDiscrepancy) {
+	log.WithFields(logrus.Fields{
+		"event":      "checkout_total_discrepancy",
+		"order":      d.OrderID,
+		"displayed":  d.Displayed,
+		"charged":    d.Charged,
+		"difference": d.Difference,
+	}).Warn("charged total differs from the displayed cart total")
+
+	trace.FromContext(ctx).AddAttributes(
+		trace.BoolAttribute("checkout.total_discrepancy", true),
+		trace.StringAttribute("checkout.total_displayed", d.Displayed.Total),
+		trace.StringAttribute("checkout.total_charged", d.Charged.Total),
+	)
+	stats.Record(ctx, totalDiscrepancies.M(1))
+}
+
+// formatAmount formats m with all its nanos, e.g. "EUR 10.990000000".
+func formatAmount(m pb.Money) string {
+	return m.GetCurrencyCode() + " " + formatDecimal(m)
+}
+
+// formatDecimal formats the amount of m with all its nanos, e.g.
+// "10.990000000".
+func formatDecimal(m pb.Money) string {
+	units, nanos, sign := m.GetUnits(), m.GetNanos(), ""
+	if units < 0 || nanos < 0 {
+		units, nanos, sign = -units, -nanos, "-"
+	}
+	return fmt.Sprintf("%s%d.%09d", sign, units, nanos)
+}
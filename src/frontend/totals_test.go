@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestTotalDiscrepancy(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		drift      int32
+		tolerance  pb.Money
+		demoMode   bool
+		wantReport bool
+	}{
+		{name: "same total"},
+		{name: "difference not displayed", drift: 1000000},
+		{name: "one cent off", drift: 5000000, wantReport: true},
+		{name: "one cent off in demo mode", drift: 5000000, demoMode: true, wantReport: true},
+		{name: "within tolerance", drift: 5000000, tolerance: pb.Money{Nanos: 10000000}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHarness(t, func(fe *frontendServer) {
+				fe.totalTolerance = tc.tolerance
+				fe.demoMode = tc.demoMode
+			})
+			defer h.close()
+			h.checkout.drift = tc.drift
+
+			h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"2"}})
+			resp := h.post("/cart/checkout", checkoutForm)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("POST /cart/checkout = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+
+			events := h.logs.find("checkout_total_discrepancy")
+			if gotNote := strings.Contains(resp.body, `id="total_discrepancy"`); gotNote != tc.wantReport {
+				t.Errorf("discrepancy note shown = %v, want %v", gotNote, tc.wantReport)
+			}
+			if !tc.wantReport {
+				if len(events) != 0 {
+					t.Errorf("got %d discrepancy events, want none", len(events))
+				}
+				return
+			}
+
+			if len(events) != 1 {
+				t.Fatalf("got %d discrepancy events, want 1", len(events))
+			}
+			ev := events[0].Data
+			if ev["order"] != "order-1" {
+				t.Errorf("event order = %v, want order-1", ev["order"])
+			}
+			if want := (totalBreakdown{
+				Items:    map[string]string{"OLJCESPC7Z": "USD 135.980000000"},
+				Shipping: "USD 8.990000000",
+				Total:    "USD 144.970000000",
+			}); !reflect.DeepEqual(ev["displayed"], want) {
+				t.Errorf("event displayed = %+v, want %+v", ev["displayed"], want)
+			}
+			if want := (totalBreakdown{
+				Items:    map[string]string{"OLJCESPC7Z": "USD 135.985000000"},
+				Shipping: "USD 8.990000000",
+				Total:    "USD 144.975000000",
+			}); !reflect.DeepEqual(ev["charged"], want) {
+				t.Errorf("event charged = %+v, want %+v", ev["charged"], want)
+			}
+			if want := "USD 0.010000000"; ev["difference"] != want {
+				t.Errorf("event difference = %v, want %v", ev["difference"], want)
+			}
+
+			if !strings.Contains(resp.body, "Total Paid: <strong>USD 144.98</strong>") {
+				t.Error("confirmation does not show the charged total")
+			}
+			if !strings.Contains(resp.body, "differs from the USD 144.97 shown in your cart") {
+				t.Error("confirmation does not mention the displayed total")
+			}
+			if gotDetail := strings.Contains(resp.body, "USD 144.975000000"); gotDetail != tc.demoMode {
+				t.Errorf("discrepancy detail shown = %v, want %v", gotDetail, tc.demoMode)
+			}
+		})
+	}
+}
+
+func TestCartTotalOverflow(t *testing.T) {
+	h := newTestHarness(t)
+	defer h.close()
+	// Four of these overflow an int64 of units; the price itself converts
+	// exactly through the fake currency service's float arithmetic.
+	h.catalog.products = append([]*pb.Product{{
+		Id: "PRICELESS", Name: "Priceless", Picture: "/static/img/products/typewriter.jpg",
+		PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 1 << 61},
+	}}, fakeProducts...)
+	h.post("/cart", url.Values{"product_id": {"PRICELESS"}, "quantity": {"4"}})
+
+	if resp := h.get("/cart"); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("GET /cart = %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+	}
+	if resp := h.post("/cart/checkout", checkoutForm); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("POST /cart/checkout = %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+	}
+	var p problem
+	decodeAPI(t, h.get("/api/v1/cart"), http.StatusUnprocessableEntity, &p)
+	decodeAPI(t, h.postJSON("/api/v1/checkout", apiCheckoutBody), http.StatusUnprocessableEntity, &p)
+	if n := h.faults.calls(placeOrderMethod); n != 0 {
+		t.Errorf("PlaceOrder called %d times, want none", n)
+	}
+
+	// Three fit.
+	h.post("/cart/empty", nil)
+	h.post("/cart", url.Values{"product_id": {"PRICELESS"}, "quantity": {"3"}})
+	if resp := h.get("/cart"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /cart with a large but valid total = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
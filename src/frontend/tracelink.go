@@ -0,0 +1,81 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opencensus.io/trace"
+)
+
+// traceURLPlaceholder is replaced by the trace ID in the trace URL template.
+const traceURLPlaceholder = "{trace}"
+
+// traceIDFromContext returns the ID of the trace of the current span, or ""
+// when there is none.
+func traceIDFromContext(ctx context.Context) string {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return ""
+	}
+	id := span.SpanContext().TraceID
+	if id == (trace.TraceID{}) {
+		return ""
+	}
+	return id.String()
+}
+
+// validTraceURLTemplate reports whether tmpl is an http(s) URL containing
+// the trace ID placeholder.
+func validTraceURLTemplate(tmpl string) bool {
+	if !strings.Contains(tmpl, traceURLPlaceholder) {
+		return false
+	}
+	u, err := url.Parse(strings.Replace(tmpl, traceURLPlaceholder, "0", -1))
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// traceURL returns the link to the current trace in the tracing backend,
+// or "" when no trace URL template is configured.
+func (fe *frontendServer) traceURL(ctx context.Context) string {
+	id := traceIDFromContext(ctx)
+	if fe.traceURLTemplate == "" || id == "" {
+		return ""
+	}
+	return strings.Replace(fe.traceURLTemplate, traceURLPlaceholder, url.PathEscape(id), -1)
+}
+
+// isAdmin reports whether the request carries the admin bearer token.
+func (fe *frontendServer) isAdmin(r *http.Request) bool {
+	return hasBearerToken(r, fe.adminToken)
+}
+
+// hasBearerToken reports whether the request carries token as its bearer
+// token. An empty token is never carried.
+func hasBearerToken(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(h, prefix)), []byte(token)) == 1
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorPageTraceLink(t *testing.T) {
+	// The trace is propagated from the caller with B3 headers, which makes
+	// its ID known in advance.
+	const traceID = "463ac35c9f6413ad48485a3953bb6124"
+	const tmpl = "https://tenant.instana.io/#/traces;traceId={trace}"
+
+	for _, tc := range []struct {
+		name     string
+		demoMode bool
+		template string
+		token    string
+		wantID   bool
+		wantLink bool
+	}{
+		{name: "default", template: tmpl},
+		{name: "demo mode", demoMode: true, template: tmpl, wantID: true, wantLink: true},
+		{name: "demo mode without template", demoMode: true, wantID: true},
+		{name: "admin token", template: tmpl, token: "s3cret", wantID: true, wantLink: true},
+		{name: "wrong admin token", template: tmpl, token: "guess"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHarness(t, func(fe *frontendServer) {
+				fe.demoMode = tc.demoMode
+				fe.traceURLTemplate = tc.template
+				fe.adminToken = "s3cret"
+			})
+			defer h.close()
+			h.fail("/hipstershop.ProductCatalogService/ListProducts", status.Error(codes.Unavailable, "injected failure"))
+
+			req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/", nil)
+			req.Header.Set("X-B3-TraceId", traceID)
+			req.Header.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+			req.Header.Set("X-B3-Sampled", "1")
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			resp := h.do(req)
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+			}
+
+			if !strings.Contains(resp.body, "<strong>Request ID:</strong>") {
+				t.Error("error page does not show the request ID")
+			}
+			if got := strings.Contains(resp.body, traceID); got != tc.wantID {
+				t.Errorf("trace ID shown = %v, want %v", got, tc.wantID)
+			}
+			wantHref := `href="https://tenant.instana.io/#/traces;traceId=` + traceID + `"`
+			if got := strings.Contains(resp.body, wantHref); got != tc.wantLink {
+				t.Errorf("trace link shown = %v, want %v", got, tc.wantLink)
+			}
+		})
+	}
+}
+
+func TestTraceURLEscaping(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) {
+		fe.demoMode = true
+		fe.traceURLTemplate = `https://tenant.instana.io/#/traces;traceId={trace}&x="><script>alert(1)</script>`
+	})
+	defer h.close()
+	h.fail("/hipstershop.ProductCatalogService/ListProducts", status.Error(codes.Unavailable, "injected failure"))
+
+	resp := h.get("/")
+	if strings.Contains(resp.body, "<script>alert(1)</script>") {
+		t.Error("trace URL is not escaped")
+	}
+	if !strings.Contains(resp.body, `id="trace_link"`) {
+		t.Error("trace link missing")
+	}
+}
+
+func TestValidTraceURLTemplate(t *testing.T) {
+	for tmpl, want := range map[string]bool{
+		"https://tenant.instana.io/#/traces;traceId={trace}": true,
+		"http://jaeger:16686/trace/{trace}":                  true,
+		"https://tenant.instana.io/#/traces":                 false,
+		"javascript:alert('{trace}')":                        false,
+		"/traces/{trace}":                                    false,
+	} {
+		if got := validTraceURLTemplate(tmpl); got != want {
+			t.Errorf("validTraceURLTemplate(%q) = %v, want %v", tmpl, got, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/plugin/ocgrpc"
+	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+	"google.golang.org/grpc"
+)
+
+// Tracing backends, selected with TRACING_BACKEND. All of them record the
+// same spans, with the OpenCensus instrumentation; only where they are sent
+// and how the trace context is read from incoming requests differ.
+const (
+	// tracingStackdriver exports to Stackdriver, and to Jaeger when
+	// JAEGER_SERVICE_ADDR is set, with B3 headers. It is the default.
+	tracingStackdriver = "stackdriver"
+	// tracingOTLP exports to an OpenTelemetry collector, with W3C
+	// traceparent headers.
+	tracingOTLP = "otlp"
+	// tracingNone records nothing: no handler or interceptor is installed,
+	// e.g. for benchmarks.
+	tracingNone = "none"
+)
+
+// tracingBackendFromEnv returns the tracing backend selected by
+// TRACING_BACKEND. Without it, DISABLE_TRACING still selects none.
+func tracingBackendFromEnv(log logrus.FieldLogger) string {
+	v := os.Getenv("TRACING_BACKEND")
+	switch v {
+	case tracingStackdriver, tracingOTLP, tracingNone:
+		return v
+	case "":
+	default:
+		log.Warnf("invalid TRACING_BACKEND %q, want one of %s, %s or %s", v, tracingStackdriver, tracingOTLP, tracingNone)
+	}
+	if os.Getenv("DISABLE_TRACING") != "" {
+		return tracingNone
+	}
+	return tracingStackdriver
+}
+
+// tracingSummary names where traces go, for the startup summary.
+func tracingSummary(backend string) string {
+	switch backend {
+	case tracingNone:
+		return "disabled"
+	case tracingOTLP:
+		return "otlp"
+	}
+	if os.Getenv("JAEGER_SERVICE_ADDR") != "" {
+		return "jaeger+stackdriver"
+	}
+	return tracingStackdriver
+}
+
+// setupTracing starts exporting the spans to the backend. The returned
+// function sends the spans not exported yet, on shutdown.
+func setupTracing(ctx context.Context, log logrus.FieldLogger, backend string) func() {
+	switch backend {
+	case tracingNone:
+		// Spans started by the frontend itself have no parent to follow.
+		trace.ApplyConfig(trace.Config{DefaultSampler: trace.NeverSample()})
+		return func() {}
+	case tracingOTLP:
+		trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+		protocol := otlpProtocol(log)
+		endpoint := otlpEndpoint(protocol)
+		exporter, err := newOTLPExporter(endpoint, protocol, "frontend")
+		if err != nil {
+			log.WithField("error", err).Warn("could not export traces over OTLP")
+			return func() {}
+		}
+		trace.RegisterExporter(exporter)
+		go exporter.run(ctx, log, otlpFlushInterval)
+		log.WithFields(logrus.Fields{"endpoint": endpoint, "protocol": protocol}).Info("exporting traces over OTLP")
+		return func() {
+			if err := exporter.flush(context.Background(), log); err != nil {
+				log.WithField("error", err).Warn("could not export the last spans")
+			}
+			exporter.close()
+		}
+	}
+	go initTracing(log)
+	return func() {}
+}
+
+// httpPropagation is how the trace context of incoming requests is read.
+func (fe *frontendServer) httpPropagation() propagation.HTTPFormat {
+	if fe.tracingBackend == tracingOTLP {
+		return &tracecontext.HTTPFormat{}
+	}
+	return &b3.HTTPFormat{}
+}
+
+// dialOptions are the options of the connections to the backends: the
+// interceptors, and the tracing of the calls unless disabled.
+func (fe *frontendServer) dialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{grpc.WithChainUnaryInterceptor(requestIDInterceptor, fe.metrics.intercept, fe.hedges.intercept, fe.retries.intercept, fe.outbound.intercept)}
+	if fe.tracingBackend != tracingNone {
+		opts = append(opts, grpc.WithStatsHandler(&ocgrpc.ClientHandler{}))
+	}
+	return opts
+}
@@ -0,0 +1,266 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/plugin/ocgrpc"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// tracedBackend serves the registered fakes with the server side of the
+// gRPC tracing, and returns a connection dialed the way the frontend does.
+func tracedBackend(t *testing.T, fe *frontendServer, register func(*grpc.Server)) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.StatsHandler(&ocgrpc.ServerHandler{}))
+	register(srv)
+	go srv.Serve(lis)
+	var conn *grpc.ClientConn
+	if err := dialGRPC(context.Background(), &conn, "bufnet", append(fe.dialOptions(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }))...); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// spansOf returns the spans of the trace recorded so far, by span ID.
+func spansOf(recs []*spanRecorder, traceID string) map[trace.SpanID]*trace.SpanData {
+	out := make(map[trace.SpanID]*trace.SpanData)
+	for _, rec := range recs {
+		rec.mu.Lock()
+		for _, sd := range rec.spans {
+			if sd.TraceID.String() == traceID {
+				out[sd.SpanID] = sd
+			}
+		}
+		rec.mu.Unlock()
+	}
+	return out
+}
+
+func TestOTLPTraceContinuesTraceparent(t *testing.T) {
+	servers := &spanRecorder{kind: trace.SpanKindServer}
+	clients := &spanRecorder{kind: trace.SpanKindClient}
+	trace.RegisterExporter(servers)
+	trace.RegisterExporter(clients)
+	defer trace.UnregisterExporter(servers)
+	defer trace.UnregisterExporter(clients)
+
+	catalog, rates := &fakeCatalog{products: fakeProducts}, newFakeRateTable()
+	h := newTestHarness(t, func(fe *frontendServer) {
+		fe.tracingBackend = tracingOTLP
+		fe.productCatalogSvcConn = tracedBackend(t, fe, func(s *grpc.Server) {
+			pb.RegisterProductCatalogServiceServer(s, catalog)
+		})
+		fe.currencySvcConn = tracedBackend(t, fe, func(s *grpc.Server) {
+			pb.RegisterCurrencyServiceServer(s, fakeCurrency{rates})
+		})
+	})
+	defer h.close()
+
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+	req, _ := http.NewRequest(http.MethodGet, h.srv.URL+"/api/v1/products/OLJCESPC7Z?currency=EUR", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	if resp := h.do(req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("product: %d %s", resp.StatusCode, resp.body)
+	}
+
+	// The frontend's span ends once the response is written.
+	var page *trace.SpanData
+	var spans map[trace.SpanID]*trace.SpanData
+	for deadline := time.Now().Add(time.Second); page == nil && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		spans = spansOf([]*spanRecorder{servers, clients}, traceID)
+		for _, sd := range spans {
+			if sd.Name == "GET /api/v1/products/{id}" {
+				page = sd
+			}
+		}
+	}
+	if page == nil {
+		t.Fatal("no span for the request")
+	}
+	if page.ParentSpanID.String() != parentID || !page.HasRemoteParent {
+		t.Errorf("request span parent = %s, want the traceparent's %s", page.ParentSpanID, parentID)
+	}
+
+	// Each backend call is a descendant of the request, and the parent of
+	// the backend's own span.
+	descends := func(sd *trace.SpanData) bool {
+		for sd != nil {
+			if sd.ParentSpanID == page.SpanID {
+				return true
+			}
+			sd = spans[sd.ParentSpanID]
+		}
+		return false
+	}
+	for _, name := range []string{"hipstershop.ProductCatalogService.GetProduct", "hipstershop.CurrencyService.Convert"} {
+		var client, server *trace.SpanData
+		for _, sd := range spans {
+			if sd.Name != name {
+				continue
+			}
+			if sd.SpanKind == trace.SpanKindClient {
+				client = sd
+			} else {
+				server = sd
+			}
+		}
+		if client == nil || server == nil {
+			t.Errorf("%s: client span %v, backend span %v", name, client != nil, server != nil)
+			continue
+		}
+		if !descends(client) {
+			t.Errorf("%s: call is not part of the request span", name)
+		}
+		if server.ParentSpanID != client.SpanID {
+			t.Errorf("%s: backend span's parent = %s, want the call %s", name, server.ParentSpanID, client.SpanID)
+		}
+	}
+}
+
+func TestTracingNone(t *testing.T) {
+	h := newTestHarness(t, func(fe *frontendServer) { fe.tracingBackend = tracingNone })
+	defer h.close()
+	router, err := h.fe.router()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, traced := h.fe.handler(logrus.New(), router).(*ochttp.Handler); traced {
+		t.Error("requests traced with TRACING_BACKEND=none")
+	}
+	if n := len(h.fe.dialOptions()); n != 1 {
+		t.Errorf("%d dial options, want only the interceptors", n)
+	}
+	if resp := h.get("/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("home page: %d", resp.StatusCode)
+	}
+
+	h.fe.tracingBackend = ""
+	if _, traced := h.fe.handler(logrus.New(), router).(*ochttp.Handler); !traced {
+		t.Error("requests not traced by default")
+	}
+}
+
+func TestTracingBackendFromEnv(t *testing.T) {
+	defer os.Unsetenv("TRACING_BACKEND")
+	defer os.Unsetenv("DISABLE_TRACING")
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	for _, tc := range []struct {
+		backend, disable string
+		want             string
+	}{
+		{"", "", tracingStackdriver},
+		{"", "1", tracingNone},
+		{"otlp", "", tracingOTLP},
+		{"otlp", "1", tracingOTLP},
+		{"zipkin", "", tracingStackdriver},
+		{"none", "", tracingNone},
+	} {
+		os.Setenv("TRACING_BACKEND", tc.backend)
+		os.Setenv("DISABLE_TRACING", tc.disable)
+		if got := tracingBackendFromEnv(log); got != tc.want {
+			t.Errorf("TRACING_BACKEND=%q DISABLE_TRACING=%q: %q, want %q", tc.backend, tc.disable, got, tc.want)
+		}
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	received := make(chan otlpTraces, 1)
+	status := http.StatusOK
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("export to %s as %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var traces otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+		received <- traces
+	}))
+	defer collector.Close()
+
+	e, err := newOTLPExporter(collector.URL+"/", otlpProtocolJSON, "frontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace.RegisterExporter(e)
+	ctx, parent := trace.StartSpan(context.Background(), "GET /cart", trace.WithSampler(trace.AlwaysSample()), trace.WithSpanKind(trace.SpanKindServer))
+	_, child := trace.StartSpan(ctx, "hipstershop.CartService.GetCart", trace.WithSpanKind(trace.SpanKindClient))
+	child.AddAttributes(trace.Int64Attribute("cart.lines", 3), trace.BoolAttribute("retried", true))
+	child.SetStatus(trace.Status{Code: trace.StatusCodeUnavailable, Message: "cart down"})
+	child.End()
+	parent.End()
+	trace.UnregisterExporter(e)
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	if err := e.flush(context.Background(), log); err != nil {
+		t.Fatal(err)
+	}
+	traces := <-received
+	if len(traces.ResourceSpans) != 1 || len(traces.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("traces = %+v", traces)
+	}
+	if attrs := traces.ResourceSpans[0].Resource.Attributes; len(attrs) != 1 || *attrs[0].Value.StringValue != "frontend" {
+		t.Errorf("resource = %+v, want the service name", attrs)
+	}
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("%d spans exported, want 2", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if p.Kind != otlpKindServer || c.Kind != otlpKindClient {
+		t.Errorf("kinds = %d, %d", p.Kind, c.Kind)
+	}
+	if c.TraceID != p.TraceID || len(c.TraceID) != 32 || c.ParentSpanID != p.SpanID || p.ParentSpanID != "" {
+		t.Errorf("child %s/%s of %s, parent %s/%s of %q", c.TraceID, c.SpanID, c.ParentSpanID, p.TraceID, p.SpanID, p.ParentSpanID)
+	}
+	if len(c.Attributes) != 2 || c.Attributes[0].Key != "cart.lines" || *c.Attributes[0].Value.IntValue != "3" ||
+		!*c.Attributes[1].Value.BoolValue {
+		t.Errorf("attributes = %+v", c.Attributes)
+	}
+	if c.Status.Code != otlpStatusError || c.Status.Message != "cart down" || p.Status.Code != 0 {
+		t.Errorf("statuses = %+v, %+v", c.Status, p.Status)
+	}
+
+	status = http.StatusServiceUnavailable
+	e.ExportSpan(&trace.SpanData{Name: "lost"})
+	if err := e.flush(context.Background(), log); err == nil {
+		t.Error("no error when the collector refuses spans")
+	}
+	<-received
+}
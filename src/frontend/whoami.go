@@ -0,0 +1,120 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxActivitySessions = 1000 // sessions tracked by the activity log
+	maxSessionActivity  = 10   // requests remembered per session
+)
+
+// activityEvent is a request made by a session, as listed on /whoami.
+type activityEvent struct {
+	Time    time.Time
+	Method  string
+	Path    string
+	TraceID string
+}
+
+// sessionActivity remembers the last few requests of recently active
+// sessions so /whoami can link a session to its traces. It is bounded both
+// per session and in the number of sessions.
+type sessionActivity struct {
+	mu       sync.Mutex
+	sessions map[string][]activityEvent
+	order    []string // session IDs, least recently added first
+}
+
+func newSessionActivity() *sessionActivity {
+	return &sessionActivity{sessions: make(map[string][]activityEvent)}
+}
+
+func (a *sessionActivity) record(sessionID string, ev activityEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	events, ok := a.sessions[sessionID]
+	if !ok {
+		if len(a.order) >= maxActivitySessions {
+			delete(a.sessions, a.order[0])
+			a.order = a.order[1:]
+		}
+		a.order = append(a.order, sessionID)
+	}
+	events = append(events, ev)
+	if len(events) > maxSessionActivity {
+		events = events[len(events)-maxSessionActivity:]
+	}
+	a.sessions[sessionID] = events
+}
+
+// recent returns the session's requests, most recent first.
+func (a *sessionActivity) recent(sessionID string) []activityEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	events := a.sessions[sessionID]
+	out := make([]activityEvent, len(events))
+	for i, ev := range events {
+		out[len(events)-1-i] = ev
+	}
+	return out
+}
+
+// recordActivity is a middleware adding every page request to the session's
+// activity log.
+func (fe *frontendServer) recordActivity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := sessionID(r); id != "" && !strings.HasPrefix(r.URL.Path, "/static/") {
+			fe.activity.record(id, activityEvent{
+				Time:    fe.clock.Now(),
+				Method:  r.Method,
+				Path:    r.URL.Path,
+				TraceID: traceIDFromContext(r.Context()),
+			})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// whoamiHandler renders the state of the caller's own session. It is only
+// registered in demo mode.
+func (fe *frontendServer) whoamiHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	cart, err := fe.getCart(r.Context(), cartID(r))
+	if err != nil {
+		fe.renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
+		return
+	}
+	quantity := cartQuantity(cart)
+	fe.setCartCount(w, quantity)
+
+	fe.render(w, r, http.StatusOK, "whoami", fe.injectCommonTemplateData(r, map[string]interface{}{
+		"session_hash":  hashSessionID(sessionID(r)),
+		"user_currency": currentCurrency(r),
+		"cart_items":    cart,
+		"cart_size":     quantity,
+		"cart_lines":    len(cart),
+		"trace_id":      traceIDFromContext(r.Context()),
+		"activity":      fe.activity.recent(sessionID(r)),
+	}))
+}
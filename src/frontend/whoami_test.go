@@ -0,0 +1,82 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWhoami(t *testing.T) {
+	t.Run("absent outside demo mode", func(t *testing.T) {
+		h := newTestHarness(t)
+		defer h.close()
+		if resp := h.get("/whoami"); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET /whoami = %d, want %d", resp.StatusCode, http.StatusNotFound)
+		}
+	})
+
+	t.Run("demo mode", func(t *testing.T) {
+		h := newTestHarness(t, func(fe *frontendServer) {
+			fe.demoMode = true
+		})
+		defer h.close()
+
+		h.get("/product/OLJCESPC7Z")
+		h.post("/cart", url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"3"}})
+		resp := h.get("/whoami")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /whoami = %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+		session := h.cookie(cookieSessionID)
+		for _, want := range []string{
+			hashSessionID(session),
+			"1 line(s), 3 item(s)",
+			"GET /product/OLJCESPC7Z",
+			"POST /cart",
+		} {
+			if !strings.Contains(resp.body, want) {
+				t.Errorf("/whoami does not contain %q", want)
+			}
+		}
+	})
+}
+
+func TestSessionActivityBounds(t *testing.T) {
+	a := newSessionActivity()
+	for i := 0; i < maxSessionActivity+5; i++ {
+		a.record("s", activityEvent{Path: fmt.Sprintf("/%d", i)})
+	}
+	events := a.recent("s")
+	if len(events) != maxSessionActivity {
+		t.Fatalf("got %d events, want %d", len(events), maxSessionActivity)
+	}
+	if want := fmt.Sprintf("/%d", maxSessionActivity+4); events[0].Path != want {
+		t.Errorf("most recent event = %q, want %q", events[0].Path, want)
+	}
+
+	for i := 0; i < maxActivitySessions+1; i++ {
+		a.record(fmt.Sprintf("session-%d", i), activityEvent{})
+	}
+	if len(a.sessions) != maxActivitySessions {
+		t.Errorf("tracking %d sessions, want %d", len(a.sessions), maxActivitySessions)
+	}
+	if len(a.recent("s")) != 0 {
+		t.Error("oldest session was not evicted")
+	}
+}